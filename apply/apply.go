@@ -0,0 +1,375 @@
+// Package apply replays oplog entries on another cluster, idempotently so
+// entries already reflected on it, by a copy or an earlier partial replay,
+// can be applied again harmlessly.
+package apply
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/diff"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Entry an individual document from the oplog.rs collection. o is kept in
+// order, commands are only understood with their name first.
+type Entry struct {
+	Timestamp   bson.MongoTimestamp `bson:"ts"`
+	Operation   string              `bson:"op"`
+	Namespace   string              `bson:"ns"`
+	Object      bson.D              `bson:"o"`
+	QueryObject bson.M              `bson:"o2"`
+	Wall        time.Time           `bson:"wall"` // when the server wrote it, 3.6 onwards
+}
+
+// Filter decides which namespaces are applied
+type Filter interface {
+	DB(db string) bool // whether anything in db could be applied
+	NS(ns string) bool // whether db.collection is applied
+}
+
+// Applier applies entries on Dst. Filter sees namespaces as they're named
+// on the source, they're then renamed by Remap, given and returning db or
+// db.collection. With DryRun nothing is written, what would be is printed
+// instead, and Dst can be nil. With Conflicts set, inserts, updates and
+// deletes are checked against the document they'd change first.
+type Applier struct {
+	Dst       *mgo.Session
+	Filter    Filter
+	Remap     func(ns string) string
+	DryRun    bool
+	Conflicts *Conflicts
+}
+
+// commands on a collection that are replayed, as is or as indexCommand
+// translates them
+var collectionCommands = map[string]bool{
+	"create": true, "drop": true, "collMod": true,
+	"createIndexes": true, "dropIndexes": true, "deleteIndexes": true,
+	"commitIndexBuild": true,
+}
+
+func (a *Applier) remap(ns string) string {
+	if a.Remap == nil {
+		return ns
+	}
+	return a.Remap(ns)
+}
+
+// Apply replays o. Inserts are upserts and updates or deletes of missing
+// documents are ignored.
+func (a *Applier) Apply(o *Entry) error {
+	switch o.Operation {
+	case "n":
+		return nil
+	case "c":
+		return a.applyCommand(o)
+	}
+	if !a.Filter.NS(o.Namespace) {
+		return nil
+	}
+	ns := a.remap(o.Namespace)
+	if a.DryRun {
+		fmt.Printf("%d %s %s %v %v\n", o.Timestamp, o.Operation, ns, o.Object, o.QueryObject)
+		return nil
+	}
+	i := strings.Index(ns, ".")
+	c := a.Dst.DB(ns[:i]).C(ns[i+1:])
+	if a.Conflicts != nil {
+		id, _ := lookupID(o.Object)
+		if o.Operation == "u" {
+			id = o.QueryObject["_id"]
+		}
+		if apply, err := a.Conflicts.check(c, o, id); err != nil || !apply {
+			return err
+		}
+	}
+	var err error
+	switch o.Operation {
+	case "i":
+		id, ok := lookupID(o.Object)
+		if !ok {
+			return fmt.Errorf("insert into %s without _id", ns)
+		}
+		_, err = c.Upsert(bson.M{"_id": id}, o.Object)
+	case "u":
+		update, err := diff.Normalize(o.Object)
+		if err != nil {
+			return err
+		}
+		// array truncations go first, mongodb refuses them together with
+		// other changes to the same array
+		if len(update) > 0 && update[0].Name == "$push" {
+			err := c.Update(o.QueryObject, update[:1])
+			if err == mgo.ErrNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			update = update[1:]
+		}
+		if len(update) == 0 {
+			return nil
+		}
+		err = c.Update(o.QueryObject, update)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	case "d":
+		err = c.Remove(o.Object)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown op %q at %d", o.Operation, o.Timestamp)
+	}
+	return err
+}
+
+func lookupID(doc bson.D) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Name == "_id" {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// split splits db.collection, a db on its own having no collection
+func split(ns string) (string, string) {
+	if i := strings.Index(ns, "."); i >= 0 {
+		return ns[:i], ns[i+1:]
+	}
+	return ns, ""
+}
+
+// indexCommand returns the createIndexes command an index build logged as
+// name stands for, nil if it's not one. The oplog logs each index built by
+// createIndexes on its own, its spec inline after the collection, and from
+// 4.4 builds as started, then committed with the specs of every index.
+func indexCommand(name, coll string, rest bson.D) bson.D {
+	var specs []interface{}
+	switch name {
+	case "createIndexes":
+		specs = []interface{}{rest}
+	case "commitIndexBuild":
+		for _, e := range rest {
+			if e.Name == "indexes" {
+				specs, _ = e.Value.([]interface{})
+			}
+		}
+	default:
+		return nil
+	}
+	return bson.D{{Name: "createIndexes", Value: coll}, {Name: "indexes", Value: specs}}
+}
+
+func (a *Applier) applyCommand(o *Entry) error {
+	if len(o.Object) == 0 {
+		return nil
+	}
+	db := strings.TrimSuffix(o.Namespace, ".$cmd")
+	name := o.Object[0].Name
+	arg, _ := o.Object[0].Value.(string)
+	switch {
+	case collectionCommands[name]:
+		if !a.Filter.NS(db + "." + arg) {
+			return nil
+		}
+		db, coll := split(a.remap(db + "." + arg))
+		cmd := indexCommand(name, coll, o.Object[1:])
+		if cmd == nil {
+			cmd = append(bson.D{{Name: name, Value: coll}}, o.Object[1:]...)
+		}
+		if a.DryRun {
+			fmt.Printf("%d c %s.$cmd %v\n", o.Timestamp, db, cmd)
+			return nil
+		}
+		err := a.Dst.DB(db).Run(cmd, nil)
+		if qerr, ok := err.(*mgo.QueryError); ok && (qerr.Code == 26 || qerr.Code == 48) {
+			return nil // dropped or created already
+		}
+		return err
+	case name == "startIndexBuild" || name == "abortIndexBuild":
+		return nil // the indexes are created once the build's committed
+	case name == "dropDatabase":
+		// only what's applied is dropped, the target may hold more. The
+		// collections are gone from the source by now, those the db is
+		// renamed to are dropped, not those renamed one by one elsewhere.
+		if !a.Filter.DB(db) {
+			return nil
+		}
+		to := a.remap(db)
+		if a.DryRun {
+			fmt.Printf("%d c %s.$cmd dropDatabase, the collections applied\n", o.Timestamp, to)
+			return nil
+		}
+		names, err := a.Dst.DB(to).CollectionNames()
+		if err != nil {
+			return err
+		}
+		for _, c := range names {
+			if a.Filter.NS(db+"."+c) && a.remap(db+"."+c) == to+"."+c {
+				if err := a.Dst.DB(to).C(c).DropCollection(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case name == "renameCollection":
+		var to string
+		for _, e := range o.Object {
+			if e.Name == "to" {
+				to, _ = e.Value.(string)
+			}
+		}
+		from := arg
+		switch {
+		case a.Filter.NS(from) && a.Filter.NS(to):
+			from, to := a.remap(from), a.remap(to)
+			cmd := bson.D{{Name: "renameCollection", Value: from}, {Name: "to", Value: to}}
+			for _, e := range o.Object {
+				if e.Name != "renameCollection" && e.Name != "to" {
+					cmd = append(cmd, e)
+				}
+			}
+			if a.DryRun {
+				fmt.Printf("%d c admin.$cmd %v\n", o.Timestamp, cmd)
+				return nil
+			}
+			return a.Dst.Run(cmd, nil)
+		case a.Filter.NS(from) || a.Filter.NS(to):
+			fmt.Fprintf(os.Stderr, "skipping rename of %s to %s, only one side is applied\n", from, to)
+		}
+		return nil
+	case name == "applyOps":
+		return a.applyOps(o)
+	}
+	fmt.Fprintf(os.Stderr, "skipping %s command on %s at %d\n", name, db, o.Timestamp)
+	return nil
+}
+
+// applyOps replays the operations of a transaction. Unprepared ones are
+// only logged once committed, partialTxn entries included, so each entry
+// can be applied as it comes. Prepared ones may still be aborted and are
+// only logged on shards, which aren't applied from directly.
+func (a *Applier) applyOps(o *Entry) error {
+	inner, err := transaction(o)
+	if err != nil {
+		return err
+	}
+	for i := range inner {
+		if err := a.Apply(&inner[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transaction returns the entries of the applyOps command o, with its ts
+// and wall since they carry neither, so their conflicts are checked by
+// when the transaction was written. A prepared one has none.
+func transaction(o *Entry) ([]Entry, error) {
+	var ops []interface{}
+	for _, e := range o.Object {
+		switch e.Name {
+		case "applyOps":
+			ops, _ = e.Value.([]interface{})
+		case "prepare":
+			if e.Value == true {
+				fmt.Fprintf(os.Stderr, "skipping prepared transaction at %d\n", o.Timestamp)
+				return nil, nil
+			}
+		}
+	}
+	var entries []Entry
+	for _, op := range ops {
+		data, err := bson.Marshal(op)
+		if err != nil {
+			return nil, err
+		}
+		var inner Entry
+		if err := bson.Unmarshal(data, &inner); err != nil {
+			return nil, err
+		}
+		// set after, unmarshaling zeroes them
+		inner.Timestamp, inner.Wall = o.Timestamp, o.Wall
+		entries = append(entries, inner)
+	}
+	return entries, nil
+}
+
+// ApplyOps applies CRUD entries together in one applyOps command, which
+// mongodb applies atomically on a replica set. Commands have to go
+// through Apply, and Conflicts aren't checked.
+func (a *Applier) ApplyOps(entries []Entry) error {
+	ops, err := a.ops(entries)
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+	if a.DryRun {
+		fmt.Printf("applyOps %v\n", ops)
+		return nil
+	}
+	var res struct {
+		Applied int `bson:"applied"`
+	}
+	return a.Dst.Run(bson.D{{Name: "applyOps", Value: ops}}, &res)
+}
+
+// ops returns the operations of an applyOps command applying entries.
+// Updates are normalized as Apply does, an array truncation becoming an
+// operation of its own ahead of the rest of the update.
+func (a *Applier) ops(entries []Entry) ([]bson.D, error) {
+	ops := make([]bson.D, 0, len(entries))
+	for _, o := range entries {
+		switch {
+		case o.Operation == "n" || !a.Filter.NS(o.Namespace):
+			continue
+		case o.Operation == "c":
+			return nil, fmt.Errorf("command at %d can't be part of applyOps", o.Timestamp)
+		}
+		ns := a.remap(o.Namespace)
+		updates := []bson.D{o.Object}
+		if o.Operation == "u" {
+			update, err := diff.Normalize(o.Object)
+			if err != nil {
+				return nil, err
+			}
+			updates = []bson.D{update}
+			switch {
+			case len(update) == 0:
+				continue // an empty update would replace the document
+			case len(update) > 1 && update[0].Name == "$push":
+				updates = []bson.D{update[:1], update[1:]}
+			}
+		}
+		for _, update := range updates {
+			op := bson.D{{Name: "op", Value: o.Operation}, {Name: "ns", Value: ns}, {Name: "o", Value: update}}
+			if o.QueryObject != nil {
+				op = append(op, bson.DocElem{Name: "o2", Value: o.QueryObject})
+			}
+			ops = append(ops, op)
+		}
+	}
+	return ops, nil
+}
+
+// UserData applies everything but admin, local, config and system
+// collections
+type UserData struct{}
+
+func (UserData) DB(db string) bool {
+	return db != "admin" && db != "local" && db != "config"
+}
+
+func (u UserData) NS(ns string) bool {
+	db, coll := split(ns)
+	return u.DB(db) && coll != "" && !strings.HasPrefix(coll, "system.")
+}
@@ -0,0 +1,164 @@
+package apply
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// d is a bson.D of name, value pairs
+func d(pairs ...interface{}) bson.D {
+	var doc bson.D
+	for i := 0; i < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
+
+func TestApplyOpsNormalizes(t *testing.T) {
+	a := &Applier{Filter: UserData{}, Remap: func(ns string) string { return strings.Replace(ns, "shop.", "mirror.", 1) }}
+	id := bson.M{"_id": 7}
+	ops, err := a.ops([]Entry{
+		{Operation: "n", Namespace: ""},
+		{Operation: "i", Namespace: "shop.orders", Object: d("_id", 7, "items", []interface{}{"a", "b", "c"})},
+		{Operation: "u", Namespace: "shop.orders", QueryObject: id, Object: d("$v", 1, "$set", d("paid", true))},
+		{Operation: "u", Namespace: "shop.orders", QueryObject: id, Object: d("$v", 2, "diff", d(
+			"u", d("status", "sent"),
+			"sitems", d("a", true, "l", 2, "u1", "z"),
+		))},
+		{Operation: "u", Namespace: "shop.orders", QueryObject: id, Object: d("$v", 2, "diff", d("d", d("note", false)))},
+		{Operation: "u", Namespace: "shop.orders", QueryObject: id, Object: d("$v", 2, "diff", d())},
+		{Operation: "i", Namespace: "admin.system.users", Object: d("_id", "admin.ada")},
+		{Operation: "d", Namespace: "shop.orders", Object: d("_id", 7)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bson.D{
+		d("op", "i", "ns", "mirror.orders", "o", d("_id", 7, "items", []interface{}{"a", "b", "c"})),
+		d("op", "u", "ns", "mirror.orders", "o", d("$set", d("paid", true)), "o2", id),
+		// the truncation on its own, mongodb refuses it with the $set of an element
+		d("op", "u", "ns", "mirror.orders", "o", d("$push", d("items", d("$each", []interface{}{}, "$slice", 2))), "o2", id),
+		d("op", "u", "ns", "mirror.orders", "o", d("$set", d("status", "sent", "items.1", "z")), "o2", id),
+		d("op", "u", "ns", "mirror.orders", "o", d("$unset", d("note", true)), "o2", id),
+		d("op", "d", "ns", "mirror.orders", "o", d("_id", 7)),
+	}
+	if len(ops) != len(want) {
+		t.Fatalf("%d ops, want %d:\n%v", len(ops), len(want), ops)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(ops[i], want[i]) {
+			t.Errorf("op %d is %v, want %v", i, ops[i], want[i])
+		}
+	}
+}
+
+func TestApplyOpsInvalid(t *testing.T) {
+	a := &Applier{Filter: UserData{}}
+	for _, c := range []struct {
+		entry Entry
+		err   string
+	}{
+		{Entry{Timestamp: 5, Operation: "c", Namespace: "shop.$cmd", Object: d("drop", "orders")}, "command at 5 can't be part of applyOps"},
+		{Entry{Operation: "u", Namespace: "shop.orders", Object: d("$v", 2)}, "v2 update without diff"},
+		{Entry{Operation: "u", Namespace: "shop.orders", Object: d("$v", 2, "diff", d("x", d()))}, "unknown diff section"},
+	} {
+		if _, err := a.ops([]Entry{c.entry}); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: %v, want %q", c.entry.Object, err, c.err)
+		}
+	}
+	if err := a.ApplyOps([]Entry{{Operation: "i", Namespace: "local.oplog.rs"}}); err != nil {
+		t.Errorf("nothing to apply: %s", err)
+	}
+}
+
+// txn is an applyOps entry written at wall, of an update stamping nothing
+// and an insert stamped updated
+func txn(wall, updated time.Time) *Entry {
+	return &Entry{
+		Timestamp: 9 << 32, Operation: "c", Namespace: "admin.$cmd", Wall: wall,
+		Object: d("applyOps", []interface{}{
+			d("op", "u", "ns", "shop.orders", "o", d("$v", 1, "$inc", d("n", 1)), "o2", d("_id", 1)),
+			d("op", "i", "ns", "shop.orders", "o", d("_id", 2, "updatedAt", updated)),
+		}),
+	}
+}
+
+func TestTransactionVersions(t *testing.T) {
+	wall := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	updated := wall.Add(-time.Hour)
+	inner, err := transaction(txn(wall, updated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inner) != 2 {
+		t.Fatalf("%d entries, want 2", len(inner))
+	}
+	cs := &Conflicts{Field: "updatedAt"}
+	for i, want := range []time.Time{wall, updated} {
+		if inner[i].Timestamp != 9<<32 {
+			t.Errorf("entry %d at %d, want the transaction's ts", i, inner[i].Timestamp)
+		}
+		if v, ok := cs.version(&inner[i]).(time.Time); !ok || !v.Equal(want) {
+			t.Errorf("entry %d versioned %v, want %v", i, cs.version(&inner[i]), want)
+		}
+	}
+
+	prepared := txn(wall, updated)
+	prepared.Object = append(prepared.Object, bson.DocElem{Name: "prepare", Value: true})
+	if inner, err := transaction(prepared); err != nil || len(inner) != 0 {
+		t.Errorf("prepared: %d entries, %v, want none", len(inner), err)
+	}
+}
+
+// TestConflictingTransaction applies a transaction older than the target's
+// documents. It needs mongodb at MONGO_URL, and is skipped without one.
+func TestConflictingTransaction(t *testing.T) {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("no mongodb, MONGO_URL is empty")
+	}
+	sess, err := mgo.DialWithTimeout(url, 2*time.Second)
+	if err != nil {
+		t.Skipf("no mongodb at MONGO_URL: %s", err)
+	}
+	defer sess.Close()
+	c := sess.DB("apply_test").C("orders")
+	defer sess.DB("apply_test").DropDatabase()
+	c.DropCollection()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if err := c.Insert(bson.M{"_id": 1, "n": 0, "updatedAt": now}, bson.M{"_id": 2, "updatedAt": now}); err != nil {
+		t.Fatal(err)
+	}
+
+	var conflicts []Conflict
+	a := &Applier{
+		Dst:       sess,
+		Filter:    UserData{},
+		Remap:     func(ns string) string { return strings.Replace(ns, "shop.", "apply_test.", 1) },
+		Conflicts: &Conflicts{Field: "updatedAt", Resolve: TargetWins, Report: func(c Conflict) { conflicts = append(conflicts, c) }},
+	}
+	if err := a.Apply(txn(now.Add(-time.Minute), now.Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 {
+		t.Errorf("%d conflicts, want both of the transaction's: %v", len(conflicts), conflicts)
+	}
+	var doc bson.M
+	if err := c.FindId(1).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["n"] != 0 {
+		t.Errorf("the older update was applied: %v", doc)
+	}
+
+	a.Conflicts.Resolve = Fail
+	if err := a.Apply(txn(now.Add(-time.Minute), now.Add(-time.Hour))); err == nil {
+		t.Error("a conflicting transaction applied with the fail resolution")
+	}
+}
@@ -0,0 +1,163 @@
+package apply
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/diff"
+	"github.com/hanjoyo/oplog-abuse/optime"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Conflict is a write the target took since, found when an entry would
+// overwrite it
+type Conflict struct {
+	TS         string      `json:"ts"`
+	Namespace  string      `json:"ns"` // as applied, remapped
+	ID         interface{} `json:"_id"`
+	Operation  string      `json:"op"`
+	Source     interface{} `json:"source"` // the entry's version
+	Target     interface{} `json:"target"` // the target document's
+	Resolution string      `json:"resolution"`
+}
+
+// Resolutions of a conflict
+const (
+	SourceWins = "source" // the entry is applied anyway
+	TargetWins = "target" // the entry is skipped
+	Fail       = "fail"   // applying stops with an error
+)
+
+// Conflicts finds entries older than the target document they'd change,
+// by a version Field documents carry, such as an updatedAt date or a
+// revision number. Entries not setting it, and deletes, are versioned by
+// when they were written instead, the field has to hold dates for them to
+// be checked. Each conflict is passed to Report and resolved by Resolve.
+type Conflicts struct {
+	Field   string
+	Resolve string
+	Report  func(Conflict)
+}
+
+// check returns whether o should be applied to c, the document it changes
+// being id
+func (cs *Conflicts) check(c *mgo.Collection, o *Entry, id interface{}) (bool, error) {
+	source := cs.version(o)
+	if source == nil {
+		return true, nil
+	}
+	var doc bson.M
+	err := c.FindId(id).Select(bson.M{cs.Field: 1}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	target := lookup(doc, cs.Field)
+	if !newer(target, source) {
+		return true, nil
+	}
+	conflict := Conflict{
+		TS:         optime.Format(o.Timestamp),
+		Namespace:  c.FullName,
+		ID:         id,
+		Operation:  o.Operation,
+		Source:     source,
+		Target:     target,
+		Resolution: cs.Resolve,
+	}
+	if cs.Report != nil {
+		cs.Report(conflict)
+	}
+	switch cs.Resolve {
+	case SourceWins:
+		return true, nil
+	case TargetWins:
+		return false, nil
+	}
+	return false, fmt.Errorf("%s %v on %s is newer on the target, %v over %v", cs.Field, id, c.FullName, target, source)
+}
+
+// version returns the version o writes, nil if it has none
+func (cs *Conflicts) version(o *Entry) interface{} {
+	switch o.Operation {
+	case "i":
+		if v := lookup(o.Object.Map(), cs.Field); v != nil {
+			return v
+		}
+	case "u":
+		update, err := diff.Normalize(o.Object)
+		if err != nil {
+			return nil
+		}
+		if len(update) == 0 || !strings.HasPrefix(update[0].Name, "$") {
+			// a whole replacement
+			if v := lookup(o.Object.Map(), cs.Field); v != nil {
+				return v
+			}
+			break
+		}
+		for _, op := range update {
+			if set, ok := op.Value.(bson.D); ok && op.Name == "$set" {
+				for _, e := range set {
+					if e.Name == cs.Field {
+						return e.Value
+					}
+				}
+			}
+		}
+	}
+	if o.Wall.IsZero() {
+		return nil
+	}
+	return o.Wall
+}
+
+// lookup returns doc's dotted path, nil if missing
+func lookup(doc bson.M, path string) interface{} {
+	var v interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		switch m := v.(type) {
+		case bson.M:
+			v = m[key]
+		case bson.D:
+			v = m.Map()[key]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// newer reports whether a is a later version than b, false when they
+// can't be compared
+func newer(a, b interface{}) bool {
+	if at, ok := a.(time.Time); ok {
+		bt, ok := b.(time.Time)
+		return ok && at.After(bt)
+	}
+	af, ok := number(a)
+	if !ok {
+		return false
+	}
+	bf, ok := number(b)
+	return ok && af > bf
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bson.MongoTimestamp:
+		return float64(n), true
+	}
+	return 0, false
+}
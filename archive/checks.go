@@ -0,0 +1,25 @@
+package archive
+
+import (
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		return []cli.Check{
+			{Name: "MONGO_URL", Run: func() error {
+				return dial.Probe(*mongoURL, dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}})
+			}},
+			{Name: "ARCHIVE " + *archive, Run: func() error {
+				store, err := pitr.Open(*archive)
+				if err != nil {
+					return err
+				}
+				_, err = store.List()
+				return err
+			}},
+		}
+	})
+}
@@ -0,0 +1,199 @@
+// Package archive archives the oplog to a directory or s3 in segments, the oplogctl archive command.
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("archive", "archive the oplog in segments to a directory or s3")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL      = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the replica set to archive the oplog of")
+	archive       = flags.String("ARCHIVE", "", "directory or s3://bucket/prefix the archive is kept in")
+	segmentSpan   = flags.Duration("ARCHIVE_SEGMENT", 10*time.Minute, "longest a segment is kept open, the most a crash loses to be archived again")
+	segmentSize   = flags.Int("ARCHIVE_SEGMENT_SIZE", 64<<20, "bytes a segment is closed at")
+	baseMark      = flags.String("BASE_MARK", "", "record a base marker of this name at the oplog's latest ts and exit, start the base backup right after")
+	resumeRetries = flags.Int("RESUME_RETRIES", 5, "times in a row a failed oplog cursor is resumed before giving up")
+)
+
+type entry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+}
+
+func oplogEdge(sess *mgo.Session, sort string) (bson.MongoTimestamp, error) {
+	var e entry
+	err := sess.DB("local").C("oplog.rs").Find(nil).Select(bson.M{"ts": 1}).Sort(sort).One(&e)
+	return e.Timestamp, err
+}
+
+// resumePoint is where the archive ends, the last segment or else the
+// newest base marker
+func resumePoint(store pitr.Store) (bson.MongoTimestamp, error) {
+	segments, err := pitr.Segments(store)
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) > 0 {
+		return segments[len(segments)-1].Last, nil
+	}
+	bases, err := pitr.Bases(store)
+	if err != nil {
+		return 0, err
+	}
+	if len(bases) == 0 {
+		return 0, errors.New("no base marker to archive from, record one with BASE_MARK before taking the base backup")
+	}
+	return bases[len(bases)-1].TS, nil
+}
+
+// segmenter gathers the entries read into segments put to a store
+type segmenter struct {
+	store  pitr.Store
+	buf    bytes.Buffer
+	pos    bson.MongoTimestamp // archived up to
+	last   bson.MongoTimestamp // read up to, across cursors
+	opened time.Time
+}
+
+// add adds the entry raw of ts to the open segment
+func (s *segmenter) add(raw []byte, ts bson.MongoTimestamp) {
+	s.buf.Write(raw)
+	s.last = ts
+}
+
+// due reports whether the open segment is full or has been open long
+// enough to be put
+func (s *segmenter) due() bool {
+	return s.buf.Len() >= *segmentSize || time.Since(s.opened) >= *segmentSpan
+}
+
+// flush puts the open segment, if it holds anything, and opens the next
+func (s *segmenter) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	seg := pitr.Segment{After: s.pos, Last: s.last}
+	if err := s.store.Put(seg.Name(), s.buf.Bytes()); err != nil {
+		return err
+	}
+	fmt.Printf("archived %s, %d bytes\n", seg.Name(), s.buf.Len())
+	s.pos = s.last
+	s.buf.Reset()
+	s.opened = time.Now()
+	return nil
+}
+
+// Main runs oplogctl archive, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *archive == "" {
+		panic(cli.Invalidf("ARCHIVE not set"))
+	}
+	store, err := pitr.Open(*archive)
+	if err != nil {
+		panic(err)
+	}
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	err = dial.CheckPrivileges(sess,
+		dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	if *baseMark != "" {
+		ts, err := oplogEdge(sess, "-$natural")
+		if err != nil {
+			panic(err)
+		}
+		if err := pitr.PutBase(store, pitr.Base{Name: *baseMark, TS: ts, At: time.Now()}); err != nil {
+			panic(err)
+		}
+		fmt.Printf("base %s marked at %s, start the base backup now\n", *baseMark, optime.Format(ts))
+		return
+	}
+
+	pos, err := resumePoint(store)
+	if err != nil {
+		panic(err)
+	}
+	// entries after pos have to still be there, or the archive has a gap
+	oldest, err := oplogEdge(sess, "$natural")
+	if err != nil {
+		panic(err)
+	}
+	if oldest > pos {
+		panic(cli.RolledOverf("the oplog starts at %s, entries after %s were lost, mark and take a new base backup", optime.Format(oldest), optime.Format(pos)))
+	}
+	fmt.Printf("archiving to %s after %s\n", *archive, optime.Format(pos))
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	seg := &segmenter{store: store, pos: pos, last: pos, opened: time.Now()}
+	flush := func() {
+		if err := seg.flush(); err != nil {
+			panic(err)
+		}
+	}
+
+	for failures := 0; ; failures++ {
+		iter := sess.DB("local").
+			C("oplog.rs").
+			Find(bson.M{"ts": bson.M{"$gt": seg.last}}).
+			Sort("$natural").
+			LogReplay().
+			Tail(time.Second)
+		var raw bson.Raw
+		for {
+			if iter.Next(&raw) {
+				failures = 0
+				var e entry
+				if err := raw.Unmarshal(&e); err != nil {
+					panic(err)
+				}
+				seg.add(raw.Data, e.Timestamp)
+			} else if !iter.Timeout() {
+				break
+			}
+			if seg.due() {
+				flush()
+			}
+			select {
+			case <-stop:
+				iter.Close()
+				flush()
+				return
+			default:
+			}
+		}
+		err = iter.Close()
+		if failures >= *resumeRetries {
+			panic(err)
+		}
+		fmt.Fprintf(os.Stderr, "oplog cursor failed: %v, resuming\n", err)
+		time.Sleep(time.Second)
+		sess.Refresh()
+	}
+}
@@ -0,0 +1,103 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/pitr"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestResumePoint(t *testing.T) {
+	store, err := pitr.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resumePoint(store); err == nil || !strings.Contains(err.Error(), "no base marker") {
+		t.Errorf("an empty archive: %v", err)
+	}
+	for _, b := range []pitr.Base{{Name: "monday", TS: 100 << 32}, {Name: "tuesday", TS: 200 << 32}} {
+		if err := pitr.PutBase(store, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pos, err := resumePoint(store); pos != 200<<32 || err != nil {
+		t.Errorf("from the newest base: %d, %v", pos, err)
+	}
+	for _, seg := range []pitr.Segment{{After: 200 << 32, Last: 250 << 32}, {After: 250 << 32, Last: 300 << 32}} {
+		if err := store.Put(seg.Name(), []byte{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pos, err := resumePoint(store); pos != 300<<32 || err != nil {
+		t.Errorf("from the last segment: %d, %v", pos, err)
+	}
+}
+
+func TestSegmenter(t *testing.T) {
+	defer func(size int, span time.Duration) { *segmentSize, *segmentSpan = size, span }(*segmentSize, *segmentSpan)
+	*segmentSize, *segmentSpan = 10, time.Hour
+	store, err := pitr.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &segmenter{store: store, pos: 1 << 32, last: 1 << 32, opened: time.Now()}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := store.List(); len(names) != 0 {
+		t.Errorf("an empty segment put: %v", names)
+	}
+
+	s.add([]byte("abcd"), 2<<32)
+	s.add([]byte("efgh"), 3<<32)
+	if s.due() {
+		t.Error("due at 8 bytes of 10")
+	}
+	s.add([]byte("ij"), 4<<32)
+	if !s.due() {
+		t.Error("not due at 10 bytes of 10")
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.add([]byte("kl"), 5<<32)
+	s.opened = time.Now().Add(-2 * time.Hour)
+	if !s.due() {
+		t.Error("not due open past ARCHIVE_SEGMENT")
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s.pos != 5<<32 || s.buf.Len() != 0 || time.Since(s.opened) > time.Minute {
+		t.Errorf("after flushing: pos %d, %d bytes held, opened %s", s.pos, s.buf.Len(), s.opened)
+	}
+
+	segments, err := pitr.Segments(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pitr.Segment{{After: 1 << 32, Last: 4 << 32}, {After: 4 << 32, Last: 5 << 32}}
+	if len(segments) != 2 || segments[0] != want[0] || segments[1] != want[1] {
+		t.Fatalf("segments %v, want %v", segments, want)
+	}
+	for i, data := range []string{"abcdefghij", "kl"} {
+		f, err := store.Open(segments[i].Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(f)
+		f.Close()
+		if !bytes.Equal(got, []byte(data)) {
+			t.Errorf("segment %d holds %q, want %q", i, got, data)
+		}
+	}
+	// the archive goes on from the last segment
+	if pos, err := resumePoint(store); pos != bson.MongoTimestamp(5<<32) || err != nil {
+		t.Errorf("resumes from %d, %v", pos, err)
+	}
+}
@@ -0,0 +1,300 @@
+// Package avro writes Apache Avro object container files of oplog entries,
+// uncompressed. An entry's a Document of its fields in order, each value a
+// union of the bson types, so it's kept as is, but for the deprecated
+// undefined, symbol and db pointer types that aren't encoded. That's what
+// dump writes for FORMAT=avro, not a general purpose writer.
+package avro
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Schema is the schema of the entries written, a Document. The branches of
+// Value's union are in the order of the union* constants.
+const Schema = `{"type": "record", "name": "Document", "namespace": "oplog", "fields": [
+  {"name": "fields", "type": {"type": "array", "items": {"type": "record", "name": "Field", "fields": [
+    {"name": "name", "type": "string"},
+    {"name": "value", "type": {"type": "record", "name": "Value", "fields": [
+      {"name": "v", "type": [
+        "null", "boolean", "int", "long", "double", "string", "Document",
+        {"type": "array", "items": "Value"},
+        {"type": "fixed", "name": "ObjectId", "size": 12},
+        {"type": "record", "name": "Decimal128", "fields": [{"name": "value", "type": "string"}]},
+        {"type": "record", "name": "Date", "fields": [{"name": "millis", "type": {"type": "long", "logicalType": "timestamp-millis"}}]},
+        {"type": "record", "name": "Timestamp", "fields": [{"name": "t", "type": "long"}, {"name": "i", "type": "long"}]},
+        {"type": "record", "name": "Binary", "fields": [{"name": "subtype", "type": "int"}, {"name": "data", "type": "bytes"}]},
+        {"type": "record", "name": "Regex", "fields": [{"name": "pattern", "type": "string"}, {"name": "options", "type": "string"}]},
+        {"type": "record", "name": "JavaScript", "fields": [{"name": "code", "type": "string"}, {"name": "scope", "type": ["null", "Document"]}]},
+        {"type": "enum", "name": "Bound", "symbols": ["MinKey", "MaxKey"]}
+      ]}
+    ]}}
+  ]}}}
+]}
+`
+
+// the branches of Value's union
+const (
+	unionNull = iota
+	unionBoolean
+	unionInt
+	unionLong
+	unionDouble
+	unionString
+	unionDocument
+	unionArray
+	unionObjectID
+	unionDecimal128
+	unionDate
+	unionTimestamp
+	unionBinary
+	unionRegex
+	unionJavaScript
+	unionBound
+)
+
+// blockSize is about how much of the entries go in a block
+const blockSize = 1 << 20
+
+var magic = []byte("Obj\x01")
+
+// sync is the marker between blocks. It's the same in every file, for dumps
+// of the same entries to be the same, the spec only asks it be unlikely in
+// the data.
+var sync = func() []byte {
+	sum := sha256.Sum256([]byte(Schema))
+	return sum[:16]
+}()
+
+// Encode returns the binary encoding of an entry, the raw bson of it, as a
+// Document
+func Encode(raw []byte) ([]byte, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var e encoder
+	if err := e.document(doc); err != nil {
+		return nil, err
+	}
+	return e.b, nil
+}
+
+// Writer writes an object container file of entries to w, a block at a time
+type Writer struct {
+	w      io.Writer
+	header bool
+	block  []byte
+	n      int // entries in block
+}
+
+// NewWriter returns a Writer of a file to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write adds an entry, the raw bson of it, to the file
+func (w *Writer) Write(raw []byte) error {
+	datum, err := Encode(raw)
+	if err != nil {
+		return err
+	}
+	w.block = append(w.block, datum...)
+	w.n++
+	if len(w.block) >= blockSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// Close writes the entries not written yet, and the header of a file of none.
+// It doesn't close the writer underneath.
+func (w *Writer) Close() error {
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	var e encoder
+	if !w.header {
+		e.b = append(e.b, magic...)
+		// the metadata, a map of bytes
+		e.long(2)
+		e.string("avro.codec")
+		e.string("null")
+		e.string("avro.schema")
+		e.string(Schema)
+		e.long(0)
+		e.b = append(e.b, sync...)
+		w.header = true
+	}
+	if w.n > 0 {
+		e.long(int64(w.n))
+		e.long(int64(len(w.block)))
+		e.b = append(e.b, w.block...)
+		e.b = append(e.b, sync...)
+		w.block, w.n = w.block[:0], 0
+	}
+	_, err := w.w.Write(e.b)
+	return err
+}
+
+// encoder appends the binary encoding of values to b
+type encoder struct {
+	b []byte
+}
+
+// long appends n zigzag varint encoded, as ints are too
+func (e *encoder) long(n int64) {
+	u := uint64(n<<1 ^ n>>63)
+	for u >= 0x80 {
+		e.b = append(e.b, byte(u)|0x80)
+		u >>= 7
+	}
+	e.b = append(e.b, byte(u))
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.long(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.long(int64(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) document(doc bson.D) error {
+	if len(doc) > 0 {
+		e.long(int64(len(doc)))
+	}
+	for _, field := range doc {
+		e.string(field.Name)
+		if err := e.value(field.Value); err != nil {
+			return fmt.Errorf("%s: %s", field.Name, err)
+		}
+	}
+	e.long(0)
+	return nil
+}
+
+func (e *encoder) value(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.long(unionNull)
+	case bool:
+		e.long(unionBoolean)
+		if v {
+			e.b = append(e.b, 1)
+		} else {
+			e.b = append(e.b, 0)
+		}
+	case int:
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			e.long(unionLong)
+		} else {
+			e.long(unionInt)
+		}
+		e.long(int64(v))
+	case int64:
+		e.long(unionLong)
+		e.long(v)
+	case float64:
+		e.long(unionDouble)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		e.b = append(e.b, b[:]...)
+	case string:
+		e.long(unionString)
+		e.string(v)
+	case bson.D:
+		e.long(unionDocument)
+		return e.document(v)
+	case bson.M:
+		e.long(unionDocument)
+		return e.document(sorted(v))
+	case []interface{}:
+		e.long(unionArray)
+		if len(v) > 0 {
+			e.long(int64(len(v)))
+		}
+		for i, elem := range v {
+			if err := e.value(elem); err != nil {
+				return fmt.Errorf("%d: %s", i, err)
+			}
+		}
+		e.long(0)
+	case bson.ObjectId:
+		if len(v) != 12 {
+			return fmt.Errorf("object id of %d bytes", len(v))
+		}
+		e.long(unionObjectID)
+		e.b = append(e.b, v...)
+	case bson.Decimal128:
+		e.long(unionDecimal128)
+		e.string(v.String())
+	case time.Time:
+		e.long(unionDate)
+		e.long(v.Unix()*1e3 + int64(v.Nanosecond()/1e6))
+	case bson.MongoTimestamp:
+		e.long(unionTimestamp)
+		e.long(int64(uint64(v) >> 32))
+		e.long(int64(uint32(v)))
+	case []byte:
+		e.long(unionBinary)
+		e.long(0)
+		e.bytes(v)
+	case bson.Binary:
+		e.long(unionBinary)
+		e.long(int64(v.Kind))
+		e.bytes(v.Data)
+	case bson.RegEx:
+		e.long(unionRegex)
+		e.string(v.Pattern)
+		e.string(v.Options)
+	case bson.JavaScript:
+		e.long(unionJavaScript)
+		e.string(v.Code)
+		if v.Scope == nil {
+			e.long(0)
+			return nil
+		}
+		e.long(1)
+		switch scope := v.Scope.(type) {
+		case bson.D:
+			return e.document(scope)
+		case bson.M:
+			return e.document(sorted(scope))
+		}
+		return fmt.Errorf("javascript scope of %T", v.Scope)
+	default:
+		switch v {
+		case bson.MinKey:
+			e.long(unionBound)
+			e.long(0)
+		case bson.MaxKey:
+			e.long(unionBound)
+			e.long(1)
+		default:
+			return fmt.Errorf("can't encode %T", v)
+		}
+	}
+	return nil
+}
+
+// sorted returns m as a document in the order of its keys, which a map
+// doesn't keep
+func sorted(m bson.M) bson.D {
+	doc := make(bson.D, 0, len(m))
+	for k, v := range m {
+		doc = append(doc, bson.DocElem{Name: k, Value: v})
+	}
+	sort.Slice(doc, func(i, j int) bool { return doc[i].Name < doc[j].Name })
+	return doc
+}
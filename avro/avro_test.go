@@ -0,0 +1,345 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/oplogtest"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// reader reads the binary encoding back, a Document as a bson.D of the
+// types bson.Unmarshal gives
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+	r.b = nil
+}
+
+func (r *reader) long() int64 {
+	var u uint64
+	for shift := uint(0); ; shift += 7 {
+		if len(r.b) == 0 || shift > 63 {
+			r.fail("bad long")
+			return 0
+		}
+		c := r.b[0]
+		r.b = r.b[1:]
+		u |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			break
+		}
+	}
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *reader) fixed(n int) []byte {
+	if n < 0 || n > len(r.b) {
+		r.fail("%d bytes past the end", n)
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) bytes() []byte  { return r.fixed(int(r.long())) }
+func (r *reader) string() string { return string(r.bytes()) }
+
+// blocks reads the blocks of an array or map, calling item for each
+func (r *reader) blocks(item func()) {
+	for r.err == nil {
+		n := r.long()
+		if n == 0 {
+			return
+		}
+		if n < 0 {
+			// a negative count is followed by the block's size
+			n = -n
+			r.long()
+		}
+		for ; n > 0 && r.err == nil; n-- {
+			item()
+		}
+	}
+}
+
+func (r *reader) document() bson.D {
+	doc := bson.D{}
+	r.blocks(func() {
+		name := r.string()
+		doc = append(doc, bson.DocElem{Name: name, Value: r.value()})
+	})
+	return doc
+}
+
+func (r *reader) value() interface{} {
+	switch branch := r.long(); branch {
+	case unionNull:
+		return nil
+	case unionBoolean:
+		return r.fixed(1)[0] == 1
+	case unionInt:
+		return int(r.long())
+	case unionLong:
+		return r.long()
+	case unionDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(r.fixed(8)))
+	case unionString:
+		return r.string()
+	case unionDocument:
+		return r.document()
+	case unionArray:
+		array := []interface{}{}
+		r.blocks(func() { array = append(array, r.value()) })
+		return array
+	case unionObjectID:
+		return bson.ObjectId(r.fixed(12))
+	case unionDecimal128:
+		d, err := bson.ParseDecimal128(r.string())
+		if err != nil {
+			r.fail("%s", err)
+		}
+		return d
+	case unionDate:
+		// as bson.Unmarshal reads it, the zero time.Time in UTC
+		if ms := r.long(); ms != -62135596800000 {
+			return time.Unix(ms/1e3, ms%1e3*1e6)
+		}
+		return time.Time{}
+	case unionTimestamp:
+		t, i := r.long(), r.long()
+		return bson.MongoTimestamp(t<<32 | i)
+	case unionBinary:
+		kind, data := byte(r.long()), r.bytes()
+		if kind == 0 {
+			return data
+		}
+		return bson.Binary{Kind: kind, Data: data}
+	case unionRegex:
+		return bson.RegEx{Pattern: r.string(), Options: r.string()}
+	case unionJavaScript:
+		js := bson.JavaScript{Code: r.string()}
+		if r.long() == 1 {
+			scope := bson.M{}
+			for _, e := range r.document() {
+				scope[e.Name] = e.Value
+			}
+			js.Scope = scope
+		}
+		return js
+	case unionBound:
+		if r.long() == 0 {
+			return bson.MinKey
+		}
+		return bson.MaxKey
+	default:
+		r.fail("unknown branch %d", branch)
+		return nil
+	}
+}
+
+// readFile reads a container file, its metadata and entries
+func readFile(t *testing.T, file []byte) (map[string]string, []bson.D) {
+	t.Helper()
+	if !bytes.HasPrefix(file, magic) {
+		t.Fatalf("file starts %q", file[:4])
+	}
+	r := &reader{b: file[len(magic):]}
+	meta := make(map[string]string)
+	r.blocks(func() {
+		k := r.string()
+		meta[k] = r.string()
+	})
+	marker := r.fixed(16)
+	var entries []bson.D
+	for r.err == nil && len(r.b) > 0 {
+		n, size := r.long(), r.long()
+		block := &reader{b: r.fixed(int(size))}
+		for ; n > 0 && block.err == nil; n-- {
+			entries = append(entries, block.document())
+		}
+		if block.err == nil && len(block.b) > 0 {
+			block.fail("%d bytes left in the block", len(block.b))
+		}
+		if block.err != nil {
+			t.Fatal(block.err)
+		}
+		if m := r.fixed(16); !bytes.Equal(m, marker) {
+			t.Fatalf("block ends %x, not the sync marker %x", m, marker)
+		}
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return meta, entries
+}
+
+func representative(t *testing.T) ([][]byte, []bson.D) {
+	var raws [][]byte
+	var docs []bson.D
+	for _, e := range oplogtest.Representative() {
+		raw, err := bson.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc bson.D
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			t.Fatal(err)
+		}
+		raws, docs = append(raws, raw), append(docs, doc)
+	}
+	return raws, docs
+}
+
+func TestWriter(t *testing.T) {
+	raws, docs := representative(t)
+	var file bytes.Buffer
+	w := NewWriter(&file)
+	for _, raw := range raws {
+		if err := w.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	oplogtest.Golden(t, "testdata/representative.avro.hex", []byte(hex.Dump(file.Bytes())))
+
+	meta, entries := readFile(t, file.Bytes())
+	if meta["avro.schema"] != Schema || meta["avro.codec"] != "null" || len(meta) != 2 {
+		t.Errorf("metadata %q", meta)
+	}
+	if len(entries) != len(docs) {
+		t.Fatalf("%d entries, want %d", len(entries), len(docs))
+	}
+	for i := range docs {
+		if !reflect.DeepEqual(entries[i], docs[i]) {
+			t.Errorf("entry %d read back as\n%#v\nwant\n%#v", i, entries[i], docs[i])
+		}
+	}
+}
+
+func TestWriterBlocks(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{{Name: "pad", Value: strings.Repeat("x", blockSize/3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file bytes.Buffer
+	w := NewWriter(&file)
+	for i := 0; i < 7; i++ {
+		if err := w.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(file.Bytes(), sync); n != 4 {
+		t.Errorf("%d sync markers, want the header's and 3 blocks'", n)
+	}
+	if _, entries := readFile(t, file.Bytes()); len(entries) != 7 {
+		t.Errorf("%d entries, want 7", len(entries))
+	}
+
+	// none is a header
+	file.Reset()
+	if err := NewWriter(&file).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if meta, entries := readFile(t, file.Bytes()); meta["avro.schema"] != Schema || entries != nil {
+		t.Errorf("empty file has %q, %v", meta, entries)
+	}
+}
+
+func TestEncodeValues(t *testing.T) {
+	for _, v := range []interface{}{
+		nil, true, false, 0, -1, math.MaxInt32, int64(math.MinInt64), 0.5, math.Inf(-1), "", "é",
+		bson.D{}, bson.D{{Name: "a", Value: bson.D{{Name: "b", Value: []interface{}{}}}}},
+		[]interface{}{1, "a", []interface{}{nil}},
+		time.Date(1969, 12, 31, 23, 59, 59, 999e6, time.UTC), time.Time{},
+		bson.MongoTimestamp(1700000000<<32 | 7), bson.MongoTimestamp(-1),
+		[]byte{}, bson.Binary{Kind: 0x80, Data: []byte{1}},
+		bson.JavaScript{Code: "x"}, bson.JavaScript{Code: "x + y", Scope: bson.M{"y": 1}},
+		bson.MinKey, bson.MaxKey,
+	} {
+		raw, err := bson.Marshal(bson.D{{Name: "v", Value: v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bson.D
+		if err := bson.Unmarshal(raw, &want); err != nil {
+			t.Fatal(err)
+		}
+		datum, err := Encode(raw)
+		if err != nil {
+			t.Errorf("%#v: %s", v, err)
+			continue
+		}
+		r := &reader{b: datum}
+		got := r.document()
+		if r.err != nil || len(r.b) > 0 {
+			t.Errorf("%#v: %v, %d bytes left", v, r.err, len(r.b))
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%#v read back as %#v", v, got)
+		}
+	}
+}
+
+func TestEncodeDeprecated(t *testing.T) {
+	for _, v := range []interface{}{bson.Undefined, bson.Symbol("s"), bson.DBPointer{Namespace: "a.b", Id: bson.NewObjectId()}} {
+		raw, err := bson.Marshal(bson.D{{Name: "a", Value: []interface{}{v}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Encode(raw); err == nil || !strings.HasPrefix(err.Error(), "a: 0: can't encode") {
+			t.Errorf("%#v: %v", v, err)
+		}
+	}
+}
+
+// the union in Schema has its branches in the order they're written in
+func TestSchema(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(Schema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	field := schema["fields"].([]interface{})[0].(map[string]interface{})["type"].(map[string]interface{})["items"].(map[string]interface{})
+	value := field["fields"].([]interface{})[1].(map[string]interface{})["type"].(map[string]interface{})
+	union := value["fields"].([]interface{})[0].(map[string]interface{})["type"].([]interface{})
+	var branches []string
+	for _, b := range union {
+		switch b := b.(type) {
+		case string:
+			branches = append(branches, b)
+		case map[string]interface{}:
+			if name, ok := b["name"].(string); ok {
+				branches = append(branches, name)
+			} else {
+				branches = append(branches, b["type"].(string))
+			}
+		}
+	}
+	want := []string{"null", "boolean", "int", "long", "double", "string", "Document", "array",
+		"ObjectId", "Decimal128", "Date", "Timestamp", "Binary", "Regex", "JavaScript", "Bound"}
+	if !reflect.DeepEqual(branches, want) || len(want) != unionBound+1 {
+		t.Errorf("union is %q", branches)
+	}
+}
@@ -0,0 +1,112 @@
+// Package bsonfile reads files of concatenated BSON documents, as
+// mongodump writes them.
+package bsonfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// largest document mongodb stores is 16MB, some slack for oplog entries
+const maxSize = 17 << 20
+
+// Reader decodes documents one at a time
+type Reader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 1<<20)}
+}
+
+// Next decodes the next document into v, returning io.EOF after the last.
+// v can be kept, binaries decoded into it would share the buffer NextRaw
+// reuses, so a copy is decoded.
+func (r *Reader) Next(v interface{}) error {
+	raw, err := r.NextRaw()
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(append([]byte(nil), raw...), v)
+}
+
+// NextRaw returns the next document undecoded, valid until the next call
+func (r *Reader) NextRaw() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r.r, size[:]); err != nil {
+		return nil, err // io.EOF on a clean end
+	}
+	n := int(binary.LittleEndian.Uint32(size[:]))
+	if n < 5 || n > maxSize {
+		return nil, fmt.Errorf("bsonfile: bad document size %d", n)
+	}
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+	copy(r.buf, size[:])
+	if _, err := io.ReadFull(r.r, r.buf[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return r.buf, nil
+}
+
+// JSONLine encodes a document as one line of extended json, as dump's json
+// format writes entries. Fields are in name order.
+func JSONLine(raw []byte) ([]byte, error) {
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	data, err := MarshalJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	// the encoder ends what it writes with a newline already
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return data, nil
+}
+
+// MarshalJSON encodes v as bson.MarshalJSON does, but for decimals, which
+// it'd write as {}, written as {"$numberDecimal": "..."} so they're exact
+func MarshalJSON(v interface{}) ([]byte, error) {
+	return bson.MarshalJSON(decimals(v))
+}
+
+// decimals returns v with its decimals replaced by their extended json,
+// documents and arrays holding some copied rather than changed
+func decimals(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.Decimal128:
+		return bson.M{"$numberDecimal": v.String()}
+	case bson.M:
+		m := make(bson.M, len(v))
+		for k, e := range v {
+			m[k] = decimals(e)
+		}
+		return m
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, e := range v {
+			d[i] = bson.DocElem{Name: e.Name, Value: decimals(e.Value)}
+		}
+		return d
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, e := range v {
+			list[i] = decimals(e)
+		}
+		return list
+	}
+	return v
+}
@@ -0,0 +1,108 @@
+package bsonfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// file is docs marshaled one after another
+func file(t *testing.T, docs ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	data := file(t, bson.M{"_id": 1, "bin": []byte("first")}, bson.M{"_id": 2, "bin": []byte("second")}, bson.M{"_id": 3})
+	r := NewReader(bytes.NewReader(data))
+	var first bson.M
+	if err := r.Next(&first); err != nil {
+		t.Fatal(err)
+	}
+	var second bson.M
+	if err := r.Next(&second); err != nil {
+		t.Fatal(err)
+	}
+	// decoded from a copy, not the buffer reused
+	if string(first["bin"].([]byte)) != "first" || string(second["bin"].([]byte)) != "second" {
+		t.Errorf("read %v then %v", first, second)
+	}
+	raw, err := r.NextRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var third bson.M
+	if err := bson.Unmarshal(raw, &third); err != nil || third["_id"] != 3 {
+		t.Errorf("raw %v, %v", third, err)
+	}
+	if _, err := r.NextRaw(); err != io.EOF {
+		t.Errorf("past the end: %v, want io.EOF", err)
+	}
+	if _, err := NewReader(bytes.NewReader(nil)).NextRaw(); err != io.EOF {
+		t.Errorf("empty: %v, want io.EOF", err)
+	}
+}
+
+// after is a copy of data followed by more
+func after(data []byte, more ...byte) []byte {
+	return append(append([]byte(nil), data...), more...)
+}
+
+func TestReaderBroken(t *testing.T) {
+	data := file(t, bson.M{"_id": 1}, bson.M{"_id": 2})
+	huge := make([]byte, 4)
+	binary.LittleEndian.PutUint32(huge, maxSize+1)
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"truncated document", data[:len(data)-3], io.ErrUnexpectedEOF.Error()},
+		{"truncated size", after(data, 9, 0), io.ErrUnexpectedEOF.Error()},
+		{"too small", after(data, 4, 0, 0, 0), "bad document size 4"},
+		{"too large", after(data, huge...), "bad document size"},
+	} {
+		r := NewReader(bytes.NewReader(c.data))
+		var err error
+		for err == nil {
+			_, err = r.NextRaw()
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestJSONLine(t *testing.T) {
+	dec, err := bson.ParseDecimal128("0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := file(t, bson.D{
+		{Name: "z", Value: 1},
+		{Name: "a", Value: dec},
+		{Name: "list", Value: []interface{}{dec, bson.D{{Name: "d", Value: dec}}}},
+	})
+	line, err := JSONLine(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":{"$numberDecimal":"0.10"},"list":[{"$numberDecimal":"0.10"},{"d":{"$numberDecimal":"0.10"}}],"z":1}` + "\n"
+	if string(line) != want {
+		t.Errorf("line\n%s\nwant\n%s", line, want)
+	}
+	if _, err := JSONLine(raw[:len(raw)-1]); err == nil {
+		t.Error("a broken document encoded")
+	}
+}
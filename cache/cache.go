@@ -0,0 +1,229 @@
+// Package cache deletes keys from a cache: redis at redis://host:port/db,
+// or over tls rediss://, and memcached at memcached://host:port. A Client
+// keeps one connection, reconnecting to delete when it's lost it, retrying
+// CACHE_RETRIES times.
+package cache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ianschenck/envflag"
+)
+
+var (
+	retries = envflag.Int("CACHE_RETRIES", 3, "times a failed delete from a cache is retried, backing off from a second, reconnecting")
+)
+
+// timeout bounds connecting and each reply
+const timeout = 10 * time.Second
+
+// Client deletes keys from a cache
+type Client struct {
+	kind     string // redis or memcached
+	addr     string
+	tls      *tls.Config
+	db       int
+	user     string
+	password string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Open connects to the cache at rawurl, with user and password for redis
+// unless empty, a user of default taking the password alone. Memcached's
+// text protocol has no authentication.
+func Open(rawurl, user, password string) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("cache: %q must be redis://, rediss:// or memcached://host:port", rawurl)
+	}
+	c := &Client{addr: u.Host, user: user, password: password}
+	port := ""
+	switch u.Scheme {
+	case "redis", "rediss":
+		c.kind, port = "redis", "6379"
+		if u.Scheme == "rediss" {
+			c.tls = &tls.Config{ServerName: u.Hostname()}
+		}
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+				return nil, fmt.Errorf("cache: %q's db must be a number", rawurl)
+			}
+		}
+	case "memcached":
+		c.kind, port = "memcached", "11211"
+		if user != "" {
+			return nil, errors.New("cache: memcached can't authenticate")
+		}
+	default:
+		return nil, fmt.Errorf("cache: %q must be redis://, rediss:// or memcached://host:port", rawurl)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect opens a connection, authenticated and on its db, c.mu held
+func (c *Client) connect() error {
+	dialer := &net.Dialer{Timeout: timeout}
+	var err error
+	if c.tls != nil {
+		c.conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tls)
+	} else {
+		c.conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		c.conn = nil
+		return fmt.Errorf("cache: %s", err)
+	}
+	c.r = bufio.NewReader(c.conn)
+	if c.kind != "redis" {
+		return nil
+	}
+	switch {
+	case c.user != "" && c.user != "default":
+		err = c.command("AUTH", c.user, c.password)
+	case c.password != "":
+		err = c.command("AUTH", c.password)
+	}
+	if err == nil && c.db != 0 {
+		err = c.command("SELECT", strconv.Itoa(c.db))
+	}
+	if err != nil {
+		c.drop()
+		return fmt.Errorf("cache %s: %s", c.addr, err)
+	}
+	return nil
+}
+
+// drop closes the connection, c.mu held
+func (c *Client) drop() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Delete deletes keys, those already gone included
+func (c *Client) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if c.kind == "memcached" {
+		for _, k := range keys {
+			if len(k) > 250 || strings.IndexFunc(k, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+				return fmt.Errorf("cache: %q isn't a memcached key", k)
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for attempt := 0; attempt <= *retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << uint(attempt-1))
+		}
+		if c.conn == nil {
+			if err = c.connect(); err != nil {
+				continue
+			}
+		}
+		if c.kind == "redis" {
+			err = c.command(append([]string{"DEL"}, keys...)...)
+		} else {
+			err = c.memcachedDelete(keys)
+		}
+		if err == nil {
+			return nil
+		}
+		c.drop()
+	}
+	return err
+}
+
+// command sends a redis command, reading its reply, c.mu held
+func (c *Client) command(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return fmt.Errorf("cache: %s", err)
+	}
+	line, err := c.line()
+	if err != nil {
+		return err
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return fmt.Errorf("redis %s: %s", args[0], line[1:])
+	}
+	return fmt.Errorf("redis %s: unexpected reply %q", args[0], line)
+}
+
+// memcachedDelete deletes keys in one round trip, c.mu held
+func (c *Client) memcachedDelete(keys []string) error {
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "delete %s\r\n", k)
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return fmt.Errorf("cache: %s", err)
+	}
+	for range keys {
+		line, err := c.line()
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return fmt.Errorf("memcached delete: %s", line)
+		}
+	}
+	return nil
+}
+
+// line reads a reply's line, c.mu held
+func (c *Client) line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("cache: %s", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("cache: empty reply")
+	}
+	return line, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drop()
+	return nil
+}
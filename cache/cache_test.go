@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// pipe is a client of kind connected to the server end of a net.Pipe,
+// not retrying, that end's reader and the end
+func pipe(t *testing.T, kind string) (*Client, *bufio.Reader, net.Conn) {
+	old := *retries
+	*retries = 0
+	t.Cleanup(func() { *retries = old })
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	c := &Client{kind: kind, addr: "127.0.0.1:1", conn: client, r: bufio.NewReader(client)}
+	return c, bufio.NewReader(server), server
+}
+
+// readCommand reads a redis command as a client sends it
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("command %q isn't an array", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bulk string %q: %s", line, err)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+// serve answers a command with reply, passing on what it was
+func serve(r *bufio.Reader, conn net.Conn, reply string, read func(*bufio.Reader) ([]string, error)) <-chan []string {
+	got := make(chan []string, 1)
+	go func() {
+		args, err := read(r)
+		if err != nil {
+			args = []string{"error: " + err.Error()}
+		}
+		got <- args
+		conn.Write([]byte(reply))
+	}()
+	return got
+}
+
+func TestRedisDelete(t *testing.T) {
+	c, r, server := pipe(t, "redis")
+	got := serve(r, server, ":1\r\n", readCommand)
+	if err := c.Delete("user:7", "user:email:ada@example.com", "user:name:a b"); err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Join(<-got, "|"); args != "DEL|user:7|user:email:ada@example.com|user:name:a b" {
+		t.Errorf("sent %s", args)
+	}
+}
+
+func TestRedisReplies(t *testing.T) {
+	for _, c := range []struct {
+		reply string
+		err   string // empty for none
+	}{
+		{":0\r\n", ""}, // none of the keys were there
+		{"+OK\r\n", ""},
+		{"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "redis DEL: WRONGTYPE Operation"},
+		{"-NOPERM this user has no permissions to run the 'del' command\r\n", "redis DEL: NOPERM"},
+		{"$1\r\nx\r\n", "unexpected reply"},
+		{"\r\n", "empty reply"},
+	} {
+		client, r, server := pipe(t, "redis")
+		serve(r, server, c.reply, readCommand)
+		err := client.Delete("user:7")
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%q: %s", c.reply, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%q: %v, want %q", c.reply, err, c.err)
+		}
+		if c.err != "" && client.conn != nil {
+			t.Errorf("%q: the connection kept after a failed delete", c.reply)
+		}
+	}
+}
+
+// readDeletes reads n memcached deletes
+func readDeletes(n int) func(*bufio.Reader) ([]string, error) {
+	return func(r *bufio.Reader) ([]string, error) {
+		var lines []string
+		for i := 0; i < n; i++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasSuffix(line, "\r\n") {
+				return nil, fmt.Errorf("%q isn't ended by \\r\\n", line)
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\r\n"))
+		}
+		return lines, nil
+	}
+}
+
+func TestMemcachedDelete(t *testing.T) {
+	c, r, server := pipe(t, "memcached")
+	// both its replies, a key deleted and one that wasn't there
+	got := serve(r, server, "DELETED\r\nNOT_FOUND\r\n", readDeletes(2))
+	if err := c.Delete("user:7", "user:email:ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Join(<-got, "|"); lines != "delete user:7|delete user:email:ada@example.com" {
+		t.Errorf("sent %s", lines)
+	}
+}
+
+func TestMemcachedReplies(t *testing.T) {
+	for _, reply := range []string{
+		"DELETED\r\nSERVER_ERROR out of memory\r\n",
+		"CLIENT_ERROR bad command line format\r\nDELETED\r\n",
+		"ERROR\r\n",
+	} {
+		c, r, server := pipe(t, "memcached")
+		serve(r, server, reply, readDeletes(2))
+		if err := c.Delete("a", "b"); err == nil || !strings.Contains(err.Error(), "memcached delete") {
+			t.Errorf("%q: %v", reply, err)
+		}
+	}
+}
+
+func TestMemcachedKeys(t *testing.T) {
+	c, _, _ := pipe(t, "memcached")
+	for _, k := range []string{"user:name:a b", "line\nbreak", "del\x7f", strings.Repeat("k", 251)} {
+		// nothing's sent, the pipe'd block if it were
+		if err := c.Delete(k); err == nil || !strings.Contains(err.Error(), "isn't a memcached key") {
+			t.Errorf("%q deleted with %v", k, err)
+		}
+	}
+}
+
+func TestDeleteNothing(t *testing.T) {
+	c, _, _ := pipe(t, "redis")
+	if err := c.Delete(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	for _, c := range []struct {
+		url, user, err string
+	}{
+		{"http://localhost", "", "must be redis://"},
+		{"redis://", "", "must be redis://"},
+		{"redis://localhost/zero", "", "db must be a number"},
+		{"redis://localhost/-1", "", "db must be a number"},
+		{"memcached://localhost", "ada", "can't authenticate"},
+	} {
+		if _, err := Open(c.url, c.user, ""); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q opened with %v, want %q", c.url, err, c.err)
+		}
+	}
+}
+
+func TestOpenRedis(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for _, reply := range []string{"+OK\r\n", "-ERR DB index is out of range\r\n"} {
+			args, err := readCommand(r)
+			if err != nil {
+				return
+			}
+			got <- args
+			conn.Write([]byte(reply))
+		}
+	}()
+	_, err = Open("redis://"+ln.Addr().String()+"/99", "ada", "secret")
+	if err == nil || !strings.Contains(err.Error(), "redis SELECT: ERR DB index is out of range") {
+		t.Errorf("opened with %v, want SELECT's error", err)
+	}
+	for _, want := range []string{"AUTH|ada|secret", "SELECT|99"} {
+		if args := strings.Join(<-got, "|"); args != want {
+			t.Errorf("sent %s, want %s", args, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package chaos injects faults to exercise reconnecting, retrying and
+// checkpointing: cursors dropped, writes failed and acknowledgements held
+// back, at the rates the CHAOS_ settings give, all 0 by default. Each site
+// faults are injected at draws from a generator of its own, seeded from
+// CHAOS_SEED and its name, so runs with the same seed inject the same
+// faults at the same points of each site.
+package chaos
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ianschenck/envflag"
+)
+
+var (
+	seed          = envflag.Int64("CHAOS_SEED", 1, "seed of the faults CHAOS_ rates inject, the same seed injecting the same faults")
+	cursorDrops   = envflag.Float64("CHAOS_CURSOR_DROPS", 0, "chance an oplog entry read ends its cursor instead, as a member going away would, for testing")
+	writeFailures = envflag.Float64("CHAOS_WRITE_FAILURES", 0, "chance a write, of summaries or checkpoints, fails instead of being sent, for testing")
+	ackDelays     = envflag.Float64("CHAOS_ACK_DELAYS", 0, "chance a write's acknowledgement is held back up to CHAOS_ACK_DELAY, for testing")
+	ackDelay      = envflag.Duration("CHAOS_ACK_DELAY", 2*time.Second, "longest an acknowledgement is held back by CHAOS_ACK_DELAYS")
+)
+
+// Site is a point faults are injected at. Sites are declared once, as
+// package variables, and used after the settings are parsed.
+type Site struct {
+	name string
+
+	once sync.Once
+	mu   sync.Mutex
+	r    *rand.Rand
+}
+
+// New returns the site named name, as faults injected at it are logged
+func New(name string) *Site {
+	return &Site{name: name}
+}
+
+// draw reports whether a fault of chance p is injected
+func (s *Site) draw(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.once.Do(func() {
+		h := fnv.New64a()
+		h.Write([]byte(s.name))
+		s.r = rand.New(rand.NewSource(*seed ^ int64(h.Sum64())))
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.Float64() < p
+}
+
+// duration draws a delay up to d
+func (s *Site) duration(d time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.r.Int63n(int64(d) + 1))
+}
+
+func (s *Site) fault(what string) error {
+	fmt.Fprintf(os.Stderr, "chaos: %s at %s\n", what, s.name)
+	return fmt.Errorf("%s: %s, injected by chaos", s.name, what)
+}
+
+// Drop returns an error for the cursor to fail with, as the entry just
+// read was never read, or nil to go on
+func (s *Site) Drop() error {
+	if !s.draw(*cursorDrops) {
+		return nil
+	}
+	return s.fault("cursor dropped")
+}
+
+// Write runs write unless a failure is injected instead, holding back its
+// return when a delay of its acknowledgement is
+func (s *Site) Write(write func() error) error {
+	if s.draw(*writeFailures) {
+		return s.fault("write failed")
+	}
+	err := write()
+	if err == nil && *ackDelay > 0 && s.draw(*ackDelays) {
+		d := s.duration(*ackDelay)
+		fmt.Fprintf(os.Stderr, "chaos: acknowledgement held back %s at %s\n", d, s.name)
+		time.Sleep(d)
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package chaos
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// set has *p be v for the rest of the test
+func set(t *testing.T, p *float64, v float64) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// drops draws n cursor drops at a new site named name
+func drops(name string, n int) []bool {
+	s := New(name)
+	out := make([]bool, n)
+	for i := range out {
+		out[i] = s.Drop() != nil
+	}
+	return out
+}
+
+func TestDeterministic(t *testing.T) {
+	set(t, cursorDrops, 0.3)
+	a, b := drops("oplog", 200), drops("oplog", 200)
+	other := drops("checkpoint", 200)
+	dropped, same := 0, true
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("draw %d differs between runs of the same seed", i)
+		}
+		if a[i] {
+			dropped++
+		}
+		same = same && a[i] == other[i]
+	}
+	if dropped < 30 || dropped > 90 {
+		t.Errorf("%d of 200 dropped at a rate of 0.3", dropped)
+	}
+	if same {
+		t.Error("sites of different names draw the same faults")
+	}
+
+	old := *seed
+	defer func() { *seed = old }()
+	*seed = 2
+	reseeded := drops("oplog", 200)
+	for i := range a {
+		if a[i] != reseeded[i] {
+			return
+		}
+	}
+	t.Error("another seed draws the same faults")
+}
+
+func TestRates(t *testing.T) {
+	s := New("site")
+	for i := 0; i < 100; i++ {
+		if err := s.Drop(); err != nil {
+			t.Fatalf("dropped at a rate of 0: %s", err)
+		}
+	}
+	set(t, cursorDrops, 1)
+	if err := s.Drop(); err == nil || !strings.Contains(err.Error(), "site: cursor dropped, injected by chaos") {
+		t.Errorf("at a rate of 1: %v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	s := New("summaries")
+	written := 0
+	write := func() error { written++; return nil }
+	if err := s.Write(write); err != nil || written != 1 {
+		t.Errorf("written %d, %v", written, err)
+	}
+	failing := errors.New("duplicate key")
+	if err := s.Write(func() error { return failing }); err != failing {
+		t.Errorf("the write's error %v, want its own", err)
+	}
+
+	set(t, writeFailures, 1)
+	if err := s.Write(write); err == nil || written != 1 {
+		t.Errorf("a failure injected: written %d, %v", written, err)
+	}
+}
+
+func TestAckDelay(t *testing.T) {
+	set(t, ackDelays, 1)
+	old := *ackDelay
+	defer func() { *ackDelay = old }()
+	*ackDelay = 20 * time.Millisecond
+	s := New("acks")
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := s.Write(func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 10**ackDelay+time.Second {
+		t.Errorf("10 acknowledgements held back %s, at most %s each", elapsed, *ackDelay)
+	}
+	// a failed write isn't acknowledged, so isn't held back
+	*ackDelay = time.Hour
+	if err := s.Write(func() error { return errors.New("failed") }); err == nil {
+		t.Error("the write's error was lost")
+	}
+}
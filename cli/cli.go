@@ -0,0 +1,270 @@
+// Package cli holds what oplogctl's commands share: their settings, read
+// from a configuration file, the environment over it and -NAME=value
+// arguments over both, and their --help.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ianschenck/envflag"
+
+	"github.com/hanjoyo/oplog-abuse/config"
+)
+
+// FlagSet is a command's settings. Flags are defined on it as on a
+// flag.FlagSet, named as the environment variables they're read from.
+type FlagSet struct {
+	*flag.FlagSet
+	Summary string // one line on what the command does, for help
+
+	path   string            // of the configuration file, if any
+	args   []string          // as parsed, for reloads
+	origin map[string]string // where settings not left at their default came from
+	seps   map[string]string // what lists are joined with, by setting, commas if unset
+}
+
+// Command is one of oplogctl's commands
+type Command struct {
+	Flags  *FlagSet
+	Main   func(args []string)
+	Checks func() []Check // what validate-config probes once the flags are parsed, if set
+}
+
+// Check is a probe of something a command needs, such as a cluster it
+// connects to with the privileges it uses, or a directory it writes
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+var commands = make(map[string]Command)
+
+// NewFlagSet returns the settings of command name
+func NewFlagSet(name, summary string) *FlagSet {
+	f := &FlagSet{FlagSet: flag.NewFlagSet(name, flag.ExitOnError), Summary: summary}
+	f.String("config", "", "yaml or toml configuration file, "+ConfigEnv+" if not given")
+	f.String("error-format", "text", "how a failure is printed to stderr, text or json for one object with its exit status, "+ErrorFormatEnv+" if not given")
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: %s\n\nusage: oplogctl %s [-NAME=value ...], settings also read from the environment:\n\n", name, summary, name)
+		f.PrintDefaults()
+	}
+	return f
+}
+
+// Register makes main, with flags, the command named as they are
+func Register(flags *FlagSet, main func(args []string)) {
+	c := commands[flags.Name()]
+	c.Flags, c.Main = flags, main
+	commands[flags.Name()] = c
+}
+
+// RegisterChecks sets the checks of the command flags belong to
+func RegisterChecks(flags *FlagSet, checks func() []Check) {
+	c := commands[flags.Name()]
+	c.Flags, c.Checks = flags, checks
+	commands[flags.Name()] = c
+}
+
+// Lookup returns the command named name
+func Lookup(name string) (Command, bool) {
+	c, ok := commands[name]
+	return c, ok
+}
+
+// Names lists the commands in order
+func Names() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ConfigEnv names the configuration file when -config isn't given
+const ConfigEnv = "OPLOGCTL_CONFIG"
+
+// Parse sets the flags from the configuration file, then the environment,
+// then args, each winning over the one before. Environment variables
+// naming no flag are left alone, as envflag did. The settings packages
+// shared between commands define with envflag, such as how dial connects,
+// are taken as the command's own.
+func (f *FlagSet) Parse(args []string) {
+	envflag.VisitAll(func(shared *flag.Flag) {
+		if f.Lookup(shared.Name) == nil {
+			f.Var(shared.Value, shared.Name, shared.Usage)
+		}
+	})
+	f.args = args
+	f.origin = make(map[string]string)
+	command = "oplogctl " + f.Name()
+	if format := argument(args, "error-format"); format != "" {
+		errorFormat = format
+	}
+	if errorFormat != "" && errorFormat != "text" && errorFormat != "json" {
+		format := errorFormat
+		errorFormat = "text"
+		Fail(Invalidf("unknown error-format %q, text or json", format))
+	}
+	if f.path = argument(args, "config"); f.path == "" {
+		f.path = os.Getenv(ConfigEnv)
+	}
+	if f.path != "" {
+		file, err := config.Load(f.path)
+		if err == nil {
+			err = f.apply(file)
+		}
+		if err != nil {
+			Fail(err)
+		}
+	}
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		if i < 0 || f.Lookup(kv[:i]) == nil {
+			continue
+		}
+		if err := f.Set(kv[:i], kv[i+1:]); err != nil {
+			Fail(Invalidf("invalid value %q for %s: %s", kv[i+1:], kv[:i], err))
+		}
+		f.origin[kv[:i]] = "environment"
+	}
+	f.FlagSet.Parse(args)
+	for name := range f.fromArgs() {
+		f.origin[name] = "arguments"
+	}
+}
+
+// Origin says where a setting's value came from: a line of the
+// configuration file, the environment or the arguments, "" for the default
+func (f *FlagSet) Origin(name string) string {
+	return f.origin[name]
+}
+
+// Validate checks every table of a configuration file against the
+// commands, reporting the first mistake by line
+func Validate(file *config.File) error {
+	for _, name := range Names() {
+		if _, err := commands[name].Flags.settings(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// argument returns the value of -name in args, "" if it isn't given
+func argument(args []string, name string) string {
+	for i, arg := range args {
+		flag := strings.TrimLeft(arg, "-")
+		switch {
+		case arg == flag:
+			return "" // past the flags
+		case flag == name && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(flag, name+"="):
+			return strings.TrimPrefix(flag, name+"=")
+		}
+	}
+	return ""
+}
+
+// settingName turns a key as written in a file, mongo_url or mongo-url,
+// into the setting's name
+func settingName(key string) string {
+	return strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+// settings returns the settings file has for f's command by name. A file
+// is a table per command plus a shared one for every command, with the
+// settings in them by name, the command's winning over shared ones.
+// Tables nested within, such as source or checkpointing, only group
+// settings. Anything no command knows is an error.
+func (f *FlagSet) settings(file *config.File) (map[string]config.Setting, error) {
+	own, shared := make(map[string]config.Setting), make(map[string]config.Setting)
+	for _, s := range file.Settings {
+		if len(s.Path) < 2 {
+			return nil, file.Errorf(s, "%s is outside a command's table, or shared", s.Key())
+		}
+		section, name := s.Path[0], settingName(s.Key())
+		switch {
+		case section == f.Name():
+			if !f.has(name) {
+				return nil, file.Errorf(s, "unknown setting %s for %s", s.Key(), section)
+			}
+			own[name] = s
+		case section == "shared":
+			if f.has(name) {
+				shared[name] = s
+			} else if !known(name) {
+				return nil, file.Errorf(s, "no command has a setting %s", s.Key())
+			}
+		default:
+			c, ok := commands[section]
+			if !ok {
+				return nil, file.Errorf(s, "unknown command %s", section)
+			}
+			if !c.Flags.has(name) {
+				return nil, file.Errorf(s, "unknown setting %s for %s", s.Key(), section)
+			}
+		}
+	}
+	for name, s := range own {
+		shared[name] = s
+	}
+	return shared, nil
+}
+
+// apply sets the flags file has for f's command
+func (f *FlagSet) apply(file *config.File) error {
+	settings, err := f.settings(file)
+	if err != nil {
+		return err
+	}
+	for name, s := range settings {
+		v := f.value(name, s)
+		if err := f.Set(name, v); err != nil {
+			return file.Errorf(s, "invalid value %q for %s: %s", v, s.Key(), err)
+		}
+		f.origin[name] = fmt.Sprintf("%s:%d", file.Name, s.Line)
+	}
+	return nil
+}
+
+// ListSeparator has lists the configuration file gives for name joined with
+// sep, as the setting splits them, instead of with commas
+func (f *FlagSet) ListSeparator(name, sep string) {
+	if f.seps == nil {
+		f.seps = make(map[string]string)
+	}
+	f.seps[name] = sep
+}
+
+// value returns the value s sets name to, a list joined as name splits it
+func (f *FlagSet) value(name string, s config.Setting) string {
+	if sep, ok := f.seps[name]; ok && s.List != nil {
+		return strings.Join(s.List, sep)
+	}
+	return s.Value
+}
+
+// has reports whether f has the setting, shared ones included before
+// Parse takes them on
+func (f *FlagSet) has(name string) bool {
+	return f.Lookup(name) != nil || envflag.Lookup(name) != nil
+}
+
+// known reports whether any command has the setting
+func known(name string) bool {
+	if envflag.Lookup(name) != nil {
+		return true
+	}
+	for _, c := range commands {
+		if c.Flags.Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
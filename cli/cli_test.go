@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ianschenck/envflag"
+
+	"github.com/hanjoyo/oplog-abuse/config"
+)
+
+// a setting shared between commands, as dial's are
+var testURL = envflag.String("CLITEST_URL", "mongodb://localhost", "")
+
+// newTestFlags registers a command named name with the settings given
+func newTestFlags(name string, settings ...string) *FlagSet {
+	f := NewFlagSet(name, "for tests")
+	for _, s := range settings {
+		f.String(s, "default", "")
+	}
+	Register(f, func([]string) {})
+	return f
+}
+
+func TestSettings(t *testing.T) {
+	one := newTestFlags("clitest-one", "DIR", "RATE")
+	newTestFlags("clitest-two", "PORT")
+	for _, c := range []struct {
+		name, yaml string
+		want       map[string]string // by setting, with the line it's from
+		err        string
+	}{
+		{
+			"command over shared", "shared:\n  clitest_url: mongodb://shared\n  rate: 1\nclitest-one:\n  rate: 2\n",
+			map[string]string{"CLITEST_URL": "mongodb://shared:2", "RATE": "2:5"}, "",
+		},
+		{
+			"shared the command doesn't have", "shared:\n  port: 80\nclitest-one:\n  dir: /tmp\n",
+			map[string]string{"DIR": "/tmp:4"}, "",
+		},
+		{
+			"grouping tables", "clitest-one:\n  storage:\n    dir: /var\n  rate: 3\n",
+			map[string]string{"DIR": "/var:3", "RATE": "3:4"}, "",
+		},
+		{
+			"names as written", "clitest-one:\n  clitest-url: mongodb://dashed\n",
+			map[string]string{"CLITEST_URL": "mongodb://dashed:2"}, "",
+		},
+		{"another command's table", "clitest-two:\n  port: 80\n", map[string]string{}, ""},
+		{"unknown setting", "clitest-one:\n  port: 80\n", nil, "c.yaml:2: unknown setting port for clitest-one"},
+		{"unknown setting of another command", "clitest-two:\n  dir: /tmp\n", nil, "c.yaml:2: unknown setting dir for clitest-two"},
+		{"unknown shared setting", "shared:\n  nope: 1\n", nil, "c.yaml:2: no command has a setting nope"},
+		{"unknown command", "clitest-three:\n  dir: /tmp\n", nil, "c.yaml:2: unknown command clitest-three"},
+		{"outside a table", "dir: /tmp\n", nil, "c.yaml:1: dir is outside a command's table, or shared"},
+	} {
+		file, err := config.Parse("c.yaml", []byte(c.yaml))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		settings, err := one.settings(file)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: error %v, want %s", c.name, err, c.err)
+			}
+			if _, ok := err.(*config.Error); !ok {
+				t.Errorf("%s: error %#v isn't a *config.Error", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		got := make(map[string]string)
+		for name, s := range settings {
+			got[name] = fmt.Sprintf("%s:%d", s.Value, s.Line)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: settings %v, want %v", c.name, got, c.want)
+		}
+		for name, want := range c.want {
+			if got[name] != want {
+				t.Errorf("%s: %s is %q, want %q", c.name, name, got[name], want)
+			}
+		}
+	}
+}
+
+// the file's overridden by the environment, which the arguments override
+func TestParsePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oplogctl.toml")
+	data := "[shared]\nclitest_url = \"mongodb://file\"\n\n[clitest-precedence]\nfile = \"file\"\nenv = \"file\"\nargs = \"file\"\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFlags("clitest-precedence", "FILE", "ENV", "ARGS", "UNSET")
+	t.Setenv("ENV", "env")
+	t.Setenv("ARGS", "env")
+	t.Setenv("UNRELATED", "env")
+	old := *testURL
+	t.Cleanup(func() { *testURL = old })
+	f.Parse([]string{"-config", path, "-ARGS=args", "rest"})
+
+	for _, c := range []struct{ name, value, origin string }{
+		{"CLITEST_URL", "mongodb://file", path + ":2"},
+		{"FILE", "file", path + ":5"},
+		{"ENV", "env", "environment"},
+		{"ARGS", "args", "arguments"},
+		{"UNSET", "default", ""},
+	} {
+		if v := f.Lookup(c.name).Value.String(); v != c.value {
+			t.Errorf("%s is %q, want %q", c.name, v, c.value)
+		}
+		if o := f.Origin(c.name); o != c.origin {
+			t.Errorf("%s came from %q, want %q", c.name, o, c.origin)
+		}
+	}
+	if *testURL != "mongodb://file" {
+		t.Errorf("the shared setting is %q, want it set too", *testURL)
+	}
+	if args := f.Args(); len(args) != 1 || args[0] != "rest" {
+		t.Errorf("args %v, want [rest]", args)
+	}
+}
@@ -0,0 +1,258 @@
+package cli
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ianschenck/envflag"
+)
+
+// Builtins are what oplogctl does besides running commands, completed
+// along with them
+var Builtins = map[string]string{
+	"help":       "list the commands, or a command's settings",
+	"completion": "print bash, zsh or fish completions",
+	"man":        "print the manual page of oplogctl or a command, or write them all with -dir",
+}
+
+// Flags lists a command's settings by name, shared ones included
+func (f *FlagSet) Flags() []*flag.Flag {
+	var list []*flag.Flag
+	f.VisitAll(func(fl *flag.Flag) { list = append(list, fl) })
+	envflag.VisitAll(func(shared *flag.Flag) {
+		if f.Lookup(shared.Name) == nil {
+			list = append(list, shared)
+		}
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// isBool reports whether fl is set without a value, as -NAME
+func isBool(fl *flag.Flag) bool {
+	b, ok := fl.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// words lists what completes as oplogctl's first argument
+func words() []string {
+	names := Names()
+	for name := range Builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// summary is the first line of a usage, shortened for menus
+func summary(usage string) string {
+	_, usage = flag.UnquoteUsage(&flag.Flag{Usage: usage})
+	if i := strings.IndexAny(usage, ",("); i > 0 {
+		usage = usage[:i]
+	}
+	return usage
+}
+
+// Completion writes completions of the commands and their settings for
+// shell, bash, zsh or fish
+func Completion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		bashCompletion(w)
+	case "zsh":
+		zshCompletion(w)
+	case "fish":
+		fishCompletion(w)
+	default:
+		return fmt.Errorf("no completions for %q, bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+// settingWords lists a command's settings as typed, -NAME= for those
+// taking a value
+func settingWords(f *FlagSet) []string {
+	var list []string
+	for _, fl := range f.Flags() {
+		if isBool(fl) {
+			list = append(list, "-"+fl.Name)
+		} else {
+			list = append(list, "-"+fl.Name+"=")
+		}
+	}
+	return list
+}
+
+func bashCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# oplogctl completion bash, source from ~/.bashrc or /etc/bash_completion.d\n")
+	fmt.Fprintf(w, "_oplogctl() {\n")
+	fmt.Fprintf(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	// = breaks words, what follows -NAME= is a value
+	fmt.Fprintf(w, "\t[[ \"$cur\" == = || \"$prev\" == = ]] && return\n")
+	fmt.Fprintf(w, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(words(), " "))
+	fmt.Fprintf(w, "\t\treturn\n\tfi\n")
+	fmt.Fprintf(w, "\tcase \"${COMP_WORDS[1]}\" in\n")
+	fmt.Fprintf(w, "\thelp|man) [ \"$COMP_CWORD\" -eq 2 ] && COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(Names(), " "))
+	fmt.Fprintf(w, "\tcompletion) [ \"$COMP_CWORD\" -eq 2 ] && COMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\")) ;;\n")
+	for _, name := range Names() {
+		fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", name, strings.Join(settingWords(commands[name].Flags), " "))
+	}
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "\t[[ \"${COMPREPLY[0]}\" == *= ]] && compopt -o nospace\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -F _oplogctl oplogctl\n")
+}
+
+// zshQuote quotes s for a single quoted zsh word, brackets and colons
+// being taken by _arguments specs
+func zshQuote(s string) string {
+	s = strings.NewReplacer("'", "'\\''", "[", "(", "]", ")", ":", " ").Replace(s)
+	return s
+}
+
+func zshCompletion(w io.Writer) {
+	fmt.Fprintf(w, "#compdef oplogctl\n# oplogctl completion zsh, saved as _oplogctl in a directory of $fpath\n\n")
+	fmt.Fprintf(w, "_oplogctl() {\n\tlocal -a commands\n\tcommands=(\n")
+	for _, name := range words() {
+		desc := Builtins[name]
+		if c, ok := commands[name]; ok {
+			desc = c.Flags.Summary
+		}
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", name, zshQuote(desc))
+	}
+	fmt.Fprintf(w, "\t)\n\tif (( CURRENT == 2 )); then\n\t\t_describe command commands\n\t\treturn\n\tfi\n")
+	fmt.Fprintf(w, "\tcase $words[2] in\n")
+	fmt.Fprintf(w, "\thelp|man) (( CURRENT == 3 )) && _values command %s ;;\n", strings.Join(Names(), " "))
+	fmt.Fprintf(w, "\tcompletion) (( CURRENT == 3 )) && _values shell bash zsh fish ;;\n")
+	for _, name := range Names() {
+		fmt.Fprintf(w, "\t%s)\n\t\t_arguments \\\n", name)
+		for _, fl := range commands[name].Flags.Flags() {
+			desc := zshQuote(summary(fl.Usage))
+			if isBool(fl) {
+				fmt.Fprintf(w, "\t\t\t'-%s[%s]' \\\n", fl.Name, desc)
+				continue
+			}
+			kind, _ := flag.UnquoteUsage(fl)
+			fmt.Fprintf(w, "\t\t\t'-%s=-[%s]:%s: ' \\\n", fl.Name, desc, kind)
+		}
+		fmt.Fprintf(w, "\t\t\t&& return\n\t\t;;\n")
+	}
+	fmt.Fprintf(w, "\tesac\n}\n\n_oplogctl \"$@\"\n")
+}
+
+// fishQuote quotes s as a single quoted fish word
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func fishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# oplogctl completion fish, saved as ~/.config/fish/completions/oplogctl.fish\n")
+	fmt.Fprintf(w, "complete -c oplogctl -f\n")
+	for _, name := range words() {
+		desc := Builtins[name]
+		if c, ok := commands[name]; ok {
+			desc = c.Flags.Summary
+		}
+		fmt.Fprintf(w, "complete -c oplogctl -n __fish_use_subcommand -a %s -d %s\n", name, fishQuote(desc))
+	}
+	fmt.Fprintf(w, "complete -c oplogctl -n '__fish_seen_subcommand_from help man' -a %s\n", fishQuote(strings.Join(Names(), " ")))
+	fmt.Fprintf(w, "complete -c oplogctl -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n")
+	for _, name := range Names() {
+		for _, fl := range commands[name].Flags.Flags() {
+			// -NAME value, as the flag package also takes it
+			required := " -r"
+			if isBool(fl) {
+				required = ""
+			}
+			fmt.Fprintf(w, "complete -c oplogctl -n '__fish_seen_subcommand_from %s' -o %s%s -d %s\n", name, fl.Name, required, fishQuote(summary(fl.Usage)))
+		}
+	}
+}
+
+// roff escapes s for a manual page
+func roff(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// Man writes the manual page of command name, oplogctl's own listing the
+// commands if name is empty
+func Man(w io.Writer, name string) error {
+	if name == "" {
+		fmt.Fprintf(w, ".TH OPLOGCTL 1 \"\" oplogctl \"oplogctl manual\"\n")
+		fmt.Fprintf(w, ".SH NAME\noplogctl \\- tools for the mongodb oplog\n")
+		fmt.Fprintf(w, ".SH SYNOPSIS\n.B oplogctl\n.I command\n[\\-NAME=value ...]\n")
+		fmt.Fprintf(w, ".SH COMMANDS\n")
+		for _, n := range Names() {
+			fmt.Fprintf(w, ".TP\n.B %s\n%s, see\n.BR oplogctl\\-%s (1)\n", roff(n), roff(commands[n].Flags.Summary), roff(n))
+		}
+		for _, n := range []string{"help", "completion", "man"} {
+			fmt.Fprintf(w, ".TP\n.B %s\n%s\n", n, roff(Builtins[n]))
+		}
+		manSettings(w)
+		return nil
+	}
+	c, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	upper := roff(strings.ToUpper(name))
+	fmt.Fprintf(w, ".TH OPLOGCTL\\-%s 1 \"\" oplogctl \"oplogctl manual\"\n", upper)
+	fmt.Fprintf(w, ".SH NAME\noplogctl\\-%s \\- %s\n", roff(name), roff(c.Flags.Summary))
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B oplogctl %s\n[\\-NAME=value ...]\n", roff(name))
+	fmt.Fprintf(w, ".SH SETTINGS\n")
+	for _, fl := range c.Flags.Flags() {
+		kind, usage := flag.UnquoteUsage(fl)
+		fmt.Fprintf(w, ".TP\n.B \\-%s", roff(fl.Name))
+		if kind != "" {
+			fmt.Fprintf(w, "=\\fI%s\\fR", roff(kind))
+		}
+		fmt.Fprintf(w, "\n%s", roff(usage))
+		if fl.DefValue != "" && fl.DefValue != "false" && fl.DefValue != "0" {
+			fmt.Fprintf(w, ", %s by default", roff(fl.DefValue))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	manSettings(w)
+	fmt.Fprintf(w, ".SH SEE ALSO\n.BR oplogctl (1)\n")
+	return nil
+}
+
+// ManPages writes every manual page into dir, oplogctl.1 and one
+// oplogctl-command.1 per command
+func ManPages(dir string) error {
+	for _, name := range append([]string{""}, Names()...) {
+		var buf bytes.Buffer
+		if err := Man(&buf, name); err != nil {
+			return err
+		}
+		file := "oplogctl.1"
+		if name != "" {
+			file = "oplogctl-" + name + ".1"
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manSettings describes where settings come from
+func manSettings(w io.Writer) {
+	fmt.Fprintf(w, ".SH ENVIRONMENT\n")
+	fmt.Fprintf(w, "Every setting is also read from the environment variable of its name, "+
+		"over the configuration file and under arguments.\n")
+	fmt.Fprintf(w, ".TP\n.B %s\n", roff(ConfigEnv))
+	fmt.Fprintf(w, "yaml or toml configuration file when \\-config isn't given, "+
+		"a table per command and a shared one for every command\n")
+}
@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/hanjoyo/oplog-abuse/config"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Exit statuses, what a command failed on for whatever runs it
+const (
+	ExitFailure    = 1 // anything else, checks failing or differences found included
+	ExitUsage      = 2 // unknown command or arguments, as the flag package exits
+	ExitConfig     = 3 // settings or the configuration file invalid
+	ExitConnection = 4 // a cluster or service couldn't be reached
+	ExitAuth       = 5 // authentication failed or privileges are missing
+	ExitRolledOver = 6 // the oplog no longer holds where reading was to resume
+)
+
+// kinds names the statuses in json errors
+var kinds = map[int]string{
+	ExitFailure:    "failure",
+	ExitUsage:      "usage",
+	ExitConfig:     "config",
+	ExitConnection: "connection",
+	ExitAuth:       "auth",
+	ExitRolledOver: "rolled_over",
+}
+
+// ErrorFormatEnv sets the format errors are printed in when -error-format
+// isn't given
+const ErrorFormatEnv = "OPLOGCTL_ERROR_FORMAT"
+
+// how errors are printed, text or json, and by which command
+var errorFormat, command = os.Getenv(ErrorFormatEnv), "oplogctl"
+
+// StatusError is an error exiting with Status
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+// Invalidf returns an error about settings, exiting with ExitConfig
+func Invalidf(format string, args ...interface{}) error {
+	return &StatusError{ExitConfig, fmt.Errorf(format, args...)}
+}
+
+// RolledOverf returns an error about entries lost from the oplog, exiting
+// with ExitRolledOver
+func RolledOverf(format string, args ...interface{}) error {
+	return &StatusError{ExitRolledOver, fmt.Errorf(format, args...)}
+}
+
+// mongodb error codes, and what's in messages once errors are wrapped
+var (
+	authCodes       = map[int]bool{13: true, 18: true}              // Unauthorized, AuthenticationFailed
+	rolledOverCodes = map[int]bool{136: true, 280: true, 286: true} // CappedPositionLost, ChangeStreamFatalError, ChangeStreamHistoryLost
+	authText        = []string{"auth fail", "authentication failed", "not authorized", "unauthorized", "privileges missing"}
+	rolledOverText  = []string{"cappedpositionlost", "changestreamhistorylost", "resume point may no longer be in the oplog", "were lost"}
+	connectionText  = []string{"no reachable servers", "connection refused", "i/o timeout", "no such host", "server selection", "connection reset"}
+)
+
+func contains(s string, parts []string) bool {
+	for _, p := range parts {
+		if strings.Contains(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the exit status of err. Errors are mostly wrapped as
+// text by the time they get here, so besides their types their messages
+// are gone by.
+func Status(err error) int {
+	var status *StatusError
+	var file *config.Error
+	var query *mgo.QueryError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &status):
+		return status.Status
+	case errors.As(err, &file):
+		return ExitConfig
+	case errors.As(err, &query) && authCodes[query.Code]:
+		return ExitAuth
+	case errors.As(err, &query) && rolledOverCodes[query.Code]:
+		return ExitRolledOver
+	case errors.As(err, &netErr):
+		return ExitConnection
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case contains(msg, authText):
+		return ExitAuth
+	case contains(msg, rolledOverText):
+		return ExitRolledOver
+	case contains(msg, connectionText):
+		return ExitConnection
+	}
+	return ExitFailure
+}
+
+// Fail prints err as -error-format says, text or a json line, and exits
+// with its status
+func Fail(err error) {
+	runExitHooks()
+	status := Status(err)
+	if errorFormat == "json" {
+		data, _ := json.Marshal(struct {
+			Command string `json:"command"`
+			Error   string `json:"error"`
+			Kind    string `json:"kind"`
+			Status  int    `json:"status"`
+		}{command, err.Error(), kinds[status], status})
+		fmt.Fprintf(os.Stderr, "%s\n", data)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", command, err)
+	}
+	os.Exit(status)
+}
+
+var (
+	exitMu    sync.Mutex
+	exitHooks []func()
+)
+
+// AtExit has hook run before Fail exits, the last added first, to undo what
+// a deferred call would have: os.Exit runs none, nor those of the other
+// goroutines. Hooks run once, even if several goroutines fail.
+func AtExit(hook func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitHooks = append(exitHooks, hook)
+}
+
+func runExitHooks() {
+	exitMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// Recover turns a panic into Fail, deferred by main and by the goroutines
+// commands do their work in. Programming errors keep their stack.
+func Recover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+	if _, bug := r.(runtime.Error); bug && errorFormat != "json" {
+		os.Stderr.Write(debug.Stack())
+	}
+	Fail(err)
+}
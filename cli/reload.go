@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/config"
+)
+
+// how often the configuration file is checked for changes
+const reloadPoll = 5 * time.Second
+
+// Reload calls reload whenever SIGHUP is received or the configuration
+// file changes, once the named settings are read afresh from the file,
+// the environment and the arguments as Parse read them. Other settings
+// keep the values they started with. If reading them or reload fails,
+// the named settings go back to what they were and it's logged.
+func (f *FlagSet) Reload(names []string, reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer Recover()
+		modified := f.modified()
+		tick := time.NewTicker(reloadPoll)
+		defer tick.Stop()
+		for {
+			select {
+			case <-hup:
+			case <-tick.C:
+				m := f.modified()
+				if m.Equal(modified) {
+					continue
+				}
+				modified = m
+			}
+			if err := f.reload(names, reload); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: not reloaded: %s\n", f.Name(), err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s: reloaded %s\n", f.Name(), strings.Join(names, ", "))
+		}
+	}()
+}
+
+// modified returns when the configuration file was last written, zero
+// without one
+func (f *FlagSet) modified() time.Time {
+	if f.path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (f *FlagSet) reload(names []string, reload func() error) error {
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		values[name] = f.Lookup(name).DefValue
+	}
+	if f.path != "" {
+		file, err := config.Load(f.path)
+		if err != nil {
+			return err
+		}
+		settings, err := f.settings(file)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if s, ok := settings[name]; ok {
+				values[name] = f.value(name, s)
+			}
+		}
+	}
+	for _, name := range names {
+		if v, ok := os.LookupEnv(name); ok {
+			values[name] = v
+		}
+	}
+	for name, v := range f.fromArgs() {
+		if _, ok := values[name]; ok {
+			values[name] = v
+		}
+	}
+
+	old := make(map[string]string, len(names))
+	for _, name := range names {
+		old[name] = f.Lookup(name).Value.String()
+	}
+	restore := func() {
+		for name, v := range old {
+			f.Set(name, v)
+		}
+	}
+	for name, v := range values {
+		if err := f.Set(name, v); err != nil {
+			restore()
+			return fmt.Errorf("invalid value %q for %s: %s", v, name, err)
+		}
+	}
+	if err := reload(); err != nil {
+		restore()
+		return err
+	}
+	return nil
+}
+
+// argValue takes an argument's value as given, bool flags standing alone
+type argValue struct {
+	value   string
+	boolean bool
+}
+
+func (v *argValue) String() string     { return v.value }
+func (v *argValue) Set(s string) error { v.value = s; return nil }
+func (v *argValue) IsBoolFlag() bool   { return v.boolean }
+
+// fromArgs returns the settings the arguments gave
+func (f *FlagSet) fromArgs() map[string]string {
+	scratch := flag.NewFlagSet(f.Name(), flag.ContinueOnError)
+	scratch.SetOutput(ioutil.Discard)
+	f.VisitAll(func(fl *flag.Flag) {
+		b, ok := fl.Value.(interface{ IsBoolFlag() bool })
+		scratch.Var(&argValue{boolean: ok && b.IsBoolFlag()}, fl.Name, "")
+	})
+	scratch.Parse(f.args)
+	given := make(map[string]string)
+	scratch.Visit(func(fl *flag.Flag) {
+		given[fl.Name] = fl.Value.String()
+	})
+	return given
+}
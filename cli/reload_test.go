@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reload reads the settings named afresh as Parse did, the file under the
+// environment under the arguments, putting them back if they're invalid or
+// the reload fails
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oplogctl.yaml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("clitest-reload:\n  file: one\n  env: one\n  args: one\n  other: one\n")
+	f := newTestFlags("clitest-reload", "FILE", "ENV", "ARGS", "OTHER", "GONE")
+	f.Int("NUMBER", 1, "")
+	t.Setenv("ENV", "env")
+	f.Parse([]string{"-config=" + path, "-ARGS=args"})
+	value := func(name string) string { return f.Lookup(name).Value.String() }
+
+	write("clitest-reload:\n  file: two\n  env: two\n  args: two\n  other: two\n  number: 2\n")
+	t.Setenv("ENV", "env2")
+	names := []string{"FILE", "ENV", "ARGS", "GONE", "NUMBER"}
+	reloads := 0
+	if err := f.reload(names, func() error { reloads++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"FILE": "two", "ENV": "env2", "ARGS": "args", "GONE": "default", "NUMBER": "2", "OTHER": "one"} {
+		if v := value(name); v != want {
+			t.Errorf("%s is %q after a reload, want %q", name, v, want)
+		}
+	}
+	if reloads != 1 {
+		t.Errorf("reloaded %d times, want once", reloads)
+	}
+
+	// a setting the file takes away goes back to its default
+	write("clitest-reload:\n  env: three\n  number: 3\n")
+	if err := f.reload(names, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if v := value("FILE"); v != "default" {
+		t.Errorf("FILE is %q once the file drops it, want the default", v)
+	}
+
+	for _, c := range []struct {
+		name, data string
+		reload     error
+	}{
+		{"invalid value", "clitest-reload:\n  file: four\n  number: many\n", nil},
+		{"unknown setting", "clitest-reload:\n  file: four\n  nope: 1\n", nil},
+		{"unparsable file", "clitest-reload:\n  file: |\n    four\n", nil},
+		{"reload failing", "clitest-reload:\n  file: four\n  number: 4\n", errors.New("refused")},
+	} {
+		write(c.data)
+		err := f.reload(names, func() error { return c.reload })
+		if err == nil {
+			t.Errorf("%s: reloaded", c.name)
+		}
+		if v, n := value("FILE"), value("NUMBER"); v != "default" || n != "3" {
+			t.Errorf("%s: FILE %q and NUMBER %q, want them as they were", c.name, v, n)
+		}
+	}
+}
+
+func TestModified(t *testing.T) {
+	f := NewFlagSet("clitest-modified", "for tests")
+	if !f.modified().IsZero() {
+		t.Error("modified without a file isn't zero")
+	}
+	f.path = filepath.Join(t.TempDir(), "oplogctl.yaml")
+	if !f.modified().IsZero() {
+		t.Error("modified of a missing file isn't zero")
+	}
+	if err := ioutil.WriteFile(f.path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(f.path, at, at); err != nil {
+		t.Fatal(err)
+	}
+	if m := f.modified(); !m.Equal(at) {
+		t.Errorf("modified %s, want %s", m, at)
+	}
+}
@@ -0,0 +1,241 @@
+// Package clock abstracts the time the windows, debouncing and leases go
+// by, so their logic can be driven by a simulated clock instead of sleeps.
+// Code takes the time from a Clock, Real unless it's swapped for a Sim.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is what of the time package is gone through to tell the time and
+// wait on it
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer of a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a time.Ticker of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Since returns the time elapsed on c since t
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Until returns the time left on c until t
+func Until(c Clock, t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+// Real is the wall clock, the time package's
+var Real Clock = real{}
+
+type real struct{}
+
+func (real) Now() time.Time                         { return time.Now() }
+func (real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (real) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+func (real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Sim is a simulated clock, standing still but for Advance. Its timers,
+// tickers and sleeps fire as Advance moves past their deadlines, in order,
+// and as the time package's do, a tick not received yet is dropped.
+type Sim struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	changed chan struct{} // closed when waiters change, for Wait
+}
+
+// waiter is a timer, ticker or sleep pending on a Sim
+type waiter struct {
+	at     time.Time
+	every  time.Duration // of a ticker, 0 otherwise
+	c      chan time.Time
+	active bool
+}
+
+// NewSim returns a simulated clock reading start
+func NewSim(start time.Time) *Sim {
+	return &Sim{now: start, changed: make(chan struct{})}
+}
+
+// Now returns the time the clock was advanced to
+func (s *Sim) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Advance moves the clock d on, firing what's due on the way in the order
+// of the deadlines, each seeing the time it was due at
+func (s *Sim) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := s.now.Add(d)
+	for {
+		sort.SliceStable(s.waiters, func(i, j int) bool { return s.waiters[i].at.Before(s.waiters[j].at) })
+		if len(s.waiters) == 0 || s.waiters[0].at.After(end) {
+			break
+		}
+		w := s.waiters[0]
+		s.now = w.at
+		select {
+		case w.c <- w.at:
+		default:
+		}
+		if w.every > 0 {
+			w.at = w.at.Add(w.every)
+			continue
+		}
+		w.active = false
+		s.remove(w)
+	}
+	s.now = end
+}
+
+// Pending returns how many timers, tickers and sleeps are waiting
+func (s *Sim) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
+
+// Wait blocks until at least n timers, tickers and sleeps are waiting, for
+// a test to know the code under it got to waiting before it advances
+func (s *Sim) Wait(n int) {
+	for {
+		s.mu.Lock()
+		pending, changed := len(s.waiters), s.changed
+		s.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// add has w wait, s.mu held
+func (s *Sim) add(w *waiter) {
+	w.active = true
+	s.waiters = append(s.waiters, w)
+	s.notify()
+}
+
+// remove stops w waiting, s.mu held
+func (s *Sim) remove(w *waiter) {
+	for i, o := range s.waiters {
+		if o == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			break
+		}
+	}
+	s.notify()
+}
+
+func (s *Sim) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Sim) wait(d, every time.Duration) *waiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := &waiter{at: s.now.Add(d), every: every, c: make(chan time.Time, 1)}
+	if d <= 0 && every == 0 {
+		w.c <- s.now // due already, as the time package's are
+		return w
+	}
+	s.add(w)
+	return w
+}
+
+func (s *Sim) After(d time.Duration) <-chan time.Time {
+	return s.wait(d, 0).c
+}
+
+// Sleep blocks until the clock is advanced d on
+func (s *Sim) Sleep(d time.Duration) {
+	<-s.After(d)
+}
+
+func (s *Sim) NewTimer(d time.Duration) Timer {
+	return &simTimer{s, s.wait(d, 0)}
+}
+
+func (s *Sim) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return simTicker{&simTimer{s, s.wait(d, d)}}
+}
+
+type simTimer struct {
+	s *Sim
+	w *waiter
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.w.c
+}
+
+func (t *simTimer) Stop() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	was := t.w.active
+	if was {
+		t.w.active = false
+		t.s.remove(t.w)
+	}
+	return was
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	was := t.w.active
+	if was {
+		t.s.remove(t.w)
+	}
+	t.w.at = t.s.now.Add(d)
+	t.s.add(t.w)
+	return was
+}
+
+type simTicker struct{ t *simTimer }
+
+func (t simTicker) C() <-chan time.Time { return t.t.C() }
+func (t simTicker) Stop()               { t.t.Stop() }
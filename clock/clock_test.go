@@ -0,0 +1,166 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1792000000, 0)
+
+func received(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestSimAdvanceFiresInOrder(t *testing.T) {
+	sim := NewSim(start)
+	var fired []time.Duration
+	timers := map[time.Duration]Timer{}
+	for _, d := range []time.Duration{3 * time.Second, time.Second, 2 * time.Second} {
+		timers[d] = sim.NewTimer(d)
+	}
+	sim.Advance(1500 * time.Millisecond)
+	for _, d := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		if at, ok := received(timers[d].C()); ok {
+			fired = append(fired, at.Sub(start))
+		}
+	}
+	if len(fired) != 1 || fired[0] != time.Second {
+		t.Fatalf("after 1.5s fired %v, want [1s]", fired)
+	}
+	sim.Advance(2 * time.Second)
+	for _, d := range []time.Duration{2 * time.Second, 3 * time.Second} {
+		at, ok := received(timers[d].C())
+		if !ok {
+			t.Fatalf("the %s timer didn't fire by 3.5s", d)
+		}
+		if got := at.Sub(start); got != d {
+			t.Errorf("the %s timer saw %s", d, got)
+		}
+	}
+	if got := sim.Now().Sub(start); got != 3500*time.Millisecond {
+		t.Errorf("Now is %s on, want 3.5s", got)
+	}
+	if n := sim.Pending(); n != 0 {
+		t.Errorf("%d still pending", n)
+	}
+}
+
+func TestSimTicker(t *testing.T) {
+	sim := NewSim(start)
+	tick := sim.NewTicker(time.Second)
+	timer := sim.NewTimer(2500 * time.Millisecond)
+	var ticks []time.Duration
+	for i := 0; i < 3; i++ {
+		sim.Advance(time.Second)
+		at, ok := received(tick.C())
+		if !ok {
+			t.Fatalf("no tick %d", i+1)
+		}
+		ticks = append(ticks, at.Sub(start))
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}; !equal(ticks, want) {
+		t.Errorf("ticked at %v, want %v", ticks, want)
+	}
+	if at, ok := received(timer.C()); !ok || at.Sub(start) != 2500*time.Millisecond {
+		t.Errorf("the timer between the ticks saw %v, %v", at.Sub(start), ok)
+	}
+
+	// ticks not received are dropped, as the time package's
+	sim.Advance(3 * time.Second)
+	if at, _ := received(tick.C()); at.Sub(start) != 4*time.Second {
+		t.Errorf("after 3 ticks unreceived got the one at %s, want 4s", at.Sub(start))
+	}
+	if _, ok := received(tick.C()); ok {
+		t.Error("more than one tick kept")
+	}
+	tick.Stop()
+	sim.Advance(time.Hour)
+	if _, ok := received(tick.C()); ok {
+		t.Error("a stopped ticker ticked")
+	}
+}
+
+func TestSimTimerStopReset(t *testing.T) {
+	sim := NewSim(start)
+	timer := sim.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Error("Stop of a pending timer returned false")
+	}
+	sim.Advance(2 * time.Second)
+	if _, ok := received(timer.C()); ok {
+		t.Error("a stopped timer fired")
+	}
+	if timer.Reset(time.Second) {
+		t.Error("Reset of a stopped timer returned true")
+	}
+	sim.Advance(999 * time.Millisecond)
+	if _, ok := received(timer.C()); ok {
+		t.Error("the reset timer fired early")
+	}
+	sim.Advance(time.Millisecond)
+	if at, ok := received(timer.C()); !ok || at.Sub(start) != 3*time.Second {
+		t.Errorf("the reset timer saw %v, %v, want 3s", at.Sub(start), ok)
+	}
+	if timer.Stop() {
+		t.Error("Stop of a fired timer returned true")
+	}
+}
+
+func TestSimSleep(t *testing.T) {
+	sim := NewSim(start)
+	woke := make(chan time.Time)
+	go func() {
+		sim.Sleep(time.Minute)
+		woke <- sim.Now()
+	}()
+	sim.Wait(1)
+	sim.Advance(59 * time.Second)
+	select {
+	case <-woke:
+		t.Fatal("woke a second early")
+	case <-time.After(10 * time.Millisecond):
+	}
+	sim.Advance(time.Second)
+	select {
+	case at := <-woke:
+		if at.Sub(start) != time.Minute {
+			t.Errorf("woke at %s", at.Sub(start))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still asleep once the minute passed")
+	}
+	if at, ok := received(sim.After(0)); !ok || !at.Equal(sim.Now()) {
+		t.Error("After(0) isn't due right away")
+	}
+}
+
+func TestSinceUntil(t *testing.T) {
+	sim := NewSim(start)
+	sim.Advance(90 * time.Second)
+	if got := Since(sim, start); got != 90*time.Second {
+		t.Errorf("Since = %s, want 1m30s", got)
+	}
+	if got := Until(sim, start.Add(2*time.Minute)); got != 30*time.Second {
+		t.Errorf("Until = %s, want 30s", got)
+	}
+	if got := Until(sim, start); got != -90*time.Second {
+		t.Errorf("Until the past = %s, want -1m30s", got)
+	}
+}
+
+func equal(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
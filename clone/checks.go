@@ -0,0 +1,36 @@
+package clone
+
+import (
+	"fmt"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/remap"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		list := []cli.Check{
+			{Name: "MONGO_URL", Run: func() error {
+				return dial.Probe(*mongoURL,
+					dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+					dial.Privilege{Actions: []string{"find", "listCollections", "listIndexes"}},
+				)
+			}},
+			{Name: "TARGET_URL", Run: func() error {
+				db, c, ok := splitNS(*checkpointNS)
+				if !ok {
+					return fmt.Errorf("CHECKPOINT_NS %q must be db.collection", *checkpointNS)
+				}
+				return dial.Probe(*targetURL,
+					dial.Privilege{Actions: []string{"insert", "update", "remove", "createCollection", "createIndex"}},
+					dial.Privilege{DB: db, Collection: c, Actions: []string{"find", "insert", "update"}},
+				)
+			}},
+		}
+		if _, err := remap.Parse(*remapRules); err != nil {
+			list = append(list, cli.Check{Name: "REMAP", Run: func() error { return err }})
+		}
+		return list
+	})
+}
@@ -0,0 +1,128 @@
+package clone
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/remap"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	copyBatch = flags.Int("COPY_BATCH", 1000, "documents upserted per round trip during the initial copy")
+)
+
+// copyAll copies every collection filter lets through from src to dst,
+// renamed by rules, options and indexes included. Documents are upserted by _id, copying
+// over a partial earlier copy is fine.
+func copyAll(src, dst *mgo.Session, filter nsFilter, rules *remap.Rules) error {
+	dbs, err := src.DatabaseNames()
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		if !filter.DB(db) {
+			continue
+		}
+		names, err := src.DB(db).CollectionNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !filter.NS(db + "." + name) {
+				continue
+			}
+			to := rules.Rename(db + "." + name)
+			i := strings.Index(to, ".")
+			n, err := copyCollection(src.DB(db).C(name), dst.DB(to[:i]).C(to[i+1:]))
+			if err != nil {
+				return fmt.Errorf("copying %s.%s to %s: %s", db, name, to, err)
+			}
+			fmt.Printf("copied %s.%s to %s: %d documents\n", db, name, to, n)
+		}
+	}
+	return nil
+}
+
+func copyCollection(from, to *mgo.Collection) (int, error) {
+	if err := createLike(from, to); err != nil {
+		return 0, err
+	}
+	indexes, err := from.Indexes()
+	if err != nil {
+		return 0, err
+	}
+	for _, index := range indexes {
+		if index.Name == "_id_" {
+			continue
+		}
+		if err := to.EnsureIndex(index); err != nil {
+			return 0, fmt.Errorf("index %s: %s", index.Name, err)
+		}
+	}
+
+	iter := from.Find(nil).Sort("$natural").Iter()
+	bulk := to.Bulk()
+	bulk.Unordered()
+	pending, n := 0, 0
+	var raw bson.Raw
+	var doc struct {
+		ID interface{} `bson:"_id"`
+	}
+	for iter.Next(&raw) {
+		if err := raw.Unmarshal(&doc); err != nil {
+			iter.Close()
+			return n, err
+		}
+		// raw aliases the iterator's buffer, the bulk keeps a copy
+		bulk.Upsert(bson.M{"_id": doc.ID}, bson.Raw{Kind: raw.Kind, Data: append([]byte(nil), raw.Data...)})
+		pending++
+		if pending == *copyBatch {
+			if _, err := bulk.Run(); err != nil {
+				iter.Close()
+				return n, err
+			}
+			n += pending
+			pending = 0
+			bulk = to.Bulk()
+			bulk.Unordered()
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return n, err
+	}
+	if _, err := bulk.Run(); err != nil {
+		return n, err
+	}
+	return n + pending, nil
+}
+
+// createLike creates to with from's options, so capped collections stay
+// capped and validators are kept
+func createLike(from, to *mgo.Collection) error {
+	var res struct {
+		Cursor struct {
+			FirstBatch []struct {
+				Options bson.D `bson:"options"`
+			} `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}
+	err := from.Database.Run(bson.D{
+		{Name: "listCollections", Value: 1},
+		{Name: "filter", Value: bson.M{"name": from.Name}},
+	}, &res)
+	if err != nil {
+		return err
+	}
+	create := bson.D{{Name: "create", Value: to.Name}}
+	if len(res.Cursor.FirstBatch) > 0 {
+		create = append(create, res.Cursor.FirstBatch[0].Options...)
+	}
+	err = to.Database.Run(create, nil)
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 48 {
+		return nil // already exists
+	}
+	return err
+}
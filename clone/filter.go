@@ -0,0 +1,74 @@
+package clone
+
+import (
+	"strings"
+)
+
+var (
+	include = flags.String("INCLUDE", "", "comma separated namespaces to clone, db, db.collection or db.*, everything if empty")
+	exclude = flags.String("EXCLUDE", "", "comma separated namespaces to leave out, applied after INCLUDE")
+)
+
+// nsFilter decides which namespaces are cloned
+type nsFilter struct {
+	include, exclude []string
+}
+
+func parseFilter(include, exclude string) nsFilter {
+	split := func(s string) []string {
+		var patterns []string
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				patterns = append(patterns, strings.TrimSuffix(p, ".*"))
+			}
+		}
+		return patterns
+	}
+	return nsFilter{include: split(include), exclude: split(exclude)}
+}
+
+// matches reports whether ns is db or db.collection of pattern, a db pattern
+// covering all its collections. A collection's pattern covers it alone,
+// not app.users.archive for app.users.
+func matches(patterns []string, ns string) bool {
+	for _, p := range patterns {
+		if ns == p || !strings.Contains(p, ".") && strings.HasPrefix(ns, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// DB reports whether anything in db could be cloned
+func (f nsFilter) DB(db string) bool {
+	switch db {
+	case "admin", "local", "config":
+		return false
+	}
+	for _, p := range f.exclude {
+		if p == db {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, p := range f.include {
+		if p == db || strings.HasPrefix(p, db+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// NS reports whether db.collection is cloned
+func (f nsFilter) NS(ns string) bool {
+	i := strings.Index(ns, ".")
+	if i < 0 || !f.DB(ns[:i]) || strings.HasPrefix(ns[i+1:], "system.") {
+		return false
+	}
+	if len(f.include) > 0 && !matches(f.include, ns) {
+		return false
+	}
+	return !matches(f.exclude, ns)
+}
@@ -0,0 +1,82 @@
+package clone
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	f := parseFilter(" app.* , logs.events,, ", "app.sessions")
+	if want := []string{"app", "logs.events"}; !reflect.DeepEqual(f.include, want) {
+		t.Errorf("include %v, want %v", f.include, want)
+	}
+	if want := []string{"app.sessions"}; !reflect.DeepEqual(f.exclude, want) {
+		t.Errorf("exclude %v, want %v", f.exclude, want)
+	}
+	if f := parseFilter("", ""); f.include != nil || f.exclude != nil {
+		t.Errorf("%+v, want everything", f)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	for _, c := range []struct {
+		include, exclude string
+		ns               map[string]bool
+	}{
+		{"", "", map[string]bool{
+			"app.users":         true,
+			"admin.users":       false,
+			"local.oplog.rs":    false,
+			"config.chunks":     false,
+			"app.system.views":  false,
+			"app.system_backup": true,
+		}},
+		{"app.*", "app.sessions", map[string]bool{
+			"app.users":         true,
+			"app.users.archive": true,
+			"app.sessions":      false,
+			"apples.users":      false,
+			"logs.events":       false,
+		}},
+		{"app.users,logs", "logs.debug", map[string]bool{
+			"app.users":         true,
+			"app.users.archive": false, // another collection
+			"app.orders":        false,
+			"logs.events":       true,
+			"logs.debug":        false,
+		}},
+		{"", "logs", map[string]bool{
+			"app.users":   true,
+			"logs.events": false,
+		}},
+	} {
+		f := parseFilter(c.include, c.exclude)
+		for ns, want := range c.ns {
+			if got := f.NS(ns); got != want {
+				t.Errorf("INCLUDE %q EXCLUDE %q: %s cloned %v, want %v", c.include, c.exclude, ns, got, want)
+			}
+		}
+	}
+}
+
+func TestFilterDB(t *testing.T) {
+	f := parseFilter("app.users,logs", "archive")
+	for db, want := range map[string]bool{
+		"app":     true, // for app.users
+		"logs":    true,
+		"apples":  false,
+		"archive": false,
+		"admin":   false,
+		"local":   false,
+	} {
+		if got := f.DB(db); got != want {
+			t.Errorf("%s: %v, want %v", db, got, want)
+		}
+	}
+	if !parseFilter("", "").DB("anything") || parseFilter("", "").DB("config") {
+		t.Error("everything but admin, local and config, with no INCLUDE")
+	}
+	if parseFilter("", "app.users").DB("app") != true {
+		t.Error("a db left out for a collection excluded")
+	}
+}
@@ -0,0 +1,198 @@
+// Package clone copies a cluster and keeps the copy in sync from the oplog, the oplogctl clone command.
+package clone
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/apply"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/remap"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("clone", "copy a cluster and keep it in sync from the oplog")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL      = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the cluster to clone")
+	targetURL     = flags.String("TARGET_URL", "", "mongodb url of the cluster kept in sync")
+	checkpointNS  = flags.String("CHECKPOINT_NS", "oplog_clone.checkpoint", "db.collection on the target the last applied ts is kept in")
+	resumeRetries = flags.Int("RESUME_RETRIES", 5, "times in a row a failed oplog cursor is resumed before giving up")
+	remapRules    = flags.String("REMAP", "", "namespaces to clone under other names, comma separated from=to or from->to rules of dbs, db name prefixes ending in * or db.collections, INCLUDE and EXCLUDE naming them as on the source")
+)
+
+// checkpoint loads and saves the last applied ts on the target
+type checkpoint struct {
+	c *mgo.Collection
+}
+
+func (cp checkpoint) load() (bson.MongoTimestamp, bool, error) {
+	var doc struct {
+		TS bson.MongoTimestamp `bson:"ts"`
+	}
+	err := cp.c.FindId("clone").One(&doc)
+	if err == mgo.ErrNotFound {
+		return 0, false, nil
+	}
+	return doc.TS, err == nil, err
+}
+
+func (cp checkpoint) save(ts bson.MongoTimestamp) error {
+	_, err := cp.c.UpsertId("clone", bson.M{"ts": ts, "at": time.Now()})
+	return err
+}
+
+// LatestOplog returns the most recent oplog from the database
+func latestOplog(sess *mgo.Session) (apply.Entry, error) {
+	var oplog apply.Entry
+	err := sess.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&oplog)
+	return oplog, err
+}
+
+// Main runs oplogctl clone, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *targetURL == "" {
+		panic(cli.Invalidf("TARGET_URL not set"))
+	}
+	filter := parseFilter(*include, *exclude)
+	rules, err := remap.Parse(*remapRules)
+	if err != nil {
+		panic(err)
+	}
+
+	src, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	err = dial.CheckPrivileges(src,
+		dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+	)
+	if err != nil {
+		panic(err)
+	}
+	dst, err := dial.Dial(*targetURL)
+	if err != nil {
+		panic(err)
+	}
+	var cp checkpoint
+	if db, c, ok := splitNS(*checkpointNS); ok {
+		cp = checkpoint{dst.DB(db).C(c)}
+	} else {
+		panic(cli.Invalidf("CHECKPOINT_NS %q must be db.collection", *checkpointNS))
+	}
+
+	// the oplog is replayed from before the copy started, anything that
+	// changed while copying is applied again
+	since, resumed, err := cp.load()
+	if err != nil {
+		panic(err)
+	}
+	query := cloneQuery("$gt", since)
+	if !resumed {
+		lo, err := latestOplog(src)
+		if err != nil {
+			panic(err)
+		}
+		if err := copyAll(src, dst, filter, rules); err != nil {
+			panic(err)
+		}
+		if err := cp.save(lo.Timestamp); err != nil {
+			panic(err)
+		}
+		query = cloneQuery("$gte", lo.Timestamp)
+		since = lo.Timestamp
+	}
+
+	// SIGUSR1 starts a cutover: once writes to the source are stopped,
+	// everything up to its latest entry is applied and we exit
+	cutoverCh := make(chan os.Signal, 1)
+	signal.Notify(cutoverCh, syscall.SIGUSR1)
+	var cutover bson.MongoTimestamp
+
+	applier := &apply.Applier{Dst: dst, Filter: filter, Remap: rules.Rename}
+	applied := 0
+	lastSave := time.Now()
+	for failures := 0; ; failures++ {
+		iter := src.DB("local").
+			C("oplog.rs").
+			Find(query).
+			Sort("$natural").
+			LogReplay().
+			Tail(time.Second)
+		var oplog apply.Entry
+		for {
+			if iter.Next(&oplog) {
+				failures = 0
+				if err := applier.Apply(&oplog); err != nil {
+					panic(fmt.Errorf("applying %d: %s", oplog.Timestamp, err))
+				}
+				since = oplog.Timestamp
+				query = cloneQuery("$gt", since)
+				applied++
+				oplog = apply.Entry{} // fields missing from the next entry would keep stale values
+			} else if !iter.Timeout() {
+				break
+			}
+			select {
+			case <-cutoverCh:
+				lo, err := latestOplog(src)
+				if err != nil {
+					panic(err)
+				}
+				cutover = lo.Timestamp
+				fmt.Printf("cutover: applying up to %d\n", cutover)
+			default:
+			}
+			if time.Since(lastSave) > time.Second {
+				if err := cp.save(since); err != nil {
+					panic(err)
+				}
+				fmt.Printf("applied %d entries, at %d\n", applied, since)
+				lastSave = time.Now()
+			}
+			if cutover != 0 && since >= cutover {
+				if err := cp.save(since); err != nil {
+					panic(err)
+				}
+				fmt.Printf("cutover complete at %d, the target can take writes\n", since)
+				return
+			}
+		}
+		err = iter.Close()
+		if err == nil {
+			return
+		}
+		if failures >= *resumeRetries {
+			panic(err)
+		}
+		fmt.Fprintf(os.Stderr, "oplog cursor failed: %s, resuming\n", err)
+		time.Sleep(time.Second)
+		src.Refresh()
+	}
+}
+
+// cloneQuery matches entries with ts cmp ts, leaving out chunk migrations
+// which change nothing cluster wide
+func cloneQuery(cmp string, ts bson.MongoTimestamp) bson.M {
+	return bson.M{"ts": bson.M{cmp: ts}, "fromMigrate": bson.M{"$ne": true}}
+}
+
+func splitNS(ns string) (string, string, bool) {
+	for i := 0; i < len(ns); i++ {
+		if ns[i] == '.' {
+			return ns[:i], ns[i+1:], i > 0 && i < len(ns)-1
+		}
+	}
+	return "", "", false
+}
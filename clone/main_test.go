@@ -0,0 +1,111 @@
+package clone
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/remap"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSplitNS(t *testing.T) {
+	for _, c := range []struct {
+		ns       string
+		db, coll string
+		ok       bool
+	}{
+		{"oplog_clone.checkpoint", "oplog_clone", "checkpoint", true},
+		{"app.users.archive", "app", "users.archive", true},
+		{"app.", "app", "", false},
+		{".users", "", "users", false},
+		{"app", "", "", false},
+	} {
+		db, coll, ok := splitNS(c.ns)
+		if db != c.db || coll != c.coll || ok != c.ok {
+			t.Errorf("%q: %q %q %v", c.ns, db, coll, ok)
+		}
+	}
+}
+
+func TestCloneQuery(t *testing.T) {
+	want := bson.M{"ts": bson.M{"$gte": bson.MongoTimestamp(5)}, "fromMigrate": bson.M{"$ne": true}}
+	if q := cloneQuery("$gte", 5); !reflect.DeepEqual(q, want) {
+		t.Errorf("%v, want %v", q, want)
+	}
+}
+
+// TestCopyAll copies a db onto another, renamed, and checkpoints. It
+// needs mongodb at MONGO_URL, and is skipped without one.
+func TestCopyAll(t *testing.T) {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("no mongodb, MONGO_URL is empty")
+	}
+	sess, err := mgo.DialWithTimeout(url, 2*time.Second)
+	if err != nil {
+		t.Skipf("no mongodb at MONGO_URL: %s", err)
+	}
+	defer sess.Close()
+	for _, db := range []string{"clone_test_src", "clone_test_dst", "clone_test_cp"} {
+		sess.DB(db).DropDatabase()
+		defer sess.DB(db).DropDatabase()
+	}
+	src := sess.DB("clone_test_src")
+	if err := src.Run(bson.D{{Name: "create", Value: "capped"}, {Name: "capped", Value: true}, {Name: "size", Value: 4096}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	users := src.C("users")
+	if err := users.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(n int) { *copyBatch = n }(*copyBatch)
+	*copyBatch = 2
+	for i := 0; i < 5; i++ {
+		users.Insert(bson.M{"_id": i, "email": string(rune('a'+i)) + "@example.com"})
+	}
+	src.C("sessions").Insert(bson.M{"_id": 1})
+	// copying over a partial copy
+	sess.DB("clone_test_dst").C("users").Insert(bson.M{"_id": 0, "email": "stale"})
+
+	rules, err := remap.Parse("clone_test_src=clone_test_dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := parseFilter("clone_test_src", "clone_test_src.sessions")
+	if err := copyAll(sess, sess, filter, rules); err != nil {
+		t.Fatal(err)
+	}
+	dst := sess.DB("clone_test_dst")
+	var first bson.M
+	if n, _ := dst.C("users").Count(); n != 5 || dst.C("users").FindId(0).One(&first) != nil || first["email"] != "a@example.com" {
+		t.Errorf("%d users copied, the first %v", n, first)
+	}
+	if n, _ := dst.C("sessions").Count(); n != 0 {
+		t.Error("an excluded collection copied")
+	}
+	indexes, _ := dst.C("users").Indexes()
+	if len(indexes) != 2 || !indexes[1].Unique {
+		t.Errorf("indexes %+v", indexes)
+	}
+	var info struct {
+		Capped bool `bson:"capped"`
+	}
+	if err := dst.Run(bson.D{{Name: "collStats", Value: "capped"}}, &info); err != nil || !info.Capped {
+		t.Errorf("capped lost: %v", err)
+	}
+
+	cp := checkpoint{sess.DB("clone_test_cp").C("checkpoint")}
+	if ts, ok, err := cp.load(); ts != 0 || ok || err != nil {
+		t.Errorf("no checkpoint yet: %d %v %v", ts, ok, err)
+	}
+	if err := cp.save(42 << 32); err != nil {
+		t.Fatal(err)
+	}
+	if ts, ok, err := cp.load(); ts != 42<<32 || !ok || err != nil {
+		t.Errorf("checkpointed: %d %v %v", ts, ok, err)
+	}
+}
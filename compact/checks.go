@@ -0,0 +1,19 @@
+package compact
+
+import (
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		return []cli.Check{{Name: "ARCHIVE " + *archive, Run: func() error {
+			store, err := pitr.Open(*archive)
+			if err != nil {
+				return err
+			}
+			_, err = pitr.Covering(store, 0, 0)
+			return err
+		}}}
+	})
+}
@@ -0,0 +1,317 @@
+// Package compact compacts an archived oplog range to its net effect, the oplogctl compact command.
+package compact
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("compact", "collapse an archived oplog range to its net effect per _id")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	archive = flags.String("ARCHIVE", "", "directory or s3://bucket/prefix of the oplog archive to compact")
+	base    = flags.String("BASE", "", "compact from this base marker, replacing FROM")
+	from    = flags.String("FROM", "", "compact entries after this ts, seconds[:increment] or RFC 3339")
+	to      = flags.String("TO", "", "compact entries up to this ts, to the end of the archive if empty")
+	out     = flags.String("OUT", "", "bson file the compacted entries are written to, as the replay tool reads it, - for stdout")
+)
+
+// entry is an oplog entry as written out, only what replaying needs
+type entry struct {
+	Timestamp   bson.MongoTimestamp `bson:"ts"`
+	Operation   string              `bson:"op"`
+	Namespace   string              `bson:"ns"`
+	Object      bson.D              `bson:"o"`
+	QueryObject bson.M              `bson:"o2,omitempty"`
+	Wall        time.Time           `bson:"wall,omitempty"`
+	FromMigrate bool                `bson:"fromMigrate,omitempty"`
+}
+
+// chain is what's kept of one document's entries
+type chain struct {
+	kept []int // into compactor.entries
+	born bool  // inserted in the range, it didn't exist before
+}
+
+// compactor keeps the entries a range's net effect needs. Per document
+// only the entries since its last full image are kept: an insert, or a
+// replacement which is kept as the insert it amounts to. A document
+// deleted in the range keeps only the delete, or nothing if it was
+// inserted in it too. Updates of a document since aren't merged, they're
+// kept as they are. Commands are kept, a drop also dropping what came
+// before it of what it drops. What's kept stays in oplog order, it
+// replays like the range did.
+type compactor struct {
+	entries []*entry // nil once superseded
+	docs    map[string]map[string]*chain
+	read    int
+}
+
+func newCompactor() *compactor {
+	return &compactor{docs: make(map[string]map[string]*chain)}
+}
+
+func idKey(id interface{}) string {
+	data, _ := bson.Marshal(bson.M{"_id": id})
+	return string(data)
+}
+
+func lookupID(doc bson.D) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Name == "_id" {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// replacement reports whether an update's o is a whole document
+func replacement(o bson.D) bool {
+	return len(o) > 0 && !strings.HasPrefix(o[0].Name, "$")
+}
+
+func (c *compactor) keep(e *entry) int {
+	c.entries = append(c.entries, e)
+	return len(c.entries) - 1
+}
+
+// forget lets go of the chains of the namespaces match matches, dropping
+// what they kept too if drop is set
+func (c *compactor) forget(match func(ns string) bool, drop bool) {
+	for ns, docs := range c.docs {
+		if !match(ns) {
+			continue
+		}
+		if drop {
+			for _, ch := range docs {
+				for _, i := range ch.kept {
+					c.entries[i] = nil
+				}
+			}
+		}
+		delete(c.docs, ns)
+	}
+}
+
+// add takes the next entry of the range
+func (c *compactor) add(e *entry) error {
+	c.read++
+	switch {
+	case e.Operation == "n" || e.FromMigrate:
+		return nil
+	case e.Operation == "c":
+		return c.command(e)
+	}
+	var id interface{}
+	var ok bool
+	if e.Operation == "u" {
+		id, ok = e.QueryObject["_id"]
+		if replacement(e.Object) {
+			// the document existed on the source, upserting it is the same
+			e = &entry{Timestamp: e.Timestamp, Operation: "i", Namespace: e.Namespace, Object: e.Object, Wall: e.Wall}
+		}
+	} else {
+		id, ok = lookupID(e.Object)
+	}
+	if !ok {
+		return fmt.Errorf("%s on %s at %s without _id", e.Operation, e.Namespace, optime.Format(e.Timestamp))
+	}
+	docs := c.docs[e.Namespace]
+	if docs == nil {
+		docs = make(map[string]*chain)
+		c.docs[e.Namespace] = docs
+	}
+	key := idKey(id)
+	ch := docs[key]
+	if ch == nil {
+		ch = &chain{born: e.Operation == "i"}
+		docs[key] = ch
+	}
+	switch e.Operation {
+	case "i", "d":
+		for _, i := range ch.kept {
+			c.entries[i] = nil
+		}
+		ch.kept = ch.kept[:0]
+		if e.Operation == "d" && ch.born {
+			delete(docs, key) // came and went
+			return nil
+		}
+		ch.kept = append(ch.kept, c.keep(e))
+	case "u":
+		ch.kept = append(ch.kept, c.keep(e))
+	default:
+		return fmt.Errorf("unknown op %q at %s", e.Operation, optime.Format(e.Timestamp))
+	}
+	return nil
+}
+
+func (c *compactor) command(e *entry) error {
+	if len(e.Object) == 0 {
+		return nil
+	}
+	db := strings.TrimSuffix(e.Namespace, ".$cmd")
+	name := e.Object[0].Name
+	arg, _ := e.Object[0].Value.(string)
+	switch name {
+	case "applyOps":
+		return c.applyOps(e)
+	case "drop":
+		c.forget(func(ns string) bool { return ns == db+"."+arg }, true)
+	case "dropDatabase":
+		c.forget(func(ns string) bool { return strings.HasPrefix(ns, db+".") }, true)
+	case "renameCollection":
+		// what came before applies under the old name, a collection
+		// created by that name later is another one
+		to, _ := e.Object.Map()["to"].(string)
+		c.forget(func(ns string) bool { return ns == arg || ns == to }, false)
+	}
+	c.keep(e)
+	return nil
+}
+
+// applyOps adds the operations of a transaction as entries of their own.
+// Prepared ones aren't applied, as by the replay tool.
+func (c *compactor) applyOps(e *entry) error {
+	var ops []interface{}
+	for _, el := range e.Object {
+		switch el.Name {
+		case "applyOps":
+			ops, _ = el.Value.([]interface{})
+		case "prepare":
+			if el.Value == true {
+				return nil
+			}
+		}
+	}
+	for _, op := range ops {
+		data, err := bson.Marshal(op)
+		if err != nil {
+			return err
+		}
+		var inner entry
+		if err := bson.Unmarshal(data, &inner); err != nil {
+			return err
+		}
+		// set after, unmarshaling zeroes them
+		inner.Timestamp, inner.Wall = e.Timestamp, e.Wall
+		if err := c.add(&inner); err != nil {
+			return err
+		}
+		c.read--
+	}
+	return nil
+}
+
+// readFile adds a bson file's entries after since up to until
+func (c *compactor) readFile(r io.Reader, since, until bson.MongoTimestamp) error {
+	br := bsonfile.NewReader(r)
+	for {
+		var e entry
+		err := br.Next(&e)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if e.Timestamp > since && (until == 0 || e.Timestamp <= until) {
+			if err := c.add(&e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Main compacts a range of an oplog archive into the entries its net
+// effect needs, a smaller changeset to bootstrap a sink with or replay
+// instead. The range's documents are held in memory.
+func Main(args []string) {
+	flags.Parse(args)
+	if *archive == "" || *out == "" {
+		panic(cli.Invalidf("ARCHIVE and OUT have to be set"))
+	}
+	store, err := pitr.Open(*archive)
+	if err != nil {
+		panic(err)
+	}
+	since, err := optime.Parse(*from)
+	if err != nil {
+		panic(cli.Invalidf("FROM: %s", err))
+	}
+	if *base != "" {
+		if *from != "" {
+			panic(cli.Invalidf("BASE replaces FROM"))
+		}
+		b, err := pitr.GetBase(store, *base)
+		if err != nil {
+			panic(err)
+		}
+		since = b.TS
+	}
+	until, err := optime.Parse(*to)
+	if err != nil {
+		panic(cli.Invalidf("TO: %s", err))
+	}
+	segments, err := pitr.Covering(store, since, until)
+	if err != nil {
+		panic(err)
+	}
+
+	c := newCompactor()
+	for _, seg := range segments {
+		r, err := store.Open(seg.Name())
+		if err != nil {
+			panic(err)
+		}
+		err = c.readFile(r, since, until)
+		r.Close()
+		if err != nil {
+			panic(fmt.Errorf("%s: %s", seg.Name(), err))
+		}
+	}
+
+	f := os.Stdout
+	if *out != "-" {
+		if f, err = os.Create(*out); err != nil {
+			panic(err)
+		}
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	written := 0
+	for _, e := range c.entries {
+		if e == nil {
+			continue
+		}
+		data, err := bson.Marshal(e)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			panic(err)
+		}
+		written++
+	}
+	if err := w.Flush(); err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(os.Stderr, "compacted %d entries after %s into %d\n", c.read, optime.Format(since), written)
+}
@@ -0,0 +1,188 @@
+package compact
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// d is a bson.D of name, value pairs
+func d(pairs ...interface{}) bson.D {
+	var doc bson.D
+	for i := 0; i < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
+
+func insert(ts bson.MongoTimestamp, ns string, id interface{}) *entry {
+	return &entry{Timestamp: ts, Operation: "i", Namespace: ns, Object: d("_id", id, "v", int(ts))}
+}
+
+func update(ts bson.MongoTimestamp, ns string, id interface{}) *entry {
+	return &entry{Timestamp: ts, Operation: "u", Namespace: ns, Object: d("$set", d("v", int(ts))), QueryObject: bson.M{"_id": id}}
+}
+
+func replace(ts bson.MongoTimestamp, ns string, id interface{}) *entry {
+	return &entry{Timestamp: ts, Operation: "u", Namespace: ns, Object: d("_id", id, "v", int(ts)), QueryObject: bson.M{"_id": id}}
+}
+
+func remove(ts bson.MongoTimestamp, ns string, id interface{}) *entry {
+	return &entry{Timestamp: ts, Operation: "d", Namespace: ns, Object: d("_id", id)}
+}
+
+func command(ts bson.MongoTimestamp, db string, cmd ...interface{}) *entry {
+	return &entry{Timestamp: ts, Operation: "c", Namespace: db + ".$cmd", Object: d(cmd...)}
+}
+
+// kept writes what c kept as op@ts, in order
+func kept(c *compactor) []string {
+	var got []string
+	for _, e := range c.entries {
+		if e != nil {
+			got = append(got, fmt.Sprintf("%s@%d", e.Operation, e.Timestamp))
+		}
+	}
+	return got
+}
+
+func TestCompact(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		entries []*entry
+		want    []string
+	}{
+		{"updates kept after the insert", []*entry{
+			insert(1, "app.a", 1), update(2, "app.a", 1), update(3, "app.a", 1),
+		}, []string{"i@1", "u@2", "u@3"}},
+		{"a replacement supersedes, as an insert", []*entry{
+			insert(1, "app.a", 1), update(2, "app.a", 1), replace(3, "app.a", 1), update(4, "app.a", 1),
+		}, []string{"i@3", "u@4"}},
+		{"existing, deleted", []*entry{
+			update(1, "app.a", 1), update(2, "app.a", 1), remove(3, "app.a", 1),
+		}, []string{"d@3"}},
+		{"came and went", []*entry{
+			insert(1, "app.a", 1), update(2, "app.a", 1), remove(3, "app.a", 1),
+		}, nil},
+		{"deleted then inserted again", []*entry{
+			remove(1, "app.a", 1), insert(2, "app.a", 1),
+		}, []string{"i@2"}},
+		{"documents and namespaces apart", []*entry{
+			insert(1, "app.a", 1), insert(2, "app.a", 2), insert(3, "app.b", 1), remove(4, "app.a", 1), update(5, "app.b", 1),
+		}, []string{"i@2", "i@3", "u@5"}},
+		{"ids by value and type", []*entry{
+			insert(1, "app.a", 1), insert(2, "app.a", "1"), remove(3, "app.a", "1"),
+		}, []string{"i@1"}},
+		{"noops and migrations skipped", []*entry{
+			{Timestamp: 1, Operation: "n", Object: d("msg", "periodic noop")},
+			{Timestamp: 2, Operation: "i", Namespace: "app.a", Object: d("_id", 1), FromMigrate: true},
+			insert(3, "app.a", 2),
+		}, []string{"i@3"}},
+		{"drop drops what came before", []*entry{
+			insert(1, "app.a", 1), insert(2, "app.b", 1), command(3, "app", "drop", "a"), insert(4, "app.a", 1),
+		}, []string{"i@2", "c@3", "i@4"}},
+		{"dropDatabase", []*entry{
+			insert(1, "app.a", 1), insert(2, "other.a", 1), command(3, "app", "dropDatabase", 1), update(4, "app.a", 1),
+		}, []string{"i@2", "c@3", "u@4"}},
+		{"a rename keeps what came before", []*entry{
+			insert(1, "app.a", 1), command(2, "admin", "renameCollection", "app.a", "to", "app.b"),
+			insert(3, "app.a", 1), remove(4, "app.a", 1), update(5, "app.b", 1),
+		}, []string{"i@1", "c@2", "u@5"}},
+	} {
+		cp := newCompactor()
+		for _, e := range c.entries {
+			if err := cp.add(e); err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+		}
+		if got := kept(cp); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: kept %v, want %v", c.name, got, c.want)
+		}
+		if cp.read != len(c.entries) {
+			t.Errorf("%s: read %d, want %d", c.name, cp.read, len(c.entries))
+		}
+	}
+}
+
+func TestCompactTransaction(t *testing.T) {
+	wall := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	txn := command(5, "admin", "applyOps", []interface{}{
+		d("op", "i", "ns", "app.a", "o", d("_id", 1)),
+		d("op", "u", "ns", "app.a", "o", d("$set", d("x", 1)), "o2", d("_id", 1)),
+		d("op", "d", "ns", "app.a", "o", d("_id", 2)),
+	})
+	txn.Wall = wall
+	cp := newCompactor()
+	if err := cp.add(update(1, "app.a", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.add(txn); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := kept(cp), []string{"i@5", "u@5", "d@5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	for _, e := range cp.entries {
+		if e != nil && !e.Wall.Equal(wall) {
+			t.Errorf("%s of the transaction has wall %v, want its %v", e.Operation, e.Wall, wall)
+		}
+	}
+	if cp.read != 2 {
+		t.Errorf("read %d, want the 2 entries of the range", cp.read)
+	}
+
+	prepared := command(6, "admin", "applyOps", []interface{}{d("op", "d", "ns", "app.a", "o", d("_id", 1))}, "prepare", true)
+	if err := cp.add(prepared); err != nil {
+		t.Fatal(err)
+	}
+	if got := kept(cp); len(got) != 3 {
+		t.Errorf("a prepared transaction was applied: %v", got)
+	}
+}
+
+func TestCompactWithoutID(t *testing.T) {
+	for _, e := range []*entry{
+		{Timestamp: 1, Operation: "i", Namespace: "app.a", Object: d("v", 1)},
+		{Timestamp: 1, Operation: "u", Namespace: "app.a", Object: d("$set", d("v", 1))},
+	} {
+		if err := newCompactor().add(e); err == nil || !strings.Contains(err.Error(), "without _id") {
+			t.Errorf("%s without _id: %v", e.Operation, err)
+		}
+	}
+	if err := newCompactor().add(&entry{Operation: "x", Namespace: "app.a", Object: d("_id", 1)}); err == nil {
+		t.Error("an unknown op was taken")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	var buf bytes.Buffer
+	for ts := bson.MongoTimestamp(1); ts <= 5; ts++ {
+		data, err := bson.Marshal(update(ts, "app.a", int(ts)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+	}
+	cp := newCompactor()
+	if err := cp.readFile(bytes.NewReader(buf.Bytes()), 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := kept(cp), []string{"u@2", "u@3", "u@4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after 1 up to 4: %v, want %v", got, want)
+	}
+	cp = newCompactor()
+	if err := cp.readFile(bytes.NewReader(buf.Bytes()), 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := kept(cp), []string{"u@4", "u@5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after 3 to the end: %v, want %v", got, want)
+	}
+	if err := newCompactor().readFile(bytes.NewReader(buf.Bytes()[:buf.Len()-2]), 0, 0); err == nil {
+		t.Error("a truncated file read")
+	}
+}
@@ -0,0 +1,199 @@
+// Package config reads oplogctl's configuration files, YAML or TOML, into
+// settings by line so mistakes can be pointed at. Only what the settings
+// need of either is understood: nested tables or maps, strings, numbers,
+// booleans and lists of them, anything else is an error.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Setting is one key's value, lists joined with commas as the settings
+// take them
+type Setting struct {
+	Path  []string // tables or maps down to the key, the key last
+	Value string
+	List  []string // a list's values, Value being them joined with commas
+	Line  int
+}
+
+// Key is the setting's name
+func (s Setting) Key() string {
+	return s.Path[len(s.Path)-1]
+}
+
+// File is a parsed configuration file
+type File struct {
+	Name     string
+	Settings []Setting
+}
+
+// Error is a mistake on a line of a file
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// Load reads the file at path, as TOML if it ends in .toml and YAML
+// otherwise
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse parses data, named name, as TOML if name ends in .toml and YAML
+// otherwise
+func Parse(name string, data []byte) (*File, error) {
+	var settings []Setting
+	var err error
+	if strings.EqualFold(filepath.Ext(name), ".toml") {
+		settings, err = parseTOML(string(data))
+	} else {
+		settings, err = parseYAML(string(data))
+	}
+	if e, ok := err.(*Error); ok {
+		e.File = name
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &File{Name: name, Settings: settings}, nil
+}
+
+// Errorf returns an error pointing at s's line
+func (f *File) Errorf(s Setting, format string, args ...interface{}) error {
+	return &Error{File: f.Name, Line: s.Line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// stripComment cuts a # comment off a line, outside quotes
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// scalar unquotes a single value, quoted strings as in both formats
+func scalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return "", nil
+	}
+	switch s[0] {
+	case '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case '"':
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		var b strings.Builder
+		for i := 1; i < len(s)-1; i++ {
+			if s[i] != '\\' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i++; i == len(s)-1 {
+				return "", fmt.Errorf("bad escape in %s", s)
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"':
+				b.WriteByte(s[i])
+			default:
+				return "", fmt.Errorf("unknown escape \\%c in %s", s[i], s)
+			}
+		}
+		return b.String(), nil
+	}
+	return s, nil
+}
+
+// list parses a one line [a, b] list into its values
+func list(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list %s", s)
+	}
+	values := []string{}
+	for _, item := range splitList(s[1 : len(s)-1]) {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		if t := strings.TrimSpace(item); t[0] == '[' || t[0] == '{' {
+			return nil, fmt.Errorf("lists of lists or maps aren't supported")
+		}
+		v, err := scalar(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// splitList splits on commas outside quotes
+func splitList(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// parse sets s' value from text, as either format writes it
+func (s *Setting) parse(text string) error {
+	if strings.HasPrefix(strings.TrimSpace(text), "[") {
+		values, err := list(text)
+		if err != nil {
+			return err
+		}
+		s.Value, s.List = strings.Join(values, ","), values
+		return nil
+	}
+	v, err := scalar(text)
+	s.Value = v
+	return err
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		name, file, data string
+		want             []Setting
+	}{
+		{
+			"yaml", "oplogctl.yaml", `
+shared:
+  mongo_url: mongodb://db0,db1/?replicaSet=rs0 # primary first
+tail:
+  source:
+    source: "change#stream"
+    watch: [app, 'billing']
+    mongo_urls: ["eu=mongodb://eu0,eu1/?replicaSet=eu", "us=mongodb://us0/"]
+  sample:
+    - app.users=0.5
+    - app.orders
+`,
+			[]Setting{
+				{Path: []string{"shared", "mongo_url"}, Value: "mongodb://db0,db1/?replicaSet=rs0", Line: 3},
+				{Path: []string{"tail", "source", "source"}, Value: "change#stream", Line: 6},
+				{Path: []string{"tail", "source", "watch"}, Value: "app,billing", List: []string{"app", "billing"}, Line: 7},
+				{Path: []string{"tail", "source", "mongo_urls"}, Value: "eu=mongodb://eu0,eu1/?replicaSet=eu,us=mongodb://us0/", List: []string{"eu=mongodb://eu0,eu1/?replicaSet=eu", "us=mongodb://us0/"}, Line: 8},
+				{Path: []string{"tail", "sample"}, Value: "app.users=0.5,app.orders", List: []string{"app.users=0.5", "app.orders"}, Line: 11},
+			},
+		},
+		{
+			"yaml document markers", "c.yml", "---\ntail:\n  duration: 5m\n",
+			[]Setting{{Path: []string{"tail", "duration"}, Value: "5m", Line: 3}},
+		},
+		{
+			"yaml quoted keys", "c.yaml", "tail:\n  \"ns:app\": 1\n  'b': \"x: y\"\n",
+			[]Setting{
+				{Path: []string{"tail", "ns:app"}, Value: "1", Line: 2},
+				{Path: []string{"tail", "b"}, Value: "x: y", Line: 3},
+			},
+		},
+		{
+			"toml", "oplogctl.toml", `
+[shared]
+mongo_url = "mongodb://db0,db1/?replicaSet=rs0" # primary first
+
+[tail.source]
+source = 'changestream'
+watch = ["app", "billing"]
+"checkpointing".checkpoint_dir = "/var/lib/oplogctl"
+`,
+			[]Setting{
+				{Path: []string{"shared", "mongo_url"}, Value: "mongodb://db0,db1/?replicaSet=rs0", Line: 3},
+				{Path: []string{"tail", "source", "source"}, Value: "changestream", Line: 6},
+				{Path: []string{"tail", "source", "watch"}, Value: "app,billing", List: []string{"app", "billing"}, Line: 7},
+				{Path: []string{"tail", "source", "checkpointing", "checkpoint_dir"}, Value: "/var/lib/oplogctl", Line: 8},
+			},
+		},
+	} {
+		f, err := Parse(c.file, []byte(c.data))
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(f.Settings, c.want) {
+			t.Errorf("%s: settings\n%#v\nwant\n%#v", c.name, f.Settings, c.want)
+		}
+	}
+}
+
+// what isn't understood fails with its line rather than being read as a
+// string
+func TestParseUnsupported(t *testing.T) {
+	for _, c := range []struct {
+		name, file, data string
+		line             int
+		msg              string
+	}{
+		{"block scalar", "c.yaml", "tail:\n  watch: |\n    app\n", 2, "block scalars"},
+		{"folded scalar", "c.yaml", "tail:\n  watch: >-\n    app\n", 2, "block scalars"},
+		{"flow map", "c.yaml", "tail: {watch: app}\n", 1, "flow maps"},
+		{"anchor", "c.yaml", "shared:\n  mongo_url: &url mongodb://db0/\n", 2, "anchors"},
+		{"alias", "c.yaml", "tail:\n  mongo_url: *url\n", 2, "aliases"},
+		{"tag", "c.yaml", "tail:\n  sample: !!str 0.5\n", 2, "tags"},
+		{"map on one line", "c.yaml", "tail:\n  source: watch: app\n", 2, "on one line"},
+		{"map in a list", "c.yaml", "tail:\n  sample:\n    - ns: app.users\n", 3, "maps in lists"},
+		{"multi-line flow list", "c.yaml", "tail:\n  watch: [app,\n    billing]\n", 2, "unterminated list"},
+		{"nested list", "c.yaml", "tail:\n  watch: [app, [billing]]\n", 2, "lists of lists"},
+		{"second document", "c.yaml", "tail:\n  watch: app\n---\ntail:\n  watch: billing\n", 3, "one yaml document"},
+		{"tab indent", "c.yaml", "tail:\n\twatch: app\n", 2, "tabs"},
+		{"no value", "c.yaml", "tail:\n  watch:\nstats:\n  port: 1\n", 2, "watch has no value"},
+		{"inline table", "c.toml", "[tail]\nsource = { source = \"oplog\" }\n", 2, "inline tables"},
+		{"multi-line array", "c.toml", "[tail]\nwatch = [\n  \"app\",\n]\n", 2, "more than one line"},
+		{"multi-line string", "c.toml", "[tail]\nwatch = \"\"\"\napp\n\"\"\"\n", 2, "multi-line strings"},
+		{"array of tables", "c.toml", "[[tail]]\nwatch = \"app\"\n", 1, "expected [table]"},
+		{"nested array", "c.toml", "[tail]\nwatch = [\"app\", [\"billing\"]]\n", 2, "lists of lists"},
+		{"bad escape", "c.toml", "[tail]\nwatch = \"a\\qb\"\n", 2, "unknown escape"},
+	} {
+		_, err := Parse(c.file, []byte(c.data))
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: error %#v, want a *Error", c.name, err)
+			continue
+		}
+		if e.File != c.file || e.Line != c.line || !strings.Contains(e.Msg, c.msg) {
+			t.Errorf("%s: %s, want %s:%d with %q", c.name, e, c.file, c.line, c.msg)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseTOML parses [tables], dotted ones included, of key = value pairs,
+// dotted keys included, with one line arrays. Other toml, arrays of tables,
+// inline tables and multi-line strings or arrays, is an error rather than
+// taken as a string.
+func parseTOML(data string) ([]Setting, error) {
+	var settings []Setting
+	var table []string
+	for n, raw := range strings.Split(data, "\n") {
+		line := n + 1
+		text := strings.TrimSpace(stripComment(strings.TrimRight(raw, "\r")))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			if strings.HasPrefix(text, "[[") || !strings.HasSuffix(text, "]") {
+				return nil, &Error{Line: line, Msg: fmt.Sprintf("expected [table], got %q", text)}
+			}
+			keys, err := dotted(text[1 : len(text)-1])
+			if err != nil {
+				return nil, &Error{Line: line, Msg: err.Error()}
+			}
+			table = keys
+			continue
+		}
+		i := strings.Index(text, "=")
+		if i <= 0 {
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("expected key = value, got %q", text)}
+		}
+		keys, err := dotted(text[:i])
+		if err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		if err := unsupportedTOML(text[i+1:]); err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		setting := Setting{Path: append(append([]string(nil), table...), keys...), Line: line}
+		if err := setting.parse(text[i+1:]); err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+// unsupportedTOML fails on a value written in toml parseTOML doesn't
+// understand
+func unsupportedTOML(s string) error {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "{"):
+		return fmt.Errorf("inline tables aren't supported, use a [table]")
+	case strings.HasPrefix(s, `"""`), strings.HasPrefix(s, "'''"):
+		return fmt.Errorf("multi-line strings aren't supported")
+	case strings.HasPrefix(s, "[") && !strings.HasSuffix(s, "]"):
+		return fmt.Errorf("arrays over more than one line aren't supported")
+	}
+	return nil
+}
+
+// dotted splits a.b."c.d" into its keys
+func dotted(s string) ([]string, error) {
+	var keys []string
+	for _, part := range splitDotted(s) {
+		key, err := scalar(part)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty key in %q", strings.TrimSpace(s))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func splitDotted(s string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '.':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
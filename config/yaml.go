@@ -0,0 +1,155 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseYAML parses block maps, nested by indentation, of scalars, one line
+// [a, b] lists and lists of "- item" lines. Other yaml, block scalars, flow
+// maps, anchors, aliases and tags, or more than one document, is an error
+// rather than taken as a string.
+func parseYAML(data string) ([]Setting, error) {
+	type level struct {
+		indent int
+		key    string
+	}
+	var settings []Setting
+	var stack []level // maps opened, innermost last
+	var open *Setting // a key with no value yet, a map or a list follows
+	openIndent := 0
+	started := false // a setting's been read, a --- after ends the document
+	path := func() []string {
+		p := make([]string, len(stack))
+		for i, l := range stack {
+			p[i] = l.key
+		}
+		return p
+	}
+	for n, raw := range strings.Split(data, "\n") {
+		line := n + 1
+		text := strings.TrimRight(stripComment(strings.TrimRight(raw, "\r")), " ")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" {
+			continue
+		}
+		if trimmed == "---" || trimmed == "..." {
+			if started {
+				return nil, &Error{Line: line, Msg: "only one yaml document is supported"}
+			}
+			continue
+		}
+		started = true
+		if strings.HasPrefix(trimmed, "\t") || strings.Contains(text[:len(text)-len(trimmed)], "\t") {
+			return nil, &Error{Line: line, Msg: "tabs can't indent yaml"}
+		}
+		indent := len(text) - len(trimmed)
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if open == nil || indent < openIndent {
+				return nil, &Error{Line: line, Msg: "list item outside a list"}
+			}
+			item := strings.TrimPrefix(trimmed, "-")
+			if err := unsupportedYAML(item); err != nil {
+				return nil, &Error{Line: line, Msg: err.Error()}
+			}
+			v, err := scalar(item)
+			if err != nil {
+				return nil, &Error{Line: line, Msg: err.Error()}
+			}
+			open.List = append(open.List, v)
+			open.Value = strings.Join(open.List, ",")
+			open.Line = line
+			continue
+		}
+		if open != nil {
+			if open.Line != 0 {
+				// a list ended
+				settings = append(settings, *open)
+				open = nil
+			} else if indent > openIndent {
+				// a map is opened, its key had no value
+				stack = append(stack, level{indent: openIndent, key: open.Key()})
+				open = nil
+			} else {
+				return nil, &Error{Line: line - 1, Msg: fmt.Sprintf("%s has no value", open.Key())}
+			}
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		i := keyEnd(trimmed)
+		if i <= 0 || (i+1 < len(trimmed) && trimmed[i+1] != ' ') {
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("expected key: value, got %q", trimmed)}
+		}
+		if err := unsupportedYAML(trimmed[:i]); err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		key, err := scalar(trimmed[:i])
+		if err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		rest := strings.TrimSpace(trimmed[i+1:])
+		if err := unsupportedYAML(rest); err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		if rest == "" {
+			open = &Setting{Path: append(path(), key)}
+			openIndent = indent
+			continue
+		}
+		setting := Setting{Path: append(path(), key), Line: line}
+		if err := setting.parse(rest); err != nil {
+			return nil, &Error{Line: line, Msg: err.Error()}
+		}
+		settings = append(settings, setting)
+	}
+	if open != nil {
+		if open.Line == 0 {
+			return nil, &Error{Line: len(strings.Split(data, "\n")), Msg: fmt.Sprintf("%s has no value", open.Key())}
+		}
+		settings = append(settings, *open)
+	}
+	return settings, nil
+}
+
+// keyEnd returns the index of the colon ending a line's key, past the
+// key's quotes if it's quoted
+func keyEnd(s string) int {
+	if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
+		if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+			if i := strings.Index(s[end+2:], ":"); i >= 0 {
+				return end + 2 + i
+			}
+		}
+	}
+	return strings.Index(s, ":")
+}
+
+// unsupportedYAML fails on a key or value written in yaml parseYAML doesn't
+// understand
+func unsupportedYAML(s string) error {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	switch s[0] {
+	case '|', '>':
+		return fmt.Errorf("block scalars aren't supported, quote %s on one line", s)
+	case '{':
+		return fmt.Errorf("flow maps aren't supported, nest the keys by indentation")
+	case '&', '*':
+		return fmt.Errorf("anchors and aliases aren't supported")
+	case '!':
+		return fmt.Errorf("tags aren't supported")
+	case '?', '@', '`':
+		return fmt.Errorf("%c can't start a plain value, quote %s", s[0], s)
+	case '"', '\'', '[':
+		return nil // a string or list, checked as it's parsed
+	}
+	if strings.HasSuffix(s, ":") || strings.Contains(s, ": ") {
+		return fmt.Errorf("maps in lists or on one line aren't supported, quote %s if it's a string", s)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package dial
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ianschenck/envflag"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	authMechanism = envflag.String("MONGO_AUTH_MECHANISM", "", "auth mechanism, overrides authMechanism in MONGO_URL; adds SCRAM-SHA-256 and MONGODB-AWS to what mgo supports")
+	authSource    = envflag.String("MONGO_AUTH_SOURCE", "", "database holding the user, overrides authSource in MONGO_URL")
+)
+
+// setupAuth applies the auth flags and credential sources to info. mgo
+// handles everything but SCRAM-SHA-256 and MONGODB-AWS, which are done on
+// each new connection by wrapping dialServer, with the credentials hidden
+// from mgo. The same goes for SCRAM-SHA-1 when the credentials can rotate,
+// mgo would keep using the ones it dialed with.
+func setupAuth(info *mgo.DialInfo, config *tls.Config, dialServer func(*mgo.ServerAddr) (net.Conn, error)) (func(*mgo.ServerAddr) (net.Conn, error), error) {
+	if *authMechanism != "" {
+		info.Mechanism = *authMechanism
+	}
+	if *authSource != "" {
+		info.Source = *authSource
+	}
+	creds, err := loadCredentials(info)
+	if err != nil {
+		return nil, err
+	}
+	source := info.Source
+	if source == "" {
+		source = info.Database
+	}
+	if source == "" {
+		source = "admin"
+	}
+	switch info.Mechanism {
+	case "MONGODB-X509":
+		if config == nil || len(config.Certificates) == 0 {
+			return nil, errors.New("MONGODB-X509 needs MONGO_TLS_CERT")
+		}
+		if info.Username == "" {
+			// mgo insists on a user, it's the certificate subject
+			cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+			if err != nil {
+				return nil, err
+			}
+			info.Username = cert.Subject.String()
+		}
+	case "", "SCRAM-SHA-1", "SCRAM-SHA-256":
+		mechanism := info.Mechanism
+		if mechanism != "SCRAM-SHA-256" {
+			if !creds.reloads || info.Username == "" {
+				break // mgo handles it, or there is no auth at all
+			}
+			mechanism = "SCRAM-SHA-1"
+		}
+		if info.Username == "" {
+			return nil, errors.New("SCRAM-SHA-256 needs a username")
+		}
+		info.Username, info.Password, info.Mechanism = "", "", ""
+		dialServer = authenticated(dialServer, mechanism, func(conn net.Conn) error {
+			user, password := creds.get()
+			return scram(conn, mechanism, source, user, password)
+		})
+	case "MONGODB-AWS":
+		// credentials from the URL are optional, see lookupAWSCredentials
+		info.Username, info.Password, info.Mechanism = "", "", ""
+		dialServer = authenticated(dialServer, "MONGODB-AWS", func(conn net.Conn) error {
+			user, password := creds.get()
+			return mongodbAWS(conn, user, password)
+		})
+	}
+	return dialServer, nil
+}
+
+// authenticated wraps dialServer to run auth on every new connection
+func authenticated(dialServer func(*mgo.ServerAddr) (net.Conn, error), mechanism string, auth func(net.Conn) error) func(*mgo.ServerAddr) (net.Conn, error) {
+	return func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := dialServer(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := auth(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s auth against %s: %s", mechanism, addr, err)
+		}
+		return conn, nil
+	}
+}
+
+type saslReply struct {
+	ConversationID interface{} `bson:"conversationId"`
+	Done           bool        `bson:"done"`
+	Payload        []byte      `bson:"payload"`
+	Ok             float64     `bson:"ok"`
+	Errmsg         string      `bson:"errmsg"`
+}
+
+// scramMinIterations is the fewest iterations RFC 5802 has a server ask for
+const scramMinIterations = 4096
+
+// scram runs the SCRAM-SHA-1 (RFC 5802) or SCRAM-SHA-256 (RFC 7677)
+// conversation on conn, as OP_MSG or before 3.6 as OP_QUERY
+func scram(conn net.Conn, mechanism, source, user, password string) error {
+	wire, err := wireVersion(conn, 0)
+	if err != nil {
+		return err
+	}
+	run := runCommand
+	if wire < opMsgFrom {
+		run = runQuery
+	}
+	h := sha256.New
+	if mechanism == "SCRAM-SHA-1" {
+		// mongo hashes SHA-1 passwords the way MONGODB-CR did
+		sum := md5.Sum([]byte(user + ":mongo:" + password))
+		password = hex.EncodeToString(sum[:])
+		h = sha1.New
+	}
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	clientNonce := base64.StdEncoding.EncodeToString(nonce)
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	clientFirstBare := "n=" + name + ",r=" + clientNonce
+
+	var reply saslReply
+	err = run(conn, source, bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: mechanism},
+		{Name: "payload", Value: []byte("n,," + clientFirstBare)},
+		{Name: "autoAuthorize", Value: 1},
+	}, &reply)
+	if err != nil {
+		return err
+	}
+	serverFirst := string(reply.Payload)
+	attrs := scramAttrs(serverFirst)
+	if !strings.HasPrefix(attrs["r"], clientNonce) {
+		return errors.New("server nonce doesn't extend ours")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return err
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil {
+		return err
+	}
+	if iterations < scramMinIterations {
+		return fmt.Errorf("server asks for %d iterations, fewer than the %d SCRAM needs", iterations, scramMinIterations)
+	}
+
+	salted := pbkdf2(h, []byte(password), salt, iterations, h().Size())
+	clientKey := hmacHash(h, salted, "Client Key")
+	stored := h()
+	stored.Write(clientKey)
+	storedKey := stored.Sum(nil)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := hmacHash(h, storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	clientFinal := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+
+	id := reply.ConversationID
+	err = run(conn, source, bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: id},
+		{Name: "payload", Value: []byte(clientFinal)},
+	}, &reply)
+	if err != nil {
+		return err
+	}
+	serverSignature := base64.StdEncoding.EncodeToString(hmacHash(h, hmacHash(h, salted, "Server Key"), authMessage))
+	if scramAttrs(string(reply.Payload))["v"] != serverSignature {
+		return errors.New("server signature mismatch")
+	}
+	for !reply.Done {
+		err = run(conn, source, bson.D{
+			{Name: "saslContinue", Value: 1},
+			{Name: "conversationId", Value: id},
+			{Name: "payload", Value: []byte{}},
+		}, &reply)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scramAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if len(kv) > 2 && kv[1] == '=' {
+			attrs[kv[:1]] = kv[2:]
+		}
+	}
+	return attrs
+}
+
+func hmacHash(h func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(h, key)
+	io.WriteString(mac, msg)
+	return mac.Sum(nil)
+}
+
+func hmacSum(key []byte, msg string) []byte {
+	return hmacHash(sha256.New, key, msg)
+}
+
+// pbkdf2 is PBKDF2 from RFC 2898
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	size := prf.Size()
+	var dk []byte
+	for block := uint32(1); len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		dk = append(dk, t[:size]...)
+	}
+	return dk[:keyLen]
+}
+
+var requestID int32
+
+const opMsg = 2013
+
+// opMsgFrom is the wire version from which mongodb takes OP_MSG, 3.6's
+const opMsgFrom = 6
+
+// runCommand sends cmd to db as an OP_MSG and decodes the reply into result,
+// before mgo ever sees the connection.
+func runCommand(conn net.Conn, db string, cmd bson.D, result *saslReply) error {
+	cmd = append(cmd, bson.DocElem{Name: "$db", Value: db})
+	doc, err := bson.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	header := [4]int32{int32(16 + 4 + 1 + len(doc)), atomic.AddInt32(&requestID, 1), 0, opMsg}
+	binary.Write(&msg, binary.LittleEndian, header)
+	binary.Write(&msg, binary.LittleEndian, uint32(0)) // flags
+	msg.WriteByte(0)                                   // body section
+	msg.Write(doc)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return err
+	}
+
+	if err := binary.Read(conn, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header[3] != opMsg || header[0] < 21 || header[0] > 48<<20 {
+		return fmt.Errorf("unexpected reply opcode %d length %d", header[3], header[0])
+	}
+	body := make([]byte, header[0]-16)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return err
+	}
+	if body[4] != 0 {
+		return errors.New("reply doesn't start with a body section")
+	}
+	return saslResult(body[5:], result)
+}
+
+// runQuery sends cmd to db.$cmd as an OP_QUERY, for servers before 3.6,
+// and decodes the reply into result
+func runQuery(conn net.Conn, db string, cmd bson.D, result *saslReply) error {
+	doc, err := bson.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	ns := db + ".$cmd\x00"
+	var msg bytes.Buffer
+	header := [4]int32{int32(16 + 4 + len(ns) + 8 + len(doc)), atomic.AddInt32(&requestID, 1), 0, opQuery}
+	binary.Write(&msg, binary.LittleEndian, header)
+	binary.Write(&msg, binary.LittleEndian, int32(0)) // flags
+	msg.WriteString(ns)
+	binary.Write(&msg, binary.LittleEndian, [2]int32{0, -1}) // skip, limit
+	msg.Write(doc)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return err
+	}
+
+	reply, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+	// flags, cursor id, starting from and number returned come first
+	if opcode(reply) != opReply || len(reply) < 16+20+5 {
+		return fmt.Errorf("unexpected reply opcode %d length %d", opcode(reply), len(reply))
+	}
+	return saslResult(reply[16+20:], result)
+}
+
+// saslResult decodes a reply's document into result, failing if it's not ok
+func saslResult(doc []byte, result *saslReply) error {
+	*result = saslReply{}
+	if err := bson.Unmarshal(doc, result); err != nil {
+		return err
+	}
+	if result.Ok != 1 {
+		return errors.New(result.Errmsg)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package dial
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// scramServer is the server side of a SCRAM conversation on conn, for app
+// with password, answering isMaster with wire. It reports the opcodes the
+// sasl commands came as, and what went wrong.
+func scramServer(conn net.Conn, wire int, mechanism, password string, iterations int) (opcodes []int32, err error) {
+	defer conn.Close()
+	h := sha256.New
+	if mechanism == "SCRAM-SHA-1" {
+		sum := md5.Sum([]byte("app:mongo:" + password))
+		password = hex.EncodeToString(sum[:])
+		h = sha1.New
+	}
+	salt := []byte("saltsaltsalt")
+	var clientFirstBare, serverFirst string
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return opcodes, nil // the client's done
+		}
+		var cmd bson.D
+		switch opcode(msg) {
+		case opQuery:
+			end := 20
+			for msg[end] != 0 {
+				end++
+			}
+			err = bson.Unmarshal(msg[end+1+8:], &cmd)
+		case opMsg:
+			err = bson.Unmarshal(msg[21:], &cmd)
+		default:
+			return opcodes, fmt.Errorf("opcode %d", opcode(msg))
+		}
+		if err != nil {
+			return opcodes, err
+		}
+		args := cmd.Map()
+		var reply bson.D
+		switch cmd[0].Name {
+		case "isMaster":
+			reply = bson.D{{Name: "maxWireVersion", Value: wire}, {Name: "ok", Value: 1}}
+		case "saslStart":
+			opcodes = append(opcodes, opcode(msg))
+			clientFirstBare = strings.TrimPrefix(string(args["payload"].([]byte)), "n,,")
+			serverFirst = fmt.Sprintf("r=%sserver,s=%s,i=%d", scramAttrs(clientFirstBare)["r"], base64.StdEncoding.EncodeToString(salt), iterations)
+			reply = bson.D{{Name: "conversationId", Value: 1}, {Name: "done", Value: false}, {Name: "payload", Value: []byte(serverFirst)}, {Name: "ok", Value: 1}}
+		case "saslContinue":
+			opcodes = append(opcodes, opcode(msg))
+			clientFinal := string(args["payload"].([]byte))
+			if clientFinal == "" {
+				reply = bson.D{{Name: "conversationId", Value: 1}, {Name: "done", Value: true}, {Name: "payload", Value: []byte{}}, {Name: "ok", Value: 1}}
+				break
+			}
+			authMessage := clientFirstBare + "," + serverFirst + "," + clientFinal[:strings.Index(clientFinal, ",p=")]
+			salted := pbkdf2(h, []byte(password), salt, iterations, h().Size())
+			clientKey := hmacHash(h, salted, "Client Key")
+			stored := h()
+			stored.Write(clientKey)
+			proof := hmacHash(h, stored.Sum(nil), authMessage)
+			for i := range proof {
+				proof[i] ^= clientKey[i]
+			}
+			if scramAttrs(clientFinal)["p"] != base64.StdEncoding.EncodeToString(proof) {
+				reply = bson.D{{Name: "ok", Value: 0}, {Name: "errmsg", Value: "Authentication failed."}}
+				break
+			}
+			v := "v=" + base64.StdEncoding.EncodeToString(hmacHash(h, hmacHash(h, salted, "Server Key"), authMessage))
+			reply = bson.D{{Name: "conversationId", Value: 1}, {Name: "done", Value: false}, {Name: "payload", Value: []byte(v)}, {Name: "ok", Value: 1}}
+		default:
+			return opcodes, fmt.Errorf("unexpected %s", cmd[0].Name)
+		}
+		if err := writeReply(conn, msg, reply); err != nil {
+			return opcodes, err
+		}
+	}
+}
+
+// writeReply answers msg with doc, as OP_REPLY to an OP_QUERY
+func writeReply(conn net.Conn, msg []byte, doc bson.D) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	id := binary.LittleEndian.Uint32(msg[4:])
+	var out []byte
+	if opcode(msg) == opMsg {
+		out = opMsgOf(int32(id)+1000, 0, raw)
+	} else {
+		out = make([]byte, 36, 36+len(raw))
+		binary.LittleEndian.PutUint32(out, uint32(36+len(raw)))
+		binary.LittleEndian.PutUint32(out[12:], opReply)
+		binary.LittleEndian.PutUint32(out[32:], 1)
+		out = append(out, raw...)
+	}
+	binary.LittleEndian.PutUint32(out[8:], id)
+	_, err = conn.Write(out)
+	return err
+}
+
+func TestScram(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		wire       int
+		mechanism  string
+		password   string
+		iterations int
+		opcode     int32
+		err        string
+	}{
+		{"3.4 as OP_QUERY", 5, "SCRAM-SHA-1", "secret", 10000, opQuery, ""},
+		{"3.0 as OP_QUERY", 3, "SCRAM-SHA-1", "secret", 10000, opQuery, ""},
+		{"3.6 as OP_MSG", 6, "SCRAM-SHA-1", "secret", 10000, opMsg, ""},
+		{"7.0 sha-256", 21, "SCRAM-SHA-256", "secret", 15000, opMsg, ""},
+		{"wrong password", 5, "SCRAM-SHA-1", "other", 10000, opQuery, "Authentication failed."},
+		{"too few iterations", 6, "SCRAM-SHA-256", "secret", 4095, opMsg, "fewer than the 4096"},
+	} {
+		client, server := net.Pipe()
+		type result struct {
+			opcodes []int32
+			err     error
+		}
+		done := make(chan result)
+		go func() {
+			opcodes, err := scramServer(server, c.wire, c.mechanism, c.password, c.iterations)
+			done <- result{opcodes, err}
+		}()
+		err := scram(client, c.mechanism, "admin", "app", "secret")
+		client.Close()
+		got := <-done
+		if got.err != nil {
+			t.Fatalf("%s: server: %s", c.name, got.err)
+		}
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %s", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+		if len(got.opcodes) == 0 {
+			t.Errorf("%s: no sasl commands received", c.name)
+		}
+		for _, op := range got.opcodes {
+			if op != c.opcode {
+				t.Errorf("%s: sasl sent as opcode %d, want %d", c.name, op, c.opcode)
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package dial
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ianschenck/envflag"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	awsSessionToken = envflag.String("MONGO_AWS_SESSION_TOKEN", "", "session token to go with an access key given as MONGO_URL user and password")
+)
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// awsCredentialsCache holds instance credentials until shortly before they
+// expire, new connections would otherwise each hit the metadata endpoint.
+var awsCredentialsCache struct {
+	sync.Mutex
+	creds awsCredentials
+}
+
+// lookupAWSCredentials follows the order the drivers use: explicit user and
+// password, the environment, the ECS task role, then the EC2 instance role.
+func lookupAWSCredentials(user, password string) (awsCredentials, error) {
+	if user != "" {
+		return awsCredentials{AccessKeyID: user, SecretAccessKey: password, Token: *awsSessionToken}, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	awsCredentialsCache.Lock()
+	defer awsCredentialsCache.Unlock()
+	if c := awsCredentialsCache.creds; c.AccessKeyID != "" && time.Now().Add(5*time.Minute).Before(c.Expiration) {
+		return c, nil
+	}
+	var creds awsCredentials
+	var err error
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		err = getJSON("GET", "http://169.254.170.2"+uri, nil, &creds)
+	} else {
+		creds, err = ec2Credentials()
+	}
+	if err != nil {
+		return creds, fmt.Errorf("no AWS credentials: %s", err)
+	}
+	awsCredentialsCache.creds = creds
+	return creds, nil
+}
+
+// ec2Credentials reads the instance role credentials using IMDSv2
+func ec2Credentials() (awsCredentials, error) {
+	var creds awsCredentials
+	const imds = "http://169.254.169.254"
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, _ := http.NewRequest("PUT", imds+"/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "30")
+	token, err := readAll(client, req)
+	if err != nil {
+		return creds, err
+	}
+	header := http.Header{"X-aws-ec2-metadata-token": {string(token)}}
+	req, _ = http.NewRequest("GET", imds+"/latest/meta-data/iam/security-credentials/", nil)
+	req.Header = header
+	role, err := readAll(client, req)
+	if err != nil {
+		return creds, err
+	}
+	err = getJSON("GET", imds+"/latest/meta-data/iam/security-credentials/"+strings.TrimSpace(string(role)), header, &creds)
+	return creds, err
+}
+
+func getJSON(method, url string, header http.Header, v interface{}) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	body, err := readAll(&http.Client{Timeout: 5 * time.Second}, req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func readAll(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return body, nil
+}
+
+// mongodbAWS runs the MONGODB-AWS conversation on conn: the server hands out
+// a nonce and an STS host, and verifies a signed GetCallerIdentity request
+// for that host on our behalf.
+func mongodbAWS(conn net.Conn, user, password string) error {
+	creds, err := lookupAWSCredentials(user, password)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	first, err := bson.Marshal(bson.D{{Name: "r", Value: nonce}, {Name: "p", Value: int32('n')}})
+	if err != nil {
+		return err
+	}
+	var reply saslReply
+	err = runCommand(conn, "$external", bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: "MONGODB-AWS"},
+		{Name: "payload", Value: first},
+	}, &reply)
+	if err != nil {
+		return err
+	}
+	var server struct {
+		Nonce []byte `bson:"s"`
+		Host  string `bson:"h"`
+	}
+	if err := bson.Unmarshal(reply.Payload, &server); err != nil {
+		return err
+	}
+	if len(server.Nonce) != 64 || !bytes.Equal(server.Nonce[:32], nonce) {
+		return errors.New("server nonce doesn't extend ours")
+	}
+	if server.Host == "" || strings.Contains(server.Host, "..") || len(server.Host) > 255 {
+		return fmt.Errorf("invalid STS host %q", server.Host)
+	}
+
+	now := time.Now().UTC()
+	auth := signSTS(creds, server.Host, base64.StdEncoding.EncodeToString(server.Nonce), now)
+	final := bson.D{
+		{Name: "a", Value: auth},
+		{Name: "d", Value: now.Format("20060102T150405Z")},
+	}
+	if creds.Token != "" {
+		final = append(final, bson.DocElem{Name: "t", Value: creds.Token})
+	}
+	payload, err := bson.Marshal(final)
+	if err != nil {
+		return err
+	}
+	err = runCommand(conn, "$external", bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: reply.ConversationID},
+		{Name: "payload", Value: payload},
+	}, &reply)
+	if err != nil {
+		return err
+	}
+	if !reply.Done {
+		return errors.New("conversation didn't finish")
+	}
+	return nil
+}
+
+const stsBody = "Action=GetCallerIdentity&Version=2011-06-15"
+
+// signSTS returns the SigV4 Authorization header of the GetCallerIdentity
+// request the server will replay against host.
+func signSTS(creds awsCredentials, host, serverNonce string, now time.Time) string {
+	region := "us-east-1"
+	if labels := strings.Split(host, "."); host != "sts.amazonaws.com" && len(labels) > 1 {
+		region = labels[1]
+	}
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	headers := map[string]string{
+		"content-length":         fmt.Sprint(len(stsBody)),
+		"content-type":           "application/x-www-form-urlencoded",
+		"host":                   host,
+		"x-amz-date":             amzDate,
+		"x-mongodb-gs2-cb-flag":  "n",
+		"x-mongodb-server-nonce": serverNonce,
+	}
+	if creds.Token != "" {
+		headers["x-amz-security-token"] = creds.Token
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signed := strings.Join(names, ";")
+	bodyHash := sha256.Sum256([]byte(stsBody))
+	request := "POST\n/\n\n" + canonical.String() + "\n" + signed + "\n" + hex.EncodeToString(bodyHash[:])
+
+	scope := day + "/" + region + "/sts/aws4_request"
+	requestHash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{day, region, "sts", "aws4_request"} {
+		key = hmacSum(key, part)
+	}
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, hex.EncodeToString(hmacSum(key, toSign)))
+}
@@ -0,0 +1,18 @@
+package dial
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ClusterTime returns the $clusterTime the server sess talks to gossips,
+// 0 for servers older than 3.6 or not in a replica set
+func ClusterTime(sess *mgo.Session) (bson.MongoTimestamp, error) {
+	var res struct {
+		ClusterTime struct {
+			ClusterTime bson.MongoTimestamp `bson:"clusterTime"`
+		} `bson:"$clusterTime"`
+	}
+	err := sess.Run("isMaster", &res)
+	return res.ClusterTime.ClusterTime, err
+}
@@ -0,0 +1,158 @@
+// Package dial connects to mongodb with the options mgo's connection URL
+// can't express.
+package dial
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ianschenck/envflag"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	tlsEnabled  = envflag.Bool("MONGO_TLS", false, "connect using TLS, also enabled by ssl=true or tls=true in MONGO_URL")
+	tlsCA       = envflag.String("MONGO_TLS_CA", "", "PEM bundle of CAs to verify the server against instead of the system pool")
+	tlsCert     = envflag.String("MONGO_TLS_CERT", "", "PEM client certificate")
+	tlsKey      = envflag.String("MONGO_TLS_KEY", "", "PEM client private key, defaults to MONGO_TLS_CERT")
+	tlsInsecure = envflag.Bool("MONGO_TLS_INSECURE", false, "skip verifying the server certificate")
+)
+
+// Dial is mgo.Dial with the options from the environment applied
+func Dial(rawurl string) (*mgo.Session, error) {
+	return DialWithTimeout(rawurl, 10*time.Second)
+}
+
+// DialWithTimeout is mgo.DialWithTimeout with the options from the
+// environment applied
+func DialWithTimeout(rawurl string, timeout time.Duration) (*mgo.Session, error) {
+	info, err := ParseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = timeout
+	sess, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	sess.SetSocketTimeout(*socketTimeout)
+	if err := applyReadPreference(sess); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// userinfo matches the password of a url
+var userinfo = regexp.MustCompile(`(://[^:@/]*):[^@/]*@`)
+
+// Redact returns s with the password of any url in it hidden, for errors
+// and logs
+func Redact(s string) string {
+	return userinfo.ReplaceAllString(s, "$1:[redacted]@")
+}
+
+// ParseURL is mgo.ParseURL, additionally understanding the ssl and tls URL
+// options, with a DialServer set up for proxies, TLS and auth as configured,
+// and for OP_MSG on servers from 5.1 on.
+func ParseURL(rawurl string) (*mgo.DialInfo, error) {
+	rawurl, err := readURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	rawurl, urlTLS, err := stripTLS(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	info, err := mgo.ParseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var config *tls.Config
+	if urlTLS || *tlsEnabled {
+		config, err = tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	netDial, err := proxyDialer()
+	if err != nil {
+		return nil, err
+	}
+	dialServer := func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := netDial(addr.String(), info.Timeout)
+		if err != nil || config == nil {
+			return conn, err
+		}
+		return tlsClient(conn, addr.String(), config, info.Timeout)
+	}
+	dialServer, err = setupAuth(info, config, dialServer)
+	if err != nil {
+		return nil, err
+	}
+	info.DialServer = translated(info, dialServer)
+	return info, nil
+}
+
+// stripTLS removes the ssl and tls options mgo.ParseURL rejects, reporting
+// whether either asked for TLS. url.Parse can't be used, it chokes on
+// multiple hosts.
+func stripTLS(rawurl string) (string, bool, error) {
+	i := strings.Index(rawurl, "?")
+	if i < 0 {
+		return rawurl, false, nil
+	}
+	q, err := url.ParseQuery(rawurl[i+1:])
+	if err != nil {
+		return "", false, err
+	}
+	enabled := false
+	for _, k := range []string{"ssl", "tls"} {
+		if v := q.Get(k); v != "" {
+			enabled = enabled || v == "true"
+			q.Del(k)
+		}
+	}
+	rawurl = rawurl[:i]
+	if len(q) > 0 {
+		rawurl += "?" + q.Encode()
+	}
+	return rawurl, enabled, nil
+}
+
+func tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: *tlsInsecure}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *tlsCA)
+		}
+	}
+	if *tlsCert != "" {
+		key := *tlsKey
+		if key == "" {
+			key = *tlsCert
+		}
+		cert, err := tls.LoadX509KeyPair(*tlsCert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if *tlsKey != "" {
+		return nil, errors.New("MONGO_TLS_KEY set without MONGO_TLS_CERT")
+	}
+	return config, nil
+}
@@ -0,0 +1,444 @@
+package dial
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// opMsgOnly is the wire version from which mongodb only takes OP_MSG, 5.1's.
+// OP_QUERY, all mgo speaks, is only taken for isMaster and hello.
+const opMsgOnly = 13
+
+// opcodes
+const (
+	opReply       = 1
+	opQuery       = 2004
+	opKillCursors = 2007
+)
+
+// OP_MSG flag bits
+const (
+	msgChecksumPresent = 1 << 0
+	msgMoreToCome      = 1 << 1
+)
+
+// OP_QUERY flag bits
+const queryFlagSlaveOk = 1 << 2
+
+// msgCommands are the commands msgConn sends as OP_MSG, those mgo sends
+// itself and those the commands here run. Any other is answered with an
+// error without reaching the server.
+var msgCommands = map[string]bool{
+	// handshake, auth and status
+	"isMaster": true, "ismaster": true, "hello": true, "ping": true, "buildInfo": true, "buildinfo": true,
+	"saslStart": true, "saslContinue": true, "logout": true,
+	"connectionStatus": true, "replSetGetStatus": true, "listShards": true, "collStats": true,
+	// reads and their cursors
+	"find": true, "getMore": true, "aggregate": true, "count": true, "distinct": true,
+	"listDatabases": true, "listCollections": true, "listIndexes": true,
+	// writes
+	"insert": true, "update": true, "delete": true, "findAndModify": true, "applyOps": true,
+	// what apply and clone replay of the oplog's commands
+	"create": true, "drop": true, "dropDatabase": true, "renameCollection": true, "collMod": true,
+	"createIndexes": true, "dropIndexes": true, "deleteIndexes": true,
+}
+
+// translated wraps dialServer to have connections to servers that only take
+// OP_MSG translate what mgo sends and reads, see msgConn. isMaster is asked
+// of each server first, still as OP_QUERY, for its wire version.
+func translated(info *mgo.DialInfo, dialServer func(*mgo.ServerAddr) (net.Conn, error)) func(*mgo.ServerAddr) (net.Conn, error) {
+	return func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := dialServer(addr)
+		if err != nil {
+			return nil, err
+		}
+		wire, err := wireVersion(conn, info.Timeout)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("isMaster of %s: %s", addr, err)
+		}
+		if wire < opMsgOnly {
+			return conn, nil
+		}
+		return newMsgConn(conn), nil
+	}
+}
+
+// wireVersion asks isMaster of conn as an OP_QUERY and returns its
+// maxWireVersion
+func wireVersion(conn net.Conn, timeout time.Duration) (int, error) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	query, err := bson.Marshal(bson.D{{Name: "isMaster", Value: 1}})
+	if err != nil {
+		return 0, err
+	}
+	var msg bytes.Buffer
+	header := [4]int32{int32(16 + 4 + len("admin.$cmd\x00") + 8 + len(query)), atomic.AddInt32(&requestID, 1), 0, opQuery}
+	binary.Write(&msg, binary.LittleEndian, header)
+	binary.Write(&msg, binary.LittleEndian, int32(queryFlagSlaveOk))
+	msg.WriteString("admin.$cmd\x00")
+	binary.Write(&msg, binary.LittleEndian, [2]int32{0, -1}) // skip, limit
+	msg.Write(query)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return 0, err
+	}
+	reply, err := readMessage(conn)
+	if err != nil {
+		return 0, err
+	}
+	// flags, cursor id, starting from and number returned come first
+	if opcode(reply) != opReply || len(reply) < 16+20+5 {
+		return 0, fmt.Errorf("unexpected reply opcode %d length %d", opcode(reply), len(reply))
+	}
+	var res struct {
+		MaxWireVersion int     `bson:"maxWireVersion"`
+		Ok             float64 `bson:"ok"`
+		Errmsg         string  `bson:"errmsg"`
+	}
+	if err := bson.Unmarshal(reply[16+20:], &res); err != nil {
+		return 0, err
+	}
+	if res.Ok != 1 {
+		return 0, errors.New(res.Errmsg)
+	}
+	return res.MaxWireVersion, nil
+}
+
+// readMessage reads a whole message, header included
+func readMessage(r io.Reader) ([]byte, error) {
+	var size int32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 16 || size > 48<<20 {
+		return nil, fmt.Errorf("message of %d bytes", size)
+	}
+	msg := make([]byte, size)
+	binary.LittleEndian.PutUint32(msg, uint32(size))
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func opcode(msg []byte) int32 {
+	return int32(binary.LittleEndian.Uint32(msg[12:]))
+}
+
+// msgConn has mgo speak OP_MSG on a connection to 5.1 or later. With their
+// wire version, mgo sends every query and write as an OP_QUERY command to
+// db.$cmd, find and getMore included, and those go out as the OP_MSG of the
+// command, their replies coming back as OP_REPLY. Iter.Close's
+// OP_KILL_CURSORS goes out as a killCursors command nothing's replied to, of
+// the namespace the cursor was opened on. Anything else mgo only sends to
+// servers from before 3.2 and fails.
+//
+// Only msgCommands are sent. Others go out as a ping, replied to with an
+// error naming the command, as does getnonce with a nonce of our own: mgo
+// asks for one on every new connection and drops it without, but getnonce
+// is gone from 6.0 on and only MONGODB-CR, gone from 4.0 on, used it.
+type msgConn struct {
+	net.Conn
+	pending []byte // written, short of a whole message
+	reply   []byte // translated, not read yet
+
+	mu       sync.Mutex
+	cursors  map[int64]string // cursor ids open to their namespace
+	getMores map[int32]int64  // request ids of getMores to the cursor id
+	local    map[int32][]byte // request ids pinged instead to the reply given
+}
+
+func newMsgConn(conn net.Conn) *msgConn {
+	return &msgConn{Conn: conn, cursors: make(map[int64]string), getMores: make(map[int32]int64), local: make(map[int32][]byte)}
+}
+
+func (c *msgConn) Write(b []byte) (int, error) {
+	c.pending = append(c.pending, b...)
+	var out []byte
+	for len(c.pending) >= 16 {
+		size := int(binary.LittleEndian.Uint32(c.pending))
+		if size < 16 || size > 48<<20 {
+			return 0, fmt.Errorf("writing a message of %d bytes", size)
+		}
+		if len(c.pending) < size {
+			break
+		}
+		msg, err := c.translate(c.pending[:size])
+		if err != nil {
+			return 0, err
+		}
+		out = append(out, msg...)
+		c.pending = c.pending[size:]
+	}
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// translate returns the OP_MSG of an OP_QUERY command or OP_KILL_CURSORS
+func (c *msgConn) translate(msg []byte) ([]byte, error) {
+	id := int32(binary.LittleEndian.Uint32(msg[4:]))
+	switch op := opcode(msg); op {
+	case opQuery:
+		flags := int32(binary.LittleEndian.Uint32(msg[16:]))
+		end := bytes.IndexByte(msg[20:], 0)
+		if end < 0 {
+			return nil, errors.New("OP_QUERY without a collection")
+		}
+		collection := string(msg[20 : 20+end])
+		if !strings.HasSuffix(collection, ".$cmd") {
+			return nil, fmt.Errorf("OP_QUERY of %s, only commands can be sent as OP_MSG", collection)
+		}
+		db := strings.TrimSuffix(collection, ".$cmd")
+		query := msg[20+end+1+8:] // past skip and limit
+		if len(query) < 5 || int(binary.LittleEndian.Uint32(query)) > len(query) {
+			return nil, errors.New("OP_QUERY short of its query")
+		}
+		query = query[:binary.LittleEndian.Uint32(query)] // a selector after it is ignored
+		body, err := commandBody(query, db, flags&queryFlagSlaveOk != 0)
+		if err != nil {
+			return nil, err
+		}
+		if body, err = c.sent(id, db, body); err != nil {
+			return nil, err
+		}
+		return opMsgOf(id, 0, body), nil
+	case opKillCursors:
+		n := int(binary.LittleEndian.Uint32(msg[20:]))
+		if len(msg) < 24+8*n {
+			return nil, errors.New("OP_KILL_CURSORS short of its cursors")
+		}
+		byNS := make(map[string][]int64)
+		var order []string
+		c.mu.Lock()
+		for i := 0; i < n; i++ {
+			cursor := int64(binary.LittleEndian.Uint64(msg[24+8*i:]))
+			ns, ok := c.cursors[cursor]
+			if !ok {
+				continue // not opened here, left to time out
+			}
+			delete(c.cursors, cursor)
+			if byNS[ns] == nil {
+				order = append(order, ns)
+			}
+			byNS[ns] = append(byNS[ns], cursor)
+		}
+		c.mu.Unlock()
+		var out []byte
+		for _, ns := range order {
+			i := strings.Index(ns, ".")
+			body, err := bson.Marshal(bson.D{
+				{Name: "killCursors", Value: ns[i+1:]},
+				{Name: "cursors", Value: byNS[ns]},
+				{Name: "$db", Value: ns[:i]},
+			})
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, opMsgOf(atomic.AddInt32(&requestID, 1), msgMoreToCome, body)...)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("opcode %d can't be sent as OP_MSG", op)
+	}
+}
+
+// commandBody returns the OP_MSG body of the command an OP_QUERY sends,
+// unwrapped from $query with its $readPreference kept. slaveOk without one
+// is read as primaryPreferred, which is what it asks of a secondary.
+func commandBody(query []byte, db string, slaveOk bool) ([]byte, error) {
+	var cmd bson.RawD
+	if err := bson.Unmarshal(query, &cmd); err != nil {
+		return nil, err
+	}
+	var readPref *bson.Raw
+	if len(cmd) > 0 && cmd[0].Name == "$query" {
+		for _, e := range cmd {
+			if e.Name == "$readPreference" {
+				v := e.Value
+				readPref = &v
+			}
+		}
+		var inner bson.RawD
+		if err := cmd[0].Value.Unmarshal(&inner); err != nil {
+			return nil, err
+		}
+		cmd = inner
+	}
+	body := make(bson.D, 0, len(cmd)+2)
+	for _, e := range cmd {
+		body = append(body, bson.DocElem{Name: e.Name, Value: e.Value})
+	}
+	body = append(body, bson.DocElem{Name: "$db", Value: db})
+	switch {
+	case readPref != nil:
+		body = append(body, bson.DocElem{Name: "$readPreference", Value: *readPref})
+	case slaveOk:
+		body = append(body, bson.DocElem{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primaryPreferred"}}})
+	}
+	return bson.Marshal(body)
+}
+
+// sent notes the cursor of a getMore, to forget it once the reply says it's
+// exhausted, and returns the body to send, a ping for what's answered here
+func (c *msgConn) sent(id int32, db string, body []byte) ([]byte, error) {
+	var cmd bson.RawD
+	if err := bson.Unmarshal(body, &cmd); err != nil {
+		return nil, err
+	}
+	if len(cmd) == 0 {
+		return nil, errors.New("empty command")
+	}
+	var reply bson.D
+	switch name := cmd[0].Name; {
+	case name == "getnonce":
+		nonce := make([]byte, 8)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		reply = bson.D{{Name: "nonce", Value: hex.EncodeToString(nonce)}, {Name: "ok", Value: 1}}
+	case !msgCommands[name]:
+		reply = bson.D{{Name: "ok", Value: 0}, {Name: "errmsg", Value: fmt.Sprintf("%s isn't one of the commands sent as OP_MSG to mongodb 5.1 and later", name)}}
+	case name == "getMore":
+		var cursor int64
+		if err := cmd[0].Value.Unmarshal(&cursor); err != nil {
+			return nil, fmt.Errorf("getMore of %s", err)
+		}
+		c.mu.Lock()
+		c.getMores[id] = cursor
+		c.mu.Unlock()
+		return body, nil
+	default:
+		return body, nil
+	}
+	raw, err := bson.Marshal(reply)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.local[id] = raw
+	c.mu.Unlock()
+	return bson.Marshal(bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: db}})
+}
+
+// opMsgOf returns an OP_MSG of a body section
+func opMsgOf(id int32, flags uint32, body []byte) []byte {
+	msg := make([]byte, 16+4+1, 16+4+1+len(body))
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)+len(body)))
+	binary.LittleEndian.PutUint32(msg[4:], uint32(id))
+	binary.LittleEndian.PutUint32(msg[12:], opMsg)
+	binary.LittleEndian.PutUint32(msg[16:], flags)
+	msg[20] = 0 // body section
+	return append(msg, body...)
+}
+
+func (c *msgConn) Read(b []byte) (int, error) {
+	for len(c.reply) == 0 {
+		msg, err := readMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if c.reply, err = c.untranslate(msg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.reply)
+	c.reply = c.reply[n:]
+	return n, nil
+}
+
+// untranslate returns the OP_REPLY of an OP_MSG reply, its body the one
+// document returned
+func (c *msgConn) untranslate(msg []byte) ([]byte, error) {
+	if op := opcode(msg); op != opMsg {
+		return nil, fmt.Errorf("unexpected reply opcode %d", op)
+	}
+	responseTo := int32(binary.LittleEndian.Uint32(msg[8:]))
+	flags := binary.LittleEndian.Uint32(msg[16:])
+	sections := msg[20:]
+	if flags&msgChecksumPresent != 0 && len(sections) >= 4 {
+		sections = sections[:len(sections)-4]
+	}
+	var body []byte
+	for len(sections) > 0 {
+		kind := sections[0]
+		if len(sections) < 5 {
+			return nil, errors.New("OP_MSG reply section cut short")
+		}
+		size := int(binary.LittleEndian.Uint32(sections[1:]))
+		if size < 5 || 1+size > len(sections) {
+			return nil, fmt.Errorf("OP_MSG reply section of %d bytes", size)
+		}
+		if kind == 0 {
+			body = sections[1 : 1+size]
+		}
+		sections = sections[1+size:]
+	}
+	if body == nil {
+		return nil, errors.New("OP_MSG reply without a body")
+	}
+	body, err := c.replied(responseTo, body)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 16+20, 16+20+len(body))
+	binary.LittleEndian.PutUint32(reply, uint32(len(reply)+len(body)))
+	copy(reply[4:], msg[4:8])
+	binary.LittleEndian.PutUint32(reply[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(reply[12:], opReply)
+	// no flags, cursor id or starting from, one document
+	binary.LittleEndian.PutUint32(reply[32:], 1)
+	return append(reply, body...), nil
+}
+
+// replied keeps track of the cursors a reply opens or exhausts, and returns
+// the body mgo's given, the one answered here for a ping sent instead
+func (c *msgConn) replied(responseTo int32, body []byte) ([]byte, error) {
+	var res struct {
+		Cursor struct {
+			ID int64  `bson:"id"`
+			NS string `bson:"ns"`
+		} `bson:"cursor"`
+	}
+	bson.Unmarshal(body, &res)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reply, ok := c.local[responseTo]; ok {
+		delete(c.local, responseTo)
+		return reply, nil
+	}
+	if cursor, ok := c.getMores[responseTo]; ok {
+		delete(c.getMores, responseTo)
+		if res.Cursor.ID == 0 {
+			delete(c.cursors, cursor)
+		}
+		return body, nil
+	}
+	if res.Cursor.ID != 0 && res.Cursor.NS != "" {
+		c.cursors[res.Cursor.ID] = res.Cursor.NS
+	}
+	return body, nil
+}
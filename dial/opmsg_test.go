@@ -0,0 +1,401 @@
+package dial
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeServer answers isMaster as OP_QUERY, and from wire version 13 on
+// everything else as OP_MSG only, as mongodb does. It opens a cursor of two
+// batches on every find.
+type fakeServer struct {
+	t    *testing.T
+	ln   net.Listener
+	wire int
+
+	mu       sync.Mutex
+	commands []bson.D // the OP_MSG bodies received, isMaster's and ping's left out
+	flags    []uint32
+	legacy   []int32 // the opcodes of what else was received
+	cursor   int64
+}
+
+func newFakeServer(t *testing.T, wire int) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{t: t, ln: ln, wire: wire, cursor: 100}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) url() string {
+	return "mongodb://" + s.ln.Addr().String() + "/?connect=direct"
+}
+
+func (s *fakeServer) isMaster() bson.D {
+	return bson.D{{Name: "ismaster", Value: true}, {Name: "maxWireVersion", Value: s.wire}, {Name: "minWireVersion", Value: 0}, {Name: "ok", Value: 1}}
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		id := int32(binary.LittleEndian.Uint32(msg[4:]))
+		switch opcode(msg) {
+		case opQuery:
+			var query bson.M
+			end := 20
+			for msg[end] != 0 {
+				end++
+			}
+			if err := bson.Unmarshal(msg[end+1+8:], &query); err != nil {
+				s.t.Error(err)
+				return
+			}
+			reply := bson.D{{Name: "ok", Value: 0}, {Name: "errmsg", Value: "Unsupported OP_QUERY command"}, {Name: "code", Value: 352}}
+			if query["isMaster"] != nil || query["ismaster"] != nil || s.wire < opMsgOnly {
+				reply = s.isMaster()
+			}
+			if query["isMaster"] == nil && query["ismaster"] == nil {
+				s.mu.Lock()
+				s.legacy = append(s.legacy, opQuery)
+				s.mu.Unlock()
+			}
+			doc, _ := bson.Marshal(reply)
+			out := make([]byte, 36, 36+len(doc))
+			binary.LittleEndian.PutUint32(out, uint32(36+len(doc)))
+			binary.LittleEndian.PutUint32(out[8:], uint32(id))
+			binary.LittleEndian.PutUint32(out[12:], opReply)
+			binary.LittleEndian.PutUint32(out[32:], 1)
+			conn.Write(append(out, doc...))
+		case opMsg:
+			flags := binary.LittleEndian.Uint32(msg[16:])
+			var body bson.D
+			if msg[20] != 0 {
+				s.t.Errorf("section of kind %d", msg[20])
+				return
+			}
+			if err := bson.Unmarshal(msg[21:], &body); err != nil {
+				s.t.Error(err)
+				return
+			}
+			reply := s.command(body, flags)
+			if flags&msgMoreToCome != 0 {
+				continue
+			}
+			doc, _ := bson.Marshal(reply)
+			out := opMsgOf(id+1000, 0, doc)
+			binary.LittleEndian.PutUint32(out[8:], uint32(id))
+			conn.Write(out)
+		default:
+			s.mu.Lock()
+			s.legacy = append(s.legacy, opcode(msg))
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *fakeServer) command(body bson.D, flags uint32) bson.D {
+	name := body[0].Name
+	if name == "ismaster" || name == "isMaster" {
+		return s.isMaster()
+	}
+	if name == "ping" {
+		return bson.D{{Name: "ok", Value: 1}}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, body)
+	s.flags = append(s.flags, flags)
+	db := body.Map()["$db"]
+	switch name {
+	case "find":
+		s.cursor++
+		return bson.D{{Name: "cursor", Value: bson.D{
+			{Name: "firstBatch", Value: []bson.D{{{Name: "_id", Value: 1}}}},
+			{Name: "id", Value: s.cursor},
+			{Name: "ns", Value: db.(string) + "." + body[0].Value.(string)},
+		}}, {Name: "ok", Value: 1}}
+	case "getMore":
+		return bson.D{{Name: "cursor", Value: bson.D{
+			{Name: "nextBatch", Value: []bson.D{{{Name: "_id", Value: 2}}}},
+			{Name: "id", Value: int64(0)},
+			{Name: "ns", Value: db.(string) + "." + body.Map()["collection"].(string)},
+		}}, {Name: "ok", Value: 1}}
+	case "insert":
+		return bson.D{{Name: "n", Value: 1}, {Name: "ok", Value: 1}}
+	}
+	// getnonce too, gone from 6.0 on, and what msgConn doesn't send
+	return bson.D{{Name: "ok", Value: 0}, {Name: "errmsg", Value: "no such command: " + name}, {Name: "code", Value: 59}}
+}
+
+// received returns the commands received so far, waiting for n of them
+func (s *fakeServer) received(n int) ([]bson.D, []uint32) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		if len(s.commands) >= n {
+			commands, flags := append([]bson.D(nil), s.commands...), append([]uint32(nil), s.flags...)
+			s.mu.Unlock()
+			return commands, flags
+		}
+		s.mu.Unlock()
+	}
+	s.t.Fatalf("%d commands received, want %d", len(s.commands), n)
+	return nil, nil
+}
+
+func TestOpMsg(t *testing.T) {
+	s := newFakeServer(t, 21) // 7.0's
+	sess, err := DialWithTimeout(s.url(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a cursor read to its end
+	var ids []int
+	var doc struct {
+		ID int `bson:"_id"`
+	}
+	iter := sess.DB("app").C("orders").Find(bson.M{"status": "paid"}).Batch(2).Iter()
+	for iter.Next(&doc) {
+		ids = append(ids, doc.ID)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf("read %v, want [1 2]", ids)
+	}
+	// and one closed early, killed
+	iter = sess.DB("app").C("users").Find(nil).Batch(2).Iter()
+	if !iter.Next(&doc) {
+		t.Fatal(iter.Err())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.DB("app").C("orders").Insert(bson.M{"_id": 3}); err != nil {
+		t.Fatal(err)
+	}
+	// refused without being sent
+	err = sess.DB("app").Run(bson.D{{Name: "nonsense", Value: 1}}, nil)
+	if qerr, ok := err.(*mgo.QueryError); !ok || !strings.HasPrefix(qerr.Message, "nonsense isn't one of the commands") {
+		t.Errorf("unknown command failed with %#v", err)
+	}
+	if err := sess.DB("app").C("orders").Insert(bson.M{"_id": 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	commands, flags := s.received(6)
+	want := []struct {
+		name  string
+		value interface{}
+		more  bool
+		has   map[string]interface{}
+	}{
+		{"find", "orders", false, map[string]interface{}{"$db": "app", "filter": bson.M{"status": "paid"}, "batchSize": 2}},
+		{"getMore", int64(101), false, map[string]interface{}{"$db": "app", "collection": "orders"}},
+		{"find", "users", false, map[string]interface{}{"$db": "app"}},
+		{"killCursors", "users", true, map[string]interface{}{"$db": "app", "cursors": []interface{}{int64(102)}}},
+		{"insert", "orders", false, map[string]interface{}{"$db": "app"}},
+		{"insert", "orders", false, map[string]interface{}{"$db": "app"}},
+	}
+	for i, w := range want {
+		c := commands[i]
+		if c[0].Name != w.name || !reflect.DeepEqual(c[0].Value, w.value) || flags[i]&msgMoreToCome != 0 != w.more {
+			t.Errorf("command %d is %v, flags %b, want %s %v", i, c, flags[i], w.name, w.value)
+			continue
+		}
+		m := c.Map()
+		for k, v := range w.has {
+			got := m[k]
+			if d, ok := got.(bson.D); ok {
+				got = d.Map()
+			}
+			if !reflect.DeepEqual(got, v) {
+				t.Errorf("%s %s is %#v, want %#v", w.name, k, got, v)
+			}
+		}
+		if _, ok := m["$readPreference"]; ok {
+			t.Errorf("%s has a read preference on the primary", w.name)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.commands) > len(want) {
+		t.Errorf("%d commands received, want %d: %v", len(s.commands), len(want), s.commands[len(want):])
+	}
+	if len(s.legacy) > 0 {
+		t.Errorf("legacy opcodes %v received", s.legacy)
+	}
+}
+
+// servers before 5.1 get what mgo sends as is
+func TestOpMsgOld(t *testing.T) {
+	s := newFakeServer(t, 12)
+	dial := translated(&mgo.DialInfo{Timeout: time.Second}, func(*mgo.ServerAddr) (net.Conn, error) {
+		return net.Dial("tcp", s.ln.Addr().String())
+	})
+	conn, err := dial(nil)
+	if err == nil {
+		defer conn.Close()
+	}
+	if _, ok := conn.(*msgConn); err != nil || ok {
+		t.Fatalf("dialed %T, %v", conn, err)
+	}
+}
+
+func TestCommandBody(t *testing.T) {
+	d := func(doc bson.D) []byte {
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	secondary := bson.D{{Name: "mode", Value: "secondary"}}
+	for _, c := range []struct {
+		query   bson.D
+		slaveOk bool
+		body    bson.D
+	}{
+		{bson.D{{Name: "ping", Value: 1}}, false,
+			bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "app"}}},
+		{bson.D{{Name: "count", Value: "orders"}, {Name: "query", Value: bson.D{{Name: "a", Value: 1}}}}, true,
+			bson.D{{Name: "count", Value: "orders"}, {Name: "query", Value: bson.D{{Name: "a", Value: 1}}}, {Name: "$db", Value: "app"}, {Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primaryPreferred"}}}}},
+		// as mgo wraps it for a mongos
+		{bson.D{{Name: "$query", Value: bson.D{{Name: "find", Value: "orders"}}}, {Name: "$readPreference", Value: secondary}}, true,
+			bson.D{{Name: "find", Value: "orders"}, {Name: "$db", Value: "app"}, {Name: "$readPreference", Value: secondary}}},
+		{bson.D{{Name: "$query", Value: bson.D{{Name: "ping", Value: 1}}}}, false,
+			bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "app"}}},
+	} {
+		got, err := commandBody(d(c.query), "app", c.slaveOk)
+		if err != nil {
+			t.Errorf("%v: %s", c.query, err)
+			continue
+		}
+		var body bson.D
+		if err := bson.Unmarshal(got, &body); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(body, c.body) {
+			t.Errorf("%v is %v, want %v", c.query, body, c.body)
+		}
+	}
+}
+
+// query is the OP_QUERY mgo sends of a command to app
+func query(id int32, cmd bson.D) []byte {
+	doc, _ := bson.Marshal(cmd)
+	msg := make([]byte, 16, 64)
+	binary.LittleEndian.PutUint32(msg[4:], uint32(id))
+	binary.LittleEndian.PutUint32(msg[12:], opQuery)
+	msg = append(msg, 0, 0, 0, 0)
+	msg = append(msg, "app.$cmd\x00"...)
+	msg = append(msg, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff)
+	msg = append(msg, doc...)
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+	return msg
+}
+
+// what mgo writes may come in pieces, or several messages at once
+func TestMsgConnWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newMsgConn(client)
+	c.cursors[7] = "app.orders"
+	kill := make([]byte, 32)
+	binary.LittleEndian.PutUint32(kill, 32)
+	binary.LittleEndian.PutUint32(kill[12:], opKillCursors)
+	binary.LittleEndian.PutUint32(kill[20:], 1)
+	binary.LittleEndian.PutUint64(kill[24:], 7)
+
+	all := append(query(1, bson.D{{Name: "ping", Value: 1}}), query(2, bson.D{{Name: "getMore", Value: int64(7)}, {Name: "collection", Value: "orders"}})...)
+	all = append(all, kill...)
+	go func() {
+		for _, piece := range [][]byte{all[:3], all[3:40], all[40:]} {
+			if _, err := c.Write(piece); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	var got []string
+	for len(got) < 3 {
+		msg, err := readMessage(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body bson.D
+		if opcode(msg) != opMsg || bson.Unmarshal(msg[21:], &body) != nil {
+			t.Fatalf("wrote %x", msg)
+		}
+		got = append(got, body[0].Name)
+	}
+	if !reflect.DeepEqual(got, []string{"ping", "getMore", "killCursors"}) {
+		t.Errorf("wrote %v", got)
+	}
+	if _, err := c.translate(query(3, nil)[:20]); err == nil {
+		t.Error("a short OP_QUERY translated")
+	}
+}
+
+// a getnonce goes out as a ping, and its reply comes back with a nonce
+func TestMsgConnNonce(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newMsgConn(client)
+	go func() {
+		if _, err := c.Write(query(5, bson.D{{Name: "getnonce", Value: 1}})); err != nil {
+			t.Error(err)
+		}
+	}()
+	msg, err := readMessage(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bson.D
+	if opcode(msg) != opMsg || bson.Unmarshal(msg[21:], &body) != nil || body[0].Name != "ping" {
+		t.Fatalf("wrote %x", msg)
+	}
+	doc, _ := bson.Marshal(bson.D{{Name: "ok", Value: 1}})
+	reply := opMsgOf(9, 0, doc)
+	binary.LittleEndian.PutUint32(reply[8:], 5)
+	go server.Write(reply)
+
+	if msg, err = readMessage(c); err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Nonce string `bson:"nonce"`
+		OK    int    `bson:"ok"`
+	}
+	if opcode(msg) != opReply || int32(binary.LittleEndian.Uint32(msg[8:])) != 5 || bson.Unmarshal(msg[36:], &res) != nil || len(res.Nonce) != 16 || res.OK != 1 {
+		t.Errorf("read %x", msg)
+	}
+}
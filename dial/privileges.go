@@ -0,0 +1,204 @@
+package dial
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ianschenck/envflag"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	checkPrivileges = envflag.Bool("MONGO_CHECK_PRIVILEGES", false, "verify on startup the user has the privileges needed, warning about writes it doesn't need")
+)
+
+// Privilege is a set of actions on a collection, or on the cluster, as in
+// mongo's user privileges
+type Privilege struct {
+	DB         string
+	Collection string
+	Cluster    bool // the cluster rather than DB.Collection
+	Actions    []string
+}
+
+type resource struct {
+	DB          *string `bson:"db"`
+	Collection  *string `bson:"collection"`
+	Cluster     bool    `bson:"cluster"`
+	AnyResource bool    `bson:"anyResource"`
+}
+
+type grantedPrivilege struct {
+	Resource resource `bson:"resource"`
+	Actions  []string `bson:"actions"`
+}
+
+type connectionStatus struct {
+	AuthInfo struct {
+		Users []struct {
+			User string `bson:"user"`
+			DB   string `bson:"db"`
+		} `bson:"authenticatedUsers"`
+		Privileges []grantedPrivilege `bson:"authenticatedUserPrivileges"`
+	} `bson:"authInfo"`
+}
+
+// covers reports whether the granted resource includes p's. Like mongo,
+// an empty db means any database but local and config, an empty
+// collection any non system collection.
+func (r resource) covers(p Privilege) bool {
+	if r.AnyResource {
+		return true
+	}
+	if p.Cluster {
+		return r.Cluster
+	}
+	db, collection := p.DB, p.Collection
+	if r.DB == nil || r.Collection == nil {
+		return false
+	}
+	if *r.DB == "" && (db == "local" || db == "config") {
+		return false
+	}
+	if *r.DB != "" && *r.DB != db {
+		return false
+	}
+	if *r.Collection == "" {
+		return !strings.HasPrefix(collection, "system.")
+	}
+	return *r.Collection == collection
+}
+
+var writeActions = map[string]bool{
+	"insert": true, "update": true, "remove": true,
+	"dropCollection": true, "dropDatabase": true,
+}
+
+// CheckPrivileges verifies, when MONGO_CHECK_PRIVILEGES is set, that the
+// authenticated user has every privilege needed. Missing ones are printed
+// with the roles that would grant them, writes to databases that aren't
+// written to are printed as warnings.
+func CheckPrivileges(sess *mgo.Session, needed ...Privilege) error {
+	if !*checkPrivileges {
+		return nil
+	}
+	return verifyPrivileges(sess, needed)
+}
+
+// Probe dials rawurl, pings it and verifies the user has the privileges
+// needed whether or not MONGO_CHECK_PRIVILEGES is set, for checking a
+// deployment before it runs
+func Probe(rawurl string, needed ...Privilege) error {
+	sess, err := Dial(rawurl)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	if err := sess.Ping(); err != nil {
+		return err
+	}
+	return verifyPrivileges(sess, needed)
+}
+
+func verifyPrivileges(sess *mgo.Session, needed []Privilege) error {
+	var status connectionStatus
+	err := sess.Run(bson.D{{Name: "connectionStatus", Value: 1}, {Name: "showPrivileges", Value: true}}, &status)
+	if err != nil {
+		return err
+	}
+	if len(status.AuthInfo.Users) == 0 {
+		fmt.Fprintln(os.Stderr, "privileges: not authenticated, assuming auth is disabled")
+		return nil
+	}
+	user := status.AuthInfo.Users[0]
+	granted := status.AuthInfo.Privileges
+
+	var missing []string
+	for _, p := range needed {
+		for _, action := range p.Actions {
+			if !hasAction(granted, p, action) {
+				role, roleDB, on := "read", p.DB, p.DB+"."+p.Collection
+				if writeActions[action] {
+					role = "readWrite"
+				}
+				if p.Collection == "" {
+					on = p.DB
+				}
+				switch {
+				case p.Cluster:
+					role, roleDB, on = "clusterMonitor", "admin", "the cluster"
+				case p.DB == "":
+					// every database, only the AnyDatabase roles cover that
+					role, roleDB, on = role+"AnyDatabase", "admin", "any database"
+				}
+				missing = append(missing, fmt.Sprintf("%s on %s, grant with:\n  db.getSiblingDB(%q).grantRolesToUser(%q, [{role: %q, db: %q}])",
+					action, on, user.DB, user.User, role, roleDB))
+			}
+		}
+	}
+	for _, g := range granted {
+		if g.Resource.AnyResource {
+			warnf("%s has privileges on any resource", user.User)
+			continue
+		}
+		if g.Resource.DB == nil {
+			continue
+		}
+		for _, action := range g.Actions {
+			if writeActions[action] && !writesTo(needed, *g.Resource.DB) {
+				db := *g.Resource.DB
+				if db == "" {
+					db = "any database"
+				}
+				warnf("%s can %s on %s but doesn't write there", user.User, action, db)
+				break
+			}
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "privileges: %s@%s is missing:\n", user.User, user.DB)
+		for _, m := range missing {
+			fmt.Fprintln(os.Stderr, "- "+m)
+		}
+		return fmt.Errorf("%d privileges missing", len(missing))
+	}
+	return nil
+}
+
+func hasAction(granted []grantedPrivilege, p Privilege, action string) bool {
+	for _, g := range granted {
+		if !g.Resource.covers(p) {
+			continue
+		}
+		for _, a := range g.Actions {
+			if a == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writesTo reports whether any write is needed in db. Built in roles only
+// grant writes together, so having more write actions than needed within
+// such a db is expected.
+func writesTo(needed []Privilege, db string) bool {
+	for _, p := range needed {
+		if p.DB != db {
+			continue
+		}
+		for _, a := range p.Actions {
+			if writeActions[a] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "privileges: warning: "+format+"\n", args...)
+}
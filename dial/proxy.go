@@ -0,0 +1,170 @@
+package dial
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ianschenck/envflag"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	proxyURL      = envflag.String("MONGO_PROXY", "", "dial mongodb through socks5://[user:pass@]host:port or ssh://user@bastion[:22]")
+	sshKey        = envflag.String("MONGO_SSH_KEY", "", "private key for the ssh bastion, defaults to ssh-agent then ~/.ssh/id_rsa")
+	sshKnownHosts = envflag.String("MONGO_SSH_KNOWN_HOSTS", "", "known_hosts file to verify the bastion against, defaults to ~/.ssh/known_hosts")
+)
+
+// netDialer dials addr within timeout
+type netDialer func(addr string, timeout time.Duration) (net.Conn, error)
+
+func directDial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// proxyDialer returns how to reach servers given MONGO_PROXY
+func proxyDialer() (netDialer, error) {
+	if *proxyURL == "" {
+		return directDial, nil
+	}
+	u, err := url.Parse(*proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		return func(addr string, timeout time.Duration) (net.Conn, error) {
+			d, err := proxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{Timeout: timeout})
+			if err != nil {
+				return nil, err
+			}
+			return d.Dial("tcp", addr)
+		}, nil
+	case "ssh":
+		config, err := sshConfig(u)
+		if err != nil {
+			return nil, err
+		}
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "22")
+		}
+		return (&bastion{addr: host, config: config}).dial, nil
+	}
+	return nil, fmt.Errorf("unsupported MONGO_PROXY scheme %q", u.Scheme)
+}
+
+// bastion keeps one ssh connection that all server connections are
+// forwarded over, reconnecting when it breaks.
+type bastion struct {
+	mu     sync.Mutex
+	addr   string
+	config *ssh.ClientConfig
+	client *ssh.Client
+}
+
+func (b *bastion) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if b.client == nil {
+			config := *b.config
+			config.Timeout = timeout
+			client, err := ssh.Dial("tcp", b.addr, &config)
+			if err != nil {
+				return nil, fmt.Errorf("ssh %s: %s", b.addr, err)
+			}
+			b.client = client
+		}
+		conn, err := b.client.Dial("tcp", addr)
+		if err == nil || attempt > 0 {
+			return conn, err
+		}
+		// stale ssh connection, try once more over a fresh one
+		b.client.Close()
+		b.client = nil
+	}
+}
+
+func sshConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	name := u.User.Username()
+	home := ""
+	if cur, err := user.Current(); err == nil {
+		home = cur.HomeDir
+		if name == "" {
+			name = cur.Username
+		}
+	}
+
+	var auths []ssh.AuthMethod
+	if password, ok := u.User.Password(); ok {
+		auths = append(auths, ssh.Password(password))
+	}
+	key := *sshKey
+	if key == "" {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if conn, err := net.Dial("unix", sock); err == nil {
+				auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			}
+		}
+		key = filepath.Join(home, ".ssh", "id_rsa")
+	}
+	if pem, err := ioutil.ReadFile(key); err == nil {
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	} else if *sshKey != "" {
+		return nil, err
+	}
+
+	hosts := *sshKnownHosts
+	if hosts == "" {
+		hosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKey, err := knownhosts.New(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{User: name, Auth: auths, HostKeyCallback: hostKey}, nil
+}
+
+// tlsClient runs the TLS handshake over an already dialed conn
+func tlsClient(conn net.Conn, addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c := config.Clone()
+		c.ServerName = host
+		config = c
+	}
+	tc := tls.Client(conn, config)
+	if timeout > 0 {
+		tc.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
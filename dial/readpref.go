@@ -0,0 +1,64 @@
+package dial
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ianschenck/envflag"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	readPreference = envflag.String("MONGO_READ_PREFERENCE", "primary", "primary, primaryPreferred, secondary, secondaryPreferred or nearest; use connect=direct in MONGO_URL for hidden members")
+	readTags       = envflag.String("MONGO_READ_TAGS", "", "tag sets to pick members by in order of preference, e.g. \"use:analytics,dc:east;use:analytics\", a trailing ; falls back to any member")
+)
+
+var modes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// applyReadPreference sets the session's mode and tag sets. Writes still go
+// to the primary, mgo only sends reads elsewhere.
+func applyReadPreference(sess *mgo.Session) error {
+	mode, ok := modes[*readPreference]
+	if !ok {
+		return fmt.Errorf("unknown MONGO_READ_PREFERENCE %q", *readPreference)
+	}
+	tags, err := parseTags(*readTags)
+	if err != nil {
+		return err
+	}
+	if len(tags) > 0 && mode == mgo.Primary {
+		return fmt.Errorf("MONGO_READ_TAGS can't be used with the primary read preference")
+	}
+	sess.SetMode(mode, true)
+	sess.SelectServers(tags...)
+	return nil
+}
+
+func parseTags(s string) ([]bson.D, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var sets []bson.D
+	for _, set := range strings.Split(s, ";") {
+		tags := bson.D{}
+		if set = strings.TrimSpace(set); set != "" {
+			for _, tag := range strings.Split(set, ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("tag %q must be name:value", tag)
+				}
+				tags = append(tags, bson.DocElem{Name: strings.TrimSpace(kv[0]), Value: strings.TrimSpace(kv[1])})
+			}
+		}
+		sets = append(sets, tags)
+	}
+	return sets, nil
+}
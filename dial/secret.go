@@ -0,0 +1,154 @@
+package dial
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ianschenck/envflag"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	urlFile       = envflag.String("MONGO_URL_FILE", "", "file holding the mongodb url, overrides MONGO_URL")
+	passwordFile  = envflag.String("MONGO_PASSWORD_FILE", "", "file holding the password, e.g. a mounted kubernetes secret")
+	passwordEnv   = envflag.String("MONGO_PASSWORD_ENV", "", "name of the environment variable holding the password")
+	passwordVault = envflag.String("MONGO_PASSWORD_VAULT", "", "vault secret holding the password as path#field, using VAULT_ADDR and VAULT_TOKEN")
+	secretRefresh = envflag.Duration("MONGO_SECRET_REFRESH", 30*time.Second, "how often file and vault secrets are re-read")
+)
+
+// credentials are the current user and password. When they come from a
+// file or vault they are re-read every MONGO_SECRET_REFRESH, new connections
+// authenticate with whatever is current.
+type credentials struct {
+	mu             sync.RWMutex
+	user, password string
+	reloads        bool
+}
+
+func (c *credentials) get() (string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.user, c.password
+}
+
+// readURL returns MONGO_URL_FILE's url if set, otherwise rawurl
+func readURL(rawurl string) (string, error) {
+	if *urlFile == "" {
+		return rawurl, nil
+	}
+	data, err := ioutil.ReadFile(*urlFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// loadCredentials resolves the password sources over what info has from
+// the url, and starts refreshing them if they can rotate.
+func loadCredentials(info *mgo.DialInfo) (*credentials, error) {
+	// info is handed to mgo with the credentials blanked out later on
+	urlUser, urlPassword := info.Username, info.Password
+	c := &credentials{}
+	load := func() (string, string, error) {
+		user, password := urlUser, urlPassword
+		if *urlFile != "" {
+			rawurl, err := readURL("")
+			if err != nil {
+				return "", "", err
+			}
+			rawurl, _, err = stripTLS(rawurl)
+			if err != nil {
+				return "", "", err
+			}
+			u, err := mgo.ParseURL(rawurl)
+			if err != nil {
+				return "", "", err
+			}
+			user, password = u.Username, u.Password
+		}
+		switch {
+		case *passwordFile != "":
+			data, err := ioutil.ReadFile(*passwordFile)
+			if err != nil {
+				return "", "", err
+			}
+			password = strings.TrimRight(string(data), "\r\n")
+		case *passwordEnv != "":
+			password = os.Getenv(*passwordEnv)
+		case *passwordVault != "":
+			var err error
+			password, err = readVault(*passwordVault)
+			if err != nil {
+				return "", "", err
+			}
+		}
+		return user, password, nil
+	}
+	var err error
+	c.user, c.password, err = load()
+	if err != nil {
+		return nil, err
+	}
+	info.Username, info.Password = c.user, c.password
+	c.reloads = *urlFile != "" || *passwordFile != "" || *passwordVault != ""
+	if c.reloads && *secretRefresh > 0 {
+		go func() {
+			for range time.Tick(*secretRefresh) {
+				user, password, err := load()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "reloading mongo credentials: %s\n", err)
+					continue
+				}
+				c.mu.Lock()
+				c.user, c.password = user, password
+				c.mu.Unlock()
+			}
+		}()
+	}
+	return c, nil
+}
+
+// readVault reads path#field from vault's kv engine, either version
+func readVault(secret string) (string, error) {
+	i := strings.LastIndex(secret, "#")
+	if i < 0 {
+		return "", errors.New("MONGO_PASSWORD_VAULT must be path#field")
+	}
+	path, field := strings.Trim(secret[:i], "/"), secret[i+1:]
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR not set")
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	body, err := readAll(&http.Client{Timeout: 5 * time.Second}, req)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner // kv version 2 nests the secret
+	}
+	password, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault %s has no string field %q", path, field)
+	}
+	return password, nil
+}
@@ -0,0 +1,73 @@
+package dial
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Shard is a session straight to one shard's replica set
+type Shard struct {
+	Name    string
+	Session *mgo.Session
+}
+
+// IsMongos reports whether sess is connected to a mongos
+func IsMongos(sess *mgo.Session) (bool, error) {
+	var res struct {
+		Msg string `bson:"msg"`
+	}
+	if err := sess.Run("isMaster", &res); err != nil {
+		return false, err
+	}
+	return res.Msg == "isdbgrid", nil
+}
+
+// DialShards lists the shards behind the mongos sess is connected to and
+// dials each with rawurl's options and credentials. Shards only know their
+// shard local users, rawurl's user must exist on every shard as well.
+func DialShards(sess *mgo.Session, rawurl string) ([]Shard, error) {
+	var res struct {
+		Shards []struct {
+			ID   string `bson:"_id"`
+			Host string `bson:"host"`
+		} `bson:"shards"`
+	}
+	if err := sess.Run("listShards", &res); err != nil {
+		return nil, err
+	}
+	info, err := ParseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = 10 * time.Second
+	var shards []Shard
+	for _, s := range res.Shards {
+		// host is "replicaSet/host:port,host:port", or a lone host
+		shardInfo := *info
+		shardInfo.Direct = false
+		shardInfo.ReplicaSetName = ""
+		hosts := s.Host
+		if i := strings.Index(hosts, "/"); i >= 0 {
+			shardInfo.ReplicaSetName, hosts = hosts[:i], hosts[i+1:]
+		}
+		shardInfo.Addrs = strings.Split(hosts, ",")
+		shardSess, err := mgo.DialWithInfo(&shardInfo)
+		if err == nil {
+			shardSess.SetSocketTimeout(*socketTimeout)
+			if err = applyReadPreference(shardSess); err != nil {
+				shardSess.Close()
+			}
+		}
+		if err != nil {
+			for _, shard := range shards {
+				shard.Session.Close()
+			}
+			return nil, fmt.Errorf("shard %s: %s", s.ID, err)
+		}
+		shards = append(shards, Shard{Name: s.ID, Session: shardSess})
+	}
+	return shards, nil
+}
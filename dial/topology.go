@@ -0,0 +1,61 @@
+package dial
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"github.com/ianschenck/envflag"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	topologyInterval = envflag.Duration("MONGO_TOPOLOGY_INTERVAL", 5*time.Second, "how often the member being read from is checked, 0 to never check")
+	socketTimeout    = envflag.Duration("MONGO_SOCKET_TIMEOUT", time.Minute, "how long a read may block before the member is taken as unreachable")
+)
+
+type memberStatus struct {
+	Me        string `bson:"me"`
+	IsMaster  bool   `bson:"ismaster"`
+	Secondary bool   `bson:"secondary"`
+	SetName   string `bson:"setName"`
+	Msg       string `bson:"msg"`
+}
+
+// WatchMember checks the member sess is reading from every
+// MONGO_TOPOLOGY_INTERVAL, sending why once it should be read from no more:
+// it's unreachable, was removed from the replica set, is recovering, or
+// stepped down while the primary is wanted. Receivers Refresh sess to pick
+// another member. Nothing is ever sent for mongos or standalone servers.
+func WatchMember(sess *mgo.Session) <-chan string {
+	moved := make(chan string, 1)
+	if *topologyInterval <= 0 {
+		return moved
+	}
+	go func() {
+		defer cli.Recover()
+		for range time.Tick(*topologyInterval) {
+			var status memberStatus
+			var reason string
+			switch err := sess.Run("isMaster", &status); {
+			case err != nil:
+				reason = fmt.Sprintf("unreachable: %s", err)
+			case status.Msg == "isdbgrid" || status.SetName == "" && status.IsMaster:
+				continue // not a replica set member
+			case !status.IsMaster && !status.Secondary:
+				reason = fmt.Sprintf("%s is no longer serving reads, removed or recovering", status.Me)
+			case !status.IsMaster && sess.Mode() == mgo.Strong:
+				reason = fmt.Sprintf("%s stepped down", status.Me)
+			default:
+				continue
+			}
+			select {
+			case moved <- reason:
+			default: // the last one wasn't acted on yet
+			}
+		}
+	}()
+	return moved
+}
@@ -0,0 +1,205 @@
+// Package diff normalizes oplog updates. From 5.0 on updates are logged as
+// $v: 2 diffs, these are turned into the $set and $unset of $v: 1 updates
+// so consumers only need to understand the one format.
+//
+// A v2 diff is a document of sections, u for updated and i for inserted
+// fields, d for deleted ones, and s<field> for the diff of a subdocument:
+//
+//	{$v: 2, diff: {u: {a: 1}, d: {b: false}, sc: {i: {x: 1}}, sarr: {a: true, l: 2, u1: 5}}}
+//
+// becomes
+//
+//	{$set: {a: 1, c.x: 1, arr.1: 5}, $unset: {b: true}, $push: {arr: {$each: [], $slice: 2}}}
+//
+// Arrays diffs, marked a, update elements with u<index> and s<index> and
+// truncate the array with l, which $set can't express: it's a $push of
+// nothing sliced to the new length, to be applied before the rest as
+// mongodb refuses both on the same array in one update.
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Normalize returns o as a v1 update. Anything but a v2 diff is returned
+// as is, bar the $v field.
+func Normalize(o bson.D) (bson.D, error) {
+	version, diff := 1, interface{}(nil)
+	update := make(bson.D, 0, len(o))
+	for _, e := range o {
+		if e.Name == "$v" {
+			version = asInt(e.Value)
+		}
+	}
+	for _, e := range o {
+		switch {
+		case e.Name == "$v":
+		case e.Name == "diff" && version == 2:
+			diff = e.Value
+		default:
+			update = append(update, e)
+		}
+	}
+	switch {
+	case version == 1:
+		return update, nil
+	case version != 2:
+		return nil, fmt.Errorf("unknown update version %d", version)
+	case diff == nil:
+		return nil, errors.New("v2 update without diff")
+	}
+	var u v1
+	if err := u.doc("", diff); err != nil {
+		return nil, err
+	}
+	update = update[:0]
+	for _, op := range []struct {
+		name   string
+		fields bson.D
+	}{{"$push", u.push}, {"$set", u.set}, {"$unset", u.unset}} {
+		if len(op.fields) > 0 {
+			update = append(update, bson.DocElem{Name: op.name, Value: op.fields})
+		}
+	}
+	return update, nil
+}
+
+// NormalizeM is Normalize for updates decoded into a bson.M, the operators
+// of a diff are turned into bson.M too.
+func NormalizeM(o bson.M) (bson.M, error) {
+	d := make(bson.D, 0, len(o))
+	for k, v := range o {
+		d = append(d, bson.DocElem{Name: k, Value: v})
+	}
+	d, err := Normalize(d)
+	if err != nil {
+		return nil, err
+	}
+	m := make(bson.M, len(d))
+	for _, e := range d {
+		if fields, ok := e.Value.(bson.D); ok {
+			e.Value = fields.Map()
+		}
+		m[e.Name] = e.Value
+	}
+	return m, nil
+}
+
+type v1 struct {
+	set, unset, push bson.D
+}
+
+func (u *v1) doc(prefix string, diff interface{}) error {
+	elems, err := elements(diff)
+	if err != nil {
+		return err
+	}
+	for _, e := range elems {
+		switch {
+		case e.Name == "u" || e.Name == "i":
+			fields, err := elements(e.Value)
+			if err != nil {
+				return err
+			}
+			for _, f := range fields {
+				u.set = append(u.set, bson.DocElem{Name: join(prefix, f.Name), Value: f.Value})
+			}
+		case e.Name == "d":
+			fields, err := elements(e.Value)
+			if err != nil {
+				return err
+			}
+			for _, f := range fields {
+				u.unset = append(u.unset, bson.DocElem{Name: join(prefix, f.Name), Value: true})
+			}
+		case len(e.Name) > 1 && e.Name[0] == 's':
+			if err := u.sub(join(prefix, e.Name[1:]), e.Value); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown diff section %q at %q", e.Name, prefix)
+		}
+	}
+	return nil
+}
+
+// sub applies the diff of a subdocument or array at path
+func (u *v1) sub(path string, diff interface{}) error {
+	elems, err := elements(diff)
+	if err != nil {
+		return err
+	}
+	array := false
+	for _, e := range elems {
+		if e.Name == "a" {
+			array, _ = e.Value.(bool)
+		}
+	}
+	if !array {
+		return u.doc(path, diff)
+	}
+	for _, e := range elems {
+		switch {
+		case e.Name == "a":
+		case e.Name == "l":
+			u.push = append(u.push, bson.DocElem{Name: path, Value: bson.D{
+				{Name: "$each", Value: []interface{}{}},
+				{Name: "$slice", Value: asInt(e.Value)},
+			}})
+		case len(e.Name) > 1 && (e.Name[0] == 'u' || e.Name[0] == 's'):
+			if _, err := strconv.Atoi(e.Name[1:]); err != nil {
+				return fmt.Errorf("bad array index %q at %q", e.Name, path)
+			}
+			if e.Name[0] == 'u' {
+				u.set = append(u.set, bson.DocElem{Name: join(path, e.Name[1:]), Value: e.Value})
+			} else if err := u.sub(join(path, e.Name[1:]), e.Value); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown array diff section %q at %q", e.Name, path)
+		}
+	}
+	return nil
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// elements of a decoded document, ordered unless it was decoded into a map
+func elements(v interface{}) (bson.D, error) {
+	switch v := v.(type) {
+	case bson.D:
+		return v, nil
+	case bson.M:
+		d := make(bson.D, 0, len(v))
+		for k, e := range v {
+			d = append(d, bson.DocElem{Name: k, Value: e})
+		}
+		return d, nil
+	case map[string]interface{}:
+		return elements(bson.M(v))
+	}
+	return nil, fmt.Errorf("diff: expected a document, got %T", v)
+}
+
+func asInt(v interface{}) int {
+	switch v := v.(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		diff   bson.D
+		update bson.D
+	}{
+		{"update", d("u", d("a", 1, "b.c", "x")),
+			d("$set", d("a", 1, "b.c", "x"))},
+		{"insert", d("i", d("new", d("x", 1))),
+			d("$set", d("new", d("x", 1)))},
+		{"delete", d("d", d("gone", false, "also", false)),
+			d("$unset", d("gone", true, "also", true))},
+		{"all three", d("u", d("a", 1), "d", d("b", false), "i", d("c", 2)),
+			d("$set", d("a", 1, "c", 2), "$unset", d("b", true))},
+		{"subdocument", d("sprofile", d("u", d("name", "ada"), "d", d("nick", false))),
+			d("$set", d("profile.name", "ada"), "$unset", d("profile.nick", true))},
+		{"nested subdocuments", d("sa", d("sb", d("i", d("c", 1)))),
+			d("$set", d("a.b.c", 1))},
+		{"array element", d("saddresses", d("a", true, "u1", d("street", "main st"))),
+			d("$set", d("addresses.1", d("street", "main st")))},
+		{"array element field", d("saddresses", d("a", true, "s0", d("u", d("street", "main st")))),
+			d("$set", d("addresses.0.street", "main st"))},
+		{"array in array", d("sgrid", d("a", true, "s2", d("a", true, "u3", 9))),
+			d("$set", d("grid.2.3", 9))},
+		{"truncated", d("stags", d("a", true, "l", 2)),
+			d("$push", d("tags", d("$each", []interface{}{}, "$slice", 2)))},
+		{"truncated and updated", d("stags", d("a", true, "l", int32(3), "u2", "c"), "u", d("n", 1)),
+			d(
+				"$push", d("tags", d("$each", []interface{}{}, "$slice", 3)),
+				"$set", d("tags.2", "c", "n", 1),
+			)},
+		{"empty", bson.D{}, bson.D{}},
+	} {
+		got, err := Normalize(d("$v", 2, "diff", c.diff))
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.update) {
+			t.Errorf("%s: %v, want %v", c.name, got, c.update)
+		}
+	}
+}
+
+func TestNormalizeV1(t *testing.T) {
+	for _, o := range []bson.D{
+		d("$v", 1, "$set", d("a", 1)),
+		d("$set", d("a", 1)),
+		d("$v", int32(1), "$set", d("a", 1)),
+	} {
+		got, err := Normalize(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := d("$set", d("a", 1)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: %v, want %v", o, got, want)
+		}
+	}
+	// a replacement, a document named diff included
+	o := d("_id", 1, "diff", "kept")
+	if got, err := Normalize(o); err != nil || !reflect.DeepEqual(got, o) {
+		t.Errorf("replacement gave %v, %v", got, err)
+	}
+}
+
+func TestNormalizeInvalid(t *testing.T) {
+	for _, c := range []struct {
+		o   bson.D
+		err string
+	}{
+		{d("$v", 3, "diff", bson.D{}), "unknown update version 3"},
+		{d("$v", 2), "v2 update without diff"},
+		{d("$v", 2, "diff", "x"), "expected a document, got string"},
+		{d("$v", 2, "diff", d("x", bson.D{})), `unknown diff section "x" at ""`},
+		{d("$v", 2, "diff", d("sa", d("q", 1))), `unknown diff section "q" at "a"`},
+		{d("$v", 2, "diff", d("u", 1)), "expected a document, got int"},
+		{d("$v", 2, "diff", d("sarr", d("a", true, "ux", 1))), `bad array index "ux" at "arr"`},
+		{d("$v", 2, "diff", d("sarr", d("a", true, "d", bson.D{}))), `unknown array diff section "d" at "arr"`},
+	} {
+		if _, err := Normalize(c.o); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: %v, want %q", c.o, err, c.err)
+		}
+	}
+}
+
+func TestNormalizeM(t *testing.T) {
+	got, err := NormalizeM(bson.M{"$v": 2, "diff": bson.M{
+		"u":          bson.M{"a": 1},
+		"d":          bson.M{"b": false},
+		"saddresses": bson.M{"a": true, "l": 4, "s1": bson.M{"u": bson.M{"street": "main st"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{
+		"$set":   bson.M{"a": 1, "addresses.1.street": "main st"},
+		"$unset": bson.M{"b": true},
+		"$push":  bson.M{"addresses": d("$each", []interface{}{}, "$slice", 4)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%v, want %v", got, want)
+	}
+	if _, err := NormalizeM(bson.M{"$v": 2}); err == nil {
+		t.Error("a v2 update without diff normalized")
+	}
+}
+
+// d is a bson.D of name, value pairs
+func d(pairs ...interface{}) bson.D {
+	var doc bson.D
+	for i := 0; i < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
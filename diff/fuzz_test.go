@@ -0,0 +1,36 @@
+package diff_test
+
+import (
+	"testing"
+
+	"github.com/hanjoyo/oplog-abuse/diff"
+	"github.com/hanjoyo/oplog-abuse/oplogtest"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FuzzNormalize normalizes data decoded as an update, both ways updates
+// are decoded. Any input may fail to normalize, none may panic.
+func FuzzNormalize(f *testing.F) {
+	for _, e := range oplogtest.Representative() {
+		if o, ok := e.Map()["o"].(bson.D); ok {
+			data, err := bson.Marshal(o)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(data)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var d bson.D
+		if err := bson.Unmarshal(data, &d); err != nil {
+			return
+		}
+		var m bson.M
+		if err := bson.Unmarshal(data, &m); err != nil {
+			return
+		}
+		diff.Normalize(d)
+		diff.NormalizeM(m)
+	})
+}
@@ -0,0 +1,225 @@
+// Package dump dumps a range of the oplog to a file, the oplogctl dump command.
+package dump
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/avro"
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/protobuf"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("dump", "write an oplog range to a bson, json, avro or protobuf file with a manifest")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the replica set to dump the oplog of")
+	from     = flags.String("FROM", "", "dump entries after this ts, seconds[:increment] or RFC 3339")
+	to       = flags.String("TO", "", "dump entries up to this ts, up to the latest when started if empty")
+	out      = flags.String("OUT", "", "file written, its manifest next to it as OUT.manifest.json")
+	format   = flags.String("FORMAT", "bson", "bson, as mongodump writes and the replay tool reads, json for one extended json entry per line, avro for an avro object container file or proto for length delimited protobuf messages, of protobuf/oplog.proto")
+	nsFilter = flags.String("NS", "", "comma separated dbs or db.collections to dump, commands on their dbs included, everything if empty")
+)
+
+// manifest describes a dump, for telling what's in it without reading it
+type manifest struct {
+	From       string                    `json:"from"`
+	To         string                    `json:"to"`
+	First      string                    `json:"first,omitempty"` // ts of the first entry dumped
+	Last       string                    `json:"last,omitempty"`
+	FirstAt    time.Time                 `json:"first_at"`
+	LastAt     time.Time                 `json:"last_at"`
+	Format     string                    `json:"format"`
+	NS         []string                  `json:"ns,omitempty"`
+	Entries    int                       `json:"entries"`
+	Bytes      int64                     `json:"bytes"`
+	Namespaces map[string]map[string]int `json:"namespaces"` // ns to op to count
+	Created    time.Time                 `json:"created"`
+}
+
+type entry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Operation string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+}
+
+// add counts e, dumped after what's counted already
+func (m *manifest) add(e *entry) {
+	if m.Entries == 0 {
+		m.First, m.FirstAt = optime.Format(e.Timestamp), optime.Time(e.Timestamp)
+	}
+	m.Last, m.LastAt = optime.Format(e.Timestamp), optime.Time(e.Timestamp)
+	m.Entries++
+	if m.Namespaces[e.Namespace] == nil {
+		m.Namespaces[e.Namespace] = make(map[string]int)
+	}
+	m.Namespaces[e.Namespace][e.Operation]++
+}
+
+// writer returns what writes an entry to w as format says, and what
+// ends it, writing what's held back till the end
+func writer(w io.Writer, format string) (write func(raw []byte) error, end func() error) {
+	end = func() error { return nil }
+	switch format {
+	case "json":
+		write = func(raw []byte) error {
+			line, err := bsonfile.JSONLine(raw)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(line)
+			return err
+		}
+	case "avro":
+		aw := avro.NewWriter(w)
+		write, end = aw.Write, aw.Close
+	case "proto":
+		write = protobuf.NewWriter(w).Write
+	default:
+		write = func(raw []byte) error {
+			_, err := w.Write(raw)
+			return err
+		}
+	}
+	return write, end
+}
+
+// query matches entries after since up to until of the namespaces wanted
+func query(since, until bson.MongoTimestamp, namespaces []string) bson.M {
+	q := bson.M{"ts": bson.M{"$gt": since, "$lte": until}}
+	if len(namespaces) == 0 {
+		return q
+	}
+	var or []bson.M
+	for _, ns := range namespaces {
+		db := strings.SplitN(ns, ".", 2)[0]
+		if ns == db {
+			or = append(or, bson.M{"ns": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(db) + `\.`}})
+			continue
+		}
+		or = append(or, bson.M{"ns": ns}, bson.M{"ns": db + ".$cmd"})
+	}
+	// and the transactions that may hold them
+	or = append(or, bson.M{"op": "c", "ns": "admin.$cmd"})
+	q["$or"] = or
+	return q
+}
+
+// Main runs oplogctl dump, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *out == "" {
+		panic(cli.Invalidf("OUT not set"))
+	}
+	switch *format {
+	case "bson", "json", "avro", "proto":
+	default:
+		panic(cli.Invalidf("unknown FORMAT %q", *format))
+	}
+	since, err := optime.Parse(*from)
+	if err != nil {
+		panic(cli.Invalidf("FROM: %s", err))
+	}
+	until, err := optime.Parse(*to)
+	if err != nil {
+		panic(cli.Invalidf("TO: %s", err))
+	}
+	var namespaces []string
+	for _, ns := range strings.Split(*nsFilter, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	err = dial.CheckPrivileges(sess,
+		dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+	)
+	if err != nil {
+		panic(err)
+	}
+	if until == 0 {
+		var latest entry
+		if err := sess.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&latest); err != nil {
+			panic(err)
+		}
+		until = latest.Timestamp
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		panic(err)
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	write, end := writer(w, *format)
+	m := manifest{
+		From:       optime.Format(since),
+		To:         optime.Format(until),
+		Format:     *format,
+		NS:         namespaces,
+		Namespaces: make(map[string]map[string]int),
+	}
+	iter := sess.DB("local").
+		C("oplog.rs").
+		Find(query(since, until, namespaces)).
+		Sort("$natural").
+		LogReplay().
+		Iter()
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		var e entry
+		if err := raw.Unmarshal(&e); err != nil {
+			panic(err)
+		}
+		if err := write(raw.Data); err != nil {
+			panic(fmt.Errorf("entry at %s: %s", optime.Format(e.Timestamp), err))
+		}
+		m.add(&e)
+	}
+	if err := iter.Close(); err != nil {
+		panic(err)
+	}
+	if err := end(); err != nil {
+		panic(err)
+	}
+	if err := w.Flush(); err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	info, err := os.Stat(*out)
+	if err != nil {
+		panic(err)
+	}
+	m.Bytes = info.Size()
+
+	m.Created = time.Now()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(*out+".manifest.json", append(data, '\n'), 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("dumped %d entries, %s to %s, into %s\n", m.Entries, m.First, m.Last, *out)
+}
@@ -0,0 +1,127 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/protobuf"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestQuery(t *testing.T) {
+	ts := bson.M{"$gt": bson.MongoTimestamp(1), "$lte": bson.MongoTimestamp(2)}
+	if q := query(1, 2, nil); !reflect.DeepEqual(q, bson.M{"ts": ts}) {
+		t.Errorf("everything: %v", q)
+	}
+	q := query(1, 2, []string{"app.users", "logs.v1"})
+	want := bson.M{"ts": ts, "$or": []bson.M{
+		{"ns": "app.users"}, {"ns": "app.$cmd"},
+		{"ns": "logs.v1"}, {"ns": "logs.$cmd"},
+		{"op": "c", "ns": "admin.$cmd"},
+	}}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("collections: %v, want %v", q, want)
+	}
+	// a db's every collection, matched as written
+	q = query(1, 2, []string{"a+b"})
+	if or := q["$or"].([]bson.M); len(or) != 2 || !reflect.DeepEqual(or[0], bson.M{"ns": bson.RegEx{Pattern: `^a\+b\.`}}) {
+		t.Errorf("a db: %v", or)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	m := manifest{Namespaces: make(map[string]map[string]int)}
+	for _, e := range []entry{
+		{Timestamp: 100<<32 | 1, Operation: "i", Namespace: "app.users"},
+		{Timestamp: 100<<32 | 2, Operation: "i", Namespace: "app.users"},
+		{Timestamp: 101 << 32, Operation: "c", Namespace: "app.$cmd"},
+		{Timestamp: 102 << 32, Operation: "u", Namespace: "app.users"},
+	} {
+		m.add(&e)
+	}
+	if m.First != "100:1" || m.Last != "102:0" || m.Entries != 4 {
+		t.Errorf("first %s, last %s, %d entries", m.First, m.Last, m.Entries)
+	}
+	if !m.FirstAt.Equal(time.Unix(100, 0)) || !m.LastAt.Equal(time.Unix(102, 0)) {
+		t.Errorf("first at %s, last at %s", m.FirstAt, m.LastAt)
+	}
+	want := map[string]map[string]int{"app.users": {"i": 2, "u": 1}, "app.$cmd": {"c": 1}}
+	if !reflect.DeepEqual(m.Namespaces, want) {
+		t.Errorf("namespaces %v, want %v", m.Namespaces, want)
+	}
+}
+
+// dumped writes entries to a buffer as format says
+func dumped(t *testing.T, format string, entries [][]byte) []byte {
+	var b bytes.Buffer
+	write, end := writer(&b, format)
+	for _, raw := range entries {
+		if err := write(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := end(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestWriter(t *testing.T) {
+	var entries [][]byte
+	for i := 1; i <= 3; i++ {
+		raw, err := bson.Marshal(bson.D{
+			{Name: "ts", Value: bson.MongoTimestamp(int64(100+i) << 32)},
+			{Name: "op", Value: "i"},
+			{Name: "ns", Value: "app.users"},
+			{Name: "o", Value: bson.D{{Name: "_id", Value: i}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, raw)
+	}
+
+	// bson reads back as written
+	r := bsonfile.NewReader(bytes.NewReader(dumped(t, "bson", entries)))
+	for i, want := range entries {
+		got, err := r.NextRaw()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("bson entry %d: %v", i, err)
+		}
+	}
+	if _, err := r.NextRaw(); err == nil {
+		t.Error("more than written")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(dumped(t, "json", entries)), "\n"), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `"ts":{"$timestamp":{"t":101,"i":0}}`) || !strings.Contains(lines[2], `"o":{"_id":3}`) {
+		t.Errorf("json lines %q", lines)
+	}
+
+	if avro := dumped(t, "avro", entries); !bytes.HasPrefix(avro, []byte("Obj\x01")) {
+		t.Errorf("avro without its header: %q", avro[:8])
+	}
+
+	// length delimited messages
+	proto := dumped(t, "proto", entries)
+	for i, raw := range entries {
+		want, err := protobuf.Marshal(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, size := binary.Uvarint(proto)
+		if size <= 0 || int(n) != len(want) || !bytes.Equal(proto[size:size+int(n)], want) {
+			t.Fatalf("proto message %d", i)
+		}
+		proto = proto[size+int(n):]
+	}
+	if len(proto) != 0 {
+		t.Errorf("%d bytes after the messages", len(proto))
+	}
+}
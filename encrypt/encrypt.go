@@ -0,0 +1,279 @@
+// Package encrypt seals configured document fields with AES-GCM before
+// events leave the process.
+//
+// Fields are sealed with a data key. The data key is either read from a
+// file, or generated by vault's transit engine which acts as the KMS: vault
+// keeps the master key and hands out the data key wrapped by it, and every
+// sealed value carries that wrapped key so a consumer holding the right
+// vault policy can unwrap it again.
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Sealed is what an encrypted field is replaced with. Data is base64 of the
+// nonce followed by the AES-GCM sealed BSON document {"v": <original value>}.
+type Sealed struct {
+	Data string `bson:"$encrypted" json:"$encrypted"`
+	Key  string `bson:"$key" json:"$key"`
+}
+
+// Encryptor seals fields per namespace
+type Encryptor struct {
+	aead   cipher.AEAD
+	keyID  string
+	fields map[string][][]string
+}
+
+// New parses fields, a comma separated list of ns:dotted.path, and sets up
+// the data key from keySpec as Open does. It returns nil if no fields are
+// configured.
+func New(fields, keySpec string) (*Encryptor, error) {
+	if fields == "" {
+		return nil, nil
+	}
+	parsed := make(map[string][][]string)
+	for _, f := range strings.Split(fields, ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("encrypt: field %q must be ns:path", f)
+		}
+		parsed[kv[0]] = append(parsed[kv[0]], strings.Split(kv[1], "."))
+	}
+	e, err := Open(keySpec)
+	if err != nil {
+		return nil, err
+	}
+	e.fields = parsed
+	return e, nil
+}
+
+// Open sets up the data key from keySpec, either "file:<path>" holding a 32
+// byte key as base64 or hex, or "vault:<transit key name>" using VAULT_ADDR
+// and VAULT_TOKEN, sealing no fields until they're enrolled.
+func Open(keySpec string) (*Encryptor, error) {
+	e := &Encryptor{fields: make(map[string][][]string)}
+	var key []byte
+	var err error
+	switch {
+	case strings.HasPrefix(keySpec, "file:"):
+		key, err = readKey(strings.TrimPrefix(keySpec, "file:"))
+		e.keyID = "file"
+	case strings.HasPrefix(keySpec, "vault:"):
+		key, e.keyID, err = vaultDataKey(strings.TrimPrefix(keySpec, "vault:"))
+	default:
+		err = fmt.Errorf("key %q must be file:<path> or vault:<key name>", keySpec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %s", err)
+	}
+	e.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func readKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s doesn't hold a 32 byte key as hex or base64", path)
+}
+
+// vaultDataKey asks vault's transit engine for a new data key, returning
+// the key and its wrapped form
+func vaultDataKey(name string) ([]byte, string, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, "", errors.New("VAULT_ADDR not set")
+	}
+	req, err := http.NewRequest("POST", addr+"/v1/transit/datakey/plaintext/"+name, strings.NewReader(`{"bits":256}`))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("vault datakey %s: %s", name, resp.Status)
+	}
+	var body struct {
+		Data struct {
+			Plaintext  string `json:"plaintext"`
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, "", err
+	}
+	key, err := base64.StdEncoding.DecodeString(body.Data.Plaintext)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, body.Data.Ciphertext, nil
+}
+
+// Enroll seals the field at a dotted path of ns from now on too. It's not
+// safe to call while Apply runs.
+func (e *Encryptor) Enroll(ns, path string) {
+	for _, p := range e.fields[ns] {
+		if strings.Join(p, ".") == path {
+			return
+		}
+	}
+	e.fields[ns] = append(e.fields[ns], strings.Split(path, "."))
+}
+
+// Apply seals the configured fields of ns in each document in place. Update
+// operators are looked into, so a $set of a sealed field is sealed too.
+func (e *Encryptor) Apply(ns string, docs ...bson.M) error {
+	if e == nil {
+		return nil
+	}
+	for _, path := range e.fields[ns] {
+		for _, doc := range docs {
+			if err := e.seal(doc, path); err != nil {
+				return err
+			}
+			for op, v := range doc {
+				if !strings.HasPrefix(op, "$") {
+					continue
+				}
+				if fields, ok := v.(bson.M); ok {
+					if err := e.sealOperator(fields, path); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sealOperator handles operator documents whose keys are dotted paths. Array
+// positions in a key, as in $set {"addresses.1.street": ...}, are skipped
+// when comparing it to the path, as the path reaches into every element.
+func (e *Encryptor) sealOperator(fields bson.M, path []string) error {
+	full := strings.Join(path, ".")
+	for k := range fields {
+		if k == full {
+			if err := e.sealValue(fields, k); err != nil {
+				return err
+			}
+			continue
+		}
+		key := withoutPositions(k)
+		switch {
+		case len(key) <= len(path) && equal(key, path[:len(key)]):
+			if len(key) == len(path) {
+				if err := e.sealValue(fields, k); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := e.sealIn(fields[k], path[len(key):]); err != nil {
+				return err
+			}
+		case len(key) > len(path) && equal(key[:len(path)], path):
+			// setting inside a sealed field
+			if err := e.sealValue(fields, k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withoutPositions splits a dotted key, dropping its numeric segments
+func withoutPositions(k string) []string {
+	var key []string
+	for _, s := range strings.Split(k, ".") {
+		if _, err := strconv.Atoi(s); err != nil {
+			key = append(key, s)
+		}
+	}
+	return key
+}
+
+func equal(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func (e *Encryptor) sealIn(v interface{}, path []string) error {
+	switch v := v.(type) {
+	case bson.M:
+		return e.seal(v, path)
+	case []interface{}:
+		for _, elem := range v {
+			if err := e.sealIn(elem, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Encryptor) seal(doc bson.M, path []string) error {
+	if _, ok := doc[path[0]]; !ok {
+		return nil
+	}
+	if len(path) == 1 {
+		return e.sealValue(doc, path[0])
+	}
+	return e.sealIn(doc[path[0]], path[1:])
+}
+
+func (e *Encryptor) sealValue(doc bson.M, k string) error {
+	if _, ok := doc[k].(Sealed); ok {
+		return nil
+	}
+	plain, err := bson.Marshal(bson.M{"v": doc[k]})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plain)+e.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := e.aead.Seal(nonce, nonce, plain, nil)
+	doc[k] = Sealed{Data: base64.StdEncoding.EncodeToString(sealed), Key: e.keyID}
+	return nil
+}
@@ -0,0 +1,266 @@
+package encrypt
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var key = []byte("0123456789abcdef0123456789abcdef")
+
+// keyFile writes key to a file as hex, returning its key spec
+func keyFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return "file:" + path
+}
+
+// unseal opens a sealed value as a consumer holding the data key would
+func unseal(t *testing.T, e *Encryptor, s Sealed) interface{} {
+	data, err := base64.StdEncoding.DecodeString(s.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := e.aead.NonceSize()
+	plain, err := e.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(plain, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc["v"]
+}
+
+// walk collects the strings left in plaintext and the sealed values
+func walk(v interface{}, plain *[]string, sealed *[]Sealed) {
+	switch v := v.(type) {
+	case Sealed:
+		*sealed = append(*sealed, v)
+	case bson.M:
+		for _, elem := range v {
+			walk(elem, plain, sealed)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			walk(elem, plain, sealed)
+		}
+	case string:
+		*plain = append(*plain, v)
+	}
+}
+
+func TestApply(t *testing.T) {
+	const fields = "db.users:addresses.street,db.users:ssn,db.users:scores.2020"
+	e, err := New(fields, keyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name  string
+		ns    string
+		doc   bson.M
+		plain []string // what's left readable, every pii value is sealed
+	}{
+		{"document", "db.users", bson.M{"_id": "id", "ssn": "pii", "name": "ada"}, []string{"ada", "id"}},
+		{"sub-document", "db.users", bson.M{"addresses": bson.M{"street": "pii", "city": "paris"}}, []string{"paris"}},
+		{"array", "db.users", bson.M{"addresses": []interface{}{
+			bson.M{"street": "pii-0", "city": "paris"},
+			bson.M{"street": "pii-1"},
+			"unstructured",
+		}}, []string{"paris", "unstructured"}},
+		{"field missing", "db.users", bson.M{"addresses": bson.M{"city": "paris"}}, []string{"paris"}},
+		{"other namespace", "db.orders", bson.M{"ssn": "kept", "addresses": bson.M{"street": "kept too"}}, []string{"kept", "kept too"}},
+		{"$set exact", "db.users", bson.M{"$set": bson.M{"addresses.street": "pii", "name": "ada"}}, []string{"ada"}},
+		{"$set parent", "db.users", bson.M{"$set": bson.M{"addresses": []interface{}{
+			bson.M{"street": "pii", "city": "paris"},
+		}}}, []string{"paris"}},
+		{"$set child", "db.users", bson.M{"$set": bson.M{"addresses.street.line1": "pii", "ssn.last4": "pii"}}, nil},
+		{"$set positional", "db.users", bson.M{"$set": bson.M{"addresses.1.street": "pii", "addresses.1.city": "paris"}}, []string{"paris"}},
+		{"$set positional parent", "db.users", bson.M{"$set": bson.M{"addresses.1": bson.M{"street": "pii", "city": "paris"}}}, []string{"paris"}},
+		{"$set positional child", "db.users", bson.M{"$set": bson.M{"addresses.10.street.line1": "pii"}}, nil},
+		{"$set numeric field", "db.users", bson.M{"$set": bson.M{"scores.2020": "pii", "scores.2021": "open"}}, []string{"open"}},
+		{"$set alike names", "db.users", bson.M{"$set": bson.M{"addressesOld": "old", "street": "main st", "ssnValid": "yes"}}, []string{"main st", "old", "yes"}},
+		{"$setOnInsert", "db.users", bson.M{"$setOnInsert": bson.M{"ssn": "pii", "addresses.0.street": "pii"}}, nil},
+		{"$setOnInsert positional parent", "db.users", bson.M{"$setOnInsert": bson.M{"addresses.0": bson.M{"street": "pii"}}}, nil},
+	} {
+		if err := e.Apply(c.ns, c.doc); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		var plain []string
+		var sealed []Sealed
+		walk(c.doc, &plain, &sealed)
+		sort.Strings(plain)
+		if !reflect.DeepEqual(plain, c.plain) {
+			t.Errorf("%s: left %q readable, want %q", c.name, plain, c.plain)
+		}
+		for _, s := range sealed {
+			if v := unseal(t, e, s); !strings.HasPrefix(v.(string), "pii") {
+				t.Errorf("%s: sealed %v", c.name, v)
+			}
+		}
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	e, err := New("db.users:profile", keyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := bson.M{"email": "ada@example.com", "born": 1815, "tags": []interface{}{"math"}}
+	doc := bson.M{"profile": profile}
+	if err := e.Apply("db.users", doc); err != nil {
+		t.Fatal(err)
+	}
+	sealed, ok := doc["profile"].(Sealed)
+	if !ok {
+		t.Fatalf("profile left as %v", doc["profile"])
+	}
+	if sealed.Key != "file" {
+		t.Errorf("key %q, want file", sealed.Key)
+	}
+	if got := unseal(t, e, sealed); !reflect.DeepEqual(got, profile) {
+		t.Errorf("opened %v, want %v", got, profile)
+	}
+	// sealing again leaves it be
+	if err := e.Apply("db.users", doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["profile"] != sealed {
+		t.Error("sealed twice")
+	}
+	// the nonce differs for the same value
+	other := bson.M{"profile": profile}
+	if err := e.Apply("db.users", other); err != nil {
+		t.Fatal(err)
+	}
+	if other["profile"].(Sealed).Data == sealed.Data {
+		t.Error("the same value sealed the same twice")
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	e, err := Open(keyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := bson.M{"$set": bson.M{"contacts.3.email": "ada@example.com"}}
+	if err := e.Apply("db.users", doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["$set"].(bson.M)["contacts.3.email"].(Sealed); ok {
+		t.Fatal("sealed before enrolling")
+	}
+	e.Enroll("db.users", "contacts.email")
+	e.Enroll("db.users", "contacts.email")
+	if n := len(e.fields["db.users"]); n != 1 {
+		t.Errorf("enrolled %d paths", n)
+	}
+	if err := e.Apply("db.users", doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["$set"].(bson.M)["contacts.3.email"].(Sealed); !ok {
+		t.Errorf("not sealed once enrolled: %v", doc)
+	}
+}
+
+func TestNilEncryptor(t *testing.T) {
+	e, err := New("", "file:/nonexistent")
+	if err != nil || e != nil {
+		t.Fatalf("no fields gave %v, %v", e, err)
+	}
+	doc := bson.M{"ssn": "kept"}
+	if err := e.Apply("db.users", doc); err != nil || doc["ssn"] != "kept" {
+		t.Errorf("nil encryptor changed %v, %v", doc, err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return "file:" + path
+	}
+	for _, spec := range []string{
+		write("hex", hex.EncodeToString(key)),
+		write("base64", base64.StdEncoding.EncodeToString(key)+"\n"),
+	} {
+		if _, err := Open(spec); err != nil {
+			t.Errorf("%s: %s", spec, err)
+		}
+	}
+	for _, c := range []struct {
+		fields, spec, err string
+	}{
+		{"db.users:ssn", write("short", hex.EncodeToString(key[:16])), "doesn't hold a 32 byte key"},
+		{"db.users:ssn", write("junk", "not a key"), "doesn't hold a 32 byte key"},
+		{"db.users:ssn", "file:" + filepath.Join(dir, "missing"), "no such file"},
+		{"db.users:ssn", "aws:alias/pii", "must be file:<path> or vault:<key name>"},
+		{"ssn", keyFile(t), `field "ssn" must be ns:path`},
+		{"db.users:", keyFile(t), "must be ns:path"},
+	} {
+		if _, err := New(c.fields, c.spec); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s %s: %v, want %q", c.fields, c.spec, err, c.err)
+		}
+	}
+}
+
+func TestVault(t *testing.T) {
+	var path, token string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, token = r.URL.Path, r.Header.Get("X-Vault-Token")
+		if !strings.HasSuffix(r.URL.Path, "/pii") {
+			http.Error(w, "no such key", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{
+			"plaintext":  base64.StdEncoding.EncodeToString(key),
+			"ciphertext": "vault:v1:wrapped",
+		}})
+	}))
+	defer srv.Close()
+	t.Setenv("VAULT_ADDR", srv.URL+"/")
+	t.Setenv("VAULT_TOKEN", "s.token")
+	e, err := New("db.users:ssn", "vault:pii")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v1/transit/datakey/plaintext/pii" || token != "s.token" {
+		t.Errorf("asked %s with token %q", path, token)
+	}
+	doc := bson.M{"ssn": "pii"}
+	if err := e.Apply("db.users", doc); err != nil {
+		t.Fatal(err)
+	}
+	sealed := doc["ssn"].(Sealed)
+	if sealed.Key != "vault:v1:wrapped" {
+		t.Errorf("sealed with key %q, want the wrapped data key", sealed.Key)
+	}
+	if v := unseal(t, e, sealed); v != "pii" {
+		t.Errorf("opened %v", v)
+	}
+
+	if _, err := Open("vault:other"); err == nil || !strings.Contains(err.Error(), "vault datakey other: 400") {
+		t.Errorf("unknown key opened with %v", err)
+	}
+	t.Setenv("VAULT_ADDR", "")
+	if _, err := Open("vault:pii"); err == nil || !strings.Contains(err.Error(), "VAULT_ADDR not set") {
+		t.Errorf("no VAULT_ADDR opened with %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+// Package fieldstats profiles the fields of a namespace's documents as
+// they stream by: how often each is null or missing, about how many
+// distinct values it has, the least and most of its numbers and its most
+// frequent values.
+//
+// Only whole documents are profiled, a field missing from one is missing.
+// Array elements are profiled together, their path marked [].
+package fieldstats
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/hll"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	precision = 12   // of the distinct sketches, 4KB each
+	maxFields = 1000 // paths profiled per namespace, past it counted as Overflow
+	tracked   = 100  // candidates for the most frequent values kept per path
+	shown     = 200  // bytes of a frequent value kept, past it cut
+)
+
+// Collector profiles the documents of a namespace. It's not safe for
+// concurrent use.
+type Collector struct {
+	Namespace string
+	Documents int64
+	Overflow  int64 // values at paths not profiled, past maxFields
+
+	fields map[string]*field
+}
+
+// field is what was seen at a path
+type field struct {
+	values   int64 // times there, null or not
+	nulls    int64
+	objects  int64 // times an object, its fields' slots
+	distinct *hll.Sketch
+	min, max float64
+	numbers  int64
+	top      map[string]*count
+}
+
+// count is a candidate for the most frequent values, counted with space
+// saving: one taking the place of the least counted starts at its count,
+// an upper bound by at most err
+type count struct {
+	value string
+	n     int64
+	err   int64
+}
+
+// New returns the collector of ns, with nothing seen yet
+func New(ns string) *Collector {
+	return &Collector{Namespace: ns, fields: make(map[string]*field)}
+}
+
+// Document profiles a whole document, inserted or replacing another
+func (c *Collector) Document(doc bson.M) {
+	c.Documents++
+	c.object("", doc)
+}
+
+func (c *Collector) object(path string, doc bson.M) {
+	for name, v := range doc {
+		c.value(join(path, name), v)
+	}
+}
+
+func (c *Collector) value(path string, v interface{}) {
+	f := c.fields[path]
+	if f == nil {
+		if len(c.fields) >= maxFields {
+			c.Overflow++
+			return
+		}
+		f = &field{top: make(map[string]*count)}
+		c.fields[path] = f
+	}
+	f.values++
+	switch v := v.(type) {
+	case nil:
+		f.nulls++
+	case bson.M:
+		f.objects++
+		c.object(path, v)
+	case bson.D:
+		f.objects++
+		c.object(path, v.Map())
+	case []interface{}:
+		for _, e := range v {
+			c.value(path+"[]", e)
+		}
+	default:
+		if v == bson.Undefined {
+			f.nulls++
+			return
+		}
+		if n, ok := number(v); ok && !math.IsNaN(n) && !math.IsInf(n, 0) {
+			if f.numbers == 0 || n < f.min {
+				f.min = n
+			}
+			if f.numbers == 0 || n > f.max {
+				f.max = n
+			}
+			f.numbers++
+		}
+		f.add(fmt.Sprintf("%T", v), display(v))
+	}
+}
+
+// add counts a scalar value, shown as text
+func (f *field) add(typ, text string) {
+	if f.distinct == nil {
+		f.distinct, _ = hll.New(precision)
+	}
+	key := typ + ":" + text
+	f.distinct.AddBytes([]byte(key))
+	if c := f.top[key]; c != nil {
+		c.n++
+		return
+	}
+	if len(text) > shown {
+		text = strings.ToValidUTF8(text[:shown], "") + "..."
+	}
+	if len(f.top) < tracked {
+		f.top[key] = &count{value: text, n: 1}
+		return
+	}
+	var least string
+	for k, c := range f.top {
+		if least == "" || c.n < f.top[least].n {
+			least = k
+		}
+	}
+	min := f.top[least].n
+	delete(f.top, least)
+	f.top[key] = &count{value: text, n: min + 1, err: min}
+}
+
+// Value is one of a path's most frequent values
+type Value struct {
+	Value string `bson:"value" json:"value"`
+	Count int64  `bson:"count" json:"count"` // at most Error more than it was seen
+	Error int64  `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// Stats is the profile of a path
+type Stats struct {
+	Path     string   `bson:"path" json:"path"`
+	Count    int64    `bson:"count" json:"count"`        // times there, null or not
+	NullRate float64  `bson:"nullRate" json:"null_rate"` // of the times it could have been there, missing or null
+	Distinct uint64   `bson:"distinct" json:"distinct"`  // estimated, of scalar values
+	Min      *float64 `bson:"min,omitempty" json:"min,omitempty"`
+	Max      *float64 `bson:"max,omitempty" json:"max,omitempty"`
+	Top      []Value  `bson:"top,omitempty" json:"top,omitempty"`
+}
+
+// Stats returns the profile of every path, sorted, with the top most
+// frequent values of each
+func (c *Collector) Stats(top int) []Stats {
+	paths := make([]string, 0, len(c.fields))
+	for path := range c.fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	out := make([]Stats, 0, len(paths))
+	for _, path := range paths {
+		f := c.fields[path]
+		s := Stats{Path: path, Count: f.values}
+		if slots := c.slots(path); slots > 0 {
+			s.NullRate = float64(slots-f.values+f.nulls) / float64(slots)
+		}
+		if f.distinct != nil {
+			s.Distinct = f.distinct.Estimate()
+		}
+		if f.numbers > 0 {
+			min, max := f.min, f.max
+			s.Min, s.Max = &min, &max
+		}
+		s.Top = f.frequent(top)
+		out = append(out, s)
+	}
+	return out
+}
+
+// slots returns how many times path could have been there: every document
+// for the fields of documents, every time their object was there for the
+// fields of others and every element for the elements of arrays
+func (c *Collector) slots(path string) int64 {
+	if n := len(path); n > 2 && path[n-2:] == "[]" {
+		return c.fields[path].values
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '.' {
+			if parent := c.fields[path[:i]]; parent != nil {
+				return parent.objects
+			}
+			return 0
+		}
+	}
+	return c.Documents
+}
+
+// frequent returns the n most frequent values, by count then value, of
+// those surely seen more than once
+func (f *field) frequent(n int) []Value {
+	list := make([]Value, 0, len(f.top))
+	for _, c := range f.top {
+		if c.n-c.err > 1 {
+			list = append(list, Value{Value: c.value, Count: c.n, Error: c.err})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Value < list[j].Value
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// display returns a scalar value as text
+func display(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bson.ObjectId:
+		return v.Hex()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// number returns a numeric value as a float64
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
@@ -0,0 +1,167 @@
+package fieldstats
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// byPath returns the stats of c by path
+func byPath(c *Collector, top int) map[string]Stats {
+	m := map[string]Stats{}
+	for _, s := range c.Stats(top) {
+		m[s.Path] = s
+	}
+	return m
+}
+
+func TestCollector(t *testing.T) {
+	c := New("app.users")
+	c.Document(bson.M{"_id": 1, "name": "ada", "age": 36, "addr": bson.M{"city": "london", "zip": nil}, "tags": []interface{}{"a", "b"}})
+	c.Document(bson.M{"_id": 2, "name": "bob", "age": 41.5, "addr": bson.D{{Name: "city", Value: "paris"}}, "tags": []interface{}{"a", nil}})
+	c.Document(bson.M{"_id": 3, "name": nil, "addr": "unknown", "tags": []interface{}{}})
+	c.Document(bson.M{"_id": 4, "name": "ada", "age": bson.Undefined})
+	stats := byPath(c, 5)
+
+	var paths []string
+	for _, s := range c.Stats(5) {
+		paths = append(paths, s.Path)
+	}
+	if want := []string{"_id", "addr", "addr.city", "addr.zip", "age", "name", "tags", "tags[]"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths %v, want %v", paths, want)
+	}
+	for _, c := range []struct {
+		path     string
+		count    int64
+		nullRate float64
+	}{
+		{"_id", 4, 0},
+		{"name", 4, 0.25},
+		{"age", 3, 0.5},     // missing once, undefined once
+		{"addr", 3, 0.25},   // an object twice, a string once
+		{"addr.city", 2, 0}, // of the two objects
+		{"addr.zip", 1, 1},  // null once, missing once
+		{"tags", 3, 0.25},   // arrays, counted as there
+		{"tags[]", 4, 0.25}, // of the elements
+	} {
+		s := stats[c.path]
+		if s.Count != c.count || math.Abs(s.NullRate-c.nullRate) > 1e-9 {
+			t.Errorf("%s: count %d, null rate %g, want %d, %g", c.path, s.Count, s.NullRate, c.count, c.nullRate)
+		}
+	}
+	if s := stats["age"]; s.Min == nil || *s.Min != 36 || *s.Max != 41.5 {
+		t.Errorf("age range %v to %v", s.Min, s.Max)
+	}
+	if s := stats["name"]; s.Min != nil || s.Distinct != 2 {
+		t.Errorf("name: min %v, %d distinct", s.Min, s.Distinct)
+	}
+	if got := stats["name"].Top; !reflect.DeepEqual(got, []Value{{Value: "ada", Count: 2}}) {
+		t.Errorf("name's top %v, want ada twice, values seen once left out", got)
+	}
+	if got := stats["tags[]"].Top; !reflect.DeepEqual(got, []Value{{Value: "a", Count: 2}}) {
+		t.Errorf("tags' top %v", got)
+	}
+}
+
+func TestDistinctByType(t *testing.T) {
+	c := New("app.t")
+	for _, v := range []interface{}{1, "1", int64(1), 1.0, 1} {
+		c.Document(bson.M{"v": v})
+	}
+	if d := byPath(c, 5)["v"].Distinct; d != 4 {
+		t.Errorf("%d distinct, want 4 of int, string, int64 and float64", d)
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	id := bson.ObjectIdHex("5f1d7a9e8b3c4d2e1f0a9b8c")
+	at := time.Date(2024, 5, 1, 12, 0, 0, 500, time.FixedZone("x", 3600))
+	dec, _ := bson.ParseDecimal128("12.50")
+	for _, c := range []struct {
+		v    interface{}
+		want string
+	}{
+		{"text", "text"},
+		{id, "5f1d7a9e8b3c4d2e1f0a9b8c"},
+		{at, "2024-05-01T11:00:00.0000005Z"},
+		{0.1, "0.1"},
+		{1e21, "1e+21"},
+		{[]byte{0xde, 0xad}, "dead"},
+		{true, "true"},
+		{dec, "12.50"},
+	} {
+		if got := display(c.v); got != c.want {
+			t.Errorf("%#v displayed %s, want %s", c.v, got, c.want)
+		}
+	}
+	if n, ok := number(dec); !ok || n != 12.5 {
+		t.Errorf("decimal as a number: %g %v", n, ok)
+	}
+	if _, ok := number("12"); ok {
+		t.Error("a string taken as a number")
+	}
+}
+
+func TestNumbersSkipNaN(t *testing.T) {
+	c := New("app.t")
+	for _, v := range []interface{}{math.NaN(), 3, math.Inf(1), -2} {
+		c.Document(bson.M{"v": v})
+	}
+	if s := byPath(c, 5)["v"]; s.Min == nil || *s.Min != -2 || *s.Max != 3 {
+		t.Errorf("range %v to %v, want -2 to 3", s.Min, s.Max)
+	}
+}
+
+func TestTopSpaceSaving(t *testing.T) {
+	c := New("app.t")
+	// a frequent value among many seen once, past what's tracked
+	for i := 0; i < 1000; i++ {
+		c.Document(bson.M{"v": fmt.Sprint("rare-", i)})
+		if i%10 == 0 {
+			c.Document(bson.M{"v": "common"})
+		}
+	}
+	top := byPath(c, 3)["v"].Top
+	if len(top) == 0 || top[0].Value != "common" || top[0].Count-top[0].Error > 100 || top[0].Count < 100 {
+		t.Errorf("top %v, want common about 100 times", top)
+	}
+	for _, v := range top {
+		if strings.HasPrefix(v.Value, "rare-") && v.Count-v.Error > 1 {
+			t.Errorf("%s surely seen %d times", v.Value, v.Count-v.Error)
+		}
+	}
+	if f := c.fields["v"]; len(f.top) > tracked {
+		t.Errorf("%d candidates tracked, at most %d", len(f.top), tracked)
+	}
+}
+
+func TestLongValuesCut(t *testing.T) {
+	c := New("app.t")
+	long := strings.Repeat("é", shown) // 2 bytes each
+	c.Document(bson.M{"v": long})
+	c.Document(bson.M{"v": long})
+	top := byPath(c, 1)["v"].Top
+	if len(top) != 1 || len(top[0].Value) > shown+3 || !strings.HasSuffix(top[0].Value, "...") {
+		t.Fatalf("top %v", top)
+	}
+	if v := strings.TrimSuffix(top[0].Value, "..."); !strings.HasPrefix(long, v) {
+		t.Errorf("cut mid-character: %q", v)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	c := New("app.wide")
+	doc := bson.M{}
+	for i := 0; i < maxFields+10; i++ {
+		doc[fmt.Sprint("f", i)] = i
+	}
+	c.Document(doc)
+	if len(c.Stats(0)) != maxFields || c.Overflow != 10 {
+		t.Errorf("%d paths profiled, %d overflowing", len(c.Stats(0)), c.Overflow)
+	}
+}
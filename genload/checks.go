@@ -0,0 +1,12 @@
+package genload
+
+import (
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		return []cli.Check{{Name: "MONGO_URL", Run: func() error { return dial.Probe(*mongoURL, privileges()...) }}}
+	})
+}
@@ -0,0 +1,320 @@
+// Package genload writes synthetic traffic to benchmark and demo the pipeline, the oplogctl genload command.
+package genload
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("genload", "write synthetic inserts, updates, deletes and metrics.raw datapoints at a steady rate")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL    = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url to write to")
+	rate        = flags.Float64("RATE", 100, "inserts, updates and deletes per second, across NAMESPACES")
+	db          = flags.String("DB", "genload", "database the namespaces written are in")
+	namespaces  = flags.Int("NAMESPACES", 4, "collections written, c0, c1 and so on")
+	mix         = flags.String("MIX", "insert=60,update=30,delete=10", "weights of the operations written, deletes and updates of collections still empty being inserts")
+	values      = flags.String("VALUES", "normal:100,15", "distribution of the values written, to documents and datapoints: normal:mean,stddev, lognormal:mu,sigma, exponential:mean or uniform:min,max")
+	metricKeys  = flags.Int("METRIC_KEYS", 0, "keys datapoints are appended to in metrics.raw under genload., as stats reads them, 0 for none")
+	metricRate  = flags.Float64("METRIC_RATE", 100, "datapoints per second appended to metrics.raw, across METRIC_KEYS")
+	duration    = flags.Duration("DURATION", 0, "stop after writing this long, 0 to write on")
+	seed        = flags.Int64("SEED", 0, "seed of the traffic, 0 for a random one; the same seed draws the same operations and values in the same order")
+	reportEvery = flags.Duration("REPORT", 10*time.Second, "how often what was written is printed to stderr")
+)
+
+// tick is how often due writes are sent, in bulks
+const tick = 100 * time.Millisecond
+
+// distribution draws values
+type distribution func(r *rand.Rand) float64
+
+// parseDistribution reads VALUES
+func parseDistribution(s string) (distribution, error) {
+	parts := strings.SplitN(s, ":", 2)
+	var params []float64
+	if len(parts) == 2 {
+		for _, p := range strings.Split(parts[1], ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, cli.Invalidf("VALUES %q: parameter %q isn't a number", s, p)
+			}
+			params = append(params, v)
+		}
+	}
+	want := map[string]int{"normal": 2, "lognormal": 2, "exponential": 1, "uniform": 2}
+	n, ok := want[parts[0]]
+	if !ok {
+		return nil, cli.Invalidf("VALUES %q: normal, lognormal, exponential or uniform", s)
+	}
+	if len(params) != n {
+		return nil, cli.Invalidf("VALUES %q: %s takes %d parameters", s, parts[0], n)
+	}
+	switch parts[0] {
+	case "normal":
+		return func(r *rand.Rand) float64 { return params[0] + r.NormFloat64()*params[1] }, nil
+	case "lognormal":
+		return func(r *rand.Rand) float64 { return math.Exp(params[0] + r.NormFloat64()*params[1]) }, nil
+	case "exponential":
+		return func(r *rand.Rand) float64 { return r.ExpFloat64() * params[0] }, nil
+	}
+	return func(r *rand.Rand) float64 { return params[0] + r.Float64()*(params[1]-params[0]) }, nil
+}
+
+// weights of insert, update and delete, summing to 1
+type weights [3]float64
+
+var opNames = []string{"insert", "update", "delete"}
+
+func parseMix(s string) (weights, error) {
+	var w weights
+	var total float64
+	var seen [3]bool
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		i := -1
+		for j, name := range opNames {
+			if kv[0] == name {
+				i = j
+			}
+		}
+		if len(kv) != 2 || i < 0 {
+			return w, cli.Invalidf("MIX must be op=weight pairs of insert, update and delete, got %q", pair)
+		}
+		if seen[i] {
+			return w, cli.Invalidf("MIX weighs %s twice", kv[0])
+		}
+		seen[i] = true
+		v, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || v < 0 {
+			return w, cli.Invalidf("MIX: %s's weight %q must be a positive number", kv[0], kv[1])
+		}
+		w[i] = v
+		total += v
+	}
+	if total == 0 {
+		return w, cli.Invalidf("MIX weighs nothing")
+	}
+	for i := range w {
+		w[i] /= total
+	}
+	return w, nil
+}
+
+// pick returns the index of an operation drawn by w
+func (w weights) pick(r *rand.Rand) int {
+	x := r.Float64()
+	for i, p := range w {
+		if x < p {
+			return i
+		}
+		x -= p
+	}
+	return 0
+}
+
+// generator writes the traffic, keeping the ids of the documents it
+// inserted per collection to update and delete them
+type generator struct {
+	r      *rand.Rand
+	mix    weights
+	values distribution
+	ids    [][]bson.ObjectId
+	seq    int64
+
+	ops        [3]int64 // written since the last report, by operation
+	datapoints int64
+}
+
+// doc returns the next document inserted
+func (g *generator) doc() bson.M {
+	g.seq++
+	id := bson.NewObjectId()
+	return bson.M{
+		"_id":     id,
+		"seq":     g.seq,
+		"value":   g.values(g.r),
+		"tags":    []string{"genload", "group" + strconv.FormatInt(g.seq%10, 10)},
+		"created": time.Now(),
+		"version": 1,
+	}
+}
+
+// write sends n operations, in a bulk per collection they're drawn for
+func (g *generator) write(sess *mgo.Session, n int) error {
+	bulks := make([]*mgo.Bulk, len(g.ids))
+	for ; n > 0; n-- {
+		c := g.r.Intn(len(g.ids))
+		if bulks[c] == nil {
+			bulks[c] = sess.DB(*db).C(fmt.Sprintf("c%d", c)).Bulk()
+		}
+		op := g.mix.pick(g.r)
+		if len(g.ids[c]) == 0 {
+			op = 0
+		}
+		switch op {
+		case 0:
+			doc := g.doc()
+			bulks[c].Insert(doc)
+			g.ids[c] = append(g.ids[c], doc["_id"].(bson.ObjectId))
+		case 1:
+			id := g.ids[c][g.r.Intn(len(g.ids[c]))]
+			bulks[c].Update(bson.M{"_id": id}, bson.M{
+				"$set": bson.M{"value": g.values(g.r), "updated": time.Now()},
+				"$inc": bson.M{"version": 1},
+			})
+		case 2:
+			i := g.r.Intn(len(g.ids[c]))
+			bulks[c].Remove(bson.M{"_id": g.ids[c][i]})
+			last := len(g.ids[c]) - 1
+			g.ids[c][i] = g.ids[c][last]
+			g.ids[c] = g.ids[c][:last]
+		}
+		g.ops[op]++
+	}
+	for _, b := range bulks {
+		if b == nil {
+			continue
+		}
+		if _, err := b.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendDatapoints appends n datapoints to the raw hour buckets of the
+// keys they're drawn for, as the notes' time series are laid out
+func (g *generator) appendDatapoints(sess *mgo.Session, n int) error {
+	if n == 0 {
+		return nil
+	}
+	now := time.Now()
+	hour := now.Truncate(time.Hour).UnixNano() / int64(time.Millisecond)
+	points := make(map[string][]bson.M)
+	for ; n > 0; n-- {
+		key := fmt.Sprintf("genload.metric%d", g.r.Intn(*metricKeys))
+		points[key] = append(points[key], bson.M{"at": now, "value": g.values(g.r)})
+	}
+	bulk := sess.DB("metrics").C("raw").Bulk()
+	bulk.Unordered()
+	for key, values := range points {
+		bulk.Upsert(bson.M{"key": key, "at": hour}, bson.M{"$push": bson.M{"values": bson.M{"$each": values}}})
+		g.datapoints += int64(len(values))
+	}
+	_, err := bulk.Run()
+	return err
+}
+
+// report prints what was written since the last one, over elapsed
+func (g *generator) report(elapsed time.Duration) {
+	total := g.ops[0] + g.ops[1] + g.ops[2]
+	fmt.Fprintf(os.Stderr, "genload: %.0f ops/s (%d inserts, %d updates, %d deletes), %.0f datapoints/s\n",
+		float64(total)/elapsed.Seconds(), g.ops[0], g.ops[1], g.ops[2], float64(g.datapoints)/elapsed.Seconds())
+	g.ops, g.datapoints = [3]int64{}, 0
+}
+
+// due returns how many of what's written at perSecond are due after
+// elapsed, sent of them being written already
+func due(perSecond float64, elapsed time.Duration, sent int64) int {
+	return int(int64(perSecond*elapsed.Seconds()) - sent)
+}
+
+// Main runs oplogctl genload, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *rate < 0 || *metricRate < 0 {
+		panic(cli.Invalidf("RATE and METRIC_RATE must not be negative"))
+	}
+	if *namespaces < 1 {
+		panic(cli.Invalidf("NAMESPACES must be at least 1"))
+	}
+	if *metricKeys < 0 {
+		panic(cli.Invalidf("METRIC_KEYS must not be negative"))
+	}
+	if *reportEvery <= 0 {
+		panic(cli.Invalidf("REPORT must be positive"))
+	}
+	w, err := parseMix(*mix)
+	if err != nil {
+		panic(err)
+	}
+	dist, err := parseDistribution(*values)
+	if err != nil {
+		panic(err)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+		fmt.Fprintf(os.Stderr, "genload: SEED=%d\n", *seed)
+	}
+
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	if err := dial.CheckPrivileges(sess, privileges()...); err != nil {
+		panic(err)
+	}
+
+	g := &generator{r: rand.New(rand.NewSource(*seed)), mix: w, values: dist, ids: make([][]bson.ObjectId, *namespaces)}
+	start := time.Now()
+	var ended <-chan time.Time
+	if *duration > 0 {
+		ended = time.After(*duration)
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	var sent, sentPoints int64
+	lastReport := start
+	for {
+		select {
+		case <-ended:
+			g.report(time.Since(lastReport))
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(start)
+			n := due(*rate, elapsed, sent)
+			if err := g.write(sess, n); err != nil {
+				panic(err)
+			}
+			sent += int64(n)
+			if *metricKeys > 0 {
+				n := due(*metricRate, elapsed, sentPoints)
+				if err := g.appendDatapoints(sess, n); err != nil {
+					panic(err)
+				}
+				sentPoints += int64(n)
+			}
+			if now.Sub(lastReport) >= *reportEvery {
+				g.report(now.Sub(lastReport))
+				lastReport = now
+			}
+		}
+	}
+}
+
+// privileges are what genload writes with
+func privileges() []dial.Privilege {
+	var needed []dial.Privilege
+	for c := 0; c < *namespaces; c++ {
+		needed = append(needed, dial.Privilege{DB: *db, Collection: fmt.Sprintf("c%d", c), Actions: []string{"insert", "update", "remove"}})
+	}
+	if *metricKeys > 0 {
+		needed = append(needed, dial.Privilege{DB: "metrics", Collection: "raw", Actions: []string{"insert", "update"}})
+	}
+	return needed
+}
@@ -0,0 +1,181 @@
+package genload
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mean draws n values of d
+func mean(d distribution, n int) float64 {
+	r := rand.New(rand.NewSource(1))
+	sum := 0.0
+	for i := 0; i < n; i++ {
+		sum += d(r)
+	}
+	return sum / float64(n)
+}
+
+func TestParseDistribution(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		mean float64
+	}{
+		{"normal:100,15", 100},
+		{"lognormal:0, 0.5", math.Exp(0.125)},
+		{"exponential:20", 20},
+		{"uniform:10,30", 20},
+	} {
+		d, err := parseDistribution(c.s)
+		if err != nil {
+			t.Errorf("%s: %s", c.s, err)
+			continue
+		}
+		if m := mean(d, 100000); math.Abs(m-c.mean) > 0.02*c.mean {
+			t.Errorf("%s: mean %g, want %g", c.s, m, c.mean)
+		}
+	}
+	d, _ := parseDistribution("uniform:10,30")
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 1000; i++ {
+		if v := d(r); v < 10 || v >= 30 {
+			t.Fatalf("uniform:10,30 drew %g", v)
+		}
+	}
+	for _, s := range []string{"", "normal", "normal:1", "normal:1,x", "poisson:3", "exponential:1,2"} {
+		if _, err := parseDistribution(s); err == nil {
+			t.Errorf("%q taken", s)
+		}
+	}
+}
+
+func TestParseMix(t *testing.T) {
+	w, err := parseMix("insert=60, update=30,delete=10")
+	if err != nil || w != (weights{0.6, 0.3, 0.1}) {
+		t.Errorf("%v, %v", w, err)
+	}
+	if w, err := parseMix("update=1"); err != nil || w != (weights{0, 1, 0}) {
+		t.Errorf("updates alone: %v, %v", w, err)
+	}
+	for _, s := range []string{"", "insert", "upsert=1", "insert=-1", "insert=x", "insert=0,delete=0", "insert=1,insert=2"} {
+		if _, err := parseMix(s); err == nil {
+			t.Errorf("%q taken", s)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	w, _ := parseMix("insert=60,update=30,delete=10")
+	r := rand.New(rand.NewSource(3))
+	var n [3]int
+	for i := 0; i < 100000; i++ {
+		n[w.pick(r)]++
+	}
+	for i, want := range w {
+		if got := float64(n[i]) / 100000; math.Abs(got-want) > 0.01 {
+			t.Errorf("%s picked %g of the time, want %g", opNames[i], got, want)
+		}
+	}
+	if (weights{0, 0, 1}).pick(r) != 2 {
+		t.Error("deletes alone, something else picked")
+	}
+}
+
+func TestDue(t *testing.T) {
+	for _, c := range []struct {
+		perSecond float64
+		elapsed   time.Duration
+		sent      int64
+		want      int
+	}{
+		{100, time.Second, 0, 100},
+		{100, 1500 * time.Millisecond, 100, 50},
+		{0.5, 3 * time.Second, 1, 0}, // 1.5 due, one sent
+		{0.5, 4 * time.Second, 1, 1},
+		{100, 0, 0, 0},
+	} {
+		if got := due(c.perSecond, c.elapsed, c.sent); got != c.want {
+			t.Errorf("%g/s after %s, %d sent: %d due, want %d", c.perSecond, c.elapsed, c.sent, got, c.want)
+		}
+	}
+}
+
+func TestPrivileges(t *testing.T) {
+	defer func(d string, n, k int) { *db, *namespaces, *metricKeys = d, n, k }(*db, *namespaces, *metricKeys)
+	*db, *namespaces, *metricKeys = "load", 2, 0
+	p := privileges()
+	if len(p) != 2 || p[0].DB != "load" || p[0].Collection != "c0" || p[1].Collection != "c1" {
+		t.Errorf("%+v", p)
+	}
+	*metricKeys = 3
+	if p := privileges(); len(p) != 3 || p[2].DB != "metrics" || p[2].Collection != "raw" {
+		t.Errorf("with METRIC_KEYS: %+v", p)
+	}
+}
+
+func TestDoc(t *testing.T) {
+	d, _ := parseDistribution("uniform:1,2")
+	g := &generator{r: rand.New(rand.NewSource(1)), values: d}
+	a, b := g.doc(), g.doc()
+	if a["seq"] != int64(1) || b["seq"] != int64(2) || a["_id"] == b["_id"] {
+		t.Errorf("%v then %v", a, b)
+	}
+	if tags := b["tags"].([]string); tags[1] != "group2" {
+		t.Errorf("tags %v", tags)
+	}
+}
+
+// TestWrite writes a seeded mix and datapoints. It needs mongodb at
+// MONGO_URL, and is skipped without one.
+func TestWrite(t *testing.T) {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("no mongodb, MONGO_URL is empty")
+	}
+	sess, err := mgo.DialWithTimeout(url, 2*time.Second)
+	if err != nil {
+		t.Skipf("no mongodb at MONGO_URL: %s", err)
+	}
+	defer sess.Close()
+	defer func(d string, k int) { *db, *metricKeys = d, k }(*db, *metricKeys)
+	*db, *metricKeys = "genload_test", 2
+	sess.DB(*db).DropDatabase()
+	defer sess.DB(*db).DropDatabase()
+	defer sess.DB("metrics").C("raw").RemoveAll(bson.M{"key": bson.RegEx{Pattern: "^genload\\."}})
+
+	w, _ := parseMix("insert=50,update=25,delete=25")
+	d, _ := parseDistribution("normal:100,15")
+	g := &generator{r: rand.New(rand.NewSource(7)), mix: w, values: d, ids: make([][]bson.ObjectId, 2)}
+	if err := g.write(sess, 500); err != nil {
+		t.Fatal(err)
+	}
+	if total := g.ops[0] + g.ops[1] + g.ops[2]; total != 500 {
+		t.Errorf("%d ops counted", total)
+	}
+	for c := range g.ids {
+		n, err := sess.DB(*db).C(fmt.Sprintf("c%d", c)).Count()
+		if err != nil || n != len(g.ids[c]) {
+			t.Errorf("c%d holds %d, %d ids kept", c, n, len(g.ids[c]))
+		}
+	}
+	if err := g.appendDatapoints(sess, 40); err != nil || g.datapoints != 40 {
+		t.Errorf("%d datapoints, %v", g.datapoints, err)
+	}
+	var buckets []struct {
+		Values []interface{} `bson:"values"`
+	}
+	sess.DB("metrics").C("raw").Find(bson.M{"key": bson.RegEx{Pattern: "^genload\\."}}).All(&buckets)
+	n := 0
+	for _, b := range buckets {
+		n += len(b.Values)
+	}
+	if n != 40 {
+		t.Errorf("%d datapoints appended", n)
+	}
+}
@@ -0,0 +1,390 @@
+// Package gql parses the GraphQL operations the tools serve: one operation
+// of fields with arguments and selections, no fragments or directives.
+// Arguments are resolved against the variables on parsing, so what's
+// returned is plain values: strings, float64s, int64s, bools, nil, slices
+// and maps of these.
+package gql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operation is a parsed query, mutation or subscription
+type Operation struct {
+	Kind   string // query, mutation or subscription
+	Name   string
+	Fields []Field
+}
+
+// Field is a selected field
+type Field struct {
+	Alias     string // the name it's answered under, Name if not aliased
+	Name      string
+	Args      map[string]interface{}
+	Selection []Field
+}
+
+// Parse parses the single operation of query, its variables given
+func Parse(query string, variables map[string]interface{}) (*Operation, error) {
+	p := &parser{lex: lexer{src: strings.TrimPrefix(query, "\ufeff")}, vars: variables}
+	p.next()
+	op, err := p.operation()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != eof {
+		return nil, p.errorf("one operation only, no fragments")
+	}
+	return op, nil
+}
+
+type kind int
+
+const (
+	eof kind = iota
+	punct
+	name
+	str
+	number
+)
+
+type token struct {
+	kind kind
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+// token reads the next token, the text of strings unescaped
+func (l *lexer) token() (token, error) {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		default:
+			return l.read()
+		}
+	}
+	return token{kind: eof, pos: l.pos}, nil
+}
+
+func (l *lexer) read() (token, error) {
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		return token{}, fmt.Errorf("at %d: fragments aren't supported", start)
+	case strings.IndexByte("{}()[]:$!=@", c) >= 0:
+		l.pos++
+		return token{punct, string(c), start}, nil
+	case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		for l.pos < len(l.src) && isNameChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{name, l.src[start:l.pos], start}, nil
+	case c == '-' || c >= '0' && c <= '9':
+		l.pos++
+		for l.pos < len(l.src) && strings.IndexByte("0123456789.eE+-", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		return token{number, l.src[start:l.pos], start}, nil
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			end := strings.Index(l.src[l.pos+3:], `"""`)
+			if end < 0 {
+				return token{}, fmt.Errorf("at %d: unterminated block string", start)
+			}
+			l.pos += 3 + end + 3
+			return token{str, l.src[start+3 : l.pos-3], start}, nil
+		}
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' && l.src[l.pos] != '\n' {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) || l.src[l.pos] != '"' {
+			return token{}, fmt.Errorf("at %d: unterminated string", start)
+		}
+		l.pos++
+		s, err := strconv.Unquote(l.src[start:l.pos])
+		if err != nil {
+			return token{}, fmt.Errorf("at %d: invalid string", start)
+		}
+		return token{str, s, start}, nil
+	}
+	return token{}, fmt.Errorf("at %d: unexpected %q", start, c)
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+type parser struct {
+	lex  lexer
+	tok  token
+	err  error
+	vars map[string]interface{}
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.token()
+	if p.err != nil {
+		p.tok = token{kind: eof, pos: p.lex.pos}
+	}
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("at %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+// is reports whether the token is the punctuator s
+func (p *parser) is(s string) bool {
+	return p.tok.kind == punct && p.tok.text == s
+}
+
+func (p *parser) expect(s string) error {
+	if !p.is(s) {
+		return p.errorf("expected %s", s)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != name {
+		return "", p.errorf("expected a name")
+	}
+	n := p.tok.text
+	p.next()
+	return n, nil
+}
+
+func (p *parser) operation() (*Operation, error) {
+	op := &Operation{Kind: "query"}
+	if p.tok.kind == name {
+		switch p.tok.text {
+		case "query", "mutation", "subscription":
+		default:
+			return nil, p.errorf("unknown operation %s", p.tok.text)
+		}
+		op.Kind = p.tok.text
+		p.next()
+		if p.tok.kind == name {
+			op.Name = p.tok.text
+			p.next()
+		}
+		if p.is("(") {
+			if err := p.variableDefinitions(); err != nil {
+				return nil, err
+			}
+		}
+		if p.is("@") {
+			return nil, p.errorf("directives aren't supported")
+		}
+	}
+	fields, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.Fields = fields
+	return op, nil
+}
+
+// variableDefinitions skips the definitions, the variables given being
+// taken as they are, filling in the defaults of those missing
+func (p *parser) variableDefinitions() error {
+	p.next()
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		v, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if p.is("=") {
+			p.next()
+			def, err := p.value()
+			if err != nil {
+				return err
+			}
+			if _, ok := p.vars[v]; !ok {
+				if p.vars == nil {
+					p.vars = make(map[string]interface{})
+				}
+				p.vars[v] = def
+			}
+		}
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) skipType() error {
+	if p.is("[") {
+		p.next()
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.is("!") {
+		p.next()
+	}
+	return nil
+}
+
+func (p *parser) selectionSet() ([]Field, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []Field
+	for !p.is("}") {
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	p.next()
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection")
+	}
+	return fields, nil
+}
+
+func (p *parser) field() (Field, error) {
+	n, err := p.name()
+	if err != nil {
+		return Field{}, err
+	}
+	f := Field{Alias: n, Name: n}
+	if p.is(":") {
+		p.next()
+		if f.Name, err = p.name(); err != nil {
+			return Field{}, err
+		}
+	}
+	if p.is("(") {
+		p.next()
+		f.Args = make(map[string]interface{})
+		for !p.is(")") {
+			arg, err := p.name()
+			if err != nil {
+				return Field{}, err
+			}
+			if err := p.expect(":"); err != nil {
+				return Field{}, err
+			}
+			if f.Args[arg], err = p.value(); err != nil {
+				return Field{}, err
+			}
+		}
+		p.next()
+	}
+	if p.is("@") {
+		return Field{}, p.errorf("directives aren't supported")
+	}
+	if p.is("{") {
+		if f.Selection, err = p.selectionSet(); err != nil {
+			return Field{}, err
+		}
+	}
+	return f, nil
+}
+
+func (p *parser) value() (interface{}, error) {
+	t := p.tok
+	switch {
+	case p.is("$"):
+		p.next()
+		v, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return p.vars[v], nil
+	case p.is("["):
+		p.next()
+		list := []interface{}{}
+		for !p.is("]") {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.next()
+		return list, nil
+	case p.is("{"):
+		p.next()
+		obj := make(map[string]interface{})
+		for !p.is("}") {
+			k, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[k], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return obj, nil
+	case t.kind == str:
+		p.next()
+		return t.text, nil
+	case t.kind == number:
+		p.next()
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: invalid number %s", t.pos, t.text)
+		}
+		return f, nil
+	case t.kind == name:
+		p.next()
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return t.text, nil // an enum value
+	}
+	return nil, p.errorf("expected a value")
+}
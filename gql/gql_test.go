@@ -0,0 +1,126 @@
+package gql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		query string
+		vars  map[string]interface{}
+		want  *Operation
+	}{
+		{
+			name:  "shorthand query",
+			query: "{ a b }",
+			want:  &Operation{Kind: "query", Fields: []Field{{Alias: "a", Name: "a"}, {Alias: "b", Name: "b"}}},
+		},
+		{
+			name: "subscription with arguments",
+			query: `subscription Orders {
+				paid: documentChanged(namespace: "app.orders", filter: {status: "paid", total: 12.5, n: -3, ok: true, none: null, tags: ["a" "b"]}) {
+					operation id # and a comment
+				}
+			}`,
+			want: &Operation{Kind: "subscription", Name: "Orders", Fields: []Field{{
+				Alias: "paid", Name: "documentChanged",
+				Args: map[string]interface{}{
+					"namespace": "app.orders",
+					"filter": map[string]interface{}{
+						"status": "paid", "total": 12.5, "n": int64(-3), "ok": true, "none": nil,
+						"tags": []interface{}{"a", "b"},
+					},
+				},
+				Selection: []Field{{Alias: "operation", Name: "operation"}, {Alias: "id", Name: "id"}},
+			}}},
+		},
+		{
+			name:  "variables",
+			query: `subscription ($ns: String!, $filter: JSON, $limit: [Int!] = [10]) { documentChanged(namespace: $ns, filter: $filter, limit: $limit) { id } }`,
+			vars:  map[string]interface{}{"ns": "app.users", "filter": map[string]interface{}{"_id": 7.0}},
+			want: &Operation{Kind: "subscription", Fields: []Field{{
+				Alias: "documentChanged", Name: "documentChanged",
+				Args: map[string]interface{}{
+					"namespace": "app.users",
+					"filter":    map[string]interface{}{"_id": 7.0},
+					"limit":     []interface{}{int64(10)}, // the default of one not given
+				},
+				Selection: []Field{{Alias: "id", Name: "id"}},
+			}}},
+		},
+		{
+			name:  "strings",
+			query: "{ f(a: \"tab\\there \\u00e9\", b: \"\"\"block \"quoted\" text\"\"\") }",
+			want: &Operation{Kind: "query", Fields: []Field{{
+				Alias: "f", Name: "f", Args: map[string]interface{}{"a": "tab\there é", "b": `block "quoted" text`},
+			}}},
+		},
+		{
+			name:  "enum value",
+			query: "{ f(op: INSERT) }",
+			want:  &Operation{Kind: "query", Fields: []Field{{Alias: "f", Name: "f", Args: map[string]interface{}{"op": "INSERT"}}}},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Parse(c.query, c.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got  %#v\nwant %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseVariableGiven(t *testing.T) {
+	op, err := Parse(`query ($n: Int = 1) { f(n: $n, m: $missing) }`, map[string]interface{}{"n": 2.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := op.Fields[0].Args
+	if args["n"] != 2.0 {
+		t.Errorf("n = %v, want the variable given over the default", args["n"])
+	}
+	if v, ok := args["m"]; !ok || v != nil {
+		t.Errorf("an undefined variable is %v, want null", v)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		err   string
+	}{
+		{"", "expected {"},
+		{"{ }", "empty selection"},
+		{"{ a", "expected a name"},
+		{"fetch { a }", "unknown operation fetch"},
+		{"{ a } { b }", "one operation only"},
+		{"{ ...frag }", "fragments aren't supported"},
+		{"query @live { a }", "directives aren't supported"},
+		{"{ a @skip(if: true) }", "directives aren't supported"},
+		{`{ a(s: "open) }`, "unterminated string"},
+		{`{ a(s: """open) }`, "unterminated block string"},
+		{`{ a(s: "\q") }`, "invalid string"},
+		{"{ a(n: 1.2.3) }", "invalid number"},
+		{"{ a(n: ) }", "expected a value"},
+		{"{ a(n 1) }", "expected :"},
+		{"query ($n Int) { a }", "expected :"},
+		{"{ a; }", "unexpected ';'"},
+	} {
+		if _, err := Parse(c.query, nil); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q parsed with %v, want %q", c.query, err, c.err)
+		}
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	_, err := Parse("{ a(n: ) }", nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "at 7:") {
+		t.Errorf("error %v, want it at 7, the )", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Package hll estimates how many distinct values were seen with
+// HyperLogLog, in 2^precision bytes however many there are: about
+// 1.04/sqrt(2^precision) off, 1.6% at 12.
+package hll
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Sketch is the values seen, by their hashes
+type Sketch struct {
+	p         uint8
+	registers []uint8 // allocated on the first value
+}
+
+// New returns an empty sketch of 2^precision registers, precision being
+// from 4 to 16
+func New(precision uint8) (*Sketch, error) {
+	if precision < 4 || precision > 16 {
+		return nil, fmt.Errorf("hll precision %d must be from 4 to 16", precision)
+	}
+	return &Sketch{p: precision}, nil
+}
+
+// Add adds a value by its hash, which must be evenly distributed
+func (s *Sketch) Add(hash uint64) {
+	if s.registers == nil {
+		s.registers = make([]uint8, 1<<s.p)
+	}
+	i := hash >> (64 - s.p)
+	rho := uint8(bits.LeadingZeros64(hash<<s.p|1<<(s.p-1))) + 1
+	if rho > s.registers[i] {
+		s.registers[i] = rho
+	}
+}
+
+// AddBytes adds a value by its bytes
+func (s *Sketch) AddBytes(b []byte) {
+	h := fnv.New64a()
+	h.Write(b)
+	s.Add(mix(h.Sum64()))
+}
+
+// mix spreads fnv's bits over the whole word, splitmix64's finalizer
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// Merge adds the values of o, which must be of the same precision
+func (s *Sketch) Merge(o *Sketch) error {
+	if o.p != s.p {
+		return fmt.Errorf("can't merge a sketch of precision %d into one of %d", o.p, s.p)
+	}
+	if o.registers == nil {
+		return nil
+	}
+	if s.registers == nil {
+		s.registers = make([]uint8, 1<<s.p)
+	}
+	for i, r := range o.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Estimate returns about how many distinct values were added
+func (s *Sketch) Estimate() uint64 {
+	if s.registers == nil {
+		return 0
+	}
+	m := float64(len(s.registers))
+	var sum float64
+	zeros := 0
+	for _, r := range s.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := alpha(len(s.registers)) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros)) // linear counting, better while few
+	}
+	return uint64(e + 0.5)
+}
+
+// alpha corrects the bias of m registers' harmonic mean
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
@@ -0,0 +1,84 @@
+package hll
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	for _, p := range []uint8{0, 3, 17} {
+		if _, err := New(p); err == nil {
+			t.Errorf("precision %d accepted", p)
+		}
+	}
+	for _, p := range []uint8{4, 12, 16} {
+		if _, err := New(p); err != nil {
+			t.Errorf("precision %d: %s", p, err)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	for _, c := range []struct {
+		precision uint8
+		n         int
+		within    float64
+	}{
+		{12, 0, 0},
+		{12, 1, 0},
+		{12, 10, 0.01},
+		{12, 1000, 0.05},
+		{12, 100000, 0.05},
+		{14, 1000000, 0.03},
+		{4, 1000, 0.5},
+	} {
+		s, _ := New(c.precision)
+		for i := 0; i < c.n; i++ {
+			s.AddBytes([]byte(fmt.Sprintf("value-%d", i)))
+			if i%3 == 0 {
+				s.AddBytes([]byte(fmt.Sprintf("value-%d", i))) // again, not counted
+			}
+		}
+		got := s.Estimate()
+		if off := math.Abs(float64(got) - float64(c.n)); off > c.within*float64(c.n)+0.5 {
+			t.Errorf("precision %d, %d values: estimated %d", c.precision, c.n, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, _ := New(12)
+	b, _ := New(12)
+	union, _ := New(12)
+	for i := 0; i < 20000; i++ {
+		v := []byte(fmt.Sprint(i))
+		if i < 12000 {
+			a.AddBytes(v)
+		}
+		if i >= 8000 {
+			b.AddBytes(v)
+		}
+		union.AddBytes(v)
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Estimate() != union.Estimate() {
+		t.Errorf("merged estimate %d, the union's %d", a.Estimate(), union.Estimate())
+	}
+
+	empty, _ := New(12)
+	if err := empty.Merge(union); err != nil || empty.Estimate() != union.Estimate() {
+		t.Errorf("merged into an empty sketch: %d, %v", empty.Estimate(), err)
+	}
+	before := union.Estimate()
+	fresh, _ := New(12)
+	if err := union.Merge(fresh); err != nil || union.Estimate() != before {
+		t.Errorf("merging an empty sketch: %d, %v", union.Estimate(), err)
+	}
+	other, _ := New(10)
+	if err := union.Merge(other); err == nil {
+		t.Error("merged sketches of different precisions")
+	}
+}
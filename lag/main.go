@@ -0,0 +1,311 @@
+// Package lag watches how far each replica set member's applied optime is
+// behind the primary's, exporting it as metrics and alerting on members
+// falling behind, the oplogctl lag command.
+package lag
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/sink"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("lag", "watch each replica set member's replication lag, alerting when one falls behind")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL    = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the replica set watched")
+	interval    = flags.Duration("INTERVAL", 10*time.Second, "how often the members' optimes are polled")
+	threshold   = flags.Duration("LAG_THRESHOLD", time.Minute, "how far behind the primary a member is before it's alerted on")
+	alertSink   = flags.String("ALERT_SINK", "", "sink alerts are sent to as members fall behind, become unreachable or the primary's lost, and once they're resolved: an http or https url, authenticated as the lag sink, or file:path")
+	metricsAddr = flags.String("METRICS_ADDR", "", "address to serve each member's lag on at /debug/vars as replica_set, e.g. \":8080\"")
+	once        = flags.Bool("ONCE", false, "print each member's lag and exit, with 1 if one's alerted on")
+)
+
+var privileges = []dial.Privilege{
+	{Cluster: true, Actions: []string{"replSetGetStatus"}},
+}
+
+// member is a member's state as polled
+type member struct {
+	State      string `json:"state"`
+	Healthy    bool   `json:"healthy"`
+	Optime     string `json:"optime"`
+	LagSeconds int64  `json:"lag_seconds"` // behind the primary, or the newest member without one
+	Problem    string `json:"problem,omitempty"`
+}
+
+// problems a member, or the replica set, is alerted on
+const (
+	behind      = "behind"
+	unreachable = "unreachable"
+	noPrimary   = "no primary"
+)
+
+// setName is what a problem of the replica set as a whole is keyed by
+const setName = "(replica set)"
+
+// replicaSet is the latest poll, served as metrics
+type replicaSet struct {
+	Primary string             `json:"primary"`
+	Members map[string]*member `json:"members"`
+	At      time.Time          `json:"at"`
+}
+
+// alert is what's sent to ALERT_SINK
+type alert struct {
+	Member     string    `json:"member"`
+	Problem    string    `json:"problem"`
+	Resolved   bool      `json:"resolved"`
+	State      string    `json:"state,omitempty"`
+	LagSeconds int64     `json:"lag_seconds"`
+	Threshold  float64   `json:"threshold_seconds"`
+	At         time.Time `json:"at"`
+}
+
+// readOptime returns the ts of a replSetGetStatus optime, a {ts, t}
+// document or, on protocol version 0, the timestamp itself
+func readOptime(v interface{}) bson.MongoTimestamp {
+	switch v := v.(type) {
+	case bson.MongoTimestamp:
+		return v
+	case bson.M:
+		ts, _ := v["ts"].(bson.MongoTimestamp)
+		return ts
+	}
+	return 0
+}
+
+// status is the part of replSetGetStatus lag is measured from
+type status struct {
+	Members []struct {
+		Name     string      `bson:"name"`
+		State    int         `bson:"state"`
+		StateStr string      `bson:"stateStr"`
+		Health   float64     `bson:"health"`
+		Optime   interface{} `bson:"optime"`
+	} `bson:"members"`
+}
+
+// poll returns the members' lag
+func poll(sess *mgo.Session) (*replicaSet, error) {
+	var st status
+	if err := sess.Run(bson.D{{Name: "replSetGetStatus", Value: 1}}, &st); err != nil {
+		return nil, err
+	}
+	return st.replicaSet(time.Now()), nil
+}
+
+// replicaSet returns the members' lag as of at, arbiters left out
+func (st *status) replicaSet(at time.Time) *replicaSet {
+	rs := &replicaSet{Members: make(map[string]*member), At: at}
+	var head bson.MongoTimestamp
+	optimes := map[string]bson.MongoTimestamp{}
+	for _, m := range st.Members {
+		if m.StateStr == "ARBITER" {
+			continue
+		}
+		ts := readOptime(m.Optime)
+		optimes[m.Name] = ts
+		rs.Members[m.Name] = &member{State: m.StateStr, Healthy: m.Health == 1, Optime: optime.Format(ts)}
+		if m.StateStr == "PRIMARY" {
+			rs.Primary = m.Name
+		}
+		if ts > head {
+			head = ts
+		}
+	}
+	if rs.Primary != "" {
+		head = optimes[rs.Primary]
+	}
+	for name, m := range rs.Members {
+		if lag := int64(uint64(head)>>32) - int64(uint64(optimes[name])>>32); lag > 0 {
+			m.LagSeconds = lag
+		}
+		switch {
+		case !m.Healthy:
+			m.Problem = unreachable
+		case time.Duration(m.LagSeconds)*time.Second > *threshold:
+			m.Problem = behind
+		}
+	}
+	return rs
+}
+
+// problems returns what rs is alerted on, by member
+func (rs *replicaSet) problems() map[string]string {
+	p := map[string]string{}
+	if rs.Primary == "" {
+		p[setName] = noPrimary
+	}
+	for name, m := range rs.Members {
+		if m.Problem != "" {
+			p[name] = m.Problem
+		}
+	}
+	return p
+}
+
+// sorted returns the names of problems in order
+func sorted(problems map[string]string) []string {
+	names := make([]string, 0, len(problems))
+	for name := range problems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (rs *replicaSet) print() {
+	width := len("member")
+	for name := range rs.Members {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	fmt.Printf("%-*s %-10s %-20s %8s  %s\n", width, "member", "state", "optime", "lag", "problem")
+	names := make([]string, 0, len(rs.Members))
+	for name := range rs.Members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := rs.Members[name]
+		fmt.Printf("%-*s %-10s %-20s %8s  %s\n", width, name, m.State, m.Optime, time.Duration(m.LagSeconds)*time.Second, m.Problem)
+	}
+	if rs.Primary == "" {
+		fmt.Println(noPrimary)
+	}
+}
+
+// watcher alerts on the problems that start and end between polls
+type watcher struct {
+	alerts *sink.Sink
+	last   map[string]string
+
+	mu     sync.Mutex
+	latest *replicaSet
+}
+
+func (w *watcher) update(rs *replicaSet) {
+	w.mu.Lock()
+	w.latest = rs
+	w.mu.Unlock()
+	problems := rs.problems()
+	send := func(name, problem string, resolved bool) {
+		a := alert{Member: name, Problem: problem, Resolved: resolved, Threshold: threshold.Seconds(), At: rs.At}
+		if m := rs.Members[name]; m != nil {
+			a.State, a.LagSeconds = m.State, m.LagSeconds
+		}
+		switch {
+		case resolved:
+			fmt.Printf("%s %s: %s, resolved\n", rs.At.Format(time.RFC3339), name, problem)
+		case problem == behind:
+			fmt.Printf("%s %s: %s behind the primary\n", rs.At.Format(time.RFC3339), name, time.Duration(a.LagSeconds)*time.Second)
+		default:
+			fmt.Printf("%s %s: %s\n", rs.At.Format(time.RFC3339), name, problem)
+		}
+		if err := w.alerts.Send(a); err != nil {
+			fmt.Fprintf(os.Stderr, "ALERT_SINK: %s\n", err)
+		}
+	}
+	for _, name := range sorted(problems) {
+		if problem := problems[name]; w.last[name] != problem {
+			if w.last[name] != "" {
+				send(name, w.last[name], true)
+			}
+			send(name, problem, false)
+		}
+	}
+	for _, name := range sorted(w.last) {
+		if problems[name] == "" {
+			send(name, w.last[name], true)
+		}
+	}
+	w.last = problems
+}
+
+func (w *watcher) snapshot() interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.latest
+}
+
+// Main runs oplogctl lag, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *interval <= 0 || *threshold <= 0 {
+		panic(cli.Invalidf("INTERVAL and LAG_THRESHOLD must be positive"))
+	}
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	// any member answers, so there's a status without a primary
+	sess.SetMode(mgo.PrimaryPreferred, true)
+	if err := dial.CheckPrivileges(sess, privileges...); err != nil {
+		panic(err)
+	}
+	if *once {
+		rs, err := poll(sess)
+		if err != nil {
+			panic(err)
+		}
+		rs.print()
+		if len(rs.problems()) > 0 {
+			os.Exit(cli.ExitFailure)
+		}
+		return
+	}
+
+	alerts, err := sink.Open("lag", *alertSink)
+	if err != nil {
+		panic(err)
+	}
+	defer alerts.Close()
+	w := &watcher{alerts: alerts}
+	if *metricsAddr != "" {
+		expvar.Publish("replica_set", expvar.Func(w.snapshot))
+		go func() {
+			defer cli.Recover()
+			if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	tick := time.NewTicker(*interval)
+	defer tick.Stop()
+	for {
+		rs, err := poll(sess)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replSetGetStatus: %s, retrying\n", err)
+			sess.Refresh()
+		} else {
+			w.update(rs)
+		}
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
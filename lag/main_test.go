@@ -0,0 +1,148 @@
+package lag
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/sink"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// rsStatus is a replSetGetStatus of members given as name, state, health
+// and optime in seconds
+func rsStatus(members ...interface{}) *status {
+	st := &status{}
+	for i := 0; i < len(members); i += 4 {
+		m := struct {
+			Name     string      `bson:"name"`
+			State    int         `bson:"state"`
+			StateStr string      `bson:"stateStr"`
+			Health   float64     `bson:"health"`
+			Optime   interface{} `bson:"optime"`
+		}{Name: members[i].(string), StateStr: members[i+1].(string), Health: members[i+2].(float64)}
+		m.Optime = bson.M{"ts": bson.MongoTimestamp(int64(members[i+3].(int)) << 32), "t": int64(1)}
+		st.Members = append(st.Members, m)
+	}
+	return st
+}
+
+func TestReplicaSet(t *testing.T) {
+	defer func(d time.Duration) { *threshold = d }(*threshold)
+	*threshold = time.Minute
+	at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	rs := rsStatus(
+		"a:27017", "PRIMARY", 1.0, 1000,
+		"b:27017", "SECONDARY", 1.0, 990,
+		"c:27017", "SECONDARY", 1.0, 900,
+		"d:27017", "SECONDARY", 0.0, 1000,
+		"e:27017", "ARBITER", 1.0, 0,
+	).replicaSet(at)
+	if rs.Primary != "a:27017" || len(rs.Members) != 4 || rs.At != at {
+		t.Fatalf("primary %s, %d members", rs.Primary, len(rs.Members))
+	}
+	for name, want := range map[string]member{
+		"a:27017": {State: "PRIMARY", Healthy: true, Optime: "1000:0"},
+		"b:27017": {State: "SECONDARY", Healthy: true, Optime: "990:0", LagSeconds: 10},
+		"c:27017": {State: "SECONDARY", Healthy: true, Optime: "900:0", LagSeconds: 100, Problem: behind},
+		"d:27017": {State: "SECONDARY", Optime: "1000:0", Problem: unreachable},
+	} {
+		if got := rs.Members[name]; got == nil || *got != want {
+			t.Errorf("%s: %+v, want %+v", name, got, want)
+		}
+	}
+	if want := map[string]string{"c:27017": behind, "d:27017": unreachable}; !reflect.DeepEqual(rs.problems(), want) {
+		t.Errorf("problems %v, want %v", rs.problems(), want)
+	}
+}
+
+func TestReplicaSetNoPrimary(t *testing.T) {
+	// behind the newest member then
+	rs := rsStatus(
+		"a:27017", "SECONDARY", 1.0, 1000,
+		"b:27017", "SECONDARY", 1.0, 700,
+	).replicaSet(time.Now())
+	if rs.Primary != "" || rs.Members["a:27017"].LagSeconds != 0 || rs.Members["b:27017"].LagSeconds != 300 {
+		t.Errorf("primary %q, lag %d and %d", rs.Primary, rs.Members["a:27017"].LagSeconds, rs.Members["b:27017"].LagSeconds)
+	}
+	if p := rs.problems(); p[setName] != noPrimary {
+		t.Errorf("problems %v, want no primary", p)
+	}
+}
+
+func TestReadOptime(t *testing.T) {
+	for _, c := range []struct {
+		v    interface{}
+		want bson.MongoTimestamp
+	}{
+		{bson.M{"ts": bson.MongoTimestamp(5 << 32), "t": int64(3)}, 5 << 32},
+		{bson.MongoTimestamp(7 << 32), 7 << 32}, // protocol version 0
+		{nil, 0},
+		{bson.M{"t": int64(3)}, 0},
+	} {
+		if got := readOptime(c.v); got != c.want {
+			t.Errorf("%v: %d, want %d", c.v, got, c.want)
+		}
+	}
+}
+
+func TestWatcherAlerts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts")
+	alerts, err := sink.Open("lag", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &watcher{alerts: alerts}
+	rs := func(problems map[string]string) *replicaSet {
+		r := &replicaSet{Primary: "a", Members: map[string]*member{}}
+		for name, p := range problems {
+			if name == setName {
+				r.Primary = ""
+				continue
+			}
+			r.Members[name] = &member{State: "SECONDARY", Problem: p}
+		}
+		return r
+	}
+	w.update(rs(nil))
+	w.update(rs(map[string]string{"b": behind}))
+	w.update(rs(map[string]string{"b": behind})) // still, not sent again
+	w.update(rs(map[string]string{"b": unreachable, setName: noPrimary}))
+	w.update(rs(nil))
+	alerts.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var a alert
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			t.Fatal(err)
+		}
+		s := a.Member + " " + a.Problem
+		if a.Resolved {
+			s += " resolved"
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		"b behind",
+		"(replica set) no primary",
+		"b behind resolved",
+		"b unreachable",
+		"(replica set) no primary resolved",
+		"b unreachable resolved",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("alerts\n%v\nwant\n%v", got, want)
+	}
+}
@@ -0,0 +1,361 @@
+// Package mqtt publishes to an MQTT 3.1.1 broker, at mqtt://host:port or,
+// over tls, mqtts://host:port. A Client keeps one clean session, a message
+// in flight at a time so they arrive in order, and reconnects to publish
+// when it's lost the broker, retrying MQTT_RETRIES times.
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ianschenck/envflag"
+)
+
+var (
+	retries = envflag.Int("MQTT_RETRIES", 3, "times a failed publish to an mqtt broker is retried, backing off from a second, reconnecting")
+)
+
+// timeout bounds connecting and waiting for acks
+const timeout = 10 * time.Second
+
+// keepAlive is how long the connection may idle before it's pinged
+const keepAlive = 30 * time.Second
+
+// packet types, shifted into the fixed header's upper nibble
+const (
+	connect    = 1
+	connack    = 2
+	publish    = 3
+	puback     = 4
+	pubrec     = 5
+	pubrel     = 6
+	pubcomp    = 7
+	pingreq    = 12
+	pingresp   = 13
+	disconnect = 14
+)
+
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client id rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Client publishes to a broker
+type Client struct {
+	addr     string
+	tls      *tls.Config
+	clientID string
+	user     string
+	password string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	acks   chan ack
+	dead   chan struct{} // closed once the connection's read fails
+	nextID uint16
+	used   time.Time // when the connection was last written to
+	closed bool
+}
+
+type ack struct {
+	kind byte
+	id   uint16
+}
+
+// Dial connects to the broker at rawurl as clientID, with user and
+// password unless empty
+func Dial(rawurl, clientID, user, password string) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("mqtt: %q must be mqtt://host:port or mqtts://host:port", rawurl)
+	}
+	c := &Client{addr: u.Host, clientID: clientID, user: user, password: password}
+	switch u.Scheme {
+	case "mqtt":
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "mqtts":
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("mqtt: %q must be mqtt://host:port or mqtts://host:port", rawurl)
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	go c.ping()
+	return c, nil
+}
+
+// connect opens a connection and session, c.mu held or c not shared yet
+func (c *Client) connect() error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: timeout}
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("mqtt: %s", err)
+	}
+	var flags byte = 0x02 // clean session
+	payload := appendString(nil, c.clientID)
+	if c.user != "" {
+		flags |= 0x80
+		payload = appendString(payload, c.user)
+		if c.password != "" {
+			flags |= 0x40
+			payload = appendString(payload, c.password)
+		}
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = appendUint16(body, uint16(keepAlive/time.Second))
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(packet(connect<<4, append(body, payload...))); err != nil {
+		conn.Close()
+		return fmt.Errorf("mqtt: %s", err)
+	}
+	r := bufio.NewReader(conn)
+	kind, data, err := readPacket(r)
+	if err == nil && (kind>>4 != connack || len(data) != 2) {
+		err = errors.New("expected a CONNACK")
+	}
+	if err == nil && data[1] != 0 {
+		err = fmt.Errorf("connection refused, %s", connackErrors[data[1]])
+		if connackErrors[data[1]] == "" {
+			err = fmt.Errorf("connection refused, code %d", data[1])
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("mqtt %s: %s", c.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	c.conn, c.acks, c.dead, c.used = conn, make(chan ack, 16), make(chan struct{}), time.Now()
+	go c.read(r, c.acks, c.dead)
+	return nil
+}
+
+// read passes on the acks of a connection until it fails
+func (c *Client) read(r *bufio.Reader, acks chan<- ack, dead chan<- struct{}) {
+	defer close(dead)
+	for {
+		kind, data, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch kind >> 4 {
+		case puback, pubrec, pubcomp:
+			if len(data) != 2 {
+				return
+			}
+			select {
+			case acks <- ack{kind >> 4, binary.BigEndian.Uint16(data)}:
+			default: // acks nobody waits for
+			}
+		}
+	}
+}
+
+// ping keeps idle connections open until the client's closed
+func (c *Client) ping() {
+	for range time.Tick(keepAlive / 2) {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		if c.conn != nil && time.Since(c.used) >= keepAlive/2 {
+			c.write(packet(pingreq<<4, nil))
+		}
+		c.mu.Unlock()
+	}
+}
+
+// write sends a packet, dropping the connection if it can't, c.mu held
+func (c *Client) write(p []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(p); err != nil {
+		c.drop()
+		return err
+	}
+	c.used = time.Now()
+	return nil
+}
+
+// drop closes the connection, c.mu held
+func (c *Client) drop() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Publish sends payload to topic at qos 0, 1 or 2, returning once the
+// broker has it as the qos says, written out for 0
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if qos > 2 {
+		return fmt.Errorf("mqtt: qos %d must be 0, 1 or 2", qos)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errors.New("mqtt: client closed")
+	}
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	var err error
+	for attempt := 0; attempt <= *retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << uint(attempt-1))
+		}
+		if c.conn == nil {
+			if err = c.connect(); err != nil {
+				continue
+			}
+		}
+		if err = c.publish(topic, payload, qos, retain, attempt > 0); err == nil {
+			return nil
+		}
+		c.drop()
+	}
+	return err
+}
+
+// publish sends a message once, c.mu held
+func (c *Client) publish(topic string, payload []byte, qos byte, retain, dup bool) error {
+	kind := byte(publish<<4) | qos<<1
+	if retain {
+		kind |= 0x01
+	}
+	if dup && qos > 0 {
+		kind |= 0x08
+	}
+	body := appendString(nil, topic)
+	if qos > 0 {
+		body = appendUint16(body, c.nextID)
+	}
+	if err := c.write(packet(kind, append(body, payload...))); err != nil {
+		return fmt.Errorf("mqtt: %s", err)
+	}
+	switch qos {
+	case 1:
+		return c.await(puback)
+	case 2:
+		if err := c.await(pubrec); err != nil {
+			return err
+		}
+		if err := c.write(packet(pubrel<<4|0x02, appendUint16(nil, c.nextID))); err != nil {
+			return fmt.Errorf("mqtt: %s", err)
+		}
+		return c.await(pubcomp)
+	}
+	return nil
+}
+
+// await waits for the ack of kind of the message in flight, c.mu held
+func (c *Client) await(kind byte) error {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case a := <-c.acks:
+			if a.kind == kind && a.id == c.nextID {
+				return nil
+			}
+			// a late ack of a message already given up on
+		case <-c.dead:
+			return errors.New("mqtt: connection lost")
+		case <-deadline:
+			return errors.New("mqtt: timed out waiting for the broker")
+		}
+	}
+}
+
+// Close disconnects from the broker
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	err := c.write(packet(disconnect<<4, nil))
+	c.drop()
+	return err
+}
+
+// packet returns a packet of the fixed header's first byte and body
+func packet(kind byte, body []byte) []byte {
+	p := []byte{kind}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+// readPacket reads a packet, returning the first byte of its fixed header
+// and its body
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, uint(0)
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; i == 3 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return kind, data, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
@@ -0,0 +1,212 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemainingLength(t *testing.T) {
+	for _, c := range []struct {
+		n      int
+		header []byte // the remaining length's bytes
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	} {
+		body := bytes.Repeat([]byte{'x'}, c.n)
+		p := packet(publish<<4, body)
+		if got := p[1 : len(p)-c.n]; !bytes.Equal(got, c.header) {
+			t.Errorf("%d encoded as % x, want % x", c.n, got, c.header)
+			continue
+		}
+		kind, data, err := readPacket(bufio.NewReader(bytes.NewReader(p)))
+		if err != nil {
+			t.Errorf("%d: %s", c.n, err)
+			continue
+		}
+		if kind != publish<<4 || len(data) != c.n {
+			t.Errorf("%d decoded as kind %x of %d bytes", c.n, kind, len(data))
+		}
+	}
+}
+
+func TestRemainingLengthMalformed(t *testing.T) {
+	p := []byte{publish << 4, 0x80, 0x80, 0x80, 0x80, 0x01}
+	if _, _, err := readPacket(bufio.NewReader(bytes.NewReader(p))); err == nil || !strings.Contains(err.Error(), "malformed") {
+		t.Errorf("a five byte remaining length read with %v", err)
+	}
+	p = []byte{publish << 4, 0x05, 'a', 'b'}
+	if _, _, err := readPacket(bufio.NewReader(bytes.NewReader(p))); err == nil {
+		t.Error("a body shorter than its remaining length read")
+	}
+}
+
+// message is a PUBLISH a broker got
+type message struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
+	id      uint16
+}
+
+// broker is an in-process mqtt broker of one client at a time, acking
+// what's published as its qos asks
+type broker struct {
+	ln       net.Listener
+	code     byte // of the CONNACK
+	connects chan []byte
+	got      chan message
+}
+
+func newBroker(t *testing.T, code byte) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{ln: ln, code: code, connects: make(chan []byte, 4), got: make(chan message, 16)}
+	t.Cleanup(func() { ln.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *broker) url() string {
+	return "mqtt://" + b.ln.Addr().String()
+}
+
+func (b *broker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.session(conn)
+	}
+}
+
+func (b *broker) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	kind, data, err := readPacket(r)
+	if err != nil || kind>>4 != connect {
+		return
+	}
+	b.connects <- data
+	conn.Write(packet(connack<<4, []byte{0, b.code}))
+	for {
+		kind, data, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch kind >> 4 {
+		case publish:
+			n := int(binary.BigEndian.Uint16(data))
+			m := message{topic: string(data[2 : 2+n]), qos: kind >> 1 & 0x03, retain: kind&0x01 != 0}
+			data = data[2+n:]
+			if m.qos > 0 {
+				m.id, data = binary.BigEndian.Uint16(data), data[2:]
+			}
+			m.payload = string(data)
+			b.got <- m
+			switch m.qos {
+			case 1:
+				conn.Write(packet(puback<<4, appendUint16(nil, m.id)))
+			case 2:
+				conn.Write(packet(pubrec<<4, appendUint16(nil, m.id)))
+			}
+		case pubrel:
+			conn.Write(packet(pubcomp<<4, data))
+		case pingreq:
+			conn.Write(packet(pingresp<<4, nil))
+		case disconnect:
+			return
+		}
+	}
+}
+
+func (b *broker) next(t *testing.T) message {
+	t.Helper()
+	select {
+	case m := <-b.got:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("nothing published")
+		return message{}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	b := newBroker(t, 0)
+	c, err := Dial(b.url(), "test-client", "ada", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	connect := <-b.connects
+	for _, s := range []string{"MQTT", "test-client", "ada", "secret"} {
+		if !bytes.Contains(connect, []byte(s)) {
+			t.Errorf("CONNECT without %q: % x", s, connect)
+		}
+	}
+
+	for i, want := range []message{
+		{topic: "mongodb/app/users/insert", payload: `{"op":"i"}`, qos: 0},
+		{topic: "mongodb/app/users/update", payload: `{"op":"u"}`, qos: 1, id: 2},
+		{topic: "mongodb/app/users/delete", payload: `{"op":"d"}`, qos: 1, retain: true, id: 3},
+		{topic: "mongodb/app/orders/insert", payload: `{"op":"i"}`, qos: 2, id: 4},
+	} {
+		// Publish only returns once the broker's acked qos 1 and 2
+		if err := c.Publish(want.topic, []byte(want.payload), want.qos, want.retain); err != nil {
+			t.Fatalf("publish %d: %s", i, err)
+		}
+		if got := b.next(t); got != want {
+			t.Errorf("publish %d got %+v, want %+v", i, got, want)
+		}
+	}
+	if err := c.Publish("x", nil, 3, false); err == nil {
+		t.Error("qos 3 published")
+	}
+}
+
+func TestPublishReconnects(t *testing.T) {
+	b := newBroker(t, 0)
+	c, err := Dial(b.url(), "test-client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-b.connects
+	c.mu.Lock()
+	c.drop() // as a failed write would
+	c.mu.Unlock()
+	if err := c.Publish("mongodb/app/users/insert", []byte("{}"), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	<-b.connects
+	if got := b.next(t); got.topic != "mongodb/app/users/insert" {
+		t.Errorf("published %+v after reconnecting", got)
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	b := newBroker(t, 4)
+	_, err := Dial(b.url(), "test-client", "ada", "wrong")
+	if err == nil || !strings.Contains(err.Error(), "bad user name or password") {
+		t.Errorf("a refused CONNECT dialed with %v", err)
+	}
+	for _, rawurl := range []string{"tcp://localhost", "mqtt://", "://"} {
+		if _, err := Dial(rawurl, "test-client", "", ""); err == nil || !strings.Contains(err.Error(), "must be mqtt://") {
+			t.Errorf("%q dialed with %v", rawurl, err)
+		}
+	}
+}
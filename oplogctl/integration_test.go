@@ -0,0 +1,40 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestIntegration runs ../integration, tail and stats end to end against a
+// replica set in docker of each of INTEGRATION_IMAGES, 4.4 before OP_MSG
+// only and 6.0 and 7.0 after by default, skipped without a docker daemon to
+// run it on: go test -tags integration ./oplogctl
+func TestIntegration(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("no docker to run mongod in")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skipf("docker info: %s, the daemon isn't reachable", err)
+	}
+	images := strings.Fields(os.Getenv("INTEGRATION_IMAGES"))
+	if len(images) == 0 {
+		images = []string{"mongo:4.4", "mongo:6.0", "mongo:7.0"}
+	}
+	for i, image := range images {
+		t.Run(image, func(t *testing.T) {
+			cmd := exec.Command("./integration")
+			cmd.Dir = ".."
+			cmd.Env = append(os.Environ(), "MONGO_IMAGE="+image, "MONGO_PORT="+strconv.Itoa(27117+i))
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("integration: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	// the commands, registering themselves
+	_ "github.com/hanjoyo/oplog-abuse/archive"
+	_ "github.com/hanjoyo/oplog-abuse/clone"
+	_ "github.com/hanjoyo/oplog-abuse/compact"
+	_ "github.com/hanjoyo/oplog-abuse/dump"
+	_ "github.com/hanjoyo/oplog-abuse/genload"
+	_ "github.com/hanjoyo/oplog-abuse/lag"
+	_ "github.com/hanjoyo/oplog-abuse/outbox"
+	_ "github.com/hanjoyo/oplog-abuse/replay"
+	_ "github.com/hanjoyo/oplog-abuse/searchsync"
+	_ "github.com/hanjoyo/oplog-abuse/soak"
+	_ "github.com/hanjoyo/oplog-abuse/stats"
+	_ "github.com/hanjoyo/oplog-abuse/tail"
+	_ "github.com/hanjoyo/oplog-abuse/top"
+	_ "github.com/hanjoyo/oplog-abuse/undo"
+	_ "github.com/hanjoyo/oplog-abuse/validate"
+	_ "github.com/hanjoyo/oplog-abuse/verify"
+	_ "github.com/hanjoyo/oplog-abuse/window"
+	_ "github.com/hanjoyo/oplog-abuse/writers"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: oplogctl <command> [-NAME=value ...]\n\ncommands:\n\n")
+	for _, name := range cli.Names() {
+		c, _ := cli.Lookup(name)
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, c.Flags.Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\noplogctl help <command> lists a command's settings\n")
+	fmt.Fprintf(os.Stderr, "oplogctl completion bash|zsh|fish prints completions\n")
+	fmt.Fprintf(os.Stderr, "oplogctl man [command|-dir=DIR] prints a manual page or writes them all\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(cli.ExitUsage)
+	}
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if len(args) == 0 {
+			usage()
+			return
+		}
+		name, args = args[0], []string{"-help"}
+	case "completion":
+		if len(args) != 1 {
+			fmt.Fprintf(os.Stderr, "usage: oplogctl completion bash|zsh|fish\n")
+			os.Exit(cli.ExitUsage)
+		}
+		if err := cli.Completion(os.Stdout, args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "oplogctl: %s\n", err)
+			os.Exit(cli.ExitUsage)
+		}
+		return
+	case "man":
+		var err error
+		switch {
+		case len(args) > 0 && strings.HasPrefix(args[0], "-dir="):
+			err = cli.ManPages(strings.TrimPrefix(args[0], "-dir="))
+		case len(args) > 0:
+			err = cli.Man(os.Stdout, args[0])
+		default:
+			err = cli.Man(os.Stdout, "")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "oplogctl: %s\n", err)
+			os.Exit(cli.ExitUsage)
+		}
+		return
+	}
+	c, ok := cli.Lookup(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "oplogctl: unknown command %q\n\n", name)
+		usage()
+		os.Exit(cli.ExitUsage)
+	}
+	defer cli.Recover()
+	c.Main(args)
+}
@@ -0,0 +1,40 @@
+package oplogtest
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/tail"
+)
+
+// Fixture returns a source of the entries recorded to path by tail's
+// CAPTURE, in the order they were, closed after the last. Their
+// timestamps and wall times are kept.
+func Fixture(t testing.TB, path string) *Source {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []*tail.Oplog
+	r := bsonfile.NewReader(f)
+	for {
+		o := new(tail.Oplog)
+		if err := r.Next(o); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s: entry %d: %s", path, len(entries)+1, err)
+		}
+		entries = append(entries, o)
+	}
+	s := New(time.Time{}, len(entries))
+	for _, o := range entries {
+		s.Inject(o)
+	}
+	s.Close()
+	return s
+}
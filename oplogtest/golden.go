@@ -0,0 +1,138 @@
+package oplogtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UpdateEnv set to 1 has Golden write the golden files instead of checking
+// them, the change then reviewed in the diff
+const UpdateEnv = "OPLOGTEST_UPDATE"
+
+// Representative returns oplog entries as mongod writes them, covering the
+// types an encoding has to get right: object ids, timestamps, dates,
+// decimals, binaries, regular expressions, nested arrays and documents,
+// and the shapes of the operations, a transaction's applyOps included.
+// They're the same on every call.
+func Representative() []bson.D {
+	id := bson.ObjectIdHex("5f1d7a0e2c3b4a5d6e7f8091")
+	at := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	ts := bson.MongoTimestamp(at.Unix()<<32 | 1)
+	price, _ := bson.ParseDecimal128("1234.5678")
+	entry := func(inc int64, op, ns string, o bson.D, rest ...bson.DocElem) bson.D {
+		e := bson.D{
+			{Name: "ts", Value: ts + bson.MongoTimestamp(inc)},
+			{Name: "h", Value: int64(-4768495924470325753) + inc},
+			{Name: "v", Value: 2},
+			{Name: "op", Value: op},
+			{Name: "ns", Value: ns},
+			{Name: "wall", Value: at.Add(time.Duration(inc) * time.Millisecond)},
+			{Name: "o", Value: o},
+		}
+		return append(e, rest...)
+	}
+	return []bson.D{
+		entry(0, "i", "app.orders", bson.D{
+			{Name: "_id", Value: id},
+			{Name: "price", Value: price},
+			{Name: "qty", Value: int64(1) << 40},
+			{Name: "ratio", Value: 0.1},
+			{Name: "placed", Value: at},
+			{Name: "seen", Value: bson.MongoTimestamp(at.Unix() << 32)},
+			{Name: "digest", Value: []byte{0xde, 0xad, 0xbe, 0xef}},
+			{Name: "uuid", Value: bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}},
+			{Name: "sku", Value: bson.RegEx{Pattern: "^ab.*", Options: "i"}},
+			{Name: "note", Value: nil},
+			{Name: "lines", Value: []interface{}{
+				bson.D{{Name: "sku", Value: "a1"}, {Name: "tags", Value: []interface{}{"x", []interface{}{1, 2}, bson.D{}}}},
+				bson.D{{Name: "sku", Value: "b2"}, {Name: "tags", Value: []interface{}{}}},
+			}},
+			{Name: "address", Value: bson.D{{Name: "city", Value: "Utrecht"}, {Name: "geo", Value: []interface{}{5.12, 52.09}}}},
+		}),
+		entry(1, "u", "app.orders", bson.D{
+			{Name: "$v", Value: 2},
+			{Name: "diff", Value: bson.D{
+				{Name: "u", Value: bson.D{{Name: "price", Value: price}}},
+				{Name: "slines", Value: bson.D{{Name: "a", Value: true}, {Name: "u0", Value: bson.D{{Name: "sku", Value: "a2"}}}}},
+			}},
+		}, bson.DocElem{Name: "o2", Value: bson.D{{Name: "_id", Value: id}}}),
+		entry(2, "u", "app.orders", bson.D{
+			{Name: "$set", Value: bson.D{{Name: "lines.1.tags", Value: []interface{}{"y"}}}},
+			{Name: "$unset", Value: bson.D{{Name: "note", Value: true}}},
+		}, bson.DocElem{Name: "o2", Value: bson.D{{Name: "_id", Value: id}}}),
+		entry(3, "d", "app.orders", bson.D{{Name: "_id", Value: id}}),
+		entry(4, "c", "admin.$cmd", bson.D{
+			{Name: "applyOps", Value: []interface{}{
+				bson.D{{Name: "op", Value: "i"}, {Name: "ns", Value: "app.ledger"}, {Name: "ui", Value: bson.Binary{Kind: 4, Data: []byte("fedcba9876543210")}}, {Name: "o", Value: bson.D{{Name: "_id", Value: 1}, {Name: "amount", Value: price}}}},
+				bson.D{{Name: "op", Value: "d"}, {Name: "ns", Value: "app.ledger"}, {Name: "o", Value: bson.D{{Name: "_id", Value: 0}}}},
+			}},
+		}, bson.DocElem{Name: "lsid", Value: bson.D{{Name: "id", Value: bson.Binary{Kind: 4, Data: []byte("sessionsession00")}}}},
+			bson.DocElem{Name: "txnNumber", Value: int64(7)}),
+		entry(5, "c", "app.$cmd", bson.D{{Name: "create", Value: "ledger"}, {Name: "capped", Value: true}, {Name: "size", Value: 1 << 20}}),
+		entry(6, "n", "", bson.D{{Name: "msg", Value: "periodic noop"}}),
+	}
+}
+
+// RepresentativeJSON returns Representative as dump's json format writes
+// it, a line each: mgo's extended json, $numberLong a number and $type in
+// hex, not canonical Extended JSON v2
+func RepresentativeJSON() ([]byte, error) {
+	var out []byte
+	for _, e := range Representative() {
+		raw, err := bson.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		line, err := bsonfile.JSONLine(raw)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, line...)
+	}
+	return out, nil
+}
+
+// Golden fails t unless got is what the file at path holds, showing the
+// first line that differs. With OPLOGTEST_UPDATE=1 the file is written
+// instead.
+func Golden(t testing.TB, path string, got []byte) {
+	t.Helper()
+	if os.Getenv(UpdateEnv) == "1" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s, written by running with %s=1", err, UpdateEnv)
+	}
+	if bytes.Equal(got, want) {
+		return
+	}
+	gotLines, wantLines := strings.Split(string(got), "\n"), strings.Split(string(want), "\n")
+	for i := 0; ; i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w {
+			t.Fatalf("%s:%d differs, run with %s=1 to accept it\n got: %s\nwant: %s", path, i+1, UpdateEnv, g, w)
+		}
+	}
+}
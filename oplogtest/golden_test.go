@@ -0,0 +1,29 @@
+package oplogtest
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRepresentativeJSON(t *testing.T) {
+	got, err := RepresentativeJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Golden(t, "testdata/representative.json", got)
+}
+
+// the entries, and so the goldens of every package using them, can't vary
+func TestRepresentativeStable(t *testing.T) {
+	a, err := RepresentativeJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := RepresentativeJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatal("Representative differs between calls")
+	}
+}
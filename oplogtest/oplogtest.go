@@ -0,0 +1,203 @@
+// Package oplogtest fakes a tailed cluster for tests: entries are injected
+// as inserts, updates, deletes and commands, a tail.Source hands them on,
+// and a Recorder checks what a handler was given, without a mongod. Golden
+// checks encodings of representative entries against reviewed files.
+package oplogtest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/tail"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Source is a fake cluster, a tail.Source of the entries injected into it.
+// Entries are buffered up to the size given, injecting more waits for
+// them to be read.
+type Source struct {
+	Label string // set as the entries' Source, as MONGO_URLS would
+
+	mu     sync.Mutex
+	ch     chan *tail.Oplog
+	wall   time.Time
+	inc    uint32
+	closed bool
+}
+
+// New returns a source of entries written from start on, buffering size
+// of them
+func New(start time.Time, size int) *Source {
+	return &Source{ch: make(chan *tail.Oplog, size), wall: start.Truncate(time.Second)}
+}
+
+// Entries returns the entries injected, closed once Close is
+func (s *Source) Entries() <-chan *tail.Oplog {
+	return s.ch
+}
+
+// Advance moves the clock entries are stamped with, timestamps staying
+// ascending as the oplog's do
+func (s *Source) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if next := s.wall.Add(d).Truncate(time.Second); next.After(s.wall) {
+		s.wall, s.inc = next, 0
+	}
+}
+
+// Inject sends o as it's given but for its timestamp, wall time and
+// version, set when left out, and returns it
+func (s *Source) Inject(o *tail.Oplog) *tail.Oplog {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		panic("oplogtest: inject after Close")
+	}
+	s.inc++
+	if o.Timestamp == 0 {
+		o.Timestamp = bson.MongoTimestamp(uint64(s.wall.Unix())<<32 | uint64(s.inc))
+	}
+	if o.Wall.IsZero() {
+		o.Wall = optime.Time(o.Timestamp)
+	}
+	if o.Arrived.IsZero() {
+		o.Arrived = o.Wall
+	}
+	if o.HistoryID == 0 {
+		o.HistoryID = int64(o.Timestamp)
+	}
+	if o.MongoVersion == 0 {
+		o.MongoVersion = 2
+	}
+	o.Source = s.Label
+	s.mu.Unlock()
+	s.ch <- o
+	return o
+}
+
+// Insert injects the insert of doc into ns
+func (s *Source) Insert(ns string, doc bson.M) *tail.Oplog {
+	return s.Inject(&tail.Oplog{Operation: "i", Namespace: ns, Object: doc})
+}
+
+// Update injects an update of the document with _id id in ns, update
+// being its operators, as {"$set": {...}}
+func (s *Source) Update(ns string, id interface{}, update bson.M) *tail.Oplog {
+	return s.Inject(&tail.Oplog{Operation: "u", Namespace: ns, Object: update, QueryObject: bson.M{"_id": id}})
+}
+
+// Delete injects the delete of the document with _id id from ns
+func (s *Source) Delete(ns string, id interface{}) *tail.Oplog {
+	return s.Inject(&tail.Oplog{Operation: "d", Namespace: ns, Object: bson.M{"_id": id}})
+}
+
+// Command injects cmd run on db, as {"drop": "coll"}. Its DDL is left
+// unset, as read from the oplog before tail parses it.
+func (s *Source) Command(db string, cmd bson.M) *tail.Oplog {
+	return s.Inject(&tail.Oplog{Operation: "c", Namespace: db + ".$cmd", Object: cmd})
+}
+
+// Close ends the entries, a tail of the source then stops
+func (s *Source) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+// Recorder keeps the entries a handler is given, to check them after
+type Recorder struct {
+	mu      sync.Mutex
+	entries []*tail.Oplog
+}
+
+// Handle records o, as a handler passed to tail.Drain
+func (r *Recorder) Handle(o *tail.Oplog) {
+	r.mu.Lock()
+	r.entries = append(r.entries, o)
+	r.mu.Unlock()
+}
+
+// Wrap returns h recording what it's given first
+func (r *Recorder) Wrap(h func(*tail.Oplog)) func(*tail.Oplog) {
+	return func(o *tail.Oplog) {
+		r.Handle(o)
+		h(o)
+	}
+}
+
+// Entries returns a copy of what was recorded, in order
+func (r *Recorder) Entries() []*tail.Oplog {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*tail.Oplog(nil), r.entries...)
+}
+
+// Op is what an entry is expected to be, op and ns as in the oplog
+type Op struct {
+	Op string
+	NS string
+}
+
+// String formats o as Expect reports it, as "i db.coll"
+func (o Op) String() string {
+	return o.Op + " " + o.NS
+}
+
+// InsertOf, UpdateOf, DeleteOf and CommandOf are the entries the helpers
+// of Source inject
+func InsertOf(ns string) Op  { return Op{"i", ns} }
+func UpdateOf(ns string) Op  { return Op{"u", ns} }
+func DeleteOf(ns string) Op  { return Op{"d", ns} }
+func CommandOf(db string) Op { return Op{"c", db + ".$cmd"} }
+
+func join(ops []Op) string {
+	s := make([]string, len(ops))
+	for i, o := range ops {
+		s[i] = o.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// Expect fails t unless exactly want was recorded, in order
+func (r *Recorder) Expect(t testing.TB, want ...Op) {
+	t.Helper()
+	var got []Op
+	for _, e := range r.Entries() {
+		got = append(got, Op{e.Operation, e.Namespace})
+	}
+	if len(got) != len(want) {
+		t.Fatalf("handled %d entries, wanted %d\n got: %s\nwant: %s", len(got), len(want), join(got), join(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("entry %d is %s, wanted %s\n got: %s\nwant: %s", i, got[i], want[i], join(got), join(want))
+		}
+	}
+}
+
+// ExpectNone fails t if anything was recorded
+func (r *Recorder) ExpectNone(t testing.TB) {
+	t.Helper()
+	r.Expect(t)
+}
+
+// ExpectOrdered fails t unless the timestamps recorded from each source
+// ascend, as a tail resumed from checkpoints relies on
+func (r *Recorder) ExpectOrdered(t testing.TB) {
+	t.Helper()
+	last := make(map[string]bson.MongoTimestamp)
+	for i, e := range r.Entries() {
+		if e.Timestamp <= last[e.Source] {
+			t.Fatalf("entry %d from %q at %s, not after %s", i, e.Source, optime.Format(e.Timestamp), optime.Format(last[e.Source]))
+		}
+		last[e.Source] = e.Timestamp
+	}
+}
@@ -0,0 +1,192 @@
+package oplogtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/tail"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var start = time.Unix(1792000000, 0)
+
+func TestDrainRecords(t *testing.T) {
+	src := New(start, 10)
+	src.Label = "app"
+	src.Insert("app.users", bson.M{"_id": 1, "name": "ada"})
+	src.Update("app.users", 1, bson.M{"$set": bson.M{"name": "grace"}})
+	src.Advance(time.Second)
+	src.Delete("app.users", 1)
+	src.Command("app", bson.M{"drop": "users"})
+	src.Close()
+
+	var rec Recorder
+	tail.Drain(rec.Handle, src)
+	rec.Expect(t, InsertOf("app.users"), UpdateOf("app.users"), DeleteOf("app.users"), CommandOf("app"))
+	rec.ExpectOrdered(t)
+
+	entries := rec.Entries()
+	if got := entries[1].QueryObject["_id"]; got != 1 {
+		t.Errorf("the update is of _id %v, want 1", got)
+	}
+	for i, e := range entries {
+		if e.Source != "app" {
+			t.Errorf("entry %d from %q, want the label", i, e.Source)
+		}
+		if e.Wall.Before(start) || e.HistoryID == 0 || e.MongoVersion != 2 {
+			t.Errorf("entry %d left without its wall time, h or v: %+v", i, e)
+		}
+	}
+	if uint64(entries[2].Timestamp)>>32 != uint64(start.Unix())+1 {
+		t.Errorf("the delete after Advance is at %d, want the next second", uint64(entries[2].Timestamp)>>32)
+	}
+}
+
+func TestDrainSources(t *testing.T) {
+	a, b := New(start, 10), New(start, 10)
+	a.Label, b.Label = "a", "b"
+	a.Insert("app.users", bson.M{"_id": 1})
+	b.Insert("app.orders", bson.M{"_id": 1})
+	a.Insert("app.users", bson.M{"_id": 2})
+	a.Close()
+	b.Close()
+
+	var wrapped int
+	var rec Recorder
+	tail.Drain(rec.Wrap(func(*tail.Oplog) { wrapped++ }), a, b)
+	if n := len(rec.Entries()); n != 3 || wrapped != 3 {
+		t.Fatalf("recorded %d and handed on %d entries, want 3", n, wrapped)
+	}
+	// no order between clusters, but within each
+	rec.ExpectOrdered(t)
+}
+
+// fakeT records what Expect fails with, ending the goroutine as
+// testing.T's Fatalf does
+type fakeT struct {
+	testing.TB
+	failure string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Fatalf(format string, args ...interface{}) {
+	t.failure = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+// failure returns what check failed with, empty if it passed
+func failure(check func(testing.TB)) string {
+	t := &fakeT{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		check(t)
+	}()
+	<-done
+	return t.failure
+}
+
+func TestExpect(t *testing.T) {
+	var rec Recorder
+	rec.Handle(&tail.Oplog{Operation: "i", Namespace: "app.users"})
+	rec.Handle(&tail.Oplog{Operation: "d", Namespace: "app.users"})
+
+	if f := failure(func(t testing.TB) { rec.Expect(t, InsertOf("app.users"), DeleteOf("app.users")) }); f != "" {
+		t.Errorf("Expect of what was recorded failed: %s", f)
+	}
+	for _, c := range []struct {
+		name string
+		want []Op
+		in   string
+	}{
+		{"fewer", []Op{InsertOf("app.users")}, "handled 2 entries, wanted 1"},
+		{"more", []Op{InsertOf("app.users"), DeleteOf("app.users"), CommandOf("app")}, "handled 2 entries, wanted 3"},
+		{"other op", []Op{InsertOf("app.users"), UpdateOf("app.users")}, "entry 1 is d app.users, wanted u app.users"},
+		{"other ns", []Op{InsertOf("app.orders"), DeleteOf("app.users")}, "entry 0 is i app.users, wanted i app.orders"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := failure(func(t testing.TB) { rec.Expect(t, c.want...) })
+			if !strings.Contains(f, c.in) {
+				t.Errorf("Expect failed with %q, want it to say %q", f, c.in)
+			}
+			if !strings.Contains(f, "got: i app.users, d app.users") {
+				t.Errorf("the failure doesn't list what was recorded: %q", f)
+			}
+		})
+	}
+	if f := failure(rec.ExpectNone); !strings.Contains(f, "handled 2 entries, wanted 0") {
+		t.Errorf("ExpectNone of 2 entries failed with %q", f)
+	}
+	var empty Recorder
+	if f := failure(empty.ExpectNone); f != "" {
+		t.Errorf("ExpectNone of nothing failed: %s", f)
+	}
+}
+
+func TestExpectOrdered(t *testing.T) {
+	var rec Recorder
+	rec.Handle(&tail.Oplog{Timestamp: 2 << 32, Source: "a"})
+	rec.Handle(&tail.Oplog{Timestamp: 1 << 32, Source: "b"})
+	if f := failure(rec.ExpectOrdered); f != "" {
+		t.Errorf("entries of different sources out of order failed: %s", f)
+	}
+	rec.Handle(&tail.Oplog{Timestamp: 2 << 32, Source: "a"})
+	if f := failure(rec.ExpectOrdered); !strings.Contains(f, `entry 2 from "a" at 2:0, not after 2:0`) {
+		t.Errorf("a repeated timestamp failed with %q", f)
+	}
+}
+
+func TestFixture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.bson")
+	var data []byte
+	var want []tail.Oplog
+	for _, e := range Representative() {
+		raw, err := bson.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var o tail.Oplog
+		if err := bson.Unmarshal(raw, &o); err != nil {
+			t.Fatal(err)
+		}
+		data, want = append(data, raw...), append(want, o)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var rec Recorder
+	tail.Drain(rec.Handle, Fixture(t, path))
+	got := rec.Entries()
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Timestamp != want[i].Timestamp || got[i].Operation != want[i].Operation || got[i].Namespace != want[i].Namespace {
+			t.Errorf("entry %d is %s %s at %d, recorded as %s %s at %d", i,
+				got[i].Operation, got[i].Namespace, got[i].Timestamp, want[i].Operation, want[i].Namespace, want[i].Timestamp)
+		}
+	}
+}
+
+func TestFixtureTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.bson")
+	raw, err := bson.Marshal(Representative()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(raw, raw[:len(raw)/2]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := failure(func(t testing.TB) { Fixture(t, path) })
+	if !strings.Contains(f, "entry 2") {
+		t.Errorf("a half written entry failed with %q, want it named", f)
+	}
+}
@@ -0,0 +1,48 @@
+// Package optime parses and formats oplog timestamps for flags and output.
+package optime
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Parse reads a timestamp given as seconds:increment, seconds, or an
+// RFC 3339 time, the latter two at increment 0. Empty is 0.
+func Parse(s string) (bson.MongoTimestamp, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		if t.Unix() < 0 || t.Unix() > math.MaxUint32 {
+			return 0, fmt.Errorf("timestamp %q is out of the range an oplog ts holds", s)
+		}
+		return bson.MongoTimestamp(t.Unix() << 32), nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	secs, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("timestamp %q must be seconds[:increment] or RFC 3339", s)
+	}
+	var inc uint64
+	if len(parts) == 2 {
+		if inc, err = strconv.ParseUint(parts[1], 10, 32); err != nil {
+			return 0, fmt.Errorf("timestamp %q must be seconds[:increment] or RFC 3339", s)
+		}
+	}
+	return bson.MongoTimestamp(secs<<32 | inc), nil
+}
+
+// Format writes ts as seconds:increment, as Parse reads it
+func Format(ts bson.MongoTimestamp) string {
+	return fmt.Sprintf("%d:%d", uint64(ts)>>32, uint64(ts)&0xffffffff)
+}
+
+// Time is when ts was written, to the second
+func Time(ts bson.MongoTimestamp) time.Time {
+	return time.Unix(int64(uint64(ts)>>32), 0)
+}
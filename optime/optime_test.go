@@ -0,0 +1,60 @@
+package optime
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want bson.MongoTimestamp
+		err  string
+	}{
+		{"", 0, ""},
+		{"1700000000", 1700000000 << 32, ""},
+		{"1700000000:7", 1700000000<<32 | 7, ""},
+		{"4294967295:4294967295", bson.MongoTimestamp(-1), ""},
+		{"2023-11-14T22:13:20Z", 1700000000 << 32, ""},
+		{"2023-11-14T23:13:20+01:00", 1700000000 << 32, ""},
+		{"2023-11-14T22:13:20.999Z", 1700000000 << 32, ""}, // to the second
+		{"1969-12-31T23:59:59Z", 0, "out of the range"},
+		{"2107-01-01T00:00:00Z", 0, "out of the range"},
+		{"4294967296", 0, "seconds[:increment] or RFC 3339"},
+		{"-1", 0, "seconds[:increment] or RFC 3339"},
+		{"1700000000:", 0, "seconds[:increment] or RFC 3339"},
+		{"1700000000:x", 0, "seconds[:increment] or RFC 3339"},
+		{"2023-11-14", 0, "seconds[:increment] or RFC 3339"},
+	} {
+		got, err := Parse(c.s)
+		switch {
+		case c.err != "":
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: %v, want %q", c.s, err, c.err)
+			}
+		case err != nil:
+			t.Errorf("%q: %s", c.s, err)
+		case got != c.want:
+			t.Errorf("%q: %d, want %d", c.s, got, c.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, ts := range []bson.MongoTimestamp{0, 1, 1700000000 << 32, 1700000000<<32 | 42, bson.MongoTimestamp(-1)} {
+		s := Format(ts)
+		got, err := Parse(s)
+		if err != nil || got != ts {
+			t.Errorf("%d formatted %s, parsed back %d, %v", ts, s, got, err)
+		}
+	}
+	if s := Format(1700000000<<32 | 42); s != "1700000000:42" {
+		t.Errorf("formatted %s", s)
+	}
+	if at := Time(1700000000<<32 | 42); !at.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("time %v", at)
+	}
+}
@@ -0,0 +1,25 @@
+package outbox
+
+import (
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		return []cli.Check{
+			{Name: "OUTBOX_NS, OUTBOX_SINK and OUTBOX_PROCESSED", Run: checkSettings},
+			{Name: "SINK_AUTH_FILE", Run: func() error {
+				_, err := sinkauth.Load()
+				return err
+			}},
+			{Name: "MONGO_URL", Run: func() error {
+				if err := checkSettings(); err != nil {
+					return err
+				}
+				return dial.Probe(*mongoURL, privileges()...)
+			}},
+		}
+	})
+}
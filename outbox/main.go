@@ -0,0 +1,304 @@
+// Package outbox relays a transactional outbox collection to a broker, the
+// oplogctl outbox command.
+//
+// Services write the events they publish to OUTBOX_NS in the transactions
+// changing what they're about, documents of
+//
+//	{_id: ObjectId(...), aggregateType: "order", aggregateId: "1234", type: "OrderPlaced", payload: {...}, headers: {"traceparent": "..."}}
+//
+// and the relay posts each payload, in _id order, to OUTBOX_SINK with the
+// headers of a CloudEvent in binary mode:
+//
+//	ce-specversion: 1.0
+//	ce-id: the document's _id, hex for an ObjectId
+//	ce-source: OUTBOX_SOURCE
+//	ce-type: type
+//	ce-subject: aggregateId
+//	X-Aggregate-Type: aggregateType
+//
+// and those of headers. A payload that's a string of json is posted as is,
+// anything else as extended json. Once posted a document is marked published, or deleted
+// with OUTBOX_PROCESSED=delete, so a restart picks up where it was. An
+// event may be posted again if the relay stops in between, consumers are
+// to dedupe by ce-id.
+package outbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/sink"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("outbox", "relay a transactional outbox collection to a broker")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL      = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the replica set the outbox is on")
+	outboxNS      = flags.String("OUTBOX_NS", "", "db.collection of the outbox, see package outbox for its documents")
+	outboxSink    = flags.String("OUTBOX_SINK", "", "broker the payloads are posted to: an http or https url, a kafka rest proxy's or any endpoint, authenticated as the outbox sink, or file:path")
+	outboxSource  = flags.String("OUTBOX_SOURCE", "", "ce-source header of what's posted, /mongodb/<OUTBOX_NS> if empty")
+	processed     = flags.String("OUTBOX_PROCESSED", "mark", "what's done with a document once posted: mark it with its time in OUTBOX_MARK_FIELD, or delete it")
+	markField     = flags.String("OUTBOX_MARK_FIELD", "publishedAt", "field documents are marked published in, index the outbox on it with OUTBOX_PROCESSED=mark")
+	pollEvery     = flags.Duration("OUTBOX_POLL", 30*time.Second, "how often the outbox is looked at besides when the oplog shows it written to, retrying what failed")
+	batchSize     = flags.Int("OUTBOX_BATCH", 100, "documents read from the outbox at a time")
+	resumeRetries = flags.Int("RESUME_RETRIES", 5, "times in a row a failed oplog cursor is resumed before giving up")
+)
+
+// message is an outbox document
+type message struct {
+	ID            interface{}       `bson:"_id"`
+	AggregateType string            `bson:"aggregateType"`
+	AggregateID   interface{}       `bson:"aggregateId"`
+	Type          string            `bson:"type"`
+	Payload       interface{}       `bson:"payload"`
+	Headers       map[string]string `bson:"headers"`
+}
+
+type entry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+}
+
+// relay posts the outbox to a sink
+type relay struct {
+	coll   *mgo.Collection
+	sink   *sink.Sink
+	source string
+}
+
+func splitNS(ns string) (string, string, error) {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", cli.Invalidf("OUTBOX_NS %q must be db.collection", ns)
+	}
+	return parts[0], parts[1], nil
+}
+
+// checkSettings validates the settings besides the urls
+func checkSettings() error {
+	if _, _, err := splitNS(*outboxNS); err != nil {
+		return err
+	}
+	if *outboxSink == "" {
+		return cli.Invalidf("OUTBOX_SINK must be set")
+	}
+	if *processed != "mark" && *processed != "delete" {
+		return cli.Invalidf("OUTBOX_PROCESSED %q must be mark or delete", *processed)
+	}
+	if *batchSize <= 0 || *pollEvery <= 0 {
+		return cli.Invalidf("OUTBOX_BATCH and OUTBOX_POLL must be positive")
+	}
+	return nil
+}
+
+// privileges are what the relay needs
+func privileges() []dial.Privilege {
+	db, coll, _ := splitNS(*outboxNS)
+	actions := []string{"find", "update"}
+	if *processed == "delete" {
+		actions = []string{"find", "remove"}
+	}
+	return []dial.Privilege{
+		{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+		{DB: db, Collection: coll, Actions: actions},
+	}
+}
+
+// pending selects the documents not posted yet
+func pending() bson.M {
+	if *processed == "delete" {
+		return bson.M{}
+	}
+	return bson.M{*markField: bson.M{"$exists": false}}
+}
+
+// drain posts everything pending in _id order, stopping at the first that
+// can't be so the order holds, returning how many were
+func (r *relay) drain() (int, error) {
+	posted := 0
+	for {
+		var batch []message
+		if err := r.coll.Find(pending()).Sort("_id").Limit(*batchSize).All(&batch); err != nil {
+			return posted, err
+		}
+		for _, m := range batch {
+			if err := r.post(m); err != nil {
+				return posted, err
+			}
+			if err := r.done(m); err != nil {
+				return posted, err
+			}
+			posted++
+		}
+		if len(batch) < *batchSize {
+			return posted, nil
+		}
+	}
+}
+
+// post publishes m's payload with its headers
+func (r *relay) post(m message) error {
+	var body []byte
+	if s, ok := m.Payload.(string); ok && json.Valid([]byte(s)) {
+		body = []byte(s)
+	} else {
+		var err error
+		if body, err = bsonfile.MarshalJSON(m.Payload); err != nil {
+			return fmt.Errorf("outbox %v: %s", m.ID, err)
+		}
+		body = bytes.TrimSpace(body)
+	}
+	headers := http.Header{}
+	for name, v := range m.Headers {
+		headers.Set(name, v)
+	}
+	headers.Set("Content-Type", "application/json")
+	headers.Set("ce-specversion", "1.0")
+	headers.Set("ce-id", idString(m.ID))
+	headers.Set("ce-source", r.source)
+	headers.Set("ce-type", m.Type)
+	if m.AggregateID != nil {
+		headers.Set("ce-subject", idString(m.AggregateID))
+	}
+	if m.AggregateType != "" {
+		headers.Set("X-Aggregate-Type", m.AggregateType)
+	}
+	return r.sink.Publish(body, headers)
+}
+
+// done marks m published or deletes it
+func (r *relay) done(m message) error {
+	var err error
+	if *processed == "delete" {
+		err = r.coll.RemoveId(m.ID)
+	} else {
+		err = r.coll.UpdateId(m.ID, bson.M{"$set": bson.M{*markField: time.Now()}})
+	}
+	if err == mgo.ErrNotFound {
+		return nil // deleted meanwhile, it's out already
+	}
+	return err
+}
+
+// idString returns an id as text, ObjectIds in hex and the rest as
+// extended json but for strings
+func idString(id interface{}) string {
+	switch id := id.(type) {
+	case bson.ObjectId:
+		return id.Hex()
+	case string:
+		return id
+	}
+	data, err := bsonfile.MarshalJSON(id)
+	if err != nil {
+		return fmt.Sprint(id)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Main runs oplogctl outbox, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if err := checkSettings(); err != nil {
+		panic(err)
+	}
+	db, coll, _ := splitNS(*outboxNS)
+	s, err := sink.Open("outbox", *outboxSink)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	if err := dial.CheckPrivileges(sess, privileges()...); err != nil {
+		panic(err)
+	}
+	r := &relay{coll: sess.DB(db).C(coll), sink: s, source: *outboxSource}
+	if r.source == "" {
+		r.source = "/mongodb/" + *outboxNS
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// what's written from the latest entry on wakes the relay, anything
+	// before is drained first
+	var last entry
+	if err := sess.DB("local").C("oplog.rs").Find(nil).Select(bson.M{"ts": 1}).Sort("-$natural").One(&last); err != nil {
+		panic(err)
+	}
+	fmt.Printf("relaying %s to %s\n", *outboxNS, *outboxSink)
+	drain := func() {
+		n, err := r.drain()
+		if n > 0 {
+			fmt.Printf("posted %d\n", n)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "outbox: %s, retrying in %s\n", err, *pollEvery)
+			sess.Refresh()
+		}
+	}
+	drain()
+	polled := time.Now()
+
+	// inserts in transactions are logged in the applyOps of admin.$cmd
+	wake := bson.M{"$or": []bson.M{{"ns": *outboxNS}, {"ns": "admin.$cmd"}}, "ts": nil}
+	for failures := 0; ; failures++ {
+		wake["ts"] = bson.M{"$gt": last.Timestamp}
+		iter := sess.DB("local").
+			C("oplog.rs").
+			Find(wake).
+			Sort("$natural").
+			LogReplay().
+			Tail(time.Second)
+		woken := false
+		for {
+			idle := false
+			if iter.Next(&last) {
+				failures = 0
+				woken = true
+			} else if iter.Timeout() {
+				idle = true
+			} else {
+				break
+			}
+			// drained once the entries written at once are read, every
+			// second while more keep coming
+			if woken && (idle || time.Since(polled) >= time.Second) || time.Since(polled) >= *pollEvery {
+				drain()
+				woken, polled = false, time.Now()
+			}
+			select {
+			case <-stop:
+				iter.Close()
+				return
+			default:
+			}
+		}
+		err = iter.Close()
+		if failures >= *resumeRetries {
+			panic(err)
+		}
+		fmt.Fprintf(os.Stderr, "oplog cursor failed: %v, resuming\n", err)
+		time.Sleep(time.Second)
+		sess.Refresh()
+	}
+}
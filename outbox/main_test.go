@@ -0,0 +1,214 @@
+package outbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/sink"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// settings has the outbox settings be valid ones for the rest of the test
+func settings(t *testing.T) {
+	ns, s, p, field, batch, poll := *outboxNS, *outboxSink, *processed, *markField, *batchSize, *pollEvery
+	t.Cleanup(func() {
+		*outboxNS, *outboxSink, *processed, *markField, *batchSize, *pollEvery = ns, s, p, field, batch, poll
+	})
+	*outboxNS, *outboxSink, *processed, *markField, *batchSize, *pollEvery = "app.outbox", "file:/dev/null", "mark", "publishedAt", 100, 30*time.Second
+}
+
+func TestCheckSettings(t *testing.T) {
+	settings(t)
+	if err := checkSettings(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		set  func()
+		want string
+	}{
+		{func() { *outboxNS = "outbox" }, "must be db.collection"},
+		{func() { *outboxNS = "app." }, "must be db.collection"},
+		{func() { *outboxSink = "" }, "OUTBOX_SINK must be set"},
+		{func() { *processed = "archive" }, "must be mark or delete"},
+		{func() { *batchSize = 0 }, "must be positive"},
+		{func() { *pollEvery = 0 }, "must be positive"},
+	} {
+		settings(t)
+		c.set()
+		if err := checkSettings(); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v, want %s", err, c.want)
+		}
+	}
+}
+
+func TestProcessed(t *testing.T) {
+	settings(t)
+	if p := privileges(); len(p) != 2 || p[1].DB != "app" || p[1].Collection != "outbox" || !reflect.DeepEqual(p[1].Actions, []string{"find", "update"}) {
+		t.Errorf("marking: %+v", p)
+	}
+	if got := pending(); !reflect.DeepEqual(got, bson.M{"publishedAt": bson.M{"$exists": false}}) {
+		t.Errorf("marking, pending %v", got)
+	}
+	*processed = "delete"
+	if p := privileges(); !reflect.DeepEqual(p[1].Actions, []string{"find", "remove"}) {
+		t.Errorf("deleting: %+v", p)
+	}
+	if got := pending(); len(got) != 0 {
+		t.Errorf("deleting, pending %v, want everything", got)
+	}
+}
+
+func TestIDString(t *testing.T) {
+	for _, c := range []struct {
+		id   interface{}
+		want string
+	}{
+		{bson.ObjectIdHex("5f1d7a9e8b3c4d2e1f0a9b8c"), "5f1d7a9e8b3c4d2e1f0a9b8c"},
+		{"order-1234", "order-1234"},
+		{1234, "1234"},
+		{bson.M{"a": 1}, `{"a":1}`},
+	} {
+		if got := idString(c.id); got != c.want {
+			t.Errorf("%#v: %s, want %s", c.id, got, c.want)
+		}
+	}
+}
+
+// published returns what r posted to its file sink at path
+func published(t *testing.T, path string) []struct {
+	Headers map[string][]string
+	Payload json.RawMessage
+} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []struct {
+		Headers map[string][]string
+		Payload json.RawMessage
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		out = append(out, struct {
+			Headers map[string][]string
+			Payload json.RawMessage
+		}{})
+		if err := json.Unmarshal(scanner.Bytes(), &out[len(out)-1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+func TestPost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker")
+	s, err := sink.Open("outbox", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &relay{sink: s, source: "/mongodb/app.outbox"}
+	id := bson.ObjectIdHex("5f1d7a9e8b3c4d2e1f0a9b8c")
+	for _, m := range []message{
+		{ID: id, AggregateType: "order", AggregateID: 1234, Type: "OrderPlaced",
+			Payload: bson.M{"total": 12.5}, Headers: map[string]string{"traceparent": "00-abc-def-01", "ce-type": "overridden"}},
+		{ID: "m2", Type: "OrderShipped", Payload: `{"carrier": "dhl"}`}, // json already
+		{ID: "m3", Type: "Note", Payload: "not json"},
+	} {
+		if err := r.post(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+	got := published(t, path)
+	if len(got) != 3 {
+		t.Fatalf("%d published, want 3", len(got))
+	}
+	want := map[string][]string{
+		"Content-Type":     {"application/json"},
+		"Ce-Specversion":   {"1.0"},
+		"Ce-Id":            {"5f1d7a9e8b3c4d2e1f0a9b8c"},
+		"Ce-Source":        {"/mongodb/app.outbox"},
+		"Ce-Type":          {"OrderPlaced"},
+		"Ce-Subject":       {"1234"},
+		"X-Aggregate-Type": {"order"},
+		"Traceparent":      {"00-abc-def-01"},
+	}
+	if !reflect.DeepEqual(got[0].Headers, want) {
+		t.Errorf("headers %v, want %v", got[0].Headers, want)
+	}
+	if string(got[0].Payload) != `{"total":12.5}` {
+		t.Errorf("payload %s", got[0].Payload)
+	}
+	if h := got[1].Headers; h["Ce-Subject"] != nil || h["X-Aggregate-Type"] != nil || string(got[1].Payload) != `{"carrier":"dhl"}` {
+		t.Errorf("without an aggregate: %v, %s", h, got[1].Payload)
+	}
+	if string(got[2].Payload) != `"not json"` {
+		t.Errorf("a string payload that isn't json: %s", got[2].Payload)
+	}
+}
+
+// TestDrain relays an outbox in order, marking then deleting what's
+// posted. It needs mongodb at MONGO_URL, and is skipped without one.
+func TestDrain(t *testing.T) {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("no mongodb, MONGO_URL is empty")
+	}
+	sess, err := mgo.DialWithTimeout(url, 2*time.Second)
+	if err != nil {
+		t.Skipf("no mongodb at MONGO_URL: %s", err)
+	}
+	defer sess.Close()
+	settings(t)
+	*batchSize = 2
+	c := sess.DB("outbox_test").C("outbox")
+	defer sess.DB("outbox_test").DropDatabase()
+	c.DropCollection()
+	for _, id := range []int{3, 1, 5, 2, 4} {
+		if err := c.Insert(bson.M{"_id": id, "type": "T", "payload": bson.M{"n": id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "broker")
+	s, err := sink.Open("outbox", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &relay{coll: c, sink: s, source: "test"}
+	if n, err := r.drain(); n != 5 || err != nil {
+		t.Fatalf("%d posted, %v", n, err)
+	}
+	if n, err := r.drain(); n != 0 || err != nil {
+		t.Errorf("drained again: %d posted, %v", n, err)
+	}
+	if n, _ := c.Find(bson.M{"publishedAt": bson.M{"$exists": true}}).Count(); n != 5 {
+		t.Errorf("%d marked", n)
+	}
+
+	*processed = "delete"
+	c.DropCollection()
+	c.Insert(bson.M{"_id": 7, "type": "T"}, bson.M{"_id": 6, "type": "T"})
+	if n, err := r.drain(); n != 2 || err != nil {
+		t.Errorf("deleting: %d posted, %v", n, err)
+	}
+	if n, _ := c.Count(); n != 0 {
+		t.Errorf("%d left", n)
+	}
+	s.Close()
+	var ids []string
+	for _, p := range published(t, path) {
+		ids = append(ids, p.Headers["Ce-Id"][0])
+	}
+	if want := "1 2 3 4 5 6 7"; strings.Join(ids, " ") != want {
+		t.Errorf("posted %v, want %s", ids, want)
+	}
+}
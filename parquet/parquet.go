@@ -0,0 +1,347 @@
+// Package parquet writes Apache Parquet files of flat rows: one row group,
+// uncompressed PLAIN encoded pages of a column at a time, optional columns'
+// nulls in RLE definition levels. That's what the tools write for
+// warehouses to load, not a general purpose writer.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Kind is what a column holds
+type Kind int
+
+const (
+	String    Kind = iota // string values, UTF8
+	JSON                  // string values of json
+	Int64                 // int64 values
+	Timestamp             // time.Time values, in milliseconds
+	Bool                  // bool values
+)
+
+// Column is a column of the rows written
+type Column struct {
+	Name     string
+	Kind     Kind
+	Optional bool // nil values are null, else they're not allowed
+}
+
+// physical types, repetitions, converted types, encodings and such of
+// parquet.thrift
+const (
+	typeBoolean   = 0
+	typeInt64     = 2
+	typeByteArray = 6
+
+	required = 0
+	optional = 1
+
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+	convertedJSON            = 19
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	uncompressed = 0
+	dataPage     = 0
+)
+
+// pageSize is about how much of a column goes in a page
+const pageSize = 1 << 20
+
+var magic = []byte("PAR1")
+
+// Marshal returns the file of rows, a value per column each
+func Marshal(columns []Column, rows [][]interface{}) ([]byte, error) {
+	var file bytes.Buffer
+	file.Write(magic)
+	var chunks [][]byte // each column's ColumnChunk
+	for c, col := range columns {
+		offset := int64(file.Len())
+		var size int64
+		for start := 0; start < len(rows) || start == 0; {
+			page, n, err := encodePage(col, c, rows[start:])
+			if err != nil {
+				return nil, err
+			}
+			file.Write(page)
+			size += int64(len(page))
+			if start += n; n == 0 {
+				break
+			}
+		}
+		var meta compact
+		meta.i32(1, physical(col.Kind))
+		encodings := []int32{encodingPlain}
+		if col.Optional {
+			encodings = append(encodings, encodingRLE)
+		}
+		meta.i32List(2, encodings)
+		meta.stringList(3, []string{col.Name})
+		meta.i32(4, uncompressed)
+		meta.i64(5, int64(len(rows)))
+		meta.i64(6, size)
+		meta.i64(7, size)
+		meta.i64(9, offset)
+		var chunk compact
+		chunk.i64(2, offset)
+		chunk.structField(3, meta.end())
+		chunks = append(chunks, chunk.end())
+	}
+	var footer compact
+	footer.i32(1, 1)
+	schema := [][]byte{schemaRoot(len(columns))}
+	for _, col := range columns {
+		schema = append(schema, schemaElement(col))
+	}
+	footer.structList(2, schema)
+	footer.i64(3, int64(len(rows)))
+	var group compact
+	group.structList(1, chunks)
+	group.i64(2, int64(file.Len()-len(magic)))
+	group.i64(3, int64(len(rows)))
+	footer.structList(4, [][]byte{group.end()})
+	footer.binary(6, []byte("oplog-abuse"))
+	meta := footer.end()
+	file.Write(meta)
+	binary.Write(&file, binary.LittleEndian, uint32(len(meta)))
+	file.Write(magic)
+	return file.Bytes(), nil
+}
+
+func physical(k Kind) int32 {
+	switch k {
+	case Int64, Timestamp:
+		return typeInt64
+	case Bool:
+		return typeBoolean
+	}
+	return typeByteArray
+}
+
+func schemaRoot(children int) []byte {
+	var e compact
+	e.binary(4, []byte("schema"))
+	e.i32(5, int32(children))
+	return e.end()
+}
+
+func schemaElement(col Column) []byte {
+	var e compact
+	e.i32(1, physical(col.Kind))
+	if col.Optional {
+		e.i32(3, optional)
+	} else {
+		e.i32(3, required)
+	}
+	e.binary(4, []byte(col.Name))
+	switch col.Kind {
+	case String:
+		e.i32(6, convertedUTF8)
+	case JSON:
+		e.i32(6, convertedJSON)
+	case Timestamp:
+		e.i32(6, convertedTimestampMillis)
+	}
+	return e.end()
+}
+
+// encodePage returns the page of column c of as many of rows as fill
+// one, and how many that is
+func encodePage(col Column, c int, rows [][]interface{}) ([]byte, int, error) {
+	var values bytes.Buffer
+	var levels []bool // whether each value's there
+	var bits byte     // booleans bit packed
+	nbits := 0
+	n := 0
+	for ; n < len(rows) && values.Len() < pageSize; n++ {
+		if len(rows[n]) <= c {
+			return nil, 0, fmt.Errorf("parquet: row without %s", col.Name)
+		}
+		v := rows[n][c]
+		if v == nil {
+			if !col.Optional {
+				return nil, 0, fmt.Errorf("parquet: %s is null", col.Name)
+			}
+			levels = append(levels, false)
+			continue
+		}
+		levels = append(levels, true)
+		var ok bool
+		switch col.Kind {
+		case String, JSON:
+			var s string
+			if s, ok = v.(string); ok {
+				binary.Write(&values, binary.LittleEndian, uint32(len(s)))
+				values.WriteString(s)
+			}
+		case Int64:
+			var i int64
+			if i, ok = v.(int64); ok {
+				binary.Write(&values, binary.LittleEndian, i)
+			}
+		case Timestamp:
+			var t time.Time
+			if t, ok = v.(time.Time); ok {
+				binary.Write(&values, binary.LittleEndian, t.UnixNano()/int64(time.Millisecond))
+			}
+		case Bool:
+			var b bool
+			if b, ok = v.(bool); ok {
+				if b {
+					bits |= 1 << uint(nbits)
+				}
+				if nbits++; nbits == 8 {
+					values.WriteByte(bits)
+					bits, nbits = 0, 0
+				}
+			}
+		}
+		if !ok {
+			return nil, 0, fmt.Errorf("parquet: %s can't be %T", col.Name, v)
+		}
+	}
+	if nbits > 0 {
+		values.WriteByte(bits)
+	}
+	var data bytes.Buffer
+	if col.Optional {
+		rle := definitionLevels(levels)
+		binary.Write(&data, binary.LittleEndian, uint32(len(rle)))
+		data.Write(rle)
+	}
+	data.Write(values.Bytes())
+
+	var header compact
+	header.i32(1, dataPage)
+	header.i32(2, int32(data.Len()))
+	header.i32(3, int32(data.Len()))
+	var dph compact
+	dph.i32(1, int32(n))
+	dph.i32(2, encodingPlain)
+	dph.i32(3, encodingRLE)
+	dph.i32(4, encodingRLE)
+	header.structField(5, dph.end())
+	return append(header.end(), data.Bytes()...), n, nil
+}
+
+// definitionLevels encodes levels of bit width 1 as RLE runs
+func definitionLevels(levels []bool) []byte {
+	var out []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = appendUvarint(out, uint64(j-i)<<1)
+		if levels[i] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		i = j
+	}
+	return out
+}
+
+// compact writes a struct in thrift's compact protocol, fields in
+// increasing id order
+type compact struct {
+	buf  []byte
+	last int16
+}
+
+// thrift compact types
+const (
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+func (c *compact) field(id int16, typ byte) {
+	if delta := id - c.last; delta > 0 && delta <= 15 {
+		c.buf = append(c.buf, byte(delta)<<4|typ)
+	} else {
+		c.buf = append(c.buf, typ)
+		c.buf = appendVarint(c.buf, int64(id))
+	}
+	c.last = id
+}
+
+func (c *compact) i32(id int16, v int32) {
+	c.field(id, ctI32)
+	c.buf = appendVarint(c.buf, int64(v))
+}
+
+func (c *compact) i64(id int16, v int64) {
+	c.field(id, ctI64)
+	c.buf = appendVarint(c.buf, v)
+}
+
+func (c *compact) binary(id int16, b []byte) {
+	c.field(id, ctBinary)
+	c.buf = appendUvarint(c.buf, uint64(len(b)))
+	c.buf = append(c.buf, b...)
+}
+
+func (c *compact) listHeader(id int16, elem byte, n int) {
+	c.field(id, ctList)
+	if n < 15 {
+		c.buf = append(c.buf, byte(n)<<4|elem)
+	} else {
+		c.buf = append(c.buf, 0xf0|elem)
+		c.buf = appendUvarint(c.buf, uint64(n))
+	}
+}
+
+func (c *compact) i32List(id int16, vs []int32) {
+	c.listHeader(id, ctI32, len(vs))
+	for _, v := range vs {
+		c.buf = appendVarint(c.buf, int64(v))
+	}
+}
+
+func (c *compact) stringList(id int16, vs []string) {
+	c.listHeader(id, ctBinary, len(vs))
+	for _, v := range vs {
+		c.buf = appendUvarint(c.buf, uint64(len(v)))
+		c.buf = append(c.buf, v...)
+	}
+}
+
+// structField writes a struct ended by end
+func (c *compact) structField(id int16, s []byte) {
+	c.field(id, ctStruct)
+	c.buf = append(c.buf, s...)
+}
+
+func (c *compact) structList(id int16, structs [][]byte) {
+	c.listHeader(id, ctStruct, len(structs))
+	for _, s := range structs {
+		c.buf = append(c.buf, s...)
+	}
+}
+
+// end returns the struct, ending it with a stop
+func (c *compact) end() []byte {
+	return append(c.buf, 0)
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
+
+// appendVarint appends n zigzag encoded, as thrift's compact ints are
+func appendVarint(b []byte, n int64) []byte {
+	return appendUvarint(b, uint64(n<<1^n>>63))
+}
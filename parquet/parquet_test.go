@@ -0,0 +1,227 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// thrift reads the compact protocol Marshal writes, structs as maps of
+// field id to value: int64, []byte, []interface{} or map[int16]interface{}
+type thrift struct {
+	b   []byte
+	err error
+}
+
+func (r *thrift) byte() byte {
+	if len(r.b) == 0 {
+		r.err = fmt.Errorf("thrift: truncated")
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *thrift) uvarint() uint64 {
+	n, size := binary.Uvarint(r.b)
+	if size <= 0 {
+		r.err = fmt.Errorf("thrift: bad varint")
+		return 0
+	}
+	r.b = r.b[size:]
+	return n
+}
+
+func (r *thrift) value(typ byte) interface{} {
+	switch typ {
+	case ctI32, ctI64:
+		n := r.uvarint()
+		return int64(n>>1) ^ -int64(n&1)
+	case ctBinary:
+		n := int(r.uvarint())
+		if n > len(r.b) {
+			r.err = fmt.Errorf("thrift: binary past the end")
+			return nil
+		}
+		v := r.b[:n]
+		r.b = r.b[n:]
+		return v
+	case ctList:
+		h := r.byte()
+		n, elem := int(h>>4), h&0x0f
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		var list []interface{}
+		for i := 0; i < n && r.err == nil; i++ {
+			list = append(list, r.value(elem))
+		}
+		return list
+	case ctStruct:
+		return r.fields()
+	}
+	r.err = fmt.Errorf("thrift: type %d", typ)
+	return nil
+}
+
+func (r *thrift) fields() map[int16]interface{} {
+	s := map[int16]interface{}{}
+	var id int16
+	for r.err == nil {
+		h := r.byte()
+		if h == 0 {
+			break
+		}
+		if delta := int16(h >> 4); delta > 0 {
+			id += delta
+		} else {
+			n := r.uvarint()
+			id = int16(int64(n>>1) ^ -int64(n&1))
+		}
+		s[id] = r.value(h & 0x0f)
+	}
+	return s
+}
+
+// footer checks file is framed as parquet and returns its FileMetaData
+func footer(t *testing.T, file []byte) map[int16]interface{} {
+	t.Helper()
+	if !bytes.HasPrefix(file, magic) || !bytes.HasSuffix(file, magic) {
+		t.Fatalf("not framed by PAR1: % x ... % x", file[:4], file[len(file)-4:])
+	}
+	n := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	if n <= 0 || n > len(file)-12 {
+		t.Fatalf("footer length %d in a file of %d bytes", n, len(file))
+	}
+	r := &thrift{b: file[len(file)-8-n : len(file)-8]}
+	meta := r.fields()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if len(r.b) != 0 {
+		t.Fatalf("%d bytes left after the footer's FileMetaData", len(r.b))
+	}
+	return meta
+}
+
+func TestMarshal(t *testing.T) {
+	columns := []Column{
+		{Name: "op", Kind: String},
+		{Name: "ts", Kind: Int64},
+		{Name: "at", Kind: Timestamp},
+		{Name: "doc", Kind: JSON, Optional: true},
+		{Name: "ok", Kind: Bool},
+	}
+	at := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	rows := [][]interface{}{
+		{"insert", int64(1), at, `{"_id":1}`, true},
+		{"delete", int64(2), at.Add(time.Second), nil, false},
+		{"update", int64(3), at.Add(2 * time.Second), `{"$set":{"a":1}}`, true},
+	}
+	data, err := Marshal(columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "part-0.parquet")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := footer(t, file)
+
+	if meta[1] != int64(1) {
+		t.Errorf("version %v, want 1", meta[1])
+	}
+	if meta[3] != int64(len(rows)) {
+		t.Errorf("num_rows %v, want %d", meta[3], len(rows))
+	}
+	if by, _ := meta[6].([]byte); string(by) != "oplog-abuse" {
+		t.Errorf("created_by %q", by)
+	}
+	schema, _ := meta[2].([]interface{})
+	if len(schema) != len(columns)+1 {
+		t.Fatalf("%d schema elements, want the root and %d columns", len(schema), len(columns))
+	}
+	root := schema[0].(map[int16]interface{})
+	if root[5] != int64(len(columns)) {
+		t.Errorf("the root has %v children, want %d", root[5], len(columns))
+	}
+	for i, col := range columns {
+		e := schema[i+1].(map[int16]interface{})
+		if name, _ := e[4].([]byte); string(name) != col.Name {
+			t.Errorf("schema element %d is %q, want %q", i+1, name, col.Name)
+		}
+		if e[1] != int64(physical(col.Kind)) {
+			t.Errorf("%s has type %v, want %d", col.Name, e[1], physical(col.Kind))
+		}
+		want := int64(required)
+		if col.Optional {
+			want = optional
+		}
+		if e[3] != want {
+			t.Errorf("%s has repetition %v, want %d", col.Name, e[3], want)
+		}
+	}
+
+	groups, _ := meta[4].([]interface{})
+	if len(groups) != 1 {
+		t.Fatalf("%d row groups, want 1", len(groups))
+	}
+	group := groups[0].(map[int16]interface{})
+	chunks, _ := group[1].([]interface{})
+	if len(chunks) != len(columns) || group[3] != int64(len(rows)) {
+		t.Fatalf("the row group has %d chunks of %v rows", len(chunks), group[3])
+	}
+	end := int64(len(magic))
+	for i, chunk := range chunks {
+		cm := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+		path, _ := cm[3].([]interface{})
+		if len(path) != 1 || string(path[0].([]byte)) != columns[i].Name {
+			t.Errorf("chunk %d has path %q", i, path)
+		}
+		if cm[5] != int64(len(rows)) {
+			t.Errorf("chunk %s has %v values, want %d", columns[i].Name, cm[5], len(rows))
+		}
+		// the chunks follow each other from the magic on
+		if cm[9] != end {
+			t.Errorf("chunk %s at %v, want %d", columns[i].Name, cm[9], end)
+		}
+		end += cm[6].(int64)
+	}
+	if footerAt := int64(len(file) - 8 - int(binary.LittleEndian.Uint32(file[len(file)-8:]))); end != footerAt {
+		t.Errorf("the chunks end at %d, the footer starts at %d", end, footerAt)
+	}
+}
+
+func TestMarshalEmpty(t *testing.T) {
+	data, err := Marshal([]Column{{Name: "op", Kind: String}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta := footer(t, data); meta[3] != int64(0) {
+		t.Errorf("num_rows %v of no rows", meta[3])
+	}
+}
+
+func TestMarshalInvalid(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		rows [][]interface{}
+	}{
+		{"null in a required column", [][]interface{}{{nil}}},
+		{"wrong type", [][]interface{}{{int64(1)}}},
+		{"short row", [][]interface{}{{}}},
+	} {
+		if _, err := Marshal([]Column{{Name: "op", Kind: String}}, c.rows); err == nil {
+			t.Errorf("%s marshaled", c.name)
+		}
+	}
+}
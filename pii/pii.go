@@ -0,0 +1,223 @@
+// Package pii tells which fields of a namespace's documents likely carry
+// personal data by what their string values look like: email addresses,
+// phone numbers or payment card numbers passing the Luhn check. A field is
+// tagged once enough of its values look like one kind.
+package pii
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Kinds of personal data detected
+const (
+	Email = "email"
+	Phone = "phone"
+	Card  = "card"
+)
+
+// maxPaths is how many untagged paths are tracked, past it new ones aren't
+const maxPaths = 10000
+
+var (
+	emailRe = regexp.MustCompile(`^[A-Za-z0-9._%+'-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}$`)
+	phoneRe = regexp.MustCompile(`^\+?[0-9 ().-]+$`)
+	cardRe  = regexp.MustCompile(`^[0-9][0-9 -]+[0-9]$`)
+	// dates and ip addresses, written with digits and separators too
+	notPhoneRe = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}|^[0-9]{1,3}(\.[0-9]{1,3}){3}$`)
+)
+
+// KindOf returns the kind of personal data s looks like, empty if none
+func KindOf(s string) string {
+	s = strings.TrimSpace(s)
+	switch {
+	case len(s) > 254:
+		return ""
+	case emailRe.MatchString(s):
+		return Email
+	case cardRe.MatchString(s) && luhn(digits(s)):
+		return Card
+	case phoneRe.MatchString(s) && phone(s):
+		return Phone
+	}
+	return ""
+}
+
+func digits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// luhn reports whether a card number of 13 to 19 digits checks out
+func luhn(number string) bool {
+	if len(number) < 13 || len(number) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range number {
+		d := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// phone reports whether s, made of digits and separators, is written as a
+// phone number: 7 to 15 digits, international or with separators so plain
+// numbers kept as strings aren't taken for ones
+func phone(s string) bool {
+	n := len(digits(s))
+	return !notPhoneRe.MatchString(s) && n >= 7 && n <= 15 && (s[0] == '+' || strings.ContainsAny(s, " ().-"))
+}
+
+// Tag is a field found to carry personal data
+type Tag struct {
+	Namespace string `json:"ns"`
+	Path      string `json:"path"` // array elements marked []
+	Kind      string `json:"kind"`
+	Matches   int64  `json:"matches"` // values looking like Kind
+	Values    int64  `json:"values"`  // string values seen
+}
+
+// Detector tags the fields of the documents it's shown. It's not safe for
+// concurrent use.
+type Detector struct {
+	minValues int64
+	rate      float64
+	paths     map[string]*path
+	tags      []Tag
+}
+
+type path struct {
+	values  int64
+	matches map[string]int64
+	tagged  bool
+}
+
+// New returns a detector tagging a field once it had minValues string
+// values and at least rate of them looked like one kind
+func New(minValues int, rate float64) *Detector {
+	return &Detector{minValues: int64(minValues), rate: rate, paths: make(map[string]*path)}
+}
+
+// Document looks at the string values of doc, returning the fields of ns
+// it tagged
+func (d *Detector) Document(ns string, doc bson.M) []Tag {
+	var tags []Tag
+	d.object(ns, "", doc, &tags)
+	return tags
+}
+
+// Update looks at the values an update as the oplog logs them from $v: 1
+// sets, returning the fields of ns it tagged. An update without operators
+// replaces the document.
+func (d *Detector) Update(ns string, update bson.M) []Tag {
+	var tags []Tag
+	operators := false
+	for name := range update {
+		operators = operators || strings.HasPrefix(name, "$")
+	}
+	if !operators {
+		return d.Document(ns, update)
+	}
+	set, _ := update["$set"].(bson.M)
+	for p, v := range set {
+		d.value(ns, elements(p), v, &tags)
+	}
+	return tags
+}
+
+// elements marks the numeric segments of a dotted path []
+func elements(p string) string {
+	segs := strings.Split(p, ".")
+	for i, seg := range segs {
+		if seg != "" && strings.Trim(seg, "0123456789") == "" {
+			segs[i] = "[]"
+		}
+	}
+	return strings.Replace(strings.Join(segs, "."), ".[]", "[]", -1)
+}
+
+func (d *Detector) object(ns, prefix string, doc bson.M, tags *[]Tag) {
+	for name, v := range doc {
+		p := name
+		if prefix != "" {
+			p = prefix + "." + name
+		}
+		d.value(ns, p, v, tags)
+	}
+}
+
+func (d *Detector) value(ns, p string, v interface{}, tags *[]Tag) {
+	switch v := v.(type) {
+	case bson.M:
+		d.object(ns, p, v, tags)
+	case bson.D:
+		d.object(ns, p, v.Map(), tags)
+	case []interface{}:
+		for _, e := range v {
+			d.value(ns, p+"[]", e, tags)
+		}
+	case string:
+		if tag, ok := d.see(ns, p, KindOf(v)); ok {
+			*tags = append(*tags, tag)
+		}
+	}
+}
+
+// see counts a string value at p of kind, tagging p once it's enough
+func (d *Detector) see(ns, p, kind string) (Tag, bool) {
+	key := ns + "\x00" + p
+	seen := d.paths[key]
+	if seen == nil {
+		if len(d.paths) >= maxPaths {
+			return Tag{}, false
+		}
+		seen = &path{matches: make(map[string]int64)}
+		d.paths[key] = seen
+	}
+	if seen.tagged {
+		return Tag{}, false
+	}
+	seen.values++
+	if kind != "" {
+		seen.matches[kind]++
+	}
+	if seen.values < d.minValues {
+		return Tag{}, false
+	}
+	for _, k := range []string{Email, Card, Phone} {
+		if n := seen.matches[k]; float64(n) >= d.rate*float64(seen.values) && n > 0 {
+			seen.tagged = true
+			seen.matches = nil
+			tag := Tag{Namespace: ns, Path: p, Kind: k, Matches: n, Values: seen.values}
+			d.tags = append(d.tags, tag)
+			return tag, true
+		}
+	}
+	return Tag{}, false
+}
+
+// Tags returns every field tagged so far, by namespace and path
+func (d *Detector) Tags() []Tag {
+	tags := append([]Tag(nil), d.tags...)
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Namespace != tags[j].Namespace {
+			return tags[i].Namespace < tags[j].Namespace
+		}
+		return tags[i].Path < tags[j].Path
+	})
+	return tags
+}
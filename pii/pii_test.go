@@ -0,0 +1,162 @@
+package pii
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestKindOf(t *testing.T) {
+	for _, c := range []struct {
+		s, kind string
+	}{
+		{"ada@example.com", Email},
+		{" a.b+tag@mail.example.co.uk ", Email},
+		{"o'brien@example.ie", Email},
+		{"ada@localhost", ""},
+		{"ada@example.c", ""},
+		{"ada at example.com", ""},
+		{"+33 1 23 45 67 89", Phone},
+		{"+442071838750", Phone},
+		{"(555) 123-4567", Phone},
+		{"555.123.4567", Phone},
+		{"5551234567", ""}, // a number kept as a string
+		{"+1 234", ""},     // too few digits
+		{"+1234567890123456", ""},
+		{"2026-10-14", ""},
+		{"2026-10-14 12:00", ""},
+		{"192.168.1.10", ""},
+		{"4111 1111 1111 1111", Card},
+		{"4111111111111111", Card},
+		{"5555-5555-5555-4444", Card},
+		{"378282246310005", Card},
+		{"4111 1111 1111 1112", ""}, // fails the luhn check, too long for a phone
+		{"4111111111111112", ""},
+		{"0000 0000 0000", Phone}, // passes luhn, but 12 digits are too few for a card
+		{"", ""},
+		{"ada", ""},
+	} {
+		if kind := KindOf(c.s); kind != c.kind {
+			t.Errorf("%q is %q, want %q", c.s, kind, c.kind)
+		}
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	for _, c := range []struct {
+		minValues int
+		rate      float64
+		values    []interface{}
+		tagged    int // the value tagging it, counting from 1, 0 for none
+	}{
+		{3, 0.5, []interface{}{"ada@example.com", "ada@example.com", "ada@example.com"}, 3},
+		{3, 0.5, []interface{}{"ada@example.com", "none", "none", "ada@example.com"}, 4},
+		{3, 0.5, []interface{}{"none", "none", "none", "ada@example.com", "none"}, 0},
+		{1, 1, []interface{}{"ada@example.com"}, 1},
+		{2, 1, []interface{}{"ada@example.com", "none", "ada@example.com"}, 0},
+		// only strings count
+		{2, 1, []interface{}{"ada@example.com", 7, nil, true, "ada@example.com"}, 5},
+		// mixed kinds count apart
+		{2, 0.6, []interface{}{"ada@example.com", "+33 1 23 45 67 89", "4111111111111111"}, 0},
+	} {
+		d := New(c.minValues, c.rate)
+		tagged := 0
+		for i, v := range c.values {
+			if tags := d.Document("db.users", bson.M{"contact": v}); len(tags) != 0 {
+				if tagged != 0 {
+					t.Errorf("%v: tagged again at %d", c.values, i+1)
+				}
+				tagged = i + 1
+			}
+		}
+		if tagged != c.tagged {
+			t.Errorf("%d %.1f %v: tagged at %d, want %d", c.minValues, c.rate, c.values, tagged, c.tagged)
+		}
+	}
+}
+
+func TestTag(t *testing.T) {
+	d := New(2, 0.5)
+	d.Document("db.users", bson.M{"phone": "+33 1 23 45 67 89"})
+	tags := d.Document("db.users", bson.M{"phone": "n/a"})
+	want := []Tag{{Namespace: "db.users", Path: "phone", Kind: Phone, Matches: 1, Values: 2}}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("tagged %+v, want %+v", tags, want)
+	}
+}
+
+func TestMaxPaths(t *testing.T) {
+	d := New(1, 0.5)
+	for i := 0; i < maxPaths; i++ {
+		d.Document("db.users", bson.M{fmt.Sprintf("f%d", i): "none"})
+	}
+	if tags := d.Document("db.users", bson.M{"email": "ada@example.com"}); len(tags) != 0 {
+		t.Errorf("tagged %+v past the cap", tags)
+	}
+	if n := len(d.paths); n != maxPaths {
+		t.Errorf("%d paths tracked, want %d", n, maxPaths)
+	}
+	// the ones tracked still are
+	if tags := d.Document("db.users", bson.M{"f7": "ada@example.com"}); len(tags) != 1 {
+		t.Errorf("tagged %+v of a tracked path", tags)
+	}
+}
+
+func TestDocumentPaths(t *testing.T) {
+	d := New(1, 1)
+	d.Document("db.users", bson.M{
+		"email":    "ada@example.com",
+		"profile":  bson.M{"card": "4111111111111111"},
+		"contacts": []interface{}{bson.M{"phone": "+33 1 23 45 67 89"}, "bob@example.com"},
+		"legacy":   bson.D{{Name: "mail", Value: "ada@example.com"}},
+		"grid":     []interface{}{[]interface{}{"ada@example.com"}},
+	})
+	d.Document("db.orders", bson.M{"email": "ada@example.com"})
+	var got []string
+	for _, tag := range d.Tags() {
+		got = append(got, tag.Namespace+" "+tag.Path+" "+tag.Kind)
+	}
+	want := []string{
+		"db.orders email email",
+		"db.users contacts[] email",
+		"db.users contacts[].phone phone",
+		"db.users email email",
+		"db.users grid[][] email",
+		"db.users legacy.mail email",
+		"db.users profile.card card",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tagged\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	for _, c := range []struct {
+		update bson.M
+		paths  []string
+	}{
+		// without operators it replaces the document
+		{bson.M{"_id": 1, "email": "ada@example.com", "profile": bson.M{"phone": "+33 1 23 45 67 89"}}, []string{"email", "profile.phone"}},
+		{bson.M{"$set": bson.M{"email": "ada@example.com", "name": "ada"}}, []string{"email"}},
+		{bson.M{"$set": bson.M{"addresses.1.email": "ada@example.com"}}, []string{"addresses[].email"}},
+		{bson.M{"$set": bson.M{"grid.0.12": "ada@example.com"}}, []string{"grid[][]"}},
+		{bson.M{"$set": bson.M{"addresses.1": bson.M{"email": "ada@example.com"}}}, []string{"addresses[].email"}},
+		{bson.M{"$set": bson.M{"emails": []interface{}{"ada@example.com"}}}, []string{"emails[]"}},
+		{bson.M{"$set": bson.M{"v2020.email": "ada@example.com"}}, []string{"v2020.email"}},
+		// only what's set is looked at
+		{bson.M{"$unset": bson.M{"email": ""}, "$inc": bson.M{"n": 1}}, nil},
+		{bson.M{"$set": bson.M{"n": 1}, "$push": bson.M{"emails": "ada@example.com"}}, nil},
+	} {
+		var paths []string
+		for _, tag := range New(1, 1).Update("db.users", c.update) {
+			paths = append(paths, tag.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, c.paths) {
+			t.Errorf("%v tagged %q, want %q", c.update, paths, c.paths)
+		}
+	}
+}
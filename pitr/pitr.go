@@ -0,0 +1,215 @@
+// Package pitr lays out an oplog archive for point in time recovery: base
+// markers, the ts a base backup was started at, and segments of the oplog
+// from there on, each a bson file of the entries between two ts. Restoring
+// is loading the base backup then replaying the segments after its marker
+// up to the point wanted.
+package pitr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Store is where an archive is kept
+type Store interface {
+	Put(name string, data []byte) error
+	Open(name string) (io.ReadCloser, error)
+	List() ([]string, error) // names, sorted
+}
+
+// Open returns the store spec names, a directory or s3://bucket/prefix
+func Open(spec string) (Store, error) {
+	if strings.HasPrefix(spec, "s3://") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		return newS3Store(u)
+	}
+	if err := os.MkdirAll(spec, 0755); err != nil {
+		return nil, err
+	}
+	return dirStore(spec), nil
+}
+
+type dirStore string
+
+func (d dirStore) String() string {
+	return string(d)
+}
+
+// Put writes name in full or not at all
+func (d dirStore) Put(name string, data []byte) error {
+	path := filepath.Join(string(d), name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (d dirStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), name))
+}
+
+func (d dirStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && !strings.HasSuffix(info.Name(), ".tmp") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Segment is an archived range of the oplog, entries after After up to
+// and including Last
+type Segment struct {
+	After, Last bson.MongoTimestamp
+}
+
+// Name is the file name, hex ts so names sort in oplog order
+func (s Segment) Name() string {
+	return fmt.Sprintf("oplog-%016x-%016x.bson", uint64(s.After), uint64(s.Last))
+}
+
+func parseSegment(name string) (Segment, bool) {
+	var after, last uint64
+	if _, err := fmt.Sscanf(name, "oplog-%016x-%016x.bson", &after, &last); err != nil {
+		return Segment{}, false
+	}
+	// Sscanf takes shorter hex, and ignores what's past the format
+	seg := Segment{bson.MongoTimestamp(after), bson.MongoTimestamp(last)}
+	return seg, seg.Name() == name
+}
+
+// Segments lists the store's segments in order
+func Segments(s Store) ([]Segment, error) {
+	names, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var segments []Segment
+	for _, name := range names {
+		if seg, ok := parseSegment(name); ok {
+			segments = append(segments, seg)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].After < segments[j].After })
+	return segments, nil
+}
+
+// Covering returns the segments holding the entries after since up to
+// until, 0 being the end, erroring on gaps between them
+func Covering(s Store, since, until bson.MongoTimestamp) ([]Segment, error) {
+	segments, err := Segments(s)
+	if err != nil {
+		return nil, err
+	}
+	var covering []Segment
+	pos := since
+	for _, seg := range segments {
+		if seg.Last <= since || (until != 0 && seg.After >= until) {
+			continue
+		}
+		if seg.After > pos {
+			return nil, fmt.Errorf("archive %s has a gap after %d, next segment starts after %d", s, pos, seg.After)
+		}
+		covering = append(covering, seg)
+		pos = seg.Last
+	}
+	if len(covering) == 0 {
+		return nil, fmt.Errorf("archive %s holds nothing after %d", s, since)
+	}
+	if until != 0 && pos < until {
+		fmt.Fprintf(os.Stderr, "archive %s only goes up to %d\n", s, pos)
+	}
+	return covering, nil
+}
+
+// Base marks a base backup, started once the oplog was at TS. Replaying
+// from TS over the backup brings it to a consistent state, entries it
+// already reflects being applied harmlessly.
+type Base struct {
+	Name string              `json:"name"`
+	TS   bson.MongoTimestamp `json:"ts"`
+	At   time.Time           `json:"at"`
+}
+
+func baseName(name string) string {
+	return "base-" + name + ".json"
+}
+
+// PutBase records b
+func PutBase(s Store, b Base) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return s.Put(baseName(b.Name), data)
+}
+
+// Bases lists the store's base markers, oldest first
+func Bases(s Store) ([]Base, error) {
+	names, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var bases []Base
+	for _, name := range names {
+		if !strings.HasPrefix(name, "base-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		b, err := readBase(s, name)
+		if err != nil {
+			return nil, err
+		}
+		bases = append(bases, b)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i].TS < bases[j].TS })
+	return bases, nil
+}
+
+// GetBase reads the marker called name
+func GetBase(s Store, name string) (Base, error) {
+	return readBase(s, baseName(name))
+}
+
+func readBase(s Store, name string) (Base, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return Base{}, err
+	}
+	defer r.Close()
+	var b Base
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return Base{}, fmt.Errorf("%s: %s", name, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,152 @@
+package pitr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSegmentName(t *testing.T) {
+	seg := Segment{After: 5<<32 | 1, Last: 7<<32 | 3}
+	name := seg.Name()
+	if name != "oplog-0000000500000001-0000000700000003.bson" {
+		t.Errorf("name %s", name)
+	}
+	if got, ok := parseSegment(name); !ok || got != seg {
+		t.Errorf("parsed %v %v, want %v", got, ok, seg)
+	}
+	for _, name := range []string{"base-nightly.json", "oplog-5-7.bson", "oplog-0000000500000001.bson", name + ".tmp", "notes.txt"} {
+		if seg, ok := parseSegment(name); ok {
+			t.Errorf("%s parsed as %v", name, seg)
+		}
+	}
+	// names sort as the oplog does, past the 32 bits of a decimal
+	if a, b := (Segment{After: 9 << 32}).Name(), (Segment{After: 10 << 32}).Name(); a >= b {
+		t.Errorf("%s sorts after %s", a, b)
+	}
+}
+
+// archive is a directory store holding segments between the ts given,
+// each a segment's After and Last
+func archive(t *testing.T, bounds ...bson.MongoTimestamp) Store {
+	s, err := Open(filepath.Join(t.TempDir(), "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(bounds); i += 2 {
+		if err := s.Put(Segment{bounds[i], bounds[i+1]}.Name(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestCovering(t *testing.T) {
+	s := archive(t, 0, 10, 10, 20, 20, 30, 40, 50)
+	for _, c := range []struct {
+		since, until bson.MongoTimestamp
+		want         []Segment
+		err          string
+	}{
+		{0, 30, []Segment{{0, 10}, {10, 20}, {20, 30}}, ""},
+		{5, 15, []Segment{{0, 10}, {10, 20}}, ""},
+		{10, 20, []Segment{{10, 20}}, ""},
+		{10, 21, []Segment{{10, 20}, {20, 30}}, ""},
+		{25, 0, nil, "gap after 30"},
+		{0, 45, nil, "gap after 30"},
+		{40, 0, []Segment{{40, 50}}, ""},
+		{50, 0, nil, "holds nothing after 50"},
+	} {
+		got, err := Covering(s, c.since, c.until)
+		switch {
+		case c.err != "":
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%d to %d: %v, want %q", c.since, c.until, err, c.err)
+			}
+		case err != nil:
+			t.Errorf("%d to %d: %s", c.since, c.until, err)
+		case !reflect.DeepEqual(got, c.want):
+			t.Errorf("%d to %d: %v, want %v", c.since, c.until, got, c.want)
+		}
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("b", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("a", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	// what's left of a put that didn't finish
+	if err := ioutil.WriteFile(filepath.Join(dir, "c.tmp"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	names, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("listed %v, want [a b]", names)
+	}
+	r, err := s.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "first" {
+		t.Errorf("read %q", data)
+	}
+	if err := s.Put("a", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "a")); string(data) != "again" {
+		t.Errorf("overwritten with %q", data)
+	}
+}
+
+func TestBases(t *testing.T) {
+	s := archive(t, 0, 10)
+	at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, b := range []Base{{"late", 30, at.Add(time.Hour)}, {"early", 10, at}} {
+		if err := PutBase(s, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bases, err := Bases(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bases) != 2 || bases[0].Name != "early" || bases[1].Name != "late" {
+		t.Fatalf("bases %v, want early then late", bases)
+	}
+	b, err := GetBase(s, "late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.TS != 30 || !b.At.Equal(at.Add(time.Hour)) {
+		t.Errorf("got %v", b)
+	}
+	if _, err := GetBase(s, "missing"); err == nil {
+		t.Error("a missing base read")
+	}
+	if err := s.Put("base-broken.json", []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Bases(s); err == nil || !strings.Contains(err.Error(), "base-broken.json") {
+		t.Errorf("a broken marker: %v", err)
+	}
+}
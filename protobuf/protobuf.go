@@ -0,0 +1,254 @@
+// Package protobuf writes oplog entries as protocol buffers, the Document
+// message of oplog.proto: an entry's fields in order, each value a oneof of
+// the bson types, so it's kept as is, but for the deprecated undefined,
+// symbol and db pointer types that aren't encoded. That's what dump writes
+// for FORMAT=proto, not a general purpose encoder.
+package protobuf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// the fields of Value's oneof
+const (
+	valueNull = iota + 1
+	valueBool
+	valueInt32
+	valueInt64
+	valueDouble
+	valueString
+	valueDocument
+	valueArray
+	valueObjectID
+	valueDecimal128
+	valueDate
+	valueTimestamp
+	valueBinary
+	valueRegex
+	valueJavaScript
+	valueBound
+)
+
+// Marshal returns the Document message of an entry, the raw bson of it
+func Marshal(raw []byte) ([]byte, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var e encoder
+	if err := e.document(doc); err != nil {
+		return nil, err
+	}
+	return e.b, nil
+}
+
+// Writer writes entries to w as Document messages, each prefixed by its
+// length as a varint
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter returns a Writer to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write writes an entry, the raw bson of it
+func (w *Writer) Write(raw []byte) error {
+	msg, err := Marshal(raw)
+	if err != nil {
+		return err
+	}
+	w.buf = appendUvarint(w.buf[:0], uint64(len(msg)))
+	w.buf = append(w.buf, msg...)
+	_, err = w.w.Write(w.buf)
+	return err
+}
+
+// encoder appends the fields of a message to b
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) tag(field, wire int) {
+	e.b = appendUvarint(e.b, uint64(field<<3|wire))
+}
+
+func (e *encoder) varint(field int, n uint64) {
+	e.tag(field, wireVarint)
+	e.b = appendUvarint(e.b, n)
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.tag(field, wireBytes)
+	e.b = appendUvarint(e.b, uint64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// message appends the message encode writes as field
+func (e *encoder) message(field int, encode func(m *encoder) error) error {
+	var m encoder
+	if err := encode(&m); err != nil {
+		return err
+	}
+	e.bytes(field, m.b)
+	return nil
+}
+
+// the fields of messages other than the oneof's are left out when they're
+// the zero value, as proto3 has them
+
+func (e *encoder) optVarint(field int, n uint64) {
+	if n != 0 {
+		e.varint(field, n)
+	}
+}
+
+func (e *encoder) optBytes(field int, b []byte) {
+	if len(b) != 0 {
+		e.bytes(field, b)
+	}
+}
+
+func (e *encoder) document(doc bson.D) error {
+	for _, f := range doc {
+		err := e.message(1, func(m *encoder) error {
+			m.optBytes(1, []byte(f.Name))
+			return m.message(2, func(m *encoder) error { return m.value(f.Value) })
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *encoder) value(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.varint(valueNull, 0)
+	case bool:
+		if v {
+			e.varint(valueBool, 1)
+		} else {
+			e.varint(valueBool, 0)
+		}
+	case int:
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			e.varint(valueInt64, uint64(v))
+		} else {
+			e.varint(valueInt32, uint64(v))
+		}
+	case int64:
+		e.varint(valueInt64, uint64(v))
+	case float64:
+		e.tag(valueDouble, wireFixed64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		e.b = append(e.b, b[:]...)
+	case string:
+		e.bytes(valueString, []byte(v))
+	case bson.D:
+		return e.message(valueDocument, func(m *encoder) error { return m.document(v) })
+	case bson.M:
+		return e.message(valueDocument, func(m *encoder) error { return m.document(sorted(v)) })
+	case []interface{}:
+		return e.message(valueArray, func(m *encoder) error {
+			for i, elem := range v {
+				if err := m.message(1, func(m *encoder) error { return m.value(elem) }); err != nil {
+					return fmt.Errorf("%d: %s", i, err)
+				}
+			}
+			return nil
+		})
+	case bson.ObjectId:
+		if len(v) != 12 {
+			return fmt.Errorf("object id of %d bytes", len(v))
+		}
+		e.bytes(valueObjectID, []byte(v))
+	case bson.Decimal128:
+		e.bytes(valueDecimal128, []byte(v.String()))
+	case time.Time:
+		e.varint(valueDate, uint64(v.Unix()*1e3+int64(v.Nanosecond()/1e6)))
+	case bson.MongoTimestamp:
+		return e.message(valueTimestamp, func(m *encoder) error {
+			m.optVarint(1, uint64(v)>>32)
+			m.optVarint(2, uint64(uint32(v)))
+			return nil
+		})
+	case []byte:
+		return e.message(valueBinary, func(m *encoder) error {
+			m.optBytes(2, v)
+			return nil
+		})
+	case bson.Binary:
+		return e.message(valueBinary, func(m *encoder) error {
+			m.optVarint(1, uint64(v.Kind))
+			m.optBytes(2, v.Data)
+			return nil
+		})
+	case bson.RegEx:
+		return e.message(valueRegex, func(m *encoder) error {
+			m.optBytes(1, []byte(v.Pattern))
+			m.optBytes(2, []byte(v.Options))
+			return nil
+		})
+	case bson.JavaScript:
+		return e.message(valueJavaScript, func(m *encoder) error {
+			m.optBytes(1, []byte(v.Code))
+			switch scope := v.Scope.(type) {
+			case nil:
+				return nil
+			case bson.D:
+				return m.message(2, func(m *encoder) error { return m.document(scope) })
+			case bson.M:
+				return m.message(2, func(m *encoder) error { return m.document(sorted(scope)) })
+			}
+			return fmt.Errorf("javascript scope of %T", v.Scope)
+		})
+	default:
+		switch v {
+		case bson.MinKey:
+			e.varint(valueBound, 0)
+		case bson.MaxKey:
+			e.varint(valueBound, 1)
+		default:
+			return fmt.Errorf("can't encode %T", v)
+		}
+	}
+	return nil
+}
+
+// sorted returns m as a document in the order of its keys, which a map
+// doesn't keep
+func sorted(m bson.M) bson.D {
+	doc := make(bson.D, 0, len(m))
+	for k, v := range m {
+		doc = append(doc, bson.DocElem{Name: k, Value: v})
+	}
+	sort.Slice(doc, func(i, j int) bool { return doc[i].Name < doc[j].Name })
+	return doc
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
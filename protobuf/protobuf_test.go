@@ -0,0 +1,323 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/oplogtest"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// reader reads messages back, by the wire format alone: fields is a
+// message's fields in order, each an uint64 or []byte
+type reader struct {
+	b   []byte
+	err error
+}
+
+type field struct {
+	num   int
+	value interface{}
+}
+
+func (r *reader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+	r.b = nil
+}
+
+func (r *reader) uvarint() uint64 {
+	n, size := binary.Uvarint(r.b)
+	if size <= 0 {
+		r.fail("bad varint")
+		return 0
+	}
+	r.b = r.b[size:]
+	return n
+}
+
+func (r *reader) fixed(n int) []byte {
+	if n < 0 || n > len(r.b) {
+		r.fail("%d bytes past the end", n)
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) fields() []field {
+	var fields []field
+	for r.err == nil && len(r.b) > 0 {
+		tag := r.uvarint()
+		f := field{num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			f.value = r.uvarint()
+		case wireFixed64:
+			f.value = binary.LittleEndian.Uint64(r.fixed(8))
+		case wireBytes:
+			f.value = r.fixed(int(r.uvarint()))
+		default:
+			r.fail("wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func (r *reader) sub(b interface{}) *reader {
+	data, ok := b.([]byte)
+	if !ok {
+		r.fail("%T isn't a message", b)
+	}
+	return &reader{b: data, err: r.err}
+}
+
+// document reads a Document as a bson.D of the types bson.Unmarshal gives
+func (r *reader) document() bson.D {
+	doc := bson.D{}
+	for _, f := range r.fields() {
+		if f.num != 1 {
+			r.fail("Document field %d", f.num)
+		}
+		var e bson.DocElem
+		fr := r.sub(f.value)
+		for _, f := range fr.fields() {
+			switch f.num {
+			case 1:
+				e.Name = string(f.value.([]byte))
+			case 2:
+				e.Value = fr.value(fr.sub(f.value).fields())
+			}
+		}
+		if fr.err != nil {
+			r.fail("%s", fr.err)
+		}
+		doc = append(doc, e)
+	}
+	return doc
+}
+
+// value reads the fields of a Value
+func (r *reader) value(fields []field) interface{} {
+	if len(fields) != 1 {
+		r.fail("Value of %d fields", len(fields))
+		return nil
+	}
+	f := fields[0]
+	// the fields of a message value, numbered
+	sub := func() map[int]interface{} {
+		m := make(map[int]interface{})
+		for _, f := range r.sub(f.value).fields() {
+			m[f.num] = f.value
+		}
+		return m
+	}
+	str := func(v interface{}) string { b, _ := v.([]byte); return string(b) }
+	num := func(v interface{}) uint64 { n, _ := v.(uint64); return n }
+	switch f.num {
+	case valueNull:
+		return nil
+	case valueBool:
+		return num(f.value) == 1
+	case valueInt32:
+		return int(int32(num(f.value)))
+	case valueInt64:
+		return int64(num(f.value))
+	case valueDouble:
+		return math.Float64frombits(num(f.value))
+	case valueString:
+		return str(f.value)
+	case valueDocument:
+		return r.sub(f.value).document()
+	case valueArray:
+		array := []interface{}{}
+		a := r.sub(f.value)
+		for _, elem := range a.fields() {
+			array = append(array, a.value(a.sub(elem.value).fields()))
+		}
+		if a.err != nil {
+			r.fail("%s", a.err)
+		}
+		return array
+	case valueObjectID:
+		return bson.ObjectId(str(f.value))
+	case valueDecimal128:
+		d, err := bson.ParseDecimal128(str(f.value))
+		if err != nil {
+			r.fail("%s", err)
+		}
+		return d
+	case valueDate:
+		// as bson.Unmarshal reads it, the zero time.Time in UTC
+		if ms := int64(num(f.value)); ms != -62135596800000 {
+			return time.Unix(ms/1e3, ms%1e3*1e6)
+		}
+		return time.Time{}
+	case valueTimestamp:
+		m := sub()
+		return bson.MongoTimestamp(num(m[1])<<32 | num(m[2]))
+	case valueBinary:
+		m := sub()
+		data, _ := m[2].([]byte)
+		if data == nil {
+			data = []byte{}
+		}
+		if num(m[1]) == 0 {
+			return data
+		}
+		return bson.Binary{Kind: byte(num(m[1])), Data: data}
+	case valueRegex:
+		m := sub()
+		return bson.RegEx{Pattern: str(m[1]), Options: str(m[2])}
+	case valueJavaScript:
+		m := sub()
+		js := bson.JavaScript{Code: str(m[1])}
+		if m[2] != nil {
+			scope := bson.M{}
+			for _, e := range r.sub(m[2]).document() {
+				scope[e.Name] = e.Value
+			}
+			js.Scope = scope
+		}
+		return js
+	case valueBound:
+		if num(f.value) == 0 {
+			return bson.MinKey
+		}
+		return bson.MaxKey
+	}
+	r.fail("Value field %d", f.num)
+	return nil
+}
+
+func TestWriter(t *testing.T) {
+	var docs []bson.D
+	var file bytes.Buffer
+	w := NewWriter(&file)
+	for _, e := range oplogtest.Representative() {
+		raw, err := bson.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc bson.D
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+		if err := w.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oplogtest.Golden(t, "testdata/representative.pb.hex", []byte(hex.Dump(file.Bytes())))
+
+	r := &reader{b: file.Bytes()}
+	for i := 0; r.err == nil && len(r.b) > 0; i++ {
+		msg := &reader{b: r.fixed(int(r.uvarint()))}
+		doc := msg.document()
+		if msg.err != nil {
+			t.Fatalf("entry %d: %s", i, msg.err)
+		}
+		if i >= len(docs) {
+			t.Fatalf("more than %d entries", len(docs))
+		}
+		if !reflect.DeepEqual(doc, docs[i]) {
+			t.Errorf("entry %d read back as\n%#v\nwant\n%#v", i, doc, docs[i])
+		}
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	for _, c := range []struct {
+		doc bson.D
+		msg string
+	}{
+		// the encoding's own example, 150 as a varint
+		{bson.D{{Name: "a", Value: 150}}, "0a08 0a0161 1203 189601"},
+		{bson.D{{Name: "a", Value: -1}}, "0a10 0a0161 120b 18ffffffffffffffffff01"},
+		{bson.D{{Name: "a", Value: int64(1)}}, "0a07 0a0161 1202 2001"},
+		{bson.D{{Name: "a", Value: false}}, "0a07 0a0161 1202 1000"},
+		{bson.D{{Name: "a", Value: nil}}, "0a07 0a0161 1202 0800"},
+		{bson.D{{Name: "a", Value: 1.0}}, "0a0e 0a0161 1209 29000000000000f03f"},
+		{bson.D{{Name: "a", Value: ""}}, "0a07 0a0161 1202 3200"},
+		{bson.D{{Name: "", Value: "x"}}, "0a05 1203 320178"},
+		{bson.D{{Name: "a", Value: bson.D{}}}, "0a07 0a0161 1202 3a00"},
+		{bson.D{{Name: "a", Value: []interface{}{}}}, "0a07 0a0161 1202 4200"},
+		{bson.D{{Name: "a", Value: []interface{}{true}}}, "0a0b 0a0161 1206 4204 0a021001"},
+		{bson.D{{Name: "a", Value: bson.MongoTimestamp(0)}}, "0a07 0a0161 1202 6200"},
+		{bson.D{{Name: "a", Value: bson.MongoTimestamp(1<<32 | 2)}}, "0a0b 0a0161 1206 6204 08011002"},
+		{bson.D{{Name: "a", Value: bson.MaxKey}}, "0a08 0a0161 1203 800101"},
+		{bson.D{}, ""},
+	} {
+		raw, err := bson.Marshal(c.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := Marshal(raw)
+		if err != nil {
+			t.Errorf("%v: %s", c.doc, err)
+			continue
+		}
+		if want := strings.Replace(c.msg, " ", "", -1); hex.EncodeToString(msg) != want {
+			t.Errorf("%v: %x, want %s", c.doc, msg, want)
+		}
+	}
+}
+
+func TestMarshalValues(t *testing.T) {
+	for _, v := range []interface{}{
+		nil, true, false, 0, -1, math.MaxInt32, int64(math.MinInt64), 0.5, math.Inf(-1), "", "é",
+		bson.D{}, bson.D{{Name: "a", Value: bson.D{{Name: "b", Value: []interface{}{}}}}},
+		[]interface{}{1, "a", []interface{}{nil}},
+		bson.NewObjectId(),
+		time.Date(1969, 12, 31, 23, 59, 59, 999e6, time.UTC), time.Time{},
+		bson.MongoTimestamp(1700000000<<32 | 7), bson.MongoTimestamp(-1),
+		[]byte{}, bson.Binary{Kind: 0x80, Data: []byte{1}}, bson.Binary{Kind: 4},
+		bson.RegEx{}, bson.RegEx{Pattern: "^a", Options: "im"},
+		bson.JavaScript{Code: "x"}, bson.JavaScript{Code: "x + y", Scope: bson.M{"y": 1}}, bson.JavaScript{Scope: bson.M{}},
+		bson.MinKey, bson.MaxKey,
+	} {
+		raw, err := bson.Marshal(bson.D{{Name: "v", Value: v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bson.D
+		if err := bson.Unmarshal(raw, &want); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := Marshal(raw)
+		if err != nil {
+			t.Errorf("%#v: %s", v, err)
+			continue
+		}
+		r := &reader{b: msg}
+		if got := r.document(); r.err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%#v read back as %#v, %v", v, got, r.err)
+		}
+	}
+}
+
+func TestMarshalDeprecated(t *testing.T) {
+	for _, v := range []interface{}{bson.Undefined, bson.Symbol("s"), bson.DBPointer{Namespace: "a.b", Id: bson.NewObjectId()}} {
+		raw, err := bson.Marshal(bson.D{{Name: "a", Value: []interface{}{v}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Marshal(raw); err == nil || !strings.HasPrefix(err.Error(), "a: 0: can't encode") {
+			t.Errorf("%#v: %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Package remap renames namespaces so data can be applied under other
+// names than it was written with, such as a copy per tenant.
+package remap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rules rename single collections, whole dbs or dbs by prefix, the first
+// of these matching taking precedence and the longest prefix of several.
+// A nil Rules renames nothing.
+type Rules struct {
+	dbs      map[string]string
+	prefixes [][2]string // longest first
+	colls    map[string]string
+}
+
+// Parse parses a comma separated list of rules, from=to or from->to, both
+// sides db, db.* , db prefix* or db.collection
+func Parse(s string) (*Rules, error) {
+	r := &Rules{dbs: make(map[string]string), colls: make(map[string]string)}
+	if strings.TrimSpace(s) == "" {
+		return r, nil
+	}
+	for _, rule := range strings.Split(s, ",") {
+		from, to, err := parseRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasSuffix(from, "*"):
+			r.prefixes = append(r.prefixes, [2]string{strings.TrimSuffix(from, "*"), strings.TrimSuffix(to, "*")})
+		case strings.Contains(from, "."):
+			r.colls[from] = to
+		default:
+			r.dbs[from] = to
+		}
+	}
+	for i := 1; i < len(r.prefixes); i++ {
+		for j := i; j > 0 && len(r.prefixes[j][0]) > len(r.prefixes[j-1][0]); j-- {
+			r.prefixes[j], r.prefixes[j-1] = r.prefixes[j-1], r.prefixes[j]
+		}
+	}
+	return r, nil
+}
+
+func parseRule(rule string) (string, string, error) {
+	rule = strings.TrimSpace(rule)
+	sep := "="
+	if strings.Contains(rule, "->") {
+		sep = "->"
+	}
+	kv := strings.SplitN(rule, sep, 2)
+	if len(kv) != 2 {
+		return "", "", fmt.Errorf("remap rule %q: expected from=to", rule)
+	}
+	from, to := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+	from, to = strings.TrimSuffix(from, ".*"), strings.TrimSuffix(to, ".*")
+	switch {
+	case from == "" || to == "" || from == "*" || to == "*":
+		return "", "", fmt.Errorf("remap rule %q: empty side", rule)
+	case strings.HasSuffix(from, "*") != strings.HasSuffix(to, "*"):
+		return "", "", fmt.Errorf("remap rule %q: both sides need to be prefixes", rule)
+	case strings.Contains(from, ".") != strings.Contains(to, "."):
+		return "", "", fmt.Errorf("remap rule %q: both sides need to be dbs or collections", rule)
+	case strings.HasSuffix(from, "*") && strings.Contains(from, "."):
+		return "", "", fmt.Errorf("remap rule %q: only db names can be prefixes", rule)
+	}
+	return from, to, nil
+}
+
+// Rename renames a db or db.collection
+func (r *Rules) Rename(ns string) string {
+	if r == nil {
+		return ns
+	}
+	if to, ok := r.colls[ns]; ok {
+		return to
+	}
+	db, rest := ns, ""
+	if i := strings.Index(ns, "."); i >= 0 {
+		db, rest = ns[:i], ns[i:]
+	}
+	return r.DB(db) + rest
+}
+
+// DB renames a db by the db and prefix rules
+func (r *Rules) DB(db string) string {
+	if r == nil {
+		return db
+	}
+	if to, ok := r.dbs[db]; ok {
+		return to
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(db, p[0]) {
+			return p[1] + db[len(p[0]):]
+		}
+	}
+	return db
+}
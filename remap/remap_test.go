@@ -0,0 +1,88 @@
+package remap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	r, err := Parse("shop=mirror, logs.* -> archive.*, app.users=app.people, tenant_*=copy_*, tenant_big*=big_*, crm.leads=sales.leads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ns, want string
+	}{
+		{"shop", "mirror"},
+		{"shop.orders", "mirror.orders"},
+		{"shop.system.indexes", "mirror.system.indexes"},
+		{"shopping.orders", "shopping.orders"},
+		{"logs.2024", "archive.2024"},
+		{"app.users", "app.people"},
+		{"app.orders", "app.orders"},
+		{"app", "app"},
+		{"tenant_a.orders", "copy_a.orders"},
+		{"tenant_bigco.orders", "big_co.orders"}, // the longest prefix
+		{"tenant_.x", "copy_.x"},
+		{"crm.leads", "sales.leads"},
+		{"crm.accounts", "crm.accounts"},
+		{"other.things", "other.things"},
+	} {
+		if got := r.Rename(c.ns); got != c.want {
+			t.Errorf("%s renamed %s, want %s", c.ns, got, c.want)
+		}
+	}
+	if got := r.DB("tenant_x"); got != "copy_x" {
+		t.Errorf("db tenant_x renamed %s", got)
+	}
+}
+
+func TestRenamePrecedence(t *testing.T) {
+	// a collection rule before its db's, a db rule before a prefix
+	r, err := Parse("a.x=z.x, a=b, a*=c*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ns, want := range map[string]string{"a.x": "z.x", "a.y": "b.y", "ab.y": "cb.y"} {
+		if got := r.Rename(ns); got != want {
+			t.Errorf("%s renamed %s, want %s", ns, got, want)
+		}
+	}
+}
+
+func TestRenameNothing(t *testing.T) {
+	var nilRules *Rules
+	empty, err := Parse("  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*Rules{nilRules, empty} {
+		if got := r.Rename("app.users"); got != "app.users" {
+			t.Errorf("renamed %s", got)
+		}
+		if got := r.DB("app"); got != "app" {
+			t.Errorf("renamed db %s", got)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, c := range []struct {
+		rules, err string
+	}{
+		{"shop", "expected from=to"},
+		{"shop=", "empty side"},
+		{"=mirror", "empty side"},
+		{"*=copy_*", "empty side"},
+		{"shop.*=*", "empty side"},
+		{"tenant_*=copy", "both sides need to be prefixes"},
+		{"shop=mirror.orders", "both sides need to be dbs or collections"},
+		{"shop.orders=mirror", "both sides need to be dbs or collections"},
+		{"shop.ord*=mirror.ord*", "only db names can be prefixes"},
+		{"a=b,,c=d", "expected from=to"},
+	} {
+		if _, err := Parse(c.rules); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: %v, want %q", c.rules, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package replay
+
+import (
+	"os"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+	"github.com/hanjoyo/oplog-abuse/remap"
+)
+
+func init() {
+	cli.RegisterChecks(flags, checks)
+}
+
+// checks probes where entries are read from and the target they're
+// applied to
+func checks() []cli.Check {
+	var list []cli.Check
+	switch {
+	case *replayFile == "-":
+	case *replayFile != "":
+		list = append(list, cli.Check{Name: "REPLAY_FILE " + *replayFile, Run: func() error {
+			_, err := os.Stat(*replayFile)
+			return err
+		}})
+	case *archive != "":
+		list = append(list, cli.Check{Name: "ARCHIVE " + *archive, Run: func() error {
+			store, err := pitr.Open(*archive)
+			if err != nil {
+				return err
+			}
+			if *base != "" {
+				_, err = pitr.GetBase(store, *base)
+				return err
+			}
+			_, err = store.List()
+			return err
+		}})
+	default:
+		list = append(list, cli.Check{Name: "MONGO_URL", Run: func() error {
+			return dial.Probe(*mongoURL, dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}})
+		}})
+	}
+	if *targetURL != "" && !*dryRun {
+		list = append(list, cli.Check{Name: "TARGET_URL", Run: func() error {
+			// anything may be applied
+			return dial.Probe(*targetURL, dial.Privilege{Actions: []string{"insert", "update", "remove"}})
+		}})
+	}
+	if _, err := remap.Parse(*remapRules); err != nil {
+		list = append(list, cli.Check{Name: "REMAP", Run: func() error { return err }})
+	}
+	return list
+}
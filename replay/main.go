@@ -0,0 +1,354 @@
+// Package replay applies a range of oplog entries to another cluster, the oplogctl replay command.
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/apply"
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+	"github.com/hanjoyo/oplog-abuse/remap"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("replay", "apply an oplog range, from a file, an archive or the live oplog, to a target")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL       = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url whose oplog is replayed, unless REPLAY_FILE is set")
+	replayFile     = flags.String("REPLAY_FILE", "", "bson file of oplog entries to replay, such as mongodump's oplog.bson, - for stdin")
+	archive        = flags.String("ARCHIVE", "", "directory or s3://bucket/prefix of an oplog archive to replay, as the archive tool keeps it")
+	base           = flags.String("BASE", "", "replay the archive from this base marker, restoring the base backup it marks up to TO")
+	targetURL      = flags.String("TARGET_URL", "", "mongodb url of the cluster entries are applied to")
+	from           = flags.String("FROM", "", "replay entries after this ts, seconds[:increment] or RFC 3339")
+	to             = flags.String("TO", "", "replay entries up to this ts, the point in time restored to, up to the latest when started for the live oplog")
+	dryRun         = flags.Bool("DRY_RUN", false, "print what would be applied instead of applying it, TARGET_URL isn't needed")
+	remapRules     = flags.String("REMAP", "", "namespaces to apply elsewhere, comma separated from=to or from->to rules of dbs, db name prefixes ending in * or db.collections")
+	mode           = flags.String("MODE", "crud", "crud to apply entries one by one as inserts, updates and deletes, or applyOps to apply APPLY_BATCH at once")
+	applyBatch     = flags.Int("APPLY_BATCH", 500, "entries per applyOps command, fewer once a second in quiet times")
+	follow         = flags.Bool("FOLLOW", false, "keep tailing the live oplog and mirror writes onto the target as they're made, for soak testing with production traffic")
+	speed          = flags.String("SPEED", "max", "replay at this multiple of the rate entries were written at, 1 for real time, 2 for twice, or max for as fast as possible")
+	maxGap         = flags.Duration("MAX_GAP", 0, "with SPEED, cut longer pauses between entries, once scaled, down to this, 0 to keep them")
+	conflictField  = flags.String("CONFLICT_FIELD", "", "version field, such as updatedAt or a revision number, checked on the target before changing a document it also takes writes to, MODE crud only")
+	conflicts      = flags.String("CONFLICTS", "target", "with CONFLICT_FIELD, who wins when the target's document is newer: source to overwrite it, target to skip the entry, or fail")
+	conflictReport = flags.String("CONFLICT_REPORT", "", "file conflicts are appended to as json lines, stderr if empty")
+	resumeRetries  = flags.Int("RESUME_RETRIES", 5, "times in a row a failed oplog cursor is resumed with FOLLOW before giving up")
+)
+
+// entry is what's replayed, chunk migrations are left out as they change
+// nothing cluster wide
+type entry struct {
+	apply.Entry `bson:",inline"`
+	FromMigrate bool `bson:"fromMigrate"`
+}
+
+// entries sends the entries after since up to until, from REPLAY_FILE or
+// the live oplog
+func entries(since, until bson.MongoTimestamp) (<-chan apply.Entry, <-chan error) {
+	out := make(chan apply.Entry)
+	errc := make(chan error, 1)
+	go func() {
+		defer cli.Recover()
+		defer close(errc)
+		defer close(out)
+		errc <- read(since, until, out)
+	}()
+	return out, errc
+}
+
+func read(since, until bson.MongoTimestamp, out chan<- apply.Entry) error {
+	switch {
+	case *replayFile == "-":
+		return readFile(os.Stdin, since, until, out)
+	case *replayFile != "":
+		f, err := os.Open(*replayFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return readFile(f, since, until, out)
+	case *archive != "":
+		store, err := pitr.Open(*archive)
+		if err != nil {
+			return err
+		}
+		segments, err := pitr.Covering(store, since, until)
+		if err != nil {
+			return err
+		}
+		for _, seg := range segments {
+			r, err := store.Open(seg.Name())
+			if err != nil {
+				return err
+			}
+			err = readFile(r, since, until, out)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %s", seg.Name(), err)
+			}
+		}
+		return nil
+	}
+
+	src, err := dial.Dial(*mongoURL)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	err = dial.CheckPrivileges(src,
+		dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+	)
+	if err != nil {
+		return err
+	}
+	if *follow {
+		return tail(src, since, out)
+	}
+	if until == 0 {
+		var latest apply.Entry
+		if err := src.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&latest); err != nil {
+			return err
+		}
+		until = latest.Timestamp
+	}
+	iter := src.DB("local").
+		C("oplog.rs").
+		Find(bson.M{"ts": bson.M{"$gt": since, "$lte": until}, "fromMigrate": bson.M{"$ne": true}}).
+		Sort("$natural").
+		LogReplay().
+		Iter()
+	var e apply.Entry
+	for iter.Next(&e) {
+		out <- e
+		e = apply.Entry{} // fields missing from the next entry would keep stale values
+	}
+	return iter.Close()
+}
+
+// tail sends the live oplog's entries after since as they're written,
+// resuming a failed cursor from the last entry read
+func tail(src *mgo.Session, since bson.MongoTimestamp, out chan<- apply.Entry) error {
+	if since == 0 {
+		var latest apply.Entry
+		if err := src.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&latest); err != nil {
+			return err
+		}
+		since = latest.Timestamp
+	}
+	for failures := 0; ; failures++ {
+		iter := src.DB("local").
+			C("oplog.rs").
+			Find(bson.M{"ts": bson.M{"$gt": since}, "fromMigrate": bson.M{"$ne": true}}).
+			Sort("$natural").
+			LogReplay().
+			Tail(-1)
+		var e apply.Entry
+		for iter.Next(&e) {
+			failures = 0
+			since = e.Timestamp
+			out <- e
+			e = apply.Entry{}
+		}
+		err := iter.Close()
+		if failures >= *resumeRetries {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "oplog cursor failed: %v, resuming\n", err)
+		time.Sleep(time.Second)
+		src.Refresh()
+	}
+}
+
+// newConflicts checks conflicts as CONFLICT_FIELD and CONFLICTS say,
+// reporting them to CONFLICT_REPORT
+func newConflicts() (*apply.Conflicts, error) {
+	switch {
+	case *mode != "crud":
+		return nil, errors.New("CONFLICT_FIELD needs MODE crud")
+	case *conflicts != apply.SourceWins && *conflicts != apply.TargetWins && *conflicts != apply.Fail:
+		return nil, fmt.Errorf("unknown CONFLICTS %q", *conflicts)
+	}
+	w := io.Writer(os.Stderr)
+	if *conflictReport != "" {
+		f, err := os.OpenFile(*conflictReport, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	found := 0
+	return &apply.Conflicts{
+		Field:   *conflictField,
+		Resolve: *conflicts,
+		Report: func(c apply.Conflict) {
+			found++
+			// _id and versions as extended json, object ids and dates intact
+			if data, err := bsonfile.MarshalJSON(bson.M{"_id": c.ID, "source": c.Source, "target": c.Target}); err == nil {
+				var ext struct {
+					ID     json.RawMessage `json:"_id"`
+					Source json.RawMessage `json:"source"`
+					Target json.RawMessage `json:"target"`
+				}
+				if json.Unmarshal(data, &ext) == nil {
+					c.ID, c.Source, c.Target = ext.ID, ext.Source, ext.Target
+				}
+			}
+			if err := enc.Encode(c); err != nil {
+				fmt.Fprintf(os.Stderr, "writing conflict report: %s\n", err)
+			}
+			if found%1000 == 1 {
+				fmt.Fprintf(os.Stderr, "%d conflicts so far, CONFLICTS %s\n", found, c.Resolution)
+			}
+		},
+	}, nil
+}
+
+// readFile sends a bson file's entries after since up to until
+func readFile(f io.Reader, since, until bson.MongoTimestamp, out chan<- apply.Entry) error {
+	r := bsonfile.NewReader(f)
+	for {
+		var e entry
+		err := r.Next(&e)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if e.Timestamp > since && (until == 0 || e.Timestamp <= until) && !e.FromMigrate {
+			out <- e.Entry
+		}
+	}
+}
+
+// Main runs oplogctl replay, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *targetURL == "" && !*dryRun {
+		panic(cli.Invalidf("TARGET_URL not set"))
+	}
+	if *mode != "crud" && *mode != "applyOps" {
+		panic(cli.Invalidf("unknown MODE %q", *mode))
+	}
+	since, err := optime.Parse(*from)
+	if err != nil {
+		panic(cli.Invalidf("FROM: %s", err))
+	}
+	if *base != "" {
+		if *archive == "" || *from != "" {
+			panic(cli.Invalidf("BASE needs ARCHIVE, and replaces FROM"))
+		}
+		store, err := pitr.Open(*archive)
+		if err != nil {
+			panic(err)
+		}
+		b, err := pitr.GetBase(store, *base)
+		if err != nil {
+			panic(err)
+		}
+		since = b.TS
+		fmt.Fprintf(os.Stderr, "restoring base %s taken %s, from %s\n", b.Name, b.At.Format(time.RFC3339), optime.Format(b.TS))
+	}
+	until, err := optime.Parse(*to)
+	if err != nil {
+		panic(cli.Invalidf("TO: %s", err))
+	}
+	if *follow && (*to != "" || *replayFile != "" || *archive != "") {
+		panic(cli.Invalidf("FOLLOW tails the live oplog, with no TO"))
+	}
+	pace, err := newPacer(*speed, *maxGap)
+	if err != nil {
+		panic(err)
+	}
+	rules, err := remap.Parse(*remapRules)
+	if err != nil {
+		panic(err)
+	}
+
+	applier := &apply.Applier{Filter: apply.UserData{}, Remap: rules.Rename, DryRun: *dryRun}
+	if *conflictField != "" {
+		if applier.Conflicts, err = newConflicts(); err != nil {
+			panic(err)
+		}
+	}
+	if *targetURL != "" {
+		if applier.Dst, err = dial.Dial(*targetURL); err != nil {
+			panic(err)
+		}
+	}
+	var batch []apply.Entry
+	flush := func() {
+		if err := applier.ApplyOps(batch); err != nil {
+			panic(fmt.Errorf("applying up to %s: %s", optime.Format(batch[len(batch)-1].Timestamp), err))
+		}
+		batch = batch[:0]
+	}
+
+	applied := 0
+	var last bson.MongoTimestamp
+	lastPrint := time.Now()
+	ch, errc := entries(since, until)
+	quiet := time.NewTicker(time.Second)
+	defer quiet.Stop()
+	for {
+		var e apply.Entry
+		var ok bool
+		select {
+		case e, ok = <-ch:
+		case <-quiet.C:
+			if len(batch) > 0 {
+				flush()
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+		if wait := pace.due(&e); wait > 0 {
+			if len(batch) > 0 {
+				flush()
+			}
+			time.Sleep(wait)
+		}
+		switch {
+		case *mode == "applyOps" && e.Operation != "c":
+			if batch = append(batch, e); len(batch) >= *applyBatch {
+				flush()
+			}
+		default:
+			if len(batch) > 0 {
+				flush()
+			}
+			if err := applier.Apply(&e); err != nil {
+				panic(fmt.Errorf("applying %s: %s", optime.Format(e.Timestamp), err))
+			}
+		}
+		applied++
+		last = e.Timestamp
+		if time.Since(lastPrint) > time.Second {
+			fmt.Fprintf(os.Stderr, "replayed %d entries, at %s, %s behind\n", applied, optime.Format(last), time.Since(optime.Time(last)).Truncate(time.Second))
+			lastPrint = time.Now()
+		}
+	}
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	fmt.Fprintf(os.Stderr, "replayed %d entries, up to %s\n", applied, optime.Format(last))
+}
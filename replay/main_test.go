@@ -0,0 +1,180 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/apply"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// oplogFile is the bson file of entries at ts, those of migrate chunk
+// migrations
+func oplogFile(t *testing.T, ts []int64, migrate map[int64]bool) []byte {
+	var b bytes.Buffer
+	for _, s := range ts {
+		doc := bson.D{
+			{Name: "ts", Value: bson.MongoTimestamp(s << 32)},
+			{Name: "op", Value: "i"},
+			{Name: "ns", Value: "app.users"},
+			{Name: "o", Value: bson.D{{Name: "_id", Value: s}}},
+		}
+		if migrate[s] {
+			doc = append(doc, bson.DocElem{Name: "fromMigrate", Value: true})
+		}
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(raw)
+	}
+	return b.Bytes()
+}
+
+// collect reads data as readFile does, returning the seconds of the ts
+// of the entries sent
+func collect(data []byte, since, until bson.MongoTimestamp) ([]int64, error) {
+	out := make(chan apply.Entry)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- readFile(bytes.NewReader(data), since, until, out)
+		close(out)
+	}()
+	var got []int64
+	for e := range out {
+		got = append(got, int64(e.Timestamp>>32))
+	}
+	return got, <-errc
+}
+
+func TestReadFile(t *testing.T) {
+	data := oplogFile(t, []int64{1, 2, 3, 4, 5}, map[int64]bool{4: true})
+	for _, c := range []struct {
+		since, until int64
+		want         string
+	}{
+		{0, 0, "[1 2 3 5]"},
+		{2, 0, "[3 5]"},   // after since
+		{0, 3, "[1 2 3]"}, // up to and including until
+		{1, 4, "[2 3]"},
+		{5, 0, "[]"},
+	} {
+		got, err := collect(data, bson.MongoTimestamp(c.since<<32), bson.MongoTimestamp(c.until<<32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := fmt.Sprint(got); s != c.want {
+			t.Errorf("after %d up to %d: %s, want %s", c.since, c.until, s, c.want)
+		}
+	}
+}
+
+func TestReadFileTruncated(t *testing.T) {
+	data := oplogFile(t, []int64{1, 2}, nil)
+	got, err := collect(data[:len(data)-3], 0, 0)
+	if err == nil || len(got) != 1 {
+		t.Errorf("a truncated file: %v sent, %v", got, err)
+	}
+}
+
+func TestReadArchive(t *testing.T) {
+	dir := t.TempDir()
+	store, err := pitr.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range []struct {
+		after, last int64
+		ts          []int64
+	}{
+		{0, 3, []int64{1, 2, 3}},
+		{3, 6, []int64{4, 5, 6}},
+		{6, 8, []int64{7, 8}},
+	} {
+		s := pitr.Segment{After: bson.MongoTimestamp(seg.after << 32), Last: bson.MongoTimestamp(seg.last << 32)}
+		if err := store.Put(s.Name(), oplogFile(t, seg.ts, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(a, f string) { *archive, *replayFile = a, f }(*archive, *replayFile)
+	*archive, *replayFile = dir, ""
+
+	// restored to a point in time within the segments
+	ch, errc := entries(2<<32, 7<<32)
+	var got []int64
+	for e := range ch {
+		got = append(got, int64(e.Timestamp>>32))
+	}
+	if err := <-errc; err != nil || fmt.Sprint(got) != "[3 4 5 6 7]" {
+		t.Errorf("%v, %v, want 3 to 7", got, err)
+	}
+
+	// past what's archived, up to its end
+	ch, errc = entries(6<<32, 9<<32)
+	got = nil
+	for e := range ch {
+		got = append(got, int64(e.Timestamp>>32))
+	}
+	if err := <-errc; err != nil || fmt.Sprint(got) != "[7 8]" {
+		t.Errorf("past the archive: %v, %v, want 7 and 8", got, err)
+	}
+
+	// a segment missing, nothing's replayed over the gap
+	if err := os.Remove(filepath.Join(dir, pitr.Segment{After: 3 << 32, Last: 6 << 32}.Name())); err != nil {
+		t.Fatal(err)
+	}
+	ch, errc = entries(2<<32, 7<<32)
+	got = nil
+	for e := range ch {
+		got = append(got, int64(e.Timestamp>>32))
+	}
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "gap") || len(got) != 0 {
+		t.Errorf("over a gap: %v, %v", got, err)
+	}
+}
+
+func TestNewConflicts(t *testing.T) {
+	defer func(m, c, r string) { *mode, *conflicts, *conflictReport = m, c, r }(*mode, *conflicts, *conflictReport)
+	*mode, *conflicts = "applyOps", apply.TargetWins
+	if _, err := newConflicts(); err == nil {
+		t.Error("conflicts checked with MODE applyOps")
+	}
+	*mode, *conflicts = "crud", "newest"
+	if _, err := newConflicts(); err == nil {
+		t.Error("unknown CONFLICTS taken")
+	}
+
+	*conflicts, *conflictReport = apply.Fail, filepath.Join(t.TempDir(), "conflicts.json")
+	c, err := newConflicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Resolve != apply.Fail {
+		t.Errorf("resolved as %s", c.Resolve)
+	}
+	id := bson.ObjectIdHex("5f1d7a9e8b3c4d2e1f0a9b8c")
+	at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	c.Report(apply.Conflict{TS: "100:1", Namespace: "app.users", ID: id, Operation: "u", Source: at, Target: at.Add(time.Second), Resolution: apply.Fail})
+	c.Report(apply.Conflict{TS: "100:2", Namespace: "app.users", ID: 7, Operation: "d", Source: 3, Target: 4, Resolution: apply.Fail})
+	data, err := ioutil.ReadFile(*conflictReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{
+		`{"ts":"100:1","ns":"app.users","_id":{"$oid":"5f1d7a9e8b3c4d2e1f0a9b8c"},"op":"u","source":{"$date":"2024-05-01T00:00:00Z"},"target":{"$date":"2024-05-01T00:00:01Z"},"resolution":"fail"}`,
+		`{"ts":"100:2","ns":"app.users","_id":7,"op":"d","source":3,"target":4,"resolution":"fail"}`,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("reported\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,67 @@
+package replay
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/apply"
+	"github.com/hanjoyo/oplog-abuse/optime"
+)
+
+// pacer holds entries back to replay them at speed times the rate they
+// were written at, keeping the gaps between them so bursts stay bursts.
+// Entries are due at a time worked out from when they were written alone,
+// relative to the first one, so a slow apply doesn't push every later one
+// back and two replays of the same entries are paced the same. Gaps over
+// maxGap, once scaled, are cut to it.
+type pacer struct {
+	speed  float64
+	maxGap time.Duration
+	prev   time.Time     // when the previous entry was written
+	offset time.Duration // into the replay it's due at
+	start  time.Time
+}
+
+// newPacer parses SPEED, nil for as fast as possible
+func newPacer(speed string, maxGap time.Duration) (*pacer, error) {
+	if speed == "" || speed == "max" {
+		return nil, nil
+	}
+	x, err := strconv.ParseFloat(speed, 64)
+	if err != nil || x <= 0 {
+		return nil, fmt.Errorf("SPEED %q must be a positive multiplier or max", speed)
+	}
+	return &pacer{speed: x, maxGap: maxGap}, nil
+}
+
+// written is when e was written, to the millisecond from wall, to the
+// second from ts before 3.6
+func written(e *apply.Entry) time.Time {
+	if !e.Wall.IsZero() {
+		return e.Wall
+	}
+	return optime.Time(e.Timestamp)
+}
+
+// due returns how long to wait before replaying e
+func (p *pacer) due(e *apply.Entry) time.Duration {
+	if p == nil {
+		return 0
+	}
+	at := written(e)
+	if p.start.IsZero() {
+		p.prev, p.start = at, time.Now()
+		return 0
+	}
+	gap := time.Duration(float64(at.Sub(p.prev)) / p.speed)
+	if gap < 0 {
+		gap = 0 // clocks stepping back across a failover
+	}
+	if p.maxGap > 0 && gap > p.maxGap {
+		gap = p.maxGap
+	}
+	p.prev = at
+	p.offset += gap
+	return time.Until(p.start.Add(p.offset))
+}
@@ -0,0 +1,79 @@
+package replay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/apply"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNewPacer(t *testing.T) {
+	for _, speed := range []string{"", "max"} {
+		if p, err := newPacer(speed, 0); p != nil || err != nil {
+			t.Errorf("%q: %v, %v, want as fast as possible", speed, p, err)
+		}
+	}
+	for _, speed := range []string{"0", "-1", "fast", "2x"} {
+		if _, err := newPacer(speed, 0); err == nil {
+			t.Errorf("%q taken", speed)
+		}
+	}
+	if p, err := newPacer("0.5", time.Second); err != nil || p.speed != 0.5 || p.maxGap != time.Second {
+		t.Errorf("%+v, %v", p, err)
+	}
+	var p *pacer
+	if wait := p.due(&apply.Entry{}); wait != 0 {
+		t.Errorf("held back %s at max", wait)
+	}
+}
+
+func TestWritten(t *testing.T) {
+	wall := time.Date(2024, 5, 1, 0, 0, 0, 250e6, time.UTC)
+	if at := written(&apply.Entry{Timestamp: 1714521600 << 32, Wall: wall}); !at.Equal(wall) {
+		t.Errorf("%s, want wall's %s", at, wall)
+	}
+	if at := written(&apply.Entry{Timestamp: 1714521600 << 32}); !at.Equal(time.Unix(1714521600, 0)) {
+		t.Errorf("%s, want ts' without wall", at)
+	}
+}
+
+func TestPace(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *apply.Entry {
+		return &apply.Entry{Timestamp: bson.MongoTimestamp(start.Unix() << 32), Wall: start.Add(d)}
+	}
+	p, _ := newPacer("2", time.Minute)
+	for _, c := range []struct {
+		written time.Duration
+		offset  time.Duration
+	}{
+		{0, 0},
+		{time.Second, 500 * time.Millisecond}, // at twice the rate
+		{time.Second, 500 * time.Millisecond}, // a burst stays a burst
+		{3 * time.Second, 1500 * time.Millisecond},
+		{2 * time.Second, 1500 * time.Millisecond}, // a clock stepping back
+		{time.Hour, 1500*time.Millisecond + time.Minute},
+		{time.Hour + time.Second, 2*time.Second + time.Minute},
+	} {
+		p.due(at(c.written))
+		if p.offset != c.offset {
+			t.Errorf("written at %s: due %s in, want %s", c.written, p.offset, c.offset)
+		}
+	}
+
+	// due relative to the first entry, not to when the previous one was
+	// replayed
+	p, _ = newPacer("1", 0)
+	if wait := p.due(at(0)); wait != 0 {
+		t.Errorf("the first held back %s", wait)
+	}
+	p.start = p.start.Add(-time.Second) // replaying it took a second
+	if wait := p.due(at(time.Second)); wait > 0 {
+		t.Errorf("held back %s when already due", wait)
+	}
+	if wait := p.due(at(3 * time.Second)); wait < time.Second || wait > 2*time.Second {
+		t.Errorf("held back %s, want 2s less the time past", wait)
+	}
+}
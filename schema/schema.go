@@ -0,0 +1,418 @@
+// Package schema infers the shape of a namespace's documents from the
+// changes seen to them: the fields, the types each was seen with, how
+// often it was there and how many distinct values it had, given out as the
+// JSON Schema mongodb's $jsonSchema validators take.
+//
+// Inserts and replacements are whole documents, they tell which fields are
+// always there. Updates only add to the types of the fields they set.
+package schema
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	maxDistinct = 1000 // values told apart per field, past it the count is a lower bound
+	maxFields   = 1000 // fields kept per object, past it they're counted as Overflow
+)
+
+// Field is what was seen at a path
+type Field struct {
+	Seen     int64             // times it was there when its object was seen whole
+	Types    map[string]int64  // bson type names to times seen as each
+	Fields   map[string]*Field // of objects
+	Items    *Field            // of arrays, their elements
+	MinItems int
+	MaxItems int
+	Overflow int64 // fields of objects not kept, past maxFields
+
+	distinct map[uint64]struct{}
+}
+
+func newField() *Field {
+	return &Field{Types: make(map[string]int64)}
+}
+
+// Distinct returns how many distinct values of scalar types were seen,
+// capped reporting that it's at least that many
+func (f *Field) Distinct() (n int, capped bool) {
+	return len(f.distinct), len(f.distinct) >= maxDistinct
+}
+
+// Required reports whether child was there every time f was seen as a
+// whole object
+func (f *Field) Required(child *Field) bool {
+	return child.Seen > 0 && child.Seen == f.Types["object"]
+}
+
+// field returns f's field name, added when it's new, nil once past
+// maxFields
+func (f *Field) field(name string) (c *Field, added bool) {
+	if c, ok := f.Fields[name]; ok {
+		return c, false
+	}
+	if f.Fields == nil {
+		f.Fields = make(map[string]*Field)
+	}
+	if len(f.Fields) >= maxFields {
+		f.Overflow++
+		return nil, false
+	}
+	c = newField()
+	f.Fields[name] = c
+	return c, true
+}
+
+func (f *Field) items() *Field {
+	if f.Items == nil {
+		f.Items = newField()
+	}
+	return f.Items
+}
+
+// visit is where observe is in the value seen
+type visit struct {
+	path   string
+	fresh  bool // f is new, so is everything in it, only it drifted
+	drifts *[]Drift
+}
+
+func (o visit) drift(kind, path, typ string, was []string) {
+	if !o.fresh {
+		*o.drifts = append(*o.drifts, Drift{Kind: kind, Path: path, Type: typ, Was: was})
+	}
+}
+
+// child returns the visit of name in o
+func (o visit) child(name string, added bool) visit {
+	c := visit{path: join(o.path, name), fresh: o.fresh || added, drifts: o.drifts}
+	if added {
+		o.drift(FieldAdded, c.path, "", nil)
+	}
+	return c
+}
+
+// observe adds v to what was seen at f, whole when f's object was seen
+// whole, so f being there or not tells whether it's required
+func (f *Field) observe(v interface{}, whole bool, o visit) {
+	if whole {
+		f.Seen++
+	}
+	t := TypeOf(v)
+	if f.Types[t] == 0 && len(f.Types) > 0 {
+		o.drift(TypeChanged, o.path, t, f.TypeNames())
+	}
+	objects := f.Types["object"]
+	f.Types[t]++
+	switch v := v.(type) {
+	case bson.M:
+		for name, e := range v {
+			if c, added := f.field(name); c != nil {
+				c.observe(e, true, o.child(name, added))
+			}
+		}
+		f.removed(objects, func(name string) bool { _, ok := v[name]; return ok }, o)
+	case bson.D:
+		for _, e := range v {
+			if c, added := f.field(e.Name); c != nil {
+				c.observe(e.Value, true, o.child(e.Name, added))
+			}
+		}
+		f.removed(objects, func(name string) bool {
+			for _, e := range v {
+				if e.Name == name {
+					return true
+				}
+			}
+			return false
+		}, o)
+	case []interface{}:
+		if f.Types["array"] == 1 || len(v) < f.MinItems {
+			f.MinItems = len(v)
+		}
+		if len(v) > f.MaxItems {
+			f.MaxItems = len(v)
+		}
+		items := f.items()
+		for _, e := range v {
+			items.observe(e, true, visit{path: o.path + "[]", fresh: o.fresh, drifts: o.drifts})
+		}
+	default:
+		if len(f.distinct) < maxDistinct {
+			if f.distinct == nil {
+				f.distinct = make(map[uint64]struct{})
+			}
+			h := fnv.New64a()
+			fmt.Fprintf(h, "%T:%v", v, v)
+			f.distinct[h.Sum64()] = struct{}{}
+		}
+	}
+}
+
+// removed reports the fields of f that were in every one of the objects
+// seen before but aren't in the one just seen
+func (f *Field) removed(objects int64, has func(name string) bool, o visit) {
+	if objects == 0 {
+		return
+	}
+	for _, name := range f.names() {
+		if c := f.Fields[name]; c.Seen == objects && !has(name) {
+			o.drift(FieldRemoved, join(o.path, name), "", c.TypeNames())
+		}
+	}
+}
+
+// Kinds of Drift
+const (
+	FieldAdded   = "field_added"   // a path never seen before
+	TypeChanged  = "type_changed"  // a path seen as a type it never had
+	FieldRemoved = "field_removed" // a path every document had before missing
+)
+
+// Drift is a change to a schema a document made
+type Drift struct {
+	Kind string   `json:"kind"`
+	Path string   `json:"path"`           // array elements marked []
+	Type string   `json:"type,omitempty"` // seen, of a TypeChanged
+	Was  []string `json:"was,omitempty"`  // types seen before, of TypeChanged and FieldRemoved
+}
+
+// TypeOf returns the bson type name of a decoded value, as $jsonSchema's
+// bsonType names them
+func TypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case bson.M, bson.D:
+		return "object"
+	case []interface{}:
+		return "array"
+	case []byte, bson.Binary:
+		return "binData"
+	case bson.ObjectId:
+		return "objectId"
+	case bool:
+		return "bool"
+	case time.Time:
+		return "date"
+	case bson.RegEx:
+		return "regex"
+	case bson.DBPointer:
+		return "dbPointer"
+	case bson.JavaScript:
+		return "javascript"
+	case bson.Symbol:
+		return "symbol"
+	case int, int32:
+		return "int"
+	case bson.MongoTimestamp:
+		return "timestamp"
+	case int64:
+		return "long"
+	case bson.Decimal128:
+		return "decimal"
+	}
+	switch v {
+	case bson.MinKey:
+		return "minKey"
+	case bson.MaxKey:
+		return "maxKey"
+	case bson.Undefined:
+		return "undefined"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Schema is what was inferred of a namespace's documents. It's not safe
+// for concurrent use.
+type Schema struct {
+	Namespace string
+	Documents int64 // whole documents seen, inserted or replaced
+	Updates   int64 // updates seen setting fields
+
+	root *Field
+}
+
+// New returns the schema of ns, with nothing seen yet
+func New(ns string) *Schema {
+	return &Schema{Namespace: ns, root: newField()}
+}
+
+// Root returns the field of the documents themselves
+func (s *Schema) Root() *Field {
+	return s.root
+}
+
+// Document adds a whole document, inserted or replacing another,
+// returning how it drifted from the documents seen before
+func (s *Schema) Document(doc bson.M) []Drift {
+	var drifts []Drift
+	s.Documents++
+	s.root.observe(doc, true, visit{drifts: &drifts})
+	return drifts
+}
+
+// Update adds an update as the oplog logs them from $v: 1, its $set fields
+// by dotted path, returning the ones that drifted. An update without
+// operators replaces the document.
+func (s *Schema) Update(update bson.M) []Drift {
+	set, _ := update["$set"].(bson.M)
+	operators := false
+	for name := range update {
+		operators = operators || strings.HasPrefix(name, "$")
+	}
+	if !operators {
+		return s.Document(update)
+	}
+	var drifts []Drift
+	s.Updates++
+	for path, v := range set {
+		if f, o := s.at(path, &drifts); f != nil {
+			f.observe(v, false, o)
+		}
+	}
+	return drifts
+}
+
+// at returns the field at a dotted path, numeric segments being elements
+// of arrays set by index, and its visit
+func (s *Schema) at(path string, drifts *[]Drift) (*Field, visit) {
+	f, o := s.root, visit{drifts: drifts}
+	for _, seg := range strings.Split(path, ".") {
+		if _, err := strconv.Atoi(seg); err == nil && (f.Types["array"] > 0 || f.Fields[seg] == nil) {
+			f, o.path = f.items(), o.path+"[]"
+			continue
+		}
+		c, added := f.field(seg)
+		if c == nil {
+			return nil, o
+		}
+		f, o = c, o.child(seg, added)
+	}
+	return f, o
+}
+
+// JSONSchema returns the schema of the documents seen, as a $jsonSchema
+// document: the bsonTypes each field was seen with, the fields every whole
+// document had as required, and the least and most elements of arrays
+func (s *Schema) JSONSchema() bson.D {
+	return s.root.jsonSchema()
+}
+
+func (f *Field) jsonSchema() bson.D {
+	var d bson.D
+	types := f.TypeNames()
+	if len(types) == 0 && len(f.Fields) > 0 {
+		types = []string{"object"} // only seen by the paths of updates
+	}
+	switch len(types) {
+	case 0:
+	case 1:
+		d = append(d, bson.DocElem{Name: "bsonType", Value: types[0]})
+	default:
+		d = append(d, bson.DocElem{Name: "bsonType", Value: types})
+	}
+	if len(f.Fields) > 0 {
+		var props bson.D
+		var required []string
+		for _, name := range f.names() {
+			child := f.Fields[name]
+			props = append(props, bson.DocElem{Name: name, Value: child.jsonSchema()})
+			if f.Required(child) {
+				required = append(required, name)
+			}
+		}
+		d = append(d, bson.DocElem{Name: "properties", Value: props})
+		if len(required) > 0 {
+			d = append(d, bson.DocElem{Name: "required", Value: required})
+		}
+	}
+	if f.Items != nil {
+		d = append(d, bson.DocElem{Name: "items", Value: f.Items.jsonSchema()})
+	}
+	if f.Types["array"] > 0 {
+		d = append(d,
+			bson.DocElem{Name: "minItems", Value: f.MinItems},
+			bson.DocElem{Name: "maxItems", Value: f.MaxItems},
+		)
+	}
+	return d
+}
+
+// TypeNames returns the types f was seen with, sorted
+func (f *Field) TypeNames() []string {
+	types := make([]string, 0, len(f.Types))
+	for t := range f.Types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (f *Field) names() []string {
+	names := make([]string, 0, len(f.Fields))
+	for name := range f.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Observation is what was seen at one path, array elements marked []
+type Observation struct {
+	Path           string           `bson:"path"`
+	Types          map[string]int64 `bson:"types"`
+	Seen           int64            `bson:"seen"`
+	Required       bool             `bson:"required"`
+	Distinct       int              `bson:"distinct,omitempty"`
+	DistinctCapped bool             `bson:"distinctCapped,omitempty"`
+	MinItems       int              `bson:"minItems,omitempty"`
+	MaxItems       int              `bson:"maxItems,omitempty"`
+	Overflow       int64            `bson:"overflow,omitempty"`
+}
+
+// Observations returns what was seen at every path, sorted by path
+func (s *Schema) Observations() []Observation {
+	var out []Observation
+	var add func(path string, parent, f *Field)
+	add = func(path string, parent, f *Field) {
+		types := make(map[string]int64, len(f.Types))
+		for t, n := range f.Types {
+			types[t] = n
+		}
+		o := Observation{Path: path, Types: types, Seen: f.Seen, MinItems: f.MinItems, MaxItems: f.MaxItems, Overflow: f.Overflow}
+		o.Distinct, o.DistinctCapped = f.Distinct()
+		if parent != nil {
+			o.Required = parent.Required(f)
+		}
+		out = append(out, o)
+		for _, name := range f.names() {
+			add(join(path, name), f, f.Fields[name])
+		}
+		if f.Items != nil {
+			add(path+"[]", nil, f.Items)
+		}
+	}
+	for _, name := range s.root.names() {
+		add(name, s.root, s.root.Fields[name])
+	}
+	return out
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
@@ -0,0 +1,352 @@
+package schema
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Violation is where and how a document breaks a schema
+type Violation struct {
+	Path    string `json:"path"` // array elements by index
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+// Validator checks documents against a JSON Schema as $jsonSchema takes
+// them, JSONSchema's included: bsonType or type, properties, required,
+// additionalProperties, items, minItems, maxItems, enum, minimum, maximum,
+// minLength, maxLength and pattern. Other keywords are ignored.
+type Validator struct {
+	root     map[string]interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// NewValidator returns the validator of schema, decoded from json
+func NewValidator(schema map[string]interface{}) (*Validator, error) {
+	v := &Validator{root: schema, patterns: make(map[string]*regexp.Regexp)}
+	if err := v.compile("", schema); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// compile checks the keywords of s are of the types they take, compiling
+// the patterns
+func (v *Validator) compile(path string, s map[string]interface{}) error {
+	for _, kw := range []string{"bsonType", "type"} {
+		if t, ok := s[kw]; ok {
+			if _, err := typeNames(t); err != nil {
+				return fmt.Errorf("%s%s: %s", where(path), kw, err)
+			}
+		}
+	}
+	if p, ok := s["pattern"]; ok {
+		pattern, ok := p.(string)
+		if !ok {
+			return fmt.Errorf("%spattern must be a string", where(path))
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%spattern: %s", where(path), err)
+		}
+		v.patterns[pattern] = re
+	}
+	if r, ok := s["required"]; ok {
+		if _, err := stringList(r); err != nil {
+			return fmt.Errorf("%srequired: %s", where(path), err)
+		}
+	}
+	if props, ok := s["properties"]; ok {
+		m, ok := props.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%sproperties must be an object", where(path))
+		}
+		for name, p := range m {
+			sub, ok := p.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%sproperties.%s must be an object", where(path), name)
+			}
+			if err := v.compile(join(path, name), sub); err != nil {
+				return err
+			}
+		}
+	}
+	if items, ok := s["items"]; ok {
+		sub, ok := items.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%sitems must be an object", where(path))
+		}
+		if err := v.compile(path+"[]", sub); err != nil {
+			return err
+		}
+	}
+	if a, ok := s["additionalProperties"]; ok {
+		if _, ok := a.(bool); !ok {
+			return fmt.Errorf("%sadditionalProperties must be a boolean", where(path))
+		}
+	}
+	return nil
+}
+
+func where(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ": "
+}
+
+// Document returns how doc breaks the schema, nil if it's valid
+func (v *Validator) Document(doc bson.M) []Violation {
+	var out []Violation
+	v.check("", v.root, doc, &out)
+	return out
+}
+
+// Update returns how an update as the oplog logs them from $v: 1 breaks
+// the schema: the values it sets by dotted path against the schemas at
+// them, and the fields it unsets against required. An update without
+// operators replaces the document, and is checked as one.
+func (v *Validator) Update(update bson.M) []Violation {
+	operators := false
+	for name := range update {
+		operators = operators || strings.HasPrefix(name, "$")
+	}
+	if !operators {
+		return v.Document(update)
+	}
+	var out []Violation
+	set, _ := update["$set"].(bson.M)
+	for _, path := range sortedKeys(set) {
+		if s := v.at(path); s != nil {
+			v.check(path, s, set[path], &out)
+		}
+	}
+	unset, _ := update["$unset"].(bson.M)
+	for _, path := range sortedKeys(unset) {
+		i := strings.LastIndex(path, ".")
+		parent, name := v.root, path
+		if i >= 0 {
+			parent, name = v.at(path[:i]), path[i+1:]
+		}
+		if parent == nil {
+			continue
+		}
+		required, _ := stringList(parent["required"])
+		for _, r := range required {
+			if r == name {
+				out = append(out, Violation{path, "is required, can't be unset"})
+			}
+		}
+	}
+	return out
+}
+
+// at returns the schema at a dotted path, nil if nothing constrains it
+func (v *Validator) at(path string) map[string]interface{} {
+	s := v.root
+	for _, seg := range strings.Split(path, ".") {
+		if _, err := strconv.Atoi(seg); err == nil {
+			if items, ok := s["items"].(map[string]interface{}); ok {
+				s = items
+				continue
+			}
+		}
+		props, _ := s["properties"].(map[string]interface{})
+		sub, ok := props[seg].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		s = sub
+	}
+	return s
+}
+
+func (v *Validator) check(path string, s map[string]interface{}, value interface{}, out *[]Violation) {
+	fail := func(format string, args ...interface{}) {
+		*out = append(*out, Violation{path, fmt.Sprintf(format, args...)})
+	}
+	for _, kw := range []string{"bsonType", "type"} {
+		t, ok := s[kw]
+		if !ok {
+			continue
+		}
+		names, _ := typeNames(t)
+		if !hasType(names, value, kw == "type") {
+			fail("is %s, not %s", TypeOf(value), strings.Join(names, " or "))
+			return // the rest only make sense of the types allowed
+		}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || equal(e, value)
+		}
+		if !found {
+			fail("isn't one of the enum's values")
+		}
+	}
+	if f, ok := number(value); ok {
+		if min, ok := s["minimum"].(float64); ok && f < min {
+			fail("%v is less than the minimum %v", f, min)
+		}
+		if max, ok := s["maximum"].(float64); ok && f > max {
+			fail("%v is more than the maximum %v", f, max)
+		}
+	}
+	switch value := value.(type) {
+	case string:
+		n := float64(utf8.RuneCountInString(value))
+		if min, ok := s["minLength"].(float64); ok && n < min {
+			fail("is shorter than %v characters", min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && n > max {
+			fail("is longer than %v characters", max)
+		}
+		if p, ok := s["pattern"].(string); ok && !v.patterns[p].MatchString(value) {
+			fail("doesn't match %q", p)
+		}
+	case []interface{}:
+		n := float64(len(value))
+		if min, ok := s["minItems"].(float64); ok && n < min {
+			fail("has fewer than %v items", min)
+		}
+		if max, ok := s["maxItems"].(float64); ok && n > max {
+			fail("has more than %v items", max)
+		}
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, e := range value {
+				v.check(join(path, strconv.Itoa(i)), items, e, out)
+			}
+		}
+	case bson.M:
+		v.object(path, s, value, out)
+	case bson.D:
+		v.object(path, s, value.Map(), out)
+	}
+}
+
+func (v *Validator) object(path string, s map[string]interface{}, doc bson.M, out *[]Violation) {
+	required, _ := stringList(s["required"])
+	for _, name := range required {
+		if _, ok := doc[name]; !ok {
+			*out = append(*out, Violation{join(path, name), "is required"})
+		}
+	}
+	props, _ := s["properties"].(map[string]interface{})
+	for _, name := range sortedKeys(doc) {
+		sub, ok := props[name].(map[string]interface{})
+		if !ok {
+			if s["additionalProperties"] == false {
+				*out = append(*out, Violation{join(path, name), "isn't allowed, additionalProperties is false"})
+			}
+			continue
+		}
+		v.check(join(path, name), sub, doc[name], out)
+	}
+}
+
+// typeNames reads a bsonType or type, a name or a list of them
+func typeNames(t interface{}) ([]string, error) {
+	if name, ok := t.(string); ok {
+		return []string{name}, nil
+	}
+	return stringList(t)
+}
+
+func stringList(v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("must be a string or a list of them")
+	}
+	names := make([]string, len(list))
+	for i, e := range list {
+		if names[i], ok = e.(string); !ok {
+			return nil, fmt.Errorf("must be a list of strings")
+		}
+	}
+	return names, nil
+}
+
+// jsonTypes are the bson types of JSON Schema's type names
+var jsonTypes = map[string][]string{
+	"object":  {"object"},
+	"array":   {"array"},
+	"string":  {"string"},
+	"boolean": {"bool"},
+	"null":    {"null"},
+	"number":  {"int", "long", "double", "decimal"},
+	"integer": {"int", "long"},
+}
+
+func hasType(names []string, value interface{}, jsonType bool) bool {
+	t := TypeOf(value)
+	for _, name := range names {
+		switch {
+		case jsonType && contains(jsonTypes[name], t):
+			return true
+		case !jsonType && (name == t || name == "number" && contains(jsonTypes["number"], t)):
+			return true // number is $jsonSchema's alias of the numeric types
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// number returns a numeric value as a float64
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+// equal compares a value decoded from json to one decoded from bson,
+// numbers by value
+func equal(j, b interface{}) bool {
+	if f, ok := j.(float64); ok {
+		g, ok := number(b)
+		return ok && f == g
+	}
+	return reflect.DeepEqual(j, b)
+}
+
+func sortedKeys(m bson.M) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,191 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const usersSchema = `{
+	"bsonType": "object",
+	"required": ["_id", "email", "profile"],
+	"additionalProperties": false,
+	"properties": {
+		"_id": {"bsonType": "objectId"},
+		"email": {"bsonType": "string", "pattern": "^[^@]+@[^@]+$", "maxLength": 24},
+		"age": {"bsonType": ["int", "long"], "minimum": 0, "maximum": 150},
+		"score": {"bsonType": "number"},
+		"name": {"type": "string", "minLength": 1},
+		"verified": {"type": ["boolean", "null"]},
+		"status": {"enum": ["active", "banned", 3]},
+		"profile": {
+			"bsonType": "object",
+			"required": ["handle"],
+			"properties": {
+				"handle": {"bsonType": "string"},
+				"address": {
+					"bsonType": "object",
+					"required": ["city"],
+					"properties": {"city": {"bsonType": "string"}}
+				}
+			}
+		},
+		"tags": {"bsonType": "array", "minItems": 1, "maxItems": 3, "items": {"bsonType": "string"}},
+		"addresses": {
+			"bsonType": "array",
+			"items": {"bsonType": "object", "required": ["street"], "properties": {"street": {"bsonType": "string"}}}
+		}
+	}
+}`
+
+func users(t *testing.T) *Validator {
+	var s map[string]interface{}
+	if err := json.Unmarshal([]byte(usersSchema), &s); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewValidator(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+var id = bson.ObjectIdHex("5f0c8e3a9d1e4b2a3c4d5e6f")
+
+// user is a valid document, changed by set
+func user(set bson.M) bson.M {
+	doc := bson.M{"_id": id, "email": "ada@example.com", "profile": bson.M{"handle": "ada"}}
+	for k, v := range set {
+		if v == nil {
+			delete(doc, k)
+		} else {
+			doc[k] = v
+		}
+	}
+	return doc
+}
+
+func violations(vs []Violation) []string {
+	var out []string
+	for _, v := range vs {
+		out = append(out, v.String())
+	}
+	return out
+}
+
+func TestValidateDocument(t *testing.T) {
+	v := users(t)
+	for _, c := range []struct {
+		doc  bson.M
+		want []string
+	}{
+		{user(nil), nil},
+		{user(bson.M{"age": 36, "score": 1.5, "name": "Ada", "verified": true, "status": "active", "tags": []interface{}{"a"}}), nil},
+		{user(bson.M{"age": int64(150), "score": bson.M{}}), []string{"score: is object, not number"}},
+		{user(bson.M{"score": int64(3)}), nil},
+		{user(bson.M{"score": bson.Decimal128{}}), nil},
+		{bson.M{"_id": id, "email": "ada@example.com", "profile": bson.M{"handle": "ada"}, "verified": nil}, nil},
+		// types
+		{user(bson.M{"email": 7}), []string{"email: is int, not string"}},
+		{user(bson.M{"age": "36"}), []string{"age: is string, not int or long"}},
+		{user(bson.M{"age": 36.0}), []string{"age: is double, not int or long"}},
+		{user(bson.M{"name": 1}), []string{"name: is int, not string"}},
+		{user(bson.M{"verified": "yes"}), []string{"verified: is string, not boolean or null"}},
+		{user(bson.M{"_id": "ada"}), []string{"_id: is string, not objectId"}},
+		// values
+		{user(bson.M{"age": int64(200)}), []string{"age: 200 is more than the maximum 150"}},
+		{user(bson.M{"age": -1}), []string{"age: -1 is less than the minimum 0"}},
+		{user(bson.M{"name": ""}), []string{"name: is shorter than 1 characters"}},
+		{user(bson.M{"email": "ada.lovelace.byron@example.com"}), []string{"email: is longer than 24 characters"}},
+		{user(bson.M{"email": "ada"}), []string{`email: doesn't match "^[^@]+@[^@]+$"`}},
+		{user(bson.M{"status": "deleted"}), []string{"status: isn't one of the enum's values"}},
+		{user(bson.M{"status": int64(3)}), nil},
+		// required and additional
+		{user(bson.M{"email": nil, "profile": nil}), []string{"email: is required", "profile: is required"}},
+		{user(bson.M{"nickname": "ada"}), []string{"nickname: isn't allowed, additionalProperties is false"}},
+		// nested
+		{user(bson.M{"profile": bson.M{}}), []string{"profile.handle: is required"}},
+		{user(bson.M{"profile": bson.M{"handle": 1}}), []string{"profile.handle: is int, not string"}},
+		{user(bson.M{"profile": bson.M{"handle": "ada", "address": bson.M{"city": 75}}}), []string{"profile.address.city: is int, not string"}},
+		{user(bson.M{"profile": bson.M{"handle": "ada", "address": bson.M{}}}), []string{"profile.address.city: is required"}},
+		{user(bson.M{"profile": bson.D{{Name: "handle", Value: 1}}}), []string{"profile.handle: is int, not string"}},
+		{user(bson.M{"profile": "ada"}), []string{"profile: is string, not object"}},
+		// arrays
+		{user(bson.M{"tags": []interface{}{}}), []string{"tags: has fewer than 1 items"}},
+		{user(bson.M{"tags": []interface{}{"a", "b", "c", "d"}}), []string{"tags: has more than 3 items"}},
+		{user(bson.M{"tags": []interface{}{"a", 2, "c"}}), []string{"tags.1: is int, not string"}},
+		{user(bson.M{"tags": "a"}), []string{"tags: is string, not array"}},
+		{user(bson.M{"addresses": []interface{}{bson.M{"street": "main st"}, bson.M{}, bson.M{"street": 1}}}),
+			[]string{"addresses.1.street: is required", "addresses.2.street: is int, not string"}},
+		// everything at once, in path order
+		{bson.M{"email": 1, "x": 1, "profile": bson.M{"handle": "ada"}}, []string{"_id: is required", "email: is int, not string", "x: isn't allowed, additionalProperties is false"}},
+	} {
+		if got := violations(v.Document(c.doc)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: %q, want %q", c.doc, got, c.want)
+		}
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	v := users(t)
+	for _, c := range []struct {
+		update bson.M
+		want   []string
+	}{
+		{bson.M{"$set": bson.M{"email": "bob@example.com", "age": 40}}, nil},
+		{bson.M{"$set": bson.M{"email": 5, "age": 400}}, []string{"age: 400 is more than the maximum 150", "email: is int, not string"}},
+		{bson.M{"$set": bson.M{"profile.handle": 1}}, []string{"profile.handle: is int, not string"}},
+		{bson.M{"$set": bson.M{"profile.address.city": 75}}, []string{"profile.address.city: is int, not string"}},
+		{bson.M{"$set": bson.M{"profile.address": bson.M{}}}, []string{"profile.address.city: is required"}},
+		{bson.M{"$set": bson.M{"profile": bson.M{"handle": "ada"}}}, nil},
+		{bson.M{"$set": bson.M{"tags.1": 2}}, []string{"tags.1: is int, not string"}},
+		{bson.M{"$set": bson.M{"tags.1": "b"}}, nil},
+		{bson.M{"$set": bson.M{"addresses.2.street": 1}}, []string{"addresses.2.street: is int, not string"}},
+		{bson.M{"$set": bson.M{"addresses.2": bson.M{"city": "paris"}}}, []string{"addresses.2.street: is required"}},
+		// nothing constrains it
+		{bson.M{"$set": bson.M{"profile.extra.deep": 1}}, nil},
+		{bson.M{"$inc": bson.M{"age": 1}}, nil},
+		// unset
+		{bson.M{"$unset": bson.M{"email": ""}}, []string{"email: is required, can't be unset"}},
+		{bson.M{"$unset": bson.M{"profile.handle": ""}}, []string{"profile.handle: is required, can't be unset"}},
+		{bson.M{"$unset": bson.M{"profile.address.city": ""}}, []string{"profile.address.city: is required, can't be unset"}},
+		{bson.M{"$unset": bson.M{"age": "", "profile.address": ""}}, nil},
+		{bson.M{"$unset": bson.M{"profile.extra.city": ""}}, nil},
+		// without operators it replaces the document
+		{bson.M{"_id": id, "email": "ada@example.com"}, []string{"profile: is required"}},
+		{user(nil), nil},
+	} {
+		if got := violations(v.Update(c.update)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: %q, want %q", c.update, got, c.want)
+		}
+	}
+}
+
+func TestNewValidatorInvalid(t *testing.T) {
+	for _, c := range []struct {
+		schema, err string
+	}{
+		{`{"bsonType": 5}`, "bsonType: must be a string or a list of them"},
+		{`{"type": ["string", 1]}`, "type: must be a list of strings"},
+		{`{"pattern": 1}`, "pattern must be a string"},
+		{`{"pattern": "("}`, "pattern: error parsing regexp"},
+		{`{"required": "email"}`, "required: must be a string or a list of them"},
+		{`{"properties": []}`, "properties must be an object"},
+		{`{"properties": {"email": "string"}}`, "properties.email must be an object"},
+		{`{"properties": {"profile": {"properties": {"handle": {"bsonType": 1}}}}}`, "profile.handle: bsonType: must be a string"},
+		{`{"items": true}`, "items must be an object"},
+		{`{"properties": {"tags": {"items": {"pattern": "["}}}}`, "tags[]: pattern: error parsing regexp"},
+		{`{"additionalProperties": "no"}`, "additionalProperties must be a boolean"},
+	} {
+		var s map[string]interface{}
+		if err := json.Unmarshal([]byte(c.schema), &s); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewValidator(s); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v, want %q", c.schema, err, c.err)
+		}
+	}
+}
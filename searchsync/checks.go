@@ -0,0 +1,31 @@
+package searchsync
+
+import (
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		return []cli.Check{
+			{Name: "SEARCH_NS, SEARCH_URL and SEARCH_ENGINE", Run: checkSettings},
+			{Name: "SEARCH_URL", Run: func() error {
+				if err := checkSettings(); err != nil {
+					return err
+				}
+				eng, err := newEngine()
+				if err != nil {
+					return err
+				}
+				_, err = eng.ids()
+				return err
+			}},
+			{Name: "MONGO_URL", Run: func() error {
+				if err := checkSettings(); err != nil {
+					return err
+				}
+				return dial.Probe(*mongoURL, privileges()...)
+			}},
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package searchsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+)
+
+// an engine is a search index documents are kept in, by their id field
+type engine interface {
+	// ensure creates the index if it needs to be before documents are added
+	ensure() error
+	// upsert adds documents, replacing those with their ids
+	upsert(docs []map[string]interface{}) error
+	// remove deletes the documents of ids, those already gone included
+	remove(ids []string) error
+	// ids returns the ids of every document in the index
+	ids() (map[string]bool, error)
+}
+
+// client talks to every engine
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// api is an engine's http api, authenticated as the search entry of
+// SINK_AUTH_FILE
+type api struct {
+	base string
+	auth *sinkauth.Auth
+}
+
+// notFound is the error of a 404
+type notFound struct{ url string }
+
+func (e notFound) Error() string { return e.url + " not found" }
+
+// do sends a request of body, giving the response's body to read unless
+// it's nil, and fails unless it's answered with a 2xx
+func (a *api) do(method, path string, body []byte, contentType string, read func(io.Reader) error) error {
+	req, err := http.NewRequest(method, a.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if err := a.auth.Apply(req); err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s", sinkauth.Redact(err.Error()))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return notFound{a.base + path}
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s answered %s: %s", method, a.base+path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if read == nil {
+		return nil
+	}
+	return read(resp.Body)
+}
+
+// meilisearch keeps an index of meilisearch, https://www.meilisearch.com.
+// What it's sent is queued there as tasks, so a document it refuses shows
+// in the index's failed tasks rather than here.
+type meilisearch struct {
+	api
+	index string
+}
+
+func (m *meilisearch) ensure() error {
+	return nil // created by the first documents added
+}
+
+func (m *meilisearch) upsert(docs []map[string]interface{}) error {
+	body, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	return m.do("POST", "/indexes/"+url.PathEscape(m.index)+"/documents?primaryKey=id", body, "application/json", nil)
+}
+
+func (m *meilisearch) remove(ids []string) error {
+	body, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return m.do("POST", "/indexes/"+url.PathEscape(m.index)+"/documents/delete-batch", body, "application/json", nil)
+}
+
+func (m *meilisearch) ids() (map[string]bool, error) {
+	ids := map[string]bool{}
+	const page = 1000
+	for offset := 0; ; offset += page {
+		var res struct {
+			Results []struct {
+				ID interface{} `json:"id"`
+			} `json:"results"`
+		}
+		path := fmt.Sprintf("/indexes/%s/documents?fields=id&limit=%d&offset=%d", url.PathEscape(m.index), page, offset)
+		err := m.do("GET", path, nil, "", func(r io.Reader) error {
+			d := json.NewDecoder(r)
+			d.UseNumber()
+			return d.Decode(&res)
+		})
+		if _, ok := err.(notFound); ok {
+			return ids, nil // no index yet
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range res.Results {
+			ids[fmt.Sprint(doc.ID)] = true
+		}
+		if len(res.Results) < page {
+			return ids, nil
+		}
+	}
+}
+
+// typesense keeps a collection of typesense, https://typesense.org,
+// creating it with field types detected and nested fields if it's missing
+type typesense struct {
+	api
+	collection string
+}
+
+func (t *typesense) ensure() error {
+	err := t.do("GET", "/collections/"+url.PathEscape(t.collection), nil, "", nil)
+	if _, ok := err.(notFound); !ok {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"name":                 t.collection,
+		"fields":               []map[string]string{{"name": ".*", "type": "auto"}},
+		"enable_nested_fields": true,
+	})
+	if err != nil {
+		return err
+	}
+	return t.do("POST", "/collections", body, "application/json", nil)
+}
+
+func (t *typesense) upsert(docs []map[string]interface{}) error {
+	var body bytes.Buffer
+	for _, doc := range docs {
+		line, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		body.Write(append(line, '\n'))
+	}
+	// answered with a line for each document, whether it was imported
+	failed, first := 0, ""
+	err := t.do("POST", "/collections/"+url.PathEscape(t.collection)+"/documents/import?action=upsert", body.Bytes(), "text/plain", func(r io.Reader) error {
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			var res struct {
+				Success bool   `json:"success"`
+				Error   string `json:"error"`
+			}
+			if err := json.Unmarshal(s.Bytes(), &res); err != nil {
+				return err
+			}
+			if !res.Success {
+				if failed++; first == "" {
+					first = res.Error
+				}
+			}
+		}
+		return s.Err()
+	})
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("typesense refused %d of %d documents, the first as %s", failed, len(docs), first)
+	}
+	return err
+}
+
+func (t *typesense) remove(ids []string) error {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = "`" + id + "`"
+	}
+	q := url.Values{"filter_by": {"id:[" + strings.Join(quoted, ",") + "]"}}
+	return t.do("DELETE", "/collections/"+url.PathEscape(t.collection)+"/documents?"+q.Encode(), nil, "", nil)
+}
+
+func (t *typesense) ids() (map[string]bool, error) {
+	ids := map[string]bool{}
+	err := t.do("GET", "/collections/"+url.PathEscape(t.collection)+"/documents/export?include_fields=id", nil, "", func(r io.Reader) error {
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			var doc struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(s.Bytes(), &doc); err != nil {
+				return err
+			}
+			ids[doc.ID] = true
+		}
+		return s.Err()
+	})
+	return ids, err
+}
@@ -0,0 +1,157 @@
+package searchsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// request is what a fake engine was sent
+type request struct {
+	method, uri, contentType, body string
+}
+
+// fake serves the api of an engine with answer, recording what it's sent
+func fake(t *testing.T, answer func(w http.ResponseWriter, r *http.Request)) (*api, *[]request) {
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = append(got, request{r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type"), string(body)})
+		answer(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return &api{base: srv.URL}, &got
+}
+
+func TestMeilisearch(t *testing.T) {
+	a, got := fake(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"results": [{"id": "a"}, {"id": 12345678901234567890}], "total": 2}`)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	m := &meilisearch{api: *a, index: "app users"}
+	if err := m.upsert([]map[string]interface{}{{"id": "a", "name": "ada"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.remove([]string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := m.ids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, map[string]bool{"a": true, "12345678901234567890": true}) {
+		t.Errorf("ids %v", ids)
+	}
+	want := []request{
+		{"POST", "/indexes/app%20users/documents?primaryKey=id", "application/json", `[{"id":"a","name":"ada"}]`},
+		{"POST", "/indexes/app%20users/documents/delete-batch", "application/json", `["b","c"]`},
+		{"GET", "/indexes/app%20users/documents?fields=id&limit=1000&offset=0", "", ""},
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("sent %v, want %v", *got, want)
+	}
+}
+
+func TestMeilisearchPages(t *testing.T) {
+	a, got := fake(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("offset") != "0" {
+			fmt.Fprint(w, `{"results": [{"id": "last"}]}`)
+			return
+		}
+		results := make([]map[string]int, 1000)
+		for i := range results {
+			results[i] = map[string]int{"id": i}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	})
+	ids, err := (&meilisearch{api: *a, index: "users"}).ids()
+	if err != nil || len(ids) != 1001 || !ids["999"] || !ids["last"] || len(*got) != 2 {
+		t.Errorf("%d ids over %d pages, %v", len(ids), len(*got), err)
+	}
+}
+
+func TestMeilisearchErrors(t *testing.T) {
+	a, _ := fake(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"message": "invalid primary key"}`+"\n")
+	})
+	m := &meilisearch{api: *a, index: "users"}
+	if ids, err := m.ids(); err != nil || len(ids) != 0 {
+		t.Errorf("no index yet: %v, %v", ids, err)
+	}
+	err := m.upsert([]map[string]interface{}{{"id": "a"}})
+	if err == nil || !strings.Contains(err.Error(), `400 Bad Request: {"message": "invalid primary key"}`) {
+		t.Errorf("refused: %v", err)
+	}
+}
+
+func TestTypesenseEnsure(t *testing.T) {
+	exists := false
+	a, got := fake(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && !exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	ts := &typesense{api: *a, collection: "users"}
+	if err := ts.ensure(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*got) != 2 || (*got)[1].uri != "/collections" {
+		t.Fatalf("sent %v, want the collection created", *got)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte((*got)[1].body), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema["name"] != "users" || schema["enable_nested_fields"] != true {
+		t.Errorf("created %v", schema)
+	}
+	exists = true
+	*got = nil
+	if err := ts.ensure(); err != nil || len(*got) != 1 {
+		t.Errorf("already there: sent %v, %v", *got, err)
+	}
+}
+
+func TestTypesense(t *testing.T) {
+	a, got := fake(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/import"):
+			fmt.Fprint(w, `{"success": true}`+"\n"+`{"success": false, "error": "bad field"}`+"\n"+`{"success": false, "error": "other"}`+"\n")
+		case strings.Contains(r.URL.Path, "/export"):
+			fmt.Fprint(w, `{"id": "a"}`+"\n"+`{"id": "b"}`+"\n")
+		}
+	})
+	ts := &typesense{api: *a, collection: "users"}
+	err := ts.upsert([]map[string]interface{}{{"id": "a"}, {"id": "b"}, {"id": "c"}})
+	if err == nil || err.Error() != "typesense refused 2 of 3 documents, the first as bad field" {
+		t.Errorf("refused: %v", err)
+	}
+	if err := ts.remove([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := ts.ids()
+	if err != nil || !reflect.DeepEqual(ids, map[string]bool{"a": true, "b": true}) {
+		t.Errorf("ids %v, %v", ids, err)
+	}
+	want := []request{
+		{"POST", "/collections/users/documents/import?action=upsert", "text/plain", `{"id":"a"}` + "\n" + `{"id":"b"}` + "\n" + `{"id":"c"}` + "\n"},
+		{"DELETE", "/collections/users/documents?filter_by=id%3A%5B%60a%60%2C%60b%60%5D", "", ""},
+		{"GET", "/collections/users/documents/export?include_fields=id", "", ""},
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("sent %v, want %v", *got, want)
+	}
+}
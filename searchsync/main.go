@@ -0,0 +1,439 @@
+// Package searchsync keeps a Meilisearch index or Typesense collection in
+// sync with a collection, the oplogctl searchsync command.
+//
+// The collection's documents are indexed by their _id as id, hex for an
+// ObjectId, with dates in unix milliseconds and the rest of bson as plain
+// json has it. Changes are read from the oplog and the documents they
+// touch looked up, indexed if they're there and deleted if not, so
+// what's indexed is the collection's as it is however the changes came.
+// It's reconciled with the collection on start and every
+// SEARCH_RECONCILE: everything indexed again and what it no longer has
+// deleted, catching up on whatever was missed.
+package searchsync
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("searchsync", "keep a meilisearch or typesense index in sync with a collection")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL      = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the replica set the collection is on")
+	searchNS      = flags.String("SEARCH_NS", "", "db.collection indexed")
+	searchURL     = flags.String("SEARCH_URL", "", "url of the search engine's api, authenticated as the search entry of SINK_AUTH_FILE, a bearer key for meilisearch and an apikey of header X-TYPESENSE-API-KEY for typesense")
+	searchEngine  = flags.String("SEARCH_ENGINE", "meilisearch", "meilisearch or typesense")
+	searchIndex   = flags.String("SEARCH_INDEX", "", "index or collection the documents are kept in, SEARCH_NS' collection if empty")
+	searchFields  = flags.String("SEARCH_FIELDS", "", "comma separated fields indexed, all of them if empty")
+	reconcileIn   = flags.Duration("SEARCH_RECONCILE", 24*time.Hour, "how often everything's indexed again and what's gone deleted, 0 for on start only")
+	batchSize     = flags.Int("SEARCH_BATCH", 500, "documents sent at a time")
+	resumeRetries = flags.Int("RESUME_RETRIES", 5, "times in a row a failed oplog cursor is resumed before giving up")
+)
+
+type entry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Operation string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+	Object    bson.M              `bson:"o"`
+	Query     bson.M              `bson:"o2"`
+}
+
+func splitNS(ns string) (string, string, error) {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", cli.Invalidf("SEARCH_NS %q must be db.collection", ns)
+	}
+	return parts[0], parts[1], nil
+}
+
+// checkSettings validates the settings besides the urls
+func checkSettings() error {
+	if _, _, err := splitNS(*searchNS); err != nil {
+		return err
+	}
+	if u, err := url.Parse(*searchURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return cli.Invalidf("SEARCH_URL %q must be an http or https url", *searchURL)
+	}
+	if *searchEngine != "meilisearch" && *searchEngine != "typesense" {
+		return cli.Invalidf("SEARCH_ENGINE %q must be meilisearch or typesense", *searchEngine)
+	}
+	if *batchSize <= 0 || *reconcileIn < 0 {
+		return cli.Invalidf("SEARCH_BATCH must be positive and SEARCH_RECONCILE not negative")
+	}
+	return nil
+}
+
+// privileges are what the sync needs
+func privileges() []dial.Privilege {
+	db, coll, _ := splitNS(*searchNS)
+	return []dial.Privilege{
+		{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+		{DB: db, Collection: coll, Actions: []string{"find"}},
+	}
+}
+
+// newEngine returns SEARCH_ENGINE at SEARCH_URL
+func newEngine() (engine, error) {
+	auths, err := sinkauth.Load()
+	if err != nil {
+		return nil, err
+	}
+	a := api{base: strings.TrimSuffix(*searchURL, "/"), auth: auths.Get("search")}
+	_, coll, _ := splitNS(*searchNS)
+	index := *searchIndex
+	if index == "" {
+		index = coll
+	}
+	if *searchEngine == "typesense" {
+		return &typesense{api: a, collection: index}, nil
+	}
+	return &meilisearch{api: a, index: index}, nil
+}
+
+// syncer indexes a collection's documents
+type syncer struct {
+	coll   *mgo.Collection
+	engine engine
+	fields bson.M // the projection of SEARCH_FIELDS, nil for all
+}
+
+// index looks up the documents of ids, sending those there and deleting
+// the rest
+func (s *syncer) index(ids map[string]interface{}) error {
+	list := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, id)
+	}
+	for len(list) > 0 {
+		n := len(list)
+		if n > *batchSize {
+			n = *batchSize
+		}
+		var found []bson.M
+		if err := s.coll.Find(bson.M{"_id": bson.M{"$in": list[:n]}}).Select(s.fields).All(&found); err != nil {
+			return err
+		}
+		gone := map[string]bool{}
+		for _, id := range list[:n] {
+			gone[idString(id)] = true
+		}
+		docs := make([]map[string]interface{}, len(found))
+		for i, doc := range found {
+			docs[i] = document(doc)
+			delete(gone, docs[i]["id"].(string))
+		}
+		if len(docs) > 0 {
+			if err := s.engine.upsert(docs); err != nil {
+				return err
+			}
+		}
+		if len(gone) > 0 {
+			if err := s.engine.remove(keys(gone)); err != nil {
+				return err
+			}
+		}
+		list = list[n:]
+	}
+	return nil
+}
+
+// reconcile indexes every document, deleting what the index has besides,
+// returning how many of each
+func (s *syncer) reconcile() (int, int, error) {
+	if err := s.engine.ensure(); err != nil {
+		return 0, 0, err
+	}
+	have := map[string]bool{}
+	iter := s.coll.Find(nil).Select(s.fields).Batch(*batchSize).Iter()
+	var doc bson.M
+	var docs []map[string]interface{}
+	for iter.Next(&doc) {
+		d := document(doc)
+		have[d["id"].(string)] = true
+		if docs = append(docs, d); len(docs) == *batchSize {
+			if err := s.engine.upsert(docs); err != nil {
+				iter.Close()
+				return 0, 0, err
+			}
+			docs = nil
+		}
+		doc = nil
+	}
+	if err := iter.Close(); err != nil {
+		return 0, 0, err
+	}
+	if len(docs) > 0 {
+		if err := s.engine.upsert(docs); err != nil {
+			return 0, 0, err
+		}
+	}
+	indexed, err := s.engine.ids()
+	if err != nil {
+		return 0, 0, err
+	}
+	var stale []string
+	for id := range indexed {
+		if !have[id] {
+			stale = append(stale, id)
+		}
+	}
+	for i := 0; i < len(stale); i += *batchSize {
+		end := i + *batchSize
+		if end > len(stale) {
+			end = len(stale)
+		}
+		if err := s.engine.remove(stale[i:end]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(have), len(stale), nil
+}
+
+func keys(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for k := range set {
+		list = append(list, k)
+	}
+	return list
+}
+
+// touched adds the _ids of what e changes in ns to ids, those of the
+// operations of its transaction too, reporting whether it drops or
+// renames the collection, or its db, so everything's reconciled
+func touched(e entry, ns string, ids map[string]interface{}) bool {
+	db, coll, _ := splitNS(ns)
+	var id interface{}
+	switch {
+	case e.Operation == "c" && e.Namespace == "admin.$cmd":
+		ops, _ := e.Object["applyOps"].([]interface{})
+		reset := false
+		for _, op := range ops {
+			if m, ok := op.(bson.M); ok {
+				var inner entry
+				raw, err := bson.Marshal(m)
+				if err == nil && bson.Unmarshal(raw, &inner) == nil {
+					reset = touched(inner, ns, ids) || reset
+				}
+			}
+		}
+		return reset
+	case e.Operation == "c" && e.Namespace == db+".$cmd":
+		return e.Object["drop"] == coll || e.Object["dropDatabase"] != nil ||
+			e.Object["renameCollection"] == ns || e.Object["to"] == ns
+	case e.Namespace != ns:
+		return false
+	case e.Operation == "u":
+		id = e.Query["_id"]
+	case e.Operation == "i" || e.Operation == "d":
+		id = e.Object["_id"]
+	}
+	if id != nil {
+		ids[idString(id)] = id
+	}
+	return false
+}
+
+// idString returns an _id as the index's id, ObjectIds in hex, numbers
+// in decimal and the rest but strings as extended json
+func idString(id interface{}) string {
+	switch id := id.(type) {
+	case bson.ObjectId:
+		return id.Hex()
+	case string:
+		return id
+	case int, int32, int64:
+		return fmt.Sprint(id)
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	}
+	data, err := bsonfile.MarshalJSON(id)
+	if err != nil {
+		return fmt.Sprint(id)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// document returns doc as it's indexed
+func document(doc bson.M) map[string]interface{} {
+	d := plain(doc).(map[string]interface{})
+	delete(d, "_id")
+	d["id"] = idString(doc["_id"])
+	return d
+}
+
+// plain returns v as plain json has it, for engines that take no extended
+// json
+func plain(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = plain(e)
+		}
+		return m
+	case bson.D:
+		return plain(v.Map())
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = plain(e)
+		}
+		return a
+	case bson.ObjectId:
+		return v.Hex()
+	case time.Time:
+		return v.UnixNano() / int64(time.Millisecond)
+	case bson.MongoTimestamp:
+		return int64(v >> 32)
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return v.String()
+		}
+		return plain(f)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case bson.Binary:
+		return base64.StdEncoding.EncodeToString(v.Data)
+	case bson.RegEx:
+		return v.Pattern
+	case bson.JavaScript:
+		return v.Code
+	case bson.Symbol:
+		return string(v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+	}
+	return v
+}
+
+// Main runs oplogctl searchsync, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if err := checkSettings(); err != nil {
+		panic(err)
+	}
+	db, coll, _ := splitNS(*searchNS)
+	eng, err := newEngine()
+	if err != nil {
+		panic(err)
+	}
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	if err := dial.CheckPrivileges(sess, privileges()...); err != nil {
+		panic(err)
+	}
+	s := &syncer{coll: sess.DB(db).C(coll), engine: eng}
+	if *searchFields != "" {
+		s.fields = bson.M{}
+		for _, f := range strings.Split(*searchFields, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				s.fields[f] = 1
+			}
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// what's written from the latest entry on is indexed after the
+	// reconcile, in case it's missed what's written meanwhile
+	var last entry
+	if err := sess.DB("local").C("oplog.rs").Find(nil).Select(bson.M{"ts": 1}).Sort("-$natural").One(&last); err != nil {
+		panic(err)
+	}
+	fmt.Printf("indexing %s in %s %s\n", *searchNS, *searchEngine, *searchURL)
+	reconcile := func() bool {
+		n, removed, err := s.reconcile()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reconcile: %s, retrying in a minute\n", err)
+			sess.Refresh()
+			return false
+		}
+		fmt.Printf("reconciled %d, removed %d\n", n, removed)
+		return true
+	}
+	failed := !reconcile()
+	reconciled, reset := time.Now(), false
+
+	pending := map[string]interface{}{}
+	flushed := time.Now()
+	flush := func() {
+		if err := s.index(pending); err != nil {
+			fmt.Fprintf(os.Stderr, "index: %s, retrying\n", err)
+			sess.Refresh()
+			return
+		}
+		pending = map[string]interface{}{}
+	}
+	watched := bson.M{"$or": []bson.M{{"ns": *searchNS}, {"ns": db + ".$cmd"}, {"ns": "admin.$cmd"}}, "ts": nil}
+	for failures := 0; ; failures++ {
+		watched["ts"] = bson.M{"$gt": last.Timestamp}
+		iter := sess.DB("local").
+			C("oplog.rs").
+			Find(watched).
+			Sort("$natural").
+			LogReplay().
+			Tail(time.Second)
+		for {
+			idle := false
+			if iter.Next(&last) {
+				failures = 0
+				reset = touched(last, *searchNS, pending) || reset
+				last.Object, last.Query = nil, nil // not merged into by the next
+			} else if iter.Timeout() {
+				idle = true
+			} else {
+				break
+			}
+			// looked up once the entries written at once are read, every
+			// second while more keep coming, a batch at a time
+			if len(pending) > 0 && (idle || len(pending) >= *batchSize || time.Since(flushed) >= time.Second) {
+				flush()
+				flushed = time.Now()
+			}
+			since := time.Since(reconciled)
+			if reset || failed && since >= time.Minute || *reconcileIn > 0 && since >= *reconcileIn {
+				failed = !reconcile()
+				reconciled, reset = time.Now(), false
+			}
+			select {
+			case <-stop:
+				iter.Close()
+				return
+			default:
+			}
+		}
+		err = iter.Close()
+		if failures >= *resumeRetries {
+			panic(err)
+		}
+		fmt.Fprintf(os.Stderr, "oplog cursor failed: %v, resuming\n", err)
+		time.Sleep(time.Second)
+		sess.Refresh()
+	}
+}
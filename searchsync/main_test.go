@@ -0,0 +1,230 @@
+package searchsync
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// settings has the searchsync settings be valid ones for the rest of the
+// test
+func settings(t *testing.T) {
+	ns, u, eng, index, batch, every := *searchNS, *searchURL, *searchEngine, *searchIndex, *batchSize, *reconcileIn
+	t.Cleanup(func() {
+		*searchNS, *searchURL, *searchEngine, *searchIndex, *batchSize, *reconcileIn = ns, u, eng, index, batch, every
+	})
+	*searchNS, *searchURL, *searchEngine, *searchIndex, *batchSize, *reconcileIn = "app.users", "http://search:7700/", "meilisearch", "", 500, time.Hour
+}
+
+func TestCheckSettings(t *testing.T) {
+	settings(t)
+	if err := checkSettings(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		set  func()
+		want string
+	}{
+		{func() { *searchNS = "users" }, "must be db.collection"},
+		{func() { *searchURL = "" }, "must be an http or https url"},
+		{func() { *searchURL = "search:7700" }, "must be an http or https url"},
+		{func() { *searchEngine = "elasticsearch" }, "must be meilisearch or typesense"},
+		{func() { *batchSize = 0 }, "SEARCH_BATCH must be positive"},
+		{func() { *reconcileIn = -time.Second }, "SEARCH_RECONCILE not negative"},
+	} {
+		settings(t)
+		c.set()
+		if err := checkSettings(); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v, want %s", err, c.want)
+		}
+	}
+}
+
+func TestNewEngine(t *testing.T) {
+	settings(t)
+	eng, err := newEngine()
+	if m, ok := eng.(*meilisearch); err != nil || !ok || m.index != "users" || m.base != "http://search:7700" {
+		t.Errorf("%#v, %v", eng, err)
+	}
+	*searchEngine, *searchIndex = "typesense", "people"
+	eng, err = newEngine()
+	if ts, ok := eng.(*typesense); err != nil || !ok || ts.collection != "people" {
+		t.Errorf("%#v, %v", eng, err)
+	}
+}
+
+func TestTouched(t *testing.T) {
+	id := bson.ObjectIdHex("5f1d7a9e8b3c4d2e1f0a9b8c")
+	for _, c := range []struct {
+		name  string
+		e     entry
+		ids   []string
+		reset bool
+	}{
+		{"insert", entry{Operation: "i", Namespace: "app.users", Object: bson.M{"_id": id}}, []string{id.Hex()}, false},
+		{"update", entry{Operation: "u", Namespace: "app.users", Object: bson.M{"$set": bson.M{"a": 1}}, Query: bson.M{"_id": 7}}, []string{"7"}, false},
+		{"delete", entry{Operation: "d", Namespace: "app.users", Object: bson.M{"_id": "ada"}}, []string{"ada"}, false},
+		{"another collection", entry{Operation: "i", Namespace: "app.orders", Object: bson.M{"_id": 1}}, nil, false},
+		{"noop", entry{Operation: "n", Namespace: "app.users", Object: bson.M{"msg": "x"}}, nil, false},
+		{"transaction", entry{Operation: "c", Namespace: "admin.$cmd", Object: bson.M{"applyOps": []interface{}{
+			bson.M{"op": "i", "ns": "app.users", "o": bson.M{"_id": 1}},
+			bson.M{"op": "i", "ns": "app.orders", "o": bson.M{"_id": 2}},
+			bson.M{"op": "u", "ns": "app.users", "o": bson.M{"$set": bson.M{"a": 1}}, "o2": bson.M{"_id": 3}},
+		}}}, []string{"1", "3"}, false},
+		{"drop", entry{Operation: "c", Namespace: "app.$cmd", Object: bson.M{"drop": "users"}}, nil, true},
+		{"drop another", entry{Operation: "c", Namespace: "app.$cmd", Object: bson.M{"drop": "orders"}}, nil, false},
+		{"drop database", entry{Operation: "c", Namespace: "app.$cmd", Object: bson.M{"dropDatabase": 1}}, nil, true},
+		{"renamed away", entry{Operation: "c", Namespace: "app.$cmd", Object: bson.M{"renameCollection": "app.users", "to": "app.old"}}, nil, true},
+		{"renamed over", entry{Operation: "c", Namespace: "app.$cmd", Object: bson.M{"renameCollection": "app.new", "to": "app.users"}}, nil, true},
+		{"another database", entry{Operation: "c", Namespace: "other.$cmd", Object: bson.M{"drop": "users"}}, nil, false},
+		{"dropped in a transaction", entry{Operation: "c", Namespace: "admin.$cmd", Object: bson.M{"applyOps": []interface{}{
+			bson.M{"op": "c", "ns": "app.$cmd", "o": bson.M{"drop": "users"}},
+		}}}, nil, true},
+	} {
+		ids := map[string]interface{}{}
+		reset := touched(c.e, "app.users", ids)
+		var got []string
+		for id := range ids {
+			got = append(got, id)
+		}
+		sort.Strings(got)
+		if reset != c.reset || !reflect.DeepEqual(got, c.ids) {
+			t.Errorf("%s: %v, reset %v, want %v, %v", c.name, got, reset, c.ids, c.reset)
+		}
+	}
+}
+
+func TestIDString(t *testing.T) {
+	for _, c := range []struct {
+		id   interface{}
+		want string
+	}{
+		{bson.ObjectIdHex("5f1d7a9e8b3c4d2e1f0a9b8c"), "5f1d7a9e8b3c4d2e1f0a9b8c"},
+		{"ada", "ada"},
+		{7, "7"},
+		{int64(1) << 40, "1099511627776"},
+		{2.5, "2.5"},
+		{1e21, "1000000000000000000000"},
+		{bson.M{"a": 1}, `{"a":1}`},
+	} {
+		if got := idString(c.id); got != c.want {
+			t.Errorf("%#v: %s, want %s", c.id, got, c.want)
+		}
+	}
+}
+
+func TestDocument(t *testing.T) {
+	dec, _ := bson.ParseDecimal128("12.50")
+	at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	id := bson.ObjectIdHex("5f1d7a9e8b3c4d2e1f0a9b8c")
+	got := document(bson.M{
+		"_id":     id,
+		"owner":   id,
+		"at":      at,
+		"ts":      bson.MongoTimestamp(1714521600 << 32),
+		"price":   dec,
+		"avatar":  []byte{1, 2},
+		"blob":    bson.Binary{Kind: 4, Data: []byte{3}},
+		"pattern": bson.RegEx{Pattern: "^a", Options: "i"},
+		"score":   math.NaN(),
+		"addr":    bson.D{{Name: "city", Value: "london"}},
+		"tags":    []interface{}{"a", bson.M{"at": at}},
+	})
+	want := map[string]interface{}{
+		"id":      "5f1d7a9e8b3c4d2e1f0a9b8c",
+		"owner":   "5f1d7a9e8b3c4d2e1f0a9b8c",
+		"at":      int64(1714521600000),
+		"ts":      int64(1714521600),
+		"price":   12.5,
+		"avatar":  "AQI=",
+		"blob":    "Aw==",
+		"pattern": "^a",
+		"score":   nil,
+		"addr":    map[string]interface{}{"city": "london"},
+		"tags":    []interface{}{"a", map[string]interface{}{"at": int64(1714521600000)}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%v\nwant %v", got, want)
+	}
+}
+
+// recorder is an engine recording what it's sent
+type recorder struct {
+	docs    map[string]map[string]interface{}
+	removed []string
+}
+
+func (r *recorder) ensure() error { return nil }
+
+func (r *recorder) upsert(docs []map[string]interface{}) error {
+	for _, d := range docs {
+		r.docs[d["id"].(string)] = d
+	}
+	return nil
+}
+
+func (r *recorder) remove(ids []string) error {
+	for _, id := range ids {
+		delete(r.docs, id)
+		r.removed = append(r.removed, id)
+	}
+	return nil
+}
+
+func (r *recorder) ids() (map[string]bool, error) {
+	ids := map[string]bool{}
+	for id := range r.docs {
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// TestSyncer indexes and reconciles a collection. It needs mongodb at
+// MONGO_URL, and is skipped without one.
+func TestSyncer(t *testing.T) {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("no mongodb, MONGO_URL is empty")
+	}
+	sess, err := mgo.DialWithTimeout(url, 2*time.Second)
+	if err != nil {
+		t.Skipf("no mongodb at MONGO_URL: %s", err)
+	}
+	defer sess.Close()
+	settings(t)
+	*batchSize = 2
+	c := sess.DB("searchsync_test").C("users")
+	defer sess.DB("searchsync_test").DropDatabase()
+	c.DropCollection()
+	for i := 1; i <= 5; i++ {
+		if err := c.Insert(bson.M{"_id": i, "name": "user", "secret": "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eng := &recorder{docs: map[string]map[string]interface{}{"9": {"id": "9"}}}
+	s := &syncer{coll: c, engine: eng, fields: bson.M{"name": 1}}
+	indexed, removed, err := s.reconcile()
+	if err != nil || indexed != 5 || removed != 1 || len(eng.docs) != 5 {
+		t.Fatalf("%d indexed, %d removed, %v", indexed, removed, err)
+	}
+	if d := eng.docs["3"]; d["name"] != "user" || d["secret"] != nil {
+		t.Errorf("indexed %v, want only SEARCH_FIELDS", d)
+	}
+
+	c.RemoveId(2)
+	c.UpdateId(3, bson.M{"$set": bson.M{"name": "renamed"}})
+	ids := map[string]interface{}{"2": 2, "3": 3, "6": 6}
+	if err := s.index(ids); err != nil {
+		t.Fatal(err)
+	}
+	if eng.docs["2"] != nil || eng.docs["3"]["name"] != "renamed" || len(eng.docs) != 4 {
+		t.Errorf("indexed %v", eng.docs)
+	}
+}
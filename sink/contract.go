@@ -0,0 +1,238 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"github.com/ianschenck/envflag"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	contractFile = envflag.String("SINK_CONTRACT_FILE", "", "json file of the fields each sink's events must carry and how the missing ones are looked up, by sink name, see package sink")
+	lookupTTL    = envflag.Duration("SINK_LOOKUP_TTL", 5*time.Minute, "how long a contract lookup's result is reused")
+)
+
+// contracts has a map of enriched and rejected counts per sink with a
+// contract
+var contracts = expvar.NewMap("sink_contracts")
+
+// Contract is the fields a sink's events must carry, an entry of the
+// SINK_CONTRACT_FILE json:
+//
+//	{
+//	  "quarantine": {
+//	    "required": ["ns", "tenantId"],
+//	    "lookup": {
+//	      "tenantId": {"by": "ns", "url": "mongodb://db0/", "ns": "app.tenants", "key": "namespaces", "field": "_id"}
+//	    }
+//	  },
+//	  "drift": {
+//	    "required": ["team"],
+//	    "lookup": {"team": {"by": "ns", "table": {"app.users": "identity", "app.orders": "checkout"}}}
+//	  }
+//	}
+//
+// A required field missing from an event is looked up by another of its
+// fields, in a table or the first document of a collection matching it.
+// Events still missing one are rejected, logged and counted, never sent.
+type Contract struct {
+	Required []string           `json:"required"` // dotted paths
+	Lookup   map[string]*Lookup `json:"lookup"`   // of required paths
+
+	counts *expvar.Map
+}
+
+// Lookup is how a required field is filled in
+type Lookup struct {
+	By    string                 `json:"by"`    // dotted path of the event's field looked up by
+	Table map[string]interface{} `json:"table"` // values by the By field's value as text
+	URL   string                 `json:"url"`   // mongodb url NS is on, instead of a table
+	NS    string                 `json:"ns"`
+	Key   string                 `json:"key"`   // field of NS matching the By field, _id if empty
+	Field string                 `json:"field"` // dotted path of the field of NS taken, the required one's if empty
+
+	c     *mgo.Collection
+	mu    sync.Mutex
+	cache map[string]cachedLookup
+}
+
+type cachedLookup struct {
+	v  interface{}
+	at time.Time
+}
+
+// loadContract returns the contract of sink name, nil if it has none
+func loadContract(name string) (*Contract, error) {
+	if *contractFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(*contractFile)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]*Contract
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("%s: %s", *contractFile, err)
+	}
+	c := all[name]
+	if c == nil {
+		return nil, nil
+	}
+	for path, l := range c.Lookup {
+		if err := l.open(path); err != nil {
+			return nil, fmt.Errorf("sink %s contract, %s: %s", name, path, err)
+		}
+	}
+	c.counts = new(expvar.Map).Init()
+	contracts.Set(name, c.counts)
+	return c, nil
+}
+
+func (l *Lookup) open(path string) error {
+	if l.By == "" {
+		return fmt.Errorf("lookup needs a by")
+	}
+	if l.Field == "" {
+		l.Field = path
+	}
+	if l.Key == "" {
+		l.Key = "_id"
+	}
+	l.cache = make(map[string]cachedLookup)
+	switch {
+	case l.Table != nil && l.URL != "":
+		return fmt.Errorf("lookup takes a table or a url, not both")
+	case l.Table != nil:
+		return nil
+	case l.URL == "":
+		return fmt.Errorf("lookup needs a table or a url")
+	}
+	parts := strings.SplitN(l.NS, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("lookup ns %q must be db.collection", l.NS)
+	}
+	sess, err := dial.Dial(l.URL)
+	if err != nil {
+		return err
+	}
+	l.c = sess.DB(parts[0]).C(parts[1])
+	return nil
+}
+
+// enforce returns body with the required fields missing looked up, or an
+// error if some can't be
+func (c *Contract) enforce(body []byte) ([]byte, error) {
+	if c == nil {
+		return body, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var event map[string]interface{}
+	if err := dec.Decode(&event); err != nil {
+		return nil, err
+	}
+	enriched := false
+	for _, path := range c.Required {
+		if get(event, path) != nil {
+			continue
+		}
+		l := c.Lookup[path]
+		if l == nil {
+			c.counts.Add("rejected", 1)
+			return nil, fmt.Errorf("event without %s rejected", path)
+		}
+		v, err := l.find(get(event, l.By))
+		if err != nil || v == nil {
+			c.counts.Add("rejected", 1)
+			if err == nil {
+				err = fmt.Errorf("%s not found by %s", path, l.By)
+			}
+			return nil, fmt.Errorf("event without %s rejected: %s", path, err)
+		}
+		set(event, path, v)
+		enriched = true
+	}
+	if !enriched {
+		return body, nil
+	}
+	c.counts.Add("enriched", 1)
+	return json.Marshal(event)
+}
+
+// find returns the value looked up by by, nil if there's none
+func (l *Lookup) find(by interface{}) (interface{}, error) {
+	if by == nil {
+		return nil, nil
+	}
+	text := fmt.Sprint(by)
+	if l.Table != nil {
+		return l.Table[text], nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.cache[text]; ok && time.Since(c.at) < *lookupTTL {
+		return c.v, nil
+	}
+	if n, ok := by.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			by = i
+		} else if f, err := n.Float64(); err == nil {
+			by = f
+		}
+	}
+	var doc bson.M
+	err := l.c.Find(bson.M{l.Key: by}).One(&doc)
+	if err == mgo.ErrNotFound {
+		doc, err = nil, nil
+	}
+	if err != nil {
+		l.c.Database.Session.Refresh()
+		return nil, err
+	}
+	var v interface{}
+	if doc != nil {
+		v = get(doc, l.Field)
+	}
+	l.cache[text] = cachedLookup{v: v, at: time.Now()}
+	return v, nil
+}
+
+// get returns the value at a dotted path of doc, nil if it's not there
+func get(doc map[string]interface{}, path string) interface{} {
+	var v interface{} = doc
+	for _, seg := range strings.Split(path, ".") {
+		switch m := v.(type) {
+		case map[string]interface{}:
+			v = m[seg]
+		case bson.M:
+			v = m[seg]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// set puts v at a dotted path of doc, making the objects on the way
+func set(doc map[string]interface{}, path string, v interface{}) {
+	segs := strings.Split(path, ".")
+	for _, seg := range segs[:len(segs)-1] {
+		next, ok := doc[seg].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			doc[seg] = next
+		}
+		doc = next
+	}
+	doc[segs[len(segs)-1]] = v
+}
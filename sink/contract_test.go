@@ -0,0 +1,132 @@
+package sink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// contracting has SINK_CONTRACT_FILE be a file of contracts for the rest
+// of the test
+func contracting(t *testing.T, contracts string) {
+	path := filepath.Join(t.TempDir(), "contracts.json")
+	if err := ioutil.WriteFile(path, []byte(contracts), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := *contractFile
+	*contractFile = path
+	t.Cleanup(func() { *contractFile = old })
+}
+
+func TestEnforce(t *testing.T) {
+	contracting(t, `{"drift": {
+		"required": ["ns", "owner.team"],
+		"lookup": {"owner.team": {"by": "ns", "table": {"app.users": "identity", "app.orders": "checkout"}}}
+	}}`)
+	c, err := loadContract("drift")
+	if err != nil || c == nil {
+		t.Fatalf("%v, %v", c, err)
+	}
+	for _, x := range []struct {
+		body, want, err string
+	}{
+		// carrying everything, sent as it is
+		{`{"ns":"app.users","owner":{"team":"growth"},"n":12345678901234567890}`, `{"ns":"app.users","owner":{"team":"growth"},"n":12345678901234567890}`, ""},
+		{`{"ns":"app.orders","n":12345678901234567890}`, `{"n":12345678901234567890,"ns":"app.orders","owner":{"team":"checkout"}}`, ""},
+		{`{"ns":"app.orders","owner":"nobody"}`, `{"ns":"app.orders","owner":{"team":"checkout"}}`, ""},
+		{`{"ns":"app.logs"}`, "", "owner.team rejected: owner.team not found by ns"},
+		{`{"owner":{"team":"growth"}}`, "", "event without ns rejected"},
+		{`not json`, "", "invalid"},
+	} {
+		got, err := c.enforce([]byte(x.body))
+		if x.err != "" {
+			if err == nil || !strings.Contains(err.Error(), x.err) {
+				t.Errorf("%s: %s, %v, want %s", x.body, got, err, x.err)
+			}
+			continue
+		}
+		if err != nil || string(got) != x.want {
+			t.Errorf("%s: %s, %v, want %s", x.body, got, err, x.want)
+		}
+	}
+	if got := c.counts.String(); got != `{"enriched": 2, "rejected": 2}` {
+		t.Errorf("counts %s", got)
+	}
+}
+
+func TestLoadContract(t *testing.T) {
+	contracting(t, `{"drift": {"required": ["ns"]}}`)
+	if c, err := loadContract("quarantine"); c != nil || err != nil {
+		t.Errorf("a sink without a contract: %v, %v", c, err)
+	}
+	for _, c := range []struct {
+		lookup, err string
+	}{
+		{`{"table": {}}`, "needs a by"},
+		{`{"by": "ns"}`, "needs a table or a url"},
+		{`{"by": "ns", "table": {}, "url": "mongodb://db0/"}`, "not both"},
+		{`{"by": "ns", "url": "mongodb://db0/", "ns": "tenants"}`, "must be db.collection"},
+	} {
+		contracting(t, `{"drift": {"required": ["team"], "lookup": {"team": `+c.lookup+`}}}`)
+		if _, err := loadContract("drift"); err == nil || !strings.HasPrefix(err.Error(), "sink drift contract, team: ") || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v", c.lookup, err)
+		}
+	}
+	contracting(t, `{"drift": ["ns"]}`)
+	if _, err := loadContract("drift"); err == nil {
+		t.Error("a contract that isn't an object loaded")
+	}
+}
+
+func TestLookupDefaults(t *testing.T) {
+	l := &Lookup{By: "ns", Table: map[string]interface{}{"7": "seven"}}
+	if err := l.open("owner.team"); err != nil {
+		t.Fatal(err)
+	}
+	if l.Field != "owner.team" || l.Key != "_id" {
+		t.Errorf("field %q, key %q", l.Field, l.Key)
+	}
+	// looked up by the value as text
+	if v, err := l.find(json.Number("7")); v != "seven" || err != nil {
+		t.Errorf("%v, %v", v, err)
+	}
+	if v, err := l.find(nil); v != nil || err != nil {
+		t.Errorf("by nothing: %v, %v", v, err)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	doc := map[string]interface{}{"a": map[string]interface{}{"b": 1}, "s": "text"}
+	if get(doc, "a.b") != 1 || get(doc, "a.c") != nil || get(doc, "s.x") != nil || get(doc, "z.y") != nil {
+		t.Errorf("get from %v", doc)
+	}
+	set(doc, "a.c", 2)
+	set(doc, "s.x", 3) // replacing what isn't an object
+	set(doc, "n.m.o", 4)
+	want := map[string]interface{}{
+		"a": map[string]interface{}{"b": 1, "c": 2},
+		"s": map[string]interface{}{"x": 3},
+		"n": map[string]interface{}{"m": map[string]interface{}{"o": 4}},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("%v, want %v", doc, want)
+	}
+}
+
+func TestSendRejected(t *testing.T) {
+	contracting(t, `{"drift": {"required": ["ns"]}}`)
+	path := filepath.Join(t.TempDir(), "events")
+	s, err := Open("drift", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send(map[string]string{"ns": "app.users"})
+	s.Send(map[string]string{"field": "email"})
+	s.Close()
+	if got := lines(t, path); len(got) != 1 || got[0]["ns"] != "app.users" {
+		t.Errorf("sent %v, want only the event carrying ns", got)
+	}
+}
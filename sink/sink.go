@@ -0,0 +1,184 @@
+// Package sink delivers events as json to where a sink's url points: an
+// http or https endpoint each event is posted to, authenticated with the
+// SINK_AUTH_FILE entry of the sink's name, or with file: a file they're
+// appended to a line each. Events are queued and sent in order by one
+// goroutine, dropped while the queue is full so what sends them never
+// waits. A sink with a Contract only sends the events carrying its fields.
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+
+	"github.com/ianschenck/envflag"
+)
+
+var (
+	retries = envflag.Int("SINK_RETRIES", 3, "times a failed delivery to a sink is retried, backing off from a second, before it's dropped")
+)
+
+// queued is how many events wait before more are dropped
+const queued = 1000
+
+// Sink is where one kind of event goes. A nil Sink drops everything.
+type Sink struct {
+	name     string
+	url      string
+	auth     *sinkauth.Auth
+	file     *os.File
+	contract *Contract
+	queue    chan []byte
+	done     chan struct{}
+}
+
+// Open returns the sink name at rawurl, nil if rawurl is empty
+func Open(name, rawurl string) (*Sink, error) {
+	if rawurl == "" {
+		return nil, nil
+	}
+	contract, err := loadContract(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &Sink{name: name, url: rawurl, contract: contract, queue: make(chan []byte, queued), done: make(chan struct{})}
+	switch {
+	case strings.HasPrefix(rawurl, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(rawurl, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %s", name, err)
+		}
+		s.file = f
+	default:
+		u, err := url.Parse(rawurl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("sink %s: %q must be http, https or file:path", name, rawurl)
+		}
+		auth, err := sinkauth.Load()
+		if err != nil {
+			return nil, err
+		}
+		s.auth = auth.Get(name)
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send queues event, marshalled as json
+func (s *Sink) Send(event interface{}) error {
+	if s == nil {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- body:
+	default:
+		fmt.Fprintf(os.Stderr, "sink %s: queue full, dropping an event\n", s.name)
+	}
+	return nil
+}
+
+// Publish delivers body now, posted with headers or written to a file as
+// {"headers": ..., "payload": body}, returning why it couldn't be after
+// SINK_RETRIES. What must not be dropped is published rather than sent.
+func (s *Sink) Publish(body []byte, headers http.Header) error {
+	if s == nil {
+		return nil
+	}
+	body, err := s.contract.enforce(body)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		line, err := json.Marshal(struct {
+			Headers http.Header     `json:"headers"`
+			Payload json.RawMessage `json:"payload"`
+		}{headers, body})
+		if err != nil {
+			return err
+		}
+		return s.deliver(line, nil)
+	}
+	if err := s.deliver(body, headers); err != nil {
+		return fmt.Errorf("sink %s: %s", s.name, sinkauth.Redact(err.Error()))
+	}
+	return nil
+}
+
+// Close delivers what's queued and closes the sink
+func (s *Sink) Close() error {
+	if s == nil {
+		return nil
+	}
+	close(s.queue)
+	<-s.done
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// client posts to every sink
+var client = &http.Client{Timeout: 10 * time.Second}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	for body := range s.queue {
+		body, err := s.contract.enforce(body)
+		if err == nil {
+			err = s.deliver(body, nil)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sink %s: %s\n", s.name, sinkauth.Redact(err.Error()))
+		}
+	}
+}
+
+// deliver writes or posts body, with headers, retrying SINK_RETRIES times
+// on failures
+func (s *Sink) deliver(body []byte, headers http.Header) error {
+	if s.file != nil {
+		_, err := s.file.Write(append(body, '\n'))
+		return err
+	}
+	var err error
+	for attempt := 0; attempt <= *retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << uint(attempt-1))
+		}
+		var req *http.Request
+		req, err = http.NewRequest("POST", s.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for name, values := range headers {
+			req.Header[name] = values
+		}
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if err = s.auth.Apply(req); err != nil {
+			continue
+		}
+		var resp *http.Response
+		if resp, err = client.Do(req); err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+		err = fmt.Errorf("%s answered %s", s.url, resp.Status)
+	}
+	return err
+}
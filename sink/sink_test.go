@@ -0,0 +1,201 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lines returns the json lines of the file at path
+func lines(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("%q: %s", scanner.Text(), err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestOpen(t *testing.T) {
+	s, err := Open("drift", "")
+	if s != nil || err != nil {
+		t.Errorf("no url: %v, %v, want a nil sink", s, err)
+	}
+	// a nil sink drops everything
+	if err := s.Send(map[string]int{"n": 1}); err != nil {
+		t.Error(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	for _, u := range []string{"ftp://example.com/", "http://", "example.com/events", "file:" + filepath.Join(t.TempDir(), "missing", "events")} {
+		if _, err := Open("drift", u); err == nil || !strings.Contains(err.Error(), "sink drift") {
+			t.Errorf("%s: %v", u, err)
+		}
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	if err := ioutil.WriteFile(path, []byte(`{"n":0}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open("drift", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := s.Send(map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Send(func() {}); err == nil {
+		t.Error("sent what isn't json")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := lines(t, path)
+	if len(got) != 4 {
+		t.Fatalf("%d lines, want the one there and 3 appended", len(got))
+	}
+	for i, m := range got {
+		if m["n"] != float64(i) {
+			t.Errorf("line %d: %v", i, m)
+		}
+	}
+}
+
+func TestSendHTTP(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		mu.Lock()
+		got = append(got, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	s, err := Open("drift", srv.URL+"/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ns := range []string{"app.a", "app.b", "app.c"} {
+		s.Send(map[string]string{"ns": ns})
+	}
+	s.Close()
+	want := []string{`{"ns":"app.a"}`, `{"ns":"app.b"}`, `{"ns":"app.c"}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("posted %v, want %v in order", got, want)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 1
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	s := &Sink{name: "drift", url: srv.URL}
+	if err := s.deliver([]byte(`{}`), nil); err != nil || attempts != 2 {
+		t.Errorf("%d attempts: %v, want delivered on the retry", attempts, err)
+	}
+
+	*retries = 0
+	attempts = 0
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	if err := s.deliver([]byte(`{}`), nil); err == nil || !strings.Contains(err.Error(), "502") || attempts != 1 {
+		t.Errorf("%d attempts: %v, want one failing", attempts, err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	var posted http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = r.Header
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	s, err := Open("outbox", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	headers := http.Header{"Ce-Id": {"m1"}, "Content-Type": {"application/cloudevents+json"}}
+	if err := s.Publish([]byte(`{"n":1}`), headers); err != nil {
+		t.Fatal(err)
+	}
+	if posted.Get("Ce-Id") != "m1" || posted.Get("Content-Type") != "application/cloudevents+json" {
+		t.Errorf("posted with %v", posted)
+	}
+
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 0
+	down, err := Open("outbox", srv.URL+"/down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+	if err := down.Publish([]byte(`{}`), nil); err == nil || !strings.HasPrefix(err.Error(), "sink outbox: ") {
+		t.Errorf("published to what's down: %v", err)
+	}
+
+	var nothing *Sink
+	if err := nothing.Publish([]byte(`{}`), nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPublishFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	s, err := Open("outbox", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish([]byte(`{"n": 1}`), http.Header{"Ce-Id": {"m1"}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	got := lines(t, path)
+	want := []map[string]interface{}{{
+		"headers": map[string]interface{}{"Ce-Id": []interface{}{"m1"}},
+		"payload": map[string]interface{}{"n": float64(1)},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%v, want %v", got, want)
+	}
+}
@@ -0,0 +1,286 @@
+// Package sinkauth holds the credentials sinks authenticate with, one entry
+// per sink name in the SINK_AUTH_FILE json:
+//
+//	{
+//	  "search":  {"type": "apikey", "header": "Authorization", "prefix": "ApiKey ", "key": "env:ES_KEY"},
+//	  "kafka":   {"type": "sasl", "mechanism": "SCRAM-SHA-512", "user": "stats", "password": "file:/run/secrets/kafka"},
+//	  "webhook": {"type": "oauth2", "token_url": "https://idp/token", "client_id": "stats", "client_secret": "env:HOOK_SECRET", "scopes": ["events"]}
+//	}
+//
+// Secrets are literal, or read once on load from env:NAME or file:path.
+// Everything is validated by Load so a bad entry fails at startup rather
+// than on the first event, and secrets never show up formatted or in
+// strings passed through Redact.
+package sinkauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ianschenck/envflag"
+)
+
+var (
+	authFile = envflag.String("SINK_AUTH_FILE", "", "json file of per sink credentials, see package sinkauth")
+)
+
+const redacted = "[redacted]"
+
+// Auth is one sink's credentials. A nil Auth authenticates with nothing.
+type Auth struct {
+	Type string `json:"type"` // apikey, basic, bearer, sasl or oauth2
+
+	// apikey and bearer
+	Header string `json:"header"`
+	Prefix string `json:"prefix"`
+	Key    string `json:"key"`
+
+	// basic and sasl
+	Mechanism string `json:"mechanism"`
+	User      string `json:"user"`
+	Password  string `json:"password"`
+
+	// oauth2 client credentials
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Set is every configured sink's Auth by name
+type Set map[string]*Auth
+
+// Get returns name's Auth, nil if it has none
+func (s Set) Get(name string) *Auth {
+	return s[name]
+}
+
+// Load reads and validates SINK_AUTH_FILE, an empty Set if unset
+func Load() (Set, error) {
+	set := Set{}
+	if *authFile == "" {
+		return set, nil
+	}
+	data, err := ioutil.ReadFile(*authFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %s", *authFile, err)
+	}
+	for name, a := range set {
+		if err := a.load(); err != nil {
+			return nil, fmt.Errorf("sink %s: %s", name, err)
+		}
+		register(a.Key, a.Password, a.ClientSecret)
+	}
+	return set, nil
+}
+
+func (a *Auth) load() error {
+	var err error
+	for _, s := range []*string{&a.Key, &a.Password, &a.ClientSecret} {
+		if *s, err = resolve(*s); err != nil {
+			return err
+		}
+	}
+	switch a.Type {
+	case "apikey", "bearer":
+		if a.Key == "" {
+			return errors.New("key missing")
+		}
+		if a.Header == "" {
+			a.Header = "Authorization"
+		}
+		if a.Type == "bearer" && a.Prefix == "" {
+			a.Prefix = "Bearer "
+		}
+	case "basic":
+		if a.User == "" {
+			return errors.New("user missing")
+		}
+	case "sasl":
+		switch a.Mechanism {
+		case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		default:
+			return fmt.Errorf("unsupported sasl mechanism %q", a.Mechanism)
+		}
+		if a.User == "" || a.Password == "" {
+			return errors.New("user and password needed")
+		}
+	case "oauth2":
+		u, err := url.Parse(a.TokenURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid token_url %q", a.TokenURL)
+		}
+		if a.ClientID == "" || a.ClientSecret == "" {
+			return errors.New("client_id and client_secret needed")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", a.Type)
+	}
+	return nil
+}
+
+// resolve reads env:NAME and file:path secrets
+func resolve(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "env:"):
+		name := strings.TrimPrefix(s, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(s, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return s, nil
+}
+
+// Apply authenticates req, fetching an oauth2 token if the cached one is
+// about to expire. sasl credentials don't apply to http.
+func (a *Auth) Apply(req *http.Request) error {
+	if a == nil {
+		return nil
+	}
+	switch a.Type {
+	case "apikey", "bearer":
+		req.Header.Set(a.Header, a.Prefix+a.Key)
+	case "basic":
+		req.SetBasicAuth(a.User, a.Password)
+	case "oauth2":
+		token, err := a.oauth2Token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "sasl":
+		return errors.New("sasl credentials can't authenticate http requests")
+	}
+	return nil
+}
+
+// Check verifies a can authenticate without sending anything to its
+// sink, by fetching a token for oauth2
+func (a *Auth) Check() error {
+	if a == nil || a.Type != "oauth2" {
+		return nil
+	}
+	_, err := a.oauth2Token()
+	return err
+}
+
+// SASL returns the mechanism and credentials of a sasl Auth
+func (a *Auth) SASL() (mechanism, user, password string, err error) {
+	if a == nil || a.Type != "sasl" {
+		return "", "", "", errors.New("no sasl credentials")
+	}
+	return a.Mechanism, a.User, a.Password, nil
+}
+
+func (a *Auth) oauth2Token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Add(time.Minute).Before(a.expires) {
+		return a.token, nil
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return "", errors.New(Redact(err.Error()))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token %s: %s", a.TokenURL, resp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("token %s: no access_token", a.TokenURL)
+	}
+	a.token = body.AccessToken
+	a.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	register(a.token)
+	return a.token, nil
+}
+
+// String describes a without its secrets, so logging an Auth is safe
+func (a *Auth) String() string {
+	if a == nil {
+		return "none"
+	}
+	switch a.Type {
+	case "apikey", "bearer":
+		return fmt.Sprintf("%s %s: %s%s", a.Type, a.Header, a.Prefix, redacted)
+	case "oauth2":
+		return fmt.Sprintf("oauth2 %s as %s", a.TokenURL, a.ClientID)
+	case "sasl":
+		return fmt.Sprintf("sasl %s as %s", a.Mechanism, a.User)
+	}
+	return fmt.Sprintf("%s as %s", a.Type, a.User)
+}
+
+// GoString keeps %#v from printing the fields
+func (a *Auth) GoString() string {
+	return a.String()
+}
+
+var secrets struct {
+	sync.RWMutex
+	values []string
+}
+
+func register(values ...string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range values {
+		if len(v) >= 4 { // shorter would redact half of every message
+			secrets.values = append(secrets.values, v)
+		}
+	}
+	// longest first, a secret holding another isn't left half shown
+	sort.SliceStable(secrets.values, func(i, j int) bool { return len(secrets.values[i]) > len(secrets.values[j]) })
+}
+
+// Redact replaces every loaded secret in s, for messages that may echo
+// requests back such as sink error responses
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, v := range secrets.values {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	return s
+}
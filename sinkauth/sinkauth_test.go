@@ -0,0 +1,210 @@
+package sinkauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// load has SINK_AUTH_FILE be json for the rest of the test, and loads it
+func load(t *testing.T, json string) (Set, error) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(path, []byte(json), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(f string) { *authFile = f }(*authFile)
+	*authFile = path
+	return Load()
+}
+
+func TestLoad(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("from-a-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SINKAUTH_TEST_KEY", "from-the-env")
+	set, err := load(t, `{
+		"search": {"type": "apikey", "key": "env:SINKAUTH_TEST_KEY"},
+		"api": {"type": "bearer", "key": "literal-key"},
+		"custom": {"type": "apikey", "header": "X-Api-Key", "key": "file:`+secret+`"},
+		"kafka": {"type": "sasl", "mechanism": "SCRAM-SHA-512", "user": "stats", "password": "file:`+secret+`"},
+		"basic": {"type": "basic", "user": "u", "password": "p"}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := set.Get("search"); a.Key != "from-the-env" || a.Header != "Authorization" || a.Prefix != "" {
+		t.Errorf("search: %s %q %q", a.Header, a.Prefix, a.Key)
+	}
+	if a := set.Get("api"); a.Header != "Authorization" || a.Prefix != "Bearer " {
+		t.Errorf("bearer defaults: %s %q", a.Header, a.Prefix)
+	}
+	if a := set.Get("custom"); a.Key != "from-a-file" || a.Header != "X-Api-Key" {
+		t.Errorf("custom: %s %q", a.Header, a.Key)
+	}
+	mechanism, user, password, err := set.Get("kafka").SASL()
+	if err != nil || mechanism != "SCRAM-SHA-512" || user != "stats" || password != "from-a-file" {
+		t.Errorf("sasl: %s %s %s %v", mechanism, user, password, err)
+	}
+	if _, _, _, err := set.Get("basic").SASL(); err == nil {
+		t.Error("basic credentials taken for sasl")
+	}
+	if set.Get("missing") != nil {
+		t.Error("a missing sink has credentials")
+	}
+	if msg := Redact("sent from-the-env and from-a-file"); strings.Contains(msg, "from-") {
+		t.Errorf("loaded secrets not redacted: %s", msg)
+	}
+
+	defer func(f string) { *authFile = f }(*authFile)
+	*authFile = ""
+	if set, err := Load(); err != nil || len(set) != 0 {
+		t.Errorf("unset: %v, %v", set, err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	os.Unsetenv("SINKAUTH_TEST_UNSET")
+	for _, c := range []struct {
+		json, err string
+	}{
+		{`{"s": {"type": "apikey"}}`, "sink s: key missing"},
+		{`{"s": {"type": "apikey", "key": "env:SINKAUTH_TEST_UNSET"}}`, "SINKAUTH_TEST_UNSET not set"},
+		{`{"s": {"type": "bearer", "key": "file:/nonexistent/secret"}}`, "no such file"},
+		{`{"s": {"type": "basic"}}`, "user missing"},
+		{`{"s": {"type": "sasl", "mechanism": "GSSAPI", "user": "u", "password": "p"}}`, "unsupported sasl mechanism"},
+		{`{"s": {"type": "sasl", "mechanism": "PLAIN", "user": "u"}}`, "user and password needed"},
+		{`{"s": {"type": "oauth2", "token_url": "/token", "client_id": "c", "client_secret": "s"}}`, "invalid token_url"},
+		{`{"s": {"type": "oauth2", "token_url": "https://idp/token", "client_id": "c"}}`, "client_id and client_secret needed"},
+		{`{"s": {"type": "kerberos"}}`, "unknown type"},
+		{`{"s": {"type": "basic", "user": "u"`, "auth.json"},
+	} {
+		if _, err := load(t, c.json); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: %v, want %q", c.json, err, c.err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	for _, c := range []struct {
+		auth         *Auth
+		header, want string
+	}{
+		{nil, "Authorization", ""},
+		{&Auth{Type: "apikey", Header: "X-Api-Key", Key: "k3y1"}, "X-Api-Key", "k3y1"},
+		{&Auth{Type: "apikey", Header: "Authorization", Prefix: "ApiKey ", Key: "k3y1"}, "Authorization", "ApiKey k3y1"},
+		{&Auth{Type: "bearer", Header: "Authorization", Prefix: "Bearer ", Key: "t0ken"}, "Authorization", "Bearer t0ken"},
+		{&Auth{Type: "basic", User: "u", Password: "p"}, "Authorization", "Basic dTpw"},
+	} {
+		req, _ := http.NewRequest("POST", "https://sink.example.com/", nil)
+		if err := c.auth.Apply(req); err != nil {
+			t.Errorf("%v: %s", c.auth, err)
+		}
+		if got := req.Header.Get(c.header); got != c.want {
+			t.Errorf("%v: %s %q, want %q", c.auth, c.header, got, c.want)
+		}
+	}
+	req, _ := http.NewRequest("POST", "https://sink.example.com/", nil)
+	if err := (&Auth{Type: "sasl", Mechanism: "PLAIN", User: "u", Password: "p"}).Apply(req); err == nil {
+		t.Error("sasl credentials applied to http")
+	}
+}
+
+func TestOAuth2(t *testing.T) {
+	var fetched int32
+	expiresIn := 3600
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// client credentials are form encoded in basic auth
+		id, secret, ok := r.BasicAuth()
+		secret, _ = url.QueryUnescape(secret)
+		if !ok || id != "stats" || secret != "client s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "events read" {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt32(&fetched, 1)
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": %d}`, n, expiresIn)
+	}))
+	defer srv.Close()
+
+	a := &Auth{Type: "oauth2", TokenURL: srv.URL, ClientID: "stats", ClientSecret: "client s3cret", Scopes: []string{"events", "read"}}
+	if err := a.Check(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "https://sink.example.com/", nil)
+		if err := a.Apply(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer token-1" {
+			t.Errorf("Authorization %q, want the cached token-1", got)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("token fetched %d times, want once", fetched)
+	}
+	if msg := Redact("echoed token-1"); strings.Contains(msg, "token-1") {
+		t.Errorf("the token isn't redacted: %s", msg)
+	}
+
+	// within a minute of expiring it's fetched again
+	expiresIn = 30
+	a.expires = a.expires.Add(-time.Hour)
+	req, _ := http.NewRequest("POST", "https://sink.example.com/", nil)
+	if err := a.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer token-2" {
+		t.Errorf("Authorization %q once expiring, want token-2", got)
+	}
+
+	wrong := &Auth{Type: "oauth2", TokenURL: srv.URL, ClientID: "stats", ClientSecret: "wrong"}
+	if err := wrong.Check(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("wrong secret: %v", err)
+	}
+}
+
+func TestNoSecretsShown(t *testing.T) {
+	for _, a := range []*Auth{
+		{Type: "apikey", Header: "Authorization", Prefix: "ApiKey ", Key: "k3y-secret"},
+		{Type: "basic", User: "u", Password: "pw-secret"},
+		{Type: "sasl", Mechanism: "PLAIN", User: "u", Password: "pw-secret"},
+		{Type: "oauth2", TokenURL: "https://idp/token", ClientID: "c", ClientSecret: "client-secret", token: "token-secret"},
+	} {
+		for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+			if s := fmt.Sprintf(format, a); strings.Contains(s, "secret") {
+				t.Errorf("%s shows a secret: %s", format, s)
+			}
+		}
+	}
+	if s := fmt.Sprint(Set{"s": {Type: "bearer", Header: "Authorization", Key: "k3y-secret"}}); strings.Contains(s, "secret") {
+		t.Errorf("a Set shows a secret: %s", s)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	register("abc", "redact-me", "redact-me-too-long")
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"nothing here", "nothing here"},
+		{"say redact-me twice: redact-me", "say [redacted] twice: [redacted]"},
+		// a secret holding another isn't half shown
+		{"key redact-me-too-long", "key [redacted]"},
+		{"abc is too short to redact", "abc is too short to redact"},
+	} {
+		if got := Redact(c.in); got != c.want {
+			t.Errorf("%q redacted %q, want %q", c.in, got, c.want)
+		}
+	}
+}
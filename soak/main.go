@@ -0,0 +1,328 @@
+// Package soak runs the pipeline under load for long and checks it keeps
+// up, the oplogctl soak command.
+package soak
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("soak", "run genload, stats and tail for long, checking summaries keep up and checkpoints never go back")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL      = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the cluster soaked")
+	duration      = flags.Duration("DURATION", 0, "stop after soaking this long, 0 to soak until interrupted")
+	checkEvery    = flags.Duration("CHECK_EVERY", 10*time.Second, "how often the invariants are checked")
+	grace         = flags.Duration("GRACE", 30*time.Second, "how far behind metrics.raw the summaries may be before it's a violation")
+	spawn         = flags.Bool("SPAWN", true, "run genload, stats and tail as children, false to check a pipeline run otherwise")
+	rate          = flags.Float64("RATE", 100, "inserts, updates and deletes per second genload writes")
+	metricKeys    = flags.Int("METRIC_KEYS", 10, "keys genload appends datapoints to")
+	metricRate    = flags.Float64("METRIC_RATE", 100, "datapoints per second genload appends")
+	prefix        = flags.String("KEY_PREFIX", "genload.", "prefix of the metrics.raw keys checked, genload's by default")
+	leaseNS       = flags.String("LEASE_NS", "metrics.leases", "db.collection of stats' lease, holding the checkpoint checked, empty to not check it")
+	checkpointDir = flags.String("CHECKPOINT_DIR", "", "tail's CHECKPOINT_DIR, checked, a temporary one when spawning and empty")
+)
+
+// observation is how many values a raw bucket had at a check
+type observation struct {
+	n  int
+	at time.Time
+}
+
+type bucketKey struct {
+	key string
+	at  int64
+}
+
+// checker holds what the invariants are checked against, from one check
+// to the next
+type checker struct {
+	sess        *mgo.Session
+	seen        map[bucketKey][]observation // within GRACE, and the newest before
+	checkpoints map[string]bson.MongoTimestamp
+	violations  int
+}
+
+func newChecker(sess *mgo.Session) *checker {
+	return &checker{sess: sess, seen: make(map[bucketKey][]observation), checkpoints: make(map[string]bson.MongoTimestamp)}
+}
+
+func (c *checker) violation(format string, args ...interface{}) {
+	c.violations++
+	fmt.Fprintf(os.Stderr, "soak: VIOLATION "+format+"\n", args...)
+}
+
+// summaries checks every raw bucket under KEY_PREFIX has a summary of at
+// least as many values as it had GRACE ago, returning how many buckets
+// were up to date and how many within GRACE
+func (c *checker) summaries(now time.Time) (current, behind int, err error) {
+	var raws []struct {
+		Key    string     `bson:"key"`
+		At     int64      `bson:"at"`
+		Values []bson.Raw `bson:"values"`
+	}
+	selector := bson.M{"key": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(*prefix)}}
+	metrics := c.sess.DB("metrics")
+	if err := metrics.C("raw").Find(selector).Select(bson.M{"key": 1, "at": 1, "values.at": 1}).All(&raws); err != nil {
+		return 0, 0, err
+	}
+	var sums []struct {
+		Key string `bson:"key"`
+		At  int64  `bson:"at"`
+		N   int    `bson:"n"`
+	}
+	if err := metrics.C("summary").Find(selector).Select(bson.M{"key": 1, "at": 1, "n": 1}).All(&sums); err != nil {
+		return 0, 0, err
+	}
+	summarized := make(map[bucketKey]int, len(sums))
+	for _, s := range sums {
+		summarized[bucketKey{s.Key, s.At}] = s.N
+	}
+	for _, r := range raws {
+		b := bucketKey{r.Key, r.At}
+		n, ok := summarized[b]
+		if cur, late := c.observe(b, len(r.Values), n, ok, now); cur {
+			current++
+		} else if late {
+			behind++
+		}
+	}
+	return current, behind, nil
+}
+
+// observe records raw bucket b holding values at now, its summary n of
+// them if summarized, reporting whether the summary is current or else
+// within GRACE of it, a violation if neither
+func (c *checker) observe(b bucketKey, values, n int, summarized bool, now time.Time) (current, behind bool) {
+	// the observations within GRACE, and the newest before, the one the
+	// summary has to have caught up with
+	seen := append(c.seen[b], observation{values, now})
+	for len(seen) > 1 && now.Sub(seen[1].at) >= *grace {
+		seen = seen[1:]
+	}
+	c.seen[b] = seen
+	at := time.Unix(0, b.at*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+	switch {
+	case summarized && n >= values:
+		return true, false
+	case now.Sub(seen[0].at) < *grace || (summarized && n >= seen[0].n):
+		return false, true
+	case !summarized:
+		c.violation("%s at %s: %d values unsummarized for over %s", b.key, at, seen[0].n, *grace)
+	default:
+		c.violation("%s at %s: summary of %d values, %d were there %s ago", b.key, at, n, seen[0].n, now.Sub(seen[0].at).Round(time.Second))
+	}
+	return false, false
+}
+
+// checkpoint checks the checkpoint of name didn't go back from the last
+// check
+func (c *checker) checkpoint(name string, ts bson.MongoTimestamp) {
+	if last, ok := c.checkpoints[name]; ok && ts < last {
+		c.violation("%s checkpoint went back from %s to %s", name, optime.Format(last), optime.Format(ts))
+	}
+	c.checkpoints[name] = ts
+}
+
+// leaseCheckpoint checks stats' checkpoint, kept on its lease
+func (c *checker) leaseCheckpoint() error {
+	if *leaseNS == "" {
+		return nil
+	}
+	parts := strings.SplitN(*leaseNS, ".", 2)
+	var doc struct {
+		Checkpoint bson.MongoTimestamp `bson:"ts"`
+	}
+	err := c.sess.DB(parts[0]).C(parts[1]).FindId("stats").One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil // not acquired yet
+	}
+	if err != nil {
+		return err
+	}
+	c.checkpoint("stats", doc.Checkpoint)
+	return nil
+}
+
+// tailCheckpoints checks the checkpoints of each stream in dir
+func (c *checker) tailCheckpoints(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		ts, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			continue // not a checkpoint, the namespace a stream watches
+		}
+		c.checkpoint("tail "+f.Name(), bson.MongoTimestamp(ts))
+	}
+	return nil
+}
+
+// check checks every invariant, printing how the pipeline keeps up
+func (c *checker) check(dir string) {
+	c.sess.Refresh()
+	current, behind, err := c.summaries(time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "soak: reading summaries: %s\n", err)
+	}
+	if err := c.leaseCheckpoint(); err != nil {
+		fmt.Fprintf(os.Stderr, "soak: reading stats' checkpoint: %s\n", err)
+	}
+	if err := c.tailCheckpoints(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "soak: reading tail's checkpoints: %s\n", err)
+	}
+	fmt.Fprintf(os.Stderr, "soak: %d buckets summarized, %d catching up, %d checkpoints, %d violations\n", current, behind, len(c.checkpoints), c.violations)
+}
+
+// child is a command of this oplogctl run alongside
+type child struct {
+	name string
+	cmd  *exec.Cmd
+}
+
+// start runs the oplogctl command name with args, its exit sent on exited
+func start(name string, args []string, exited chan<- error) (*child, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(self, append([]string{name}, args...)...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		err := cmd.Wait()
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		exited <- fmt.Errorf("%s: %s", name, err)
+	}()
+	return &child{name, cmd}, nil
+}
+
+// Main runs oplogctl soak, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *checkEvery <= 0 || *grace <= 0 {
+		panic(cli.Invalidf("CHECK_EVERY and GRACE must be positive"))
+	}
+	if parts := strings.SplitN(*leaseNS, ".", 2); *leaseNS != "" && (len(parts) != 2 || parts[0] == "" || parts[1] == "") {
+		panic(cli.Invalidf("LEASE_NS %q must be db.collection", *leaseNS))
+	}
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	if err := dial.CheckPrivileges(sess, privileges()...); err != nil {
+		panic(err)
+	}
+
+	dir := *checkpointDir
+	exited := make(chan error, 3)
+	var children []*child
+	if *spawn {
+		if dir == "" {
+			if dir, err = ioutil.TempDir("", "soak"); err != nil {
+				panic(err)
+			}
+			defer os.RemoveAll(dir)
+		}
+		// DURATION is given, soak's in the environment would apply to
+		// them otherwise
+		common := []string{"-MONGO_URL=" + *mongoURL}
+		commands := []struct {
+			name string
+			args []string
+		}{
+			{"genload", []string{
+				"-DURATION=0",
+				"-RATE=" + strconv.FormatFloat(*rate, 'g', -1, 64),
+				"-METRIC_KEYS=" + strconv.Itoa(*metricKeys),
+				"-METRIC_RATE=" + strconv.FormatFloat(*metricRate, 'g', -1, 64),
+			}},
+			{"stats", []string{"-LEASE_NS=" + *leaseNS}},
+			{"tail", []string{"-CHECKPOINT_DIR=" + dir, "-DURATION=0"}},
+		}
+		for _, c := range commands {
+			ch, err := start(c.name, append(common, c.args...), exited)
+			if err != nil {
+				panic(err)
+			}
+			children = append(children, ch)
+		}
+		defer func() {
+			for _, ch := range children {
+				ch.cmd.Process.Signal(syscall.SIGTERM)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	var ended <-chan time.Time
+	if *duration > 0 {
+		ended = time.After(*duration)
+	}
+	c := newChecker(sess)
+	ticker := time.NewTicker(*checkEvery)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			c.check(dir)
+		case err := <-exited:
+			c.violation("%s", err)
+			running = false
+		case <-stop:
+			running = false
+		case <-ended:
+			c.check(dir)
+			running = false
+		}
+	}
+	if c.violations > 0 {
+		panic(fmt.Errorf("%d violations", c.violations))
+	}
+}
+
+// privileges are what soak checks with
+func privileges() []dial.Privilege {
+	needed := []dial.Privilege{
+		{DB: "metrics", Collection: "raw", Actions: []string{"find"}},
+		{DB: "metrics", Collection: "summary", Actions: []string{"find"}},
+	}
+	if parts := strings.SplitN(*leaseNS, ".", 2); len(parts) == 2 {
+		needed = append(needed, dial.Privilege{DB: parts[0], Collection: parts[1], Actions: []string{"find"}})
+	}
+	return needed
+}
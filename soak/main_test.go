@@ -0,0 +1,107 @@
+package soak
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	defer func(g time.Duration) { *grace = g }(*grace)
+	*grace = 30 * time.Second
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	c := newChecker(nil)
+	b := bucketKey{"genload.metric0", start.UnixNano() / int64(time.Millisecond)}
+	for _, s := range []struct {
+		at         time.Duration
+		values, n  int
+		summarized bool
+		state      string
+		violations int
+	}{
+		{0, 10, 0, false, "behind", 0},                // not summarized yet, within GRACE
+		{10 * time.Second, 20, 10, true, "behind", 0}, // caught up with 10 of 20
+		{20 * time.Second, 30, 30, true, "current", 0},
+		{40 * time.Second, 40, 20, true, "behind", 0}, // has the 20 of 30s ago
+		{60 * time.Second, 50, 20, true, "", 1},       // not the 30 of 40s ago
+		{70 * time.Second, 50, 50, true, "current", 1},
+	} {
+		cur, late := c.observe(b, s.values, s.n, s.summarized, start.Add(s.at))
+		state := ""
+		if cur {
+			state = "current"
+		} else if late {
+			state = "behind"
+		}
+		if state != s.state || c.violations != s.violations {
+			t.Errorf("at %s: %q, %d violations, want %q, %d", s.at, state, c.violations, s.state, s.violations)
+		}
+	}
+	// only the observations within GRACE are kept, and the newest before
+	if seen := c.seen[b]; len(seen) != 3 || seen[0].n != 40 {
+		t.Errorf("kept %v", seen)
+	}
+
+	never := bucketKey{"genload.metric1", b.at}
+	c.observe(never, 5, 0, false, start)
+	if c.observe(never, 5, 0, false, start.Add(time.Minute)); c.violations != 2 {
+		t.Errorf("unsummarized past GRACE: %d violations", c.violations)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	c := newChecker(nil)
+	c.checkpoint("stats", 5<<32)
+	c.checkpoint("stats", 5<<32)
+	c.checkpoint("stats", 6<<32)
+	c.checkpoint("tail a", 1<<32) // another's
+	if c.violations != 0 {
+		t.Fatalf("%d violations going forward", c.violations)
+	}
+	c.checkpoint("stats", 5<<32|9)
+	if c.violations != 1 || c.checkpoints["stats"] != 5<<32|9 {
+		t.Errorf("going back: %d violations, at %d", c.violations, c.checkpoints["stats"])
+	}
+}
+
+func TestTailCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("users", "429496729600\n")
+	write("users.ns", "app.users") // what the stream watches
+	c := newChecker(nil)
+	if err := c.tailCheckpoints(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.checkpoints) != 1 || c.checkpoints["tail users"] != 100<<32 {
+		t.Errorf("checkpoints %v", c.checkpoints)
+	}
+	write("users", "429496729599")
+	c.tailCheckpoints(dir)
+	if c.violations != 1 {
+		t.Errorf("%d violations, a checkpoint went back", c.violations)
+	}
+	if err := c.tailCheckpoints(""); err != nil {
+		t.Error(err)
+	}
+	if err := c.tailCheckpoints(filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing CHECKPOINT_DIR read")
+	}
+}
+
+func TestPrivileges(t *testing.T) {
+	defer func(ns string) { *leaseNS = ns }(*leaseNS)
+	*leaseNS = "metrics.leases"
+	if p := privileges(); len(p) != 3 || p[2].Collection != "leases" {
+		t.Errorf("%+v", p)
+	}
+	*leaseNS = ""
+	if p := privileges(); len(p) != 2 {
+		t.Errorf("without LEASE_NS: %+v", p)
+	}
+}
@@ -0,0 +1,357 @@
+package stats
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	apiAddr  = flags.String("API_ADDR", "", "address to serve the summaries query api on, e.g. \":8081\", empty for none")
+	apiLimit = flags.Int("API_LIMIT", 1000, "most summaries a query returns at once, the rest paged through with next")
+)
+
+// api serves the summaries over http, a copy of sess per request
+type api struct {
+	sess *mgo.Session
+}
+
+// serveAPI serves the query api in the background if API_ADDR is set, to
+// the tenants of API_TOKENS if that is
+func serveAPI(sess *mgo.Session) error {
+	if *apiAddr == "" {
+		return nil
+	}
+	t, err := parseTokens(*apiTokens)
+	if err != nil {
+		return err
+	}
+	mux := apiMux(sess, t)
+	go func() {
+		defer cli.Recover()
+		if err := http.ListenAndServe(*apiAddr, mux); err != nil {
+			panic(err)
+		}
+	}()
+	return nil
+}
+
+// apiMux routes the api's requests, authorized by t
+func apiMux(sess *mgo.Session, t tokens) *http.ServeMux {
+	a := &api{sess: sess}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/summaries", t.authorize(a.summaries))
+	mux.HandleFunc("/summaries/export", t.authorize(a.export))
+	mux.HandleFunc("/keys", t.authorize(a.keys))
+	mux.HandleFunc("/fields", t.authorize(a.fields))
+	mux.HandleFunc("/eval", t.authorize(a.eval))
+	mux.HandleFunc("/feed", t.authorize(a.feed))
+	mux.HandleFunc("/ingest", t.authorize(a.ingest))
+	mux.HandleFunc("/webhooks", t.authorize(a.webhooks))
+	mux.Handle("/ui/", ui()) // asking for a token itself
+	// grafana's json datasource
+	mux.HandleFunc("/", t.authorize(a.grafanaRoot))
+	mux.HandleFunc("/search", t.authorize(a.grafanaSearch))
+	mux.HandleFunc("/query", t.authorize(a.grafanaQuery))
+	mux.HandleFunc("/annotations", t.authorize(a.grafanaAnnotations))
+	return mux
+}
+
+// apiError is a response with status code
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// reply writes v as json, or err with its status
+func reply(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		code := http.StatusInternalServerError
+		if e, ok := err.(*apiError); ok {
+			code = e.code
+		} else {
+			fmt.Fprintf(os.Stderr, "api: %s\n", err)
+		}
+		w.WriteHeader(code)
+		v = map[string]string{"error": err.Error()}
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// parseAt reads a bucket time as at holds it, unix milliseconds, or RFC 3339
+func parseAt(s string) (int64, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return unixMillis(t), nil
+	}
+	at, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, badRequest("time %q must be unix milliseconds or RFC 3339", s)
+	}
+	return at, nil
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// parsePositive reads the number given as parameter name
+func parsePositive(name, s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, badRequest("%s must be a positive number", name)
+	}
+	return n, nil
+}
+
+// summaryQuery is what a request for summaries selects: keys, each key
+// given on its own or comma separated, buckets from up to but not
+// including to, either left out being unbounded
+type summaryQuery struct {
+	keys     []string
+	from, to int64
+	hasFrom  bool
+	hasTo    bool
+}
+
+func parseSummaryQuery(r *http.Request) (summaryQuery, error) {
+	q, err := parseRange(r)
+	if err != nil {
+		return q, err
+	}
+	t := tenantOf(r)
+	for _, k := range r.URL.Query()["key"] {
+		for _, key := range strings.Split(k, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				q.keys = append(q.keys, t.key(key))
+			}
+		}
+	}
+	if len(q.keys) == 0 {
+		return q, badRequest("key is needed")
+	}
+	return q, nil
+}
+
+// parseRange reads from and to, leaving the keys to the caller
+func parseRange(r *http.Request) (summaryQuery, error) {
+	var q summaryQuery
+	params := r.URL.Query()
+	var err error
+	if s := params.Get("from"); s != "" {
+		if q.from, err = parseAt(s); err != nil {
+			return q, err
+		}
+		q.hasFrom = true
+	}
+	if s := params.Get("to"); s != "" {
+		if q.to, err = parseAt(s); err != nil {
+			return q, err
+		}
+		q.hasTo = true
+	}
+	return q, nil
+}
+
+// selector matches the summaries of q
+func (q summaryQuery) selector() bson.M {
+	sel := bson.M{"key": bson.M{"$in": q.keys}}
+	at := bson.M{}
+	if q.hasFrom {
+		at["$gte"] = q.from
+	}
+	if q.hasTo {
+		at["$lt"] = q.to
+	}
+	if len(at) > 0 {
+		sel["at"] = at
+	}
+	return sel
+}
+
+// resolutionCollection returns the collection of a resolution, raw or
+// one of ROLLUPS
+func resolutionCollection(name string) (string, error) {
+	if name == "raw" {
+		return "summary", nil
+	}
+	for _, r := range rollups {
+		if r.name == name {
+			return r.collection(), nil
+		}
+	}
+	names := []string{"raw"}
+	for _, r := range rollups {
+		names = append(names, r.name)
+	}
+	return "", badRequest("resolution %q: one of auto, %s", name, strings.Join(names, ", "))
+}
+
+// autoResolution picks the finest resolution with at most points summaries
+// of each key over the range of q, raw when there are few enough of those
+// already. Open ranges run from the first raw summary and up to now.
+func autoResolution(raw *mgo.Collection, q summaryQuery, points int) (string, error) {
+	if len(rollups) == 0 {
+		return "raw", nil
+	}
+	most := points * len(q.keys)
+	n, err := raw.Find(q.selector()).Limit(most + 1).Count()
+	if err != nil {
+		return "", err
+	}
+	if n <= most {
+		return "raw", nil
+	}
+	from, to := q.from, q.to
+	if !q.hasTo {
+		to = unixMillis(sysClock.Now())
+	}
+	if !q.hasFrom {
+		var first Summary
+		if err := raw.Find(q.selector()).Sort("at").One(&first); err != nil {
+			return "", err
+		}
+		from = first.At
+	}
+	for _, r := range rollups {
+		if (to-from)/r.width <= int64(points) {
+			return r.name, nil
+		}
+	}
+	return rollups[len(rollups)-1].name, nil
+}
+
+// cursor is where a page ended, the next one starting after it at the
+// same resolution
+type cursor struct {
+	Key        string `json:"k"`
+	At         int64  `json:"a"`
+	Resolution string `json:"r,omitempty"`
+}
+
+func (c cursor) token() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseCursor(token string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, badRequest("invalid after %q", token)
+	}
+	return c, nil
+}
+
+// summaryPage is a page of summaries in key then at order, Next set to
+// pass as after for the next one while there are more
+type summaryPage struct {
+	Resolution string    `json:"resolution"`
+	Summaries  []Summary `json:"summaries"`
+	Next       string    `json:"next,omitempty"`
+}
+
+// summaries serves GET /summaries?key=...&from=...&to=...&limit=...&after=...
+// at a resolution, raw, one of ROLLUPS, or auto picking the finest with at
+// most points summaries of a key, API_LIMIT unless given
+func (a *api) summaries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		reply(w, nil, &apiError{http.StatusMethodNotAllowed, "GET only"})
+		return
+	}
+	q, err := parseSummaryQuery(r)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	limit := *apiLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := parsePositive("limit", s)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	points := *apiLimit
+	if s := r.URL.Query().Get("points"); s != "" {
+		if points, err = parsePositive("points", s); err != nil {
+			reply(w, nil, err)
+			return
+		}
+	}
+	res := r.URL.Query().Get("resolution")
+	if res == "" {
+		res = "auto"
+	}
+
+	sess := a.sess.Copy()
+	defer sess.Close()
+	sel := q.selector()
+	if token := r.URL.Query().Get("after"); token != "" {
+		c, err := parseCursor(token)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		if c.Resolution != "" {
+			res = c.Resolution // the page before picked it
+		}
+		sel = bson.M{"$and": []bson.M{sel, {"$or": []bson.M{
+			{"key": bson.M{"$gt": c.Key}},
+			{"key": c.Key, "at": bson.M{"$gt": c.At}},
+		}}}}
+	}
+
+	if res == "auto" {
+		if res, err = autoResolution(sess.DB("metrics").C("summary"), q, points); err != nil {
+			reply(w, nil, err)
+			return
+		}
+	}
+	coll, err := resolutionCollection(res)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	page := summaryPage{Resolution: res, Summaries: []Summary{}}
+	// one more than the limit tells whether there's a next page
+	err = sess.DB("metrics").C(coll).Find(sel).Sort("key", "at").Limit(limit + 1).All(&page.Summaries)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	if len(page.Summaries) > limit {
+		page.Summaries = page.Summaries[:limit]
+		last := page.Summaries[limit-1]
+		page.Next = cursor{last.Key, last.At, res}.token()
+	}
+	t := tenantOf(r)
+	for i := range page.Summaries {
+		page.Summaries[i].Key = t.strip(page.Summaries[i].Key)
+	}
+	reply(w, page, nil)
+}
@@ -0,0 +1,99 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	auditFile       = flags.String("AUDIT_FILE", "", "file every write is appended to as a JSON line")
+	auditCollection = flags.String("AUDIT_COLLECTION", "", "db.collection every write is recorded in")
+)
+
+// auditEntry records one write and the oplog entry that caused it
+type auditEntry struct {
+	At       time.Time           `bson:"at" json:"at"`
+	Op       string              `bson:"op" json:"op"`
+	NS       string              `bson:"ns" json:"ns"`
+	Selector bson.M              `bson:"selector" json:"selector"`
+	Source   string              `bson:"source" json:"source"` // _id of the raw document
+	Trigger  bson.MongoTimestamp `bson:"ts" json:"ts"`
+}
+
+// auditLog appends entries to AUDIT_FILE and AUDIT_COLLECTION. A nil
+// auditLog records nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	coll *mgo.Collection
+}
+
+// audit is set up by main, nil when auditing is off
+var audit *auditLog
+
+func newAuditLog(sess *mgo.Session) (*auditLog, error) {
+	if *auditFile == "" && *auditCollection == "" {
+		return nil, nil
+	}
+	a := &auditLog{}
+	if *auditFile != "" {
+		f, err := os.OpenFile(*auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	if *auditCollection != "" {
+		parts := strings.SplitN(*auditCollection, ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("AUDIT_COLLECTION %q must be db.collection", *auditCollection)
+		}
+		a.coll = sess.DB(parts[0]).C(parts[1])
+	}
+	return a, nil
+}
+
+// record writes entries out, the file is synced so entries survive a crash
+// right after the writes they describe
+func (a *auditLog) record(entries []auditEntry) error {
+	if a == nil || len(entries) == 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		buf := bufPool.Get().(*bytes.Buffer)
+		defer bufPool.Put(buf)
+		buf.Reset()
+		enc := json.NewEncoder(buf)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		if _, err := a.file.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if a.coll != nil {
+		docs := make([]interface{}, len(entries))
+		for i, e := range entries {
+			docs[i] = e
+		}
+		if err := a.coll.Insert(docs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
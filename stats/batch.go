@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	batchMax  = flags.Int("BATCH_MAX", 1000, "most raw documents summarized in one batch")
+	flushMax  = flags.Duration("FLUSH_MAX", time.Second, "longest a change waits before its batch is flushed")
+	lagTarget = flags.Duration("LAG_TARGET", 2*time.Second, "oplog lag above which batches grow, below half of which they shrink")
+)
+
+// flushMin is how long a lone change waits for company when caught up
+const flushMin = 10 * time.Millisecond
+
+// lagMeter tracks how far behind the oplog head the consumer is
+type lagMeter struct {
+	head int64 // bson.MongoTimestamp of the newest oplog entry
+	last int64 // bson.MongoTimestamp of the newest entry consumed
+}
+
+// poll refreshes the oplog head every interval, forever
+func (l *lagMeter) poll(sess *mgo.Session, interval time.Duration) {
+	defer cli.Recover()
+	defer sess.Close()
+	for range time.Tick(interval) {
+		lo, err := latestOplog(sess)
+		if err != nil {
+			sess.Refresh()
+			continue
+		}
+		atomic.StoreInt64(&l.head, int64(lo.Timestamp))
+	}
+}
+
+func (l *lagMeter) consumed(ts bson.MongoTimestamp) {
+	atomic.StoreInt64(&l.last, int64(ts))
+}
+
+// lag returns the seconds between the head and the last consumed entry.
+// Timestamps only have second resolution, so anything under a second is 0.
+func (l *lagMeter) lag() time.Duration {
+	head := atomic.LoadInt64(&l.head) >> 32
+	last := atomic.LoadInt64(&l.last) >> 32
+	if last == 0 || head <= last {
+		return 0
+	}
+	return time.Duration(head-last) * time.Second
+}
+
+// adapt doubles batch size and flush interval while lagging behind, and
+// halves them once caught up, within [1, BATCH_MAX] and [flushMin, FLUSH_MAX].
+func adapt(size int, interval, lag time.Duration) (int, time.Duration) {
+	switch {
+	case lag > *lagTarget:
+		size, interval = size*2, interval*2
+	case lag < *lagTarget/2:
+		size, interval = size/2, interval/2
+	}
+	if size > *batchMax {
+		size = *batchMax
+	}
+	if size < 1 {
+		size = 1
+	}
+	if interval > *flushMax {
+		interval = *flushMax
+	}
+	if interval < flushMin {
+		interval = flushMin
+	}
+	return size, interval
+}
+
+// batchCh groups changes into batches, flushing when the batch is full or
+// the flush interval elapses. Both are adapted to the lag after every flush.
+func batchCh(in <-chan change, meter *lagMeter) <-chan []change {
+	out := make(chan []change)
+	go func() {
+		defer cli.Recover()
+		defer close(out)
+		size, interval := 1, flushMin
+		timer := sysClock.NewTimer(interval)
+		var batch []change
+		flush := func() {
+			if len(batch) > 0 {
+				out <- batch
+				batch = nil
+			}
+			size, interval = adapt(size, interval, meter.lag())
+			if !timer.Stop() {
+				select {
+				case <-timer.C():
+				default:
+				}
+			}
+			timer.Reset(interval)
+		}
+		for {
+			select {
+			case c, ok := <-in:
+				if !ok {
+					if len(batch) > 0 {
+						out <- batch
+					}
+					return
+				}
+				meter.consumed(c.Timestamp)
+				batch = append(batch, c)
+				if len(batch) >= size {
+					flush()
+				}
+			case <-timer.C():
+				flush()
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,95 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/clock"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// useSim has sysClock be a clock.Sim for the rest of the test
+func useSim(t *testing.T) *clock.Sim {
+	sim := clock.NewSim(time.Unix(1792000000, 0))
+	sysClock = sim
+	t.Cleanup(func() { sysClock = clock.Real })
+	return sim
+}
+
+func receive(t *testing.T, out <-chan []change) []change {
+	t.Helper()
+	select {
+	case batch := <-out:
+		return batch
+	case <-time.After(time.Second):
+		t.Fatal("no batch flushed")
+		return nil
+	}
+}
+
+func noBatch(t *testing.T, out <-chan []change) {
+	t.Helper()
+	select {
+	case batch := <-out:
+		t.Fatalf("flushed %v early", batch)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestBatchFlushOnTimeout(t *testing.T) {
+	sim := useSim(t)
+	in := make(chan change)
+	// far behind the head, batches double after every flush
+	meter := &lagMeter{head: int64(100 << 32)}
+	out := batchCh(in, meter)
+
+	in <- change{ID: "a", Timestamp: 1 << 32}
+	if batch := receive(t, out); len(batch) != 1 {
+		t.Fatalf("first batch %v, want the one change", batch)
+	}
+	// the send only goes through once the timer's reset to flushMin*2
+	in <- change{ID: "b", Timestamp: 2 << 32}
+	sim.Advance(2*flushMin - time.Millisecond)
+	noBatch(t, out)
+	sim.Advance(time.Millisecond)
+	if batch := receive(t, out); len(batch) != 1 || batch[0].ID != "b" {
+		t.Fatalf("timed out batch %v, want b alone", batch)
+	}
+
+	in <- change{ID: "c", Timestamp: 3 << 32}
+	in <- change{ID: "d", Timestamp: 4 << 32}
+	in <- change{ID: "e", Timestamp: 5 << 32}
+	sim.Advance(4*flushMin - time.Millisecond)
+	noBatch(t, out)
+	sim.Advance(time.Millisecond)
+	if batch := receive(t, out); len(batch) != 3 {
+		t.Fatalf("timed out batch %v, want c, d and e", batch)
+	}
+
+	in <- change{ID: "f", Timestamp: 6 << 32}
+	close(in)
+	if batch := receive(t, out); len(batch) != 1 || batch[0].ID != "f" {
+		t.Fatalf("batch left on close %v, want f", batch)
+	}
+	if _, ok := <-out; ok {
+		t.Fatal("out not closed after in")
+	}
+}
+
+func TestBatchCaughtUp(t *testing.T) {
+	sim := useSim(t)
+	in := make(chan change)
+	meter := &lagMeter{}
+	out := batchCh(in, meter)
+	for i := bson.MongoTimestamp(1); i <= 3; i++ {
+		in <- change{ID: "a", Timestamp: i << 32}
+		// caught up, every change is flushed as it comes
+		if batch := receive(t, out); len(batch) != 1 {
+			t.Fatalf("batch %v, want the one change", batch)
+		}
+	}
+	sim.Advance(time.Hour)
+	noBatch(t, out)
+	close(in)
+}
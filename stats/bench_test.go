@@ -0,0 +1,201 @@
+package stats
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// benchKey is the key of every raw document written by the throughput benchmark
+// so they can be told apart from (and cleaned up without touching) real data.
+const benchKey = "bench.throughput"
+
+// sampleRaw builds a full hour bucket with one datapoint per second
+func sampleRaw() Raw {
+	start := time.Date(2015, 4, 13, 15, 0, 0, 0, time.UTC)
+	raw := Raw{
+		Key:    "some.metric.name",
+		At:     start.UnixNano() / int64(time.Millisecond),
+		Values: make([]Datapoint, 3600),
+	}
+	for i := range raw.Values {
+		raw.Values[i] = Datapoint{
+			At:    start.Add(time.Duration(i) * time.Second),
+			Value: float64(i%97) + 0.5,
+		}
+	}
+	return raw
+}
+
+// sampleOplog is an update to a raw bucket as mongod would write it
+func sampleOplog() Oplog {
+	return Oplog{
+		Timestamp:    bson.MongoTimestamp(time.Now().Unix() << 32),
+		HistoryID:    -4768495924470325753,
+		MongoVersion: 2,
+		Operation:    "u",
+		Namespace:    "metrics.raw",
+		Object: bson.M{"$set": bson.M{"values.42": bson.M{
+			"at":    time.Now(),
+			"value": 42.0,
+		}}},
+		QueryObject: bson.M{"_id": bson.NewObjectId()},
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data, err := bson.Marshal(sampleOplog())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		oplog := getOplog()
+		if err := bson.Unmarshal(data, oplog); err != nil {
+			b.Fatal(err)
+		}
+		putOplog(oplog)
+	}
+}
+
+func BenchmarkExtract(b *testing.B) {
+	oplog := sampleOplog()
+	in := make(chan *Oplog)
+	out := oidCh(in)
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		defer close(in)
+		for i := 0; i < b.N; i++ {
+			o := getOplog()
+			*o = oplog
+			in <- o
+		}
+	}()
+	for range out {
+	}
+}
+
+func BenchmarkSummarize(b *testing.B) {
+	raw := sampleRaw()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rawToSummary(raw)
+	}
+}
+
+func BenchmarkFields(b *testing.B) {
+	data, err := bson.Marshal(sampleRaw())
+	if err != nil {
+		b.Fatal(err)
+	}
+	e, err := compileExtractor("key", "at", "auto", "values.value", "numbers")
+	if err != nil {
+		b.Fatal(err)
+	}
+	values := make([]float64, 0, 3600)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, values, err = e.extract(data, values[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkThroughput measures the whole pipeline: inserts into metrics.raw
+// are picked up from the oplog, summarized and upserted into metrics.summary.
+// It needs a replica set at MONGO_URL, and is skipped without one. It fails
+// below THROUGHPUT_TARGET events/s when that's set.
+func BenchmarkThroughput(b *testing.B) {
+	flags.Parse(nil)
+	var target float64
+	if env := os.Getenv("THROUGHPUT_TARGET"); env != "" {
+		var err error
+		if target, err = strconv.ParseFloat(env, 64); err != nil {
+			b.Fatalf("THROUGHPUT_TARGET: %s", err)
+		}
+	}
+	if err := compileFields(); err != nil {
+		b.Fatal(err)
+	}
+	sess, err := dial.DialWithTimeout(*mongoURL, 2*time.Second)
+	if err != nil {
+		b.Skipf("no mongodb at MONGO_URL: %s", err)
+	}
+	defer sess.Close()
+	defer func() {
+		selector := bson.M{"key": benchKey}
+		if _, err := sess.DB("metrics").C("raw").RemoveAll(selector); err != nil {
+			b.Error(err)
+		}
+		if _, err := sess.DB("metrics").C("summary").RemoveAll(selector); err != nil {
+			b.Error(err)
+		}
+	}()
+	lo, err := latestOplog(sess)
+	if err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	rs := sess.Copy()
+	och, errCh := oplogCh(rs, rawQuery, lo.Timestamp, done)
+	oidch := oidCh(och)
+	defer func() {
+		close(done)
+		for range oidch {
+		}
+		if err := <-errCh; err != nil {
+			b.Error(err)
+		}
+		rs.Close()
+	}()
+
+	raw := sampleRaw()
+	raw.Key = benchKey
+	raw.Values = raw.Values[:60]
+	failed := make(chan struct{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		ws := sess.Copy()
+		defer ws.Close()
+		for i := 0; i < b.N; i++ {
+			raw.At = int64(i)
+			if err := ws.DB("metrics").C("raw").Insert(raw); err != nil {
+				b.Error(err)
+				close(failed)
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		select {
+		case c, ok := <-oidch:
+			if !ok {
+				return
+			}
+			if err := stats(sess, c); err != nil {
+				b.Fatal(err)
+			}
+		case <-failed:
+			return
+		}
+	}
+	rate := float64(b.N) / b.Elapsed().Seconds()
+	b.ReportMetric(rate, "events/s")
+	// the short runs b.N is sized by are mostly round trips, not throughput
+	if target > 0 && b.Elapsed() >= time.Second && rate < target {
+		b.Errorf("%.0f events/s, below the target of %.0f", rate, target)
+	}
+}
@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	memoryBudget = flags.Int64("MEMORY_BUDGET", 64<<20, "bytes of oplog entries allowed in flight, 0 for no limit")
+	shedPolicy   = flags.String("SHED_POLICY", "pause", "what to do over budget: \"pause\" the cursor, or \"shed\" the entry, leaving its bucket's summary stale until the bucket changes again")
+)
+
+// budget limits the bytes of oplog entries between the cursor and the end
+// of extraction.
+type budget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	used  int64
+	limit int64
+	shed  bool
+}
+
+func newBudget(limit int64, policy string) (*budget, error) {
+	b := &budget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	switch policy {
+	case "pause":
+	case "shed":
+		b.shed = true
+	default:
+		return nil, fmt.Errorf("unknown SHED_POLICY %q", policy)
+	}
+	return b, nil
+}
+
+// acquire reserves n bytes. Over budget it blocks until enough is released,
+// which stops reading the cursor, or with the shed policy returns false. A
+// single entry larger than the whole budget is let through once nothing
+// else is in flight.
+func (b *budget) acquire(n int64) bool {
+	if b == nil || b.limit <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used > 0 && b.used+n > b.limit {
+		if b.shed {
+			shedEvents.Add(1)
+			return false
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+	inflightBytes.Set(b.used)
+	return true
+}
+
+func (b *budget) release(n int64) {
+	if b == nil || b.limit <= 0 || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	inflightBytes.Set(b.used)
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// staleBuckets are the raw buckets entries were shed for, their summaries
+// behind until a later change has them summarized again
+var staleBuckets = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// shed counts the bucket the oplog entry doc inserts or updates as stale.
+// A transaction's buckets aren't looked for, it's counted as unknown.
+func shed(doc []byte) {
+	path := []string{"o", "_id"}
+	if kind, op, err := lookup(doc, []string{"op"}); err == nil && kind == bsonString && len(op) >= 5 && string(op[4:len(op)-1]) == "u" {
+		path = []string{"o2", "_id"}
+	}
+	kind, id, err := lookup(doc, path)
+	if err != nil || kind != bsonObjectID {
+		shedUnknown.Add(1)
+		return
+	}
+	staleBuckets.Lock()
+	staleBuckets.ids[bson.ObjectId(id).Hex()] = true
+	staleBucketCount.Set(int64(len(staleBuckets.ids)))
+	staleBuckets.Unlock()
+}
+
+// freshen has the buckets of changes, summarized, no longer stale
+func freshen(changes []change) {
+	staleBuckets.Lock()
+	defer staleBuckets.Unlock()
+	if len(staleBuckets.ids) == 0 {
+		return
+	}
+	for _, c := range changes {
+		delete(staleBuckets.ids, c.ID)
+	}
+	staleBucketCount.Set(int64(len(staleBuckets.ids)))
+}
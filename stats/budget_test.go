@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBudgetShed(t *testing.T) {
+	b, err := newBudget(100, "shed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.acquire(60) || !b.acquire(40) {
+		t.Fatal("refused within the budget")
+	}
+	if b.acquire(1) {
+		t.Error("acquired over the budget")
+	}
+	b.release(40)
+	if !b.acquire(30) {
+		t.Error("refused once released")
+	}
+	b.release(90)
+	if !b.acquire(500) {
+		t.Error("an entry over the whole budget is refused with nothing in flight")
+	}
+	if _, err := newBudget(100, "drop"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestBudgetPause(t *testing.T) {
+	b, err := newBudget(100, "pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.acquire(80)
+	acquired := make(chan bool)
+	go func() { acquired <- b.acquire(30) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired over the budget without waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(80)
+	if !<-acquired {
+		t.Error("paused acquire failed")
+	}
+}
+
+func TestPushBudgetedStopped(t *testing.T) {
+	defer func(b *budget) { inflight = b }(inflight)
+	var err error
+	if inflight, err = newBudget(1<<20, "pause"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := bson.Marshal(bson.M{"op": "i", "o": bson.M{"_id": 1}})
+	second, _ := bson.Marshal(bson.M{"op": "i", "o": bson.M{"_id": 2, "x": "padding"}})
+	r := newRing(1)
+	stop := make(chan struct{})
+	if !pushBudgeted(r, bson.Raw{Kind: 3, Data: first}, stop) {
+		t.Fatal("push failed before stopping")
+	}
+	close(stop)
+	// nothing reads the ring, so this push only sees stop
+	if pushBudgeted(r, bson.Raw{Kind: 3, Data: second}, stop) {
+		t.Fatal("push succeeded once stopped")
+	}
+	if inflight.used != int64(len(first)) {
+		t.Errorf("%d bytes in flight after a push failed on stop, want the first entry's %d", inflight.used, len(first))
+	}
+}
@@ -0,0 +1,214 @@
+package stats
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var keysNS = flags.String("KEYS_NS", "metrics.keys", "db.collection cataloguing every key summarized, served as /keys by the api, empty for none")
+
+// keyInfo is a key's entry in the catalog
+type keyInfo struct {
+	Key        string    `bson:"_id" json:"key"`
+	First      int64     `bson:"first" json:"first"` // earliest bucket
+	Last       int64     `bson:"last" json:"last"`   // latest bucket
+	Seen       time.Time `bson:"seen" json:"seen"`   // last summarized
+	Buckets    int       `bson:"buckets" json:"buckets"`
+	Datapoints int64     `bson:"datapoints" json:"datapoints"`
+}
+
+// catalog keeps KEYS_NS up to date as summaries are written. A nil
+// catalog keeps nothing.
+type catalog struct {
+	c *mgo.Collection
+}
+
+// keyCatalog is set up by main, nil when KEYS_NS is empty
+var keyCatalog *catalog
+
+func splitKeysNS() (string, string, error) {
+	parts := strings.SplitN(*keysNS, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", cli.Invalidf("KEYS_NS %q must be db.collection", *keysNS)
+	}
+	return parts[0], parts[1], nil
+}
+
+func newCatalog(sess *mgo.Session) (*catalog, error) {
+	if *keysNS == "" {
+		return nil, nil
+	}
+	db, coll, err := splitKeysNS()
+	if err != nil {
+		return nil, err
+	}
+	return &catalog{c: sess.DB(db).C(coll)}, nil
+}
+
+// catalogPrivileges are needed to keep the catalog, and to serve it with
+// the api
+func catalogPrivileges() []dial.Privilege {
+	if *keysNS == "" {
+		return nil
+	}
+	db, coll, err := splitKeysNS()
+	if err != nil {
+		return nil
+	}
+	actions := []string{"insert", "update"}
+	if *apiAddr != "" {
+		actions = append(actions, "find")
+	}
+	return []dial.Privilege{
+		{DB: db, Collection: coll, Actions: actions},
+		{DB: "metrics", Collection: "summary", Actions: []string{"find"}},
+	}
+}
+
+// previous returns how many values the summaries about to be replaced had,
+// buckets missing from it being new. Summaries written before counts were
+// kept count as none.
+func (c *catalog) previous(sess *mgo.Session, summaries []Summary) (map[bucketKey]int, error) {
+	if c == nil || len(summaries) == 0 {
+		return nil, nil
+	}
+	counts := make(map[bucketKey]int, len(summaries))
+	for start := 0; start < len(summaries); start += bucketsPerQuery {
+		end := start + bucketsPerQuery
+		if end > len(summaries) {
+			end = len(summaries)
+		}
+		or := make([]bson.M, 0, end-start)
+		for _, s := range summaries[start:end] {
+			or = append(or, bson.M{"key": s.Key, "at": s.At})
+		}
+		var old []Summary
+		err := sess.DB("metrics").C("summary").Find(bson.M{"$or": or}).Select(bson.M{"key": 1, "at": 1, "n": 1}).All(&old)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range old {
+			counts[bucketKey{s.Key, s.At}] = s.N
+		}
+	}
+	return counts, nil
+}
+
+// record adds the summaries written to the catalog, counting the values
+// and buckets they add to what was there before
+func (c *catalog) record(summaries []Summary, previous map[bucketKey]int) error {
+	if c == nil || len(summaries) == 0 {
+		return nil
+	}
+	type change struct {
+		first, last int64
+		buckets     int
+		datapoints  int64
+	}
+	changes := make(map[string]*change)
+	var order []string
+	for _, s := range summaries {
+		ch := changes[s.Key]
+		if ch == nil {
+			ch = &change{first: s.At, last: s.At}
+			changes[s.Key] = ch
+			order = append(order, s.Key)
+		}
+		if s.At < ch.first {
+			ch.first = s.At
+		}
+		if s.At > ch.last {
+			ch.last = s.At
+		}
+		n, existed := previous[bucketKey{s.Key, s.At}]
+		if !existed {
+			ch.buckets++
+		}
+		ch.datapoints += int64(s.N - n)
+	}
+	now := sysClock.Now()
+	bulk := c.c.Bulk()
+	bulk.Unordered()
+	for _, key := range order {
+		ch := changes[key]
+		bulk.Upsert(bson.M{"_id": key}, bson.M{
+			"$min": bson.M{"first": ch.first},
+			"$max": bson.M{"last": ch.last, "seen": now},
+			"$inc": bson.M{"buckets": ch.buckets, "datapoints": ch.datapoints},
+		})
+	}
+	_, err := bulk.Run()
+	return err
+}
+
+// keyPage is a page of the catalog in key order
+type keyPage struct {
+	Keys []keyInfo `json:"keys"`
+	Next string    `json:"next,omitempty"`
+}
+
+// keys serves GET /keys?prefix=...&limit=...&after=..., the catalog
+func (a *api) keys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		reply(w, nil, &apiError{http.StatusMethodNotAllowed, "GET only"})
+		return
+	}
+	if keyCatalog == nil {
+		reply(w, nil, &apiError{http.StatusNotFound, "no catalog, KEYS_NS is empty"})
+		return
+	}
+	params := r.URL.Query()
+	limit := *apiLimit
+	if s := params.Get("limit"); s != "" {
+		n, err := parsePositive("limit", s)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	t := tenantOf(r)
+	id := bson.M{}
+	if prefix := t.key(params.Get("prefix")); prefix != "" {
+		id["$regex"] = "^" + regexp.QuoteMeta(prefix)
+	}
+	if token := params.Get("after"); token != "" {
+		c, err := parseCursor(token)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		id["$gt"] = c.Key
+	}
+	var sel bson.M
+	if len(id) > 0 {
+		sel = bson.M{"_id": id}
+	}
+
+	sess := a.sess.Copy()
+	defer sess.Close()
+	page := keyPage{Keys: []keyInfo{}}
+	err := keyCatalog.c.With(sess).Find(sel).Sort("_id").Limit(limit + 1).All(&page.Keys)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	if len(page.Keys) > limit {
+		page.Keys = page.Keys[:limit]
+		page.Next = cursor{Key: page.Keys[limit-1].Key}.token()
+	}
+	for i := range page.Keys {
+		page.Keys[i].Key = t.strip(page.Keys[i].Key)
+	}
+	reply(w, page, nil)
+}
@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		needed := []dial.Privilege{
+			{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+			{DB: "metrics", Collection: "raw", Actions: []string{"find"}},
+			{DB: "metrics", Collection: "summary", Actions: []string{"insert", "update"}},
+		}
+		needed = append(needed, rollupPrivileges()...)
+		needed = append(needed, catalogPrivileges()...)
+		needed = append(needed, webhookPrivileges()...)
+		needed = append(needed, fieldStatsPrivileges()...)
+		if *apiAddr != "" {
+			needed = append(needed, dial.Privilege{DB: "metrics", Collection: "summary", Actions: []string{"find"}})
+		}
+		if *apiAddr != "" && *apiIngest {
+			needed = append(needed, dial.Privilege{DB: "metrics", Collection: "raw", Actions: []string{"insert", "update"}})
+		}
+		if parts := strings.SplitN(*auditCollection, ".", 2); len(parts) == 2 {
+			needed = append(needed, dial.Privilege{DB: parts[0], Collection: parts[1], Actions: []string{"insert"}})
+		}
+		if parts := strings.SplitN(*leaseNS, ".", 2); len(parts) == 2 {
+			needed = append(needed, dial.Privilege{DB: parts[0], Collection: parts[1], Actions: []string{"find", "insert", "update"}})
+		}
+		return []cli.Check{
+			{Name: "KEY_PATH, AT_PATH, AT_UNIT, VALUE_PATH and COERCE_VALUES", Run: func() error {
+				_, err := compileExtractor(*keyPath, *atPath, *atUnit, *valuePath, *coerce)
+				return err
+			}},
+			{Name: "TIMEZONE and ROLLUPS", Run: func() error {
+				if err := loadZone(); err != nil {
+					return err
+				}
+				_, err := parseRollups(*rollupWidths)
+				return err
+			}},
+			{Name: "KEYS_NS", Run: func() error {
+				if *keysNS == "" {
+					return nil
+				}
+				_, _, err := splitKeysNS()
+				return err
+			}},
+			{Name: "WEBHOOKS_NS", Run: func() error {
+				if *webhooksNS == "" {
+					return nil
+				}
+				if _, _, err := splitWebhooksNS(); err != nil {
+					return err
+				}
+				_, err := parseWebhookHosts()
+				return err
+			}},
+			{Name: "FIELD_STATS_NS", Run: func() error {
+				if *fieldStatsNS == "" {
+					return nil
+				}
+				_, _, err := splitFieldStatsNS()
+				return err
+			}},
+			{Name: "API_TOKENS", Run: func() error {
+				_, err := parseTokens(*apiTokens)
+				return err
+			}},
+			{Name: "MONGO_URL", Run: func() error { return dial.Probe(*mongoURL, needed...) }},
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package stats
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	decimalPlaces = flags.Int("DECIMAL_PLACES", -1, "digits after the point the exact summaries of decimal128 values are rounded to, halves away from zero, -1 to keep them as they are")
+)
+
+// Decimal is a decimal128 kept exact, written to mongodb as one and to
+// json as a string so it's not read back as a float
+type Decimal struct {
+	bson.Decimal128
+}
+
+func (d Decimal) GetBSON() (interface{}, error) {
+	return d.Decimal128, nil
+}
+
+func (d *Decimal) SetBSON(raw bson.Raw) error {
+	return raw.Unmarshal(&d.Decimal128)
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	var err error
+	d.Decimal128, err = bson.ParseDecimal128(s)
+	return err
+}
+
+// DecimalSummary is the summary of a bucket holding decimal128 values, each
+// stat exact where Summary's are the nearest float64
+type DecimalSummary struct {
+	Min Decimal `bson:"min" json:"min"`
+	Max Decimal `bson:"max" json:"max"`
+	P2  Decimal `bson:"p2" json:"p2"`
+	P9  Decimal `bson:"p9" json:"p9"`
+	P25 Decimal `bson:"p25" json:"p25"`
+	P50 Decimal `bson:"p50" json:"p50"`
+	P75 Decimal `bson:"p75" json:"p75"`
+	P91 Decimal `bson:"p91" json:"p91"`
+	P98 Decimal `bson:"p98" json:"p98"`
+}
+
+// value returns the stat named stat
+func (d *DecimalSummary) value(stat string) (Decimal, bool) {
+	switch stat {
+	case "min":
+		return d.Min, true
+	case "p2":
+		return d.P2, true
+	case "p9":
+		return d.P9, true
+	case "p25":
+		return d.P25, true
+	case "p50":
+		return d.P50, true
+	case "p75":
+		return d.P75, true
+	case "p91":
+		return d.P91, true
+	case "p98":
+		return d.P98, true
+	case "max":
+		return d.Max, true
+	}
+	return Decimal{}, false
+}
+
+// exactValue is a datapoint value as written and its exact value
+type exactValue struct {
+	text string
+	rat  *big.Rat
+}
+
+// exact returns the values of doc COERCE_VALUES takes exactly, nil unless
+// there's a decimal128 among them: doubles and integers summarize exactly
+// as float64 already
+func (e *extractor) exact(doc []byte) ([]exactValue, error) {
+	var values []exactValue
+	decimals := false
+	err := each(doc, e.value, func(kind byte, data []byte) {
+		text, ok := e.text(kind, data)
+		if !ok {
+			return
+		}
+		rat, ok := new(big.Rat).SetString(text)
+		if !ok {
+			return
+		}
+		decimals = decimals || kind == bsonDecimal
+		values = append(values, exactValue{text, rat})
+	})
+	if err != nil || !decimals {
+		return nil, err
+	}
+	return values, nil
+}
+
+// text returns a value COERCE_VALUES takes as the number it was written as
+func (e *extractor) text(kind byte, data []byte) (string, bool) {
+	switch {
+	case kind == bsonDouble:
+		f, _ := number(kind, data)
+		return strconv.FormatFloat(f, 'g', -1, 64), !math.IsNaN(f) && !math.IsInf(f, 0)
+	case e.coerce < coerceNumbers:
+	case kind == bsonInt32:
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(data))), 10), true
+	case kind == bsonInt64:
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(data)), 10), true
+	case kind == bsonDecimal:
+		return decimalString(data)
+	case kind == bsonString && e.coerce >= coerceStrings && len(data) >= 5:
+		s := strings.TrimSpace(string(data[4 : len(data)-1]))
+		_, ok := numeric(s)
+		return s, ok
+	}
+	return "", false
+}
+
+// summarizeExact sorts values in place and returns their summary, taking
+// the same ranks summarize does, nil if a stat doesn't fit a decimal128
+func summarizeExact(values []exactValue) *DecimalSummary {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].rat.Cmp(values[j].rat) < 0 })
+	var d DecimalSummary
+	for _, q := range []struct {
+		p  float64
+		to *Decimal
+	}{
+		{0, &d.Min}, {0.02, &d.P2}, {0.09, &d.P9}, {0.25, &d.P25}, {0.50, &d.P50},
+		{0.75, &d.P75}, {0.91, &d.P91}, {0.98, &d.P98}, {1, &d.Max},
+	} {
+		v := values[rank(q.p, len(values))]
+		text := v.text
+		if *decimalPlaces >= 0 {
+			text = v.rat.FloatString(*decimalPlaces)
+		}
+		var err error
+		if q.to.Decimal128, err = bson.ParseDecimal128(text); err != nil {
+			return nil
+		}
+	}
+	return &d
+}
+
+// rank returns the index of the p quantile of n sorted values, the first
+// one at least p of them are up to, as stat.Empirical takes it
+func rank(p float64, n int) int {
+	at := p * float64(n)
+	var cum float64
+	for i := 0; i < n; i++ {
+		cum++
+		if cum >= at {
+			return i
+		}
+	}
+	return n - 1
+}
@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"runtime"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	decodeWorkers = flags.Int("DECODE_WORKERS", runtime.NumCPU(), "goroutines decoding oplog entries in parallel")
+	ringSize      = flags.Int("DECODE_RING", 1024, "oplog entries in flight between the cursor and the decoders")
+)
+
+// slot holds one undecoded oplog entry on its way through the ring
+type slot struct {
+	data  []byte
+	oplog *Oplog
+	err   error
+	done  chan struct{} // signalled once decoded
+}
+
+// ring is a fixed set of slots reused in cursor order. The ordered channel
+// admits at most n slots at a time, the ring has two more: one being filled
+// by the reader and one still being emitted, so a slot is never reused
+// before it was sent on.
+type ring struct {
+	slots   []slot
+	next    int
+	ordered chan *slot // slots in cursor order, read by the emitter
+	jobs    chan *slot // the same slots, read by whichever decoder is free
+}
+
+func newRing(n int) *ring {
+	if n < 1 {
+		n = 1
+	}
+	r := &ring{
+		slots:   make([]slot, n+2),
+		ordered: make(chan *slot, n),
+		jobs:    make(chan *slot, n),
+	}
+	for i := range r.slots {
+		r.slots[i].done = make(chan struct{}, 1)
+	}
+	return r
+}
+
+// push copies raw into the next slot and hands it to the decoders. It
+// returns false without pushing if stop is closed.
+func (r *ring) push(raw bson.Raw, stop <-chan struct{}) bool {
+	s := &r.slots[r.next]
+	r.next = (r.next + 1) % len(r.slots)
+	s.data = append(s.data[:0], raw.Data...)
+	s.oplog, s.err = nil, nil
+	select {
+	case r.ordered <- s:
+	case <-stop:
+		return false
+	}
+	r.jobs <- s
+	return true
+}
+
+// close is called by the reader once it is done pushing
+func (r *ring) close() {
+	close(r.jobs)
+	close(r.ordered)
+}
+
+func decoder(jobs <-chan *slot) {
+	defer cli.Recover()
+	for s := range jobs {
+		s.oplog = getOplog()
+		s.oplog.size = int64(len(s.data))
+		s.err = bson.Unmarshal(s.data, s.oplog)
+		s.done <- struct{}{}
+	}
+}
+
+// decodeCh decodes the ring's slots on workers goroutines and sends the
+// results in cursor order. The first decode error ends the stream and closes
+// stop, otherwise the stream ends with whatever readErr returns once the
+// reader closes the ring.
+func decodeCh(r *ring, workers int, stop chan<- struct{}, readErr func() error) (<-chan *Oplog, <-chan error) {
+	out := make(chan *Oplog)
+	errc := make(chan error, 1)
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go decoder(r.jobs)
+	}
+	go func() {
+		defer cli.Recover()
+		var err error
+		defer func() {
+			errc <- err
+			close(errc)
+		}()
+		defer close(out)
+		for s := range r.ordered {
+			<-s.done
+			if s.err != nil {
+				putOplog(s.oplog)
+				err = s.err
+				close(stop)
+				return
+			}
+			out <- s.oplog
+		}
+		err = readErr()
+	}()
+	return out, errc
+}
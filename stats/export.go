@@ -0,0 +1,230 @@
+package stats
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// exportColumns head every export, a row per summary
+var exportColumns = append([]string{"key", "at", "time", "n"}, statNames...)
+
+// exportRow returns the cells of s under exportColumns, strings and
+// numbers, the stats of decimal128 values exact
+func exportRow(s Summary) []interface{} {
+	at := time.Unix(0, s.At*int64(time.Millisecond)).UTC()
+	row := []interface{}{s.Key, float64(s.At), at.Format(time.RFC3339Nano), float64(s.N)}
+	for _, stat := range statNames {
+		if s.Decimal != nil {
+			d, _ := s.Decimal.value(stat)
+			row = append(row, d)
+			continue
+		}
+		v, _ := s.value(stat)
+		row = append(row, v)
+	}
+	return row
+}
+
+// cell formats a cell of a row as text
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case Decimal:
+		return v.String()
+	}
+	return v.(string)
+}
+
+// exporter writes summaries out as a file of one kind
+type exporter interface {
+	write(s Summary) error
+	close() error
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func newCSVExporter(w io.Writer) (exporter, error) {
+	e := &csvExporter{csv.NewWriter(w)}
+	return e, e.w.Write(exportColumns)
+}
+
+func (e *csvExporter) write(s Summary) error {
+	var record []string
+	for _, v := range exportRow(s) {
+		record = append(record, cell(v))
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExporter) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// xlsxExporter writes a workbook of one sheet, as little of the format as
+// spreadsheets open. Strings are inline, there being no shared strings.
+type xlsxExporter struct {
+	z     *zip.Writer
+	sheet io.Writer
+	rows  int
+}
+
+// the parts of the workbook besides the sheet
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="summaries" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`},
+}
+
+func newXLSXExporter(w io.Writer) (exporter, error) {
+	e := &xlsxExporter{z: zip.NewWriter(w)}
+	for _, part := range xlsxParts {
+		f, err := e.z.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+	// the sheet is written last, streamed row by row
+	var err error
+	if e.sheet, err = e.z.Create("xl/worksheets/sheet1.xml"); err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(e.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]interface{}, len(exportColumns))
+	for i, name := range exportColumns {
+		header[i] = name
+	}
+	return e, e.row(header)
+}
+
+// row writes the next row of the sheet, numbers as numbers so they sort
+// and compute as such
+func (e *xlsxExporter) row(cells []interface{}) error {
+	e.rows++
+	fmt.Fprintf(e.sheet, `<row r="%d">`, e.rows)
+	for _, v := range cells {
+		if _, ok := v.(string); !ok {
+			fmt.Fprintf(e.sheet, `<c><v>%s</v></c>`, cell(v))
+			continue
+		}
+		io.WriteString(e.sheet, `<c t="inlineStr"><is><t>`)
+		xml.EscapeText(e.sheet, []byte(cell(v)))
+		io.WriteString(e.sheet, `</t></is></c>`)
+	}
+	_, err := io.WriteString(e.sheet, "</row>")
+	return err
+}
+
+func (e *xlsxExporter) write(s Summary) error {
+	return e.row(exportRow(s))
+}
+
+func (e *xlsxExporter) close() error {
+	if _, err := io.WriteString(e.sheet, "</sheetData></worksheet>"); err != nil {
+		return err
+	}
+	return e.z.Close()
+}
+
+// export formats, their content types and the exporter writing them
+var exports = map[string]struct {
+	contentType string
+	open        func(io.Writer) (exporter, error)
+}{
+	"csv":  {"text/csv", newCSVExporter},
+	"xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", newXLSXExporter},
+}
+
+// export serves GET /summaries/export?format=csv|xlsx&key=...&from=...&to=...
+// &resolution=..., every summary selected as a file to download, csv
+// unless format says otherwise
+func (a *api) export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		reply(w, nil, &apiError{http.StatusMethodNotAllowed, "GET only"})
+		return
+	}
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	kind, ok := exports[format]
+	if !ok {
+		reply(w, nil, badRequest("format %q: csv or xlsx", format))
+		return
+	}
+	q, err := parseSummaryQuery(r)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	res := params.Get("resolution")
+	if res == "" {
+		res = "raw"
+	}
+	coll, err := resolutionCollection(res)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+
+	sess := a.sess.Copy()
+	defer sess.Close()
+	iter := sess.DB("metrics").C(coll).Find(q.selector()).Sort("key", "at").Iter()
+	w.Header().Set("Content-Type", kind.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="summaries.%s"`, format))
+	// past here the status is sent, a failure only cuts the file short
+	e, err := kind.open(w)
+	t := tenantOf(r)
+	for err == nil {
+		var s Summary // fresh, n is left out of older ones
+		if !iter.Next(&s) {
+			break
+		}
+		s.Key = t.strip(s.Key)
+		err = e.write(s)
+	}
+	if err == nil {
+		err = iter.Err()
+	}
+	if err == nil {
+		err = e.close()
+	}
+	iter.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "api: export: %s\n", err)
+	}
+}
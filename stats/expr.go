@@ -0,0 +1,570 @@
+package stats
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Expressions over the stored series, evaluated by GET /eval and by grafana
+// targets calling a function:
+//
+//	p50(key), p95(key), ...   a percentile of key's buckets, any up to p100
+//	min(key), max(key)        the least and greatest value of key's buckets
+//	count(key)                how many values key's buckets had
+//	key                       a bare key, its p50
+//	rate(key), rate(expr)     per second increase of a counter, key's max, or expr
+//	+ - * /                   arithmetic between series and numbers
+//	> < >= <= == !=           keeping the points it holds for
+//
+// Series are matched by bucket. Keys with operators in them are quoted,
+// "a-b.c".
+
+// point is a bucket of an evaluated series
+type point struct {
+	At    int64   `json:"at"`
+	Value float64 `json:"value"`
+}
+
+// value is a number, or a series when series isn't nil
+type value struct {
+	number float64
+	series []point
+}
+
+// node is a parsed expression
+type node interface {
+	eval(e *evaluator) (value, error)
+}
+
+type numberNode float64
+
+// keyNode is one of key's summary values, fn naming which, empty for a
+// bare key
+type keyNode struct {
+	fn, key string
+}
+
+type rateNode struct {
+	arg node
+}
+
+type negNode struct {
+	arg node
+}
+
+type binaryNode struct {
+	op   string
+	l, r node
+}
+
+// tokens of an expression, kinds being "number", "key", "op" and "end"
+type token struct {
+	kind, text string
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				(s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				j++
+			}
+			tokens = append(tokens, token{"number", s[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{"key", s[i:j]})
+			i = j
+		case c == '"':
+			j := strings.IndexByte(s[i+1:], '"')
+			if j < 0 {
+				return nil, badRequest("expression: unterminated quote at %d", i)
+			}
+			tokens = append(tokens, token{"key", s[i+1 : i+1+j]})
+			i += j + 2
+		case strings.ContainsRune("<>=!", c) && i+1 < len(s) && s[i+1] == '=':
+			tokens = append(tokens, token{"op", s[i : i+2]})
+			i += 2
+		case strings.ContainsRune("+-*/()<>,", c):
+			tokens = append(tokens, token{"op", s[i : i+1]})
+			i++
+		default:
+			return nil, badRequest("expression: unexpected %q at %d", c, i)
+		}
+	}
+	return append(tokens, token{"end", ""}), nil
+}
+
+// parser is a recursive descent over the tokens, comparisons binding
+// loosest and unary minus tightest
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parseExpr(s string) (node, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "end" {
+		return nil, badRequest("expression: unexpected %q", t.text)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != "end" {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it's one of ops
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != "op" {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return badRequest("expression: expected %q, got %q", op, p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) comparison() (node, error) {
+	l, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.accept(">", "<", ">=", "<=", "==", "!="); ok {
+		r, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return binaryNode{op, l, r}, nil
+	}
+	return l, nil
+}
+
+func (p *parser) sum() (node, error) {
+	l, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return l, nil
+		}
+		r, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{op, l, r}
+	}
+}
+
+func (p *parser) term() (node, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/")
+		if !ok {
+			return l, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{op, l, r}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if _, ok := p.accept("-"); ok {
+		arg, err := p.unary()
+		return negNode{arg}, err
+	}
+	return p.primary()
+}
+
+// percentileFn matches pN, N up to 100 with decimals
+var percentileFn = regexp.MustCompile(`^p(100|[0-9]{1,2}(\.[0-9]+)?)$`)
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case "number":
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, badRequest("expression: invalid number %q", t.text)
+		}
+		return numberNode(v), nil
+	case "key":
+		if _, call := p.accept("("); !call {
+			return keyNode{"", t.text}, nil
+		}
+		fn := t.text
+		if fn == "rate" {
+			arg, err := p.comparison()
+			if err != nil {
+				return nil, err
+			}
+			if k, ok := arg.(keyNode); ok && k.fn == "" {
+				arg = keyNode{"max", k.key} // a bare counter
+			}
+			return rateNode{arg}, p.expect(")")
+		}
+		if fn != "min" && fn != "max" && fn != "count" && !percentileFn.MatchString(fn) {
+			return nil, badRequest("expression: unknown function %q", fn)
+		}
+		key := p.next()
+		if key.kind != "key" {
+			return nil, badRequest("expression: %s takes a key, got %q", fn, key.text)
+		}
+		return keyNode{fn, key.text}, p.expect(")")
+	case "op":
+		if t.text == "(" {
+			n, err := p.comparison()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		}
+	}
+	if t.kind == "end" {
+		return nil, badRequest("expression: unexpected end")
+	}
+	return nil, badRequest("expression: unexpected %q", t.text)
+}
+
+// exprKeys returns the keys n reads
+func exprKeys(n node) []string {
+	seen := make(map[string]bool)
+	var walk func(n node)
+	walk = func(n node) {
+		switch n := n.(type) {
+		case keyNode:
+			seen[n.key] = true
+		case rateNode:
+			walk(n.arg)
+		case negNode:
+			walk(n.arg)
+		case binaryNode:
+			walk(n.l)
+			walk(n.r)
+		}
+	}
+	walk(n)
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// evaluator loads the series of an expression's keys, each once, as the
+// tenant has them
+type evaluator struct {
+	tenant tenant
+	coll   *mgo.Collection
+	q      summaryQuery
+	points int
+	loaded map[string][]Summary
+}
+
+func (e *evaluator) summaries(key string) ([]Summary, error) {
+	if s, ok := e.loaded[key]; ok {
+		return s, nil
+	}
+	q := e.q
+	q.keys = []string{e.tenant.key(key)}
+	var summaries []Summary
+	// the latest ones when there are more than points
+	if err := e.coll.Find(q.selector()).Sort("-at").Limit(e.points).All(&summaries); err != nil {
+		return nil, err
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].At < summaries[j].At })
+	e.loaded[key] = summaries
+	return summaries, nil
+}
+
+func (n numberNode) eval(e *evaluator) (value, error) {
+	return value{number: float64(n)}, nil
+}
+
+// percentile interpolates the p'th percentile between the stored ones
+func percentile(s Summary, p float64) float64 {
+	qs := []float64{0, 2, 9, 25, 50, 75, 91, 98, 100}
+	vs := []float64{s.Min, s.P2, s.P9, s.P25, s.P50, s.P75, s.P91, s.P98, s.Max}
+	for i := 1; i < len(qs); i++ {
+		if p <= qs[i] {
+			v := vs[i-1] + (vs[i]-vs[i-1])*(p-qs[i-1])/(qs[i]-qs[i-1])
+			// rounding can take it past the stat it's read towards
+			return math.Max(vs[i-1], math.Min(v, vs[i]))
+		}
+	}
+	return s.Max
+}
+
+func (n keyNode) eval(e *evaluator) (value, error) {
+	summaries, err := e.summaries(n.key)
+	if err != nil {
+		return value{}, err
+	}
+	series := make([]point, len(summaries))
+	for i, s := range summaries {
+		var v float64
+		switch n.fn {
+		case "count":
+			v = float64(s.N)
+		case "min":
+			v = s.Min
+		case "max":
+			v = s.Max
+		case "":
+			v = s.P50
+		default:
+			p, _ := strconv.ParseFloat(n.fn[1:], 64)
+			v = percentile(s, p)
+		}
+		series[i] = point{s.At, v}
+	}
+	return value{series: series}, nil
+}
+
+func (n rateNode) eval(e *evaluator) (value, error) {
+	v, err := n.arg.eval(e)
+	if err != nil {
+		return value{}, err
+	}
+	if v.series == nil {
+		return value{}, badRequest("expression: rate of a number")
+	}
+	rates := []point{}
+	for i := 1; i < len(v.series); i++ {
+		prev, cur := v.series[i-1], v.series[i]
+		increase := cur.Value - prev.Value
+		if increase < 0 {
+			increase = cur.Value // reset, counted up from 0 again
+		}
+		rates = append(rates, point{cur.At, increase / (float64(cur.At-prev.At) / 1000)})
+	}
+	return value{series: rates}, nil
+}
+
+func (n negNode) eval(e *evaluator) (value, error) {
+	v, err := n.arg.eval(e)
+	if err != nil || v.series == nil {
+		return value{number: -v.number}, err
+	}
+	neg := make([]point, len(v.series))
+	for i, p := range v.series {
+		neg[i] = point{p.At, -p.Value}
+	}
+	return value{series: neg}, nil
+}
+
+// apply returns a op b, and for comparisons whether the point is kept
+func apply(op string, a, b float64) (float64, bool) {
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		return a / b, true
+	case ">":
+		return a, a > b
+	case "<":
+		return a, a < b
+	case ">=":
+		return a, a >= b
+	case "<=":
+		return a, a <= b
+	case "==":
+		return a, a == b
+	case "!=":
+		return a, a != b
+	}
+	return 0, false
+}
+
+func comparing(op string) bool {
+	return op != "+" && op != "-" && op != "*" && op != "/"
+}
+
+func (n binaryNode) eval(e *evaluator) (value, error) {
+	l, err := n.l.eval(e)
+	if err != nil {
+		return value{}, err
+	}
+	r, err := n.r.eval(e)
+	if err != nil {
+		return value{}, err
+	}
+	if l.series == nil && r.series == nil {
+		v, ok := apply(n.op, l.number, r.number)
+		if comparing(n.op) {
+			v = 0
+			if ok {
+				v = 1
+			}
+		}
+		return value{number: v}, nil
+	}
+	out := []point{}
+	add := func(at int64, a, b, kept float64) {
+		v, ok := apply(n.op, a, b)
+		if comparing(n.op) {
+			v = kept
+		}
+		if ok && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			out = append(out, point{at, v})
+		}
+	}
+	switch {
+	case r.series == nil:
+		for _, p := range l.series {
+			add(p.At, p.Value, r.number, p.Value)
+		}
+	case l.series == nil:
+		for _, p := range r.series {
+			add(p.At, l.number, p.Value, p.Value)
+		}
+	default:
+		// both in bucket order, only buckets both have
+		for i, j := 0, 0; i < len(l.series) && j < len(r.series); {
+			a, b := l.series[i], r.series[j]
+			switch {
+			case a.At < b.At:
+				i++
+			case a.At > b.At:
+				j++
+			default:
+				add(a.At, a.Value, b.Value, a.Value)
+				i++
+				j++
+			}
+		}
+	}
+	return value{series: out}, nil
+}
+
+// evaluate evaluates expr over the range of q at a resolution, auto
+// picking one for all of its keys
+func (a *api) evaluate(sess *mgo.Session, t tenant, expr string, q summaryQuery, res string, points int) ([]point, string, error) {
+	n, err := parseExpr(expr)
+	if err != nil {
+		return nil, "", err
+	}
+	keys := exprKeys(n)
+	if len(keys) == 0 {
+		return nil, "", badRequest("expression %q reads no key", expr)
+	}
+	q.keys = nil
+	for _, key := range keys {
+		q.keys = append(q.keys, t.key(key))
+	}
+	if res == "auto" {
+		if res, err = autoResolution(sess.DB("metrics").C("summary"), q, points); err != nil {
+			return nil, "", err
+		}
+	}
+	coll, err := resolutionCollection(res)
+	if err != nil {
+		return nil, "", err
+	}
+	e := &evaluator{tenant: t, coll: sess.DB("metrics").C(coll), q: q, points: points, loaded: make(map[string][]Summary)}
+	v, err := n.eval(e)
+	if err != nil {
+		return nil, "", err
+	}
+	return v.series, res, nil
+}
+
+// evalResult is the series an expression evaluated to
+type evalResult struct {
+	Resolution string  `json:"resolution"`
+	Series     []point `json:"series"`
+}
+
+// eval serves GET /eval?expr=...&from=...&to=...&resolution=...&points=...
+func (a *api) eval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		reply(w, nil, &apiError{http.StatusMethodNotAllowed, "GET only"})
+		return
+	}
+	params := r.URL.Query()
+	expr := params.Get("expr")
+	if expr == "" {
+		reply(w, nil, badRequest("expr is needed"))
+		return
+	}
+	q, err := parseRange(r)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	points := *apiLimit
+	if s := params.Get("points"); s != "" {
+		if points, err = parsePositive("points", s); err != nil {
+			reply(w, nil, err)
+			return
+		}
+	}
+	res := params.Get("resolution")
+	if res == "" {
+		res = "auto"
+	}
+	sess := a.sess.Copy()
+	defer sess.Close()
+	series, res, err := a.evaluate(sess, tenantOf(r), expr, q, res, points)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	reply(w, evalResult{res, series}, nil)
+}
@@ -0,0 +1,229 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sexpr writes a parsed expression out with its grouping explicit
+func sexpr(n node) string {
+	switch n := n.(type) {
+	case numberNode:
+		return fmt.Sprint(float64(n))
+	case keyNode:
+		if n.fn == "" {
+			return n.key
+		}
+		return n.fn + "(" + n.key + ")"
+	case rateNode:
+		return "rate(" + sexpr(n.arg) + ")"
+	case negNode:
+		return "(neg " + sexpr(n.arg) + ")"
+	case binaryNode:
+		return "(" + n.op + " " + sexpr(n.l) + " " + sexpr(n.r) + ")"
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+func TestParseExpr(t *testing.T) {
+	for _, c := range []struct {
+		expr, parsed string
+	}{
+		{"lat", "lat"},
+		{"1 + 2 * 3", "(+ 1 (* 2 3))"},
+		{"1 * 2 + 3", "(+ (* 1 2) 3)"},
+		{"(1 + 2) * 3", "(* (+ 1 2) 3)"},
+		{"1 - 2 - 3", "(- (- 1 2) 3)"},
+		{"8 / 4 / 2", "(/ (/ 8 4) 2)"},
+		{"-lat * 2", "(* (neg lat) 2)"},
+		{"2 * -3", "(* 2 (neg 3))"},
+		{"- -1", "(neg (neg 1))"},
+		{"-(1 + 2)", "(neg (+ 1 2))"},
+		{"1 - -2", "(- 1 (neg 2))"},
+		{"a + 1 > b * 2", "(> (+ a 1) (* b 2))"},
+		{"a>=1", "(>= a 1)"},
+		{"a != b", "(!= a b)"},
+		{"((a))", "a"},
+		{"p95(lat) / p50(lat)", "(/ p95(lat) p50(lat))"},
+		{"p99.9(lat) + p100(lat) + p0(lat)", "(+ (+ p99.9(lat) p100(lat)) p0(lat))"},
+		{"min(lat) + max(lat) + count(lat)", "(+ (+ min(lat) max(lat)) count(lat))"},
+		{"rate(hits)", "rate(max(hits))"},
+		{"rate(count(hits))", "rate(count(hits))"},
+		{"rate(hits * 2)", "rate((* hits 2))"},
+		{`"a-b.c" + 1`, "(+ a-b.c 1)"},
+		{"db.ops_1", "db.ops_1"},
+		{"1e3 + .5 + 2.5E-1", "(+ (+ 1000 0.5) 0.25)"},
+		{"\tlat\n", "lat"},
+	} {
+		n, err := parseExpr(c.expr)
+		if err != nil {
+			t.Errorf("%q: %s", c.expr, err)
+			continue
+		}
+		if got := sexpr(n); got != c.parsed {
+			t.Errorf("%q parsed as %s, want %s", c.expr, got, c.parsed)
+		}
+	}
+}
+
+func TestParseExprInvalid(t *testing.T) {
+	for _, c := range []struct {
+		expr, err string
+	}{
+		{"", "expression: unexpected end"},
+		{"1 +", "expression: unexpected end"},
+		{"-", "expression: unexpected end"},
+		{"1 2", `expression: unexpected "2"`},
+		{"lat lat", `expression: unexpected "lat"`},
+		{"1 + 2)", `expression: unexpected ")"`},
+		{"a > b > c", `expression: unexpected ">"`},
+		{"*3", `expression: unexpected "*"`},
+		{"()", `expression: unexpected ")"`},
+		{"(1 + 2", `expression: expected ")", got ""`},
+		{"p50(lat", `expression: expected ")", got ""`},
+		{"p50(lat, p)", `expression: expected ")", got ","`},
+		{"rate(hits", `expression: expected ")", got ""`},
+		{"avg(lat)", `expression: unknown function "avg"`},
+		{"p101(lat)", `expression: unknown function "p101"`},
+		{"p5x(lat)", `expression: unknown function "p5x"`},
+		{"p50(1)", `expression: p50 takes a key, got "1"`},
+		{"max()", `expression: max takes a key, got ")"`},
+		{`"open`, "expression: unterminated quote at 0"},
+		{`1 + "a`, "expression: unterminated quote at 4"},
+		{"lat # 2", "expression: unexpected '#' at 4"},
+		{"lat = 2", "expression: unexpected '=' at 4"},
+		{"lat ! 2", "expression: unexpected '!' at 4"},
+		{"1..2", `expression: invalid number "1..2"`},
+		{"1e", `expression: invalid number "1e"`},
+	} {
+		_, err := parseExpr(c.expr)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: %v, want %s", c.expr, err, c.err)
+			continue
+		}
+		if e, ok := err.(*apiError); !ok || e.code != 400 {
+			t.Errorf("%q: %#v isn't a bad request", c.expr, err)
+		}
+	}
+}
+
+func TestExprKeys(t *testing.T) {
+	n, err := parseExpr(`rate(hits) / p95(lat) + -lat * count("a-b") > 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := exprKeys(n); !reflect.DeepEqual(keys, []string{"a-b", "hits", "lat"}) {
+		t.Errorf("keys %q", keys)
+	}
+}
+
+// loaded is an evaluator over series as if read from the summaries
+func loaded() *evaluator {
+	return &evaluator{loaded: map[string][]Summary{
+		"lat": {
+			{At: 1000, Min: 1, P2: 2, P9: 4, P25: 8, P50: 10, P75: 12, P91: 14, P98: 15, Max: 16, N: 5},
+			{At: 2000, Min: 2, P2: 3, P9: 5, P25: 10, P50: 20, P75: 22, P91: 24, P98: 25, Max: 26, N: 7},
+			{At: 3000, Min: 3, P2: 4, P9: 6, P25: 12, P50: 30, P75: 32, P91: 34, P98: 35, Max: 36, N: 9},
+		},
+		"zero":   {{At: 1000, P50: 0}, {At: 2000, P50: 5}},
+		"sparse": {{At: 2000, P50: 1}, {At: 4000, P50: 1}},
+		// a counter, reset between 3000 and 4000
+		"hits":  {{At: 1000, Max: 100}, {At: 3000, Max: 160}, {At: 4000, Max: 40}},
+		"empty": nil,
+	}}
+}
+
+func TestEval(t *testing.T) {
+	for _, c := range []struct {
+		expr   string
+		series []point
+	}{
+		{"lat", []point{{1000, 10}, {2000, 20}, {3000, 30}}},
+		{"-lat", []point{{1000, -10}, {2000, -20}, {3000, -30}}},
+		{"lat * 2 + 1", []point{{1000, 21}, {2000, 41}, {3000, 61}}},
+		{"1 + 2 * lat", []point{{1000, 21}, {2000, 41}, {3000, 61}}},
+		{"(1 + 2) * lat", []point{{1000, 30}, {2000, 60}, {3000, 90}}},
+		{"100 / lat", []point{{1000, 10}, {2000, 5}, {3000, 100.0 / 30}}},
+		{"min(lat) + max(lat)", []point{{1000, 17}, {2000, 28}, {3000, 39}}},
+		{"count(lat)", []point{{1000, 5}, {2000, 7}, {3000, 9}}},
+		{"p0(lat) - p100(lat)", []point{{1000, -15}, {2000, -24}, {3000, -33}}},
+		{"p37.5(lat)", []point{{1000, 9}, {2000, 15}, {3000, 21}}},
+		{"p98(lat)", []point{{1000, 15}, {2000, 25}, {3000, 35}}},
+		// only buckets both have
+		{"lat + sparse", []point{{2000, 21}}},
+		// division by zero leaves the point out
+		{"lat / 0", []point{}},
+		{"lat / zero", []point{{2000, 4}}},
+		{"0 / zero", []point{{2000, 0}}},
+		// comparisons keep the points of the series they hold for
+		{"lat > 15", []point{{2000, 20}, {3000, 30}}},
+		{"15 > lat", []point{{1000, 10}}},
+		{"lat <= lat", []point{{1000, 10}, {2000, 20}, {3000, 30}}},
+		{"lat != 20", []point{{1000, 10}, {3000, 30}}},
+		{"lat == 21", []point{}},
+		// per second, a reset counting up from 0
+		{"rate(hits)", []point{{3000, 30}, {4000, 40}}},
+		{"rate(lat * 1000)", []point{{2000, 10000}, {3000, 10000}}},
+		{"rate(empty)", []point{}},
+		{"empty + 1", []point{}},
+	} {
+		n, err := parseExpr(c.expr)
+		if err != nil {
+			t.Errorf("%q: %s", c.expr, err)
+			continue
+		}
+		v, err := n.eval(loaded())
+		if err != nil {
+			t.Errorf("%q: %s", c.expr, err)
+			continue
+		}
+		if len(v.series) != len(c.series) {
+			t.Errorf("%q is %v, want %v", c.expr, v.series, c.series)
+			continue
+		}
+		for i, p := range c.series {
+			if v.series[i].At != p.At || math.Abs(v.series[i].Value-p.Value) > 1e-9 {
+				t.Errorf("%q is %v, want %v", c.expr, v.series, c.series)
+				break
+			}
+		}
+	}
+}
+
+func TestEvalNumbers(t *testing.T) {
+	for _, c := range []struct {
+		expr   string
+		number float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"-(1 + 2) * 3", -9},
+		{"2 > 1", 1},
+		{"2 < 1", 0},
+		{"1 / 0", math.Inf(1)},
+		{"-1 / 0", math.Inf(-1)},
+	} {
+		n, err := parseExpr(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := n.eval(loaded())
+		if err != nil || v.series != nil || v.number != c.number {
+			t.Errorf("%q is %v, %v, want %v", c.expr, v, err, c.number)
+		}
+	}
+}
+
+func TestEvalInvalid(t *testing.T) {
+	for _, expr := range []string{"rate(2)", "rate(1 + 2) * lat", "lat + rate(-1)"} {
+		n, err := parseExpr(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.eval(loaded()); err == nil || !strings.Contains(err.Error(), "expression: rate of a number") {
+			t.Errorf("%q: %v", expr, err)
+		}
+	}
+}
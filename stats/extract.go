@@ -0,0 +1,329 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	// reloaded on SIGHUP or a config file change
+	keyPath   = flags.String("KEY_PATH", "key", "dotted path to the metric key in raw documents")
+	atPath    = flags.String("AT_PATH", "at", "dotted path to the bucket time in raw documents")
+	valuePath = flags.String("VALUE_PATH", "values.value", "dotted path to datapoint values, arrays on the way are walked element by element")
+	coerce    = flags.String("COERCE_VALUES", "numbers", "datapoint values taken besides doubles: strict for none, numbers for int32, int64 and decimal128 ones, strings for those and strings of numbers too, the rest counted as rejected_values")
+)
+
+// COERCE_VALUES strictness, each taking what the one before does
+const (
+	coerceStrict = iota
+	coerceNumbers
+	coerceStrings
+)
+
+var coerceLevels = map[string]int{"strict": coerceStrict, "numbers": coerceNumbers, "strings": coerceStrings}
+
+var errMalformed = errors.New("malformed bson")
+
+// bson element types the extractors care about
+const (
+	bsonDouble    = 0x01
+	bsonString    = 0x02
+	bsonDocument  = 0x03
+	bsonArray     = 0x04
+	bsonObjectID  = 0x07
+	bsonInt32     = 0x10
+	bsonTimestamp = 0x11
+	bsonInt64     = 0x12
+	bsonDecimal   = 0x13
+)
+
+// extractor pulls key, at and values straight out of raw document bytes,
+// walking only the elements on each precompiled path.
+type extractor struct {
+	key, at, value []string
+	coerce         int
+	unit           int64 // milliseconds per AT_UNIT, 0 for auto
+}
+
+func compileExtractor(key, at, unit, value, coerce string) (*extractor, error) {
+	level, ok := coerceLevels[coerce]
+	if !ok {
+		return nil, fmt.Errorf("COERCE_VALUES %q must be strict, numbers or strings", coerce)
+	}
+	ms, ok := atUnits[unit]
+	if !ok {
+		return nil, fmt.Errorf("AT_UNIT %q must be s, ms or auto", unit)
+	}
+	e := &extractor{
+		key:    strings.Split(key, "."),
+		at:     strings.Split(at, "."),
+		value:  strings.Split(value, "."),
+		coerce: level,
+		unit:   ms,
+	}
+	for _, p := range [][]string{e.key, e.at, e.value} {
+		for _, seg := range p {
+			if seg == "" {
+				return nil, fmt.Errorf("empty segment in extraction path %q", strings.Join(p, "."))
+			}
+		}
+	}
+	return e, nil
+}
+
+// extract appends the datapoint values of doc to values. Values that
+// COERCE_VALUES doesn't take are skipped.
+func (e *extractor) extract(doc []byte, values []float64) (key string, at int64, _ []float64, err error) {
+	kind, data, err := lookup(doc, e.key)
+	if err != nil {
+		return "", 0, values, err
+	}
+	if kind != bsonString || len(data) < 5 {
+		return "", 0, values, fmt.Errorf("%s is not a string", strings.Join(e.key, "."))
+	}
+	key = string(data[4 : len(data)-1])
+
+	kind, data, err = lookup(doc, e.at)
+	if err != nil {
+		return "", 0, values, err
+	}
+	at, ok := e.atMillis(kind, data)
+	if !ok {
+		return "", 0, values, fmt.Errorf("%s is not a time", strings.Join(e.at, "."))
+	}
+
+	values, err = e.collect(doc, e.value, values)
+	return key, at, values, err
+}
+
+// collect appends every value found at path
+func (e *extractor) collect(doc []byte, path []string, values []float64) ([]float64, error) {
+	err := each(doc, path, func(kind byte, data []byte) {
+		if f, ok := e.datapoint(kind, data); ok {
+			values = append(values, f)
+		}
+	})
+	return values, err
+}
+
+// each calls fn with every element found at path, fanning out over arrays
+func each(doc []byte, path []string, fn func(kind byte, data []byte)) error {
+	return walk(doc, func(name []byte, kind byte, data []byte) (bool, error) {
+		if string(name) != path[0] {
+			return true, nil
+		}
+		if len(path) == 1 {
+			fn(kind, data)
+			return false, nil
+		}
+		var err error
+		switch kind {
+		case bsonDocument:
+			err = each(data, path[1:], fn)
+		case bsonArray:
+			err = walk(data, func(_ []byte, kind byte, elem []byte) (bool, error) {
+				if kind != bsonDocument {
+					return true, nil
+				}
+				err := each(elem, path[1:], fn)
+				return err == nil, err
+			})
+		}
+		return false, err
+	})
+}
+
+// lookup returns the first element at path
+func lookup(doc []byte, path []string) (kind byte, data []byte, err error) {
+	found := false
+	err = walk(doc, func(name []byte, k byte, d []byte) (bool, error) {
+		if string(name) != path[0] {
+			return true, nil
+		}
+		if len(path) == 1 {
+			kind, data, found = k, d, true
+			return false, nil
+		}
+		if k == bsonDocument || k == bsonArray {
+			kind, data, err = lookup(d, path[1:])
+			found = err == nil
+			return false, err
+		}
+		return false, nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("%s not found", strings.Join(path, "."))
+	}
+	return
+}
+
+func number(kind byte, data []byte) (float64, bool) {
+	switch kind {
+	case bsonDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), true
+	case bsonInt32:
+		return float64(int32(binary.LittleEndian.Uint32(data))), true
+	case bsonInt64:
+		return float64(int64(binary.LittleEndian.Uint64(data))), true
+	}
+	return 0, false
+}
+
+// datapoint returns a value as a float64 if COERCE_VALUES takes its type,
+// counting the ones coerced and rejected
+func (e *extractor) datapoint(kind byte, data []byte) (float64, bool) {
+	if kind == bsonDouble {
+		return number(kind, data)
+	}
+	var f float64
+	ok := false
+	switch {
+	case e.coerce < coerceNumbers:
+	case kind == bsonInt32, kind == bsonInt64:
+		f, ok = number(kind, data)
+	case kind == bsonDecimal:
+		f, ok = decimal(data)
+	case kind == bsonString && e.coerce >= coerceStrings && len(data) >= 5:
+		f, ok = numeric(string(data[4 : len(data)-1]))
+	}
+	if !ok {
+		rejectedValues.Add(1)
+		return 0, false
+	}
+	coercedValues.Add(1)
+	return f, true
+}
+
+// decimal returns the decimal128 in data as the nearest float64, not ok
+// for NaN, infinities and those past float64's range
+func decimal(data []byte) (float64, bool) {
+	s, ok := decimalString(data)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// decimalString returns the decimal128 in data as its significand and
+// exponent, 1234E-2, not ok for NaN and infinities
+func decimalString(data []byte) (string, bool) {
+	lo := binary.LittleEndian.Uint64(data)
+	hi := binary.LittleEndian.Uint64(data[8:])
+	sign := ""
+	if hi>>63 == 1 {
+		sign = "-"
+	}
+	switch {
+	case hi>>58&0x1f >= 0x1e:
+		return "", false // NaN or infinity
+	case hi>>61&0x3 == 0x3:
+		return sign + "0", true // a significand past 34 digits, zero
+	}
+	exp := int(hi>>49&0x3fff) - 6176
+	var coef big.Int
+	coef.SetUint64(hi & (1<<49 - 1))
+	coef.Lsh(&coef, 64)
+	coef.Or(&coef, new(big.Int).SetUint64(lo))
+	return sign + coef.String() + "E" + strconv.Itoa(exp), true
+}
+
+// numeric parses a string of a number, not ok for NaN and infinities
+func numeric(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// walk calls fn with every element of doc until fn returns false. data is
+// the element's value bytes, for documents and arrays the whole sub document.
+func walk(doc []byte, fn func(name []byte, kind byte, data []byte) (bool, error)) error {
+	if len(doc) < 5 {
+		return errMalformed
+	}
+	end := int(int32(binary.LittleEndian.Uint32(doc)))
+	if end > len(doc) || end < 5 {
+		return errMalformed
+	}
+	pos := 4
+	for pos < end-1 {
+		kind := doc[pos]
+		pos++
+		n := bytes.IndexByte(doc[pos:end], 0)
+		if n < 0 {
+			return errMalformed
+		}
+		name := doc[pos : pos+n]
+		pos += n + 1
+		size, err := valueSize(kind, doc[pos:end])
+		if err != nil {
+			return err
+		}
+		more, err := fn(name, kind, doc[pos:pos+size])
+		if err != nil || !more {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
+
+// valueSize returns the length of an element value of kind at the start of b
+func valueSize(kind byte, b []byte) (int, error) {
+	var size int
+	switch kind {
+	case 0x06, 0x0A, 0x7F, 0xFF: // undefined, null, max key, min key
+		size = 0
+	case 0x08: // bool
+		size = 1
+	case 0x10: // int32
+		size = 4
+	case 0x01, 0x09, 0x11, 0x12: // double, datetime, timestamp, int64
+		size = 8
+	case 0x07: // object id
+		size = 12
+	case 0x13: // decimal128
+		size = 16
+	case 0x02, 0x0D, 0x0E: // string, javascript, symbol
+		if len(b) < 4 {
+			return 0, errMalformed
+		}
+		size = 4 + int(int32(binary.LittleEndian.Uint32(b)))
+	case 0x03, 0x04, 0x0F: // document, array, code with scope
+		if len(b) < 4 {
+			return 0, errMalformed
+		}
+		size = int(int32(binary.LittleEndian.Uint32(b)))
+	case 0x05: // binary
+		if len(b) < 4 {
+			return 0, errMalformed
+		}
+		size = 5 + int(int32(binary.LittleEndian.Uint32(b)))
+	case 0x0C: // db pointer
+		if len(b) < 4 {
+			return 0, errMalformed
+		}
+		size = 4 + int(int32(binary.LittleEndian.Uint32(b))) + 12
+	case 0x0B: // regex, two cstrings
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return 0, errMalformed
+		}
+		j := bytes.IndexByte(b[i+1:], 0)
+		if j < 0 {
+			return 0, errMalformed
+		}
+		size = i + j + 2
+	default:
+		return 0, fmt.Errorf("unknown bson element type 0x%02x", kind)
+	}
+	if size < 0 || size > len(b) {
+		return 0, errMalformed
+	}
+	return size, nil
+}
@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var feedInterval = flags.Duration("FEED_INTERVAL", time.Second, "how often /feed looks for summaries written since it last did")
+
+//go:embed ui
+var uiFiles embed.FS
+
+// ui serves the dashboard, charting keys from /feed
+func ui() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui", http.FileServer(http.FS(files)))
+}
+
+// feed serves GET /feed?key=...&from=...&resolution=..., server-sent events
+// of the summaries of keys as they're written, a summary event each with
+// the summary as data. Buckets are sent again every time they change.
+// Without from it starts at the latest bucket of the keys. Summaries are
+// polled for every FEED_INTERVAL so standbys, writing none, feed them too.
+func (a *api) feed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		reply(w, nil, &apiError{http.StatusMethodNotAllowed, "GET only"})
+		return
+	}
+	q, err := parseSummaryQuery(r)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	res := r.URL.Query().Get("resolution")
+	if res == "" {
+		res = "raw"
+	}
+	coll, err := resolutionCollection(res)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		reply(w, nil, fmt.Errorf("streaming isn't supported"))
+		return
+	}
+
+	sess := a.sess.Copy()
+	defer sess.Close()
+	c := sess.DB("metrics").C(coll)
+	since := q.from
+	if !q.hasFrom {
+		var latest Summary
+		err := c.Find(bson.M{"key": bson.M{"$in": q.keys}}).Sort("-at").One(&latest)
+		if err != nil && err != mgo.ErrNotFound {
+			reply(w, nil, err)
+			return
+		}
+		since = latest.At
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	t := tenantOf(r)
+	sent := make(map[bucketKey]Summary)
+	tick := time.NewTicker(*feedInterval)
+	defer tick.Stop()
+	for {
+		var summaries []Summary
+		err := c.Find(bson.M{"key": bson.M{"$in": q.keys}, "at": bson.M{"$gte": since}}).Sort("at").Limit(*apiLimit).All(&summaries)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+			flusher.Flush()
+			return
+		}
+		latest := make(map[string]int64, len(q.keys))
+		for _, s := range summaries {
+			latest[s.Key] = s.At
+			since = s.At
+			b := bucketKey{s.Key, s.At}
+			if sent[b] == s {
+				continue
+			}
+			sent[b] = s
+			s.Key = t.strip(s.Key)
+			data, _ := json.Marshal(s)
+			fmt.Fprintf(w, "event: summary\ndata: %s\n\n", data)
+		}
+		// only the latest bucket of each key is still being written, unless
+		// there were more than a query returns to catch up on
+		if len(summaries) < *apiLimit {
+			for _, at := range latest {
+				if at < since {
+					since = at
+				}
+			}
+		}
+		for b := range sent {
+			if b.at < since {
+				delete(sent, b)
+			}
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
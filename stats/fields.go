@@ -0,0 +1,85 @@
+package stats
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/fieldstats"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var fieldStatsNS = flags.String("FIELD_STATS_NS", "", "db.collection tail writes the statistics of each namespace's fields to with its FIELD_STATS_NS, served as /fields by the api, empty for none")
+
+// fieldProfile is a namespace's entry in FIELD_STATS_NS
+type fieldProfile struct {
+	Namespace string             `bson:"ns" json:"ns"`
+	Source    string             `bson:"source,omitempty" json:"source,omitempty"`
+	Documents int64              `bson:"documents" json:"documents"`
+	Overflow  int64              `bson:"overflow,omitempty" json:"overflow,omitempty"`
+	Updated   time.Time          `bson:"updated" json:"updated"`
+	Fields    []fieldstats.Stats `bson:"fields" json:"fields"`
+}
+
+func splitFieldStatsNS() (string, string, error) {
+	parts := strings.SplitN(*fieldStatsNS, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", cli.Invalidf("FIELD_STATS_NS %q must be db.collection", *fieldStatsNS)
+	}
+	return parts[0], parts[1], nil
+}
+
+// fieldStatsPrivileges are needed to serve the field statistics
+func fieldStatsPrivileges() []dial.Privilege {
+	if *fieldStatsNS == "" || *apiAddr == "" {
+		return nil
+	}
+	db, coll, err := splitFieldStatsNS()
+	if err != nil {
+		return nil
+	}
+	return []dial.Privilege{{DB: db, Collection: coll, Actions: []string{"find"}}}
+}
+
+// fields serves GET /fields?ns=...&source=..., the field statistics of
+// the namespaces given, comma separated, or of every one. They're of the
+// whole cluster, not a tenant's keys, so only tenant * sees them.
+func (a *api) fields(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		reply(w, nil, &apiError{http.StatusMethodNotAllowed, "GET only"})
+		return
+	}
+	if *fieldStatsNS == "" {
+		reply(w, nil, &apiError{http.StatusNotFound, "no field statistics, FIELD_STATS_NS is empty"})
+		return
+	}
+	if tenantOf(r).prefix != "" {
+		reply(w, nil, &apiError{http.StatusForbidden, "field statistics are only served to tenant *"})
+		return
+	}
+	db, coll, err := splitFieldStatsNS()
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	params := r.URL.Query()
+	sel := bson.M{}
+	if ns := params.Get("ns"); ns != "" {
+		sel["ns"] = bson.M{"$in": strings.Split(ns, ",")}
+	}
+	if source := params.Get("source"); source != "" {
+		sel["source"] = source
+	}
+
+	sess := a.sess.Copy()
+	defer sess.Close()
+	profiles := []fieldProfile{}
+	if err := sess.DB(db).C(coll).Find(sel).Sort("_id").Limit(*apiLimit).All(&profiles); err != nil {
+		reply(w, nil, err)
+		return
+	}
+	reply(w, map[string][]fieldProfile{"namespaces": profiles}, nil)
+}
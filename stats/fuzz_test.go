@@ -0,0 +1,40 @@
+package stats
+
+import (
+	"testing"
+
+	"github.com/hanjoyo/oplog-abuse/oplogtest"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FuzzDecode decodes data as an oplog entry and extracts datapoints from it
+// as a raw document, the paths of bytes straight off the cursor. Any input
+// may fail to decode, none may panic.
+func FuzzDecode(f *testing.F) {
+	for _, e := range oplogtest.Representative() {
+		data, err := bson.Marshal(e)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	data, err := bson.Marshal(sampleRaw())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	e, err := compileExtractor(*keyPath, *atPath, *atUnit, *valuePath, *coerce)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		oplogTimestamp(data)
+		e.extract(data, nil)
+		var o Oplog
+		if err := bson.Unmarshal(data, &o); err != nil {
+			return
+		}
+		changedID(o.Operation, o.Object, o.QueryObject)
+	})
+}
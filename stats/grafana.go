@@ -0,0 +1,253 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// statNames are the values of a summary, in the order series are returned
+var statNames = []string{"min", "p2", "p9", "p25", "p50", "p75", "p91", "p98", "max"}
+
+// value returns the summary value named stat
+func (s Summary) value(stat string) (float64, bool) {
+	switch stat {
+	case "min":
+		return s.Min, true
+	case "p2":
+		return s.P2, true
+	case "p9":
+		return s.P9, true
+	case "p25":
+		return s.P25, true
+	case "p50":
+		return s.P50, true
+	case "p75":
+		return s.P75, true
+	case "p91":
+		return s.P91, true
+	case "p98":
+		return s.P98, true
+	case "max":
+		return s.Max, true
+	}
+	return 0, false
+}
+
+// splitTarget splits a grafana target, key:stat, into its key and the
+// stats it charts, every one of them for a bare key
+func splitTarget(target string) (string, []string, error) {
+	i := strings.LastIndex(target, ":")
+	if i < 0 {
+		return target, statNames, nil
+	}
+	key, stat := target[:i], target[i+1:]
+	if _, ok := (Summary{}).value(stat); !ok {
+		return "", nil, badRequest("target %q: unknown stat %q, one of %s", target, stat, strings.Join(statNames, ", "))
+	}
+	return key, []string{stat}, nil
+}
+
+// decode reads the json body of a grafana POST into v
+func decode(r *http.Request, v interface{}) error {
+	if r.Method != "POST" {
+		return &apiError{http.StatusMethodNotAllowed, "POST only"}
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest("invalid body: %s", err)
+	}
+	return nil
+}
+
+// grafanaRoot answers the test grafana makes when saving the datasource
+func (a *api) grafanaRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		reply(w, nil, &apiError{http.StatusNotFound, "not found"})
+		return
+	}
+	reply(w, map[string]string{"status": "ok"}, nil)
+}
+
+// grafanaSearch serves POST /search, the targets the query editor offers,
+// every key starting with what's typed and each of its stats
+func (a *api) grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := decode(r, &req); err != nil {
+		reply(w, nil, err)
+		return
+	}
+	sess := a.sess.Copy()
+	defer sess.Close()
+	prefix := req.Target
+	if i := strings.LastIndex(prefix, ":"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	t := tenantOf(r)
+	prefix = t.key(prefix)
+	var sel bson.M
+	if prefix != "" {
+		sel = bson.M{"key": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}}
+	}
+	var keys []string
+	if err := sess.DB("metrics").C("summary").Find(sel).Distinct("key", &keys); err != nil {
+		reply(w, nil, err)
+		return
+	}
+	sort.Strings(keys)
+	targets := []string{}
+	for _, key := range keys {
+		if len(targets) >= *apiLimit {
+			break
+		}
+		key = t.strip(key)
+		targets = append(targets, key)
+		for _, stat := range statNames {
+			targets = append(targets, key+":"+stat)
+		}
+	}
+	reply(w, targets, nil)
+}
+
+// grafanaRequest is the body of POST /query
+type grafanaRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+		Type   string `json:"type"`
+	} `json:"targets"`
+	MaxDataPoints int `json:"maxDataPoints"`
+}
+
+// grafanaSeries is a timeseries target's response, values with unix
+// milliseconds
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// grafanaTable is a table target's response, a row per summary
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// grafanaQuery serves POST /query, the summaries in the range charted as a
+// series per target and stat, or listed as a table, at the finest
+// resolution fitting maxDataPoints. Targets calling a function are
+// expressions, charted as the series they evaluate to.
+func (a *api) grafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var req grafanaRequest
+	if err := decode(r, &req); err != nil {
+		reply(w, nil, err)
+		return
+	}
+	limit := *apiLimit
+	if req.MaxDataPoints > 0 && req.MaxDataPoints < limit {
+		limit = req.MaxDataPoints
+	}
+	sess := a.sess.Copy()
+	defer sess.Close()
+	var rng summaryQuery
+	if !req.Range.From.IsZero() {
+		rng.from, rng.hasFrom = unixMillis(req.Range.From), true
+	}
+	if !req.Range.To.IsZero() {
+		rng.to, rng.hasTo = unixMillis(req.Range.To)+1, true
+	}
+	results := []interface{}{}
+	for _, t := range req.Targets {
+		if strings.Contains(t.Target, "(") {
+			points, _, err := a.evaluate(sess, tenantOf(r), t.Target, rng, "auto", limit)
+			if err != nil {
+				reply(w, nil, err)
+				return
+			}
+			series := grafanaSeries{Target: t.Target, Datapoints: [][2]float64{}}
+			for _, p := range points {
+				series.Datapoints = append(series.Datapoints, [2]float64{p.Value, float64(p.At)})
+			}
+			results = append(results, series)
+			continue
+		}
+		key, names, err := splitTarget(t.Target)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		q := rng
+		q.keys = []string{tenantOf(r).key(key)}
+		res, err := autoResolution(sess.DB("metrics").C("summary"), q, limit)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		coll, _ := resolutionCollection(res)
+		var summaries []Summary
+		// the latest ones when there are more than the limit
+		err = sess.DB("metrics").C(coll).Find(q.selector()).Sort("-at").Limit(limit).All(&summaries)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		sort.Slice(summaries, func(i, j int) bool { return summaries[i].At < summaries[j].At })
+		if t.Type == "table" {
+			for i := range summaries {
+				summaries[i].Key = key
+			}
+			results = append(results, summaryTable(summaries, names))
+			continue
+		}
+		for _, stat := range names {
+			series := grafanaSeries{Target: key + ":" + stat, Datapoints: [][2]float64{}}
+			for _, s := range summaries {
+				v, _ := s.value(stat)
+				series.Datapoints = append(series.Datapoints, [2]float64{v, float64(s.At)})
+			}
+			results = append(results, series)
+		}
+	}
+	reply(w, results, nil)
+}
+
+func summaryTable(summaries []Summary, names []string) grafanaTable {
+	t := grafanaTable{Type: "table", Rows: [][]interface{}{}}
+	t.Columns = append(t.Columns, grafanaColumn{"time", "time"}, grafanaColumn{"key", "string"})
+	for _, stat := range names {
+		t.Columns = append(t.Columns, grafanaColumn{stat, "number"})
+	}
+	for _, s := range summaries {
+		row := []interface{}{s.At, s.Key}
+		for _, stat := range names {
+			v, _ := s.value(stat)
+			row = append(row, v)
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t
+}
+
+// grafanaAnnotations serves POST /annotations, summaries have none
+func (a *api) grafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	if err := decode(r, &req); err != nil {
+		reply(w, nil, err)
+		return
+	}
+	reply(w, []interface{}{}, nil)
+}
@@ -0,0 +1,193 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	apiIngest    = flags.Bool("API_INGEST", false, "accept datapoints on POST /ingest, appending them to metrics.raw")
+	ingestBucket = flags.Duration("INGEST_BUCKET", time.Hour, "width of the raw buckets ingested datapoints are appended to, by their time")
+)
+
+// most an ingest request's body holds
+const ingestMaxBytes = 16 << 20
+
+// ingestPoint is a datapoint as posted, at being unix milliseconds or
+// RFC 3339 and now if left out, value a number or a string of one written
+// as a decimal128 so it's kept exact
+type ingestPoint struct {
+	Key   string          `json:"key"`
+	At    json.RawMessage `json:"at"`
+	Value json.RawMessage `json:"value"`
+}
+
+// value returns p's value as it's written to the raw document
+func (p ingestPoint) value() (interface{}, error) {
+	var s string
+	if json.Unmarshal(p.Value, &s) == nil {
+		d, err := bson.ParseDecimal128(strings.TrimSpace(s))
+		if err != nil {
+			return nil, badRequest("%s: value %q isn't a decimal", p.Key, s)
+		}
+		return d, nil
+	}
+	var f float64
+	if err := json.Unmarshal(p.Value, &f); err != nil {
+		return nil, badRequest("%s: value must be a number or a string of one", p.Key)
+	}
+	return f, nil
+}
+
+// time returns when p was taken
+func (p ingestPoint) time(now time.Time) (time.Time, error) {
+	if len(p.At) == 0 {
+		return now, nil
+	}
+	var s string
+	if json.Unmarshal(p.At, &s) == nil {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, badRequest("%s: at %q isn't RFC 3339", p.Key, s)
+		}
+		return t, nil
+	}
+	var ms int64
+	if err := json.Unmarshal(p.At, &ms); err != nil {
+		return time.Time{}, badRequest("%s: at must be unix milliseconds or RFC 3339", p.Key)
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// readPoints decodes a body of datapoints, objects or arrays of them one
+// after another, as json lines are
+func readPoints(r io.Reader) ([]ingestPoint, error) {
+	var points []ingestPoint
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return points, nil
+		} else if err != nil {
+			return nil, badRequest("invalid body: %s", err)
+		}
+		if s := strings.TrimSpace(string(raw)); strings.HasPrefix(s, "[") {
+			var list []ingestPoint
+			if err := json.Unmarshal(raw, &list); err != nil {
+				return nil, badRequest("invalid datapoints: %s", err)
+			}
+			points = append(points, list...)
+			continue
+		}
+		var p ingestPoint
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, badRequest("invalid datapoint: %s", err)
+		}
+		points = append(points, p)
+	}
+}
+
+// rawLayout is where KEY_PATH, AT_PATH and VALUE_PATH put the fields of a
+// raw document, values being elements of an array
+type rawLayout struct {
+	key, at, values, value string
+}
+
+// layout is the raw layout of the paths e was compiled from, read from the
+// extractor in fields rather than the settings a reload rewrites
+func (e *extractor) layout() (rawLayout, error) {
+	if len(e.value) < 2 {
+		return rawLayout{}, fmt.Errorf("VALUE_PATH %q has no array to append to", strings.Join(e.value, "."))
+	}
+	n := len(e.value) - 1
+	return rawLayout{strings.Join(e.key, "."), strings.Join(e.at, "."), strings.Join(e.value[:n], "."), e.value[n]}, nil
+}
+
+// ingested says what an ingest appended
+type ingested struct {
+	Datapoints int `json:"datapoints"`
+	Buckets    int `json:"buckets"`
+}
+
+// ingest serves POST /ingest, appending datapoints to the raw buckets of
+// their keys and INGEST_BUCKET, which are summarized as any other
+// document written to metrics.raw
+func (a *api) ingest(w http.ResponseWriter, r *http.Request) {
+	if !*apiIngest {
+		reply(w, nil, &apiError{http.StatusNotFound, "ingesting is off, API_INGEST"})
+		return
+	}
+	if r.Method != "POST" {
+		reply(w, nil, &apiError{http.StatusMethodNotAllowed, "POST only"})
+		return
+	}
+	layout, err := fields.Load().(*extractor).layout()
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	points, err := readPoints(http.MaxBytesReader(w, r.Body, ingestMaxBytes))
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+
+	t := tenantOf(r)
+	width := int64(*ingestBucket / time.Millisecond)
+	if width <= 0 {
+		width = 1
+	}
+	now := sysClock.Now()
+	buckets := make(map[bucketKey][]bson.M)
+	var order []bucketKey
+	for _, p := range points {
+		if p.Key == "" || len(p.Value) == 0 || string(p.Value) == "null" {
+			reply(w, nil, badRequest("datapoints need a key and a value"))
+			return
+		}
+		at, err := p.time(now)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		v, err := p.value()
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		b := bucketKey{t.key(p.Key), bucketIn(unixMillis(at), width)}
+		if _, ok := buckets[b]; !ok {
+			order = append(order, b)
+		}
+		buckets[b] = append(buckets[b], bson.M{"at": at, layout.value: v})
+	}
+
+	sess := a.sess.Copy()
+	defer sess.Close()
+	bulk := sess.DB("metrics").C("raw").Bulk()
+	bulk.Unordered()
+	unit := fields.Load().(*extractor).unit
+	for _, b := range order {
+		at := b.at
+		if unit > 1 {
+			at /= unit // in the AT_UNIT it's summarized by
+		}
+		bulk.Upsert(
+			bson.M{layout.key: b.key, layout.at: at},
+			bson.M{"$push": bson.M{layout.values: bson.M{"$each": buckets[b]}}},
+		)
+	}
+	if len(order) > 0 {
+		if _, err := bulk.Run(); err != nil {
+			reply(w, nil, err)
+			return
+		}
+	}
+	reply(w, ingested{len(points), len(order)}, nil)
+}
@@ -0,0 +1,122 @@
+package stats
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	leaseNS  = flags.String("LEASE_NS", "", "db.collection holding the lease when running active/standby, e.g. metrics.leases")
+	leaseTTL = flags.Duration("LEASE_TTL", 6*time.Second, "how long the lease holds without renewal, a standby takes over about this long after the leader dies")
+	leaseID  = flags.String("INSTANCE_ID", "", "name of this instance on the lease, defaults to host:pid")
+)
+
+// leaseName is the _id of the stats processor's lease
+const leaseName = "stats"
+
+// lease lets one of several instances process events. The lease document
+// also holds the checkpoint, the ts of the last batch summarized, which
+// whoever holds the lease next resumes from.
+type lease struct {
+	c      *mgo.Collection
+	holder string
+}
+
+type leaseDoc struct {
+	Holder     string              `bson:"holder"`
+	Expires    time.Time           `bson:"expires"`
+	Checkpoint bson.MongoTimestamp `bson:"ts"`
+}
+
+// newLease returns nil if LEASE_NS isn't set, nothing is coordinated then
+func newLease(sess *mgo.Session) (*lease, error) {
+	if *leaseNS == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(*leaseNS, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("LEASE_NS %q must be db.collection", *leaseNS)
+	}
+	holder := *leaseID
+	if holder == "" {
+		host, _ := os.Hostname()
+		holder = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	return &lease{c: sess.DB(parts[0]).C(parts[1]), holder: holder}, nil
+}
+
+// try takes or renews the lease, reporting whether it's ours
+func (l *lease) try() (bool, error) {
+	now := sysClock.Now()
+	_, err := l.c.Upsert(
+		bson.M{"_id": leaseName, "$or": []bson.M{{"holder": l.holder}, {"expires": bson.M{"$lt": now}}}},
+		bson.M{"$set": bson.M{"holder": l.holder, "expires": now.Add(*leaseTTL)}},
+	)
+	if mgo.IsDup(err) {
+		return false, nil // held by someone else, the upsert collided with it
+	}
+	return err == nil, err
+}
+
+// acquire blocks until the lease is ours, then keeps renewing it. Losing
+// it, to a partition or a clock jump, ends the process so two never
+// process at once. It returns the checkpoint to resume from, if any.
+func (l *lease) acquire() (bson.MongoTimestamp, error) {
+	retry := *leaseTTL / 3
+	waiting := false
+	for {
+		ok, err := l.try()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			break
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "lease held by another instance, standing by\n")
+			waiting = true
+		}
+		sysClock.Sleep(retry)
+	}
+	fmt.Fprintf(os.Stderr, "lease acquired by %s\n", l.holder)
+	go func() {
+		defer cli.Recover()
+		renew := sysClock.NewTicker(retry)
+		defer renew.Stop()
+		for range renew.C() {
+			ok, err := l.try()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "renewing lease: %s\n", err)
+				l.c.Database.Session.Refresh()
+				continue
+			}
+			if !ok {
+				panic(fmt.Errorf("lease lost by %s", l.holder))
+			}
+		}
+	}()
+	var doc leaseDoc
+	err := l.c.FindId(leaseName).One(&doc)
+	return doc.Checkpoint, err
+}
+
+// checkpoint records ts as summarized, failing if the lease was lost
+func (l *lease) checkpoint(ts bson.MongoTimestamp) error {
+	if l == nil {
+		return nil
+	}
+	err := writeChaos.Write(func() error {
+		return l.c.Update(bson.M{"_id": leaseName, "holder": l.holder}, bson.M{"$set": bson.M{"ts": ts}})
+	})
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("lease lost by %s", l.holder)
+	}
+	return err
+}
@@ -1,12 +1,21 @@
-package main
+// Package stats summarizes the metrics written to metrics.raw from the oplog, the oplogctl stats command.
+package stats
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gonum/stat"
-	"github.com/ianschenck/envflag"
+	"github.com/hanjoyo/oplog-abuse/chaos"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/clock"
+	"github.com/hanjoyo/oplog-abuse/dial"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -21,6 +30,8 @@ type Oplog struct {
 	Namespace    string              `bson:"ns"`
 	Object       bson.M              `bson:"o"`
 	QueryObject  bson.M              `bson:"o2"`
+
+	size int64 // bytes held against the memory budget
 }
 
 type Datapoint struct {
@@ -36,23 +47,82 @@ type Raw struct {
 
 // http://en.wikipedia.org/wiki/Seven-number_summary
 type Summary struct {
-	Key string  `bson:"key"`
-	At  int64   `bson:"at"`
-	Min float64 `bson:"min"`
-	Max float64 `bson:"max"`
-	P2  float64 `bson:"p2"`
-	P9  float64 `bson:"p9"`
-	P25 float64 `bson:"p25"`
-	P50 float64 `bson:"p50"`
-	P75 float64 `bson:"p75"`
-	P91 float64 `bson:"p91"`
-	P98 float64 `bson:"p98"`
+	Key string  `bson:"key" json:"key"`
+	At  int64   `bson:"at" json:"at"`
+	Min float64 `bson:"min" json:"min"`
+	Max float64 `bson:"max" json:"max"`
+	P2  float64 `bson:"p2" json:"p2"`
+	P9  float64 `bson:"p9" json:"p9"`
+	P25 float64 `bson:"p25" json:"p25"`
+	P50 float64 `bson:"p50" json:"p50"`
+	P75 float64 `bson:"p75" json:"p75"`
+	P91 float64 `bson:"p91" json:"p91"`
+	P98 float64 `bson:"p98" json:"p98"`
+	N   int     `bson:"n,omitempty" json:"n,omitempty"` // values summarized
+
+	// the stats exact, of buckets with decimal128 values
+	Decimal *DecimalSummary `bson:"decimal,omitempty" json:"decimal,omitempty"`
+}
+
+var flags = cli.NewFlagSet("stats", "extract metrics from oplog entries written to metrics.raw into summaries")
+
+func init() {
+	cli.Register(flags, Main)
 }
 
 var (
-	mongoURL = envflag.String("MONGO_URL", "mongodb://localhost", "mongodb url to connect to")
+	mongoURL      = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url to connect to, mongodb 3.0 to 7.x")
+	resumeRetries = flags.Int("RESUME_RETRIES", 5, "times in a row a failed oplog cursor is resumed before giving up")
+)
+
+// cursorChaos drops oplog cursors, writeChaos fails summary and lease
+// writes
+var (
+	cursorChaos = chaos.New("stats cursor")
+	writeChaos  = chaos.New("stats write")
+)
+
+// sysClock is what batching, the lease and the webhook cache go by, a
+// clock.Sim to drive them without sleeps
+var sysClock clock.Clock = clock.Real
+
+// fields holds the *extractor of key, at and values from raw documents,
+// compiled by main and again when KEY_PATH, AT_PATH, AT_UNIT, VALUE_PATH
+// or COERCE_VALUES are reloaded
+var fields atomic.Value
+
+// inflight is the memory budget shared by the event path, nil until main
+// sets it up
+var inflight *budget
+
+// pools for the per event allocations, at tens of thousands of events a
+// second these otherwise dominate GC time.
+var (
+	oplogPool = sync.Pool{
+		New: func() interface{} { return new(Oplog) },
+	}
+	// *[]float64 scratch space for sorting datapoint values
+	valuesPool = sync.Pool{
+		New: func() interface{} { return new([]float64) },
+	}
+	bufPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
 )
 
+// getOplog returns a zeroed Oplog from the pool
+func getOplog() *Oplog {
+	o := oplogPool.Get().(*Oplog)
+	*o = Oplog{}
+	return o
+}
+
+// putOplog returns o to the pool, releasing its share of the memory budget
+func putOplog(o *Oplog) {
+	inflight.release(o.size)
+	oplogPool.Put(o)
+}
+
 // LatestOplog returns the most recent oplog from the database
 func latestOplog(sess *mgo.Session) (Oplog, error) {
 	var oplog Oplog
@@ -60,69 +130,194 @@ func latestOplog(sess *mgo.Session) (Oplog, error) {
 	return oplog, err
 }
 
-func oplogCh(sess *mgo.Session, query bson.M) (<-chan Oplog, <-chan error) {
-	out := make(chan Oplog)
-	errc := make(chan error, 1)
+// rawQuery matches inserts and updates to metrics.raw newer than ts, on
+// their own or committed in a transaction. On a shard, chunk migrations
+// insert documents that didn't change, these are left out.
+func rawQuery(ts bson.MongoTimestamp) bson.M {
+	return bson.M{
+		"ts": bson.M{
+			"$gt": ts,
+		},
+		"$or": []bson.M{
+			{
+				"ns": "metrics.raw",
+				"op": bson.M{
+					"$in": []string{"i", "u"},
+				},
+			},
+			// a transaction's last applyOps, documents are only read
+			// once committed so earlier partialTxn entries are left out
+			{
+				"op":            "c",
+				"o.applyOps.ns": "metrics.raw",
+				"o.partialTxn":  bson.M{"$ne": true},
+				"o.prepare":     bson.M{"$ne": true},
+			},
+		},
+		"fromMigrate": bson.M{
+			"$ne": true,
+		},
+	}
+}
+
+// oplogCh tails the oplog for query(ts) from since, sending pooled Oplogs,
+// receivers hand them back with putOplog once done. A single goroutine reads
+// the cursor, decoding is spread over DECODE_WORKERS without reordering
+// entries. A failing cursor is resumed from the last entry read, up to
+// RESUME_RETRIES times in a row, picking a member afresh. It stops once
+// done is closed and the entries read are received, nil tails forever.
+func oplogCh(sess *mgo.Session, query func(ts bson.MongoTimestamp) bson.M, since bson.MongoTimestamp, done <-chan struct{}) (<-chan *Oplog, <-chan error) {
+	r := newRing(*ringSize)
+	stop := make(chan struct{})
+	var err error
 	go func() {
-		var err error
-		defer func() {
-			errc <- err
-			close(errc)
-		}()
-		defer close(out)
-		iter := sess.DB("local").
-			C("oplog.rs").
-			Find(query).
-			Sort("$natural").
-			LogReplay().
-			Tail(-1) // tail forever
-		var oplog Oplog
-		for iter.Next(&oplog) {
-			out <- oplog
-		}
-		err = iter.Err()
-		if err != nil {
-			return
+		defer cli.Recover()
+		defer r.close()
+		for failures := 0; ; failures++ {
+			iter := sess.DB("local").
+				C("oplog.rs").
+				Find(query(since)).
+				Sort("$natural").
+				LogReplay().
+				Tail(time.Second)
+			var raw bson.Raw
+			var dropped error
+			for {
+				if !iter.Next(&raw) {
+					if iter.Timeout() && !closed(done) {
+						continue // nothing new yet, tailing on
+					}
+					break
+				}
+				if dropped = cursorChaos.Drop(); dropped != nil {
+					break // read again by the next cursor
+				}
+				failures = 0
+				if ts, ok := oplogTimestamp(raw.Data); ok {
+					since = ts
+				}
+				if !pushBudgeted(r, raw, stop) {
+					iter.Close()
+					return
+				}
+			}
+			err = iter.Close()
+			if err == nil {
+				err = dropped
+			}
+			if err == nil || failures >= *resumeRetries {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "oplog cursor failed: %s, resuming\n", err)
+			time.Sleep(time.Second)
+			sess.Refresh()
 		}
-		err = iter.Close()
 	}()
-	return out, errc
+	// only called once the ring is closed, after err was set
+	return decodeCh(r, *decodeWorkers, stop, func() error { return err })
+}
+
+// pushBudgeted reserves raw's bytes of inflight and pushes it to r, or
+// sheds it over budget. It returns false once stop is closed, the bytes
+// released since the entry never reaches the end of extraction.
+func pushBudgeted(r *ring, raw bson.Raw, stop <-chan struct{}) bool {
+	n := int64(len(raw.Data))
+	if !inflight.acquire(n) {
+		shed(raw.Data) // stale until the bucket's next change
+		return true
+	}
+	if !r.push(raw, stop) {
+		inflight.release(n)
+		return false
+	}
+	return true
+}
+
+// closed reports whether done is, nil never is
+func closed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// oplogTimestamp reads ts from an undecoded oplog entry
+func oplogTimestamp(doc []byte) (bson.MongoTimestamp, bool) {
+	kind, data, err := lookup(doc, []string{"ts"})
+	if err != nil || kind != bsonTimestamp {
+		return 0, false
+	}
+	return bson.MongoTimestamp(binary.LittleEndian.Uint64(data)), true
+}
+
+// change is a raw document modified by the oplog entry at Timestamp
+type change struct {
+	ID        string
+	Timestamp bson.MongoTimestamp
 }
 
 // assumes the oplog will be modifying a default "_id" field that is an
-// ObjectID type. Returns the string representation of oplog ObjectIDs being
+// ObjectID type. Sends the string representation of oplog ObjectIDs being
 // either inserted or updated.
-func oidCh(in <-chan Oplog) <-chan string {
-	out := make(chan string)
+func oidCh(in <-chan *Oplog) <-chan change {
+	out := make(chan change)
 	go func() {
+		defer cli.Recover()
 		defer close(out)
 		for o := range in {
-			if o.Operation == "i" {
-				if id, ok := o.Object["_id"]; ok {
-					if boid, ok := id.(bson.ObjectId); ok {
-						out <- boid.Hex()
+			if o.Operation == "c" {
+				ops, _ := o.Object["applyOps"].([]interface{})
+				for _, v := range ops {
+					if op, ok := v.(bson.M); ok && op["ns"] == "metrics.raw" {
+						object, _ := op["o"].(bson.M)
+						query, _ := op["o2"].(bson.M)
+						if id, ok := changedID(op["op"], object, query); ok {
+							out <- change{id, o.Timestamp}
+						}
 					}
 				}
 			}
-			if o.Operation == "u" {
-				if id, ok := o.QueryObject["_id"]; ok {
-					if boid, ok := id.(bson.ObjectId); ok {
-						out <- boid.Hex()
-					}
-				}
+			if id, ok := changedID(o.Operation, o.Object, o.QueryObject); ok {
+				out <- change{id, o.Timestamp}
 			}
+			putOplog(o)
 		}
 	}()
 	return out
 }
 
-func rawToSummary(raw Raw) (summary Summary) {
-	summary.Key = raw.Key
-	summary.At = raw.At
-	values := make([]float64, len(raw.Values), len(raw.Values))
-	for i, value := range raw.Values {
-		values[i] = value.Value
+// changedID returns the ObjectID an insert or update changes
+func changedID(op interface{}, object, query bson.M) (string, bool) {
+	doc := object
+	switch op {
+	case "i":
+	case "u":
+		doc = query
+	default:
+		return "", false
+	}
+	boid, ok := doc["_id"].(bson.ObjectId)
+	return boid.Hex(), ok
+}
+
+func rawToSummary(raw Raw) Summary {
+	vp := valuesPool.Get().(*[]float64)
+	defer valuesPool.Put(vp)
+	values := (*vp)[:0]
+	for _, value := range raw.Values {
+		values = append(values, value.Value)
 	}
+	*vp = values
+	return summarize(raw.Key, raw.At, values)
+}
+
+// summarize sorts values in place and returns their summary
+func summarize(key string, at int64, values []float64) (summary Summary) {
+	summary.Key = key
+	summary.At = at
+	summary.N = len(values)
 	sort.Float64s(values)
 	summary.Min = stat.Quantile(0, stat.Empirical, values, nil)
 	summary.Max = stat.Quantile(1, stat.Empirical, values, nil)
@@ -136,51 +331,223 @@ func rawToSummary(raw Raw) (summary Summary) {
 	return
 }
 
-func stats(sess *mgo.Session, oid string) error {
-	// get raw object
-	var raw Raw
-	err := sess.DB("metrics").C("raw").Find(bson.M{"_id": bson.ObjectIdHex(oid)}).One(&raw)
+// stats summarizes the raw documents changed and upserts the summaries.
+// Documents changed several times in a batch are only summarized once, the
+// audit log names the latest change.
+func stats(sess *mgo.Session, changes ...change) error {
+	ids := make([]bson.ObjectId, 0, len(changes))
+	latest := make(map[string]bson.MongoTimestamp, len(changes))
+	for _, c := range changes {
+		ts, seen := latest[c.ID]
+		if !seen {
+			ids = append(ids, bson.ObjectIdHex(c.ID))
+		}
+		if !seen || c.Timestamp > ts {
+			latest[c.ID] = c.Timestamp
+		}
+	}
+	// get raw objects
+	iter := sess.DB("metrics").C("raw").Find(bson.M{"_id": bson.M{"$in": ids}}).Iter()
+	bulk := sess.DB("metrics").C("summary").Bulk()
+	bulk.Unordered()
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	buf.Reset()
+	vp := valuesPool.Get().(*[]float64)
+	defer valuesPool.Put(vp)
+	var entries []auditEntry
+	var summaries []Summary
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		e := fields.Load().(*extractor)
+		key, at, values, err := e.extract(raw.Data, (*vp)[:0])
+		*vp = values
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping raw document: %s\n", err)
+			continue
+		}
+		if len(values) == 0 {
+			continue
+		}
+		summary := summarize(key, at, values)
+		exact, err := e.exact(raw.Data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping raw document: %s\n", err)
+			continue
+		}
+		summary.Decimal = summarizeExact(exact)
+		selector := bson.M{"key": summary.Key, "at": summary.At}
+		bulk.Upsert(selector, summary)
+		summaries = append(summaries, summary)
+		fmt.Fprintf(buf, "%s@%d: %d values\n", key, at, len(values))
+		if audit != nil {
+			source := rawID(raw.Data)
+			entries = append(entries, auditEntry{
+				At:       sysClock.Now(),
+				Op:       "upsert",
+				NS:       "metrics.summary",
+				Selector: selector,
+				Source:   source,
+				Trigger:  latest[source],
+			})
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	previous, err := keyCatalog.previous(sess, summaries)
+	if err != nil {
+		return err
+	}
+	err = writeChaos.Write(func() error {
+		_, err := bulk.Run()
+		return err
+	})
+	os.Stdout.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	freshen(changes)
+	if err := keyCatalog.record(summaries, previous); err != nil {
+		return err
+	}
+	if err := webhooks.fire(summaries); err != nil {
+		return err
+	}
+	written := make([]bucketKey, len(summaries))
+	for i, s := range summaries {
+		written[i] = bucketKey{s.Key, s.At}
+	}
+	rolled, err := rollUp(sess, written)
+	if err != nil {
+		return err
+	}
+	return audit.record(append(entries, rolled...))
+}
+
+// rawID returns the hex _id of an undecoded raw document
+func rawID(doc []byte) string {
+	kind, data, err := lookup(doc, []string{"_id"})
+	if err != nil || kind != bsonObjectID {
+		return ""
+	}
+	return bson.ObjectId(data).Hex()
+}
+
+// compileFields compiles KEY_PATH, AT_PATH, AT_UNIT, VALUE_PATH and COERCE_VALUES
+// into fields
+func compileFields() error {
+	e, err := compileExtractor(*keyPath, *atPath, *atUnit, *valuePath, *coerce)
 	if err != nil {
 		return err
 	}
-	summary := rawToSummary(raw)
-	selector := bson.M{"key": summary.Key, "at": summary.At}
-	// update := bson.M{"min": summary.Min, "max": summary.Max, "p95": summary.P95}
-	_, err = sess.DB("metrics").C("summary").Upsert(selector, summary)
-	fmt.Printf("%+v\n", raw)
-	return err
+	fields.Store(e)
+	return nil
 }
 
-func main() {
-	envflag.Parse()
-	sess, err := mgo.Dial(*mongoURL)
+// Main runs oplogctl stats, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+
+	if err := loadZone(); err != nil {
+		panic(err)
+	}
+	if err := compileFields(); err != nil {
+		panic(err)
+	}
+	flags.Reload([]string{"KEY_PATH", "AT_PATH", "AT_UNIT", "VALUE_PATH", "COERCE_VALUES"}, compileFields)
+	var err error
+	inflight, err = newBudget(*memoryBudget, *shedPolicy)
+	if err != nil {
+		panic(err)
+	}
+	rollups, err = parseRollups(*rollupWidths)
 	if err != nil {
 		panic(err)
 	}
+	serveMetrics()
 
-	// need last oplog timestamp to make tailing query
-	lo, err := latestOplog(sess)
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	audit, err = newAuditLog(sess)
+	if err != nil {
+		panic(err)
+	}
+	keyCatalog, err = newCatalog(sess)
+	if err != nil {
+		panic(err)
+	}
+	webhooks, err = newHooks(sess)
 	if err != nil {
 		panic(err)
 	}
 
-	query := bson.M{
-		"ts": bson.M{
-			"$gt": lo.Timestamp,
-		},
-		"ns": "metrics.raw",
-		"op": bson.M{
-			"$in": []string{"i", "u"},
-		},
+	needed := []dial.Privilege{
+		{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+		{DB: "metrics", Collection: "raw", Actions: []string{"find"}},
+		{DB: "metrics", Collection: "summary", Actions: []string{"insert", "update"}},
+	}
+	needed = append(needed, rollupPrivileges()...)
+	needed = append(needed, catalogPrivileges()...)
+	needed = append(needed, webhookPrivileges()...)
+	if audit != nil && audit.coll != nil {
+		needed = append(needed, dial.Privilege{DB: audit.coll.Database.Name, Collection: audit.coll.Name, Actions: []string{"insert"}})
 	}
-	och, errCh := oplogCh(sess, query)
-	oidch := oidCh(och)
-	for oid := range oidch {
-		fmt.Printf("got oid: %s\n", oid)
-		err = stats(sess, oid)
+	lease, err := newLease(sess)
+	if err != nil {
+		panic(err)
+	}
+	if lease != nil {
+		needed = append(needed, dial.Privilege{DB: lease.c.Database.Name, Collection: lease.c.Name, Actions: []string{"find", "insert", "update"}})
+	}
+	if *apiAddr != "" {
+		needed = append(needed, dial.Privilege{DB: "metrics", Collection: "summary", Actions: []string{"find"}})
+	}
+	if *apiAddr != "" && *apiIngest {
+		needed = append(needed, dial.Privilege{DB: "metrics", Collection: "raw", Actions: []string{"insert", "update"}})
+	}
+	err = dial.CheckPrivileges(sess, needed...)
+	if err != nil {
+		panic(err)
+	}
+	// standbys serve it too
+	if err := serveAPI(sess); err != nil {
+		panic(err)
+	}
+
+	// a standby waits here, then picks up where the last leader left off
+	var since bson.MongoTimestamp
+	if lease != nil {
+		since, err = lease.acquire()
+		if err != nil {
+			panic(err)
+		}
+	}
+	if since == 0 {
+		// need last oplog timestamp to make tailing query
+		lo, err := latestOplog(sess)
 		if err != nil {
 			panic(err)
 		}
+		since = lo.Timestamp
+	}
+
+	meter := &lagMeter{}
+	go meter.poll(sess.Copy(), time.Second)
+
+	och, errCh := oplogCh(sess, rawQuery, since, nil)
+	batches := batchCh(oidCh(och), meter)
+	for batch := range batches {
+		fmt.Printf("got %d oids\n", len(batch))
+		err = stats(sess, batch...)
+		if err != nil {
+			panic(err)
+		}
+		if err := lease.checkpoint(batch[len(batch)-1].Timestamp); err != nil {
+			panic(err)
+		}
 	}
 	err = <-errCh
 	if err != nil {
@@ -0,0 +1,37 @@
+package stats
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+)
+
+var (
+	metricsAddr = flags.String("METRICS_ADDR", "", "address to serve expvar metrics on at /debug/vars, e.g. \":8080\"")
+)
+
+var (
+	inflightBytes = expvar.NewInt("inflight_bytes")
+	shedEvents    = expvar.NewInt("shed_events")
+	// buckets whose summaries are behind for an entry shed, and the shed
+	// entries of transactions, whose buckets aren't known
+	staleBucketCount = expvar.NewInt("stale_buckets")
+	shedUnknown      = expvar.NewInt("shed_unknown_buckets")
+	// datapoint values COERCE_VALUES turned into doubles, and those it didn't take
+	coercedValues  = expvar.NewInt("coerced_values")
+	rejectedValues = expvar.NewInt("rejected_values")
+)
+
+// serveMetrics serves expvar in the background if METRICS_ADDR is set
+func serveMetrics() {
+	if *metricsAddr == "" {
+		return
+	}
+	go func() {
+		defer cli.Recover()
+		if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
+			panic(err)
+		}
+	}()
+}
@@ -0,0 +1,207 @@
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var rollupWidths = flags.String("ROLLUPS", "1m,5m,1h", "comma separated bucket widths summaries are rolled up into, each a multiple of the one before, or 1d, 1w and 1mo of the TIMEZONE calendar, kept in metrics.summary_<width>, empty for none")
+
+// rollup is a coarser resolution of the summaries, in buckets of width
+// milliseconds, or of the calendar, days, weeks or months, width then their
+// nominal length
+type rollup struct {
+	name     string
+	width    int64
+	calendar bool
+}
+
+// collection is where the rollup's summaries are kept
+func (r rollup) collection() string {
+	return "summary_" + r.name
+}
+
+// rollups are the resolutions from ROLLUPS, finest first, set by main
+var rollups []rollup
+
+func parseRollups(s string) ([]rollup, error) {
+	var list []rollup
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		r := rollup{name: name, width: calendars[name], calendar: calendars[name] != 0}
+		if !r.calendar {
+			d, err := time.ParseDuration(name)
+			if err != nil || d < time.Millisecond {
+				return nil, cli.Invalidf("ROLLUPS: invalid width %q", name)
+			}
+			r.width = int64(d / time.Millisecond)
+		}
+		if n := len(list); n > 0 {
+			if err := nests(list[n-1], r); err != nil {
+				return nil, cli.Invalidf("ROLLUPS: %s", err)
+			}
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// rollupPrivileges are needed to roll up, each level being read from the
+// one before
+func rollupPrivileges() []dial.Privilege {
+	list, _ := parseRollups(*rollupWidths)
+	if len(list) == 0 {
+		return nil
+	}
+	needed := []dial.Privilege{{DB: "metrics", Collection: "summary", Actions: []string{"find"}}}
+	for _, r := range list {
+		needed = append(needed, dial.Privilege{DB: "metrics", Collection: r.collection(), Actions: []string{"find", "insert", "update"}})
+	}
+	return needed
+}
+
+// bucket returns the start of the bucket at falls in
+func (r rollup) bucket(at int64) int64 {
+	if r.calendar {
+		return unixMillis(midnight(r.name, at))
+	}
+	return bucketIn(at, r.width)
+}
+
+// end returns the end of the bucket starting at start
+func (r rollup) end(start int64) int64 {
+	if !r.calendar {
+		return start + r.width
+	}
+	t := midnight(r.name, start)
+	switch r.name {
+	case "1w":
+		t = t.AddDate(0, 0, 7)
+	case "1mo":
+		t = t.AddDate(0, 1, 0)
+	default:
+		t = t.AddDate(0, 0, 1)
+	}
+	return unixMillis(t)
+}
+
+// bucketOf returns the start of the bucket of width at falls in
+func bucketOf(at, width int64) int64 {
+	m := at % width
+	if m < 0 {
+		m += width
+	}
+	return at - m
+}
+
+// bucketKey is a summary's key and bucket
+type bucketKey struct {
+	key string
+	at  int64
+}
+
+// merge combines the summaries of a bucket, min and max exactly and the
+// percentiles as the average weighted by how many values each summarizes
+func merge(key string, at int64, summaries []Summary) Summary {
+	merged := Summary{Key: key, At: at, Min: summaries[0].Min, Max: summaries[0].Max}
+	var weights float64
+	for _, s := range summaries {
+		if s.Min < merged.Min {
+			merged.Min = s.Min
+		}
+		if s.Max > merged.Max {
+			merged.Max = s.Max
+		}
+		n := float64(s.N)
+		if n == 0 {
+			n = 1 // summarized before counts were kept
+		}
+		weights += n
+		merged.N += s.N
+		merged.P2 += s.P2 * n
+		merged.P9 += s.P9 * n
+		merged.P25 += s.P25 * n
+		merged.P50 += s.P50 * n
+		merged.P75 += s.P75 * n
+		merged.P91 += s.P91 * n
+		merged.P98 += s.P98 * n
+	}
+	merged.P2 /= weights
+	merged.P9 /= weights
+	merged.P25 /= weights
+	merged.P50 /= weights
+	merged.P75 /= weights
+	merged.P91 /= weights
+	merged.P98 /= weights
+	return merged
+}
+
+// most buckets read back in one query
+const bucketsPerQuery = 500
+
+// rollUp summarizes the buckets of every rollup that the summaries written
+// fall in again, each level from the one before, returning the upserts made
+// for the audit log
+func rollUp(sess *mgo.Session, written []bucketKey) ([]auditEntry, error) {
+	var entries []auditEntry
+	from := sess.DB("metrics").C("summary")
+	for _, r := range rollups {
+		touched := make(map[bucketKey]bool, len(written))
+		var buckets []bucketKey
+		for _, w := range written {
+			b := bucketKey{w.key, r.bucket(w.at)}
+			if !touched[b] {
+				touched[b] = true
+				buckets = append(buckets, b)
+			}
+		}
+		to := sess.DB("metrics").C(r.collection())
+		bulk := to.Bulk()
+		bulk.Unordered()
+		for start := 0; start < len(buckets); start += bucketsPerQuery {
+			end := start + bucketsPerQuery
+			if end > len(buckets) {
+				end = len(buckets)
+			}
+			or := make([]bson.M, 0, end-start)
+			for _, b := range buckets[start:end] {
+				or = append(or, bson.M{"key": b.key, "at": bson.M{"$gte": b.at, "$lt": r.end(b.at)}})
+			}
+			var finer []Summary
+			if err := from.Find(bson.M{"$or": or}).All(&finer); err != nil {
+				return nil, fmt.Errorf("rolling up %s: %s", r.name, err)
+			}
+			grouped := make(map[bucketKey][]Summary, end-start)
+			for _, s := range finer {
+				b := bucketKey{s.Key, r.bucket(s.At)}
+				grouped[b] = append(grouped[b], s)
+			}
+			for _, b := range buckets[start:end] {
+				if len(grouped[b]) == 0 {
+					continue
+				}
+				selector := bson.M{"key": b.key, "at": b.at}
+				bulk.Upsert(selector, merge(b.key, b.at, grouped[b]))
+				if audit != nil {
+					entries = append(entries, auditEntry{At: sysClock.Now(), Op: "upsert", NS: "metrics." + r.collection(), Selector: selector})
+				}
+			}
+		}
+		if len(buckets) > 0 {
+			if _, err := bulk.Run(); err != nil {
+				return nil, fmt.Errorf("rolling up %s: %s", r.name, err)
+			}
+		}
+		from, written = to, buckets
+	}
+	return entries, nil
+}
@@ -0,0 +1,165 @@
+package stats
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// sample is the values of a raw bucket as quick generates them: any
+// length from 1, ties, negatives, and magnitudes far apart
+type sample []float64
+
+func (sample) Generate(r *rand.Rand, size int) reflect.Value {
+	n := 1 + r.Intn(size*10+1)
+	s := make(sample, n)
+	kind := r.Intn(4)
+	for i := range s {
+		switch kind {
+		case 0: // ties
+			s[i] = float64(r.Intn(5))
+		case 1:
+			s[i] = r.NormFloat64() * 100
+		case 2:
+			s[i] = math.Ldexp(r.Float64(), r.Intn(200)-100)
+		default:
+			s[i] = (r.Float64() - 0.5) * math.MaxFloat32
+		}
+	}
+	return reflect.ValueOf(s)
+}
+
+// summaryOf summarizes a copy of s, summarize sorting what it's given
+func summaryOf(s []float64) Summary {
+	return summarize("prop", 0, append([]float64(nil), s...))
+}
+
+// ordered returns the stats of sm from min to max
+func ordered(sm Summary) []float64 {
+	return []float64{sm.Min, sm.P2, sm.P9, sm.P25, sm.P50, sm.P75, sm.P91, sm.P98, sm.Max}
+}
+
+// nearestRank is the reference the quantiles are checked against: the
+// smallest value at least a fraction p of the values are at or below
+func nearestRank(s []float64, p float64) float64 {
+	sorted := append([]float64(nil), s...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// summaryProperties are what summarize and rawToSummary must hold to,
+// whatever they're rewritten as
+var summaryProperties = []struct {
+	name  string
+	check interface{}
+}{
+	{"ordered", func(s sample) bool {
+		stats := ordered(summaryOf(s))
+		return sort.Float64sAreSorted(stats)
+	}},
+	{"bounds", func(s sample) bool {
+		min, max := s[0], s[0]
+		for _, v := range s {
+			min, max = math.Min(min, v), math.Max(max, v)
+		}
+		sm := summaryOf(s)
+		return sm.Min == min && sm.Max == max && sm.N == len(s)
+	}},
+	{"permutation", func(s sample, seed int64) bool {
+		shuffled := append([]float64(nil), s...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		return summaryOf(s) == summaryOf(shuffled)
+	}},
+	{"monotone", func(s sample, i uint, by float64) bool {
+		// raising a value lowers no stat
+		raised := append([]float64(nil), s...)
+		raised[i%uint(len(s))] += math.Abs(by)
+		before, after := ordered(summaryOf(s)), ordered(summaryOf(raised))
+		for k := range before {
+			if after[k] < before[k] {
+				return false
+			}
+		}
+		return true
+	}},
+	{"scaling", func(s sample, k uint8) bool {
+		// quantiles pick values, order kept picks the same ones
+		f := float64(k) + 1
+		scaled := make([]float64, len(s))
+		for i, v := range s {
+			scaled[i] = v * f
+		}
+		before, after := ordered(summaryOf(s)), ordered(summaryOf(scaled))
+		for i := range before {
+			if after[i] != before[i]*f {
+				return false
+			}
+		}
+		return true
+	}},
+	{"reference", func(s sample) bool {
+		ps := []float64{0, 0.02, 0.09, 0.25, 0.50, 0.75, 0.91, 0.98, 1}
+		stats := ordered(summaryOf(s))
+		for i, p := range ps {
+			if stats[i] != nearestRank(s, p) {
+				return false
+			}
+		}
+		return true
+	}},
+	{"interpolated", func(s sample, a, b uint8) bool {
+		// percentile reads between the stats kept, monotone in p
+		sm := summaryOf(s)
+		lo, hi := math.Min(float64(a), float64(b))/2.55, math.Max(float64(a), float64(b))/2.55
+		pl, ph := percentile(sm, lo), percentile(sm, hi)
+		return sm.Min <= pl && pl <= ph && ph <= sm.Max
+	}},
+	{"rawToSummary", func(s sample, other sample) bool {
+		// pooled buffers leave nothing behind between raw documents
+		raw := func(s sample) Raw {
+			r := Raw{Key: "prop", Values: make([]Datapoint, len(s))}
+			for i, v := range s {
+				r.Values[i].Value = v
+			}
+			return r
+		}
+		first := rawToSummary(raw(s))
+		rawToSummary(raw(other))
+		return first == summaryOf(s) && rawToSummary(raw(s)) == first
+	}},
+}
+
+// TestSummaryProperties checks the summary properties on -quickchecks
+// random cases each. The seed is logged, PROPERTIES_SEED runs the same
+// cases again.
+func TestSummaryProperties(t *testing.T) {
+	seed := time.Now().UnixNano()
+	if env := os.Getenv("PROPERTIES_SEED"); env != "" {
+		var err error
+		if seed, err = strconv.ParseInt(env, 10, 64); err != nil {
+			t.Fatalf("PROPERTIES_SEED: %s", err)
+		}
+	}
+	t.Logf("PROPERTIES_SEED=%d", seed)
+	for _, p := range summaryProperties {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			config := &quick.Config{Rand: rand.New(rand.NewSource(seed))}
+			if err := quick.Check(p.check, config); err != nil {
+				t.Errorf("PROPERTIES_SEED=%d: %s", seed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package stats
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+)
+
+var apiTokens = flags.String("API_TOKENS", "", "comma separated tenant:token pairs the api requires one of as a bearer token, a tenant seeing only keys starting with its name and a dot, as if they didn't, its name having no dot; tenant * sees every key. Empty serves every key to anyone.")
+
+// tenant is whose request the api is serving, the prefix of the keys it
+// sees. Keys are given and returned without it.
+type tenant struct {
+	prefix string
+}
+
+// key returns the stored key of k
+func (t tenant) key(k string) string {
+	return t.prefix + k
+}
+
+// strip returns k as the tenant knows it
+func (t tenant) strip(k string) string {
+	return strings.TrimPrefix(k, t.prefix)
+}
+
+// tokens maps API_TOKENS to their tenants, nil when it's empty
+type tokens map[string]tenant
+
+func parseTokens(s string) (tokens, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t := make(tokens)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, cli.Invalidf("API_TOKENS must be tenant:token pairs")
+		}
+		if _, ok := t[parts[1]]; ok {
+			return nil, cli.Invalidf("API_TOKENS: a token is given twice")
+		}
+		// a dot would put one tenant's keys inside another's, team.a's in team's
+		if parts[0] != "*" && strings.ContainsAny(parts[0], ".*") {
+			return nil, cli.Invalidf("API_TOKENS: tenant %q can't have a dot, or a * but alone", parts[0])
+		}
+		prefix := parts[0] + "."
+		if parts[0] == "*" {
+			prefix = ""
+		}
+		t[parts[1]] = tenant{prefix}
+	}
+	return t, nil
+}
+
+// lookup returns the tenant of a token, comparing it with every one so
+// how long it takes tells nothing
+func (t tokens) lookup(token string) (tenant, bool) {
+	var found tenant
+	ok := false
+	for known, tn := range t {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			found, ok = tn, true
+		}
+	}
+	return found, ok
+}
+
+type tenantKey struct{}
+
+// tenantOf returns the tenant a request is served for
+func tenantOf(r *http.Request) tenant {
+	t, _ := r.Context().Value(tenantKey{}).(tenant)
+	return t
+}
+
+// authorize serves h the requests bearing a token, in the Authorization
+// header or, for EventSource which can't set one, as access_token
+func (t tokens) authorize(h http.HandlerFunc) http.HandlerFunc {
+	if t == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("access_token")
+		}
+		tn, ok := t.lookup(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oplogctl stats"`)
+			reply(w, nil, &apiError{http.StatusUnauthorized, "a valid bearer token is needed"})
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tn)))
+	}
+}
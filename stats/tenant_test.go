@@ -0,0 +1,272 @@
+package stats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseTokens(t *testing.T) {
+	for _, c := range []struct {
+		s       string
+		tenants map[string]string // prefix by token
+		ok      bool
+	}{
+		{"", nil, true},
+		{"team-a:s3cret, team-b:0ther,*:adm1n", map[string]string{"s3cret": "team-a.", "0ther": "team-b.", "adm1n": ""}, true},
+		{"team:a:b", map[string]string{"a:b": "team."}, true},
+		{"team.a:s3cret", nil, false},
+		{"team.:s3cret", nil, false},
+		{"team*:s3cret", nil, false},
+		{"*team:s3cret", nil, false},
+		{"**:s3cret", nil, false},
+		{"team-a:s3cret,team-b:s3cret", nil, false},
+		{"team-a", nil, false},
+		{":s3cret", nil, false},
+		{"team-a:", nil, false},
+	} {
+		tokens, err := parseTokens(c.s)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: %v", c.s, err)
+			continue
+		}
+		if len(tokens) != len(c.tenants) {
+			t.Errorf("%q: tokens %v, want %v", c.s, tokens, c.tenants)
+		}
+		for token, prefix := range c.tenants {
+			if tn, ok := tokens.lookup(token); !ok || tn.prefix != prefix {
+				t.Errorf("%q: %s is of %q, want %q", c.s, token, tn.prefix, prefix)
+			}
+		}
+	}
+}
+
+// every route but the dashboard's page wants a token
+func TestAPIUnauthorized(t *testing.T) {
+	tokens, err := parseTokens("isoa:a-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(apiMux(nil, tokens))
+	defer srv.Close()
+	for _, path := range []string{"/summaries?key=cpu", "/summaries/export?key=cpu", "/keys", "/fields", "/eval?expr=cpu",
+		"/feed?key=cpu", "/ingest", "/webhooks", "/", "/search", "/query", "/annotations"} {
+		for _, token := range []string{"", "b-token", "a-token2"} {
+			if code := tenantRequest(t, srv.URL, token, "GET", path, "", nil); code != http.StatusUnauthorized {
+				t.Errorf("GET %s with %q: %d, want %d", path, token, code, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+// tenantRequest asks path of the api at url with token, decoding the json
+// reply into v unless it's nil or a string the reply's copied to, and
+// returns the status
+func tenantRequest(t *testing.T, url, token, method, path, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := v.(*string); ok {
+		*s = string(data)
+	} else if v != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("%s %s: %s: %s", method, path, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+// TestTenantIsolation has two tenants, isoa and isob, each with a key cpu,
+// ask every route of the api for the other's: none of it is served. It
+// needs mongodb at MONGO_URL, and is skipped without one.
+func TestTenantIsolation(t *testing.T) {
+	flags.Parse(nil)
+	if err := compileFields(); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := dial.DialWithTimeout(*mongoURL, 2*time.Second)
+	if err != nil {
+		t.Skipf("no mongodb at MONGO_URL: %s", err)
+	}
+	defer sess.Close()
+
+	keys := []string{"isoa.cpu", "isob.cpu", "cpu"}
+	test := sess.DB("oplogctl_tenant_test")
+	cleanup := func() {
+		selector := bson.M{"key": bson.M{"$in": keys}}
+		sess.DB("metrics").C("summary").RemoveAll(selector)
+		sess.DB("metrics").C("raw").RemoveAll(selector)
+		test.DropDatabase()
+	}
+	cleanup()
+	defer cleanup()
+	for i, key := range keys[:2] {
+		s := Summary{Key: key, At: 1000, Min: float64(i + 1), Max: float64(i + 1), P50: float64(i + 1)}
+		if err := sess.DB("metrics").C("summary").Insert(s); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.C("keys").Insert(keyInfo{Key: key, First: 1000, Last: 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hookIDs := map[string]bson.ObjectId{"isoa.": bson.NewObjectId(), "isob.": bson.NewObjectId()}
+	for tenant, id := range hookIDs {
+		hook := webhook{ID: id, Tenant: tenant, URL: "https://example.com/" + tenant, Pattern: "cpu", Created: time.Now()}
+		if err := test.C("webhooks").Insert(hook); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldCatalog, oldHooks, oldIngest, oldFields := keyCatalog, webhooks, *apiIngest, *fieldStatsNS
+	defer func() { keyCatalog, webhooks, *apiIngest, *fieldStatsNS = oldCatalog, oldHooks, oldIngest, oldFields }()
+	keyCatalog = &catalog{c: test.C("keys")}
+	webhooks = &hooks{c: test.C("webhooks")}
+	*apiIngest, *fieldStatsNS = true, "oplogctl_tenant_test.fields"
+	tokens, err := parseTokens("isoa:a-token,isob:b-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(apiMux(sess, tokens))
+	defer srv.Close()
+
+	var page summaryPage
+	if code := tenantRequest(t, srv.URL, "b-token", "GET", "/summaries?key=cpu&resolution=raw", "", &page); code != 200 || len(page.Summaries) != 1 || page.Summaries[0].Min != 2 {
+		t.Fatalf("isob's cpu: %d %+v, want its min of 2", code, page.Summaries)
+	}
+
+	// each route as isoa sees only isoa.cpu, as cpu with a min of 1
+	for _, path := range []string{"/summaries?key=cpu&resolution=raw", "/summaries?key=cpu,isob.cpu,../isob.cpu&resolution=raw"} {
+		var page summaryPage
+		if code := tenantRequest(t, srv.URL, "a-token", "GET", path, "", &page); code != 200 {
+			t.Fatalf("GET %s: %d", path, code)
+		}
+		if len(page.Summaries) != 1 || page.Summaries[0].Key != "cpu" || page.Summaries[0].Min != 1 {
+			t.Errorf("GET %s: %+v, want isoa's cpu alone", path, page.Summaries)
+		}
+	}
+
+	var csv string
+	if code := tenantRequest(t, srv.URL, "a-token", "GET", "/summaries/export?key=cpu,isob.cpu", "", &csv); code != 200 {
+		t.Fatalf("export: %d", code)
+	}
+	if lines := strings.Split(strings.TrimSpace(csv), "\n"); len(lines) != 2 || strings.Contains(csv, "isob") || !strings.HasPrefix(lines[1], "cpu,") {
+		t.Errorf("export:\n%s\nwant a header and isoa's cpu", csv)
+	}
+
+	for _, path := range []string{"/keys", "/keys?prefix=isob", "/keys?prefix=c"} {
+		var page keyPage
+		if code := tenantRequest(t, srv.URL, "a-token", "GET", path, "", &page); code != 200 {
+			t.Fatalf("GET %s: %d", path, code)
+		}
+		want := 1
+		if strings.Contains(path, "isob") {
+			want = 0
+		}
+		if len(page.Keys) != want || want == 1 && page.Keys[0].Key != "cpu" {
+			t.Errorf("GET %s: %+v, want %d of isoa's keys", path, page.Keys, want)
+		}
+	}
+
+	if code := tenantRequest(t, srv.URL, "a-token", "GET", "/fields", "", nil); code != http.StatusForbidden {
+		t.Errorf("GET /fields: %d, want %d for a tenant", code, http.StatusForbidden)
+	}
+
+	var result evalResult
+	if code := tenantRequest(t, srv.URL, "a-token", "GET", "/eval?expr=min(cpu)&resolution=raw", "", &result); code != 200 {
+		t.Fatalf("eval: %d", code)
+	}
+	if len(result.Series) != 1 || result.Series[0].Value != 1 {
+		t.Errorf("eval min(cpu): %+v, want isoa's 1", result.Series)
+	}
+	if code := tenantRequest(t, srv.URL, "a-token", "GET", "/eval?expr=min(isob.cpu)&resolution=raw", "", &result); code == 200 && len(result.Series) != 0 {
+		t.Errorf("eval min(isob.cpu): %+v, want nothing of isob's", result.Series)
+	}
+
+	var targets []string
+	if code := tenantRequest(t, srv.URL, "a-token", "POST", "/search", `{"target": ""}`, &targets); code != 200 {
+		t.Fatalf("search: %d", code)
+	}
+	for _, target := range targets {
+		if !strings.HasPrefix(target, "cpu") {
+			t.Errorf("search offers %s, want only isoa's cpu", target)
+		}
+	}
+	var series []grafanaSeries
+	query := `{"targets": [{"target": "cpu:min"}, {"target": "isob.cpu:min"}, {"target": "max(cpu)"}]}`
+	if code := tenantRequest(t, srv.URL, "a-token", "POST", "/query", query, &series); code != 200 {
+		t.Fatalf("query: %d", code)
+	}
+	if len(series) != 3 || len(series[0].Datapoints) != 1 || series[0].Datapoints[0][0] != 1 || len(series[1].Datapoints) != 0 || len(series[2].Datapoints) != 1 || series[2].Datapoints[0][0] != 1 {
+		t.Errorf("query: %+v, want isoa's cpu, nothing and isoa's cpu", series)
+	}
+
+	var listed []webhook
+	if code := tenantRequest(t, srv.URL, "a-token", "GET", "/webhooks", "", &listed); code != 200 {
+		t.Fatalf("webhooks: %d", code)
+	}
+	if len(listed) != 1 || listed[0].ID != hookIDs["isoa."] {
+		t.Errorf("webhooks: %+v, want isoa's alone", listed)
+	}
+	if code := tenantRequest(t, srv.URL, "a-token", "DELETE", "/webhooks?id="+hookIDs["isob."].Hex(), "", nil); code != http.StatusNotFound {
+		t.Errorf("deleting isob's webhook as isoa: %d, want %d", code, http.StatusNotFound)
+	}
+	if n, err := test.C("webhooks").FindId(hookIDs["isob."]).Count(); err != nil || n != 1 {
+		t.Errorf("isob's webhook is gone: %d, %v", n, err)
+	}
+
+	if code := tenantRequest(t, srv.URL, "a-token", "POST", "/ingest", `{"key": "cpu", "at": 5000, "value": 3}`, nil); code != 200 {
+		t.Fatalf("ingest: %d", code)
+	}
+	var raw []bson.M
+	if err := sess.DB("metrics").C("raw").Find(bson.M{"key": bson.M{"$in": keys}}).All(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 1 || raw[0]["key"] != "isoa.cpu" {
+		t.Errorf("ingested %v, want isoa.cpu's bucket alone", raw)
+	}
+
+	// the feed's first summary is isoa's
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/feed?key=cpu,isob.cpu&from=0&access_token=a-token", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	sent := false
+	for !sent && lines.Scan() {
+		if data := strings.TrimPrefix(lines.Text(), "data: "); data != lines.Text() {
+			var s Summary
+			if err := json.Unmarshal([]byte(data), &s); err != nil || s.Key != "cpu" || s.Min != 1 {
+				t.Errorf("feed sent %s, want isoa's cpu", data)
+			}
+			sent = true
+		}
+	}
+	if !sent {
+		t.Error("feed sent no summary")
+	}
+}
@@ -0,0 +1,145 @@
+package stats
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+)
+
+var (
+	atUnit   = flags.String("AT_UNIT", "auto", "unit of numeric bucket times: s, ms, or auto for seconds below 1e11 and milliseconds from it")
+	timezone = flags.String("TIMEZONE", "UTC", "IANA zone bucket times without one are read in, ROLLUPS and INGEST_BUCKET align to and 1d, 1w and 1mo rollups start at the midnights of")
+)
+
+// bsonDatetime is the element type of bucket times besides numbers,
+// timestamps and strings
+const bsonDatetime = 0x09
+
+// atUnits are the milliseconds per unit of AT_UNIT, 0 for auto
+var atUnits = map[string]int64{"auto": 0, "s": 1000, "ms": 1}
+
+// secondsBelow is the magnitude under which auto takes a time for
+// seconds, 1e11 seconds being past the year 5000 and milliseconds 1973
+const secondsBelow = 1e11
+
+// zone is TIMEZONE, loaded by main
+var zone = time.UTC
+
+func loadZone() error {
+	z, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return cli.Invalidf("TIMEZONE: %s", err)
+	}
+	zone = z
+	return nil
+}
+
+// layouts bucket times are read from strings in, the ones without an
+// offset in TIMEZONE
+var layouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999", "2006-01-02"}
+
+// atMillis returns a bucket time as unix milliseconds in UTC: numbers in
+// AT_UNIT, datetimes, timestamps and strings of either
+func (e *extractor) atMillis(kind byte, data []byte) (int64, bool) {
+	switch kind {
+	case bsonDatetime:
+		return int64(binary.LittleEndian.Uint64(data)), true
+	case bsonTimestamp:
+		return int64(binary.LittleEndian.Uint64(data)>>32) * 1000, true
+	case bsonString:
+		if len(data) < 5 {
+			return 0, false
+		}
+		return e.parseAt(strings.TrimSpace(string(data[4 : len(data)-1])))
+	}
+	f, ok := number(kind, data)
+	if !ok {
+		return 0, false
+	}
+	return e.epoch(f)
+}
+
+// parseAt reads a bucket time written as a string
+func (e *extractor) parseAt(s string) (int64, bool) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return e.epoch(f)
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, zone); err == nil {
+			return unixMillis(t), true
+		}
+	}
+	return 0, false
+}
+
+// epoch returns a number of AT_UNIT since the unix epoch as milliseconds
+func (e *extractor) epoch(f float64) (int64, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	unit := e.unit
+	if unit == 0 {
+		unit = 1
+		if math.Abs(f) < secondsBelow {
+			unit = 1000
+		}
+	}
+	ms := f * float64(unit)
+	if math.Abs(ms) > math.MaxInt64/2 {
+		return 0, false
+	}
+	return int64(math.Floor(ms)), true
+}
+
+// bucketIn returns the start of the bucket of width at falls in, buckets
+// aligned to the wall clock of TIMEZONE rather than UTC
+func bucketIn(at, width int64) int64 {
+	_, offset := time.Unix(0, at*int64(time.Millisecond)).In(zone).Zone()
+	o := int64(offset) * 1000
+	return bucketOf(at+o, width) - o
+}
+
+// calendar widths, buckets starting at TIMEZONE midnights, their width the
+// nominal one picking resolutions by
+var calendars = map[string]int64{
+	"1d":  int64(24 * time.Hour / time.Millisecond),
+	"1w":  int64(7 * 24 * time.Hour / time.Millisecond),
+	"1mo": int64(30 * 24 * time.Hour / time.Millisecond),
+}
+
+// midnight returns the start of the calendar bucket of name at falls in,
+// weeks starting on monday
+func midnight(name string, at int64) time.Time {
+	t := time.Unix(0, at*int64(time.Millisecond)).In(zone)
+	y, m, d := t.Date()
+	switch name {
+	case "1w":
+		d -= (int(t.Weekday()) + 6) % 7
+	case "1mo":
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, zone)
+}
+
+// nests returns an error unless the buckets of rollup finer fall whole in
+// those of coarser
+func nests(finer, coarser rollup) error {
+	switch {
+	case !finer.calendar && !coarser.calendar:
+		if coarser.width%finer.width != 0 {
+			return fmt.Errorf("%s isn't a multiple of %s", coarser.name, finer.name)
+		}
+	case !finer.calendar:
+		if calendars["1d"]%finer.width != 0 {
+			return fmt.Errorf("%s doesn't divide a day, so doesn't fit in %s", finer.name, coarser.name)
+		}
+	case !coarser.calendar, finer.name != "1d", coarser.name == "1d":
+		return fmt.Errorf("%s doesn't fit in %s", finer.name, coarser.name)
+	}
+	return nil
+}
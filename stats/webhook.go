@@ -0,0 +1,458 @@
+package stats
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/clock"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	webhooksNS     = flags.String("WEBHOOKS_NS", "", "db.collection of the webhooks registered on /webhooks, each posted the summaries written that it matches, empty for none")
+	webhookRetries = flags.Int("WEBHOOK_RETRIES", 3, "times a failed webhook delivery is retried, backing off from a second, before it's dropped")
+	webhookHosts   = flags.String("WEBHOOK_HOSTS", "", "comma separated hosts webhooks may be registered with, host=name authenticating deliveries to one as the SINK_AUTH_FILE entry name, any public host without credentials if empty")
+)
+
+const (
+	hookRefresh = 10 * time.Second // how long registered webhooks are cached
+	hookQueue   = 1000             // deliveries waiting before more are dropped
+	hookWorkers = 4
+)
+
+// webhook is a registration, posted every summary written with a key
+// matching Pattern, a glob, for which Condition holds
+type webhook struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Tenant    string        `bson:"tenant" json:"-"`
+	URL       string        `bson:"url" json:"url"`
+	Pattern   string        `bson:"pattern" json:"pattern"`
+	Condition string        `bson:"condition,omitempty" json:"condition,omitempty"`
+	Secret    string        `bson:"secret,omitempty" json:"-"` // signs deliveries
+	Created   time.Time     `bson:"created" json:"created"`
+
+	cond node
+}
+
+// matches reports whether s, its key as stored, is one for h
+func (h *webhook) matches(s Summary) bool {
+	if !strings.HasPrefix(s.Key, h.Tenant) {
+		return false
+	}
+	if ok, _ := path.Match(h.Pattern, strings.TrimPrefix(s.Key, h.Tenant)); !ok {
+		return false
+	}
+	if h.cond == nil {
+		return true
+	}
+	v, err := conditionValue(h.cond, s)
+	return err == nil && v != 0
+}
+
+// conditionValue evaluates an expression over one summary, bare names
+// being its values, min, max, n and percentiles as pN. Comparisons are 1
+// when they hold and 0 when they don't.
+func conditionValue(n node, s Summary) (float64, error) {
+	switch n := n.(type) {
+	case numberNode:
+		return float64(n), nil
+	case keyNode:
+		if n.fn != "" {
+			return 0, badRequest("condition: %s(%s), conditions name values, as p98 > 250", n.fn, n.key)
+		}
+		switch {
+		case n.key == "n" || n.key == "count":
+			return float64(s.N), nil
+		case n.key == "min":
+			return s.Min, nil
+		case n.key == "max":
+			return s.Max, nil
+		case percentileFn.MatchString(n.key):
+			p, _ := strconv.ParseFloat(n.key[1:], 64)
+			return percentile(s, p), nil
+		}
+		return 0, badRequest("condition: unknown value %q, one of min, max, n or pN", n.key)
+	case negNode:
+		v, err := conditionValue(n.arg, s)
+		return -v, err
+	case binaryNode:
+		l, err := conditionValue(n.l, s)
+		if err != nil {
+			return 0, err
+		}
+		r, err := conditionValue(n.r, s)
+		if err != nil {
+			return 0, err
+		}
+		v, ok := apply(n.op, l, r)
+		if comparing(n.op) {
+			v = 0
+			if ok {
+				v = 1
+			}
+		}
+		return v, nil
+	}
+	return 0, badRequest("condition: rate needs a series, conditions see one summary")
+}
+
+// delivery is a summary on its way to a webhook
+type delivery struct {
+	hook *webhook
+	body []byte
+}
+
+// hooks fires the webhooks registered in WEBHOOKS_NS. A nil hooks fires
+// nothing.
+type hooks struct {
+	c     *mgo.Collection
+	hosts map[string]*sinkauth.Auth // of WEBHOOK_HOSTS, nil for any
+	queue chan delivery
+
+	mu     sync.Mutex
+	list   []*webhook
+	loaded time.Time
+}
+
+// webhooks is set up by main, nil when WEBHOOKS_NS is empty
+var webhooks *hooks
+
+func splitWebhooksNS() (string, string, error) {
+	parts := strings.SplitN(*webhooksNS, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", cli.Invalidf("WEBHOOKS_NS %q must be db.collection", *webhooksNS)
+	}
+	return parts[0], parts[1], nil
+}
+
+// parseWebhookHosts reads WEBHOOK_HOSTS, the credentials of each host
+// allowed by lowercased name, nil for any host
+func parseWebhookHosts() (map[string]*sinkauth.Auth, error) {
+	if strings.TrimSpace(*webhookHosts) == "" {
+		return nil, nil
+	}
+	auth, err := sinkauth.Load()
+	if err != nil {
+		return nil, err
+	}
+	hosts := map[string]*sinkauth.Auth{}
+	for _, h := range strings.Split(*webhookHosts, ",") {
+		host, name := strings.TrimSpace(h), ""
+		if i := strings.Index(host, "="); i >= 0 {
+			host, name = strings.TrimSpace(host[:i]), strings.TrimSpace(host[i+1:])
+		}
+		if host == "" {
+			continue
+		}
+		var a *sinkauth.Auth
+		if name != "" {
+			if a = auth.Get(name); a == nil {
+				return nil, cli.Invalidf("WEBHOOK_HOSTS: %s isn't in SINK_AUTH_FILE", name)
+			}
+		}
+		hosts[strings.ToLower(host)] = a
+	}
+	return hosts, nil
+}
+
+// reservedNets aren't public though net.IP has no method saying so:
+// "this network" and the carrier-grade NAT shared space
+var reservedNets = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+}
+
+// publicIP reports whether ip is one a webhook may be delivered to, not
+// loopback, private, link-local, shared, unspecified or multicast, so one
+// can't reach the services next to stats or a cloud's metadata endpoint
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// refusePrivate fails connections to addresses publicIP refuses, checked
+// as they're dialed so a name resolving elsewhere later doesn't get by
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%s is a private, loopback or link-local address", host)
+	}
+	return nil
+}
+
+// newHooks starts delivering, deliveries failing being logged
+func newHooks(sess *mgo.Session) (*hooks, error) {
+	if *webhooksNS == "" {
+		return nil, nil
+	}
+	db, coll, err := splitWebhooksNS()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := parseWebhookHosts()
+	if err != nil {
+		return nil, err
+	}
+	h := &hooks{c: sess.DB(db).C(coll), hosts: hosts, queue: make(chan delivery, hookQueue)}
+	client := hookClient(refusePrivate)
+	for i := 0; i < hookWorkers; i++ {
+		go func() {
+			defer cli.Recover()
+			for d := range h.queue {
+				if err := h.deliver(client, d); err != nil {
+					fmt.Fprintf(os.Stderr, "webhook %s: %s\n", d.hook.ID.Hex(), sinkauth.Redact(err.Error()))
+				}
+			}
+		}()
+	}
+	return h, nil
+}
+
+// hookClient delivers webhooks, control checking each address dialed
+func hookClient(control func(network, address string, c syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: control}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		// a redirect would take a host's credentials elsewhere
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// webhookPrivileges are needed to fire the webhooks, and to register them
+// with the api
+func webhookPrivileges() []dial.Privilege {
+	if *webhooksNS == "" {
+		return nil
+	}
+	db, coll, err := splitWebhooksNS()
+	if err != nil {
+		return nil
+	}
+	actions := []string{"find"}
+	if *apiAddr != "" {
+		actions = append(actions, "insert", "remove")
+	}
+	return []dial.Privilege{{DB: db, Collection: coll, Actions: actions}}
+}
+
+// registered returns the webhooks, read again once hookRefresh old
+func (h *hooks) registered() ([]*webhook, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if clock.Since(sysClock, h.loaded) < hookRefresh {
+		return h.list, nil
+	}
+	var list []*webhook
+	if err := h.c.Find(nil).All(&list); err != nil {
+		return nil, err
+	}
+	for _, hook := range list {
+		if hook.Condition != "" {
+			// registering checked it parses
+			hook.cond, _ = parseExpr(hook.Condition)
+		}
+	}
+	h.list, h.loaded = list, sysClock.Now()
+	return list, nil
+}
+
+// fire queues a delivery of every summary to each webhook it matches,
+// dropping them while the queue is full so summarizing never waits
+func (h *hooks) fire(summaries []Summary) error {
+	if h == nil || len(summaries) == 0 {
+		return nil
+	}
+	list, err := h.registered()
+	if err != nil {
+		return err
+	}
+	for _, hook := range list {
+		for _, s := range summaries {
+			if !hook.matches(s) {
+				continue
+			}
+			s.Key = strings.TrimPrefix(s.Key, hook.Tenant)
+			body, _ := json.Marshal(struct {
+				Hook    bson.ObjectId `json:"hook"`
+				Summary Summary       `json:"summary"`
+			}{hook.ID, s})
+			select {
+			case h.queue <- delivery{hook, body}:
+			default:
+				fmt.Fprintf(os.Stderr, "webhook %s: queue full, dropping %s@%d\n", hook.ID.Hex(), s.Key, s.At)
+			}
+		}
+	}
+	return nil
+}
+
+// deliver posts d, retrying WEBHOOK_RETRIES times on failures. Deliveries
+// are signed with the webhook's secret as X-Oplogctl-Signature, sha256=
+// and the hex hmac of the body, and authenticated as WEBHOOK_HOSTS binds
+// their host.
+func (h *hooks) deliver(client *http.Client, d delivery) error {
+	var err error
+	for attempt := 0; attempt <= *webhookRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << uint(attempt-1))
+		}
+		var req *http.Request
+		req, err = http.NewRequest("POST", d.hook.URL, bytes.NewReader(d.body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Oplogctl-Hook", d.hook.ID.Hex())
+		if d.hook.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(d.hook.Secret))
+			mac.Write(d.body)
+			req.Header.Set("X-Oplogctl-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		if err = h.hosts[strings.ToLower(req.URL.Hostname())].Apply(req); err != nil {
+			continue
+		}
+		var resp *http.Response
+		if resp, err = client.Do(req); err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+		err = fmt.Errorf("%s answered %s", d.hook.URL, resp.Status)
+	}
+	return err
+}
+
+// register checks and stores a webhook
+func (h *hooks) register(sess *mgo.Session, hook *webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return badRequest("url %q must be http or https", hook.URL)
+	}
+	host := strings.ToLower(u.Hostname())
+	if _, ok := h.hosts[host]; h.hosts != nil && !ok {
+		return badRequest("url %q isn't of one of WEBHOOK_HOSTS", hook.URL)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return badRequest("url %q: %s", hook.URL, err)
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return badRequest("url %q is at %s, a private, loopback or link-local address", hook.URL, ip)
+		}
+	}
+	if hook.Pattern == "" {
+		return badRequest("pattern is needed, * for every key")
+	}
+	if _, err := path.Match(hook.Pattern, ""); err != nil {
+		return badRequest("pattern %q: %s", hook.Pattern, err)
+	}
+	if hook.Condition != "" {
+		if hook.cond, err = parseExpr(hook.Condition); err != nil {
+			return err
+		}
+		if _, err := conditionValue(hook.cond, Summary{}); err != nil {
+			return err
+		}
+	}
+	hook.ID = bson.NewObjectId()
+	hook.Created = sysClock.Now()
+	if err := h.c.With(sess).Insert(hook); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.loaded = time.Time{} // seen by the next batch
+	h.mu.Unlock()
+	return nil
+}
+
+// webhooks serves /webhooks, a tenant's registrations: GET lists them, POST
+// registers {"url", "pattern", "condition", "secret"} and DELETE
+// ?id= removes one
+func (a *api) webhooks(w http.ResponseWriter, r *http.Request) {
+	if webhooks == nil {
+		reply(w, nil, &apiError{http.StatusNotFound, "no webhooks, WEBHOOKS_NS is empty"})
+		return
+	}
+	t := tenantOf(r)
+	sess := a.sess.Copy()
+	defer sess.Close()
+	c := webhooks.c.With(sess)
+	switch r.Method {
+	case "GET":
+		list := []*webhook{}
+		err := c.Find(bson.M{"tenant": t.prefix}).Sort("created").All(&list)
+		reply(w, list, err)
+	case "POST":
+		var req struct {
+			URL       string `json:"url"`
+			Pattern   string `json:"pattern"`
+			Condition string `json:"condition"`
+			Auth      string `json:"auth"`
+			Secret    string `json:"secret"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			reply(w, nil, badRequest("invalid body: %s", err))
+			return
+		}
+		if req.Auth != "" {
+			reply(w, nil, badRequest("auth can't be chosen, WEBHOOK_HOSTS binds credentials to hosts"))
+			return
+		}
+		hook := &webhook{Tenant: t.prefix, URL: req.URL, Pattern: req.Pattern, Condition: req.Condition, Secret: req.Secret}
+		if err := webhooks.register(sess, hook); err != nil {
+			reply(w, nil, err)
+			return
+		}
+		// reply can't set headers once the status is written
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hook)
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if !bson.IsObjectIdHex(id) {
+			reply(w, nil, badRequest("id %q isn't a webhook's", id))
+			return
+		}
+		err := c.Remove(bson.M{"_id": bson.ObjectIdHex(id), "tenant": t.prefix})
+		if err == mgo.ErrNotFound {
+			err = &apiError{http.StatusNotFound, "no webhook " + id}
+		}
+		reply(w, map[string]string{"removed": id}, err)
+	default:
+		reply(w, nil, &apiError{http.StatusMethodNotAllowed, "GET, POST or DELETE"})
+	}
+}
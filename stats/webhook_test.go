@@ -0,0 +1,215 @@
+package stats
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPublicIP(t *testing.T) {
+	for _, c := range []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false}, // cloud metadata
+		{"fe80::1", false},
+		{"100.64.0.1", false}, // carrier-grade NAT
+		{"100.127.255.255", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:100.64.0.1", false},
+	} {
+		if got := publicIP(net.ParseIP(c.ip)); got != c.public {
+			t.Errorf("publicIP(%s) = %v, want %v", c.ip, got, c.public)
+		}
+	}
+}
+
+func TestRefusePrivate(t *testing.T) {
+	for _, c := range []struct {
+		address string
+		refused bool
+	}{
+		{"8.8.8.8:443", false},
+		{"[2001:4860:4860::8888]:443", false},
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"10.0.0.1:80", true},
+		{"169.254.169.254:80", true},
+		{"100.100.100.100:80", true},
+		{"0.0.0.0:80", true},
+		{"localhost:80", true}, // dialing sees addresses, never names
+	} {
+		if err := refusePrivate("tcp", c.address, nil); (err != nil) != c.refused {
+			t.Errorf("refusePrivate(%s): %v, want refused %v", c.address, err, c.refused)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, err := hookClient(refusePrivate).Post(srv.URL, "application/json", strings.NewReader("{}"))
+	if err == nil || !strings.Contains(err.Error(), "private, loopback or link-local") {
+		t.Errorf("delivering to %s: %v, want it refused", srv.URL, err)
+	}
+}
+
+func TestRegisterRefused(t *testing.T) {
+	for _, c := range []struct {
+		hosts   []string
+		url     string
+		pattern string
+		err     string
+	}{
+		{nil, "ftp://hooks.example.com/", "*", "must be http or https"},
+		{nil, "http:///path", "*", "must be http or https"},
+		{nil, "http://127.0.0.1:8080/", "*", "private, loopback or link-local"},
+		{nil, "http://[::1]/", "*", "private, loopback or link-local"},
+		{nil, "http://localhost/", "*", "private, loopback or link-local"},
+		{nil, "http://169.254.169.254/latest/meta-data", "*", "private, loopback or link-local"},
+		{nil, "http://10.0.0.1/", "*", "private, loopback or link-local"},
+		{nil, "http://100.64.0.1/", "*", "private, loopback or link-local"},
+		{nil, "https://0.0.0.0/", "*", "private, loopback or link-local"},
+		{[]string{"hooks.example.com"}, "https://other.example.com/", "*", "isn't of one of WEBHOOK_HOSTS"},
+		{[]string{"8.8.8.8"}, "https://8.8.8.8/", "", "pattern is needed"},
+		{[]string{"8.8.8.8"}, "https://8.8.8.8/", "[", "pattern"},
+	} {
+		h := &hooks{}
+		if c.hosts != nil {
+			h.hosts = map[string]*sinkauth.Auth{}
+			for _, host := range c.hosts {
+				h.hosts[host] = nil
+			}
+		}
+		err := h.register(nil, &webhook{URL: c.url, Pattern: c.pattern})
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("registering %s: %v, want %q", c.url, err, c.err)
+		}
+		if _, ok := err.(*apiError); err != nil && !ok {
+			t.Errorf("registering %s: %T, want a bad request", c.url, err)
+		}
+	}
+}
+
+func TestDeliverRedirect(t *testing.T) {
+	defer func(n int) { *webhookRetries = n }(*webhookRetries)
+	*webhookRetries = 0
+	followed := false
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed = true
+	}))
+	defer elsewhere.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, elsewhere.URL, http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	h := &hooks{}
+	err := h.deliver(hookClient(nil), delivery{&webhook{ID: bson.NewObjectId(), URL: srv.URL}, []byte("{}")})
+	if err == nil || !strings.Contains(err.Error(), "307") {
+		t.Errorf("delivering to a redirect: %v, want it failed", err)
+	}
+	if followed {
+		t.Error("the redirect was followed")
+	}
+}
+
+func TestDeliverSignature(t *testing.T) {
+	defer func(n int) { *webhookRetries = n }(*webhookRetries)
+	*webhookRetries = 0
+	var got http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	h := &hooks{}
+	hook := &webhook{ID: bson.NewObjectId(), URL: srv.URL, Secret: "s3cret"}
+	sent := []byte(`{"hook":"x","summary":{"key":"lat"}}`)
+	if err := h.deliver(hookClient(nil), delivery{hook, sent}); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(sent) {
+		t.Errorf("body %s, want %s", body, sent)
+	}
+	if got.Get("X-Oplogctl-Hook") != hook.ID.Hex() {
+		t.Errorf("X-Oplogctl-Hook %q, want %q", got.Get("X-Oplogctl-Hook"), hook.ID.Hex())
+	}
+	sig := strings.TrimPrefix(got.Get("X-Oplogctl-Signature"), "sha256=")
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if want := hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(sig), []byte(want)) {
+		t.Errorf("signature %q, want sha256=%s", got.Get("X-Oplogctl-Signature"), want)
+	}
+	mac = hmac.New(sha256.New, []byte("other"))
+	mac.Write(body)
+	if hex.EncodeToString(mac.Sum(nil)) == sig {
+		t.Error("signature verifies with another secret")
+	}
+
+	hook.Secret = ""
+	if err := h.deliver(hookClient(nil), delivery{hook, sent}); err != nil {
+		t.Fatal(err)
+	}
+	if s := got.Get("X-Oplogctl-Signature"); s != "" {
+		t.Errorf("unsigned delivery has X-Oplogctl-Signature %q", s)
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	for _, c := range []struct {
+		tenant, pattern, condition string
+		key                        string
+		match                      bool
+	}{
+		{"", "*", "", "lat", true},
+		{"", "lat.*", "", "lat.orders", true},
+		{"", "lat.*", "", "size.orders", false},
+		{"", "lat.?", "", "lat.ab", false},
+		{"acme.", "*", "", "acme.lat", true},
+		{"acme.", "*", "", "other.lat", false},
+		{"acme.", "lat", "", "lat", false},
+		{"acme.", "acme.lat", "", "acme.lat", false}, // patterns are within the tenant
+		{"", "*", "p98 > 250", "lat", true},
+		{"", "*", "p98 > 300", "lat", false},
+		{"", "*", "(max - min >= 290) * (n == 10)", "lat", true},
+		{"acme.", "l*", "p50 < 100", "acme.lat", true},
+		{"acme.", "l*", "p50 < 100", "acme.size", false},
+	} {
+		hook := &webhook{Tenant: c.tenant, Pattern: c.pattern}
+		if c.condition != "" {
+			var err error
+			if hook.cond, err = parseExpr(c.condition); err != nil {
+				t.Fatalf("%s: %s", c.condition, err)
+			}
+		}
+		s := Summary{Key: c.key, Min: 10, Max: 300, P50: 50, P98: 260, N: 10}
+		if got := hook.matches(s); got != c.match {
+			t.Errorf("%q %q %q matching %s: %v, want %v", c.tenant, c.pattern, c.condition, c.key, got, c.match)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package tail
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	atlasProject    = flags.String("ATLAS_PROJECT", "", "Atlas project id to tail every cluster of, labeled by cluster name")
+	atlasPublicKey  = flags.String("ATLAS_PUBLIC_KEY", "", "Atlas Admin API public key")
+	atlasPrivateKey = flags.String("ATLAS_PRIVATE_KEY", "", "Atlas Admin API private key")
+	atlasDBUser     = flags.String("ATLAS_DB_USER", "", "database user as user or user:password to connect to the clusters with, the password can also come from MONGO_PASSWORD_*")
+	atlasAPI        = flags.String("ATLAS_API", "https://cloud.mongodb.com", "Atlas Admin API base url")
+)
+
+type atlasCluster struct {
+	Name              string `json:"name"`
+	Paused            bool   `json:"paused"`
+	ConnectionStrings struct {
+		Standard string `json:"standard"`
+	} `json:"connectionStrings"`
+}
+
+// atlasSources lists the clusters of ATLAS_PROJECT through the Admin API.
+// The standard connection string is used, mgo can't resolve the srv one.
+func atlasSources() ([]source, error) {
+	var sources []source
+	client := &http.Client{Timeout: 10 * time.Second}
+	for page := 1; ; page++ {
+		u := fmt.Sprintf("%s/api/atlas/v2/groups/%s/clusters?itemsPerPage=100&pageNum=%d",
+			strings.TrimRight(*atlasAPI, "/"), url.PathEscape(*atlasProject), page)
+		var res struct {
+			Results    []atlasCluster `json:"results"`
+			TotalCount int            `json:"totalCount"`
+		}
+		if err := atlasGet(client, u, &res); err != nil {
+			return nil, err
+		}
+		for _, c := range res.Results {
+			if c.Paused || c.ConnectionStrings.Standard == "" {
+				fmt.Fprintf(os.Stderr, "atlas: skipping cluster %s, paused or not yet provisioned\n", c.Name)
+				continue
+			}
+			rawurl := c.ConnectionStrings.Standard
+			if *atlasDBUser != "" {
+				rawurl = strings.Replace(rawurl, "mongodb://", "mongodb://"+atlasUserinfo(*atlasDBUser)+"@", 1)
+			}
+			sources = append(sources, source{Label: c.Name, URL: rawurl})
+		}
+		if len(res.Results) == 0 || page*100 >= res.TotalCount {
+			break
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("atlas: no clusters to tail in project %s", *atlasProject)
+	}
+	return sources, nil
+}
+
+func atlasUserinfo(s string) string {
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) == 2 {
+		return url.UserPassword(kv[0], kv[1]).String()
+	}
+	return url.User(kv[0]).String()
+}
+
+// atlasGet GETs u into v, answering the Admin API's digest challenge
+func atlasGet(client *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.atlas.2023-01-01+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		auth, err := digestAuth(challenge, "GET", req.URL.RequestURI(), *atlasPublicKey, *atlasPrivateKey)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth)
+		if resp, err = client.Do(req); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("atlas: GET %s: %s: %s", u, resp.Status, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// digestAuth answers an RFC 2617 digest challenge with qop=auth
+func digestAuth(challenge, method, uri, user, password string) (string, error) {
+	if !strings.HasPrefix(challenge, "Digest ") {
+		return "", fmt.Errorf("atlas: expected a digest challenge, got %q", challenge)
+	}
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Digest "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b)
+	const nc = "00000001"
+	ha1 := md5hex(user + ":" + params["realm"] + ":" + password)
+	ha2 := md5hex(method + ":" + uri)
+	response := md5hex(ha1 + ":" + params["nonce"] + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=auth, nc=%s, cnonce="%s", response="%s", algorithm=MD5`,
+		user, params["realm"], params["nonce"], uri, nc, cnonce, response)
+	if opaque, ok := params["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return auth, nil
+}
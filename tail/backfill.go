@@ -0,0 +1,127 @@
+package tail
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	backfill = flags.Bool("BACKFILL", false, "before a change stream without a checkpoint, print everything watched as inserts read at one cluster time (5.0+), the stream starting right after it")
+)
+
+type snapshotCursor struct {
+	Cursor struct {
+		ID            int64               `bson:"id"`
+		FirstBatch    []bson.M            `bson:"firstBatch"`
+		NextBatch     []bson.M            `bson:"nextBatch"`
+		AtClusterTime bson.MongoTimestamp `bson:"atClusterTime"`
+	} `bson:"cursor"`
+}
+
+// backfillCh sends every document of what ns watches, as Backfill
+// inserts, as of a single cluster time which is returned once done.
+// Starting a change stream at the ts right after it leaves neither a gap
+// nor an overlap. The first collection read picks the cluster time, the
+// rest are read at it. Snapshots are only kept for
+// minSnapshotHistoryWindowInSeconds, 5 minutes by default, a backfill
+// taking longer fails.
+func backfillCh(sess *mgo.Session, source, ns string, out chan<- *Oplog) (bson.MongoTimestamp, error) {
+	namespaces, err := backfillNamespaces(sess, ns)
+	if err != nil {
+		return 0, err
+	}
+	var at bson.MongoTimestamp
+	arrived := sysClock.Now()
+	for _, ns := range namespaces {
+		i := strings.Index(ns, ".")
+		db, coll := sess.DB(ns[:i]), ns[i+1:]
+		readConcern := bson.M{"level": "snapshot"}
+		if at != 0 {
+			readConcern["atClusterTime"] = at
+		}
+		var res snapshotCursor
+		err := db.Run(bson.D{
+			{Name: "find", Value: coll},
+			{Name: "readConcern", Value: readConcern},
+		}, &res)
+		if err != nil {
+			return 0, fmt.Errorf("backfilling %s: %s", ns, err)
+		}
+		if at == 0 {
+			at = res.Cursor.AtClusterTime
+		}
+		id, batch := res.Cursor.ID, res.Cursor.FirstBatch
+		for {
+			for _, doc := range batch {
+				out <- &Oplog{
+					Timestamp: at,
+					Operation: "i",
+					Namespace: ns,
+					Object:    doc,
+					Source:    source,
+					Arrived:   arrived,
+					Backfill:  true,
+				}
+			}
+			if id == 0 {
+				break
+			}
+			res = snapshotCursor{}
+			err := db.Run(bson.D{{Name: "getMore", Value: id}, {Name: "collection", Value: coll}}, &res)
+			if err != nil {
+				return 0, fmt.Errorf("backfilling %s: %s", ns, err)
+			}
+			id, batch = res.Cursor.ID, res.Cursor.NextBatch
+		}
+		fmt.Fprintf(os.Stderr, "backfilled %s at %d\n", ns, at)
+	}
+	if at == 0 {
+		// nothing to read, from now on then
+		var status struct {
+			OperationTime bson.MongoTimestamp `bson:"operationTime"`
+		}
+		if err := sess.Run(bson.D{{Name: "ping", Value: 1}}, &status); err != nil {
+			return 0, err
+		}
+		at = status.OperationTime
+	}
+	return at, nil
+}
+
+// backfillNamespaces lists the collections ns watches, every one outside
+// admin, local and config for the whole cluster
+func backfillNamespaces(sess *mgo.Session, ns string) ([]string, error) {
+	if strings.Contains(ns, ".") {
+		return []string{ns}, nil
+	}
+	dbs := []string{ns}
+	if ns == "" {
+		names, err := sess.DatabaseNames()
+		if err != nil {
+			return nil, err
+		}
+		dbs = dbs[:0]
+		for _, db := range names {
+			if db != "admin" && db != "local" && db != "config" {
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	var namespaces []string
+	for _, db := range dbs {
+		names, err := sess.DB(db).CollectionNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range names {
+			if !strings.HasPrefix(c, "system.") {
+				namespaces = append(namespaces, db+"."+c)
+			}
+		}
+	}
+	return namespaces, nil
+}
@@ -0,0 +1,130 @@
+package tail
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	capturePath  = flags.String("CAPTURE", "", "bson file a sanitized sample of the entries printed is recorded to, fixtures for oplogtest.Fixture to replay: strings and binaries become keyed hashes, the same value the same hash, the rest is kept")
+	captureLimit = flags.Int("CAPTURE_LIMIT", 1000, "entries CAPTURE records before it stops, the tail carrying on")
+	captureKeep  = flags.String("CAPTURE_KEEP", "", "comma separated field names whose strings CAPTURE keeps as they are, such as a metric key")
+)
+
+// capture records entries to CAPTURE, nil when it's not set
+type capture struct {
+	f    *os.File
+	key  []byte // of the hashes, random so they can't be matched to guesses
+	keep map[string]bool
+	left int
+}
+
+func newCapture() (*capture, error) {
+	if *capturePath == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(*capturePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &capture{f: f, key: make([]byte, 32), keep: map[string]bool{"ns": true, "op": true}, left: *captureLimit}
+	if _, err := rand.Read(c.key); err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(*captureKeep, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			c.keep[name] = true
+		}
+	}
+	return c, nil
+}
+
+// record writes a sanitized copy of o, once it's one of the first
+// CAPTURE_LIMIT. Commands keep their top level strings, collection and
+// index names, the documents in them are sanitized.
+func (c *capture) record(o *Oplog) error {
+	if c == nil || c.left <= 0 {
+		return nil
+	}
+	c.left--
+	s := *o
+	s.Object = c.doc(o.Object, o.Operation == "c")
+	s.QueryObject = c.doc(o.QueryObject, false)
+	s.LSID = c.doc(o.LSID, false)
+	data, err := bson.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	if _, err := c.f.Write(data); err != nil {
+		return err
+	}
+	if c.left == 0 {
+		fmt.Fprintf(os.Stderr, "captured %d entries to %s\n", *captureLimit, *capturePath)
+	}
+	return nil
+}
+
+func (c *capture) close() error {
+	if c == nil {
+		return nil
+	}
+	return c.f.Close()
+}
+
+func (c *capture) hash(data []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// doc returns a sanitized copy of d, its own strings kept with keepStrings
+func (c *capture) doc(d bson.M, keepStrings bool) bson.M {
+	if d == nil {
+		return nil
+	}
+	out := make(bson.M, len(d))
+	for k, v := range d {
+		if _, ok := v.(string); ok && (keepStrings || c.keep[k]) {
+			out[k] = v
+			continue
+		}
+		out[k] = c.value(v)
+	}
+	return out
+}
+
+func (c *capture) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return "h" + hex.EncodeToString(c.hash([]byte(v)))[:16]
+	case []byte:
+		return c.bytes(v)
+	case bson.Binary:
+		return bson.Binary{Kind: v.Kind, Data: c.bytes(v.Data)}
+	case bson.M:
+		return c.doc(v, false)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = c.value(e)
+		}
+		return out
+	}
+	return v
+}
+
+// bytes replaces b with as many bytes of its hash
+func (c *capture) bytes(b []byte) []byte {
+	var out []byte
+	for h := c.hash(b); len(out) < len(b); h = c.hash(h) {
+		out = append(out, h...)
+	}
+	return out[:len(b)]
+}
@@ -0,0 +1,279 @@
+package tail
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/parquet"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+)
+
+var (
+	cdcDir   = flags.String("CDC_DIR", "", "directory or s3://bucket/prefix a Delta Lake table of the changes printed is kept in per namespace, parquet files of them with their op and ts, for snowflake, spark and the like to load, empty for none")
+	cdcRows  = flags.Int("CDC_ROWS", 100000, "changes in a CDC_DIR file at most")
+	cdcFlush = flags.Duration("CDC_FLUSH", time.Minute, "how long changes wait to be written to CDC_DIR at most")
+)
+
+// cdcColumns are the columns of a CDC_DIR file, as cdcRow fills them in
+var cdcColumns = []parquet.Column{
+	{Name: "op", Kind: parquet.String},         // insert, update, replace or delete
+	{Name: "ts", Kind: parquet.Int64},          // the entry's, seconds and increment, ordering the changes
+	{Name: "ts_time", Kind: parquet.Timestamp}, // when it was written
+	{Name: "source", Kind: parquet.String},
+	{Name: "id", Kind: parquet.JSON},                       // the _id as extended json
+	{Name: "document", Kind: parquet.JSON, Optional: true}, // as it is after, when known
+	{Name: "before", Kind: parquet.JSON, Optional: true},   // as it was, with pre-images
+	{Name: "update", Kind: parquet.JSON, Optional: true},   // what an update sets and unsets
+}
+
+// deltaTypes are the Delta Lake types of the kinds of cdcColumns
+var deltaTypes = map[parquet.Kind]string{
+	parquet.String: "string", parquet.JSON: "string", parquet.Int64: "long", parquet.Timestamp: "timestamp",
+}
+
+// warehouse keeps a Delta Lake table of changes per namespace in CDC_DIR:
+// parquet files and the json commits of _delta_log adding them, each
+// file committed once it's written so readers see none part way. One
+// tail writes a table, Delta's log needing a store that can put a file
+// only if it's absent for more. Changes buffered when the tail's killed
+// are lost. A nil warehouse, without CDC_DIR, keeps nothing.
+type warehouse struct {
+	mu     sync.Mutex
+	tables map[string]*cdcTable
+	done   chan struct{}
+}
+
+// cdcTable is a namespace's table
+type cdcTable struct {
+	files   pitr.Store
+	log     pitr.Store
+	version int // of the next commit
+	rows    [][]interface{}
+	since   time.Time // when the first of rows was buffered
+}
+
+func newWarehouse() (*warehouse, error) {
+	if *cdcDir == "" {
+		return nil, nil
+	}
+	if *cdcRows <= 0 || *cdcFlush <= 0 {
+		return nil, cli.Invalidf("CDC_ROWS and CDC_FLUSH must be positive")
+	}
+	w := &warehouse{tables: make(map[string]*cdcTable), done: make(chan struct{})}
+	go w.flushEvery(time.Second)
+	return w, nil
+}
+
+// record buffers o's change, writing its table's file if it's due
+func (w *warehouse) record(o *Oplog) error {
+	if w == nil {
+		return nil
+	}
+	row, ok := cdcRow(o)
+	if !ok {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t, err := w.table(o.Namespace)
+	if err != nil {
+		return err
+	}
+	if len(t.rows) == 0 {
+		t.since = time.Now()
+	}
+	t.rows = append(t.rows, row)
+	if len(t.rows) >= *cdcRows {
+		return t.flush()
+	}
+	return nil
+}
+
+// table opens ns' table, w.mu held
+func (w *warehouse) table(ns string) (*cdcTable, error) {
+	if t := w.tables[ns]; t != nil {
+		return t, nil
+	}
+	root := strings.TrimSuffix(*cdcDir, "/") + "/" + ns
+	files, err := pitr.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	log, err := pitr.Open(root + "/_delta_log")
+	if err != nil {
+		return nil, err
+	}
+	names, err := log.List()
+	if err != nil {
+		return nil, err
+	}
+	t := &cdcTable{files: files, log: log}
+	for _, name := range names {
+		if v, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil && strings.HasSuffix(name, ".json") && v >= t.version {
+			t.version = v + 1
+		}
+	}
+	w.tables[ns] = t
+	return t, nil
+}
+
+// flushEvery writes the files that have waited CDC_FLUSH, checking every
+// interval until closed
+func (w *warehouse) flushEvery(interval time.Duration) {
+	defer cli.Recover()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-tick.C:
+		}
+		w.mu.Lock()
+		for ns, t := range w.tables {
+			if len(t.rows) > 0 && time.Since(t.since) >= *cdcFlush {
+				if err := t.flush(); err != nil {
+					fmt.Fprintf(os.Stderr, "CDC_DIR %s: %s, retrying\n", ns, err)
+				}
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// close writes what's buffered
+func (w *warehouse) close() error {
+	if w == nil {
+		return nil
+	}
+	close(w.done)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, t := range w.tables {
+		if err := t.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the rows as a file and commits it, the first commit
+// creating the table
+func (t *cdcTable) flush() error {
+	if len(t.rows) == 0 {
+		return nil
+	}
+	data, err := parquet.Marshal(cdcColumns, t.rows)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("part-%020d.parquet", t.version)
+	if err := t.files.Put(name, data); err != nil {
+		return err
+	}
+	now := time.Now()
+	var actions []interface{}
+	if t.version == 0 {
+		meta, err := deltaMetadata(now)
+		if err != nil {
+			return err
+		}
+		actions = append(actions,
+			map[string]interface{}{"protocol": map[string]int{"minReaderVersion": 1, "minWriterVersion": 2}},
+			map[string]interface{}{"metaData": meta},
+		)
+	}
+	actions = append(actions,
+		map[string]interface{}{"add": map[string]interface{}{
+			"path":             name,
+			"partitionValues":  map[string]string{},
+			"size":             len(data),
+			"modificationTime": unixMillis(now),
+			"dataChange":       true,
+		}},
+		map[string]interface{}{"commitInfo": map[string]interface{}{
+			"timestamp":           unixMillis(now),
+			"operation":           "WRITE",
+			"operationParameters": map[string]string{"mode": "Append"},
+		}},
+	)
+	var commit []byte
+	for _, a := range actions {
+		line, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		commit = append(append(commit, line...), '\n')
+	}
+	if err := t.log.Put(fmt.Sprintf("%020d.json", t.version), commit); err != nil {
+		return err // the file's written again under the same name
+	}
+	t.version++
+	t.rows = nil
+	return nil
+}
+
+// deltaMetadata returns the metaData action creating a table
+func deltaMetadata(now time.Time) (map[string]interface{}, error) {
+	var fields []map[string]interface{}
+	for _, c := range cdcColumns {
+		fields = append(fields, map[string]interface{}{
+			"name": c.Name, "type": deltaTypes[c.Kind], "nullable": c.Optional, "metadata": map[string]string{},
+		})
+	}
+	schema, err := json.Marshal(map[string]interface{}{"type": "struct", "fields": fields})
+	if err != nil {
+		return nil, err
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	id[6], id[8] = id[6]&0x0f|0x40, id[8]&0x3f|0x80
+	return map[string]interface{}{
+		"id":               fmt.Sprintf("%x-%x-%x-%x-%x", id[:4], id[4:6], id[6:8], id[8:10], id[10:]),
+		"format":           map[string]interface{}{"provider": "parquet", "options": map[string]string{}},
+		"schemaString":     string(schema),
+		"partitionColumns": []string{},
+		"configuration":    map[string]string{},
+		"createdTime":      unixMillis(now),
+	}, nil
+}
+
+// cdcRow returns the row of o's change, not ok if it's not a document's
+func cdcRow(o *Oplog) ([]interface{}, bool) {
+	id, ok := documentID(o)
+	if !ok || o.DDL != nil || (o.Operation != "i" && o.Operation != "u" && o.Operation != "d") {
+		return nil, false
+	}
+	at := o.Wall
+	if at.IsZero() {
+		at = optime.Time(o.Timestamp)
+	}
+	row := []interface{}{"", int64(o.Timestamp), at, streamName(o.Source, o.Shard), compactJSON(id), nil, nil, nil}
+	switch {
+	case o.Operation == "i":
+		row[0], row[5] = "insert", compactJSON(o.Object)
+	case o.Operation == "d":
+		row[0] = "delete"
+	case replacing(o.Object):
+		row[0], row[5] = "replace", compactJSON(o.Object)
+	default:
+		row[0], row[7] = "update", compactJSON(o.Object)
+		if o.FullDocument != nil {
+			row[5] = compactJSON(o.FullDocument)
+		}
+	}
+	if o.FullDocumentBefore != nil {
+		row[6] = compactJSON(o.FullDocumentBefore)
+	}
+	return row, true
+}
@@ -0,0 +1,135 @@
+package tail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func setCDC(t *testing.T, dir string, rows int) {
+	oldDir, oldRows := *cdcDir, *cdcRows
+	*cdcDir, *cdcRows = dir, rows
+	t.Cleanup(func() { *cdcDir, *cdcRows = oldDir, oldRows })
+}
+
+// commit returns the actions of the table's commit of version
+func commit(t *testing.T, table string, version int) []map[string]json.RawMessage {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(table, "_delta_log", fmt.Sprintf("%020d.json", version)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []map[string]json.RawMessage
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		var a map[string]json.RawMessage
+		if err := json.Unmarshal(s.Bytes(), &a); err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		actions = append(actions, a)
+	}
+	return actions
+}
+
+// added checks the add action of a commit names a parquet file of the
+// table of its size, returning its path
+func added(t *testing.T, table string, actions []map[string]json.RawMessage) string {
+	t.Helper()
+	for _, a := range actions {
+		raw, ok := a["add"]
+		if !ok {
+			continue
+		}
+		var add struct {
+			Path       string `json:"path"`
+			Size       int    `json:"size"`
+			DataChange bool   `json:"dataChange"`
+		}
+		if err := json.Unmarshal(raw, &add); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(table, add.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != add.Size || !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) || !add.DataChange {
+			t.Errorf("add of %s, %d bytes, isn't its parquet file of %d", add.Path, add.Size, len(data))
+		}
+		return add.Path
+	}
+	t.Fatal("a commit without an add action")
+	return ""
+}
+
+func TestWarehouseCommits(t *testing.T) {
+	dir := t.TempDir()
+	setCDC(t, dir, 2)
+	w, err := newWarehouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := w.record(&Oplog{Operation: "i", Namespace: "app.users", Object: bson.M{"_id": i}, Timestamp: bson.MongoTimestamp(i << 32)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// commands have no row
+	if err := w.record(&Oplog{Operation: "c", Namespace: "app.$cmd", Object: bson.M{"drop": "users"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	table := filepath.Join(dir, "app.users")
+	logs, err := filepath.Glob(filepath.Join(table, "_delta_log", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3 {
+		t.Fatalf("%d commits of 5 rows 2 a file, want 3: %v", len(logs), logs)
+	}
+	paths := map[string]bool{}
+	for v := 0; v < 3; v++ {
+		actions := commit(t, table, v)
+		_, protocol := actions[0]["protocol"]
+		if v == 0 && (!protocol || actions[1]["metaData"] == nil) {
+			t.Errorf("the first commit doesn't create the table: %s", actions)
+		}
+		if v > 0 && protocol {
+			t.Errorf("commit %d creates the table again", v)
+		}
+		paths[added(t, table, actions)] = true
+	}
+	if len(paths) != 3 {
+		t.Errorf("commits add %d distinct files, want 3", len(paths))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.$cmd")); !os.IsNotExist(err) {
+		t.Errorf("a table of commands: %v", err)
+	}
+
+	// another tail carries on from the versions there
+	w, err = newWarehouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.record(&Oplog{Operation: "d", Namespace: "app.users", Object: bson.M{"_id": 1}, Timestamp: 6 << 32}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	actions := commit(t, table, 3)
+	if _, ok := actions[0]["protocol"]; ok {
+		t.Error("a reopened table created again")
+	}
+	if path := added(t, table, actions); paths[path] {
+		t.Errorf("version 3 adds %s again", path)
+	}
+}
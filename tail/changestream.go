@@ -0,0 +1,314 @@
+package tail
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	sourceMode   = flags.String("SOURCE", "auto", "what to tail, oplog (local.oplog.rs), changestream (watch(), for deployments without oplog access, 3.6+) or auto to pick by server version and access, from mongodb 3.0 to 7.x")
+	watch        = flags.String("WATCH", "", "what a change stream watches, empty for the whole cluster (4.0+), db (4.0+) or db.collection (3.6+)")
+	watchRenames = flags.Bool("WATCH_RENAMES", false, "keep watching a collection under its new name once renamed, instead of waiting for the old name to come back")
+
+	// post and pre-images need changeStreamPreAndPostImages enabled on the
+	// collections watched
+	fullDocument             = flags.String("FULL_DOCUMENT", "updateLookup", "document after an update, updateLookup to look it up when the event is read, whenAvailable or required for the post-image (6.0+)")
+	fullDocumentBeforeChange = flags.String("FULL_DOCUMENT_BEFORE_CHANGE", "", "document before an update, replace or delete, whenAvailable or required for the pre-image (6.0+), empty for none")
+)
+
+// checkImages validates FULL_DOCUMENT and FULL_DOCUMENT_BEFORE_CHANGE
+func checkImages() error {
+	switch *fullDocument {
+	case "updateLookup", "whenAvailable", "required":
+	default:
+		return fmt.Errorf("unknown FULL_DOCUMENT %q", *fullDocument)
+	}
+	switch *fullDocumentBeforeChange {
+	case "", "whenAvailable", "required":
+	default:
+		return fmt.Errorf("unknown FULL_DOCUMENT_BEFORE_CHANGE %q", *fullDocumentBeforeChange)
+	}
+	if imagesWanted() && *sourceMode == "oplog" {
+		return fmt.Errorf("pre and post-images need SOURCE changestream")
+	}
+	return nil
+}
+
+// imagesWanted reports whether stored pre or post-images are asked for,
+// only change streams on 6.0+ have them
+func imagesWanted() bool {
+	return *fullDocument != "updateLookup" || *fullDocumentBeforeChange != ""
+}
+
+// imagesServed fails when pre or post-images are asked for of a server
+// that doesn't store them, before 6.0
+func imagesServed(info mgo.BuildInfo) error {
+	if imagesWanted() && !info.VersionAtLeast(6, 0) {
+		return fmt.Errorf("pre and post-images need mongodb 6.0+, not %s", info.Version)
+	}
+	return nil
+}
+
+// changeEvent is a change stream document
+type changeEvent struct {
+	ID                   bson.Raw            `bson:"_id"` // resume token
+	OperationType        string              `bson:"operationType"`
+	ClusterTime          bson.MongoTimestamp `bson:"clusterTime"`
+	WallTime             time.Time           `bson:"wallTime"`
+	NS                   changeNS            `bson:"ns"`
+	To                   changeNS            `bson:"to"` // of a rename
+	DocumentKey          bson.M              `bson:"documentKey"`
+	FullDocument         bson.M              `bson:"fullDocument"`
+	FullDocumentBefore   bson.M              `bson:"fullDocumentBeforeChange"`
+	LSID                 bson.M              `bson:"lsid"`
+	TxnNumber            int64               `bson:"txnNumber"`
+	OperationDescription bson.M              `bson:"operationDescription"` // of 6.0's expanded events
+	UpdateDescription    struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+type changeNS struct {
+	DB   string `bson:"db"`
+	Coll string `bson:"coll"`
+}
+
+type changeCursor struct {
+	Cursor struct {
+		ID          int64      `bson:"id"`
+		FirstBatch  []bson.Raw `bson:"firstBatch"`
+		NextBatch   []bson.Raw `bson:"nextBatch"`
+		ResumeToken bson.Raw   `bson:"postBatchResumeToken"`
+	} `bson:"cursor"`
+}
+
+// toOplog shapes a change event like the oplog entry it came from, updates
+// with $set and $unset as in v1 oplog entries, with the document after the
+// change as FullDocument and the one before, when asked for, as
+// FullDocumentBefore
+func (e *changeEvent) toOplog() *Oplog {
+	o := &Oplog{
+		Timestamp:          e.ClusterTime,
+		Namespace:          e.NS.DB + "." + e.NS.Coll,
+		QueryObject:        e.DocumentKey,
+		Wall:               e.WallTime,
+		LSID:               e.LSID,
+		TxnNumber:          e.TxnNumber,
+		FullDocumentBefore: e.FullDocumentBefore,
+	}
+	if e.TxnNumber != 0 {
+		// change streams unwrap transactions, clusterTime is the commit's
+		o.CommitTimestamp = e.ClusterTime
+	}
+	switch e.OperationType {
+	case "insert":
+		o.Operation, o.Object = "i", e.FullDocument
+	case "replace":
+		o.Operation, o.Object = "u", e.FullDocument
+		o.FullDocument = e.FullDocument
+	case "update":
+		o.Operation = "u"
+		o.Object = bson.M{}
+		if len(e.UpdateDescription.UpdatedFields) > 0 {
+			o.Object["$set"] = e.UpdateDescription.UpdatedFields
+		}
+		if len(e.UpdateDescription.RemovedFields) > 0 {
+			unset := bson.M{}
+			for _, f := range e.UpdateDescription.RemovedFields {
+				unset[f] = true
+			}
+			o.Object["$unset"] = unset
+		}
+		o.FullDocument = e.FullDocument
+	case "delete":
+		o.Operation, o.Object = "d", e.DocumentKey
+	default:
+		// drop, rename, dropDatabase, invalidate and on 6.0+ the expanded
+		// events such as create and createIndexes
+		o.Operation = "c"
+		o.Namespace = e.NS.DB + ".$cmd"
+		o.Object = bson.M{e.OperationType: e.NS.Coll}
+		o.DDL = changeDDL(e)
+	}
+	return o
+}
+
+// changeStreamTarget returns the db to aggregate on for watching ns and
+// the aggregate's collection, 1 for a whole db or cluster
+func changeStreamTarget(ns string) (string, interface{}, bool) {
+	switch i := strings.Index(ns, "."); {
+	case ns == "":
+		return "admin", 1, true
+	case i < 0:
+		return ns, 1, false
+	default:
+		return ns[:i], ns[i+1:], false
+	}
+}
+
+// changeStreamCh watches sess like tailCh tails, resuming a failed cursor
+// from the last resume token seen. Across restarts it resumes after the
+// stream's checkpoint ts, events of a transaction share a ts so one cut
+// short by a crash isn't printed in full on restart.
+//
+// Dropping or renaming what's watched invalidates the stream. The
+// invalidate event is sent on and watching starts over right after it, on
+// the new name with WATCH_RENAMES, which is kept beside the checkpoint.
+func changeStreamCh(sess *mgo.Session, source string, cps *checkpoints) <-chan *Oplog {
+	stream := streamName(source, "")
+	since, ok, err := cps.load(stream)
+	if err != nil {
+		panic(err)
+	}
+	ns := *watch
+	if renamed, err := cps.loadWatching(stream); err != nil {
+		panic(err)
+	} else if renamed != "" && *watchRenames {
+		ns = renamed
+	}
+	info, err := sess.BuildInfo()
+	if err != nil {
+		panic(err)
+	}
+	if *backfill && !ok && !info.VersionAtLeast(5, 0) {
+		panic(fmt.Errorf("BACKFILL needs snapshot reads, mongodb 5.0+, not %s", info.Version))
+	}
+	if err := imagesServed(info); err != nil {
+		panic(err)
+	}
+
+	out := make(chan *Oplog)
+	moved := dial.WatchMember(sess)
+	meter := newStreamMeter(stream, sess)
+	cc := newClusterClock(sess)
+	go func() {
+		defer cli.Recover()
+		defer close(out)
+		if *backfill && !ok {
+			at, err := backfillCh(sess, source, ns, out)
+			if err != nil {
+				panic(err)
+			}
+			since, ok = at, true
+		}
+		var token bson.Raw
+		var renamed string // to, once what's watched is renamed
+		for failures := 0; ; failures++ {
+			db, coll, cluster := changeStreamTarget(ns)
+			getMoreColl := "$cmd.aggregate"
+			if name, ok := coll.(string); ok {
+				getMoreColl = name
+			}
+			spec := bson.D{{Name: "fullDocument", Value: *fullDocument}}
+			if *fullDocumentBeforeChange != "" {
+				spec = append(spec, bson.DocElem{Name: "fullDocumentBeforeChange", Value: *fullDocumentBeforeChange})
+			}
+			switch {
+			case token.Kind != 0:
+				spec = append(spec, bson.DocElem{Name: "resumeAfter", Value: token})
+			case ok:
+				spec = append(spec, bson.DocElem{Name: "startAtOperationTime", Value: since + 1})
+			}
+			if cluster {
+				spec = append(spec, bson.DocElem{Name: "allChangesForCluster", Value: true})
+			}
+			if info.VersionAtLeast(6, 0) {
+				// DDL beyond drops and renames
+				spec = append(spec, bson.DocElem{Name: "showExpandedEvents", Value: true})
+			}
+			var res changeCursor
+			err := sess.DB(db).Run(bson.D{
+				{Name: "aggregate", Value: coll},
+				{Name: "pipeline", Value: []bson.M{{"$changeStream": spec}}},
+				{Name: "cursor", Value: bson.M{}},
+			}, &res)
+			id, batch := res.Cursor.ID, res.Cursor.FirstBatch
+			var moving string
+			invalidated := false
+			for err == nil && moving == "" && !invalidated {
+				for _, raw := range batch {
+					var e changeEvent
+					if err = raw.Unmarshal(&e); err != nil {
+						break
+					}
+					failures = 0
+					// the reply's buffer isn't ours to keep
+					token = bson.Raw{Kind: e.ID.Kind, Data: append([]byte(nil), e.ID.Data...)}
+					oplog := e.toOplog()
+					oplog.Source = source
+					oplog.ClusterTime = cc.observe(oplog.Timestamp)
+					oplog.Arrived = sysClock.Now()
+					if e.OperationType == "invalidate" {
+						oplog.DDL = &DDL{Event: StreamInvalidated, Namespace: ns}
+					}
+					meter.read(oplog)
+					out <- oplog
+					switch e.OperationType {
+					case "rename":
+						renamed = e.To.DB + "." + e.To.Coll
+					case "invalidate":
+						// the cursor is closed, nothing follows
+						invalidated = true
+						since, ok = e.ClusterTime, true
+					}
+					if invalidated {
+						break
+					}
+				}
+				if err != nil || invalidated {
+					break
+				}
+				if res.Cursor.ResumeToken.Kind != 0 {
+					token = bson.Raw{Kind: res.Cursor.ResumeToken.Kind, Data: append([]byte(nil), res.Cursor.ResumeToken.Data...)}
+				}
+				select {
+				case moving = <-moved:
+					continue
+				default:
+				}
+				res = changeCursor{}
+				err = sess.DB(db).Run(bson.D{
+					{Name: "getMore", Value: id},
+					{Name: "collection", Value: getMoreColl},
+					{Name: "maxTimeMS", Value: 1000},
+				}, &res)
+				batch = res.Cursor.NextBatch
+			}
+			if invalidated {
+				// resume tokens don't outlive an invalidate before 4.2,
+				// start over from its ts instead
+				token = bson.Raw{}
+				if _, isColl := coll.(string); isColl && renamed != "" && *watchRenames {
+					ns = renamed
+					cps.watching(stream, ns)
+				}
+				renamed = ""
+				fmt.Fprintf(os.Stderr, "change stream invalidated, watching %s again\n", ns)
+				failures = -1
+				continue
+			}
+			if moving != "" {
+				fmt.Fprintf(os.Stderr, "change stream member %s, moving to another\n", moving)
+				failures = -1
+				sess.Refresh()
+				continue
+			}
+			if failures >= *resumeRetries {
+				panic(err)
+			}
+			fmt.Fprintf(os.Stderr, "change stream failed: %s, resuming\n", err)
+			time.Sleep(time.Second)
+			sess.Refresh()
+		}
+	}()
+	return out
+}
@@ -0,0 +1,114 @@
+package tail
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCheckImages(t *testing.T) {
+	oldAfter, oldBefore, oldSource := *fullDocument, *fullDocumentBeforeChange, *sourceMode
+	t.Cleanup(func() { *fullDocument, *fullDocumentBeforeChange, *sourceMode = oldAfter, oldBefore, oldSource })
+	for _, c := range []struct {
+		after, before, source string
+		ok                    bool
+	}{
+		{"updateLookup", "", "auto", true},
+		{"updateLookup", "", "oplog", true},
+		{"whenAvailable", "required", "changestream", true},
+		{"updateLookup", "whenAvailable", "auto", true},
+		{"required", "", "oplog", false},
+		{"updateLookup", "whenAvailable", "oplog", false},
+		{"off", "", "auto", false},
+		{"updateLookup", "updateLookup", "auto", false},
+	} {
+		*fullDocument, *fullDocumentBeforeChange, *sourceMode = c.after, c.before, c.source
+		if err := checkImages(); (err == nil) != c.ok {
+			t.Errorf("FULL_DOCUMENT=%s FULL_DOCUMENT_BEFORE_CHANGE=%q SOURCE=%s: %v", c.after, c.before, c.source, err)
+		}
+	}
+}
+
+func TestImagesServed(t *testing.T) {
+	oldAfter, oldBefore := *fullDocument, *fullDocumentBeforeChange
+	t.Cleanup(func() { *fullDocument, *fullDocumentBeforeChange = oldAfter, oldBefore })
+	for _, c := range []struct {
+		after, before string
+		version       []int
+		ok            bool
+	}{
+		{"updateLookup", "", []int{4, 4, 0}, true},
+		{"updateLookup", "required", []int{6, 0, 0}, true},
+		{"whenAvailable", "", []int{7, 0, 2}, true},
+		{"updateLookup", "whenAvailable", []int{5, 0, 9}, false},
+		{"required", "", []int{4, 4, 0}, false},
+	} {
+		*fullDocument, *fullDocumentBeforeChange = c.after, c.before
+		info := mgo.BuildInfo{VersionArray: c.version}
+		if err := imagesServed(info); (err == nil) != c.ok {
+			t.Errorf("FULL_DOCUMENT=%s FULL_DOCUMENT_BEFORE_CHANGE=%q on %v: %v", c.after, c.before, c.version, err)
+		}
+	}
+}
+
+// the pre and post-images of an event make it to the entry and from there
+// the CDC row and graphql change
+func TestChangeEventImages(t *testing.T) {
+	before := bson.M{"_id": 1, "status": "open"}
+	after := bson.M{"_id": 1, "status": "paid"}
+	for _, c := range []struct {
+		name      string
+		event     bson.M
+		op        string
+		cdcBefore interface{}
+		cdcAfter  interface{}
+		document  interface{}
+	}{
+		{
+			"update", bson.M{"operationType": "update", "ns": bson.M{"db": "app", "coll": "orders"}, "documentKey": bson.M{"_id": 1},
+				"updateDescription": bson.M{"updatedFields": bson.M{"status": "paid"}}, "fullDocument": after, "fullDocumentBeforeChange": before},
+			"u", `{"_id":1,"status":"open"}`, `{"_id":1,"status":"paid"}`, after,
+		},
+		{
+			"delete", bson.M{"operationType": "delete", "ns": bson.M{"db": "app", "coll": "orders"}, "documentKey": bson.M{"_id": 1}, "fullDocumentBeforeChange": before},
+			"d", `{"_id":1,"status":"open"}`, nil, nil,
+		},
+		{
+			"delete without pre-images", bson.M{"operationType": "delete", "ns": bson.M{"db": "app", "coll": "orders"}, "documentKey": bson.M{"_id": 1}},
+			"d", nil, nil, nil,
+		},
+	} {
+		raw, err := bson.Marshal(c.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e changeEvent
+		if err := bson.Unmarshal(raw, &e); err != nil {
+			t.Fatal(err)
+		}
+		o := e.toOplog()
+		if o.Operation != c.op {
+			t.Errorf("%s is op %s, want %s", c.name, o.Operation, c.op)
+		}
+		row, ok := cdcRow(o)
+		if !ok || row[6] != c.cdcBefore || row[5] != c.cdcAfter {
+			t.Errorf("%s row %v, want before %v and document %v", c.name, row, c.cdcBefore, c.cdcAfter)
+		}
+		change, ok := documentChange(o)
+		if !ok {
+			t.Fatalf("%s isn't a document change", c.name)
+		}
+		var wantBefore interface{}
+		if c.cdcBefore != nil {
+			wantBefore = before
+		}
+		if !reflect.DeepEqual(change["documentBefore"], wantBefore) {
+			t.Errorf("%s documentBefore %#v, want %#v", c.name, change["documentBefore"], wantBefore)
+		}
+		if c.document != nil && !reflect.DeepEqual(change["document"], c.document) {
+			t.Errorf("%s document %#v, want %#v", c.name, change["document"], c.document)
+		}
+	}
+}
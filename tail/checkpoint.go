@@ -0,0 +1,165 @@
+package tail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	checkpointDir = flags.String("CHECKPOINT_DIR", "", "directory the last ts printed per cluster and shard is kept in, tailing resumes from there on restart")
+)
+
+// checkpoints tracks the last ts printed per stream, a stream being a
+// source cluster or one of its shards, and writes them out every second.
+// With no CHECKPOINT_DIR nothing is kept.
+type checkpoints struct {
+	mu    sync.Mutex
+	dir   string
+	ts    map[string]bson.MongoTimestamp
+	dirty map[string]bool
+}
+
+func newCheckpoints(dir string) (*checkpoints, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &checkpoints{dir: dir, ts: make(map[string]bson.MongoTimestamp), dirty: make(map[string]bool)}
+	go func() {
+		defer cli.Recover()
+		for range time.Tick(time.Second) {
+			if err := c.flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "writing checkpoint: %s\n", err)
+			}
+		}
+	}()
+	return c, nil
+}
+
+// streamName names the stream of a source's shard, "" being the default
+// source or an unsharded one
+func streamName(source, shard string) string {
+	name := source
+	if name == "" {
+		name = "default"
+	}
+	if shard != "" {
+		name += "." + shard
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// load returns the stream's checkpoint, if any
+func (c *checkpoints) load(stream string) (bson.MongoTimestamp, bool, error) {
+	if c == nil {
+		return 0, false, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, stream))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("checkpoint %s: %s", stream, err)
+	}
+	return bson.MongoTimestamp(ts), true, nil
+}
+
+// seen records that the stream's entries up to ts are done with
+func (c *checkpoints) seen(stream string, ts bson.MongoTimestamp) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.ts[stream] = ts
+	c.dirty[stream] = true
+	c.mu.Unlock()
+}
+
+func (c *checkpoints) flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	pending := make(map[string]bson.MongoTimestamp, len(c.dirty))
+	for stream := range c.dirty {
+		pending[stream] = c.ts[stream]
+	}
+	c.dirty = make(map[string]bool)
+	c.mu.Unlock()
+	for stream, ts := range pending {
+		err := checkpointChaos.Write(func() error {
+			// write and rename so a crash never leaves a torn checkpoint
+			path := filepath.Join(c.dir, stream)
+			if err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatInt(int64(ts), 10)+"\n"), 0644); err != nil {
+				return err
+			}
+			return os.Rename(path+".tmp", path)
+		})
+		if err != nil {
+			c.retry(pending)
+			return err
+		}
+		delete(pending, stream)
+	}
+	return nil
+}
+
+// retry marks the streams left in pending dirty again, the next flush
+// writing them as they are by then
+func (c *checkpoints) retry(pending map[string]bson.MongoTimestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for stream := range pending {
+		c.dirty[stream] = true
+	}
+}
+
+// loadWatching returns the namespace the stream's change stream followed a
+// rename to, "" if none
+func (c *checkpoints) loadWatching(stream string) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, stream+".watch"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// watching records that the stream's change stream followed a rename to
+// ns. It's written right away, renames are rare.
+func (c *checkpoints) watching(stream, ns string) {
+	if c == nil {
+		return
+	}
+	path := filepath.Join(c.dir, stream+".watch")
+	err := ioutil.WriteFile(path+".tmp", []byte(ns+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "writing checkpoint: %s\n", err)
+	}
+}
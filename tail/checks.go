@@ -0,0 +1,136 @@
+package tail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+)
+
+func init() {
+	cli.RegisterChecks(flags, checks)
+}
+
+// checks probes every source with the privileges what it tails needs, that
+// schemas and checkpoints can be written
+func checks() []cli.Check {
+	var list []cli.Check
+	sources, err := parseSources(*mongoURLs, *mongoURL)
+	if err != nil {
+		return []cli.Check{{Name: "MONGO_URLS", Run: func() error { return err }}}
+	}
+	for _, src := range sources {
+		src := src
+		list = append(list, cli.Check{
+			Name: fmt.Sprintf("source %s", streamName(src.Label, "")),
+			Run:  func() error { return probeSource(src) },
+		})
+	}
+	if *partitions != 0 {
+		list = append(list, cli.Check{Name: "PARTITIONS", Run: func() error { return checkPartitions(sources) }})
+	}
+	if db, coll, ok := splitNS(*schemaNS); ok {
+		list = append(list, cli.Check{
+			Name: "SCHEMA_NS " + *schemaNS,
+			Run: func() error {
+				return dial.Probe(schemaURLOrDefault(), dial.Privilege{DB: db, Collection: coll, Actions: []string{"insert", "update"}})
+			},
+		})
+	}
+	if db, coll, ok := splitNS(*fieldStatsNS); ok {
+		list = append(list, cli.Check{
+			Name: "FIELD_STATS_NS " + *fieldStatsNS,
+			Run: func() error {
+				return dial.Probe(fieldStatsURLOrDefault(), dial.Privilege{DB: db, Collection: coll, Actions: []string{"insert", "update"}})
+			},
+		})
+	}
+	if *checkpointDir != "" {
+		list = append(list, cli.Check{
+			Name: "CHECKPOINT_DIR " + *checkpointDir,
+			Run: func() error {
+				if err := os.MkdirAll(*checkpointDir, 0755); err != nil {
+					return err
+				}
+				f, err := ioutil.TempFile(*checkpointDir, ".probe")
+				if err != nil {
+					return err
+				}
+				f.Close()
+				return os.Remove(f.Name())
+			},
+		})
+	}
+	if *invalidateURL != "" {
+		list = append(list, cli.Check{
+			Name: "INVALIDATE_URL " + *invalidateURL,
+			Run: func() error {
+				c, err := openCache()
+				if err != nil {
+					return err
+				}
+				return c.Close()
+			},
+		})
+	}
+	if *mqttURL != "" {
+		list = append(list, cli.Check{
+			Name: "MQTT_URL " + *mqttURL,
+			Run: func() error {
+				client, err := dialBroker()
+				if err != nil {
+					return err
+				}
+				return client.Close()
+			},
+		})
+	}
+	return list
+}
+
+// probeSource picks what src is tailed through as SOURCE would and checks
+// the privileges for that
+func probeSource(src source) error {
+	sess, err := dial.Dial(src.URL)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	mode := *sourceMode
+	if *compat != "" {
+		mode = "changestream"
+	}
+	if mode == "auto" {
+		mongos, err := dial.IsMongos(sess)
+		if err != nil {
+			return err
+		}
+		if mode, err = chooseSource(sess, mongos); err != nil {
+			return err
+		}
+	}
+	needed := []dial.Privilege{{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}}}
+	if db, coll, ok := splitNS(*partitionNS); ok && *partitions > 0 {
+		needed = append(needed, dial.Privilege{DB: db, Collection: coll, Actions: []string{"find", "insert", "update"}})
+	}
+	if mode == "changestream" {
+		db, coll, _ := changeStreamTarget(*watch)
+		if db == "admin" {
+			db = ""
+		}
+		name, _ := coll.(string)
+		needed = []dial.Privilege{{DB: db, Collection: name, Actions: []string{"changeStream", "find"}}}
+	}
+	return dial.Probe(src.URL, needed...)
+}
+
+func splitNS(ns string) (string, string, bool) {
+	i := strings.Index(ns, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	return ns[:i], ns[i+1:], i > 0 && i < len(ns)-1
+}
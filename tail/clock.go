@@ -0,0 +1,59 @@
+package tail
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	clusterTimeInterval = flags.Duration("CLUSTER_TIME_INTERVAL", time.Second, "how often each stream's gossiped $clusterTime is polled to annotate entries with, 0 to only go by entry ts")
+)
+
+// clusterClock is the newest cluster time observed on a stream: the
+// $clusterTime the server gossips, or the ts of an entry read if newer.
+// Everything up to it has been read from the stream, so downstream can
+// merge shards in order up to the oldest of their clocks.
+type clusterClock struct {
+	ts int64 // bson.MongoTimestamp
+}
+
+// newClusterClock polls a copy of sess for the gossiped cluster time
+func newClusterClock(sess *mgo.Session) *clusterClock {
+	c := &clusterClock{}
+	if *clusterTimeInterval > 0 {
+		go c.poll(sess.Copy(), *clusterTimeInterval)
+	}
+	return c
+}
+
+func (c *clusterClock) poll(sess *mgo.Session, interval time.Duration) {
+	defer cli.Recover()
+	defer sess.Close()
+	for range time.Tick(interval) {
+		ts, err := dial.ClusterTime(sess)
+		if err != nil {
+			sess.Refresh()
+			continue
+		}
+		c.observe(ts)
+	}
+}
+
+// observe advances the clock to ts, returning the clock
+func (c *clusterClock) observe(ts bson.MongoTimestamp) bson.MongoTimestamp {
+	for {
+		cur := atomic.LoadInt64(&c.ts)
+		if int64(ts) <= cur {
+			return bson.MongoTimestamp(cur)
+		}
+		if atomic.CompareAndSwapInt64(&c.ts, cur, int64(ts)) {
+			return ts
+		}
+	}
+}
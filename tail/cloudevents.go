@@ -0,0 +1,90 @@
+package tail
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/optime"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	cloudEvents      = flags.Bool("CLOUDEVENTS", false, "print OUTPUT's entries as the data of CloudEvents 1.0, in json structured mode")
+	cloudEventSource = flags.String("CLOUDEVENTS_SOURCE", "/mongodb/{source}/{ns}", "source attribute of CLOUDEVENTS, {source}, {ns}, {db}, {collection} and {op} replaced by the entry's")
+	cloudEventType   = flags.String("CLOUDEVENTS_TYPE", "org.mongodb.oplog.{op}", "type attribute of CLOUDEVENTS, replaced in as CLOUDEVENTS_SOURCE is")
+)
+
+// cloudEventOps are the names of oplog operations in CLOUDEVENTS
+var cloudEventOps = map[string]string{"i": "insert", "u": "update", "d": "delete", "c": "command", "n": "noop"}
+
+// cloudEvent is an entry's event as a CloudEvent, https://cloudevents.io
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"` // the document's _id as extended json
+	Time            string      `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// newCloudEvents returns ev wrapped in CloudEvents. Their ids are the
+// stream and timestamp of the entry, numbered after the first of the
+// entries of a transaction sharing one, unique to a cluster as its sources
+// need.
+func newCloudEvents(ev event) event {
+	last := map[string]bson.MongoTimestamp{}
+	n := map[string]int{}
+	return func(o *Oplog) (interface{}, error) {
+		data, err := ev(o)
+		if data == nil || err != nil {
+			return nil, err
+		}
+		stream := streamName(o.Source, o.Shard)
+		id := stream + "/" + optime.Format(o.Timestamp)
+		if ts, ok := last[stream]; ok && ts == o.Timestamp {
+			n[stream]++
+			id += "/" + strconv.Itoa(n[stream])
+		} else {
+			last[stream], n[stream] = o.Timestamp, 0
+		}
+		at := o.Wall
+		if at.IsZero() {
+			at = optime.Time(o.Timestamp)
+		}
+		attrs := fillIn(o)
+		e := cloudEvent{
+			SpecVersion:     "1.0",
+			ID:              id,
+			Source:          attrs.Replace(*cloudEventSource),
+			Type:            attrs.Replace(*cloudEventType),
+			Time:            at.UTC().Format(time.RFC3339Nano),
+			DataContentType: "application/json",
+			Data:            data,
+		}
+		if id, ok := documentID(o); ok && o.Operation != "c" {
+			e.Subject = compactJSON(id)
+		}
+		return e, nil
+	}
+}
+
+// fillIn returns the replacer of the placeholders of CLOUDEVENTS_SOURCE
+// and CLOUDEVENTS_TYPE for o
+func fillIn(o *Oplog) *strings.Replacer {
+	db, coll, _ := splitNS(o.Namespace)
+	op := cloudEventOps[o.Operation]
+	if op == "" {
+		op = o.Operation
+	}
+	return strings.NewReplacer(
+		"{source}", streamName(o.Source, o.Shard),
+		"{ns}", o.Namespace,
+		"{db}", db,
+		"{collection}", coll,
+		"{op}", op,
+	)
+}
@@ -0,0 +1,181 @@
+package tail
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	compat         = flags.String("COMPAT", "", "documentdb or cosmos for services with a partial change stream api and no oplog, empty for mongodb")
+	compatDiscover = flags.Duration("COMPAT_DISCOVER", time.Minute, "how often COMPAT looks for collections created since")
+)
+
+func checkCompat() error {
+	switch *compat {
+	case "":
+		return nil
+	case "documentdb", "cosmos":
+	default:
+		return fmt.Errorf("unknown COMPAT %q", *compat)
+	}
+	switch {
+	case *partitions > 0:
+		return fmt.Errorf("PARTITIONS can't be used with COMPAT")
+	case imagesWanted():
+		return fmt.Errorf("COMPAT has no pre or post-images")
+	case *backfill:
+		return fmt.Errorf("COMPAT has no snapshot reads to BACKFILL with")
+	}
+	return nil
+}
+
+// compatCursor is one collection's change stream
+type compatCursor struct {
+	db, coll string
+	id       int64
+	token    bson.Raw
+	failures int
+}
+
+// compatCh watches every collection WATCH covers with a change stream of
+// its own, taking turns polling them. DocumentDB only streams collections
+// change streams were enabled on. Cosmos only inserts and updates, as
+// their documents after the change with no cluster time: they're printed
+// as replacements, and a restart starts from now. Resume tokens are kept
+// in memory only, DocumentDB restarts from the checkpoint.
+// Entries of different collections aren't ordered between them.
+func compatCh(sess *mgo.Session, source string, cps *checkpoints) <-chan *Oplog {
+	stream := streamName(source, "")
+	since, ok, err := cps.load(stream)
+	if err != nil {
+		panic(err)
+	}
+	if ok && *compat == "cosmos" {
+		fmt.Fprintf(os.Stderr, "%s: cosmos can't start at a checkpoint, watching from now\n", stream)
+	}
+	out := make(chan *Oplog)
+	meter := newStreamMeter(stream, sess)
+	go func() {
+		defer cli.Recover()
+		defer close(out)
+		cursors := make(map[string]*compatCursor)
+		var discovered time.Time
+		for {
+			if time.Since(discovered) > *compatDiscover {
+				namespaces, err := backfillNamespaces(sess, *watch)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: listing collections: %s\n", stream, err)
+					sess.Refresh()
+				}
+				for _, ns := range namespaces {
+					if cursors[ns] == nil {
+						i := strings.Index(ns, ".")
+						cursors[ns] = &compatCursor{db: ns[:i], coll: ns[i+1:]}
+					}
+				}
+				discovered = time.Now()
+			}
+			if len(cursors) == 0 {
+				time.Sleep(time.Second)
+				continue
+			}
+			idle := true
+			for ns, c := range cursors {
+				events, err := c.poll(sess, since, ok)
+				if err != nil {
+					c.failures++
+					c.id = 0
+					if c.failures > *resumeRetries {
+						// most likely dropped, found again if it comes back
+						fmt.Fprintf(os.Stderr, "%s: giving up on %s: %s\n", stream, ns, err)
+						delete(cursors, ns)
+					}
+					continue
+				}
+				c.failures = 0
+				for _, e := range events {
+					idle = false
+					oplog := e.toOplog()
+					oplog.Source = source
+					oplog.Arrived = sysClock.Now()
+					meter.read(oplog)
+					out <- oplog
+					if e.OperationType == "invalidate" {
+						delete(cursors, ns)
+					}
+				}
+			}
+			if idle {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}()
+	return out
+}
+
+// poll opens c's change stream if needed and returns its next batch
+func (c *compatCursor) poll(sess *mgo.Session, since bson.MongoTimestamp, ok bool) ([]changeEvent, error) {
+	var res changeCursor
+	var batch []bson.Raw
+	if c.id == 0 {
+		spec := bson.D{{Name: "fullDocument", Value: "updateLookup"}}
+		switch {
+		case c.token.Kind != 0:
+			spec = append(spec, bson.DocElem{Name: "resumeAfter", Value: c.token})
+		case ok && *compat == "documentdb":
+			spec = append(spec, bson.DocElem{Name: "startAtOperationTime", Value: since + 1})
+		}
+		pipeline := []bson.M{{"$changeStream": spec}}
+		if *compat == "cosmos" {
+			// the only pipeline cosmos accepts
+			pipeline = append(pipeline,
+				bson.M{"$match": bson.M{"operationType": bson.M{"$in": []string{"insert", "update", "replace"}}}},
+				bson.M{"$project": bson.M{"_id": 1, "fullDocument": 1, "ns": 1, "documentKey": 1}},
+			)
+		}
+		err := sess.DB(c.db).Run(bson.D{
+			{Name: "aggregate", Value: c.coll},
+			{Name: "pipeline", Value: pipeline},
+			{Name: "cursor", Value: bson.M{}},
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+		c.id, batch = res.Cursor.ID, res.Cursor.FirstBatch
+	} else {
+		err := sess.DB(c.db).Run(bson.D{
+			{Name: "getMore", Value: c.id},
+			{Name: "collection", Value: c.coll},
+			{Name: "maxTimeMS", Value: 100},
+		}, &res)
+		if err != nil {
+			return nil, err
+		}
+		batch = res.Cursor.NextBatch
+	}
+	events := make([]changeEvent, 0, len(batch))
+	for _, raw := range batch {
+		var e changeEvent
+		if err := raw.Unmarshal(&e); err != nil {
+			return events, err
+		}
+		// the reply's buffer isn't ours to keep
+		e.ID = bson.Raw{Kind: e.ID.Kind, Data: append([]byte(nil), e.ID.Data...)}
+		c.token = e.ID
+		if e.OperationType == "" {
+			e.OperationType = "replace" // projected away by cosmos, the document is whole
+		}
+		events = append(events, e)
+	}
+	if res.Cursor.ResumeToken.Kind != 0 {
+		c.token = bson.Raw{Kind: res.Cursor.ResumeToken.Kind, Data: append([]byte(nil), res.Cursor.ResumeToken.Data...)}
+	}
+	return events, nil
+}
@@ -0,0 +1,153 @@
+package tail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	correlateStyle   = flags.String("CORRELATE", "", "add the fields joining printed json events with APM traces, named as datadog or elastic expect them, empty for none")
+	correlateService = flags.String("CORRELATE_SERVICE", "", "service name CORRELATE gives events")
+	correlateEnv     = flags.String("CORRELATE_ENV", "", "environment CORRELATE gives events")
+	correlateTrace   = flags.String("CORRELATE_TRACE_FIELDS", "traceparent,traceId,trace_id", "comma separated dotted paths of the document fields a trace id is read from, the first there, a W3C traceparent giving the span id too")
+)
+
+// correlationNames are the names of the service, environment, trace and
+// span id fields by CORRELATE
+var correlationNames = map[string][4]string{
+	"datadog": {"service", "env", "dd.trace_id", "dd.span_id"},
+	"elastic": {"service.name", "service.environment", "trace.id", "span.id"},
+}
+
+var traceparentRe = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// newCorrelation returns ev with the CORRELATE fields added to its events,
+// ev itself without CORRELATE
+func newCorrelation(ev event) (event, error) {
+	if *correlateStyle == "" {
+		return ev, nil
+	}
+	names, ok := correlationNames[*correlateStyle]
+	if !ok {
+		return nil, cli.Invalidf("CORRELATE %q must be datadog or elastic", *correlateStyle)
+	}
+	var paths []string
+	for _, p := range strings.Split(*correlateTrace, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return func(o *Oplog) (interface{}, error) {
+		v, err := ev(o)
+		if v == nil || err != nil {
+			return v, err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var fields []string
+		add := func(name, value string) {
+			if value != "" {
+				k, _ := json.Marshal(name)
+				v, _ := json.Marshal(value)
+				fields = append(fields, string(k)+":"+string(v))
+			}
+		}
+		add(names[0], *correlateService)
+		add(names[1], *correlateEnv)
+		trace, span := traceOf(o, paths)
+		if *correlateStyle == "datadog" {
+			trace, span = datadogID(trace, span != ""), datadogID(span, true)
+		}
+		add(names[2], trace)
+		add(names[3], span)
+		return splice(data, fields), nil
+	}, nil
+}
+
+// splice adds fields, "name":value each, to the json object data
+func splice(data []byte, fields []string) json.RawMessage {
+	data = bytes.TrimSpace(data)
+	if len(fields) == 0 || len(data) < 2 || data[len(data)-1] != '}' {
+		return data
+	}
+	out := append([]byte(nil), data[:len(data)-1]...)
+	if len(bytes.TrimSpace(out)) > 1 {
+		out = append(out, ',')
+	}
+	out = append(out, strings.Join(fields, ",")...)
+	return append(out, '}')
+}
+
+// traceOf returns the trace and span ids of the document o changes, read
+// from the first of paths it has, the span's empty unless it's a
+// traceparent
+func traceOf(o *Oplog, paths []string) (string, string) {
+	docs := []bson.M{o.FullDocument, o.Object}
+	if set, ok := o.Object["$set"].(bson.M); ok {
+		docs = append(docs, set)
+	}
+	for _, p := range paths {
+		for _, doc := range docs {
+			v, ok := lookupPath(doc, p)
+			if !ok {
+				continue
+			}
+			s, ok := v.(string)
+			if !ok {
+				switch n := v.(type) {
+				case int, int32, int64:
+					return fmt.Sprint(n), "" // datadog's, kept as numbers
+				}
+				continue
+			}
+			if m := traceparentRe.FindStringSubmatch(s); m != nil {
+				return m[1], m[2]
+			}
+			return s, ""
+		}
+	}
+	return "", ""
+}
+
+// lookupPath returns what's at a dotted path of doc, an update's $set
+// holding them whole
+func lookupPath(doc bson.M, p string) (interface{}, bool) {
+	if v, ok := doc[p]; ok {
+		return v, true
+	}
+	var v interface{} = doc
+	for _, seg := range strings.Split(p, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[seg]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// datadogID returns a trace or span id of 16 or 32 hex digits as the
+// decimal of its lower 64 bits, as datadog takes them, anything else as is.
+// Ids that could be either are taken for hex from a traceparent only.
+func datadogID(id string, hex bool) string {
+	if len(id) != 16 && len(id) != 32 || !hex && strings.Trim(id, "0123456789") == "" {
+		return id
+	}
+	n, err := strconv.ParseUint(id[len(id)-16:], 16, 64)
+	if err != nil {
+		return id
+	}
+	return strconv.FormatUint(n, 10)
+}
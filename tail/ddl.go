@@ -0,0 +1,139 @@
+package tail
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// kinds of DDL events
+const (
+	CollectionCreated  = "CollectionCreated"
+	CollectionDropped  = "CollectionDropped"
+	CollectionRenamed  = "CollectionRenamed"
+	CollectionModified = "CollectionModified"
+	DatabaseDropped    = "DatabaseDropped"
+	IndexCreated       = "IndexCreated"
+	IndexDropped       = "IndexDropped"
+	StreamInvalidated  = "StreamInvalidated" // what a change stream watched was dropped or renamed
+)
+
+// DDL is a schema level change parsed from a command entry, or from a
+// change stream event, for consumers to react to without knowing every
+// command's shape
+type DDL struct {
+	Event     string
+	Namespace string // db for DatabaseDropped, db.collection otherwise
+	To        string // the new db.collection of a rename
+	Indexes   []Index
+}
+
+// Index names an index created or dropped, Key is only known on creation
+type Index struct {
+	Name string
+	Key  bson.M
+}
+
+func (d *DDL) String() string {
+	s := d.Event + " " + d.Namespace
+	if d.To != "" {
+		s += " to " + d.To
+	}
+	for _, i := range d.Indexes {
+		s += " " + i.Name
+	}
+	return s
+}
+
+// parseDDL returns the DDL o stands for, nil if it's not one. Indexes are
+// created by a createIndexes command from 4.2, or a commitIndexBuild once
+// built on 4.4+, and an insert into system.indexes before.
+func parseDDL(o *Oplog) *DDL {
+	if o.Operation == "i" && strings.HasSuffix(o.Namespace, ".system.indexes") {
+		ns, _ := o.Object["ns"].(string)
+		return &DDL{Event: IndexCreated, Namespace: ns, Indexes: []Index{indexOf(o.Object)}}
+	}
+	if o.Operation != "c" {
+		return nil
+	}
+	db := strings.TrimSuffix(o.Namespace, ".$cmd")
+	coll := func(k string) string {
+		name, _ := o.Object[k].(string)
+		return db + "." + name
+	}
+	switch {
+	case o.Object["create"] != nil:
+		return &DDL{Event: CollectionCreated, Namespace: coll("create")}
+	case o.Object["drop"] != nil:
+		return &DDL{Event: CollectionDropped, Namespace: coll("drop")}
+	case o.Object["collMod"] != nil:
+		return &DDL{Event: CollectionModified, Namespace: coll("collMod")}
+	case o.Object["dropDatabase"] != nil:
+		return &DDL{Event: DatabaseDropped, Namespace: db}
+	case o.Object["renameCollection"] != nil:
+		from, _ := o.Object["renameCollection"].(string)
+		to, _ := o.Object["to"].(string)
+		return &DDL{Event: CollectionRenamed, Namespace: from, To: to}
+	case o.Object["createIndexes"] != nil:
+		return &DDL{Event: IndexCreated, Namespace: coll("createIndexes"), Indexes: []Index{indexOf(o.Object)}}
+	case o.Object["commitIndexBuild"] != nil:
+		d := &DDL{Event: IndexCreated, Namespace: coll("commitIndexBuild")}
+		specs, _ := o.Object["indexes"].([]interface{})
+		for _, spec := range specs {
+			if spec, ok := spec.(bson.M); ok {
+				d.Indexes = append(d.Indexes, indexOf(spec))
+			}
+		}
+		return d
+	case o.Object["dropIndexes"] != nil || o.Object["deleteIndexes"] != nil:
+		k := "dropIndexes"
+		if o.Object[k] == nil {
+			k = "deleteIndexes"
+		}
+		d := &DDL{Event: IndexDropped, Namespace: coll(k)}
+		// the index name, or "*" for all of them
+		if name, ok := o.Object["index"].(string); ok {
+			d.Indexes = []Index{{Name: name}}
+		}
+		return d
+	}
+	return nil
+}
+
+func indexOf(spec bson.M) Index {
+	name, _ := spec["name"].(string)
+	key, _ := spec["key"].(bson.M)
+	return Index{Name: name, Key: key}
+}
+
+// changeDDL returns the DDL a change stream event stands for, nil if it's
+// not one
+func changeDDL(e *changeEvent) *DDL {
+	ns := e.NS.DB + "." + e.NS.Coll
+	switch e.OperationType {
+	case "create":
+		return &DDL{Event: CollectionCreated, Namespace: ns}
+	case "drop":
+		return &DDL{Event: CollectionDropped, Namespace: ns}
+	case "modify":
+		return &DDL{Event: CollectionModified, Namespace: ns}
+	case "dropDatabase":
+		return &DDL{Event: DatabaseDropped, Namespace: e.NS.DB}
+
+	case "rename":
+		return &DDL{Event: CollectionRenamed, Namespace: ns, To: e.To.DB + "." + e.To.Coll}
+	case "createIndexes", "dropIndexes":
+		d := &DDL{Event: IndexCreated, Namespace: ns}
+		if e.OperationType == "dropIndexes" {
+			d.Event = IndexDropped
+		}
+		specs, _ := e.OperationDescription["indexes"].([]interface{})
+		for _, spec := range specs {
+			if spec, ok := spec.(bson.M); ok {
+				d.Indexes = append(d.Indexes, indexOf(spec))
+			}
+		}
+		return d
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package tail
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var debeziumName = flags.String("DEBEZIUM_NAME", "oplogctl", "logical name debezium envelopes give as their source's name, the topic prefix of the connector they stand in for")
+
+// envelope is a change as debezium's mongodb connector emits it, with the
+// json converter's schemas off. Documents are extended json strings.
+type envelope struct {
+	Before            *string            `json:"before"`
+	After             *string            `json:"after"`
+	UpdateDescription *updateDescription `json:"updateDescription,omitempty"`
+	Filter            *string            `json:"filter,omitempty"` // the _id an update or delete is of, as the connector's 1.x envelopes had it
+	Source            envelopeSource     `json:"source"`
+	Op                string             `json:"op"`
+	TsMs              int64              `json:"ts_ms"`
+	Transaction       *envelopeTxn       `json:"transaction"`
+}
+
+// updateDescription is an update without the document it left
+type updateDescription struct {
+	RemovedFields   []string         `json:"removedFields"`
+	UpdatedFields   *string          `json:"updatedFields"`
+	TruncatedArrays []truncatedArray `json:"truncatedArrays"`
+}
+
+type truncatedArray struct {
+	Field string `json:"field"`
+	Size  int    `json:"size"`
+}
+
+type envelopeSource struct {
+	Version    string `json:"version"`
+	Connector  string `json:"connector"`
+	Name       string `json:"name"`
+	TsMs       int64  `json:"ts_ms"`
+	Snapshot   string `json:"snapshot"`
+	DB         string `json:"db"`
+	RS         string `json:"rs"`
+	Collection string `json:"collection"`
+	Ord        int64  `json:"ord"`
+	LSID       string `json:"lsid,omitempty"`
+	TxnNumber  int64  `json:"txnNumber,omitempty"`
+	WallTime   int64  `json:"wallTime,omitempty"`
+}
+
+type envelopeTxn struct {
+	ID string `json:"id"`
+}
+
+// debeziumOps are the envelope ops of oplog ones, the rest aren't changes
+// to documents and aren't printed
+var debeziumOps = map[string]string{"i": "c", "u": "u", "d": "d"}
+
+// debezium returns the envelope of o, not ok if it's not a document change
+func debezium(o *Oplog) (envelope, bool) {
+	op, ok := debeziumOps[o.Operation]
+	if !ok || o.DDL != nil {
+		return envelope{}, false
+	}
+	db, coll, _ := splitNS(o.Namespace)
+	at := o.Arrived
+	if at.IsZero() {
+		at = sysClock.Now()
+	}
+	e := envelope{
+		Op:   op,
+		TsMs: unixMillis(at),
+		Source: envelopeSource{
+			Version:    "oplogctl",
+			Connector:  "mongodb",
+			Name:       *debeziumName,
+			TsMs:       int64(o.Timestamp>>32) * 1000,
+			Snapshot:   "false",
+			DB:         db,
+			RS:         streamName(o.Source, o.Shard),
+			Collection: coll,
+			Ord:        int64(uint32(o.Timestamp)),
+		},
+	}
+	if !o.Wall.IsZero() {
+		e.Source.WallTime = unixMillis(o.Wall)
+	}
+	if o.LSID != nil {
+		e.Source.LSID = compactJSON(o.LSID["id"])
+		e.Source.TxnNumber = o.TxnNumber
+		e.Transaction = &envelopeTxn{ID: fmt.Sprintf("%s:%d", e.Source.LSID, o.TxnNumber)}
+	}
+	if o.Backfill {
+		e.Op, e.Source.Snapshot = "r", "true"
+	}
+	e.Before = jsonString(o.FullDocumentBefore)
+	switch {
+	case o.Operation == "i", o.Operation == "u" && replacing(o.Object):
+		e.After = jsonString(o.Object)
+	case o.Operation == "u":
+		e.After = jsonString(o.FullDocument)
+		e.UpdateDescription = describe(o.Object)
+	}
+	switch o.Operation {
+	case "u":
+		e.Filter = jsonString(o.QueryObject)
+	case "d":
+		e.Filter = jsonString(o.Object)
+	}
+	return e, true
+}
+
+// describe returns what a $v: 1 update changes
+func describe(update bson.M) *updateDescription {
+	d := &updateDescription{RemovedFields: []string{}, TruncatedArrays: []truncatedArray{}}
+	if set, ok := update["$set"].(bson.M); ok {
+		d.UpdatedFields = jsonString(set)
+	}
+	if unset, ok := update["$unset"].(bson.M); ok {
+		for field := range unset {
+			d.RemovedFields = append(d.RemovedFields, field)
+		}
+		sort.Strings(d.RemovedFields)
+	}
+	// arrays cut short, as diff writes their v2 truncations
+	if push, ok := update["$push"].(bson.M); ok {
+		for field, v := range push {
+			if spec, ok := v.(bson.M); ok {
+				if size, ok := number(spec["$slice"]); ok {
+					d.TruncatedArrays = append(d.TruncatedArrays, truncatedArray{field, int(size)})
+				}
+			}
+		}
+	}
+	return d
+}
+
+// jsonString returns doc as extended json, nil for no document
+func jsonString(doc bson.M) *string {
+	if doc == nil {
+		return nil
+	}
+	s := compactJSON(doc)
+	return &s
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,25 @@
+package tail
+
+import (
+	"github.com/hanjoyo/oplog-abuse/diff"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DecodeRaw decodes data as an oplog entry and unwraps, parses and
+// normalizes it as tailCh does, for FuzzDecode, which oplogtest's import
+// of tail keeps out of the package
+func DecodeRaw(data []byte) {
+	var o Oplog
+	if err := bson.Unmarshal(data, &o); err != nil {
+		return
+	}
+	txns := newTxnBuffer()
+	for _, e := range txns.unwrap(&o) {
+		e.DDL = parseDDL(e)
+		if e.Operation == "u" {
+			diff.NormalizeM(e.Object)
+		}
+	}
+	txns.resume()
+}
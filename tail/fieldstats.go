@@ -0,0 +1,150 @@
+package tail
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/fieldstats"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	fieldStatsNS       = flags.String("FIELD_STATS_NS", "", "db.collection the statistics of each namespace's fields are written to, null rates, distinct values, least and most numbers and most frequent values, such as oplog_abuse.fields, served by stats' api as /fields, empty to not collect them")
+	fieldStatsURL      = flags.String("FIELD_STATS_URL", "", "mongodb url FIELD_STATS_NS is on, MONGO_URL if empty")
+	fieldStatsInterval = flags.Duration("FIELD_STATS_INTERVAL", time.Minute, "how often the field statistics are written to FIELD_STATS_NS")
+	fieldStatsTop      = flags.Int("FIELD_STATS_TOP", 5, "most frequent values written per field")
+)
+
+// profiles collects the statistics of the fields of every namespace whole
+// documents are read of, writing those that changed every
+// FIELD_STATS_INTERVAL. Nil without FIELD_STATS_NS.
+type profiles struct {
+	c *mgo.Collection
+
+	mu    sync.Mutex
+	byID  map[string]*profileEntry
+	dirty map[string]bool
+}
+
+type profileEntry struct {
+	source    string
+	collector *fieldstats.Collector
+}
+
+// profileDoc is what's written to FIELD_STATS_NS per namespace
+type profileDoc struct {
+	ID        string             `bson:"_id"`
+	Namespace string             `bson:"ns"`
+	Source    string             `bson:"source,omitempty"`
+	Documents int64              `bson:"documents"`
+	Overflow  int64              `bson:"overflow,omitempty"`
+	Updated   time.Time          `bson:"updated"`
+	Fields    []fieldstats.Stats `bson:"fields"`
+}
+
+// fieldStatsURLOrDefault is the url FIELD_STATS_NS is written on
+func fieldStatsURLOrDefault() string {
+	if *fieldStatsURL != "" {
+		return *fieldStatsURL
+	}
+	return *mongoURL
+}
+
+func newProfiles() (*profiles, error) {
+	if *fieldStatsNS == "" {
+		return nil, nil
+	}
+	db, coll, ok := splitNS(*fieldStatsNS)
+	if !ok {
+		return nil, fmt.Errorf("FIELD_STATS_NS %q must be db.collection", *fieldStatsNS)
+	}
+	if *fieldStatsInterval <= 0 {
+		return nil, fmt.Errorf("FIELD_STATS_INTERVAL must be positive")
+	}
+	sess, err := dial.Dial(fieldStatsURLOrDefault())
+	if err != nil {
+		return nil, err
+	}
+	p := &profiles{c: sess.DB(db).C(coll), byID: make(map[string]*profileEntry), dirty: make(map[string]bool)}
+	go func() {
+		defer cli.Recover()
+		for range sysClock.NewTicker(*fieldStatsInterval).C() {
+			if err := p.flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "writing field statistics: %s\n", err)
+				p.c.Database.Session.Refresh()
+			}
+		}
+	}()
+	return p, nil
+}
+
+// observe profiles the document o inserts, or replaces or updates when it
+// carries the whole of it
+func (p *profiles) observe(o *Oplog) {
+	if p == nil || o.Namespace == "" || strings.Contains(o.Namespace, ".system.") {
+		return
+	}
+	doc := o.FullDocument
+	switch {
+	case o.Operation == "i":
+		doc = o.Object
+	case o.Operation != "u":
+		return
+	case doc == nil && replacing(o.Object):
+		doc = o.Object
+	}
+	if doc == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := schemaID(o.Source, o.Namespace)
+	e := p.byID[id]
+	if e == nil {
+		e = &profileEntry{source: o.Source, collector: fieldstats.New(o.Namespace)}
+		p.byID[id] = e
+	}
+	e.collector.Document(doc)
+	p.dirty[id] = true
+}
+
+// flush writes the statistics changed since the last flush
+func (p *profiles) flush() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	docs := make([]profileDoc, 0, len(p.dirty))
+	now := sysClock.Now()
+	for id := range p.dirty {
+		e := p.byID[id]
+		docs = append(docs, profileDoc{
+			ID:        id,
+			Namespace: e.collector.Namespace,
+			Source:    e.source,
+			Documents: e.collector.Documents,
+			Overflow:  e.collector.Overflow,
+			Updated:   now,
+			Fields:    e.collector.Stats(*fieldStatsTop),
+		})
+	}
+	p.dirty = make(map[string]bool)
+	p.mu.Unlock()
+	for i, doc := range docs {
+		if _, err := p.c.UpsertId(doc.ID, doc); err != nil {
+			p.mu.Lock()
+			for _, d := range docs[i:] {
+				p.dirty[d.ID] = true // written on the next flush
+			}
+			p.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
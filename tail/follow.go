@@ -0,0 +1,152 @@
+package tail
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	followID = flags.String("ID", "", "only print the changes to the document with this _id, as a history, extended json such as {\"$oid\":\"...\"} or a plain string")
+	followNS = flags.String("NS", "", "db.collection the ID document is in")
+)
+
+// follower picks the changes to one document out of the stream, and what
+// happens to its collection, printing them as the document's history
+type follower struct {
+	ns      string
+	id      interface{}
+	changes int
+}
+
+// newFollower parses ID and NS, nil if ID isn't set
+func newFollower() (*follower, error) {
+	if *followID == "" {
+		if *followNS != "" {
+			return nil, cli.Invalidf("NS is only used with ID")
+		}
+		return nil, nil
+	}
+	if _, _, ok := splitNS(*followNS); !ok {
+		return nil, cli.Invalidf("ID needs NS as db.collection, got %q", *followNS)
+	}
+	var id interface{} = *followID // unless it's json
+	var doc bson.M
+	if err := bson.UnmarshalJSON([]byte(`{"_id":`+*followID+`}`), &doc); err == nil && doc["_id"] != nil {
+		id = doc["_id"]
+	}
+	return &follower{ns: *followNS, id: id}, nil
+}
+
+// number returns v as a float64 if it's a number of any width
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// sameID compares ids as mongodb does, numbers by value whatever their type
+func sameID(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	da, err := bson.Marshal(bson.M{"_id": a})
+	if err != nil {
+		return false
+	}
+	db, err := bson.Marshal(bson.M{"_id": b})
+	return err == nil && string(da) == string(db)
+}
+
+// touches reports whether o changes the document, or drops or renames its
+// collection. A nil follower follows everything.
+func (f *follower) touches(o *Oplog) bool {
+	if f == nil {
+		return true
+	}
+	if o.Operation == "c" {
+		db, coll, _ := splitNS(f.ns)
+		if o.Namespace != db+".$cmd" {
+			return false
+		}
+		for _, name := range []string{"drop", "renameCollection", "dropDatabase"} {
+			if v, ok := o.Object[name]; ok {
+				arg, _ := v.(string)
+				return name == "dropDatabase" || arg == coll || arg == f.ns
+			}
+		}
+		return false
+	}
+	if o.Namespace != f.ns {
+		return false
+	}
+	id, ok := documentID(o)
+	return ok && sameID(id, f.id)
+}
+
+func compactJSON(v interface{}) string {
+	data, err := bsonfile.MarshalJSON(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// replacing reports whether an update's o is a whole document
+func replacing(o bson.M) bool {
+	for name := range o {
+		if strings.HasPrefix(name, "$") {
+			return false
+		}
+	}
+	return len(o) > 0
+}
+
+// print prints o as the next change of the history
+func (f *follower) print(o *Oplog) {
+	f.changes++
+	at := o.Wall
+	if at.IsZero() {
+		at = time.Unix(int64(o.Timestamp>>32), 0)
+	}
+	var what string
+	switch o.Operation {
+	case "i":
+		what = "inserted " + compactJSON(o.Object)
+	case "u":
+		if replacing(o.Object) {
+			what = "replaced by " + compactJSON(o.Object)
+		} else {
+			what = "updated " + compactJSON(o.Object)
+		}
+	case "d":
+		what = "deleted"
+	case "c":
+		what = "collection gone, " + compactJSON(o.Object)
+	}
+	var where string
+	if o.Source != "" || o.Shard != "" {
+		where = " on " + streamName(o.Source, o.Shard)
+	}
+	fmt.Printf("#%d %s ts %d%s: %s\n", f.changes, at.UTC().Format(time.RFC3339Nano), o.Timestamp, where, what)
+	if o.FullDocument != nil && o.Operation == "u" && !replacing(o.Object) {
+		fmt.Printf("   now %s\n", compactJSON(o.FullDocument))
+	}
+	if o.LSID != nil {
+		fmt.Printf("   in transaction %d of session %s\n", o.TxnNumber, compactJSON(o.LSID["id"]))
+	}
+}
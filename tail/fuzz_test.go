@@ -0,0 +1,26 @@
+package tail_test
+
+import (
+	"testing"
+
+	"github.com/hanjoyo/oplog-abuse/oplogtest"
+	"github.com/hanjoyo/oplog-abuse/tail"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FuzzDecode decodes data as an oplog entry and unwraps, parses and
+// normalizes it as tailCh does. Any input may fail to decode, none may
+// panic.
+func FuzzDecode(f *testing.F) {
+	for _, e := range oplogtest.Representative() {
+		data, err := bson.Marshal(e)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tail.DecodeRaw(data)
+	})
+}
@@ -0,0 +1,539 @@
+package tail
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/gql"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/ws"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	graphqlAddr   = flags.String("GRAPHQL_ADDR", "", "address to serve the documentChanged subscription of what's printed on at /graphql, e.g. \":8080\", empty for none")
+	graphqlBuffer = flags.Int("GRAPHQL_BUFFER", 1000, "changes queued for a subscriber before it's too far behind and ended")
+)
+
+var droppedSubscribers = expvar.NewInt("graphql_dropped_subscribers")
+
+// graphqlSchema is what /graphql serves, its documents and ids in extended
+// json
+const graphqlSchema = `scalar JSON
+
+enum Operation { INSERT UPDATE REPLACE DELETE }
+
+type DocumentChange {
+  operation: Operation!
+  namespace: String!
+  id: JSON!
+  document: JSON
+  documentBefore: JSON
+  updateDescription: JSON
+  timestamp: String!
+  source: String!
+}
+
+type Subscription {
+  documentChanged(namespace: String!, filter: JSON): DocumentChange!
+}
+`
+
+// changeFields are the fields of a DocumentChange
+var changeFields = map[string]bool{
+	"operation": true, "namespace": true, "id": true, "document": true, "documentBefore": true,
+	"updateDescription": true, "timestamp": true, "source": true, "__typename": true,
+}
+
+// bridge serves the changes printed as GraphQL subscriptions, over
+// graphql-sse's distinct connections: a subscription is posted, or got with
+// query and variables parameters for EventSource, and answered with a next
+// event per change. A websocket speaks graphql-transport-ws instead, its
+// subscriptions told apart by id. A nil bridge, without GRAPHQL_ADDR,
+// serves nothing.
+type bridge struct {
+	mu   sync.Mutex
+	subs map[*subscriber]bool
+}
+
+// subscriber is a documentChanged subscription
+type subscriber struct {
+	alias  string // what the field's answered under
+	ns     string // db.collection, or db for all of its
+	filter bson.M // dotted paths and the values they must have
+	fields []gql.Field
+	events chan []byte // nil once too far behind
+}
+
+// newBridge serves the subscription if GRAPHQL_ADDR is set, with the
+// metrics if it's METRICS_ADDR
+func newBridge() (*bridge, error) {
+	if *graphqlAddr == "" {
+		return nil, nil
+	}
+	if *graphqlBuffer <= 0 {
+		return nil, cli.Invalidf("GRAPHQL_BUFFER must be positive")
+	}
+	b := &bridge{subs: make(map[*subscriber]bool)}
+	http.Handle("/graphql", b)
+	if *graphqlAddr != *metricsAddr {
+		go func() {
+			defer cli.Recover()
+			if err := http.ListenAndServe(*graphqlAddr, nil); err != nil {
+				panic(err)
+			}
+		}()
+	}
+	return b, nil
+}
+
+// ServeHTTP serves a subscription until the client goes away or falls too
+// far behind, the schema on a GET without a query
+func (b *bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ws.IsUpgrade(r) {
+		b.serveWS(w, r)
+		return
+	}
+	var req subscribeRequest
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		if req.Query = q.Get("query"); req.Query == "" {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, graphqlSchema)
+			return
+		}
+		if vars := q.Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				graphqlError(w, http.StatusBadRequest, "variables: "+err.Error())
+				return
+			}
+		}
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			graphqlError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		graphqlError(w, http.StatusMethodNotAllowed, "GET or POST only")
+		return
+	}
+	sub, err := subscribe(req.Query, req.Variables)
+	if err != nil {
+		graphqlError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		graphqlError(w, http.StatusInternalServerError, "streaming isn't supported")
+		return
+	}
+	events := b.add(sub)
+	defer b.drop(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-events:
+			if !ok {
+				fmt.Fprintf(w, "event: next\ndata: %s\n\n", tooFarBehind)
+				fmt.Fprint(w, "event: complete\ndata:\n\n")
+				flusher.Flush()
+				return
+			}
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// subscribeRequest is a subscription posted, got or sent over a websocket
+type subscribeRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// tooFarBehind is the last next of a subscriber ended for it
+const tooFarBehind = `{"errors":[{"message":"too far behind, resubscribe"}]}`
+
+// wsMessage is a graphql-transport-ws message
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// graphql-transport-ws's close codes
+const (
+	wsBadMessage   = 4400
+	wsUnauthorized = 4401
+	wsDuplicateID  = 4409
+	wsTooManyInits = 4429
+)
+
+// serveWS serves graphql-transport-ws: a connection_init is acked, then
+// each subscribe answered with a next per change until the client
+// completes it, or with a complete once it's too far behind
+func (b *bridge) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := ws.Upgrade(w, r, "graphql-transport-ws")
+	if err != nil {
+		return
+	}
+	defer conn.Close(ws.CloseNormal, "")
+	send := func(m wsMessage) error {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return conn.WriteText(data)
+	}
+
+	var mu sync.Mutex
+	subs := map[string]chan struct{}{} // closed once completed by the client
+	defer func() {
+		mu.Lock()
+		for _, done := range subs {
+			close(done)
+		}
+		subs = nil
+		mu.Unlock()
+	}()
+	acked := false
+	for {
+		data, err := conn.Read()
+		if err != nil {
+			return
+		}
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			conn.Close(wsBadMessage, "invalid message")
+			return
+		}
+		switch m.Type {
+		case "connection_init":
+			if acked {
+				conn.Close(wsTooManyInits, "too many initialisation requests")
+				return
+			}
+			acked = true
+			send(wsMessage{Type: "connection_ack"})
+		case "ping":
+			send(wsMessage{Type: "pong", Payload: m.Payload})
+		case "pong":
+		case "subscribe":
+			if !acked {
+				conn.Close(wsUnauthorized, "unauthorized")
+				return
+			}
+			var req subscribeRequest
+			if m.ID == "" || json.Unmarshal(m.Payload, &req) != nil {
+				conn.Close(wsBadMessage, "invalid subscribe")
+				return
+			}
+			mu.Lock()
+			_, dup := subs[m.ID]
+			mu.Unlock()
+			if dup {
+				conn.Close(wsDuplicateID, "subscriber for "+m.ID+" already exists")
+				return
+			}
+			sub, err := subscribe(req.Query, req.Variables)
+			if err != nil {
+				errs, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+				send(wsMessage{ID: m.ID, Type: "error", Payload: errs})
+				continue
+			}
+			done := make(chan struct{})
+			mu.Lock()
+			subs[m.ID] = done
+			mu.Unlock()
+			events := b.add(sub)
+			go func(id string) {
+				defer b.drop(sub)
+				for {
+					select {
+					case <-done:
+						return
+					case data, ok := <-events:
+						if !ok {
+							send(wsMessage{ID: id, Type: "next", Payload: json.RawMessage(tooFarBehind)})
+							send(wsMessage{ID: id, Type: "complete"})
+							mu.Lock()
+							if subs != nil {
+								delete(subs, id)
+							}
+							mu.Unlock()
+							return
+						}
+						if send(wsMessage{ID: id, Type: "next", Payload: data}) != nil {
+							return
+						}
+					}
+				}
+			}(m.ID)
+		case "complete":
+			mu.Lock()
+			if done, ok := subs[m.ID]; ok {
+				close(done)
+				delete(subs, m.ID)
+			}
+			mu.Unlock()
+		default:
+			conn.Close(wsBadMessage, "unknown message type "+m.Type)
+			return
+		}
+	}
+}
+
+func graphqlError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"message": msg}},
+	})
+}
+
+// subscribe parses a documentChanged subscription
+func subscribe(query string, variables map[string]interface{}) (*subscriber, error) {
+	op, err := gql.Parse(query, variables)
+	if err != nil {
+		return nil, err
+	}
+	if op.Kind != "subscription" {
+		return nil, fmt.Errorf("only the documentChanged subscription is served, not a %s", op.Kind)
+	}
+	if len(op.Fields) != 1 || op.Fields[0].Name != "documentChanged" {
+		return nil, fmt.Errorf("a subscription has the one documentChanged field")
+	}
+	f := op.Fields[0]
+	ns, ok := f.Args["namespace"].(string)
+	if !ok || ns == "" {
+		return nil, fmt.Errorf("documentChanged needs a namespace")
+	}
+	for arg := range f.Args {
+		if arg != "namespace" && arg != "filter" {
+			return nil, fmt.Errorf("documentChanged has no argument %s", arg)
+		}
+	}
+	filter, err := toFilter(f.Args["filter"])
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Selection) == 0 {
+		return nil, fmt.Errorf("documentChanged needs a selection")
+	}
+	for _, s := range f.Selection {
+		if !changeFields[s.Name] {
+			return nil, fmt.Errorf("DocumentChange has no field %s", s.Name)
+		}
+		if s.Selection != nil || s.Args != nil {
+			return nil, fmt.Errorf("%s takes no arguments or selection", s.Name)
+		}
+	}
+	return &subscriber{alias: f.Alias, ns: ns, filter: filter, fields: f.Selection}, nil
+}
+
+// toFilter returns the filter argument, an object or a string of it, as
+// bson, extended json turned into what it stands for
+func toFilter(arg interface{}) (bson.M, error) {
+	var data []byte
+	switch arg := arg.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		data = []byte(arg)
+	case map[string]interface{}:
+		var err error
+		if data, err = json.Marshal(arg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("filter must be an object")
+	}
+	var filter bson.M
+	if err := bson.UnmarshalJSON(data, &filter); err != nil {
+		return nil, fmt.Errorf("filter: %s", err)
+	}
+	return filter, nil
+}
+
+// add starts sub's subscription, returning what it's sent
+func (b *bridge) add(sub *subscriber) <-chan []byte {
+	events := make(chan []byte, *graphqlBuffer)
+	sub.events = events
+	b.mu.Lock()
+	b.subs[sub] = true
+	b.mu.Unlock()
+	return events
+}
+
+// drop ends sub's subscription
+func (b *bridge) drop(sub *subscriber) {
+	b.mu.Lock()
+	delete(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// publish sends o to the subscriptions it matches, ending those too far
+// behind to take it
+func (b *bridge) publish(o *Oplog) {
+	if b == nil || o.Backfill {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var change bson.M
+	for sub := range b.subs {
+		if sub.events == nil || !sub.matches(o) {
+			continue
+		}
+		if change == nil {
+			var ok bool
+			if change, ok = documentChange(o); !ok {
+				return
+			}
+		}
+		data, err := sub.answer(change)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "graphql: %s at %d: %s\n", o.Namespace, o.Timestamp, err)
+			continue
+		}
+		select {
+		case sub.events <- data:
+		default:
+			close(sub.events)
+			sub.events = nil
+			droppedSubscribers.Add(1)
+		}
+	}
+}
+
+// matches reports whether o changes a document of sub's namespace with
+// the values of its filter. Updates without the document they leave are
+// matched on what they set, deletes without the one before on the _id.
+func (sub *subscriber) matches(o *Oplog) bool {
+	if o.Namespace != sub.ns && (strings.Contains(sub.ns, ".") || !strings.HasPrefix(o.Namespace, sub.ns+".")) {
+		return false
+	}
+	docs := []bson.M{o.Object}
+	switch {
+	case o.Operation == "u" && o.FullDocument != nil:
+		docs = []bson.M{o.FullDocument}
+	case o.Operation == "u" && !replacing(o.Object):
+		set, _ := o.Object["$set"].(bson.M)
+		docs = []bson.M{o.QueryObject, set}
+	case o.Operation == "d" && o.FullDocumentBefore != nil:
+		docs = []bson.M{o.FullDocumentBefore}
+	}
+next:
+	for path, want := range sub.filter {
+		for _, doc := range docs {
+			if v, ok := lookupPath(doc, path); ok && sameID(v, want) {
+				continue next
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// documentChange returns the DocumentChange of o, not ok if it's not one
+func documentChange(o *Oplog) (bson.M, bool) {
+	id, ok := documentID(o)
+	if !ok || o.DDL != nil {
+		return nil, false
+	}
+	change := bson.M{
+		"namespace": o.Namespace,
+		"id":        id,
+		"timestamp": optime.Format(o.Timestamp),
+		"source":    streamName(o.Source, o.Shard),
+		"document":  nil, "documentBefore": nil, "updateDescription": nil,
+	}
+	if o.FullDocumentBefore != nil {
+		change["documentBefore"] = o.FullDocumentBefore
+	}
+	switch {
+	case o.Operation == "i":
+		change["operation"], change["document"] = "INSERT", o.Object
+	case o.Operation == "u" && replacing(o.Object):
+		change["operation"], change["document"] = "REPLACE", o.Object
+	case o.Operation == "u":
+		change["operation"] = "UPDATE"
+		if o.FullDocument != nil {
+			change["document"] = o.FullDocument
+		}
+		set, _ := o.Object["$set"].(bson.M)
+		if set == nil {
+			set = bson.M{}
+		}
+		removed := []string{}
+		if unset, ok := o.Object["$unset"].(bson.M); ok {
+			for field := range unset {
+				removed = append(removed, field)
+			}
+			sort.Strings(removed)
+		}
+		change["updateDescription"] = bson.M{"updatedFields": set, "removedFields": removed}
+	case o.Operation == "d":
+		change["operation"] = "DELETE"
+	default:
+		return nil, false
+	}
+	return change, true
+}
+
+// answer returns the next event's data of change, the fields selected in
+// the order they were
+func (sub *subscriber) answer(change bson.M) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"data":{`)
+	writeKey(&buf, sub.alias)
+	buf.WriteByte('{')
+	for i, f := range sub.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeKey(&buf, f.Alias)
+		if f.Name == "__typename" {
+			buf.WriteString(`"DocumentChange"`)
+			continue
+		}
+		v := change[f.Name]
+		var data []byte
+		var err error
+		switch v.(type) {
+		case string:
+			data, err = json.Marshal(v)
+		default:
+			data, err = bsonfile.MarshalJSON(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(bytes.TrimSpace(data))
+	}
+	buf.WriteString("}}}")
+	return buf.Bytes(), nil
+}
+
+func writeKey(buf *bytes.Buffer, name string) {
+	k, _ := json.Marshal(name)
+	buf.Write(k)
+	buf.WriteByte(':')
+}
@@ -0,0 +1,158 @@
+package tail
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/ws"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const ordersSubscription = `subscription { paid: documentChanged(namespace: "app.orders", filter: {status: "paid"}) { operation id } }`
+
+// wsBridge serves a bridge over httptest and dials it, GRAPHQL_BUFFER
+// at buffer
+func wsBridge(t *testing.T, buffer int) (*bridge, *ws.Conn) {
+	old := *graphqlBuffer
+	*graphqlBuffer = buffer
+	t.Cleanup(func() { *graphqlBuffer = old })
+	b := &bridge{subs: make(map[*subscriber]bool)}
+	s := httptest.NewServer(b)
+	t.Cleanup(s.Close)
+	conn, err := ws.Dial(s.URL+"/graphql", "graphql-transport-ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(ws.CloseNormal, "") })
+	return b, conn
+}
+
+func sendWS(t *testing.T, conn *ws.Conn, msg string) {
+	t.Helper()
+	if err := conn.WriteText([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readWS(t *testing.T, conn *ws.Conn) wsMessage {
+	t.Helper()
+	data, err := conn.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m wsMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("%s: %s", data, err)
+	}
+	return m
+}
+
+// subscribers waits for the bridge to have n subscriptions
+func subscribers(t *testing.T, b *bridge, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		got := len(b.subs)
+		b.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers, want %d", got, n)
+		}
+	}
+}
+
+func TestBridgeWebsocket(t *testing.T) {
+	b, conn := wsBridge(t, 10)
+	sendWS(t, conn, `{"type":"connection_init","payload":{}}`)
+	if m := readWS(t, conn); m.Type != "connection_ack" {
+		t.Fatalf("connection_init answered with %+v", m)
+	}
+	sendWS(t, conn, `{"type":"ping"}`)
+	if m := readWS(t, conn); m.Type != "pong" {
+		t.Fatalf("ping answered with %+v", m)
+	}
+	sendWS(t, conn, subscribeOrders("1"))
+	subscribers(t, b, 1)
+
+	b.publish(&Oplog{Operation: "i", Namespace: "app.orders", Object: bson.M{"_id": 1, "status": "open"}})
+	b.publish(&Oplog{Operation: "i", Namespace: "app.orders", Object: bson.M{"_id": 2, "status": "paid"}})
+	m := readWS(t, conn)
+	if m.ID != "1" || m.Type != "next" || string(m.Payload) != `{"data":{"paid":{"operation":"INSERT","id":2}}}` {
+		t.Errorf("got %s %s %s, want the paid order next", m.ID, m.Type, m.Payload)
+	}
+
+	sendWS(t, conn, `{"id":"1","type":"complete"}`)
+	subscribers(t, b, 0)
+}
+
+func TestBridgeWebsocketTooFarBehind(t *testing.T) {
+	b, conn := wsBridge(t, 1)
+	sendWS(t, conn, `{"type":"connection_init"}`)
+	readWS(t, conn)
+	sendWS(t, conn, subscribeOrders("a"))
+	subscribers(t, b, 1)
+	b.mu.Lock() // ended as publish does one with a full buffer
+	for sub := range b.subs {
+		close(sub.events)
+		sub.events = nil
+	}
+	b.mu.Unlock()
+	if m := readWS(t, conn); m.ID != "a" || m.Type != "next" || string(m.Payload) != tooFarBehind {
+		t.Errorf("got %s %s %s, want too far behind", m.ID, m.Type, m.Payload)
+	}
+	if m := readWS(t, conn); m.ID != "a" || m.Type != "complete" {
+		t.Errorf("too far behind followed by %+v", m)
+	}
+	subscribers(t, b, 0)
+}
+
+func TestBridgeWebsocketErrors(t *testing.T) {
+	_, conn := wsBridge(t, 10)
+	sendWS(t, conn, subscribeOrders("1"))
+	if _, err := conn.Read(); closeCode(err) != 4401 {
+		t.Errorf("subscribing before connection_init read %v", err)
+	}
+
+	_, conn = wsBridge(t, 10)
+	sendWS(t, conn, `{"type":"connection_init"}`)
+	readWS(t, conn)
+	sendWS(t, conn, `{"id":"1","type":"subscribe","payload":{"query":"{ a }"}}`)
+	if m := readWS(t, conn); m.ID != "1" || m.Type != "error" || !strings.Contains(string(m.Payload), "not a query") {
+		t.Errorf("a query answered with %s %s", m.Type, m.Payload)
+	}
+	sendWS(t, conn, subscribeOrders("1"))
+	sendWS(t, conn, subscribeOrders("1"))
+	if _, err := conn.Read(); closeCode(err) != 4409 {
+		t.Errorf("subscribing to an id twice read %v", err)
+	}
+
+	_, conn = wsBridge(t, 10)
+	sendWS(t, conn, `{"type":"connection_init"}`)
+	readWS(t, conn)
+	sendWS(t, conn, `{"type":"connection_init"}`)
+	if _, err := conn.Read(); closeCode(err) != 4429 {
+		t.Errorf("a second connection_init read %v", err)
+	}
+}
+
+func closeCode(err error) int {
+	var ce *ws.CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return 0
+}
+
+// subscribeOrders is the subscribe message of ordersSubscription
+func subscribeOrders(id string) string {
+	payload, _ := json.Marshal(subscribeRequest{Query: ordersSubscription})
+	data, _ := json.Marshal(wsMessage{ID: id, Type: "subscribe", Payload: payload})
+	return string(data)
+}
@@ -0,0 +1,206 @@
+package tail
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/pitr"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	maxDocumentBytes = flags.Int("MAX_DOCUMENT_BYTES", 0, "bson size past which an entry's documents are replaced by a marker, or a pointer to LARGE_OBJECTS, 0 for no limit")
+	maxArrayLength   = flags.Int("MAX_ARRAY_LENGTH", 0, "elements an array is cut to, the rest replaced by a marker, 0 for no limit")
+	maxDepth         = flags.Int("MAX_DEPTH", 0, "levels of nested documents and arrays kept, deeper ones replaced by a marker, 0 for no limit")
+	largeObjects     = flags.String("LARGE_OBJECTS", "", "directory or s3://bucket/prefix documents past a limit are written to whole, as bson, a pointer to them printed instead of cutting them")
+)
+
+var (
+	truncatedDocuments = expvar.NewInt("truncated_documents")
+	largeDocuments     = expvar.NewInt("large_documents")
+)
+
+// guard keeps pathological documents from going out whole, cutting them
+// down to the limits with markers of what's missing or moving them to
+// LARGE_OBJECTS. Nil without limits.
+type guard struct {
+	store pitr.Store // nil without LARGE_OBJECTS
+}
+
+func newGuard() (*guard, error) {
+	if *maxDocumentBytes < 0 || *maxArrayLength < 0 || *maxDepth < 0 {
+		return nil, cli.Invalidf("MAX_DOCUMENT_BYTES, MAX_ARRAY_LENGTH and MAX_DEPTH can't be negative")
+	}
+	if *maxDocumentBytes == 0 && *maxArrayLength == 0 && *maxDepth == 0 {
+		if *largeObjects != "" {
+			return nil, cli.Invalidf("LARGE_OBJECTS needs one of MAX_DOCUMENT_BYTES, MAX_ARRAY_LENGTH or MAX_DEPTH")
+		}
+		return nil, nil
+	}
+	g := &guard{}
+	if *largeObjects != "" {
+		store, err := pitr.Open(*largeObjects)
+		if err != nil {
+			return nil, err
+		}
+		g.store = store
+	}
+	return g, nil
+}
+
+// apply cuts or moves the documents of o past a limit, in place
+func (g *guard) apply(o *Oplog) error {
+	if g == nil {
+		return nil
+	}
+	for _, d := range []struct {
+		name string
+		doc  *bson.M
+	}{
+		{"o", &o.Object},
+		{"o2", &o.QueryObject},
+		{"fullDocument", &o.FullDocument},
+		{"fullDocumentBeforeChange", &o.FullDocumentBefore},
+	} {
+		if *d.doc == nil {
+			continue
+		}
+		size, over, err := exceeds(*d.doc)
+		if err != nil {
+			return err
+		}
+		if !over {
+			continue
+		}
+		if g.store != nil {
+			if *d.doc, err = g.move(o, d.name, *d.doc, size); err != nil {
+				return err
+			}
+			largeDocuments.Add(1)
+			continue
+		}
+		*d.doc = cut(*d.doc, size)
+		truncatedDocuments.Add(1)
+	}
+	return nil
+}
+
+// exceeds reports whether doc is past a limit, returning its bson size
+func exceeds(doc bson.M) (int, bool, error) {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return 0, false, err
+	}
+	if *maxDocumentBytes > 0 && len(raw) > *maxDocumentBytes {
+		return len(raw), true, nil
+	}
+	return len(raw), past(doc, 1), nil
+}
+
+// past reports whether v, at depth, holds an array too long or a level
+// too deep
+func past(v interface{}, depth int) bool {
+	var children []interface{}
+	switch v := v.(type) {
+	case bson.M:
+		for _, e := range v {
+			children = append(children, e)
+		}
+	case bson.D:
+		for _, e := range v {
+			children = append(children, e.Value)
+		}
+	case []interface{}:
+		if *maxArrayLength > 0 && len(v) > *maxArrayLength {
+			return true
+		}
+		children = v
+	default:
+		return false
+	}
+	if *maxDepth > 0 && depth > *maxDepth {
+		return true
+	}
+	for _, c := range children {
+		if past(c, depth+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// move writes doc whole to LARGE_OBJECTS, returning the pointer to it,
+// keeping the _id
+func (g *guard) move(o *Oplog, field string, doc bson.M, size int) (bson.M, error) {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s.%d.%d.%s.bson", o.Namespace, int64(o.Timestamp)>>32, uint32(o.Timestamp), field)
+	if err := g.store.Put(name, raw); err != nil {
+		return nil, fmt.Errorf("LARGE_OBJECTS: %s", err)
+	}
+	pointer := bson.M{"$large": bson.M{"url": fmt.Sprint(g.store) + "/" + name, "bytes": size}}
+	if id, ok := doc["_id"]; ok {
+		pointer["_id"] = id
+	}
+	return pointer, nil
+}
+
+// cut returns doc within the limits: arrays cut to MAX_ARRAY_LENGTH ending
+// in {"$truncated": elements dropped}, levels past MAX_DEPTH replaced by
+// {"$truncated": "depth"}, and if it's still past MAX_DOCUMENT_BYTES, the
+// whole of it but the _id by {"$truncated": bytes}
+func cut(doc bson.M, size int) bson.M {
+	out := cutValue(doc, 1).(bson.M)
+	if *maxDocumentBytes == 0 {
+		return out
+	}
+	if raw, err := bson.Marshal(out); err == nil && len(raw) <= *maxDocumentBytes {
+		return out
+	}
+	marker := bson.M{"$truncated": size}
+	if id, ok := doc["_id"]; ok {
+		marker["_id"] = id
+	}
+	return marker
+}
+
+func cutValue(v interface{}, depth int) interface{} {
+	switch v.(type) {
+	case bson.M, bson.D, []interface{}:
+		if *maxDepth > 0 && depth > *maxDepth {
+			return bson.M{"$truncated": "depth"}
+		}
+	}
+	switch v := v.(type) {
+	case bson.M:
+		out := make(bson.M, len(v))
+		for k, e := range v {
+			out[k] = cutValue(e, depth+1)
+		}
+		return out
+	case bson.D:
+		out := make(bson.D, len(v))
+		for i, e := range v {
+			out[i] = bson.DocElem{Name: e.Name, Value: cutValue(e.Value, depth+1)}
+		}
+		return out
+	case []interface{}:
+		n := len(v)
+		if *maxArrayLength > 0 && n > *maxArrayLength {
+			n = *maxArrayLength
+		}
+		out := make([]interface{}, n, n+1)
+		for i := range out {
+			out[i] = cutValue(v[i], depth+1)
+		}
+		if n < len(v) {
+			out = append(out, bson.M{"$truncated": len(v) - n})
+		}
+		return out
+	}
+	return v
+}
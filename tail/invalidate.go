@@ -0,0 +1,207 @@
+package tail
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cache"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	invalidateKeys = flags.String("INVALIDATE_KEYS", "", `json file of the templates of the cache keys per namespace deleted from INVALIDATE_URL on its updates and deletes, {"app.users": ["user:{_id}", "user:email:{email}"]}, a {dotted.path} replaced by the document's value`)
+	invalidateURL  = flags.String("INVALIDATE_URL", "", "cache INVALIDATE_KEYS are deleted from, redis://host:port/db, rediss:// or memcached://host:port, authenticated as the basic SINK_AUTH_FILE entry of cache")
+)
+
+var invalidatedKeys = expvar.NewInt("invalidated_keys")
+
+// invalidator deletes the cache keys of the documents changed. A nil
+// invalidator, without INVALIDATE_KEYS, deletes nothing.
+type invalidator struct {
+	templates map[string][]keyTemplate
+	cache     *cache.Client
+}
+
+// keyTemplate is a key's literal text, parts[0], parts[2]..., around the
+// paths of the values between, parts[1], parts[3]...
+type keyTemplate struct {
+	parts []string
+}
+
+func parseKeyTemplate(s string) (keyTemplate, error) {
+	var t keyTemplate
+	for {
+		i := strings.IndexAny(s, "{}")
+		if i < 0 {
+			t.parts = append(t.parts, s)
+			break
+		}
+		j := strings.Index(s[i:], "}")
+		if s[i] == '}' || j < 0 || j == 1 {
+			return keyTemplate{}, fmt.Errorf("unbalanced or empty braces")
+		}
+		path := s[i+1 : i+j]
+		if strings.Contains(path, "{") {
+			return keyTemplate{}, fmt.Errorf("unbalanced or empty braces")
+		}
+		t.parts = append(t.parts, s[:i], path)
+		s = s[i+j+1:]
+	}
+	if len(t.parts) == 1 {
+		return keyTemplate{}, fmt.Errorf("no {path} in it, so one key'd be deleted on every change")
+	}
+	return t, nil
+}
+
+// key returns the key of doc, not ok if doc lacks one of its paths
+func (t keyTemplate) key(doc bson.M) (string, bool) {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		v, ok := lookupPath(doc, part)
+		if !ok || v == nil {
+			return "", false
+		}
+		b.WriteString(keyValue(v))
+	}
+	return b.String(), true
+}
+
+// keyValue writes a value as it'd be in a key: strings as they are,
+// ObjectIds in hex, numbers in decimal, times in RFC 3339 and the rest
+// as extended json
+func keyValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bson.ObjectId:
+		return v.Hex()
+	case int, int32, int64, bool:
+		return fmt.Sprint(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return compactJSON(v)
+}
+
+func newInvalidator() (*invalidator, error) {
+	if *invalidateKeys == "" {
+		return nil, nil
+	}
+	if *invalidateURL == "" {
+		return nil, cli.Invalidf("INVALIDATE_KEYS needs an INVALIDATE_URL to delete them from")
+	}
+	data, err := ioutil.ReadFile(*invalidateKeys)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string][]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, cli.Invalidf("INVALIDATE_KEYS %s: %s", *invalidateKeys, err)
+	}
+	inv := &invalidator{templates: make(map[string][]keyTemplate, len(keys))}
+	for ns, list := range keys {
+		for _, k := range list {
+			t, err := parseKeyTemplate(k)
+			if err != nil {
+				return nil, cli.Invalidf("INVALIDATE_KEYS %s, %s %q: %s", *invalidateKeys, ns, k, err)
+			}
+			inv.templates[ns] = append(inv.templates[ns], t)
+		}
+	}
+	if inv.cache, err = openCache(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// openCache connects to INVALIDATE_URL
+func openCache() (*cache.Client, error) {
+	auths, err := sinkauth.Load()
+	if err != nil {
+		return nil, err
+	}
+	var user, password string
+	if auth := auths.Get("cache"); auth != nil {
+		if auth.Type != "basic" {
+			return nil, cli.Invalidf("the cache SINK_AUTH_FILE entry must be basic, not %s", auth.Type)
+		}
+		user, password = auth.User, auth.Password
+	}
+	return cache.Open(*invalidateURL, user, password)
+}
+
+// apply deletes the keys of the document o updates, replaces or deletes,
+// as it was and as it is so a changed field's old key goes too. Without
+// the documents change streams give, keys are made of the _id and what
+// an update sets. It fails once the cache's given up on, so the entry's
+// tailed again on restart rather than a stale key left.
+func (inv *invalidator) apply(o *Oplog) error {
+	if inv == nil || o.Backfill || (o.Operation != "u" && o.Operation != "d") {
+		return nil
+	}
+	templates := inv.templates[o.Namespace]
+	if len(templates) == 0 {
+		return nil
+	}
+	id, ok := documentID(o)
+	if !ok {
+		return nil
+	}
+	docs := []bson.M{{"_id": id}}
+	if o.FullDocumentBefore != nil {
+		docs = append(docs, o.FullDocumentBefore)
+	}
+	switch {
+	case o.Operation == "d":
+	case o.FullDocument != nil:
+		docs = append(docs, o.FullDocument)
+	case replacing(o.Object):
+		docs = append(docs, o.Object)
+	default:
+		// the _id with what's set, at the dotted paths it's set at
+		set, _ := o.Object["$set"].(bson.M)
+		doc := bson.M{"_id": id}
+		for path, v := range set {
+			doc[path] = v
+		}
+		docs = append(docs, doc)
+	}
+	seen := map[string]bool{}
+	var keys []string
+	for _, t := range templates {
+		for _, doc := range docs {
+			if k, ok := t.key(doc); ok && !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	if err := inv.cache.Delete(keys...); err != nil {
+		return fmt.Errorf("%s at %d: %s", o.Namespace, o.Timestamp, err)
+	}
+	invalidatedKeys.Add(int64(len(keys)))
+	return nil
+}
+
+func (inv *invalidator) close() error {
+	if inv == nil {
+		return nil
+	}
+	return inv.cache.Close()
+}
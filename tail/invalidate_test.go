@@ -0,0 +1,170 @@
+package tail
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cache"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	id := bson.ObjectIdHex("5f0c8e3a9d1e4b2a3c4d5e6f")
+	doc := bson.M{
+		"_id":     id,
+		"email":   "ada@example.com",
+		"n":       7,
+		"price":   12.5,
+		"at":      time.Date(2026, 10, 14, 12, 0, 0, 0, time.FixedZone("", 3600)),
+		"profile": bson.M{"handle": "ada", "tags": []interface{}{"a", "b"}},
+		"none":    nil,
+	}
+	for _, c := range []struct {
+		template, key string // no key for a document lacking a path
+	}{
+		{"user:{_id}", "user:5f0c8e3a9d1e4b2a3c4d5e6f"},
+		{"user:email:{email}", "user:email:ada@example.com"},
+		{"{n}-{price}", "7-12.5"},
+		{"at:{at}", "at:2026-10-14T11:00:00Z"},
+		{"handle:{profile.handle}:{_id}", "handle:ada:5f0c8e3a9d1e4b2a3c4d5e6f"},
+		{"tags:{profile.tags}", `tags:["a","b"]`},
+		{"user:{missing}", ""},
+		{"user:{none}", ""},
+		{"user:{profile.missing}", ""},
+	} {
+		tmpl, err := parseKeyTemplate(c.template)
+		if err != nil {
+			t.Errorf("%s: %s", c.template, err)
+			continue
+		}
+		key, ok := tmpl.key(doc)
+		if c.key == "" {
+			if ok {
+				t.Errorf("%s gave the key %s of a document without its path", c.template, key)
+			}
+		} else if !ok || key != c.key {
+			t.Errorf("%s gave %q, %t, want %s", c.template, key, ok, c.key)
+		}
+	}
+}
+
+func TestKeyTemplateInvalid(t *testing.T) {
+	for _, s := range []string{"user", "user:{}", "user:{_id", "user:_id}", "user:{{_id}}", "{a}}"} {
+		if _, err := parseKeyTemplate(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+// fakeRedis accepts one redis client on a loopback port, answering each
+// command with the number of its arguments and passing them on
+func fakeRedis(t *testing.T) (string, <-chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan []string, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, n)
+			for i := range args {
+				r.ReadString('\n') // the $length, these keys have no line breaks
+				arg, _ := r.ReadString('\n')
+				args[i] = strings.TrimSuffix(arg, "\r\n")
+			}
+			got <- args
+			conn.Write([]byte(":" + strconv.Itoa(n-1) + "\r\n"))
+		}
+	}()
+	return "redis://" + ln.Addr().String(), got
+}
+
+func TestInvalidatorApply(t *testing.T) {
+	url, got := fakeRedis(t)
+	c, err := cache.Open(url, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := &invalidator{templates: map[string][]keyTemplate{}, cache: c}
+	defer inv.close()
+	for _, s := range []string{"user:{_id}", "user:email:{email}", "user:city:{address.city}"} {
+		tmpl, err := parseKeyTemplate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inv.templates["app.users"] = append(inv.templates["app.users"], tmpl)
+	}
+
+	for _, c := range []struct {
+		name string
+		o    *Oplog
+		keys string // empty for nothing deleted
+	}{
+		{"insert", &Oplog{Operation: "i", Namespace: "app.users", Object: bson.M{"_id": 1, "email": "a@example.com"}}, ""},
+		{"delete", &Oplog{Operation: "d", Namespace: "app.users", Object: bson.M{"_id": 1}}, "user:1"},
+		{"other namespace", &Oplog{Operation: "d", Namespace: "app.orders", Object: bson.M{"_id": 1}}, ""},
+		{"backfill", &Oplog{Operation: "d", Namespace: "app.users", Object: bson.M{"_id": 1}, Backfill: true}, ""},
+		{
+			"update of what's set",
+			&Oplog{Operation: "u", Namespace: "app.users", QueryObject: bson.M{"_id": 2}, Object: bson.M{"$set": bson.M{"email": "b@example.com", "address.city": "Oslo"}}},
+			"user:2 user:city:Oslo user:email:b@example.com",
+		},
+		{
+			"replacement",
+			&Oplog{Operation: "u", Namespace: "app.users", QueryObject: bson.M{"_id": 3}, Object: bson.M{"_id": 3, "email": "c@example.com"}},
+			"user:3 user:email:c@example.com",
+		},
+		{
+			"update of the document looked up",
+			&Oplog{Operation: "u", Namespace: "app.users", QueryObject: bson.M{"_id": 4}, Object: bson.M{"$set": bson.M{"n": 1}}, FullDocument: bson.M{"_id": 4, "email": "d@example.com", "address": bson.M{"city": "Bergen"}}},
+			"user:4 user:city:Bergen user:email:d@example.com",
+		},
+		{
+			"update with pre and post-images",
+			&Oplog{Operation: "u", Namespace: "app.users", QueryObject: bson.M{"_id": 5}, Object: bson.M{"$set": bson.M{"email": "f@example.com"}}, FullDocumentBefore: bson.M{"_id": 5, "email": "e@example.com"}, FullDocument: bson.M{"_id": 5, "email": "f@example.com"}},
+			"user:5 user:email:e@example.com user:email:f@example.com",
+		},
+		{
+			"delete with a pre-image",
+			&Oplog{Operation: "d", Namespace: "app.users", Object: bson.M{"_id": 6}, FullDocumentBefore: bson.M{"_id": 6, "email": "g@example.com"}},
+			"user:6 user:email:g@example.com",
+		},
+	} {
+		if err := inv.apply(c.o); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if c.keys == "" {
+			continue
+		}
+		select {
+		case args := <-got:
+			if args[0] != "DEL" || strings.Join(args[1:], " ") != c.keys {
+				t.Errorf("%s sent %q, want DEL %s", c.name, args, c.keys)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s deleted nothing", c.name)
+		}
+	}
+	select {
+	case args := <-got:
+		t.Errorf("sent %q, more than the keys", args)
+	default:
+	}
+}
@@ -1,9 +1,20 @@
-package main
+// Package tail tails the oplogs or change streams of one or more clusters, the oplogctl tail command.
+package tail
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+	"sync"
+	"time"
 
-	"github.com/ianschenck/envflag"
+	"github.com/hanjoyo/oplog-abuse/chaos"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/clock"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/diff"
+	"github.com/hanjoyo/oplog-abuse/encrypt"
+	"github.com/hanjoyo/oplog-abuse/optime"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -11,19 +22,68 @@ import (
 
 // Oplog an individual document from the oplog.rs collection
 type Oplog struct {
-	Timestamp    bson.MongoTimestamp `bson:"ts"`
-	HistoryID    int64               `bson:"h"`
-	MongoVersion int                 `bson:"v"`
-	Operation    string              `bson:"op"`
-	Namespace    string              `bson:"ns"`
-	Object       bson.M              `bson:"o"`
-	QueryObject  bson.M              `bson:"o2"`
+	Timestamp          bson.MongoTimestamp `bson:"ts"`
+	HistoryID          int64               `bson:"h"`
+	MongoVersion       int                 `bson:"v"`
+	Operation          string              `bson:"op"`
+	Namespace          string              `bson:"ns"`
+	Object             bson.M              `bson:"o"`
+	QueryObject        bson.M              `bson:"o2"`
+	FromMigrate        bool                `bson:"fromMigrate"`
+	Wall               time.Time           `bson:"wall"` // when the server wrote it, 3.6 onwards
+	FullDocument       bson.M              `bson:"-"`    // the document after an update or replace, from change streams
+	FullDocumentBefore bson.M              `bson:"-"`    // the document before an update, replace or delete, from change streams with pre-images
+	ClusterTime        bson.MongoTimestamp `bson:"-"`    // observed on the stream when read
+	Arrived            time.Time           `bson:"-"`
+	Source             string              `bson:"-"` // label of the cluster, from MONGO_URLS
+	Shard              string              `bson:"-"` // set when tailing through mongos
+	DDL                *DDL                `bson:"-"` // set on schema changes
+	Backfill           bool                `bson:"-"` // a document read by BACKFILL, not a change
+
+	// set on the operations of a transaction
+	LSID            bson.M              `bson:"lsid"`
+	TxnNumber       int64               `bson:"txnNumber"`
+	CommitTimestamp bson.MongoTimestamp `bson:"-"`
+	Resume          bson.MongoTimestamp `bson:"-"` // checkpointed instead of ts, behind it while a transaction is open
+}
+
+var flags = cli.NewFlagSet("tail", "tail oplogs or change streams of one or more clusters, printing their entries")
+
+func init() {
+	cli.Register(flags, Main)
 }
 
 var (
-	mongoURL = envflag.String("MONGO_URL", "mongodb://localhost", "mongodb url to connect to")
+	mongoURL      = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url to connect to, mongodb 3.0 to 7.x")
+	resumeRetries = flags.Int("RESUME_RETRIES", 5, "times in a row a failed oplog cursor is resumed before giving up")
+	encryptFields = flags.String("ENCRYPT_FIELDS", "", "fields sealed before printing as ns:dotted.path, comma separated")
+	encryptKey    = flags.String("ENCRYPT_KEY", "", "data key for ENCRYPT_FIELDS, file:<path> or vault:<transit key name>")
+	migrations    = flags.Bool("MIGRATIONS", false, "also print the inserts and deletes of chunk migrations and orphan cleanup")
+)
+
+// cursorChaos drops oplog cursors, checkpointChaos fails checkpoint writes
+var (
+	cursorChaos     = chaos.New("tail cursor")
+	checkpointChaos = chaos.New("tail checkpoint")
 )
 
+// sysClock is what entries are stamped as arrived by, and what the window,
+// shard merging and partition leases go by, a clock.Sim to drive them
+// without sleeps
+var sysClock clock.Clock = clock.Real
+
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func printOplog(oplog *Oplog) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	fmt.Fprintf(buf, "%+v\n", *oplog)
+	os.Stdout.Write(buf.Bytes())
+	bufPool.Put(buf)
+}
+
 // LatestOplog returns the most recent oplog from the database
 func latestOplog(sess *mgo.Session) (Oplog, error) {
 	var oplog Oplog
@@ -31,36 +91,354 @@ func latestOplog(sess *mgo.Session) (Oplog, error) {
 	return oplog, err
 }
 
-func main() {
-	envflag.Parse()
-	sess, err := mgo.Dial(*mongoURL)
-	if err != nil {
+// checkRetained fails with cli.ExitRolledOver if the oplog has rolled
+// over past since, resuming would skip what it lost
+func checkRetained(sess *mgo.Session, since bson.MongoTimestamp) error {
+	var oldest Oplog
+	if err := sess.DB("local").C("oplog.rs").Find(nil).Sort("$natural").One(&oldest); err != nil {
+		return err
+	}
+	if oldest.Timestamp > since {
+		return cli.RolledOverf("the oplog starts at %s, entries after the checkpoint at %s were lost", optime.Format(oldest.Timestamp), optime.Format(since))
+	}
+	return nil
+}
+
+// Main runs oplogctl tail, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if err := loadSampling(); err != nil {
 		panic(err)
 	}
+	flags.Reload([]string{"SAMPLE"}, loadSampling)
 
-	// need last oplog timestamp to make tailing query
-	lo, err := latestOplog(sess)
+	enc, err := encrypt.New(*encryptFields, *encryptKey)
+	if err != nil {
+		panic(err)
+	}
+	tagged, enc, err := newDetector(enc)
 	if err != nil {
 		panic(err)
 	}
 
-	iter := sess.DB("local").
-		C("oplog.rs").
-		Find(bson.M{"ts": bson.M{"$gte": lo.Timestamp}}). // can filter the query even more: certain ns or operations
-		Sort("$natural").
-		LogReplay().
-		Tail(-1) // tail forever
+	sources, err := parseSources(*mongoURLs, *mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	if *atlasProject != "" {
+		if sources, err = atlasSources(); err != nil {
+			panic(err)
+		}
+	}
+	cps, err := newCheckpoints(*checkpointDir)
+	if err != nil {
+		panic(err)
+	}
+	serveMetrics()
+	if *sourceMode != "auto" && *sourceMode != "oplog" && *sourceMode != "changestream" {
+		panic(cli.Invalidf("unknown SOURCE %q", *sourceMode))
+	}
+	if err := checkImages(); err != nil {
+		panic(err)
+	}
+	if err := checkCompat(); err != nil {
+		panic(err)
+	}
+	if err := checkPartitions(sources); err != nil {
+		panic(err)
+	}
+	if *mergeWindow <= 0 {
+		panic(cli.Invalidf("SHARD_MERGE_WINDOW must be positive"))
+	}
 
-	var oplog Oplog
-	for iter.Next(&oplog) {
-		fmt.Printf("%+v\n", oplog)
+	win, err := newWindow()
+	if err != nil {
+		panic(err)
+	}
+	wanted := *limit
+	if *exitOnFirstMatch {
+		wanted = 1
+	}
+	if wanted < 0 {
+		panic(cli.Invalidf("LIMIT must not be negative"))
+	}
+	printed := 0
+	defer win.summary() // once the terminal is back
+	show, err := newPrinter()
+	if err != nil {
+		panic(err)
+	}
+	if *tui {
+		t, err := newInspector()
+		if err != nil {
+			panic(err)
+		}
+		defer t.restore()
+		show = t.add
+	}
+	follow, err := newFollower()
+	if err != nil {
+		panic(err)
+	}
+	if follow != nil && !*tui {
+		show = follow.print
 	}
-	err = iter.Err()
+	capture, err := newCapture()
 	if err != nil {
 		panic(err)
 	}
-	err = iter.Close()
+	defer capture.close()
+	inferred, err := newSchemas()
 	if err != nil {
 		panic(err)
 	}
+	validated, err := newGate()
+	if err != nil {
+		panic(err)
+	}
+	profiled, err := newProfiles()
+	if err != nil {
+		panic(err)
+	}
+	guarded, err := newGuard()
+	if err != nil {
+		panic(err)
+	}
+	bridged, err := newBridge()
+	if err != nil {
+		panic(err)
+	}
+	published, err := newPublisher()
+	if err != nil {
+		panic(err)
+	}
+	defer published.close()
+	invalidated, err := newInvalidator()
+	if err != nil {
+		panic(err)
+	}
+	defer invalidated.close()
+	warehoused, err := newWarehouse()
+	if err != nil {
+		panic(err)
+	}
+
+	tailed := make([]Source, len(sources))
+	for i, src := range sources {
+		tailed[i] = chanSource(sourceCh(src, cps))
+	}
+	entries := fanIn(tailed)
+	for wanted == 0 || printed < wanted {
+		var oplog *Oplog
+		select {
+		case oplog = <-entries:
+		case <-win.ended():
+		}
+		if oplog == nil || win.past(oplog) {
+			break
+		}
+		inferred.observe(oplog)
+		profiled.observe(oplog)
+		tagged.observe(oplog)
+		// every change, sampled or not, or the cache keeps what's stale
+		if err := invalidated.apply(oplog); err != nil {
+			panic(err)
+		}
+		if sampled(samplingRates.Load().(map[string]float64), oplog) && follow.touches(oplog) {
+			// checked as read, sealed and cut down before going anywhere
+			violations := validated.check(oplog)
+			if err := enc.Apply(oplog.Namespace, oplog.Object, oplog.QueryObject, oplog.FullDocument, oplog.FullDocumentBefore); err != nil {
+				panic(err)
+			}
+			if err := guarded.apply(oplog); err != nil {
+				panic(err)
+			}
+			if violations != nil {
+				if err := validated.quarantine(oplog, violations); err != nil {
+					panic(err)
+				}
+			} else {
+				show(oplog)
+				bridged.publish(oplog)
+				if err := published.publish(oplog); err != nil {
+					panic(err)
+				}
+				if err := capture.record(oplog); err != nil {
+					panic(err)
+				}
+				if err := warehoused.record(oplog); err != nil {
+					panic(err)
+				}
+				win.count(oplog)
+				printed++
+			}
+		}
+		if oplog.Backfill {
+			continue // a restart part way would skip the rest
+		}
+		resume := oplog.Timestamp
+		if oplog.Resume != 0 {
+			resume = oplog.Resume
+		}
+		cps.seen(streamName(oplog.Source, oplog.Shard), resume)
+	}
+	if err := warehoused.close(); err != nil {
+		panic(err)
+	}
+	if err := cps.flush(); err != nil {
+		panic(err)
+	}
+	if err := inferred.close(); err != nil {
+		panic(err)
+	}
+	if err := profiled.flush(); err != nil {
+		panic(err)
+	}
+	if err := validated.close(); err != nil {
+		panic(err)
+	}
+	if err := tagged.close(); err != nil {
+		panic(err)
+	}
+	if *exitOnFirstMatch && printed == 0 {
+		panic(errNoMatch) // past the summary, and only once all went well
+	}
+}
+
+// tailQuery matches entries with ts cmp ts. Chunk migrations copy documents
+// between shards by inserting them on one and deleting them from the other,
+// marked fromMigrate, so unless MIGRATIONS is set these are left out: as
+// far as the cluster is concerned nothing changed.
+func tailQuery(cmp string, ts bson.MongoTimestamp) bson.M {
+	query := bson.M{"ts": bson.M{cmp: ts}} // can filter the query even more: certain ns or operations
+	if !*migrations {
+		query["fromMigrate"] = bson.M{"$ne": true}
+	}
+	return query
+}
+
+// tailCh tails sess's oplog, tagging entries with source and shard. It
+// starts after the stream's checkpoint, or from the latest entry without
+// one. A failing cursor is resumed from the last entry seen, most likely it
+// failed because the member it was on went away. When the member is removed
+// or can't serve reads anymore the tail moves to another one.
+func tailCh(sess *mgo.Session, source, shard string, cps *checkpoints) <-chan *Oplog {
+	stream := streamName(source, shard)
+	since, ok, err := cps.load(stream)
+	if err != nil {
+		panic(err)
+	}
+	if parts != nil {
+		since, err = parts.start()
+		if err != nil {
+			panic(err)
+		}
+		ok = since != 0
+	}
+	query := tailQuery("$gt", since)
+	if ok {
+		if err := checkRetained(sess, since); err != nil {
+			panic(err)
+		}
+	} else {
+		// need last oplog timestamp to make tailing query
+		lo, err := latestOplog(sess)
+		if err != nil {
+			panic(err)
+		}
+		query = tailQuery("$gte", lo.Timestamp)
+	}
+	out := make(chan *Oplog)
+	moved := dial.WatchMember(sess)
+	meter := newStreamMeter(stream, sess)
+	cc := newClusterClock(sess)
+	go func() {
+		defer cli.Recover()
+		defer close(out)
+		var last bson.MongoTimestamp // read up to, across cursors
+		txns := newTxnBuffer()
+		for failures := 0; ; failures++ {
+			// a short tail timeout to notice the member moving in quiet times
+			iter := sess.DB("local").
+				C("oplog.rs").
+				Find(query).
+				Sort("$natural").
+				LogReplay().
+				Tail(time.Second)
+
+			var moving string // why the member is moved off
+			var rewind bson.MongoTimestamp
+			var dropped error
+			oplog := new(Oplog)
+			for moving == "" && rewind == 0 {
+				if iter.Next(oplog) {
+					if dropped = cursorChaos.Drop(); dropped != nil {
+						break // read again by the next cursor
+					}
+					failures = 0
+					last = oplog.Timestamp
+					query = tailQuery("$gt", last)
+					oplog.Source, oplog.Shard = source, shard
+					clusterTime := cc.observe(oplog.Timestamp)
+					for _, e := range txns.unwrap(oplog) {
+						e.DDL = parseDDL(e)
+						if e.Operation == "u" {
+							if o, err := diff.NormalizeM(e.Object); err == nil {
+								e.Object = o
+							} else {
+								fmt.Fprintf(os.Stderr, "update at %d left as is: %s\n", e.Timestamp, err)
+							}
+						}
+						e.ClusterTime = clusterTime
+						e.Arrived = sysClock.Now()
+						e.Resume = txns.resume()
+						meter.read(e)
+						if parts.owns(e) {
+							out <- e
+						}
+					}
+					if !txns.holding() {
+						// not past an open transaction, it'd be skipped on restart
+						parts.advance(oplog.Timestamp)
+					}
+					oplog = new(Oplog)
+				} else if !iter.Timeout() {
+					break
+				}
+				select {
+				case moving = <-moved:
+				case rewind = <-parts.rewound():
+				default:
+				}
+			}
+			err := iter.Close()
+			if err == nil {
+				err = dropped
+			}
+			switch {
+			case rewind != 0:
+				fmt.Fprintf(os.Stderr, "rewinding to %d for a partition claimed\n", rewind)
+				parts.restart(rewind, last)
+				query = tailQuery("$gt", rewind)
+				txns = newTxnBuffer() // open ones are read again
+				failures = -1
+				continue
+			case moving != "":
+				fmt.Fprintf(os.Stderr, "oplog member %s, moving to another\n", moving)
+				failures = -1
+				sess.Refresh()
+				continue
+			}
+			if err == nil {
+				return
+			}
+			if failures >= *resumeRetries {
+				panic(err)
+			}
+			fmt.Fprintf(os.Stderr, "oplog cursor failed: %s, resuming\n", err)
+			time.Sleep(time.Second)
+			sess.Refresh()
+		}
+	}()
+	return out
 }
@@ -0,0 +1,39 @@
+package tail_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/tail"
+)
+
+// TestExitOnFirstMatchDialFailure runs Main in a child process against a
+// port nothing listens on: the dial failing has to exit with
+// ExitConnection, not the status 1 of a tail that matched nothing
+func TestExitOnFirstMatchDialFailure(t *testing.T) {
+	if os.Getenv("TAIL_TEST_MAIN") != "" {
+		defer cli.Recover()
+		tail.Main(nil)
+		return
+	}
+	if testing.Short() {
+		t.Skip("waits out the dial timeout")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExitOnFirstMatchDialFailure$")
+	cmd.Env = append(os.Environ(),
+		"TAIL_TEST_MAIN=1",
+		"MONGO_URL=mongodb://127.0.0.1:1/?connect=direct",
+		"EXIT_ON_FIRST_MATCH=true",
+	)
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		t.Fatalf("want the child to fail, got %v:\n%s", err, out)
+	}
+	if got := exit.ExitCode(); got != cli.ExitConnection {
+		t.Errorf("exit status %d, want %d:\n%s", got, cli.ExitConnection, out)
+	}
+}
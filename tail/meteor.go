@@ -0,0 +1,168 @@
+package tail
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ddpMessage is a change as meteor's observers and DDP clients take it,
+// fields in meteor's EJSON
+type ddpMessage struct {
+	Msg        string                 `json:"msg"` // added, changed or removed
+	Collection string                 `json:"collection"`
+	ID         string                 `json:"id"` // as MongoID.idStringify writes it
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	Cleared    []string               `json:"cleared,omitempty"`
+}
+
+var objectIDHex = regexp.MustCompile(`^[0-9a-fA-F]{24}$`)
+
+// meteor returns the message of o, not ok if it's not a document change.
+// An update's fields are the top level ones it sets, taken whole from the
+// document it left when there's one, else at the dotted paths it sets
+// them at, the $set flattened, and cleared the ones it unsets. A replace
+// clears what the document before had if it's known.
+func meteor(o *Oplog) (ddpMessage, bool) {
+	id, ok := documentID(o)
+	if !ok || o.DDL != nil {
+		return ddpMessage{}, false
+	}
+	_, coll, _ := splitNS(o.Namespace)
+	m := ddpMessage{Collection: coll, ID: idStringify(id)}
+	switch {
+	case o.Operation == "i":
+		m.Msg, m.Fields = "added", fieldsOf(o.Object)
+	case o.Operation == "d":
+		m.Msg = "removed"
+	case o.Operation == "u" && replacing(o.Object):
+		m.Msg, m.Fields = "changed", fieldsOf(o.Object)
+		for name := range o.FullDocumentBefore {
+			if _, ok := o.Object[name]; !ok && name != "_id" {
+				m.Cleared = append(m.Cleared, name)
+			}
+		}
+	case o.Operation == "u":
+		m.Msg, m.Fields = "changed", map[string]interface{}{}
+		set, _ := o.Object["$set"].(bson.M)
+		for path, v := range set {
+			top := strings.SplitN(path, ".", 2)[0]
+			if field, ok := o.FullDocument[top]; ok {
+				m.Fields[top] = ejson(field)
+			} else {
+				m.Fields[path] = ejson(v)
+			}
+		}
+		unset, _ := o.Object["$unset"].(bson.M)
+		for path := range unset {
+			top := strings.SplitN(path, ".", 2)[0]
+			if field, ok := o.FullDocument[top]; ok && top != path {
+				m.Fields[top] = ejson(field)
+			} else {
+				m.Cleared = append(m.Cleared, path)
+			}
+		}
+		// the rest, $push of truncations and such, leave the document
+		// the only place to read what changed from
+		for op, v := range o.Object {
+			if op == "$set" || op == "$unset" {
+				continue
+			}
+			paths, _ := v.(bson.M)
+			for path := range paths {
+				top := strings.SplitN(path, ".", 2)[0]
+				if field, ok := o.FullDocument[top]; ok {
+					m.Fields[top] = ejson(field)
+				}
+			}
+		}
+	default:
+		return ddpMessage{}, false
+	}
+	sort.Strings(m.Cleared)
+	return m, true
+}
+
+// fieldsOf returns the fields of doc but its _id
+func fieldsOf(doc bson.M) map[string]interface{} {
+	fields := make(map[string]interface{}, len(doc))
+	for name, v := range doc {
+		if name != "_id" {
+			fields[name] = ejson(v)
+		}
+	}
+	return fields
+}
+
+// idStringify writes an _id as meteor's MongoID.idStringify does: an
+// ObjectId in hex, a string as is unless it could be mistaken for one of
+// the others, prefixed with - then, anything else ~ and its EJSON
+func idStringify(id interface{}) string {
+	switch id := id.(type) {
+	case bson.ObjectId:
+		return id.Hex()
+	case string:
+		if id != "" && (strings.ContainsAny(id[:1], "-~{") || objectIDHex.MatchString(id)) {
+			return "-" + id
+		}
+		return id
+	}
+	data, err := json.Marshal(ejson(id))
+	if err != nil {
+		return "~"
+	}
+	return "~" + string(data)
+}
+
+// ejson returns v as meteor's EJSON writes it, ready for encoding/json
+func ejson(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		m := make(map[string]interface{}, len(v))
+		escape := false
+		for k, e := range v {
+			m[k] = ejson(e)
+			escape = escape || strings.HasPrefix(k, "$")
+		}
+		if escape {
+			return map[string]interface{}{"$escape": m}
+		}
+		return m
+	case bson.D:
+		return ejson(v.Map())
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = ejson(e)
+		}
+		return a
+	case bson.ObjectId:
+		return map[string]interface{}{"$type": "oid", "$value": v.Hex()}
+	case time.Time:
+		return map[string]interface{}{"$date": unixMillis(v)}
+	case []byte:
+		return map[string]interface{}{"$binary": base64.StdEncoding.EncodeToString(v)}
+	case bson.Binary:
+		return map[string]interface{}{"$binary": base64.StdEncoding.EncodeToString(v.Data)}
+	case bson.RegEx:
+		return map[string]interface{}{"$regexp": v.Pattern, "$flags": v.Options}
+	case bson.Decimal128:
+		return map[string]interface{}{"$type": "Decimal", "$value": v.String()}
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return map[string]interface{}{"$InfNaN": 0}
+		case math.IsInf(v, 1):
+			return map[string]interface{}{"$InfNaN": 1}
+		case math.IsInf(v, -1):
+			return map[string]interface{}{"$InfNaN": -1}
+		}
+	}
+	return v
+}
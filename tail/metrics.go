@@ -0,0 +1,111 @@
+package tail
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	metricsAddr = flags.String("METRICS_ADDR", "", "address to serve expvar metrics on at /debug/vars, e.g. \":8080\"")
+)
+
+// streams has a streamMeter's numbers per stream, so imbalances between
+// shards or clusters show
+var streams = expvar.NewMap("streams")
+
+// serveMetrics serves expvar in the background if METRICS_ADDR is set
+func serveMetrics() {
+	if *metricsAddr == "" {
+		return
+	}
+	go func() {
+		defer cli.Recover()
+		if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
+			panic(err)
+		}
+	}()
+}
+
+// streamMeter tracks a stream's throughput and how far behind its oplog
+// head it is. A nil streamMeter, when metrics are off, tracks nothing.
+type streamMeter struct {
+	events int64 // entries read
+	head   int64 // bson.MongoTimestamp of the newest oplog entry
+	last   int64 // bson.MongoTimestamp of the newest entry read
+
+	mu   sync.Mutex
+	rate float64 // events per second over the last interval
+}
+
+type streamSnapshot struct {
+	Events       int64   `json:"events"`
+	EventsPerSec float64 `json:"events_per_sec"`
+	LagSeconds   int64   `json:"lag_seconds"`
+	LastTS       int64   `json:"last_ts"`
+}
+
+// newStreamMeter publishes the meter of stream, polling a copy of sess for
+// the head
+func newStreamMeter(stream string, sess *mgo.Session) *streamMeter {
+	if *metricsAddr == "" {
+		return nil
+	}
+	m := &streamMeter{}
+	streams.Set(stream, expvar.Func(m.snapshot))
+	go m.poll(sess.Copy(), time.Second)
+	return m
+}
+
+// poll refreshes the head and rate every interval, forever
+func (m *streamMeter) poll(sess *mgo.Session, interval time.Duration) {
+	defer cli.Recover()
+	defer sess.Close()
+	prev, at := int64(0), time.Now()
+	for now := range time.Tick(interval) {
+		events := atomic.LoadInt64(&m.events)
+		m.mu.Lock()
+		m.rate = float64(events-prev) / now.Sub(at).Seconds()
+		m.mu.Unlock()
+		prev, at = events, now
+		lo, err := latestOplog(sess)
+		if err != nil {
+			sess.Refresh()
+			continue
+		}
+		atomic.StoreInt64(&m.head, int64(lo.Timestamp))
+	}
+}
+
+func (m *streamMeter) read(o *Oplog) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.events, 1)
+	atomic.StoreInt64(&m.last, int64(o.Timestamp))
+}
+
+func (m *streamMeter) snapshot() interface{} {
+	m.mu.Lock()
+	rate := m.rate
+	m.mu.Unlock()
+	// timestamps only have second resolution
+	head := atomic.LoadInt64(&m.head) >> 32
+	last := atomic.LoadInt64(&m.last)
+	lag := int64(0)
+	if last != 0 && head > last>>32 {
+		lag = head - last>>32
+	}
+	return streamSnapshot{
+		Events:       atomic.LoadInt64(&m.events),
+		EventsPerSec: rate,
+		LagSeconds:   lag,
+		LastTS:       last,
+	}
+}
@@ -0,0 +1,99 @@
+package tail
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/mqtt"
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+)
+
+var (
+	mqttURL      = flags.String("MQTT_URL", "", "mqtt or mqtts url of a broker what's printed is also published to, as the json OUTPUT and CLOUDEVENTS make, authenticated as the basic SINK_AUTH_FILE entry of mqtt")
+	mqttTopic    = flags.String("MQTT_TOPIC", "mongodb/{db}/{collection}/{op}", "topic entries are published to, replaced in as CLOUDEVENTS_SOURCE is")
+	mqttQoS      = flags.Int("MQTT_QOS", 1, "qos entries are published at: 0 at most once, 1 at least once, 2 exactly once")
+	mqttRetain   = flags.Bool("MQTT_RETAIN", false, "have the broker retain the latest entry of each topic for those subscribing later")
+	mqttClientID = flags.String("MQTT_CLIENT_ID", "", "client id on the broker, oplogctl-<host>-<pid> if empty")
+)
+
+// publisher publishes entries to MQTT_URL. A nil publisher, without it,
+// publishes nothing.
+type publisher struct {
+	client *mqtt.Client
+	ev     event
+}
+
+// newPublisher connects to MQTT_URL if it's set
+func newPublisher() (*publisher, error) {
+	if *mqttURL == "" {
+		return nil, nil
+	}
+	if *mqttQoS < 0 || *mqttQoS > 2 {
+		return nil, cli.Invalidf("MQTT_QOS %d must be 0, 1 or 2", *mqttQoS)
+	}
+	if strings.ContainsAny(*mqttTopic, "+#") || *mqttTopic == "" {
+		return nil, cli.Invalidf("MQTT_TOPIC %q must be a topic without wildcards", *mqttTopic)
+	}
+	ev, err := newEvent()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dialBroker()
+	if err != nil {
+		return nil, err
+	}
+	return &publisher{client: client, ev: ev}, nil
+}
+
+// dialBroker connects to MQTT_URL as MQTT_CLIENT_ID
+func dialBroker() (*mqtt.Client, error) {
+	auths, err := sinkauth.Load()
+	if err != nil {
+		return nil, err
+	}
+	var user, password string
+	if auth := auths.Get("mqtt"); auth != nil {
+		if auth.Type != "basic" {
+			return nil, cli.Invalidf("the mqtt SINK_AUTH_FILE entry must be basic, not %s", auth.Type)
+		}
+		user, password = auth.User, auth.Password
+	}
+	id := *mqttClientID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("oplogctl-%s-%d", host, os.Getpid())
+	}
+	return mqtt.Dial(*mqttURL, id, user, password)
+}
+
+// publish publishes o's event to its topic, failing once the broker's
+// given up on so the entry's tailed again on restart
+func (p *publisher) publish(o *Oplog) error {
+	if p == nil {
+		return nil
+	}
+	v, err := p.ev(o)
+	if v == nil || err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	topic := fillIn(o).Replace(*mqttTopic)
+	if strings.ContainsAny(topic, "+#") {
+		fmt.Fprintf(os.Stderr, "mqtt: %s at %d: topic %q has wildcards, skipped\n", o.Namespace, o.Timestamp, topic)
+		return nil
+	}
+	return p.client.Publish(topic, data, byte(*mqttQoS), *mqttRetain)
+}
+
+func (p *publisher) close() error {
+	if p == nil {
+		return nil
+	}
+	return p.client.Close()
+}
@@ -0,0 +1,127 @@
+package tail
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// published is a PUBLISH the fake broker got
+type published struct {
+	topic string
+	qos   byte
+	doc   bson.M
+}
+
+// fakeBroker accepts one mqtt client on a loopback port and passes on
+// what it publishes, acking qos 1
+func fakeBroker(t *testing.T) (string, <-chan published) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan published, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if kind, _, err := readMQTT(r); err != nil || kind>>4 != 1 {
+			return
+		}
+		conn.Write([]byte{0x20, 2, 0, 0}) // CONNACK, accepted
+		for {
+			kind, data, err := readMQTT(r)
+			if err != nil || kind>>4 != 3 {
+				return // anything but a PUBLISH, the DISCONNECT on close
+			}
+			n := int(binary.BigEndian.Uint16(data))
+			p := published{topic: string(data[2 : 2+n]), qos: kind >> 1 & 0x03}
+			data = data[2+n:]
+			if p.qos == 1 {
+				conn.Write([]byte{0x40, 2, data[0], data[1]}) // PUBACK
+				data = data[2:]
+			}
+			json.Unmarshal(data, &p.doc)
+			got <- p
+		}
+	}()
+	return "mqtt://" + ln.Addr().String(), got
+}
+
+// readMQTT reads a packet of less than 128 bytes of body, what fakeBroker
+// is sent
+func readMQTT(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, header[1])
+	_, err := io.ReadFull(r, data)
+	return header[0], data, err
+}
+
+func setMQTT(t *testing.T, url, topic string, qos int) {
+	oldURL, oldTopic, oldQoS := *mqttURL, *mqttTopic, *mqttQoS
+	*mqttURL, *mqttTopic, *mqttQoS = url, topic, qos
+	t.Cleanup(func() { *mqttURL, *mqttTopic, *mqttQoS = oldURL, oldTopic, oldQoS })
+}
+
+func TestPublisherTopics(t *testing.T) {
+	for _, qos := range []int{0, 1} {
+		url, got := fakeBroker(t)
+		setMQTT(t, url, "{source}/{db}/{collection}/{op}", qos)
+		p, err := newPublisher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := []*Oplog{
+			{Operation: "i", Namespace: "app.users", Object: bson.M{"_id": 1}, Source: "eu"},
+			{Operation: "d", Namespace: "app.orders.archive", Object: bson.M{"_id": 2}, Source: "eu"},
+			{Operation: "i", Namespace: "app.a+b", Object: bson.M{"_id": 3}, Source: "eu"}, // a wildcard once filled in, skipped
+			{Operation: "u", Namespace: "app.users", Object: bson.M{"$set": bson.M{"a": 1}}, QueryObject: bson.M{"_id": 1}, Source: "eu"},
+		}
+		for _, o := range entries {
+			if err := p.publish(o); err != nil {
+				t.Fatalf("qos %d: %s", qos, err)
+			}
+		}
+		for _, want := range []string{"eu/app/users/insert", "eu/app/orders.archive/delete", "eu/app/users/update"} {
+			select {
+			case m := <-got:
+				if m.topic != want || m.qos != byte(qos) {
+					t.Errorf("published to %s at qos %d, want %s at qos %d", m.topic, m.qos, want, qos)
+				}
+				if m.doc["ns"] == nil {
+					t.Errorf("%s: published %v, not the entry", m.topic, m.doc)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("qos %d: nothing published to %s", qos, want)
+			}
+		}
+		if err := p.close(); err != nil {
+			t.Error(err)
+		}
+		select {
+		case m := <-got:
+			t.Errorf("published %s, the entry with a wildcard topic included", m.topic)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestPublisherTopicWildcards(t *testing.T) {
+	setMQTT(t, "mqtt://127.0.0.1:1", "mongodb/+/{op}", 1)
+	if _, err := newPublisher(); err == nil {
+		t.Error("a MQTT_TOPIC with a wildcard was taken")
+	}
+}
@@ -0,0 +1,113 @@
+package tail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var output = flags.String("OUTPUT", "go", "how entries are printed: go for the Oplog struct as go prints it, debezium for the envelopes of debezium's mongodb connector, meteor for the added, changed and removed messages of meteor's observers, as json lines")
+
+// an event is what an entry is printed as in json, nil for nothing
+type event func(o *Oplog) (interface{}, error)
+
+// newPrinter returns what prints an entry as OUTPUT, CORRELATE and
+// CLOUDEVENTS say
+func newPrinter() (func(*Oplog), error) {
+	if (*output != "go" || *cloudEvents) && (*tui || *followID != "") {
+		return nil, cli.Invalidf("OUTPUT and CLOUDEVENTS are only used without TUI or ID")
+	}
+	if *output == "go" && !*cloudEvents {
+		if *correlateStyle != "" {
+			return nil, cli.Invalidf("CORRELATE needs OUTPUT to be json or CLOUDEVENTS")
+		}
+		return printOplog, nil
+	}
+	ev, err := newEvent()
+	if err != nil {
+		return nil, err
+	}
+	return printJSON(ev), nil
+}
+
+// newEvent returns the json event of an entry as OUTPUT, CORRELATE and
+// CLOUDEVENTS say, the entry's extended json for OUTPUT=go
+func newEvent() (event, error) {
+	var ev event
+	switch *output {
+	case "go":
+		ev = func(o *Oplog) (interface{}, error) { return entryJSON(o) }
+	case "debezium":
+		ev = func(o *Oplog) (interface{}, error) {
+			if e, ok := debezium(o); ok {
+				return e, nil
+			}
+			return nil, nil
+		}
+	case "meteor":
+		ev = func(o *Oplog) (interface{}, error) {
+			if m, ok := meteor(o); ok {
+				return m, nil
+			}
+			return nil, nil
+		}
+	default:
+		return nil, cli.Invalidf("OUTPUT %q must be go, debezium or meteor", *output)
+	}
+	ev, err := newCorrelation(ev)
+	if err != nil {
+		return nil, err
+	}
+	if *cloudEvents {
+		ev = newCloudEvents(ev)
+	}
+	return ev, nil
+}
+
+// printJSON prints the events of entries as json lines
+func printJSON(ev event) func(*Oplog) {
+	return func(o *Oplog) {
+		v, err := ev(o)
+		if v == nil && err == nil {
+			return
+		}
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(v)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s at %d: %s\n", o.Namespace, o.Timestamp, err)
+			return
+		}
+		os.Stdout.Write(append(data, '\n'))
+	}
+}
+
+// entryJSON returns the fields of o as extended json, as dump writes them
+func entryJSON(o *Oplog) (json.RawMessage, error) {
+	entry := bson.M{"ts": o.Timestamp, "op": o.Operation, "ns": o.Namespace, "o": o.Object}
+	if o.QueryObject != nil {
+		entry["o2"] = o.QueryObject
+	}
+	if o.FullDocument != nil {
+		entry["fullDocument"] = o.FullDocument
+	}
+	if o.FullDocumentBefore != nil {
+		entry["fullDocumentBeforeChange"] = o.FullDocumentBefore
+	}
+	raw, err := bson.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	line, err := bsonfile.JSONLine(raw)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(line), nil
+}
@@ -0,0 +1,364 @@
+package tail
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	partitions   = flags.Int("PARTITIONS", 0, "split namespaces into this many partitions shared out between the instances tailing, 0 to tail everything")
+	partitionNS  = flags.String("PARTITION_NS", "oplog_abuse.partitions", "db.collection the partition leases and checkpoints are kept in")
+	partitionTTL = flags.Duration("PARTITION_TTL", 10*time.Second, "how long a partition lease holds without renewal")
+	instanceID   = flags.String("INSTANCE_ID", "", "name of this instance on the leases, defaults to host:pid")
+)
+
+// parts is set up by sourceCh for the one source tailed when
+// partitioning, nil otherwise
+var parts *partitioner
+
+// partitioner claims a fair share of PARTITIONS for this instance. Every
+// namespace hashes to a partition, an entry is only printed by whoever
+// holds its partition. Leases carry a checkpoint, the ts up to which the
+// partition was printed, so a partition changing hands is neither printed
+// twice nor skipped: when a partition further behind than our cursor is
+// claimed the cursor is rewound to it.
+//
+// Every instance still reads the whole oplog, it's the work past reading
+// that's split.
+type partitioner struct {
+	c      *mgo.Collection
+	holder string
+	n      int
+
+	mu        sync.Mutex
+	held      map[int]*partitionLease
+	lapsed    map[int]bson.MongoTimestamp // printed up to when their lease lapsed
+	rewinding bson.MongoTimestamp         // sent on rewind, until the cursor restarts
+
+	pos    int64 // bson.MongoTimestamp everything held is printed up to
+	rewind chan bson.MongoTimestamp
+}
+
+type partitionLease struct {
+	expires    time.Time           // locally, a little before the lease does
+	checkpoint bson.MongoTimestamp // printed up to by the previous holders
+	pending    bool                // claimed, waiting for the cursor to rewind
+}
+
+// checkPartitions validates PARTITIONS against the rest of the config,
+// once, before any source is dialed
+func checkPartitions(sources []source) error {
+	switch {
+	case *partitions < 0:
+		return cli.Invalidf("PARTITIONS can't be negative")
+	case *partitions == 0:
+		return nil
+	case len(sources) > 1:
+		return cli.Invalidf("PARTITIONS can't be used with several MONGO_URLS")
+	case *sourceMode == "changestream":
+		return cli.Invalidf("PARTITIONS can't be used with change streams")
+	}
+	if _, _, ok := splitNS(*partitionNS); !ok {
+		return cli.Invalidf("PARTITION_NS %q must be db.collection", *partitionNS)
+	}
+	return nil
+}
+
+// newPartitioner shares out the partitions of the one source tailed, its
+// config already checked by checkPartitions
+func newPartitioner(sess *mgo.Session) *partitioner {
+	db, coll, _ := splitNS(*partitionNS)
+	holder := *instanceID
+	if holder == "" {
+		host, _ := os.Hostname()
+		holder = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	return &partitioner{
+		c:      sess.Copy().DB(db).C(coll),
+		holder: holder,
+		n:      *partitions,
+		held:   make(map[int]*partitionLease),
+		lapsed: make(map[int]bson.MongoTimestamp),
+		rewind: make(chan bson.MongoTimestamp, 1),
+	}
+}
+
+// start claims partitions, waiting while there are more instances than
+// partitions, and keeps rebalancing. It returns the ts to tail after, the
+// oldest checkpoint held, 0 if none of them has been tailed before.
+func (p *partitioner) start() (bson.MongoTimestamp, error) {
+	waiting := false
+	for {
+		if err := p.rebalance(); err != nil {
+			return 0, err
+		}
+		p.mu.Lock()
+		n := len(p.held)
+		p.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "every partition is held, standing by\n")
+			waiting = true
+		}
+		sysClock.Sleep(*partitionTTL / 3)
+	}
+	go func() {
+		defer cli.Recover()
+		for range sysClock.NewTicker(*partitionTTL / 3).C() {
+			if err := p.rebalance(); err != nil {
+				fmt.Fprintf(os.Stderr, "partitions: %s\n", err)
+				p.c.Database.Session.Refresh()
+			}
+		}
+	}()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var since bson.MongoTimestamp
+	for _, l := range p.held {
+		if l.checkpoint != 0 && (since == 0 || l.checkpoint < since) {
+			since = l.checkpoint
+		}
+	}
+	atomic.StoreInt64(&p.pos, int64(since))
+	return since, nil
+}
+
+func (p *partitioner) partition(ns string) int {
+	h := fnv.New32a()
+	h.Write([]byte(ns))
+	return int(h.Sum32() % uint32(p.n))
+}
+
+// owns reports whether o is ours to print. A lease that wasn't renewed in
+// time may be someone else's by now, so it's lost: its entries are left
+// to whoever claims it next, from the checkpoint stored on it, this
+// instance included.
+func (p *partitioner) owns(o *Oplog) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.partition(o.Namespace)
+	l, ok := p.held[i]
+	if !ok {
+		return false
+	}
+	if !sysClock.Now().Before(l.expires) {
+		printed := l.checkpoint
+		if pos := bson.MongoTimestamp(atomic.LoadInt64(&p.pos)); !l.pending && pos > printed {
+			printed = pos
+		}
+		fmt.Fprintf(os.Stderr, "partition %d lapsed at %d, claiming it again\n", i, printed)
+		delete(p.held, i)
+		p.lapsed[i] = printed
+		return false
+	}
+	return !l.pending && o.Timestamp > l.checkpoint
+}
+
+// advance records everything held as printed up to ts
+func (p *partitioner) advance(ts bson.MongoTimestamp) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.rewinding == 0 {
+		atomic.StoreInt64(&p.pos, int64(ts))
+	}
+	p.mu.Unlock()
+}
+
+// restart is called once the cursor is rewound to ts, having read up to
+// last before. Partitions held all along were printed up to last, those
+// claimed are from now on.
+func (p *partitioner) restart(ts, last bson.MongoTimestamp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rewinding = 0
+	for _, l := range p.held {
+		switch {
+		case l.pending && l.checkpoint >= ts:
+			l.pending = false
+		case l.pending:
+			// claimed after ts was sent, an older rewind is on its way
+			if p.rewinding == 0 || l.checkpoint < p.rewinding {
+				p.rewinding = l.checkpoint
+			}
+		case l.checkpoint < last:
+			l.checkpoint = last
+		}
+	}
+	atomic.StoreInt64(&p.pos, int64(ts))
+}
+
+// rewound returns the channel a ts to tail after again is sent on, nil
+// when not partitioning
+func (p *partitioner) rewound() <-chan bson.MongoTimestamp {
+	if p == nil {
+		return nil
+	}
+	return p.rewind
+}
+
+type partitionDoc struct {
+	Holder     string              `bson:"holder"`
+	Expires    time.Time           `bson:"expires"`
+	Checkpoint bson.MongoTimestamp `bson:"ts"`
+}
+
+// rebalance heartbeats, renews what's held with the current checkpoint,
+// then gives away or claims partitions to hold a fair share of them. The
+// lock is only held between round trips, owns taking it for every entry.
+func (p *partitioner) rebalance() error {
+	now := sysClock.Now()
+	ttl := *partitionTTL
+	_, err := p.c.UpsertId("instance:"+p.holder, bson.M{"$set": bson.M{"instance": true, "expires": now.Add(ttl)}})
+	if err != nil {
+		return err
+	}
+	live, err := p.c.Find(bson.M{"instance": true, "expires": bson.M{"$gt": now}}).Count()
+	if err != nil {
+		return err
+	}
+	share := (p.n + live - 1) / live
+
+	pos := bson.MongoTimestamp(atomic.LoadInt64(&p.pos))
+	p.mu.Lock()
+	renewing := make(map[int]*partitionLease, len(p.held))
+	updates := make(map[int]bson.M, len(p.held))
+	for i, l := range p.held {
+		update := bson.M{"$set": bson.M{"expires": now.Add(ttl)}}
+		if pos > 0 && !l.pending {
+			update["$max"] = bson.M{"ts": pos}
+		}
+		renewing[i], updates[i] = l, update
+	}
+	p.mu.Unlock()
+	renewed, lost := map[int]bool{}, map[int]bool{}
+	for i, update := range updates {
+		err := p.c.Update(bson.M{"_id": partitionID(i), "holder": p.holder}, update)
+		if err == mgo.ErrNotFound {
+			lost[i] = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		renewed[i] = true
+	}
+
+	p.mu.Lock()
+	for i, l := range renewing {
+		if p.held[i] != l {
+			continue // lapsed meanwhile
+		}
+		switch {
+		case lost[i]:
+			fmt.Fprintf(os.Stderr, "partition %d lost\n", i)
+			delete(p.held, i)
+		case renewed[i]:
+			l.expires = now.Add(ttl - ttl/6)
+		}
+	}
+	// given away before the round trips, so nothing's printed of them once
+	// someone else may claim them
+	var releasing []int
+	for i := range p.held {
+		if len(p.held) <= share {
+			break
+		}
+		delete(p.held, i)
+		releasing = append(releasing, i)
+	}
+	var claiming []int
+	for i := 0; i < p.n && len(p.held)+len(claiming) < share; i++ {
+		if p.held[i] == nil {
+			claiming = append(claiming, i)
+		}
+	}
+	p.mu.Unlock()
+	for _, i := range releasing {
+		err := p.c.Update(bson.M{"_id": partitionID(i), "holder": p.holder}, bson.M{"$set": bson.M{"expires": now}})
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "partition %d released\n", i)
+	}
+
+	for _, i := range claiming {
+		// still ours when it lapsed if no one's held it since
+		var before partitionDoc
+		if err := p.c.FindId(partitionID(i)).One(&before); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		_, err := p.c.Upsert(
+			bson.M{"_id": partitionID(i), "$or": []bson.M{{"expires": bson.M{"$lt": now}}, {"holder": p.holder}}},
+			bson.M{"$set": bson.M{"holder": p.holder, "expires": now.Add(ttl)}},
+		)
+		claimed := err == nil
+		if mgo.IsDup(err) {
+			err = nil // held by someone else
+		}
+		var doc partitionDoc
+		if claimed {
+			if err = p.c.FindId(partitionID(i)).One(&doc); err == nil && doc.Holder != p.holder {
+				claimed = false
+			}
+		}
+		p.mu.Lock()
+		printed, lapsed := p.lapsed[i]
+		delete(p.lapsed, i)
+		if claimed && err == nil {
+			p.claim(i, doc.Checkpoint, lapsed && before.Holder == p.holder, printed, pos, now.Add(ttl-ttl/6))
+		}
+		p.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim holds partition i from checkpoint, or from printed if it lapsed
+// from us with no one holding it since, rewinding the cursor at pos to it
+// if it's behind. p.mu is held.
+func (p *partitioner) claim(i int, checkpoint bson.MongoTimestamp, ours bool, printed, pos bson.MongoTimestamp, expires time.Time) {
+	if ours && printed > checkpoint {
+		checkpoint = printed // printed since it was last renewed
+	}
+	if checkpoint == 0 {
+		checkpoint = pos // never tailed, from wherever we are
+	}
+	l := &partitionLease{expires: expires, checkpoint: checkpoint}
+	p.held[i] = l
+	fmt.Fprintf(os.Stderr, "partition %d claimed at %d\n", i, checkpoint)
+	if pos == 0 || checkpoint >= pos {
+		return
+	}
+	l.pending = true
+	if p.rewinding == 0 || checkpoint < p.rewinding {
+		p.rewinding = checkpoint
+		select {
+		case <-p.rewind:
+		default:
+		}
+		p.rewind <- checkpoint
+	}
+}
+
+func partitionID(i int) string {
+	return fmt.Sprintf("partition:%d", i)
+}
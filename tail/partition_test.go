@@ -0,0 +1,98 @@
+package tail
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// heldPartitioner holds every one of n partitions, leased until ttl on
+// from now with the checkpoint given, without a collection to renew them
+func heldPartitioner(n int, ttl time.Duration, checkpoint bson.MongoTimestamp) *partitioner {
+	p := &partitioner{
+		holder: "test",
+		n:      n,
+		held:   make(map[int]*partitionLease),
+		lapsed: make(map[int]bson.MongoTimestamp),
+		rewind: make(chan bson.MongoTimestamp, 1),
+	}
+	for i := 0; i < n; i++ {
+		p.held[i] = &partitionLease{expires: sysClock.Now().Add(ttl), checkpoint: checkpoint}
+	}
+	return p
+}
+
+func TestPartitionLeaseExpiry(t *testing.T) {
+	sim := useSim(t)
+	p := heldPartitioner(1, 10*time.Second, 5<<32)
+	p.advance(7 << 32)
+	if !p.owns(&Oplog{Namespace: "app.users", Timestamp: 8 << 32}) {
+		t.Fatal("a held partition isn't owned")
+	}
+	if p.owns(&Oplog{Namespace: "app.users", Timestamp: 5 << 32}) {
+		t.Error("an entry up to the checkpoint is owned again")
+	}
+	sim.Advance(10*time.Second - time.Millisecond)
+	if !p.owns(&Oplog{Namespace: "app.users", Timestamp: 8 << 32}) {
+		t.Fatal("lost before the lease expired")
+	}
+	sim.Advance(time.Millisecond)
+	if p.owns(&Oplog{Namespace: "app.users", Timestamp: 9 << 32}) {
+		t.Fatal("still owned once the lease expired")
+	}
+	if _, ok := p.held[0]; ok {
+		t.Error("the lapsed lease is still held")
+	}
+	if got := p.lapsed[0]; got != 7<<32 {
+		t.Errorf("lapsed printed up to %d, want the position %d", got, bson.MongoTimestamp(7<<32))
+	}
+}
+
+func TestPartitionPendingLeaseExpiry(t *testing.T) {
+	sim := useSim(t)
+	p := heldPartitioner(1, time.Second, 5<<32)
+	p.held[0].pending = true // waiting on a rewind to the checkpoint
+	p.advance(7 << 32)
+	if p.owns(&Oplog{Namespace: "app.users", Timestamp: 8 << 32}) {
+		t.Fatal("a pending partition is owned")
+	}
+	sim.Advance(time.Second)
+	p.owns(&Oplog{Namespace: "app.users", Timestamp: 8 << 32})
+	if got := p.lapsed[0]; got != 5<<32 {
+		t.Errorf("a pending lease lapsed printed up to %d, want its checkpoint %d", got, bson.MongoTimestamp(5<<32))
+	}
+}
+
+func TestPartitionClaim(t *testing.T) {
+	useSim(t)
+	p := heldPartitioner(4, time.Second, 0)
+	p.held = make(map[int]*partitionLease)
+	expires := sysClock.Now().Add(time.Second)
+	pos := bson.MongoTimestamp(10 << 32)
+
+	p.claim(0, 12<<32, false, 0, pos, expires)
+	if l := p.held[0]; l.pending || l.checkpoint != 12<<32 {
+		t.Errorf("claimed ahead of the cursor: pending %v at %d", l.pending, l.checkpoint)
+	}
+	p.claim(1, 0, false, 0, pos, expires)
+	if l := p.held[1]; l.pending || l.checkpoint != pos {
+		t.Errorf("never tailed: pending %v at %d, want the cursor's %d", l.pending, l.checkpoint, pos)
+	}
+	p.claim(2, 6<<32, false, 0, pos, expires)
+	p.claim(3, 4<<32, true, 8<<32, pos, expires)
+	if l := p.held[3]; !l.pending || l.checkpoint != 8<<32 {
+		t.Errorf("lapsed from us: pending %v at %d, want printed %d", l.pending, l.checkpoint, bson.MongoTimestamp(8<<32))
+	}
+	if !p.held[2].pending {
+		t.Error("claimed behind the cursor isn't pending")
+	}
+	select {
+	case ts := <-p.rewind:
+		if ts != 6<<32 {
+			t.Errorf("rewound to %d, want the furthest behind %d", ts, bson.MongoTimestamp(6<<32))
+		}
+	default:
+		t.Error("no rewind sent")
+	}
+}
@@ -0,0 +1,126 @@
+package tail
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/encrypt"
+	"github.com/hanjoyo/oplog-abuse/pii"
+	"github.com/hanjoyo/oplog-abuse/sink"
+)
+
+var (
+	piiDetect    = flags.Bool("PII_DETECT", false, "tag the fields whose string values look like email addresses, phone numbers or card numbers, logging them, sending them to PII_SINK and listing them as pii_fields at METRICS_ADDR")
+	piiMinValues = flags.Int("PII_MIN_VALUES", 20, "string values of a field seen before PII_DETECT tags it")
+	piiRate      = flags.Float64("PII_RATE", 0.5, "share of a field's string values looking like one kind PII_DETECT tags it at")
+	piiSink      = flags.String("PII_SINK", "", "sink the fields PII_DETECT tags are sent to: an http or https url, authenticated as the pii sink, or file:path")
+	piiEncrypt   = flags.Bool("PII_ENCRYPT", false, "seal the fields PII_DETECT tags with ENCRYPT_KEY from then on, as if they were in ENCRYPT_FIELDS")
+)
+
+// piiTags lists the fields tagged, by namespace, at METRICS_ADDR
+var piiTags = expvar.NewMap("pii_fields")
+
+// detector tags the fields of the entries read carrying personal data,
+// enrolling them in enc. Nil without PII_DETECT.
+type detector struct {
+	d    *pii.Detector
+	sink *sink.Sink
+	enc  *encrypt.Encryptor // nil without PII_ENCRYPT
+
+	mu sync.Mutex // of d, read by the expvar listing too
+}
+
+// newDetector returns the detector, and enc or, if PII_ENCRYPT needs one,
+// a new encryptor sealing no fields yet
+func newDetector(enc *encrypt.Encryptor) (*detector, *encrypt.Encryptor, error) {
+	if !*piiDetect {
+		if *piiEncrypt {
+			return nil, nil, cli.Invalidf("PII_ENCRYPT needs PII_DETECT")
+		}
+		return nil, enc, nil
+	}
+	if *piiMinValues <= 0 || *piiRate <= 0 || *piiRate > 1 {
+		return nil, nil, cli.Invalidf("PII_MIN_VALUES must be positive and PII_RATE from 0 to 1")
+	}
+	s, err := sink.Open("pii", *piiSink)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &detector{d: pii.New(*piiMinValues, *piiRate), sink: s}
+	if *piiEncrypt {
+		if *encryptKey == "" {
+			return nil, nil, cli.Invalidf("PII_ENCRYPT needs an ENCRYPT_KEY")
+		}
+		if enc == nil {
+			if enc, err = encrypt.Open(*encryptKey); err != nil {
+				return nil, nil, err
+			}
+		}
+		d.enc = enc
+	}
+	return d, enc, nil
+}
+
+// observe looks at the documents o inserts, replaces or updates, tagging
+// the fields carrying personal data. A field is sealed from the entry it's
+// tagged by on, the ones before were shown as they were.
+func (d *detector) observe(o *Oplog) {
+	if d == nil || o.Namespace == "" || strings.Contains(o.Namespace, ".system.") {
+		return
+	}
+	if o.Operation != "i" && o.Operation != "u" {
+		return
+	}
+	d.mu.Lock()
+	var tags []pii.Tag
+	switch {
+	case o.Operation == "i":
+		tags = d.d.Document(o.Namespace, o.Object)
+	case o.FullDocument != nil:
+		tags = d.d.Document(o.Namespace, o.FullDocument)
+	default:
+		tags = d.d.Update(o.Namespace, o.Object)
+	}
+	d.mu.Unlock()
+	for _, tag := range tags {
+		fmt.Fprintf(os.Stderr, "%s %s looks like %s, %d of %d values\n", tag.Namespace, tag.Path, tag.Kind, tag.Matches, tag.Values)
+		piiTags.Set(tag.Namespace, expvar.Func(d.tagsOf(tag.Namespace)))
+		if err := d.sink.Send(tag); err != nil {
+			fmt.Fprintf(os.Stderr, "pii of %s: %s\n", tag.Namespace, err)
+		}
+		if d.enc != nil {
+			// arrays are fanned out over and positions in $set keys skipped
+			d.enc.Enroll(tag.Namespace, strings.Replace(tag.Path, "[]", "", -1))
+		}
+	}
+}
+
+// tagsOf returns the expvar listing of the fields of ns tagged
+func (d *detector) tagsOf(ns string) func() interface{} {
+	return func() interface{} {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var tags []pii.Tag
+		for _, tag := range d.d.Tags() {
+			if tag.Namespace == ns {
+				tags = append(tags, tag)
+			}
+		}
+		return tags
+	}
+}
+
+// close delivers the tags queued
+func (d *detector) close() error {
+	if d == nil {
+		return nil
+	}
+	if err := d.sink.Close(); err != nil {
+		return fmt.Errorf("PII_SINK: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package tail
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanjoyo/oplog-abuse/diff"
+	"github.com/hanjoyo/oplog-abuse/encrypt"
+	"github.com/hanjoyo/oplog-abuse/pii"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestDetectorSealsPositionalSets goes from v2 diffs of array elements,
+// normalized into positional $sets as tailCh does, to their field being
+// tagged and enrolled, and the $sets from then on sealed
+func TestDetectorSealsPositionalSets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(make([]byte, 32))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encrypt.Open("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &detector{d: pii.New(2, 1), enc: enc}
+	for i, c := range []struct {
+		diff   bson.M
+		key    string // of the $set holding the email
+		sealed bool
+	}{
+		// an element's field, then a whole element, the second tags it
+		{bson.M{"saddresses": bson.M{"a": true, "s1": bson.M{"u": bson.M{"email": "ada@example.com"}}}}, "addresses.1.email", false},
+		{bson.M{"saddresses": bson.M{"a": true, "u2": bson.M{"email": "bob@example.com", "city": "paris"}}}, "addresses.2", true},
+		{bson.M{"saddresses": bson.M{"a": true, "s0": bson.M{"u": bson.M{"email": "eve@example.com"}}}}, "addresses.0.email", true},
+	} {
+		object, err := diff.NormalizeM(bson.M{"$v": 2, "diff": c.diff})
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := &Oplog{Operation: "u", Namespace: "db.users", Object: object}
+		d.observe(o)
+		if err := enc.Apply(o.Namespace, o.Object); err != nil {
+			t.Fatal(err)
+		}
+		set := o.Object["$set"].(bson.M)
+		v := set[c.key]
+		if doc, ok := v.(bson.M); ok {
+			if doc["city"] != "paris" {
+				t.Errorf("%d: sealed the city too: %v", i, doc)
+			}
+			v = doc["email"]
+		}
+		if _, sealed := v.(encrypt.Sealed); sealed != c.sealed {
+			t.Errorf("%d: $set %v, sealed %t, want %t", i, set, sealed, c.sealed)
+		}
+	}
+	if tags := d.d.Tags(); len(tags) != 1 || tags[0].Path != "addresses[].email" {
+		t.Errorf("tagged %+v", tags)
+	}
+}
@@ -0,0 +1,109 @@
+package tail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/schema"
+	"github.com/hanjoyo/oplog-abuse/sink"
+)
+
+var (
+	validateSchemas = flags.String("VALIDATE_SCHEMAS", "", `json file of a JSON Schema per namespace, {"app.users": {"bsonType": "object", ...}}, entries whose documents break theirs sent to QUARANTINE_SINK instead of printed`)
+	quarantineSink  = flags.String("QUARANTINE_SINK", "", "sink entries breaking their VALIDATE_SCHEMAS schema are sent to, with the violations: an http or https url, authenticated as the quarantine sink, or file:path")
+)
+
+// gate holds back the entries whose documents break the schema of their
+// namespace, sending them to QUARANTINE_SINK. Nil without VALIDATE_SCHEMAS.
+type gate struct {
+	validators map[string]*schema.Validator
+	sink       *sink.Sink
+}
+
+// quarantineEvent is what's sent to QUARANTINE_SINK
+type quarantineEvent struct {
+	Namespace  string             `json:"ns"`
+	Source     string             `json:"source,omitempty"`
+	Timestamp  string             `json:"ts"`
+	Operation  string             `json:"op"`
+	Violations []schema.Violation `json:"violations"`
+	Entry      json.RawMessage    `json:"entry"` // extended json, as dump writes it
+}
+
+func newGate() (*gate, error) {
+	if *validateSchemas == "" {
+		return nil, nil
+	}
+	if *quarantineSink == "" {
+		return nil, cli.Invalidf("VALIDATE_SCHEMAS needs a QUARANTINE_SINK for the entries breaking them")
+	}
+	data, err := ioutil.ReadFile(*validateSchemas)
+	if err != nil {
+		return nil, err
+	}
+	var schemas map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return nil, cli.Invalidf("VALIDATE_SCHEMAS %s: %s", *validateSchemas, err)
+	}
+	g := &gate{validators: make(map[string]*schema.Validator, len(schemas))}
+	for ns, s := range schemas {
+		if g.validators[ns], err = schema.NewValidator(s); err != nil {
+			return nil, cli.Invalidf("VALIDATE_SCHEMAS %s, %s: %s", *validateSchemas, ns, err)
+		}
+	}
+	if g.sink, err = sink.Open("quarantine", *quarantineSink); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// check returns how o's document breaks the schema of its namespace, nil
+// if it doesn't or there's none
+func (g *gate) check(o *Oplog) []schema.Violation {
+	if g == nil {
+		return nil
+	}
+	v := g.validators[o.Namespace]
+	if v == nil {
+		return nil
+	}
+	switch {
+	case o.Operation == "i":
+		return v.Document(o.Object)
+	case o.Operation != "u":
+		return nil
+	case o.FullDocument != nil:
+		return v.Document(o.FullDocument)
+	}
+	return v.Update(o.Object)
+}
+
+// quarantine sends o to QUARANTINE_SINK with its violations
+func (g *gate) quarantine(o *Oplog, violations []schema.Violation) error {
+	entry, err := entryJSON(o)
+	if err != nil {
+		return err
+	}
+	return g.sink.Send(quarantineEvent{
+		Namespace:  o.Namespace,
+		Source:     o.Source,
+		Timestamp:  optime.Format(o.Timestamp),
+		Operation:  o.Operation,
+		Violations: violations,
+		Entry:      entry,
+	})
+}
+
+// close delivers what's quarantined still queued
+func (g *gate) close() error {
+	if g == nil {
+		return nil
+	}
+	if err := g.sink.Close(); err != nil {
+		return fmt.Errorf("QUARANTINE_SINK: %s", err)
+	}
+	return nil
+}
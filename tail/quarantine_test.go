@@ -0,0 +1,118 @@
+package tail
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanjoyo/oplog-abuse/schema"
+	"github.com/hanjoyo/oplog-abuse/sink"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestGate(t *testing.T) {
+	v, err := schema.NewValidator(map[string]interface{}{
+		"bsonType": "object",
+		"required": []interface{}{"email"},
+		"properties": map[string]interface{}{
+			"email":   map[string]interface{}{"bsonType": "string"},
+			"tags":    map[string]interface{}{"items": map[string]interface{}{"bsonType": "string"}},
+			"profile": map[string]interface{}{"properties": map[string]interface{}{"age": map[string]interface{}{"bsonType": "int"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "quarantine")
+	s, err := sink.Open("quarantine", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gate{validators: map[string]*schema.Validator{"app.users": v}, sink: s}
+
+	var shown []string
+	for _, c := range []struct {
+		o          *Oplog
+		violations string // empty when it's shown
+	}{
+		{&Oplog{Operation: "i", Namespace: "app.users", Object: bson.M{"_id": 1, "email": "ada@example.com"}}, ""},
+		{&Oplog{Operation: "i", Namespace: "app.users", Object: bson.M{"_id": 2, "email": 7}}, "email: is int, not string"},
+		{&Oplog{Operation: "i", Namespace: "app.users", Object: bson.M{"_id": 3}}, "email: is required"},
+		{&Oplog{Operation: "i", Namespace: "app.users", Object: bson.M{"_id": 4, "email": "a", "tags": []interface{}{"x", 1}}}, "tags.1: is int, not string"},
+		{&Oplog{Operation: "u", Namespace: "app.users", Object: bson.M{"$set": bson.M{"profile.age": "old"}}, QueryObject: bson.M{"_id": 1}}, "profile.age: is string, not int"},
+		{&Oplog{Operation: "u", Namespace: "app.users", Object: bson.M{"$unset": bson.M{"email": true}}, QueryObject: bson.M{"_id": 1}}, "email: is required, can't be unset"},
+		{&Oplog{Operation: "u", Namespace: "app.users", Object: bson.M{"$set": bson.M{"profile.age": 37}}, QueryObject: bson.M{"_id": 1}}, ""},
+		// the document after the update is checked when there's one
+		{&Oplog{Operation: "u", Namespace: "app.users", Object: bson.M{"$set": bson.M{"profile.age": 37}}, FullDocument: bson.M{"_id": 1}}, "email: is required"},
+		// deletes, commands and namespaces without a schema aren't checked
+		{&Oplog{Operation: "d", Namespace: "app.users", Object: bson.M{"_id": 1}}, ""},
+		{&Oplog{Operation: "c", Namespace: "app.$cmd", Object: bson.M{"drop": "users"}}, ""},
+		{&Oplog{Operation: "i", Namespace: "app.orders", Object: bson.M{"_id": 1}}, ""},
+	} {
+		violations := g.check(c.o)
+		var got []string
+		for _, v := range violations {
+			got = append(got, v.String())
+		}
+		if strings.Join(got, ", ") != c.violations {
+			t.Errorf("%s %v: %q, want %q", c.o.Operation, c.o.Object, got, c.violations)
+		}
+		// as Main does it
+		if violations != nil {
+			if err := g.quarantine(c.o, violations); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			shown = append(shown, c.o.Operation+" "+c.o.Namespace)
+		}
+	}
+	if err := g.close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "i app.users, u app.users, d app.users, c app.$cmd, i app.orders"; strings.Join(shown, ", ") != want {
+		t.Errorf("shown %s, want %s", strings.Join(shown, ", "), want)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []quarantineEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e quarantineEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %s", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 6 {
+		t.Fatalf("%d quarantined, want 6", len(events))
+	}
+	e := events[0]
+	if e.Namespace != "app.users" || e.Operation != "i" || len(e.Violations) != 1 || e.Violations[0].Path != "email" {
+		t.Errorf("quarantined %+v", e)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(e.Entry, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := entry["o"].(map[string]interface{}); o == nil || o["_id"] == nil || entry["ns"] != "app.users" {
+		t.Errorf("entry %s", e.Entry)
+	}
+}
+
+func TestGateNone(t *testing.T) {
+	var g *gate
+	if v := g.check(&Oplog{Operation: "i", Namespace: "app.users", Object: bson.M{}}); v != nil {
+		t.Errorf("no gate found %v", v)
+	}
+	if err := g.close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,113 @@
+package tail
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	sample = flags.String("SAMPLE", "", "per namespace sampling, e.g. \"db.hot=1/100,db.warm=25%\", 0% leaving a namespace out, reloaded on SIGHUP or a config file change")
+)
+
+// samplingRates holds the SAMPLE rates in use, replaced on reload while
+// the streams carry on from where they are
+var samplingRates atomic.Value
+
+func loadSampling() error {
+	rates, err := parseSampling(*sample)
+	if err != nil {
+		return err
+	}
+	samplingRates.Store(rates)
+	return nil
+}
+
+// parseSampling parses a comma separated list of ns=rate pairs where rate is
+// either 1-in-N ("1/100") or a percentage ("25%"), into the fraction of
+// events to keep per namespace.
+func parseSampling(s string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	if s == "" {
+		return rates, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("sample: expected ns=rate, got %q", pair)
+		}
+		rate, err := parseRate(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("sample: %s: %s", kv[0], err)
+		}
+		rates[kv[0]] = rate
+	}
+	return rates, nil
+}
+
+func parseRate(s string) (float64, error) {
+	var rate float64
+	switch {
+	case strings.HasSuffix(s, "%"):
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return 0, err
+		}
+		rate = pct / 100
+	case strings.HasPrefix(s, "1/"):
+		n, err := strconv.ParseFloat(strings.TrimPrefix(s, "1/"), 64)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("1-in-0 is not a rate")
+		}
+		rate = 1 / n
+	default:
+		return 0, fmt.Errorf("rate %q must look like 1/N or N%%", s)
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate %q out of range", s)
+	}
+	return rate, nil
+}
+
+// documentID returns the _id an oplog entry modifies
+func documentID(o *Oplog) (interface{}, bool) {
+	if o.Operation == "u" {
+		id, ok := o.QueryObject["_id"]
+		return id, ok
+	}
+	id, ok := o.Object["_id"]
+	return id, ok
+}
+
+// sampled reports whether the entry should be kept. The decision hashes the
+// document _id so every event for a kept document is kept, across restarts
+// and across processes. Entries without an _id (commands, noops) are always
+// kept, but in namespaces sampled at 0.
+func sampled(rates map[string]float64, o *Oplog) bool {
+	rate, ok := rates[o.Namespace]
+	if !ok {
+		return true
+	}
+	if rate == 0 {
+		return false // left out, commands and all
+	}
+	id, ok := documentID(o)
+	if !ok {
+		return true
+	}
+	data, err := bson.Marshal(bson.D{{Name: "_id", Value: id}})
+	if err != nil {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return float64(h.Sum64()) < rate*math.MaxUint64
+}
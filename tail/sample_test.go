@@ -0,0 +1,69 @@
+package tail
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseSampling(t *testing.T) {
+	for _, c := range []struct {
+		s     string
+		rates map[string]float64
+		ok    bool
+	}{
+		{"", map[string]float64{}, true},
+		{"db.hot=1/100, db.warm=25%,db.off=0%", map[string]float64{"db.hot": 0.01, "db.warm": 0.25, "db.off": 0}, true},
+		{"db.all=100%", map[string]float64{"db.all": 1}, true},
+		{"db.hot=1/0", nil, false},
+		{"db.hot=101%", nil, false},
+		{"db.hot=-1%", nil, false},
+		{"db.hot=0.5", nil, false},
+		{"db.hot", nil, false},
+		{"=1/2", nil, false},
+	} {
+		rates, err := parseSampling(c.s)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: %v", c.s, err)
+			continue
+		}
+		if len(rates) != len(c.rates) {
+			t.Errorf("%q: %v, want %v", c.s, rates, c.rates)
+		}
+		for ns, rate := range c.rates {
+			if got, ok := rates[ns]; !ok || got != rate {
+				t.Errorf("%q: %s at %v, want %v", c.s, ns, got, rate)
+			}
+		}
+	}
+}
+
+func TestSampled(t *testing.T) {
+	rates := map[string]float64{"db.half": 0.5, "db.off": 0, "db.all": 1}
+	doc := func(ns string, id int) *Oplog {
+		return &Oplog{Operation: "i", Namespace: ns, Object: bson.M{"_id": id}}
+	}
+	kept := 0
+	for id := 0; id < 1000; id++ {
+		if sampled(rates, doc("db.half", id)) {
+			kept++
+		}
+		if sampled(rates, doc("db.half", id)) != sampled(rates, &Oplog{Operation: "u", Namespace: "db.half", QueryObject: bson.M{"_id": id}, Object: bson.M{"$set": bson.M{"n": 1}}}) {
+			t.Fatalf("an insert and update of _id %d sampled apart", id)
+		}
+		if sampled(rates, doc("db.off", id)) || !sampled(rates, doc("db.all", id)) || !sampled(rates, doc("db.other", id)) {
+			t.Fatalf("_id %d sampled at other than its rate", id)
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("kept %d of 1000 at 50%%", kept)
+	}
+	command := &Oplog{Operation: "c", Namespace: "db.off", Object: bson.M{"drop": "off"}}
+	if sampled(rates, command) {
+		t.Error("a command in a namespace sampled at 0 is kept")
+	}
+	command.Namespace = "db.half"
+	if !sampled(rates, command) {
+		t.Error("a command in a sampled namespace is left out")
+	}
+}
@@ -0,0 +1,207 @@
+package tail
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+	"github.com/hanjoyo/oplog-abuse/schema"
+	"github.com/hanjoyo/oplog-abuse/sink"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	schemaNS       = flags.String("SCHEMA_NS", "", "db.collection the schemas inferred of each namespace's documents are written to, such as oplog_abuse.schemas, empty to not infer them")
+	schemaURL      = flags.String("SCHEMA_URL", "", "mongodb url SCHEMA_NS is on, MONGO_URL if empty")
+	schemaInterval = flags.Duration("SCHEMA_INTERVAL", time.Minute, "how often the schemas inferred are written to SCHEMA_NS")
+	driftSink      = flags.String("DRIFT_SINK", "", "sink the drift of the schemas inferred is sent to, fields added, removed or seen as a new type: an http or https url, authenticated as the drift sink, or file:path, empty to not detect drift")
+	driftAfter     = flags.Int("DRIFT_AFTER", 100, "documents of a namespace seen before its schema drifting is reported, every field being new until then")
+)
+
+// schemas infers the schema of every namespace entries are read of,
+// writes those that changed every SCHEMA_INTERVAL and sends how they
+// drift to DRIFT_SINK. Nil without either.
+type schemas struct {
+	c     *mgo.Collection // nil without SCHEMA_NS
+	drift *sink.Sink
+
+	mu    sync.Mutex
+	byID  map[string]*schemaEntry
+	dirty map[string]bool
+}
+
+type schemaEntry struct {
+	source string
+	schema *schema.Schema
+}
+
+// schemaDoc is what's written to SCHEMA_NS per namespace
+type schemaDoc struct {
+	ID        string               `bson:"_id"`
+	Namespace string               `bson:"ns"`
+	Source    string               `bson:"source,omitempty"`
+	Documents int64                `bson:"documents"`
+	Updates   int64                `bson:"updates"`
+	Updated   time.Time            `bson:"updated"`
+	Schema    bson.D               `bson:"schema"` // a $jsonSchema
+	Fields    []schema.Observation `bson:"fields"`
+}
+
+// schemaURLOrDefault is the url SCHEMA_NS is written on
+func schemaURLOrDefault() string {
+	if *schemaURL != "" {
+		return *schemaURL
+	}
+	return *mongoURL
+}
+
+// driftEvent is what's sent to DRIFT_SINK
+type driftEvent struct {
+	Namespace string `json:"ns"`
+	Source    string `json:"source,omitempty"`
+	Timestamp string `json:"ts"`
+	Wall      string `json:"wall,omitempty"`
+	Documents int64  `json:"documents"` // seen of the namespace before
+	schema.Drift
+}
+
+func newSchemas() (*schemas, error) {
+	if *schemaNS == "" && *driftSink == "" {
+		return nil, nil
+	}
+	drift, err := sink.Open("drift", *driftSink)
+	if err != nil {
+		return nil, err
+	}
+	s := &schemas{drift: drift, byID: make(map[string]*schemaEntry), dirty: make(map[string]bool)}
+	if *schemaNS == "" {
+		return s, nil
+	}
+	db, coll, ok := splitNS(*schemaNS)
+	if !ok {
+		return nil, fmt.Errorf("SCHEMA_NS %q must be db.collection", *schemaNS)
+	}
+	if *schemaInterval <= 0 {
+		return nil, fmt.Errorf("SCHEMA_INTERVAL must be positive")
+	}
+	sess, err := dial.Dial(schemaURLOrDefault())
+	if err != nil {
+		return nil, err
+	}
+	s.c = sess.DB(db).C(coll)
+	go func() {
+		defer cli.Recover()
+		for range sysClock.NewTicker(*schemaInterval).C() {
+			if err := s.flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "writing schemas: %s\n", err)
+				s.c.Database.Session.Refresh()
+			}
+		}
+	}()
+	return s, nil
+}
+
+// schemaID is the _id of the schema of ns tailed from source
+func schemaID(source, ns string) string {
+	if source == "" {
+		return ns
+	}
+	return source + "/" + ns
+}
+
+// observe adds the documents o inserts, replaces or updates to the schema
+// of its namespace
+func (s *schemas) observe(o *Oplog) {
+	if s == nil || o.Namespace == "" || strings.Contains(o.Namespace, ".system.") {
+		return
+	}
+	if o.Operation != "i" && o.Operation != "u" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := schemaID(o.Source, o.Namespace)
+	e := s.byID[id]
+	if e == nil {
+		e = &schemaEntry{source: o.Source, schema: schema.New(o.Namespace)}
+		s.byID[id] = e
+	}
+	documents := e.schema.Documents
+	var drifts []schema.Drift
+	switch {
+	case o.Operation == "i":
+		drifts = e.schema.Document(o.Object)
+	case o.FullDocument != nil:
+		drifts = e.schema.Document(o.FullDocument)
+	default:
+		drifts = e.schema.Update(o.Object)
+	}
+	s.dirty[id] = true
+	if documents < int64(*driftAfter) {
+		return
+	}
+	for _, d := range drifts {
+		event := driftEvent{Namespace: o.Namespace, Source: o.Source, Timestamp: optime.Format(o.Timestamp), Documents: documents, Drift: d}
+		if !o.Wall.IsZero() {
+			event.Wall = o.Wall.UTC().Format(time.RFC3339Nano)
+		}
+		if err := s.drift.Send(event); err != nil {
+			fmt.Fprintf(os.Stderr, "drift of %s: %s\n", o.Namespace, err)
+		}
+	}
+}
+
+// flush writes the schemas changed since the last flush
+func (s *schemas) flush() error {
+	if s == nil || s.c == nil {
+		return nil
+	}
+	s.mu.Lock()
+	docs := make([]schemaDoc, 0, len(s.dirty))
+	now := sysClock.Now()
+	for id := range s.dirty {
+		e := s.byID[id]
+		docs = append(docs, schemaDoc{
+			ID:        id,
+			Namespace: e.schema.Namespace,
+			Source:    e.source,
+			Documents: e.schema.Documents,
+			Updates:   e.schema.Updates,
+			Updated:   now,
+			Schema:    e.schema.JSONSchema(),
+			Fields:    e.schema.Observations(),
+		})
+	}
+	s.dirty = make(map[string]bool)
+	s.mu.Unlock()
+	for i, doc := range docs {
+		if _, err := s.c.UpsertId(doc.ID, doc); err != nil {
+			s.mu.Lock()
+			for _, d := range docs[i:] {
+				s.dirty[d.ID] = true // written on the next flush
+			}
+			s.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// close writes the schemas and delivers the drift queued
+func (s *schemas) close() error {
+	if s == nil {
+		return nil
+	}
+	err := s.flush()
+	if cerr := s.drift.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
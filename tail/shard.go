@@ -0,0 +1,120 @@
+package tail
+
+import (
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/clock"
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	mergeWindow = flags.Duration("SHARD_MERGE_WINDOW", time.Second, "how long an entry waits for the other shards to catch up before it's printed")
+)
+
+// shardsCh tails every shard behind the mongos sess is connected to and
+// merges their oplogs by ts. Shards share a cluster time so ts orders
+// entries across shards, but an idle or slow shard can't hold up the others
+// for longer than SHARD_MERGE_WINDOW, ordering is only approximate then.
+func shardsCh(sess *mgo.Session, src source, cps *checkpoints) <-chan *Oplog {
+	shards, err := dial.DialShards(sess, src.URL)
+	if err != nil {
+		panic(err)
+	}
+	chs := make([]<-chan *Oplog, len(shards))
+	for i, shard := range shards {
+		err := dial.CheckPrivileges(shard.Session,
+			dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+		)
+		if err != nil {
+			panic(err)
+		}
+		chs[i] = tailCh(shard.Session, src.Label, shard.Name, cps)
+	}
+	return mergeCh(chs, *mergeWindow)
+}
+
+type arrival struct {
+	stream int
+	oplog  *Oplog
+	at     time.Time
+}
+
+// mergeCh merges streams ordered by ts into one. The oldest pending entry
+// is sent once every open stream has an entry pending, or it has waited
+// window.
+func mergeCh(streams []<-chan *Oplog, window time.Duration) <-chan *Oplog {
+	in := make(chan arrival)
+	done := make(chan int)
+	for i, ch := range streams {
+		go func(i int, ch <-chan *Oplog) {
+			for o := range ch {
+				in <- arrival{i, o, sysClock.Now()}
+			}
+			done <- i
+		}(i, ch)
+	}
+
+	out := make(chan *Oplog)
+	go func() {
+		defer cli.Recover()
+		defer close(out)
+		pending := make([][]arrival, len(streams))
+		open := len(streams)
+		closed := make([]bool, len(streams))
+		every := window / 4
+		if every <= 0 {
+			every = window // a few nanoseconds, NewTicker takes no less
+		}
+		tick := sysClock.NewTicker(every)
+		defer tick.Stop()
+		for open > 0 || hasPending(pending) {
+			// send whatever can be sent
+			for {
+				oldest := -1
+				waiting := false
+				for i, p := range pending {
+					if len(p) == 0 {
+						waiting = waiting || !closed[i]
+						continue
+					}
+					if oldest < 0 || p[0].oplog.Timestamp < pending[oldest][0].oplog.Timestamp {
+						oldest = i
+					}
+				}
+				if oldest < 0 {
+					break
+				}
+				head := pending[oldest][0]
+				if waiting && clock.Since(sysClock, head.at) < window {
+					break
+				}
+				out <- head.oplog
+				pending[oldest] = pending[oldest][1:]
+			}
+			if open == 0 {
+				continue
+			}
+			select {
+			case a := <-in:
+				pending[a.stream] = append(pending[a.stream], a)
+			case i := <-done:
+				closed[i] = true
+				open--
+			case <-tick.C():
+			}
+		}
+	}()
+	return out
+}
+
+func hasPending(pending [][]arrival) bool {
+	for _, p := range pending {
+		if len(p) > 0 {
+			return true
+		}
+	}
+	return false
+}
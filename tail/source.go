@@ -0,0 +1,202 @@
+package tail
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	mongoURLs = flags.String("MONGO_URLS", "", "space separated label=url clusters to tail at once, overrides MONGO_URL, overridden by ATLAS_PROJECT")
+)
+
+// source is one cluster to tail, Label tags its entries
+type source struct {
+	Label string
+	URL   string
+}
+
+func init() {
+	flags.ListSeparator("MONGO_URLS", " ")
+}
+
+// String names src in errors, by its label or its url without the password
+func (src source) String() string {
+	if src.Label != "" {
+		return src.Label
+	}
+	return dial.Redact(src.URL)
+}
+
+// parseSources parses MONGO_URLS, falling back to MONGO_URL unlabeled.
+// Urls can hold commas between hosts, so entries are split on whitespace.
+func parseSources(urls, fallback string) ([]source, error) {
+	if urls == "" {
+		return []source{{URL: fallback}}, nil
+	}
+	var sources []source
+	seen := make(map[string]bool)
+	for _, entry := range strings.Fields(urls) {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || !strings.HasPrefix(kv[1], "mongodb://") {
+			return nil, fmt.Errorf("MONGO_URLS: expected label=mongodb://..., got %q", entry)
+		}
+		if seen[kv[0]] {
+			return nil, fmt.Errorf("MONGO_URLS: label %q used twice", kv[0])
+		}
+		seen[kv[0]] = true
+		sources = append(sources, source{Label: kv[0], URL: kv[1]})
+	}
+	return sources, nil
+}
+
+// sourceCh dials src and tails it, every shard of it when it's a mongos
+func sourceCh(src source, cps *checkpoints) <-chan *Oplog {
+	sess, err := dial.Dial(src.URL)
+	if err != nil {
+		panic(fmt.Errorf("%s: %s", src, err))
+	}
+	if *compat != "" {
+		return compatCh(sess, src.Label, cps)
+	}
+	mongos, err := dial.IsMongos(sess)
+	if err != nil {
+		panic(err)
+	}
+	mode := *sourceMode
+	if mode == "auto" {
+		mode, err = chooseSource(sess, mongos)
+		if err != nil {
+			panic(fmt.Errorf("%s: %s", src, err))
+		}
+		fmt.Fprintf(os.Stderr, "%s: tailing the %s\n", streamName(src.Label, ""), mode)
+	}
+	if mode == "changestream" {
+		return watchCh(sess, src, cps)
+	}
+	// through mongos every shard is tailed, each checked for privileges
+	if mongos {
+		if *partitions > 0 {
+			panic(cli.Invalidf("%s: PARTITIONS can't be used through mongos", src))
+		}
+		return shardsCh(sess, src, cps)
+	}
+	needed := []dial.Privilege{
+		{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+	}
+	if *partitions > 0 {
+		parts = newPartitioner(sess)
+		needed = append(needed, dial.Privilege{DB: parts.c.Database.Name, Collection: parts.c.Name, Actions: []string{"find", "insert", "update"}})
+	}
+	err = dial.CheckPrivileges(sess, needed...)
+	if err != nil {
+		panic(err)
+	}
+	return tailCh(sess, src.Label, "", cps)
+}
+
+// Source is a stream of entries as they're tailed, closed once there are
+// no more. Clusters are tailed as ones, oplogtest fakes them.
+type Source interface {
+	Entries() <-chan *Oplog
+}
+
+// chanSource is a cluster tailed by sourceCh
+type chanSource <-chan *Oplog
+
+func (c chanSource) Entries() <-chan *Oplog {
+	return c
+}
+
+// Drain hands h every entry of sources until they're all closed, as tail
+// would handle them
+func Drain(h func(*Oplog), sources ...Source) {
+	for o := range fanIn(sources) {
+		h(o)
+	}
+}
+
+// fanIn sends everything from sources, clusters share no clock so there's
+// no order to keep between them
+func fanIn(sources []Source) <-chan *Oplog {
+	if len(sources) == 1 {
+		return sources[0].Entries()
+	}
+	out := make(chan *Oplog)
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(ch <-chan *Oplog) {
+			defer wg.Done()
+			for o := range ch {
+				out <- o
+			}
+		}(src.Entries())
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// chooseSource picks the oplog whenever it can be read, it's there from
+// 3.0 on and carries more than change streams do, and change streams
+// otherwise, from 3.6 on. Through mongos change streams are preferred, it
+// merges the shards' changes and tailing the shards directly needs access
+// to each of them. Only change streams have pre and post-images.
+func chooseSource(sess *mgo.Session, mongos bool) (string, error) {
+	info, err := sess.BuildInfo()
+	if err != nil {
+		return "", err
+	}
+	streams := info.VersionAtLeast(4, 0) || info.VersionAtLeast(3, 6) && strings.Contains(*watch, ".")
+	if imagesWanted() {
+		return "changestream", nil // only they carry images
+	}
+	if mongos {
+		if streams {
+			return "changestream", nil
+		}
+		return "oplog", nil
+	}
+	var entry struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	}
+	err = sess.DB("local").C("oplog.rs").Find(nil).Select(bson.M{"ts": 1}).One(&entry)
+	switch {
+	case err == nil || err == mgo.ErrNotFound:
+		return "oplog", nil
+	case !streams:
+		return "", fmt.Errorf("mongodb %s and local.oplog.rs can't be read: %s", info.Version, err)
+	}
+	fmt.Fprintf(os.Stderr, "local.oplog.rs can't be read: %s\n", err)
+	return "changestream", nil
+}
+
+// watchCh watches src with a change stream, mongos merging the shards'
+// changes if it is one
+func watchCh(sess *mgo.Session, src source, cps *checkpoints) <-chan *Oplog {
+	if *partitions > 0 {
+		panic(cli.Invalidf("PARTITIONS can't be used with change streams"))
+	}
+	db, coll, _ := changeStreamTarget(*watch)
+	if db == "admin" {
+		db = "" // any database
+	}
+	name, _ := coll.(string)
+	err := dial.CheckPrivileges(sess,
+		dial.Privilege{DB: db, Collection: name, Actions: []string{"changeStream", "find"}},
+	)
+	if err != nil {
+		panic(err)
+	}
+	return changeStreamCh(sess, src.Label, cps)
+}
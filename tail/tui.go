@@ -0,0 +1,451 @@
+package tail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+
+	"golang.org/x/term"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	tui = flags.Bool("TUI", false, "browse entries in an interactive terminal view instead of printing them, stderr best redirected")
+)
+
+const (
+	tuiKeep   = 5000 // entries kept to scroll back through
+	tuiRates  = 6    // namespaces with a sparkline
+	tuiWindow = 60   // seconds a sparkline covers
+)
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// tuiEntry is an entry as listed
+type tuiEntry struct {
+	seq    int
+	line   string // one line summary, filtered on
+	search string // line and detail lowercased
+	detail []string
+}
+
+// nsRate counts a namespace's entries per second over the window
+type nsRate struct {
+	counts [tuiWindow]int
+	last   int64 // unix second of counts' newest bucket
+	total  int
+}
+
+func (r *nsRate) add(now int64) {
+	r.advance(now)
+	r.counts[now%tuiWindow]++
+	r.total++
+}
+
+// advance zeroes the buckets of the seconds since the last entry
+func (r *nsRate) advance(now int64) {
+	for s := r.last + 1; s <= now && s <= r.last+tuiWindow; s++ {
+		r.total -= r.counts[s%tuiWindow]
+		r.counts[s%tuiWindow] = 0
+	}
+	if now > r.last {
+		r.last = now
+	}
+}
+
+// inspector is the TUI: a list of entries, filterable, the namespaces'
+// rates over the last minute as sparklines and the selected entry in full.
+// Entries are added as they're read, the screen drawn ten times a second.
+type inspector struct {
+	mu       sync.Mutex
+	entries  []*tuiEntry
+	seq      int
+	selected int  // seq of the selected entry
+	follow   bool // the newest entry stays selected
+	paused   bool // entries read aren't listed
+	dropped  int  // read while paused
+	filter   string
+	editing  bool // typing a filter
+	rates    map[string]*nsRate
+	out      *os.File
+	restore  func()
+	detailAt int // first line of the detail shown
+}
+
+// newInspector takes over the terminal, failing if there's none
+func newInspector() (*inspector, error) {
+	in, out := int(os.Stdin.Fd()), os.Stdout
+	if !term.IsTerminal(in) || !term.IsTerminal(int(out.Fd())) {
+		return nil, fmt.Errorf("TUI needs a terminal")
+	}
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return nil, err
+	}
+	out.WriteString("\x1b[?1049h\x1b[?25l") // alternate screen, no cursor
+	t := &inspector{follow: true, rates: make(map[string]*nsRate), out: out}
+	var restored sync.Once
+	t.restore = func() {
+		restored.Do(func() {
+			out.WriteString("\x1b[?25h\x1b[?1049l")
+			term.Restore(in, state)
+		})
+	}
+	// a failure exits without running the deferred restore
+	cli.AtExit(t.restore)
+	go t.keys()
+	go func() {
+		defer cli.Recover()
+		for range time.Tick(100 * time.Millisecond) {
+			t.draw()
+		}
+	}()
+	return t, nil
+}
+
+// add lists oplog
+func (t *inspector) add(oplog *Oplog) {
+	at := oplog.Wall
+	if at.IsZero() {
+		at = time.Unix(int64(oplog.Timestamp>>32), 0)
+	}
+	e := &tuiEntry{line: fmt.Sprintf("%s %-2s %s %s", at.Format("15:04:05.000"), oplog.Operation, oplog.Namespace, tuiID(oplog))}
+	e.detail = tuiDetail(oplog)
+	e.search = strings.ToLower(e.line + "\n" + strings.Join(e.detail, "\n"))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.rates[oplog.Namespace]
+	if r == nil {
+		r = &nsRate{last: time.Now().Unix()}
+		t.rates[oplog.Namespace] = r
+	}
+	r.add(time.Now().Unix())
+	if t.paused {
+		t.dropped++
+		return
+	}
+	t.seq++
+	e.seq = t.seq
+	t.entries = append(t.entries, e)
+	if len(t.entries) > tuiKeep {
+		t.entries = append(t.entries[:0], t.entries[len(t.entries)-tuiKeep*9/10:]...)
+	}
+	if t.follow && t.matches(e) {
+		t.selected = e.seq
+		t.detailAt = 0
+	}
+}
+
+// tuiID is the _id of the document oplog changes, as extended json
+func tuiID(oplog *Oplog) string {
+	id, ok := oplog.Object["_id"]
+	if oplog.Operation == "u" {
+		id, ok = oplog.QueryObject["_id"]
+	}
+	if !ok {
+		return ""
+	}
+	data, err := bsonfile.MarshalJSON(bson.M{"_id": id})
+	if err != nil {
+		return fmt.Sprint(id)
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(string(bytes.TrimSpace(data)), `{"_id":`), "}")
+}
+
+// tuiDetail renders oplog in full, as indented extended json
+func tuiDetail(oplog *Oplog) []string {
+	doc := bson.M{"ts": oplog.Timestamp, "op": oplog.Operation, "ns": oplog.Namespace, "o": oplog.Object}
+	for name, v := range map[string]bson.M{"o2": oplog.QueryObject, "fullDocument": oplog.FullDocument, "fullDocumentBeforeChange": oplog.FullDocumentBefore} {
+		if v != nil {
+			doc[name] = v
+		}
+	}
+	if !oplog.Wall.IsZero() {
+		doc["wall"] = oplog.Wall
+	}
+	if oplog.Source != "" {
+		doc["source"] = oplog.Source
+	}
+	if oplog.Shard != "" {
+		doc["shard"] = oplog.Shard
+	}
+	data, err := bsonfile.MarshalJSON(doc)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return []string{string(data)}
+	}
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+func (t *inspector) matches(e *tuiEntry) bool {
+	return t.filter == "" || strings.Contains(e.search, strings.ToLower(t.filter))
+}
+
+// visible lists the entries the filter lets through
+func (t *inspector) visible() []*tuiEntry {
+	if t.filter == "" {
+		return t.entries
+	}
+	var list []*tuiEntry
+	for _, e := range t.entries {
+		if t.matches(e) {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// position returns where the selected entry is in list, the last entry if
+// it's gone
+func (t *inspector) position(list []*tuiEntry) int {
+	i := sort.Search(len(list), func(i int) bool { return list[i].seq >= t.selected })
+	if i == len(list) {
+		i--
+	}
+	return i
+}
+
+// move moves the selection by n entries
+func (t *inspector) move(n int) {
+	list := t.visible()
+	if len(list) == 0 {
+		return
+	}
+	i := t.position(list) + n
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(list)-1 {
+		i = len(list) - 1
+	}
+	t.follow = i == len(list)-1
+	t.selected = list[i].seq
+	t.detailAt = 0
+}
+
+// keys reads the keyboard: arrows or j and k move, page up and down move a
+// page, g and G go to the oldest and newest entry, / filters, [ and ]
+// scroll the detail, space pauses and q quits
+func (t *inspector) keys() {
+	defer cli.Recover()
+	buf := make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		quit := t.key(string(buf[:n]))
+		t.mu.Unlock()
+		if quit {
+			t.restore()
+			os.Exit(0)
+		}
+		t.draw()
+	}
+}
+
+func (t *inspector) key(k string) bool {
+	page := 10
+	if _, h, err := term.GetSize(int(t.out.Fd())); err == nil {
+		page = h / 3
+	}
+	if t.editing {
+		switch k {
+		case "\r", "\n":
+			t.editing = false
+		case "\x1b":
+			t.editing, t.filter = false, ""
+		case "\x7f", "\b":
+			if _, size := utf8.DecodeLastRuneInString(t.filter); size > 0 {
+				t.filter = t.filter[:len(t.filter)-size]
+			}
+		case "\x03":
+			return true
+		default:
+			if k[0] >= ' ' {
+				t.filter += k
+			}
+		}
+		t.move(0)
+		return false
+	}
+	switch k {
+	case "q", "\x03":
+		return true
+	case "k", "\x1b[A":
+		t.move(-1)
+	case "j", "\x1b[B":
+		t.move(1)
+	case "\x1b[5~":
+		t.move(-page)
+	case "\x1b[6~":
+		t.move(page)
+	case "g", "\x1b[H":
+		t.move(-len(t.entries))
+	case "G", "\x1b[F":
+		t.move(len(t.entries))
+	case "[":
+		if t.detailAt > 0 {
+			t.detailAt--
+		}
+	case "]":
+		t.detailAt++
+	case "/":
+		t.editing = true
+	case "\x1b":
+		t.filter = ""
+		t.move(0)
+	case " ":
+		t.paused = !t.paused
+		t.dropped = 0
+	}
+	return false
+}
+
+// fit cuts or pads s to width columns
+func fit(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n > width {
+		r := []rune(s)
+		return string(r[:width])
+	}
+	return s + strings.Repeat(" ", width-n)
+}
+
+// sparkline draws counts oldest first, scaled to their peak
+func sparkline(r *nsRate, now int64) string {
+	peak := 0
+	for _, c := range r.counts {
+		if c > peak {
+			peak = c
+		}
+	}
+	line := make([]rune, 0, tuiWindow)
+	for s := now - tuiWindow + 1; s <= now; s++ {
+		c := r.counts[((s%tuiWindow)+tuiWindow)%tuiWindow]
+		switch {
+		case c == 0 || peak == 0:
+			line = append(line, ' ')
+		default:
+			line = append(line, sparks[(c*len(sparks)-1)/peak])
+		}
+	}
+	return string(line)
+}
+
+// draw redraws the whole screen: the rates, the list with the selection
+// highlighted, the detail of the selection and a status line
+func (t *inspector) draw() {
+	width, height, err := term.GetSize(int(t.out.Fd()))
+	if err != nil || width < 20 || height < 10 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now().Unix()
+
+	var lines []string
+	names := make([]string, 0, len(t.rates))
+	for ns, r := range t.rates {
+		r.advance(now)
+		if r.total > 0 {
+			names = append(names, ns)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if a, b := t.rates[names[i]].total, t.rates[names[j]].total; a != b {
+			return a > b
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > tuiRates {
+		names = names[:tuiRates]
+	}
+	nsWidth := width - tuiWindow - 12
+	if nsWidth < 10 {
+		nsWidth = 10
+	}
+	for _, ns := range names {
+		r := t.rates[ns]
+		lines = append(lines, fit(fmt.Sprintf("%s %7.1f/s %s", fit(ns, nsWidth), float64(r.total)/tuiWindow, sparkline(r, now)), width))
+	}
+	for len(lines) < tuiRates {
+		lines = append(lines, fit("", width))
+	}
+	lines = append(lines, "\x1b[7m"+fit(" entries", width)+"\x1b[0m")
+
+	list := t.visible()
+	rows := (height - len(lines) - 2) / 2
+	detailRows := height - len(lines) - rows - 2
+	pos := t.position(list)
+	first := pos - rows/2
+	if first > len(list)-rows {
+		first = len(list) - rows
+	}
+	if first < 0 {
+		first = 0
+	}
+	for i := first; i < first+rows; i++ {
+		switch {
+		case i >= len(list):
+			lines = append(lines, fit("", width))
+		case i == pos:
+			lines = append(lines, "\x1b[7m"+fit(list[i].line, width)+"\x1b[0m")
+		default:
+			lines = append(lines, fit(list[i].line, width))
+		}
+	}
+
+	lines = append(lines, "\x1b[7m"+fit(" detail, [ and ] to scroll", width)+"\x1b[0m")
+	var detail []string
+	if pos >= 0 {
+		detail = list[pos].detail
+	}
+	if t.detailAt > len(detail)-1 {
+		t.detailAt = len(detail) - 1
+	}
+	if t.detailAt < 0 {
+		t.detailAt = 0
+	}
+	for i := t.detailAt; i < t.detailAt+detailRows; i++ {
+		if i < len(detail) {
+			lines = append(lines, fit(detail[i], width))
+		} else {
+			lines = append(lines, fit("", width))
+		}
+	}
+
+	status := fmt.Sprintf(" %d of %d entries", len(list), len(t.entries))
+	switch {
+	case t.editing:
+		status += " | filter: " + t.filter + "_"
+	case t.filter != "":
+		status += " | filter: " + t.filter + " (esc clears)"
+	}
+	if t.paused {
+		status += fmt.Sprintf(" | paused, %d not listed", t.dropped)
+	} else if t.follow {
+		status += " | following"
+	}
+	status += " | j/k move, / filter, space pause, q quit"
+	lines = append(lines, "\x1b[7m"+fit(status, width)+"\x1b[0m")
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	buf.WriteString(strings.Join(lines, "\r\n"))
+	t.out.Write(buf.Bytes())
+}
@@ -0,0 +1,128 @@
+package tail
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// txnBuffer unwraps the applyOps entries transactions are logged as. A
+// transaction too large for one entry is logged as several, all but the
+// last marked partialTxn, and a prepared one as an applyOps marked prepare
+// followed by a commitTransaction or abortTransaction entry. Operations
+// are held back until the transaction commits.
+type txnBuffer struct {
+	pending map[string][]*Oplog
+	opened  map[string]bson.MongoTimestamp // ts of the first entry
+}
+
+func newTxnBuffer() *txnBuffer {
+	return &txnBuffer{
+		pending: make(map[string][]*Oplog),
+		opened:  make(map[string]bson.MongoTimestamp),
+	}
+}
+
+// holding reports whether a transaction is waiting to commit
+func (b *txnBuffer) holding() bool {
+	return len(b.opened) > 0
+}
+
+// resume returns the ts a restart has to tail after not to miss the open
+// transactions, 0 if none are
+func (b *txnBuffer) resume() bson.MongoTimestamp {
+	var oldest bson.MongoTimestamp
+	for _, ts := range b.opened {
+		if oldest == 0 || ts < oldest {
+			oldest = ts
+		}
+	}
+	if oldest == 0 {
+		return 0
+	}
+	return oldest - 1
+}
+
+// unwrap returns the entries o stands for: o itself, the operations of a
+// transaction committed by o, or nothing while the transaction is open.
+// Operations are tagged with the transaction number and commit ts.
+func (b *txnBuffer) unwrap(o *Oplog) []*Oplog {
+	if o.Operation != "c" {
+		return []*Oplog{o}
+	}
+	key := txnKey(o)
+	switch {
+	case o.Object["applyOps"] != nil:
+		ops := innerOps(o)
+		if o.Object["partialTxn"] == true || o.Object["prepare"] == true {
+			if _, ok := b.opened[key]; !ok {
+				b.opened[key] = o.Timestamp
+			}
+			b.pending[key] = append(b.pending[key], ops...)
+			return nil
+		}
+		ops = append(b.pending[key], ops...)
+		b.close(key)
+		return committed(ops, o.Timestamp, o.Timestamp)
+	case o.Object["commitTransaction"] != nil:
+		ops := b.pending[key]
+		b.close(key)
+		commit, ok := o.Object["commitTimestamp"].(bson.MongoTimestamp)
+		if !ok {
+			commit = o.Timestamp
+		}
+		return committed(ops, o.Timestamp, commit)
+	case o.Object["abortTransaction"] != nil:
+		b.close(key)
+		return nil
+	}
+	return []*Oplog{o}
+}
+
+func (b *txnBuffer) close(key string) {
+	delete(b.pending, key)
+	delete(b.opened, key)
+}
+
+func txnKey(o *Oplog) string {
+	return fmt.Sprintf("%v/%d", o.LSID["id"], o.TxnNumber)
+}
+
+// innerOps turns applyOps' operations into entries of their own
+func innerOps(o *Oplog) []*Oplog {
+	list, _ := o.Object["applyOps"].([]interface{})
+	ops := make([]*Oplog, 0, len(list))
+	for _, v := range list {
+		op, ok := v.(bson.M)
+		if !ok {
+			continue
+		}
+		inner := &Oplog{
+			Operation:    asString(op["op"]),
+			Namespace:    asString(op["ns"]),
+			TxnNumber:    o.TxnNumber,
+			LSID:         o.LSID,
+			Source:       o.Source,
+			Shard:        o.Shard,
+			Wall:         o.Wall,
+			MongoVersion: o.MongoVersion,
+		}
+		inner.Object, _ = op["o"].(bson.M)
+		inner.QueryObject, _ = op["o2"].(bson.M)
+		ops = append(ops, inner)
+	}
+	return ops
+}
+
+func committed(ops []*Oplog, ts, commit bson.MongoTimestamp) []*Oplog {
+	for _, op := range ops {
+		op.Timestamp = ts
+		op.CommitTimestamp = commit
+	}
+	return ops
+}
+
+func asString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,128 @@
+package tail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/clock"
+	"github.com/hanjoyo/oplog-abuse/optime"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	duration = flags.Duration("DURATION", 0, "stop after tailing this long, printing a summary of what was seen, 0 to tail on")
+	until    = flags.String("UNTIL", "", "stop at this ts, seconds[:increment] or RFC 3339, once an entry past it is read or the clock passes it, printing a summary")
+	limit    = flags.Int("LIMIT", 0, "stop once this many entries are printed, 0 for no limit")
+
+	exitOnFirstMatch = flags.Bool("EXIT_ON_FIRST_MATCH", false, "stop at the first entry printed, what ID, NS and SAMPLE let through, with status 0, or status 1 if the tail ends without one")
+)
+
+// errNoMatch ends an EXIT_ON_FIRST_MATCH tail that printed nothing
+var errNoMatch = &cli.StatusError{Status: cli.ExitFailure, Err: errors.New("no entry matched before the tail ended")}
+
+// window bounds a tail by DURATION and UNTIL and sums up what it printed.
+// A nil window, with neither set, never ends.
+type window struct {
+	started     time.Time
+	until       bson.MongoTimestamp
+	done        <-chan time.Time
+	entries     int
+	first, last bson.MongoTimestamp
+	counts      map[string]map[string]int // ns to op to count
+}
+
+// newWindow returns the window DURATION and UNTIL set, nil if neither is
+func newWindow() (*window, error) {
+	ts, err := optime.Parse(*until)
+	if err != nil {
+		return nil, cli.Invalidf("UNTIL: %s", err)
+	}
+	if *duration < 0 {
+		return nil, cli.Invalidf("DURATION must not be negative")
+	}
+	if *duration == 0 && ts == 0 {
+		return nil, nil
+	}
+	w := &window{started: sysClock.Now(), until: ts, counts: make(map[string]map[string]int)}
+	end := *duration
+	// the rest of the second ts is in may still come. Once it's past only
+	// entries after it end a tail catching up from a checkpoint.
+	if left := clock.Until(sysClock, optime.Time(ts).Add(time.Second)); ts != 0 && left > 0 && (end == 0 || left < end) {
+		end = left
+	}
+	if end > 0 {
+		w.done = sysClock.After(end)
+	}
+	return w, nil
+}
+
+// ended returns a channel ready once the window ends, nil for a nil window
+func (w *window) ended() <-chan time.Time {
+	if w == nil {
+		return nil
+	}
+	return w.done
+}
+
+// past reports whether o comes after the window
+func (w *window) past(o *Oplog) bool {
+	return w != nil && w.until != 0 && o.Timestamp > w.until
+}
+
+// count adds o to the summary
+func (w *window) count(o *Oplog) {
+	if w == nil {
+		return
+	}
+	if w.entries == 0 {
+		w.first = o.Timestamp
+	}
+	w.entries++
+	w.last = o.Timestamp
+	ops := w.counts[o.Namespace]
+	if ops == nil {
+		ops = make(map[string]int)
+		w.counts[o.Namespace] = ops
+	}
+	ops[o.Operation]++
+}
+
+// summary prints what was seen to stderr, the busiest namespaces first
+func (w *window) summary() {
+	if w == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d entries in %s", w.entries, clock.Since(sysClock, w.started).Round(time.Millisecond))
+	if w.entries > 0 {
+		fmt.Fprintf(os.Stderr, ", %s to %s", optime.Format(w.first), optime.Format(w.last))
+	}
+	fmt.Fprintln(os.Stderr)
+	totals := make(map[string]int, len(w.counts))
+	names := make([]string, 0, len(w.counts))
+	for ns, ops := range w.counts {
+		for _, n := range ops {
+			totals[ns] += n
+		}
+		names = append(names, ns)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if totals[names[i]] != totals[names[j]] {
+			return totals[names[i]] > totals[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	for _, ns := range names {
+		var ops []string
+		for op, n := range w.counts[ns] {
+			ops = append(ops, fmt.Sprintf("%s=%d", op, n))
+		}
+		sort.Strings(ops)
+		fmt.Fprintf(os.Stderr, "  %-40s %7d  %s\n", ns, totals[ns], strings.Join(ops, " "))
+	}
+}
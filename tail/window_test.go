@@ -0,0 +1,129 @@
+package tail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/clock"
+	"github.com/hanjoyo/oplog-abuse/optime"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var simStart = time.Unix(1792000000, 0)
+
+// useSim has sysClock be a clock.Sim for the rest of the test
+func useSim(t *testing.T) *clock.Sim {
+	sim := clock.NewSim(simStart)
+	sysClock = sim
+	t.Cleanup(func() { sysClock = clock.Real })
+	return sim
+}
+
+// tsAt is the timestamp of t's second, at increment 0
+func tsAt(t time.Time) bson.MongoTimestamp {
+	return bson.MongoTimestamp(t.Unix() << 32)
+}
+
+// setWindow sets DURATION and UNTIL for the rest of the test
+func setWindow(t *testing.T, d time.Duration, ts string) {
+	oldDuration, oldUntil := *duration, *until
+	*duration, *until = d, ts
+	t.Cleanup(func() { *duration, *until = oldDuration, oldUntil })
+}
+
+func ended(w *window) bool {
+	select {
+	case <-w.ended():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWindowDuration(t *testing.T) {
+	sim := useSim(t)
+	setWindow(t, time.Minute, "")
+	w, err := newWindow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Advance(time.Minute - time.Millisecond)
+	if ended(w) {
+		t.Fatal("ended before DURATION")
+	}
+	sim.Advance(time.Millisecond)
+	if !ended(w) {
+		t.Fatal("still open once DURATION passed")
+	}
+	if w.past(&Oplog{Timestamp: bson.MongoTimestamp(1 << 62)}) {
+		t.Error("an entry past nothing without UNTIL")
+	}
+}
+
+func TestWindowUntil(t *testing.T) {
+	sim := useSim(t)
+	ts := tsAt(simStart.Add(30 * time.Second))
+	setWindow(t, time.Hour, optime.Format(ts))
+	w, err := newWindow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rest of UNTIL's second may still come, earlier than DURATION ends
+	sim.Advance(31*time.Second - time.Millisecond)
+	if ended(w) {
+		t.Fatal("ended within UNTIL's second")
+	}
+	sim.Advance(time.Millisecond)
+	if !ended(w) {
+		t.Fatal("still open past UNTIL's second")
+	}
+	if w.past(&Oplog{Timestamp: ts}) || !w.past(&Oplog{Timestamp: ts + 1}) {
+		t.Error("past doesn't end at UNTIL")
+	}
+}
+
+func TestWindowDurationBeforeUntil(t *testing.T) {
+	sim := useSim(t)
+	setWindow(t, 10*time.Second, optime.Format(tsAt(simStart.Add(time.Hour))))
+	w, err := newWindow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Advance(10 * time.Second)
+	if !ended(w) {
+		t.Fatal("DURATION ending first didn't end the window")
+	}
+}
+
+func TestWindowUntilPassed(t *testing.T) {
+	useSim(t)
+	ts := tsAt(simStart.Add(-time.Hour))
+	setWindow(t, 0, optime.Format(ts))
+	w, err := newWindow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// catching up from a checkpoint, only an entry after UNTIL ends it
+	if w.ended() != nil {
+		t.Error("a window whose UNTIL passed waits on the clock")
+	}
+	if !w.past(&Oplog{Timestamp: ts + 1}) {
+		t.Error("an entry after UNTIL isn't past it")
+	}
+}
+
+func TestNoWindow(t *testing.T) {
+	useSim(t)
+	setWindow(t, 0, "")
+	w, err := newWindow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != nil {
+		t.Fatalf("got a window without DURATION or UNTIL: %+v", w)
+	}
+	if w.ended() != nil || w.past(&Oplog{Timestamp: 1}) {
+		t.Error("a nil window ends")
+	}
+}
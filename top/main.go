@@ -0,0 +1,213 @@
+// Package top shows the operations per second of each namespace from the
+// oplog, like mongotop shows time spent, the oplogctl top command.
+package top
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+
+	"golang.org/x/term"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("top", "show the operations per second of each namespace and op type, from the oplog")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL      = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the replica set to watch the oplog of")
+	interval      = flags.Duration("INTERVAL", time.Second, "how long each table's rates are sampled over")
+	rows          = flags.Int("ROWS", 20, "busiest namespaces shown, 0 for all of them")
+	count         = flags.Int("COUNT", 0, "tables shown before exiting, 0 to keep going until interrupted")
+	resumeRetries = flags.Int("RESUME_RETRIES", 5, "times in a row a failed oplog cursor is resumed before giving up")
+)
+
+// ops are the op types counted, in the order of the table's columns
+var ops = []struct{ op, name string }{
+	{"i", "insert"}, {"u", "update"}, {"d", "delete"}, {"c", "command"}, {"n", "noop"},
+}
+
+type entry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Operation string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+	Object    struct {
+		ApplyOps []op `bson:"applyOps"`
+	} `bson:"o"`
+}
+
+// op is an operation of a transaction
+type op struct {
+	Operation string `bson:"op"`
+	Namespace string `bson:"ns"`
+}
+
+// sample counts each namespace's operations by op type
+type sample map[string]map[string]int
+
+// add counts e, a transaction's operations as those of their namespaces
+func (s sample) add(e *entry) {
+	if e.Operation == "c" && len(e.Object.ApplyOps) > 0 {
+		for _, o := range e.Object.ApplyOps {
+			s.count(o.Namespace, o.Operation)
+		}
+		return
+	}
+	ns := e.Namespace
+	if ns == "" {
+		ns = "(none)" // the primary's periodic noops
+	}
+	s.count(ns, e.Operation)
+}
+
+func (s sample) count(ns, op string) {
+	if s[ns] == nil {
+		s[ns] = make(map[string]int)
+	}
+	s[ns][op]++
+}
+
+// write writes the table of s' rates over elapsed, the busiest namespaces
+// first
+func (s sample) write(w io.Writer, at time.Time, elapsed time.Duration) {
+	total := func(counts map[string]int) int {
+		n := 0
+		for _, c := range counts {
+			n += c
+		}
+		return n
+	}
+	namespaces := make([]string, 0, len(s))
+	all := map[string]int{}
+	width := len("ns")
+	for ns, counts := range s {
+		namespaces = append(namespaces, ns)
+		for op, c := range counts {
+			all[op] += c
+		}
+		if len(ns) > width {
+			width = len(ns)
+		}
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		a, b := total(s[namespaces[i]]), total(s[namespaces[j]])
+		if a != b {
+			return a > b
+		}
+		return namespaces[i] < namespaces[j]
+	})
+	more := 0
+	if *rows > 0 && len(namespaces) > *rows {
+		namespaces, more = namespaces[:*rows], len(namespaces)-*rows
+	}
+	seconds := elapsed.Seconds()
+	line := func(name string, counts map[string]int) {
+		fmt.Fprintf(w, "%-*s %10.1f", width, name, float64(total(counts))/seconds)
+		for _, o := range ops {
+			fmt.Fprintf(w, " %10.1f", float64(counts[o.op])/seconds)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%s, operations per second over %s\n\n", at.Format("2006-01-02T15:04:05"), elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "%-*s %10s", width, "ns", "total")
+	for _, o := range ops {
+		fmt.Fprintf(w, " %10s", o.name)
+	}
+	fmt.Fprintln(w)
+	for _, ns := range namespaces {
+		line(ns, s[ns])
+	}
+	if more > 0 {
+		fmt.Fprintf(w, "(%d more)\n", more)
+	}
+	line("all", all)
+}
+
+// Main runs oplogctl top, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *interval <= 0 {
+		panic(cli.Invalidf("INTERVAL must be positive"))
+	}
+	if *rows < 0 || *count < 0 {
+		panic(cli.Invalidf("ROWS and COUNT can't be negative"))
+	}
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	err = dial.CheckPrivileges(sess,
+		dial.Privilege{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+	)
+	if err != nil {
+		panic(err)
+	}
+	var last entry
+	if err := sess.DB("local").C("oplog.rs").Find(nil).Select(bson.M{"ts": 1}).Sort("-$natural").One(&last); err != nil {
+		panic(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	// a terminal's table is redrawn in place, anything else gets one
+	// after the other
+	redraw := term.IsTerminal(int(os.Stdout.Fd()))
+
+	s, started, shown := sample{}, time.Now(), 0
+	fields := bson.M{"ts": 1, "op": 1, "ns": 1, "o.applyOps.op": 1, "o.applyOps.ns": 1}
+	for failures := 0; ; failures++ {
+		iter := sess.DB("local").
+			C("oplog.rs").
+			Find(bson.M{"ts": bson.M{"$gt": last.Timestamp}}).
+			Select(fields).
+			Sort("$natural").
+			LogReplay().
+			Tail(100 * time.Millisecond)
+		for {
+			var e entry
+			if iter.Next(&e) {
+				failures = 0
+				last.Timestamp = e.Timestamp
+				s.add(&e)
+			} else if !iter.Timeout() {
+				break
+			}
+			if now := time.Now(); now.Sub(started) >= *interval {
+				if redraw {
+					os.Stdout.WriteString("\x1b[H\x1b[2J")
+				} else if shown > 0 {
+					fmt.Println()
+				}
+				s.write(os.Stdout, now, now.Sub(started))
+				s, started = sample{}, now
+				if shown++; shown == *count {
+					iter.Close()
+					return
+				}
+			}
+			select {
+			case <-stop:
+				iter.Close()
+				return
+			default:
+			}
+		}
+		err = iter.Close()
+		if failures >= *resumeRetries {
+			panic(err)
+		}
+		fmt.Fprintf(os.Stderr, "oplog cursor failed: %v, resuming\n", err)
+		time.Sleep(time.Second)
+		sess.Refresh()
+	}
+}
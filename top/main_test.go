@@ -0,0 +1,62 @@
+package top
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdd(t *testing.T) {
+	s := sample{}
+	s.add(&entry{Operation: "i", Namespace: "app.users"})
+	s.add(&entry{Operation: "u", Namespace: "app.users"})
+	s.add(&entry{Operation: "n"})
+	txn := &entry{Operation: "c", Namespace: "admin.$cmd"}
+	txn.Object.ApplyOps = []op{{"i", "app.orders"}, {"d", "app.users"}}
+	s.add(txn)
+	s.add(&entry{Operation: "c", Namespace: "app.$cmd"}) // a drop, say
+	want := sample{
+		"app.users":  {"i": 1, "u": 1, "d": 1},
+		"app.orders": {"i": 1},
+		"(none)":     {"n": 1},
+		"app.$cmd":   {"c": 1},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("%v, want %v", s, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	defer func(n int) { *rows = n }(*rows)
+	*rows = 2
+	s := sample{
+		"app.b":   {"i": 4},
+		"app.a":   {"u": 2, "d": 2},
+		"app.c":   {"i": 1},
+		"app.log": {"i": 1},
+	}
+	var b bytes.Buffer
+	s.write(&b, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), 2*time.Second)
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	want := []string{
+		"2024-05-01T12:00:00, operations per second over 2s",
+		"",
+		"ns           total     insert     update     delete    command       noop",
+		"app.a          2.0        0.0        1.0        1.0        0.0        0.0", // a tie, by name
+		"app.b          2.0        2.0        0.0        0.0        0.0        0.0",
+		"(2 more)",
+		"all            5.0        3.0        1.0        1.0        0.0        0.0", // of those not shown too
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("table\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	*rows = 0
+	b.Reset()
+	s.write(&b, time.Now(), time.Second)
+	if strings.Contains(b.String(), "more") || !strings.Contains(b.String(), "app.log") {
+		t.Errorf("all rows shown with ROWS 0:\n%s", b.String())
+	}
+}
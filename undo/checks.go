@@ -0,0 +1,31 @@
+package undo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		parts := strings.SplitN(*ns, ".", 2)
+		if len(parts) != 2 {
+			return []cli.Check{{Name: "NS", Run: func() error { return fmt.Errorf("NS %q must be db.collection", *ns) }}}
+		}
+		list := []cli.Check{{Name: "MONGO_URL", Run: func() error {
+			return dial.Probe(*mongoURL, dial.Privilege{DB: parts[0], Collection: parts[1], Actions: []string{"changeStream", "find"}})
+		}}}
+		if *applyPlan {
+			target := *targetURL
+			if target == "" {
+				target = *mongoURL
+			}
+			list = append(list, cli.Check{Name: "TARGET_URL", Run: func() error {
+				return dial.Probe(target, dial.Privilege{DB: parts[0], Collection: parts[1], Actions: []string{"insert", "update", "remove"}})
+			}})
+		}
+		return list
+	})
+}
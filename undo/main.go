@@ -0,0 +1,367 @@
+// Package undo undoes a range of writes to a collection, the oplogctl undo command.
+package undo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("undo", "plan and apply compensating writes for a range of writes from pre-images")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL   = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the cluster the writes were made on, 6.0+ for pre-images")
+	ns         = flags.String("NS", "", "db.collection the writes to undo were made on")
+	from       = flags.String("FROM", "", "undo writes after this ts, seconds[:increment] or RFC 3339")
+	to         = flags.String("TO", "", "undo writes up to this ts")
+	backupFile = flags.String("BACKUP_FILE", "", "bson dump of the collection from before FROM, for documents without a pre-image")
+	applyPlan  = flags.Bool("APPLY", false, "apply the compensating operations, otherwise they're only printed")
+	targetURL  = flags.String("TARGET_URL", "", "mongodb url to apply to, MONGO_URL if empty")
+)
+
+// touched is what happened to one document in the range
+type touched struct {
+	id       interface{}
+	inserted bool   // by the first write in the range
+	replaced bool   // replaced or deleted at some point, only the whole document undoes that
+	deleted  bool   // gone by the end of the range
+	before   bson.M // the document before the first write, nil without a pre-image
+	fields   map[string]bool
+}
+
+type changeEvent struct {
+	OperationType string              `bson:"operationType"`
+	ClusterTime   bson.MongoTimestamp `bson:"clusterTime"`
+	DocumentKey   bson.M              `bson:"documentKey"`
+	Before        bson.M              `bson:"fullDocumentBeforeChange"`
+	Update        struct {
+		UpdatedFields   bson.M   `bson:"updatedFields"`
+		RemovedFields   []string `bson:"removedFields"`
+		TruncatedArrays []struct {
+			Field string `bson:"field"`
+		} `bson:"truncatedArrays"`
+	} `bson:"updateDescription"`
+}
+
+type changeCursor struct {
+	Cursor struct {
+		ID         int64      `bson:"id"`
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		NextBatch  []bson.Raw `bson:"nextBatch"`
+	} `bson:"cursor"`
+	OperationTime bson.MongoTimestamp `bson:"operationTime"`
+}
+
+func idKey(id interface{}) string {
+	data, _ := bson.Marshal(bson.M{"_id": id})
+	return string(data)
+}
+
+// writes are the documents written, in the order they first were
+type writes struct {
+	docs []*touched
+	byID map[string]*touched
+}
+
+// add records e, a change to db.coll. It errors on the collection
+// dropped or renamed, writes after that can't be undone document by
+// document.
+func (w *writes) add(db, coll string, e changeEvent) error {
+	id, ok := e.DocumentKey["_id"]
+	if !ok {
+		if e.OperationType == "drop" || e.OperationType == "rename" || e.OperationType == "invalidate" {
+			return fmt.Errorf("%s.%s was %s at %s, undo the writes before it", db, coll, e.OperationType, optime.Format(e.ClusterTime))
+		}
+		return nil
+	}
+	t := w.byID[idKey(id)]
+	if t == nil {
+		t = &touched{id: id, inserted: e.OperationType == "insert", before: e.Before, fields: make(map[string]bool)}
+		w.byID[idKey(id)] = t
+		w.docs = append(w.docs, t)
+	}
+	switch e.OperationType {
+	case "insert":
+		t.deleted = false
+	case "update":
+		for f := range e.Update.UpdatedFields {
+			t.fields[f] = true
+		}
+		for _, f := range e.Update.RemovedFields {
+			t.fields[f] = true
+		}
+		for _, a := range e.Update.TruncatedArrays {
+			t.fields[a.Field] = true
+		}
+	case "replace":
+		t.replaced = true
+	case "delete":
+		t.replaced, t.deleted = true, true
+	}
+	return nil
+}
+
+// collect reads the writes to db.coll after since up to until from a
+// change stream with pre-images, in the order they were made
+func collect(sess *mgo.Session, db, coll string, since, until bson.MongoTimestamp) ([]*touched, error) {
+	w := &writes{byID: make(map[string]*touched)}
+	res := changeCursor{}
+	err := sess.DB(db).Run(bson.D{
+		{Name: "aggregate", Value: coll},
+		{Name: "pipeline", Value: []bson.M{{"$changeStream": bson.D{
+			{Name: "fullDocumentBeforeChange", Value: "whenAvailable"},
+			{Name: "startAtOperationTime", Value: since + 1},
+		}}}},
+		{Name: "cursor", Value: bson.M{}},
+	}, &res)
+	batch := res.Cursor.FirstBatch
+	for err == nil {
+		for _, raw := range batch {
+			var e changeEvent
+			if err := raw.Unmarshal(&e); err != nil {
+				return nil, err
+			}
+			if e.ClusterTime > until {
+				return w.docs, nil
+			}
+			if err := w.add(db, coll, e); err != nil {
+				return nil, err
+			}
+		}
+		// caught up past until once the server's time is
+		if res.Cursor.ID == 0 || len(batch) == 0 && res.OperationTime > until {
+			return w.docs, nil
+		}
+		id := res.Cursor.ID
+		res = changeCursor{}
+		err = sess.DB(db).Run(bson.D{
+			{Name: "getMore", Value: id},
+			{Name: "collection", Value: coll},
+			{Name: "maxTimeMS", Value: 1000},
+		}, &res)
+		batch = res.Cursor.NextBatch
+	}
+	return nil, err
+}
+
+// loadBackup reads the documents of BACKUP_FILE touched, by _id
+func loadBackup(path string, docs []*touched) (map[string]bson.M, error) {
+	wanted := make(map[string]bool, len(docs))
+	for _, t := range docs {
+		if t.before == nil {
+			wanted[idKey(t.id)] = true
+		}
+	}
+	backup := make(map[string]bson.M)
+	if path == "" || len(wanted) == 0 {
+		return backup, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bsonfile.NewReader(f)
+	for {
+		var doc bson.M
+		err := r.Next(&doc)
+		if err == io.EOF {
+			return backup, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key := idKey(doc["_id"]); wanted[key] {
+			backup[key] = doc
+		}
+	}
+}
+
+// lookupPath returns the value at a dotted path, array elements by index
+func lookupPath(doc bson.M, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, k := range strings.Split(path, ".") {
+		switch cur := v.(type) {
+		case bson.M:
+			var ok bool
+			if v, ok = cur[k]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			var i int
+			if _, err := fmt.Sscanf(k, "%d", &i); err != nil || i < 0 || i >= len(cur) {
+				return nil, false
+			}
+			v = cur[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// revert returns the update setting fields back as they were in before,
+// fields inside another field reverted going with it
+func revert(before bson.M, fields map[string]bool) bson.M {
+	set, unset := bson.M{}, bson.M{}
+	for f := range fields {
+		covered := false
+		for p := range fields {
+			if strings.HasPrefix(f, p+".") {
+				covered = true
+			}
+		}
+		if covered {
+			continue
+		}
+		if v, ok := lookupPath(before, f); ok {
+			set[f] = v
+		} else {
+			unset[f] = ""
+		}
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// compensation is one operation undoing a document's writes
+type compensation struct {
+	Op     string      `bson:"op"` // delete, replace or update
+	ID     interface{} `bson:"_id"`
+	Doc    bson.M      `bson:"doc,omitempty"`
+	Update bson.M      `bson:"update,omitempty"`
+	From   string      `bson:"from,omitempty"` // where the document before came from
+}
+
+// plan returns what undoes docs, and the ids that can't be undone for
+// lack of a document before
+func plan(docs []*touched, backup map[string]bson.M) ([]compensation, []interface{}) {
+	var ops []compensation
+	var lost []interface{}
+	for _, t := range docs {
+		if t.inserted {
+			if !t.deleted {
+				ops = append(ops, compensation{Op: "delete", ID: t.id})
+			}
+			continue
+		}
+		before, source := t.before, "pre-image"
+		if before == nil {
+			before, source = backup[idKey(t.id)], "backup"
+		}
+		switch {
+		case before == nil:
+			lost = append(lost, t.id)
+		case t.replaced:
+			ops = append(ops, compensation{Op: "replace", ID: t.id, Doc: before, From: source})
+		case len(t.fields) > 0:
+			ops = append(ops, compensation{Op: "update", ID: t.id, Update: revert(before, t.fields), From: source})
+		}
+	}
+	return ops, lost
+}
+
+// Main runs oplogctl undo, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	i := strings.Index(*ns, ".")
+	if i <= 0 || i == len(*ns)-1 {
+		panic(cli.Invalidf("NS %q must be db.collection", *ns))
+	}
+	db, coll := (*ns)[:i], (*ns)[i+1:]
+	since, err := optime.Parse(*from)
+	if err != nil {
+		panic(cli.Invalidf("FROM: %s", err))
+	}
+	until, err := optime.Parse(*to)
+	if err != nil {
+		panic(cli.Invalidf("TO: %s", err))
+	}
+	if since == 0 || until == 0 {
+		panic(cli.Invalidf("FROM and TO are needed"))
+	}
+
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	err = dial.CheckPrivileges(sess,
+		dial.Privilege{DB: db, Collection: coll, Actions: []string{"changeStream", "find"}},
+	)
+	if err != nil {
+		panic(err)
+	}
+	docs, err := collect(sess, db, coll, since, until)
+	if err != nil {
+		panic(err)
+	}
+	backup, err := loadBackup(*backupFile, docs)
+	if err != nil {
+		panic(err)
+	}
+	ops, lost := plan(docs, backup)
+	for _, id := range lost {
+		fmt.Fprintf(os.Stderr, "%v can't be undone, no pre-image and not in BACKUP_FILE\n", id)
+	}
+	for _, op := range ops {
+		if op.From == "backup" {
+			fmt.Fprintf(os.Stderr, "%v restored from the backup, changes between it and FROM are undone too\n", op.ID)
+		}
+		var doc bson.M
+		data, _ := bson.Marshal(op)
+		bson.Unmarshal(data, &doc)
+		line, err := bsonfile.MarshalJSON(doc)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(line))
+	}
+	fmt.Fprintf(os.Stderr, "%d documents written, %d compensating operations, %d can't be undone\n", len(docs), len(ops), len(lost))
+	if !*applyPlan {
+		return
+	}
+
+	dst := sess
+	if *targetURL != "" {
+		if dst, err = dial.Dial(*targetURL); err != nil {
+			panic(err)
+		}
+	}
+	c := dst.DB(db).C(coll)
+	for _, op := range ops {
+		switch op.Op {
+		case "delete":
+			err = c.RemoveId(op.ID)
+		case "replace":
+			_, err = c.UpsertId(op.ID, op.Doc)
+		case "update":
+			err = c.UpdateId(op.ID, op.Update)
+		}
+		if err == mgo.ErrNotFound {
+			err = nil // deleted since, nothing left to revert
+		}
+		if err != nil {
+			panic(fmt.Errorf("undoing %v: %s", op.ID, err))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "applied %d compensating operations\n", len(ops))
+}
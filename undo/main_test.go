@@ -0,0 +1,185 @@
+package undo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// event is a change of the document with id, before it being its
+// pre-image and fields those an update set or removed
+func event(op string, id interface{}, before bson.M, fields ...string) changeEvent {
+	e := changeEvent{OperationType: op, DocumentKey: bson.M{"_id": id}, Before: before}
+	for _, f := range fields {
+		if strings.HasPrefix(f, "-") {
+			e.Update.RemovedFields = append(e.Update.RemovedFields, f[1:])
+			continue
+		}
+		if e.Update.UpdatedFields == nil {
+			e.Update.UpdatedFields = bson.M{}
+		}
+		e.Update.UpdatedFields[f] = true
+	}
+	return e
+}
+
+func TestWrites(t *testing.T) {
+	w := &writes{byID: make(map[string]*touched)}
+	for _, e := range []changeEvent{
+		event("insert", 1, nil),
+		event("update", 2, bson.M{"_id": 2, "a": 1}, "a", "-b"),
+		event("update", 1, nil, "x"),
+		event("delete", 3, bson.M{"_id": 3}),
+		event("insert", 3, nil),
+		event("update", 2, bson.M{"_id": 2, "a": 5}, "c"),
+		event("insert", 4, nil),
+		event("delete", 4, nil),
+		{OperationType: "dropIndexes"},
+	} {
+		if err := w.add("app", "users", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.docs) != 4 {
+		t.Fatalf("%d documents, want 4", len(w.docs))
+	}
+	one, two, three, four := w.docs[0], w.docs[1], w.docs[2], w.docs[3]
+	if one.id != 1 || !one.inserted || one.deleted {
+		t.Errorf("inserted then updated: %+v", one)
+	}
+	// the first pre-image is the document before the range
+	if !reflect.DeepEqual(two.before, bson.M{"_id": 2, "a": 1}) || !reflect.DeepEqual(two.fields, map[string]bool{"a": true, "b": true, "c": true}) {
+		t.Errorf("updated twice: %+v", two)
+	}
+	if three.inserted || !three.replaced || three.deleted {
+		t.Errorf("deleted then inserted again: %+v", three)
+	}
+	if !four.inserted || !four.deleted {
+		t.Errorf("inserted then deleted: %+v", four)
+	}
+
+	for _, op := range []string{"drop", "rename", "invalidate"} {
+		err := w.add("app", "users", changeEvent{OperationType: op, ClusterTime: 5 << 32})
+		if err == nil || !strings.Contains(err.Error(), "app.users was "+op) {
+			t.Errorf("%s: %v", op, err)
+		}
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	doc := bson.M{"a": bson.M{"b": []interface{}{10, bson.M{"c": "x"}}}, "n": nil}
+	for _, c := range []struct {
+		path string
+		v    interface{}
+		ok   bool
+	}{
+		{"a.b.0", 10, true},
+		{"a.b.1.c", "x", true},
+		{"n", nil, true},
+		{"a.b.2", nil, false},
+		{"a.b.-1", nil, false},
+		{"a.b.x", nil, false},
+		{"a.z", nil, false},
+		{"a.b.0.c", nil, false},
+		{"missing", nil, false},
+	} {
+		v, ok := lookupPath(doc, c.path)
+		if ok != c.ok || !reflect.DeepEqual(v, c.v) {
+			t.Errorf("%s: %v %v, want %v %v", c.path, v, ok, c.v, c.ok)
+		}
+	}
+}
+
+func TestRevert(t *testing.T) {
+	before := bson.M{"_id": 1, "a": 1, "o": bson.M{"x": 1, "y": 2}, "l": []interface{}{1, 2, 3}}
+	for _, c := range []struct {
+		fields []string
+		want   bson.M
+	}{
+		{[]string{"a"}, bson.M{"$set": bson.M{"a": 1}}},
+		{[]string{"b"}, bson.M{"$unset": bson.M{"b": ""}}},
+		{[]string{"a", "b"}, bson.M{"$set": bson.M{"a": 1}, "$unset": bson.M{"b": ""}}},
+		// inside another field changed, reverted with it
+		{[]string{"o", "o.x", "o.z"}, bson.M{"$set": bson.M{"o": bson.M{"x": 1, "y": 2}}}},
+		{[]string{"o.x", "o.z"}, bson.M{"$set": bson.M{"o.x": 1}, "$unset": bson.M{"o.z": ""}}},
+		{[]string{"l.1", "l.5"}, bson.M{"$set": bson.M{"l.1": 2}, "$unset": bson.M{"l.5": ""}}},
+		{[]string{"ox"}, bson.M{"$unset": bson.M{"ox": ""}}}, // o isn't its parent
+		{nil, bson.M{}},
+	} {
+		fields := map[string]bool{}
+		for _, f := range c.fields {
+			fields[f] = true
+		}
+		if got := revert(before, fields); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: %v, want %v", c.fields, got, c.want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	pre := bson.M{"_id": 2, "a": 1}
+	backedUp := bson.M{"_id": 5, "a": 9}
+	docs := []*touched{
+		{id: 1, inserted: true, fields: map[string]bool{"x": true}},
+		{id: 2, before: pre, fields: map[string]bool{"a": true}},
+		{id: 3, inserted: true, deleted: true},
+		{id: 4, before: bson.M{"_id": 4}, replaced: true, deleted: true},
+		{id: 5, fields: map[string]bool{"a": true}},
+		{id: 6, replaced: true},
+		{id: 7, before: bson.M{"_id": 7}, fields: map[string]bool{}},
+	}
+	ops, lost := plan(docs, map[string]bson.M{idKey(5): backedUp})
+	want := []compensation{
+		{Op: "delete", ID: 1},
+		{Op: "update", ID: 2, Update: bson.M{"$set": bson.M{"a": 1}}, From: "pre-image"},
+		{Op: "replace", ID: 4, Doc: bson.M{"_id": 4}, From: "pre-image"},
+		{Op: "update", ID: 5, Update: bson.M{"$set": bson.M{"a": 9}}, From: "backup"},
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("planned\n%v\nwant\n%v", ops, want)
+	}
+	if !reflect.DeepEqual(lost, []interface{}{6}) {
+		t.Errorf("lost %v, want [6]", lost)
+	}
+}
+
+func TestLoadBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.bson")
+	var dump []byte
+	for _, doc := range []bson.M{{"_id": 1, "a": 1}, {"_id": "two", "a": 2}, {"_id": 3, "a": 3}} {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dump = append(dump, data...)
+	}
+	if err := os.WriteFile(path, dump, 0644); err != nil {
+		t.Fatal(err)
+	}
+	docs := []*touched{
+		{id: 1},
+		{id: "two", before: bson.M{"_id": "two"}}, // has a pre-image
+		{id: 3},
+		{id: 4}, // not in the backup
+	}
+	backup, err := loadBackup(path, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup) != 2 || backup[idKey(1)]["a"] != 1 || backup[idKey(3)]["a"] != 3 {
+		t.Errorf("loaded %v, want 1 and 3", backup)
+	}
+	if backup, err := loadBackup("", docs); err != nil || len(backup) != 0 {
+		t.Errorf("without a backup: %v, %v", backup, err)
+	}
+	if err := os.WriteFile(path, dump[:len(dump)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBackup(path, docs); err == nil {
+		t.Error("a truncated backup loaded")
+	}
+}
@@ -0,0 +1,148 @@
+// Package validate checks a deployment's settings before it runs, the
+// oplogctl validate-config command.
+package validate
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/config"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/sinkauth"
+)
+
+var flags = cli.NewFlagSet("validate-config", "check the configuration file, probe what commands connect to and print their effective settings")
+
+func init() {
+	cli.Register(flags, Main)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "validate-config: %s\n\nusage: oplogctl validate-config [-config file] [command [-NAME=value ...]]\n\n", flags.Summary)
+		fmt.Fprintf(os.Stderr, "without a command every command with a table in the file is checked\n")
+	}
+}
+
+// secret names settings whose values aren't printed
+var secret = regexp.MustCompile(`PASSWORD|SECRET|TOKEN|(^|_)KEY$`)
+
+// redact hides name's value if it's a secret, or the password of a url in it
+func redact(name, value string) string {
+	if value != "" && secret.MatchString(name) {
+		return "[redacted]"
+	}
+	return sinkauth.Redact(dial.Redact(value))
+}
+
+// commands lists the commands file has a table for
+func commands(file *config.File) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, s := range file.Settings {
+		if name := s.Path[0]; name != "shared" && name != flags.Name() && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// check prints the effective settings of command name, those it doesn't
+// leave at their default with where they came from, then runs its checks,
+// returning how many failed
+func check(name string, args []string) int {
+	c, ok := cli.Lookup(name)
+	if !ok || name == flags.Name() {
+		fmt.Fprintf(os.Stderr, "validate-config: unknown command %q\n", name)
+		os.Exit(cli.ExitUsage)
+	}
+	c.Flags.Parse(args)
+	fmt.Printf("%s\n", name)
+	defaults := 0
+	c.Flags.VisitAll(func(f *flag.Flag) {
+		origin := c.Flags.Origin(f.Name)
+		if f.Name == "config" {
+			return
+		}
+		if origin == "" {
+			defaults++
+			return
+		}
+		fmt.Printf("  %s=%s\t(%s)\n", f.Name, redact(f.Name, f.Value.String()), origin)
+	})
+	fmt.Printf("  %d settings at their default\n", defaults)
+	if c.Checks == nil {
+		return 0
+	}
+	failed := 0
+	for _, ch := range c.Checks() {
+		if err := ch.Run(); err != nil {
+			fmt.Printf("  FAIL %s: %s\n", ch.Name, sinkauth.Redact(err.Error()))
+			failed++
+			continue
+		}
+		fmt.Printf("  ok   %s\n", ch.Name)
+	}
+	return failed
+}
+
+// Main validates the configuration file against every command, strictly,
+// then checks a command, or every command the file configures: its
+// effective settings are printed, secrets redacted, and what it connects
+// to is probed, mongodb with the privileges it uses. Sink credentials are
+// loaded and oauth2 ones fetch a token. It exits with status 1 if a check
+// fails.
+func Main(args []string) {
+	flags.Parse(args)
+	path := flags.Lookup("config").Value.String()
+	if path == "" {
+		path = os.Getenv(cli.ConfigEnv)
+	}
+	var names []string
+	rest := flags.Args()
+	if len(rest) > 0 {
+		names, rest = rest[:1], rest[1:]
+	}
+	if path != "" {
+		file, err := config.Load(path)
+		if err == nil {
+			err = cli.Validate(file)
+		}
+		if err != nil {
+			cli.Fail(err)
+		}
+		fmt.Printf("%s: %d settings\n", path, len(file.Settings))
+		if names == nil {
+			names = commands(file)
+		}
+		rest = append([]string{"-config", path}, rest...)
+	}
+	if len(names) == 0 {
+		flags.Usage()
+		panic(cli.Invalidf("no command to check, name one or give a configuration file"))
+	}
+
+	failed := 0
+	for _, name := range names {
+		failed += check(name, rest)
+	}
+	// as the commands' tables set it
+	auth, err := sinkauth.Load()
+	if err != nil {
+		fmt.Printf("FAIL SINK_AUTH_FILE: %s\n", err)
+		failed++
+	}
+	for sink, a := range auth {
+		if err := a.Check(); err != nil {
+			fmt.Printf("FAIL sink %s, %s: %s\n", sink, a, sinkauth.Redact(err.Error()))
+			failed++
+			continue
+		}
+		fmt.Printf("ok   sink %s, %s\n", sink, a)
+	}
+	if failed > 0 {
+		fmt.Printf("%d checks failed\n", failed)
+		os.Exit(cli.ExitFailure)
+	}
+}
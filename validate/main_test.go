@@ -0,0 +1,68 @@
+package validate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/config"
+)
+
+func TestRedact(t *testing.T) {
+	for _, c := range []struct {
+		name, value, want string
+	}{
+		{"MONGO_PASSWORD", "hunter2", "[redacted]"},
+		{"CLIENT_SECRET", "s3cret", "[redacted]"},
+		{"SINK_TOKEN", "abc", "[redacted]"},
+		{"API_KEY", "abc", "[redacted]"},
+		{"KEY", "abc", "[redacted]"},
+		{"KEYS", "a,b", "a,b"},     // not a key's value
+		{"MONGO_PASSWORD", "", ""}, // empty shows it unset
+		{"MONGO_URL", "mongodb://admin:hunter2@db:27017/app", "mongodb://admin:[redacted]@db:27017/app"},
+		{"MONGO_URL", "mongodb://db:27017", "mongodb://db:27017"},
+	} {
+		if got := redact(c.name, c.value); got != c.want {
+			t.Errorf("%s=%s: %q, want %q", c.name, c.value, got, c.want)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	file, err := config.Parse("oplogctl.yaml", []byte(
+		"shared:\n  mongo_url: mongodb://db\n"+
+			"tail:\n  dir: /tmp\n  batch: 10\n"+
+			"validate-config:\n  config: x\n"+
+			"archive:\n  bucket: b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := commands(file), []string{"tail", "archive"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%v, want %v", got, want)
+	}
+	if got := commands(&config.File{}); got != nil {
+		t.Errorf("an empty file configures %v", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	f := cli.NewFlagSet("validatetest", "for tests")
+	f.String("VALIDATETEST_DIR", "/var", "")
+	cli.Register(f, func([]string) {})
+	ran := 0
+	cli.RegisterChecks(f, func() []cli.Check {
+		return []cli.Check{
+			{Name: "fine", Run: func() error { ran++; return nil }},
+			{Name: "broken", Run: func() error { ran++; return errors.New("unreachable") }},
+		}
+	})
+	if failed := check("validatetest", []string{"-VALIDATETEST_DIR=/tmp"}); failed != 1 || ran != 2 {
+		t.Errorf("%d failed of %d run, want 1 of 2", failed, ran)
+	}
+
+	cli.Register(cli.NewFlagSet("validatetest-unchecked", "for tests"), func([]string) {})
+	if failed := check("validatetest-unchecked", nil); failed != 0 {
+		t.Errorf("%d failed without checks", failed)
+	}
+}
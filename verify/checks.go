@@ -0,0 +1,16 @@
+package verify
+
+import (
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+)
+
+func init() {
+	cli.RegisterChecks(flags, func() []cli.Check {
+		read := dial.Privilege{Actions: []string{"find", "listCollections"}}
+		return []cli.Check{
+			{Name: "MONGO_URL", Run: func() error { return dial.Probe(*mongoURL, read) }},
+			{Name: "TARGET_URL", Run: func() error { return dial.Probe(*targetURL, read) }},
+		}
+	})
+}
@@ -0,0 +1,271 @@
+// Package verify compares a source cluster and a target kept in sync with it, the oplogctl verify command.
+package verify
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hanjoyo/oplog-abuse/bsonfile"
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/remap"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("verify", "compare counts and chunk hashes between a source and a target")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL   = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the source cluster")
+	targetURL  = flags.String("TARGET_URL", "", "mongodb url of the cluster kept in sync with it, by clone or replay, the only kind of target verified")
+	ns         = flags.String("NS", "", "comma separated dbs or db.collections to verify, every collection outside admin, local and config if empty")
+	remapRules = flags.String("REMAP", "", "namespaces the target holds under other names, as clone and replay take it")
+	chunkSize  = flags.Int("CHUNK", 1000, "documents hashed together, chunks whose hashes differ are compared document by document")
+)
+
+// divergence is a document that differs between source and target
+type divergence struct {
+	Namespace string          `json:"ns"`
+	ID        json.RawMessage `json:"_id"` // extended json
+	Problem   string          `json:"problem"`
+}
+
+// doc is a document's _id and hash
+type doc struct {
+	id   interface{}
+	key  string // the _id's bson, to match documents by
+	hash [md5.Size]byte
+}
+
+// readChunk reads up to n documents of c by _id after after, up to upto,
+// bounds being left out when nil
+func readChunk(c *mgo.Collection, after, upto interface{}, n int) ([]doc, error) {
+	bounds := bson.M{}
+	if after != nil {
+		bounds["$gt"] = after
+	}
+	if upto != nil {
+		bounds["$lte"] = upto
+	}
+	query := bson.M{}
+	if len(bounds) > 0 {
+		query["_id"] = bounds
+	}
+	q := c.Find(query).Sort("_id")
+	if n > 0 {
+		q = q.Limit(n)
+	}
+	iter := q.Iter()
+	var docs []doc
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		var key struct {
+			ID bson.Raw `bson:"_id"`
+		}
+		if err := raw.Unmarshal(&key); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		var id interface{}
+		if err := key.ID.Unmarshal(&id); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		docs = append(docs, doc{
+			id:   id,
+			key:  string(key.ID.Kind) + string(key.ID.Data),
+			hash: md5.Sum(raw.Data),
+		})
+	}
+	return docs, iter.Close()
+}
+
+func chunkHash(docs []doc) [md5.Size]byte {
+	h := md5.New()
+	for _, d := range docs {
+		h.Write(d.hash[:])
+	}
+	var sum [md5.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// compare reports the documents of two chunks that differ
+func compare(ns string, source, target []doc, report func(string, interface{}, string)) {
+	byKey := make(map[string]doc, len(target))
+	for _, d := range target {
+		byKey[d.key] = d
+	}
+	for _, s := range source {
+		t, ok := byKey[s.key]
+		switch {
+		case !ok:
+			report(ns, s.id, "missing")
+		case s.hash != t.hash:
+			report(ns, s.id, "different")
+		}
+		delete(byKey, s.key)
+	}
+	for _, t := range target {
+		if _, ok := byKey[t.key]; ok {
+			report(ns, t.id, "extra")
+		}
+	}
+}
+
+// verify compares db.coll on src with what it's renamed to on dst, a chunk
+// of the source's documents at a time against the target's in the same
+// _id range. Both are read while possibly being written to, a document
+// changed in between shows as different: verify again once caught up.
+func verify(src, dst *mgo.Session, ns string, rules *remap.Rules, report func(string, interface{}, string)) (int, error) {
+	i := strings.Index(ns, ".")
+	to := rules.Rename(ns)
+	j := strings.Index(to, ".")
+	from, target := src.DB(ns[:i]).C(ns[i+1:]), dst.DB(to[:j]).C(to[j+1:])
+
+	sourceCount, err := from.Count()
+	if err != nil {
+		return 0, err
+	}
+	targetCount, err := target.Count()
+	if err != nil {
+		return 0, err
+	}
+	if sourceCount != targetCount {
+		fmt.Fprintf(os.Stderr, "%s: %d documents, %d on the target as %s\n", ns, sourceCount, targetCount, to)
+	}
+
+	chunks, diverged := 0, 0
+	var after interface{}
+	for {
+		source, err := readChunk(from, after, nil, *chunkSize)
+		if err != nil {
+			return diverged, err
+		}
+		var upto interface{} // the last chunk takes the rest of the target
+		if len(source) == *chunkSize {
+			upto = source[len(source)-1].id
+		}
+		t, err := readChunk(target, after, upto, 0)
+		if err != nil {
+			return diverged, err
+		}
+		chunks++
+		if chunkHash(source) != chunkHash(t) {
+			diverged++
+			compare(ns, source, t, report)
+		}
+		if upto == nil {
+			break
+		}
+		after = upto
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d of %d chunks differ\n", ns, diverged, chunks)
+	return diverged, nil
+}
+
+// namespaces lists the collections NS covers
+func namespaces(sess *mgo.Session) ([]string, error) {
+	var dbs, found []string
+	for _, n := range strings.Split(*ns, ",") {
+		switch n = strings.TrimSpace(n); {
+		case n == "":
+		case strings.Contains(n, "."):
+			found = append(found, n)
+		default:
+			dbs = append(dbs, n)
+		}
+	}
+	if len(dbs) == 0 && len(found) == 0 {
+		names, err := sess.DatabaseNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, db := range names {
+			if db != "admin" && db != "local" && db != "config" {
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	for _, db := range dbs {
+		names, err := sess.DB(db).CollectionNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range names {
+			if !strings.HasPrefix(c, "system.") {
+				found = append(found, db+"."+c)
+			}
+		}
+	}
+	return found, nil
+}
+
+// Main compares collections between a source and a mongodb target,
+// printing the ids of documents missing, extra or different on the target
+// as json lines. It exits with status 1 if any differ.
+func Main(args []string) {
+	flags.Parse(args)
+	if *targetURL == "" {
+		panic(cli.Invalidf("TARGET_URL not set"))
+	}
+	if i := strings.Index(*targetURL, "://"); i >= 0 && (*targetURL)[:i] != "mongodb" {
+		// there's no postgres or elasticsearch sink to compare with
+		panic(cli.Invalidf("TARGET_URL %s: only mongodb targets are verified", dial.Redact(*targetURL)))
+	}
+	if *chunkSize <= 0 {
+		panic(cli.Invalidf("CHUNK must be positive"))
+	}
+	rules, err := remap.Parse(*remapRules)
+	if err != nil {
+		panic(err)
+	}
+	src, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	dst, err := dial.Dial(*targetURL)
+	if err != nil {
+		panic(err)
+	}
+	list, err := namespaces(src)
+	if err != nil {
+		panic(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	report := func(ns string, id interface{}, problem string) {
+		data, err := bsonfile.MarshalJSON(bson.M{"_id": id})
+		if err != nil {
+			panic(err)
+		}
+		var ext struct {
+			ID json.RawMessage `json:"_id"`
+		}
+		if err := json.Unmarshal(data, &ext); err != nil {
+			panic(err)
+		}
+		if err := enc.Encode(divergence{Namespace: ns, ID: ext.ID, Problem: problem}); err != nil {
+			panic(err)
+		}
+	}
+	diverged := 0
+	for _, ns := range list {
+		n, err := verify(src, dst, ns, rules, report)
+		if err != nil {
+			panic(fmt.Errorf("verifying %s: %s", ns, err))
+		}
+		diverged += n
+	}
+	if diverged > 0 {
+		os.Exit(1)
+	}
+}
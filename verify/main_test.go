@@ -0,0 +1,72 @@
+package verify
+
+import (
+	"crypto/md5"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// docOf is a doc as readChunk reads it
+func docOf(t *testing.T, d bson.D) doc {
+	data, err := bson.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := bson.Marshal(bson.D{{Name: "_id", Value: d[0].Value}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key struct {
+		ID bson.Raw `bson:"_id"`
+	}
+	if err := bson.Unmarshal(id, &key); err != nil {
+		t.Fatal(err)
+	}
+	return doc{id: d[0].Value, key: string(key.ID.Kind) + string(key.ID.Data), hash: md5.Sum(data)}
+}
+
+func TestCompare(t *testing.T) {
+	source := []doc{
+		docOf(t, bson.D{{Name: "_id", Value: 1}, {Name: "n", Value: 1}}),
+		docOf(t, bson.D{{Name: "_id", Value: 2}, {Name: "n", Value: 2}}),
+		docOf(t, bson.D{{Name: "_id", Value: 3}, {Name: "n", Value: 3}}),
+		docOf(t, bson.D{{Name: "_id", Value: "4"}, {Name: "n", Value: 4}}),
+	}
+	target := []doc{
+		docOf(t, bson.D{{Name: "_id", Value: 1}, {Name: "n", Value: 1}}),
+		docOf(t, bson.D{{Name: "_id", Value: 2}, {Name: "n", Value: 20}}),
+		// 3 missing, and the int 4 isn't the string "4"
+		docOf(t, bson.D{{Name: "_id", Value: 4}, {Name: "n", Value: 4}}),
+		docOf(t, bson.D{{Name: "_id", Value: 5}, {Name: "n", Value: 5}}),
+	}
+	var got []string
+	compare("app.c", source, target, func(ns string, id interface{}, problem string) {
+		got = append(got, fmt.Sprintf("%s %s %#v", ns, problem, id))
+	})
+	sort.Strings(got)
+	want := []string{"app.c different 2", "app.c extra 4", "app.c extra 5", "app.c missing \"4\"", "app.c missing 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reported %q, want %q", got, want)
+	}
+
+	compare("app.c", source, source, func(ns string, id interface{}, problem string) {
+		t.Errorf("the same chunk reported %s %v", problem, id)
+	})
+}
+
+func TestChunkHash(t *testing.T) {
+	a := docOf(t, bson.D{{Name: "_id", Value: 1}})
+	b := docOf(t, bson.D{{Name: "_id", Value: 2}})
+	if chunkHash([]doc{a, b}) != chunkHash([]doc{a, b}) {
+		t.Error("a chunk's hash changes")
+	}
+	for _, other := range [][]doc{{b, a}, {a}, {a, a, b}, nil} {
+		if chunkHash([]doc{a, b}) == chunkHash(other) {
+			t.Errorf("chunks of %d documents hash alike", len(other))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Package window reports the oplog's window, how fast it's written and how
+// long a consumer can be down before what it's yet to read is gone, the
+// oplogctl window command.
+package window
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("window", "report the oplog window, its GB per hour and how long a consumer can be down for")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL    = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the replica set to report the oplog of")
+	recent      = flags.Duration("RECENT", time.Hour, "the recent rate projections use is measured over the entries of this long, 0 to use the window's average")
+	from        = flags.String("FROM", "", "a consumer's checkpoint, seconds[:increment] or RFC 3339, also reported on: how long until it rolls off")
+	minDowntime = flags.Duration("MIN_DOWNTIME", 0, "exit with 1 if a consumer, at FROM or caught up, can be down for less, 0 to never")
+	format      = flags.String("FORMAT", "text", "text, or json for a report to alert on")
+)
+
+const gb = 1e9
+
+// report is what's printed, sizes in bytes, rates in GB an hour and
+// durations in seconds
+type report struct {
+	Size      int64   `json:"size"`     // of the entries, uncompressed
+	MaxSize   int64   `json:"max_size"` // it's truncated to
+	Entries   int64   `json:"entries"`
+	First     string  `json:"first"`
+	Last      string  `json:"last"`
+	FirstAt   string  `json:"first_at"`
+	LastAt    string  `json:"last_at"`
+	Window    float64 `json:"window"`   // from the first entry to the last
+	Average   float64 `json:"average"`  // GB per hour over the window
+	Recent    float64 `json:"recent"`   // GB per hour over RECENT, 0 if unmeasured
+	Rate      float64 `json:"rate"`     // GB per hour projections are at
+	FullIn    float64 `json:"full_in"`  // until the oplog's full, 0 if it is
+	Downtime  float64 `json:"downtime"` // a consumer caught up can be down for
+	From      string  `json:"from,omitempty"`
+	FromLeft  float64 `json:"from_left"` // until FROM rolls off, 0 if it has
+	RolledOff bool    `json:"rolled_off,omitempty"`
+}
+
+var privileges = []dial.Privilege{
+	{DB: "local", Collection: "oplog.rs", Actions: []string{"find", "collStats"}},
+}
+
+type entry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+}
+
+// seconds returns d as a duration, to the minute
+func seconds(d float64) time.Duration {
+	return time.Duration(d * float64(time.Second)).Round(time.Minute)
+}
+
+// oplogStats is what's measured of the oplog
+type oplogStats struct {
+	Size       int64   `bson:"size"`
+	MaxSize    int64   `bson:"maxSize"`
+	Count      int64   `bson:"count"`
+	AvgObjSize float64 `bson:"avgObjSize"`
+
+	first, last bson.MongoTimestamp
+	recent      int64 // entries after RECENT before the last
+}
+
+// measure reports on the oplog of sess
+func measure(sess *mgo.Session, since bson.MongoTimestamp) (*report, error) {
+	oplog := sess.DB("local").C("oplog.rs")
+	var stats oplogStats
+	if err := sess.DB("local").Run(bson.D{{Name: "collStats", Value: "oplog.rs"}}, &stats); err != nil {
+		return nil, err
+	}
+	if stats.MaxSize <= 0 || stats.Count == 0 {
+		return nil, fmt.Errorf("local.oplog.rs isn't a capped collection with entries, MONGO_URL must be a replica set member")
+	}
+	var first, last entry
+	if err := oplog.Find(nil).Select(bson.M{"ts": 1}).Sort("$natural").One(&first); err != nil {
+		return nil, err
+	}
+	if err := oplog.Find(nil).Select(bson.M{"ts": 1}).Sort("-$natural").One(&last); err != nil {
+		return nil, err
+	}
+	stats.first, stats.last = first.Timestamp, last.Timestamp
+	if *recent > 0 {
+		// the entries are counted, not read, sized as the average entry
+		after := bson.MongoTimestamp(optime.Time(last.Timestamp).Add(-*recent).Unix() << 32)
+		n, err := oplog.Find(bson.M{"ts": bson.M{"$gt": after}}).Count()
+		if err != nil {
+			return nil, err
+		}
+		stats.recent = int64(n)
+	}
+	return project(stats, *recent, since), nil
+}
+
+// project reports on an oplog measured as s, its recent rate over recent,
+// and on a consumer at since if it's not 0
+func project(s oplogStats, recent time.Duration, since bson.MongoTimestamp) *report {
+	firstAt, lastAt := optime.Time(s.first), optime.Time(s.last)
+	r := &report{
+		Size:    s.Size,
+		MaxSize: s.MaxSize,
+		Entries: s.Count,
+		First:   optime.Format(s.first),
+		Last:    optime.Format(s.last),
+		FirstAt: firstAt.UTC().Format(time.RFC3339),
+		LastAt:  lastAt.UTC().Format(time.RFC3339),
+		Window:  lastAt.Sub(firstAt).Seconds(),
+	}
+	if r.Window > 0 {
+		r.Average = float64(r.Size) / gb / (r.Window / 3600)
+	}
+	r.Rate = r.Average
+	if recent > 0 {
+		measured := recent
+		if span := lastAt.Sub(firstAt); span < measured {
+			measured = span
+		}
+		if measured > 0 {
+			r.Recent = float64(s.recent) * s.AvgObjSize / gb / measured.Hours()
+			r.Rate = r.Recent
+		}
+	}
+	if r.Rate <= 0 {
+		return r // nothing written to project from
+	}
+	if r.Size < r.MaxSize {
+		r.FullIn = float64(r.MaxSize-r.Size) / gb / r.Rate * 3600
+	}
+	// what's written from a position on pushes it out once it fills it
+	r.Downtime = float64(r.MaxSize) / gb / r.Rate * 3600
+	if since != 0 {
+		r.From = optime.Format(since)
+		if since < s.first {
+			r.RolledOff = true
+			return r
+		}
+		// what's after it, as much of the entries as of the window
+		after := 0.0
+		if r.Window > 0 {
+			after = float64(r.Size) * lastAt.Sub(optime.Time(since)).Seconds() / r.Window
+		}
+		if after < float64(r.MaxSize) {
+			r.FromLeft = (float64(r.MaxSize) - after) / gb / r.Rate * 3600
+		}
+	}
+	return r
+}
+
+func (r *report) print() {
+	fmt.Printf("oplog        %.2f GB of %.2f GB, %d entries\n", float64(r.Size)/gb, float64(r.MaxSize)/gb, r.Entries)
+	fmt.Printf("window       %s to %s, %s\n", r.FirstAt, r.LastAt, seconds(r.Window))
+	fmt.Printf("average      %.3f GB/hour over the window\n", r.Average)
+	if r.Recent > 0 {
+		fmt.Printf("recent       %.3f GB/hour over the last %s\n", r.Recent, *recent)
+	}
+	if r.Rate <= 0 {
+		fmt.Printf("nothing's being written to project from\n")
+		return
+	}
+	if r.FullIn > 0 {
+		fmt.Printf("full in      %s, the window growing until then\n", seconds(r.FullIn))
+	}
+	fmt.Printf("downtime     %s a consumer caught up can be down for\n", seconds(r.Downtime))
+	switch {
+	case r.RolledOff:
+		fmt.Printf("FROM         %s has already rolled off\n", r.From)
+	case r.From != "":
+		fmt.Printf("FROM         %s rolls off in %s\n", r.From, seconds(r.FromLeft))
+	}
+}
+
+// Main runs oplogctl window, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		panic(cli.Invalidf("unknown FORMAT %q", *format))
+	}
+	if *recent < 0 || *minDowntime < 0 {
+		panic(cli.Invalidf("RECENT and MIN_DOWNTIME can't be negative"))
+	}
+	since, err := optime.Parse(*from)
+	if err != nil {
+		panic(cli.Invalidf("FROM: %s", err))
+	}
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	if err := dial.CheckPrivileges(sess, privileges...); err != nil {
+		panic(err)
+	}
+	r, err := measure(sess, since)
+	if err != nil {
+		panic(err)
+	}
+	if *format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+			panic(err)
+		}
+	} else {
+		r.print()
+	}
+	left := r.Downtime
+	if r.From != "" {
+		left = r.FromLeft
+	}
+	if r.RolledOff || *minDowntime > 0 && r.Rate > 0 && seconds(left) < *minDowntime {
+		fmt.Fprintf(os.Stderr, "a consumer can be down for less than MIN_DOWNTIME %s\n", *minDowntime)
+		os.Exit(cli.ExitFailure)
+	}
+}
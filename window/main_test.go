@@ -0,0 +1,86 @@
+package window
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// at is the ts of start plus d
+func at(d time.Duration) bson.MongoTimestamp {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	return bson.MongoTimestamp(start.Add(d).Unix() << 32)
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6*math.Max(1, math.Abs(b))
+}
+
+func TestProject(t *testing.T) {
+	// 1 GB of 2 over 10 hours, 0.1 GB an hour
+	stats := oplogStats{Size: 1e9, MaxSize: 2e9, Count: 10000, AvgObjSize: 1e5, first: at(0), last: at(10 * time.Hour)}
+
+	r := project(stats, 0, 0)
+	if r.Window != 36000 || !near(r.Average, 0.1) || r.Rate != r.Average || r.Recent != 0 {
+		t.Errorf("window %g, average %g, rate %g, recent %g", r.Window, r.Average, r.Rate, r.Recent)
+	}
+	if !near(r.FullIn, 10*3600) || !near(r.Downtime, 20*3600) {
+		t.Errorf("full in %s, downtime %s, want 10h and 20h", seconds(r.FullIn), seconds(r.Downtime))
+	}
+	if r.First != "1714521600:0" || r.LastAt != "2024-05-01T10:00:00Z" {
+		t.Errorf("first %s, last at %s", r.First, r.LastAt)
+	}
+
+	// 3600 entries in the last hour, 0.36 GB an hour
+	stats.recent = 3600
+	r = project(stats, time.Hour, 0)
+	if !near(r.Recent, 0.36) || r.Rate != r.Recent {
+		t.Errorf("recent %g, rate %g, want 0.36", r.Recent, r.Rate)
+	}
+	if !near(r.Downtime, 2/0.36*3600) {
+		t.Errorf("downtime %s at the recent rate", seconds(r.Downtime))
+	}
+	// the window's shorter than RECENT, measured over the window
+	r = project(stats, 20*time.Hour, 0)
+	if !near(r.Recent, 0.036) {
+		t.Errorf("recent %g over a window shorter than RECENT, want 0.036", r.Recent)
+	}
+}
+
+func TestProjectFrom(t *testing.T) {
+	stats := oplogStats{Size: 1e9, MaxSize: 2e9, Count: 10000, first: at(0), last: at(10 * time.Hour)}
+	for _, c := range []struct {
+		since     bson.MongoTimestamp
+		left      float64
+		rolledOff bool
+	}{
+		// 0.5 GB after it of the 2 GB, 1.5 GB at 0.1 GB an hour
+		{at(5 * time.Hour), 15 * 3600, false},
+		{at(10 * time.Hour), 20 * 3600, false},
+		{at(0), 10 * 3600, false},
+		{at(-time.Second), 0, true},
+	} {
+		r := project(stats, 0, c.since)
+		if r.RolledOff != c.rolledOff || !near(r.FromLeft, c.left) || r.From == "" {
+			t.Errorf("from %d: rolled off %v, left %s, want %v, %s", c.since, r.RolledOff, seconds(r.FromLeft), c.rolledOff, seconds(c.left))
+		}
+	}
+
+	// full: a consumer mid-window has what's after it pushed out first
+	full := oplogStats{Size: 2e9, MaxSize: 2e9, Count: 10000, first: at(0), last: at(10 * time.Hour)}
+	r := project(full, 0, at(5*time.Hour))
+	if r.FullIn != 0 || !near(r.FromLeft, 5*3600) {
+		t.Errorf("full: full in %s, left %s, want 0 and 5h", seconds(r.FullIn), seconds(r.FromLeft))
+	}
+}
+
+func TestProjectIdle(t *testing.T) {
+	// one entry, nothing to measure a rate over
+	stats := oplogStats{Size: 100, MaxSize: 2e9, Count: 1, first: at(0), last: at(0)}
+	r := project(stats, time.Hour, at(0))
+	if r.Rate != 0 || r.Downtime != 0 || r.From != "" {
+		t.Errorf("rate %g, downtime %g, from %q, want nothing projected", r.Rate, r.Downtime, r.From)
+	}
+}
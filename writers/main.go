@@ -0,0 +1,228 @@
+// Package writers reports the namespaces writing the most to the oplog,
+// by the bytes of their entries, the oplogctl writers command.
+package writers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hanjoyo/oplog-abuse/cli"
+	"github.com/hanjoyo/oplog-abuse/dial"
+	"github.com/hanjoyo/oplog-abuse/optime"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var flags = cli.NewFlagSet("writers", "report the namespaces writing the most bytes and entries to the oplog over a window")
+
+func init() {
+	cli.Register(flags, Main)
+}
+
+var (
+	mongoURL = flags.String("MONGO_URL", "mongodb://localhost", "mongodb url of the replica set to measure the oplog of")
+	window   = flags.Duration("WINDOW", time.Hour, "the entries measured are the latest written over this long, unless FROM is set")
+	from     = flags.String("FROM", "", "measure entries after this ts, seconds[:increment] or RFC 3339")
+	to       = flags.String("TO", "", "measure entries up to this ts, up to the latest when started if empty")
+	rows     = flags.Int("ROWS", 20, "namespaces reported, the most bytes first, 0 for all of them")
+	format   = flags.String("FORMAT", "text", "text, or json for one namespace per line")
+)
+
+var privileges = []dial.Privilege{
+	{DB: "local", Collection: "oplog.rs", Actions: []string{"find"}},
+}
+
+type entry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Operation string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+	Object    bson.Raw            `bson:"o"`
+}
+
+// writer is what a namespace wrote
+type writer struct {
+	Namespace string           `json:"ns"`
+	Bytes     int64            `json:"bytes"`
+	Entries   int64            `json:"entries"`
+	Largest   int64            `json:"largest"` // bytes of its largest entry
+	Share     float64          `json:"share"`   // of all the bytes, from 0 to 1
+	ByOp      map[string]int64 `json:"bytes_by_op"`
+}
+
+// tally sums the writers of the entries measured
+type tally struct {
+	writers map[string]*writer
+	bytes   int64
+	entries int64
+}
+
+func (t *tally) add(ns, op string, size int64) {
+	w := t.writers[ns]
+	if w == nil {
+		w = &writer{Namespace: ns, ByOp: make(map[string]int64)}
+		t.writers[ns] = w
+	}
+	w.Bytes += size
+	w.Entries++
+	w.ByOp[op] += size
+	if size > w.Largest {
+		w.Largest = size
+	}
+}
+
+// entry sizes raw, a transaction's operations each counted as their
+// namespace's and what's around them as admin.$cmd's
+func (t *tally) entry(raw bson.Raw) error {
+	var e entry
+	if err := raw.Unmarshal(&e); err != nil {
+		return err
+	}
+	size := int64(len(raw.Data))
+	t.bytes += size
+	t.entries++
+	var txn struct {
+		ApplyOps []bson.Raw `bson:"applyOps"`
+	}
+	if e.Operation == "c" && e.Object.Kind == 3 {
+		if err := e.Object.Unmarshal(&txn); err != nil {
+			return err
+		}
+	}
+	for _, op := range txn.ApplyOps {
+		var inner entry
+		if err := op.Unmarshal(&inner); err != nil {
+			return err
+		}
+		opSize := int64(len(op.Data))
+		t.add(inner.Namespace, inner.Operation, opSize)
+		size -= opSize
+	}
+	ns := e.Namespace
+	if ns == "" {
+		ns = "(none)" // the primary's periodic noops
+	}
+	t.add(ns, e.Operation, size)
+	return nil
+}
+
+// top returns the writers, the most bytes first
+func (t *tally) top() []*writer {
+	list := make([]*writer, 0, len(t.writers))
+	for _, w := range t.writers {
+		if t.bytes > 0 {
+			w.Share = float64(w.Bytes) / float64(t.bytes)
+		}
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Namespace < list[j].Namespace
+	})
+	return list
+}
+
+// bytesString writes n in the largest unit it's at least one of
+func bytesString(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	v, u := float64(n), 0
+	for v >= 1000 && u < len(units)-1 {
+		v, u = v/1000, u+1
+	}
+	if u == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", v, units[u])
+}
+
+// Main runs oplogctl writers, args overriding the environment
+func Main(args []string) {
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		panic(cli.Invalidf("unknown FORMAT %q", *format))
+	}
+	if *window <= 0 || *rows < 0 {
+		panic(cli.Invalidf("WINDOW must be positive and ROWS can't be negative"))
+	}
+	since, err := optime.Parse(*from)
+	if err != nil {
+		panic(cli.Invalidf("FROM: %s", err))
+	}
+	until, err := optime.Parse(*to)
+	if err != nil {
+		panic(cli.Invalidf("TO: %s", err))
+	}
+	sess, err := dial.Dial(*mongoURL)
+	if err != nil {
+		panic(err)
+	}
+	if err := dial.CheckPrivileges(sess, privileges...); err != nil {
+		panic(err)
+	}
+	oplog := sess.DB("local").C("oplog.rs")
+	if until == 0 {
+		var latest entry
+		if err := oplog.Find(nil).Select(bson.M{"ts": 1}).Sort("-$natural").One(&latest); err != nil {
+			panic(err)
+		}
+		until = latest.Timestamp
+	}
+	if since == 0 {
+		since = bson.MongoTimestamp(optime.Time(until).Add(-*window).Unix() << 32)
+	}
+
+	t := &tally{writers: make(map[string]*writer)}
+	iter := oplog.Find(bson.M{"ts": bson.M{"$gt": since, "$lte": until}}).Sort("$natural").LogReplay().Iter()
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		if err := t.entry(raw); err != nil {
+			panic(err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		panic(err)
+	}
+
+	list := t.top()
+	more := 0
+	if *rows > 0 && len(list) > *rows {
+		list, more = list[:*rows], len(list)-*rows
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, w := range list {
+			if err := enc.Encode(w); err != nil {
+				panic(err)
+			}
+		}
+		return
+	}
+	fmt.Printf("%s over %d entries, %s to %s\n\n", bytesString(t.bytes), t.entries, optime.Time(since).UTC().Format(time.RFC3339), optime.Time(until).UTC().Format(time.RFC3339))
+	width := len("ns")
+	for _, w := range list {
+		if len(w.Namespace) > width {
+			width = len(w.Namespace)
+		}
+	}
+	fmt.Printf("%-*s %10s %6s %10s %10s %10s  %s\n", width, "ns", "bytes", "share", "entries", "average", "largest", "bytes by op")
+	for _, w := range list {
+		ops := make([]string, 0, len(w.ByOp))
+		for op := range w.ByOp {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		byOp := ""
+		for _, op := range ops {
+			byOp += fmt.Sprintf(" %s=%s", op, bytesString(w.ByOp[op]))
+		}
+		fmt.Printf("%-*s %10s %5.1f%% %10d %10s %10s %s\n", width, w.Namespace, bytesString(w.Bytes), w.Share*100, w.Entries,
+			bytesString(w.Bytes/w.Entries), bytesString(w.Largest), byOp)
+	}
+	if more > 0 {
+		fmt.Printf("(%d more)\n", more)
+	}
+}
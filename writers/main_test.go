@@ -0,0 +1,106 @@
+package writers
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// raw marshals v as an oplog entry as read
+func raw(t *testing.T, v interface{}) bson.Raw {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bson.Raw{Kind: 3, Data: data}
+}
+
+func TestTally(t *testing.T) {
+	tl := &tally{writers: make(map[string]*writer)}
+	insert := raw(t, bson.D{{Name: "op", Value: "i"}, {Name: "ns", Value: "app.users"}, {Name: "o", Value: bson.M{"_id": 1, "name": "ada"}}})
+	update := raw(t, bson.D{{Name: "op", Value: "u"}, {Name: "ns", Value: "app.users"}, {Name: "o", Value: bson.M{"$set": bson.M{"name": "ada lovelace"}}}})
+	noop := raw(t, bson.D{{Name: "op", Value: "n"}, {Name: "ns", Value: ""}, {Name: "o", Value: bson.M{"msg": "periodic noop"}}})
+	inner := []bson.D{
+		{{Name: "op", Value: "i"}, {Name: "ns", Value: "app.orders"}, {Name: "o", Value: bson.M{"_id": 7}}},
+		{{Name: "op", Value: "d"}, {Name: "ns", Value: "app.users"}, {Name: "o", Value: bson.M{"_id": 1}}},
+	}
+	txn := raw(t, bson.D{{Name: "op", Value: "c"}, {Name: "ns", Value: "admin.$cmd"}, {Name: "o", Value: bson.M{"applyOps": inner}}})
+	for _, r := range []bson.Raw{insert, update, noop, txn} {
+		if err := tl.entry(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := func(r bson.Raw) int64 { return int64(len(r.Data)) }
+	ops := make([]int64, len(inner))
+	for i, d := range inner {
+		ops[i] = size(raw(t, d))
+	}
+	if want := size(insert) + size(update) + size(noop) + size(txn); tl.bytes != want || tl.entries != 4 {
+		t.Errorf("%d bytes over %d entries, want %d over 4", tl.bytes, tl.entries, want)
+	}
+
+	users := tl.writers["app.users"]
+	if users.Bytes != size(insert)+size(update)+ops[1] || users.Entries != 3 || users.ByOp["d"] != ops[1] {
+		t.Errorf("app.users %+v", users)
+	}
+	if users.Largest != size(update) {
+		t.Errorf("app.users' largest %d, want the update's %d", users.Largest, size(update))
+	}
+	if w := tl.writers["app.orders"]; w.Bytes != ops[0] || w.ByOp["i"] != ops[0] {
+		t.Errorf("app.orders %+v, want the transaction's insert", w)
+	}
+	// what's around the operations is the transaction's own
+	if w := tl.writers["admin.$cmd"]; w.Bytes != size(txn)-ops[0]-ops[1] || w.ByOp["c"] != w.Bytes {
+		t.Errorf("admin.$cmd %+v", w)
+	}
+	if w := tl.writers["(none)"]; w == nil || w.Bytes != size(noop) {
+		t.Errorf("noops %+v", w)
+	}
+
+	var sum int64
+	var share float64
+	list := tl.top()
+	for i, w := range list {
+		sum += w.Bytes
+		share += w.Share
+		if i > 0 && list[i-1].Bytes < w.Bytes {
+			t.Errorf("%s before %s, with fewer bytes", list[i-1].Namespace, w.Namespace)
+		}
+	}
+	if sum != tl.bytes || share < 0.999999 || share > 1.000001 {
+		t.Errorf("writers sum to %d bytes and a share of %g, of %d", sum, share, tl.bytes)
+	}
+}
+
+func TestTopTies(t *testing.T) {
+	tl := &tally{writers: make(map[string]*writer)}
+	tl.add("app.b", "i", 10)
+	tl.add("app.a", "i", 10)
+	tl.add("app.c", "i", 20)
+	var names []string
+	for _, w := range tl.top() {
+		names = append(names, w.Namespace)
+	}
+	if len(names) != 3 || names[0] != "app.c" || names[1] != "app.a" || names[2] != "app.b" {
+		t.Errorf("%v, want the most bytes first then by name", names)
+	}
+}
+
+func TestBytesString(t *testing.T) {
+	for _, c := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1000, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{2500000, "2.5 MB"},
+		{3e12, "3.0 TB"},
+		{4e15, "4000.0 TB"},
+	} {
+		if got := bytesString(c.n); got != c.want {
+			t.Errorf("%d: %s, want %s", c.n, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Package ws speaks RFC 6455 websockets, enough of them for a subprotocol
+// of text messages such as graphql-transport-ws: Upgrade takes a server's
+// connection over, Dial opens a client's. Pings are answered as they're
+// read, fragmented messages joined, extensions refused.
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// opcodes
+const (
+	opContinuation = 0
+	opText         = 1
+	opBinary       = 2
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// close codes
+const (
+	CloseNormal   = 1000
+	CloseProtocol = 1002
+	CloseTooBig   = 1009
+)
+
+// MaxMessage is the largest message read, bigger ones close the connection
+const MaxMessage = 1 << 20
+
+// writeTimeout bounds writing a frame
+const writeTimeout = 10 * time.Second
+
+// accept is the key the handshake's answer is made of
+const accept = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// CloseError is the close frame a connection was ended by
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed, %d %s", e.Code, e.Reason)
+}
+
+// Conn is a websocket connection. Reads are for one goroutine, writes for
+// any.
+type Conn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	client   bool // masks what it writes
+	Protocol string
+
+	mu     sync.Mutex // writes
+	closed bool
+}
+
+// acceptKey answers the handshake's Sec-WebSocket-Key
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + accept))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerHas reports whether the comma separated header holds token
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUpgrade reports whether r asks for a websocket
+func IsUpgrade(r *http.Request) bool {
+	return headerHas(r.Header, "Connection", "upgrade") && headerHas(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade answers r's handshake for the subprotocol, which the client has
+// to ask for, and takes the connection over. Failing it answers r.
+func Upgrade(w http.ResponseWriter, r *http.Request, protocol string) (*Conn, error) {
+	var err error
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != "GET" || !IsUpgrade(r):
+		err = errors.New("not a websocket handshake")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		err = errors.New("websocket version 13 only")
+	case key == "":
+		err = errors.New("no Sec-WebSocket-Key")
+	case !headerHas(r.Header, "Sec-WebSocket-Protocol", protocol):
+		err = fmt.Errorf("the %s subprotocol only", protocol)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets aren't supported", http.StatusInternalServerError)
+		return nil, errors.New("ws: connection can't be taken over")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: %s\r\n\r\n", acceptKey(key), protocol)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &Conn{conn: conn, r: rw.Reader, Protocol: protocol}, nil
+}
+
+// Dial opens a websocket to rawurl, ws:// or http://, asking for the
+// subprotocol
+func Dial(rawurl, protocol string) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws", "http":
+	default:
+		return nil, fmt.Errorf("ws: %q must be ws:// or http://", rawurl)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	conn, err := net.DialTimeout("tcp", host, writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{Method: "GET", URL: u, Host: u.Host, Header: http.Header{
+		"Upgrade":                {"websocket"},
+		"Connection":             {"Upgrade"},
+		"Sec-Websocket-Key":      {key},
+		"Sec-Websocket-Version":  {"13"},
+		"Sec-Websocket-Protocol": {protocol},
+	}}
+	conn.SetDeadline(time.Now().Add(writeTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("ws: %s refused the handshake, %s", rawurl, res.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &Conn{conn: conn, r: r, client: true, Protocol: res.Header.Get("Sec-WebSocket-Protocol")}, nil
+}
+
+// Read returns the next text or binary message, answering pings on the
+// way. A close frame is answered and returned as a *CloseError.
+func (c *Conn) Read() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, op, payload, err := c.frame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.write(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			e := &CloseError{Code: 1005} // no status
+			if len(payload) >= 2 {
+				e.Code, e.Reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+			}
+			c.Close(e.Code, "")
+			return nil, e
+		case opText, opBinary:
+			if started {
+				return nil, c.fail(CloseProtocol, "a message inside another")
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, c.fail(CloseProtocol, "a continuation of nothing")
+			}
+		default:
+			return nil, c.fail(CloseProtocol, fmt.Sprintf("opcode %d", op))
+		}
+		if len(msg)+len(payload) > MaxMessage {
+			return nil, c.fail(CloseTooBig, "message too big")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// frame reads a frame, unmasking what a client sent
+func (c *Conn) frame() (bool, byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op, masked := h[0]&0x80 != 0, h[0]&0x0f, h[1]&0x80 != 0
+	if h[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocol, "no extensions were agreed")
+	}
+	if masked == c.client {
+		return false, 0, nil, c.fail(CloseProtocol, "clients mask their frames, servers don't")
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= opClose && (n > 125 || !fin) {
+		return false, 0, nil, c.fail(CloseProtocol, "control frames are short and whole")
+	}
+	if n > MaxMessage {
+		return false, 0, nil, c.fail(CloseTooBig, "message too big")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// fail closes the connection over what the peer did wrong
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return &CloseError{code, reason}
+}
+
+// WriteText sends a text message
+func (c *Conn) WriteText(msg []byte) error {
+	return c.write(opText, msg)
+}
+
+func (c *Conn) write(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errors.New("ws: connection closed")
+	}
+	return c.writeFrame(op, payload)
+}
+
+// writeFrame writes a whole frame, c.mu held
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	frame := []byte{0x80 | op}
+	var bit byte
+	if c.client {
+		bit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, bit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, bit|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, bit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame of code and reason and closes the connection,
+// once
+func (c *Conn) Close(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	c.writeFrame(opClose, append(payload, reason...))
+	return c.conn.Close()
+}
@@ -0,0 +1,147 @@
+package ws
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// RFC 6455's example
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("accept key %s", got)
+	}
+}
+
+// echo serves a websocket echoing what it's sent until it's closed
+func echo(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, "echo")
+		if err != nil {
+			return
+		}
+		for {
+			msg, err := conn.Read()
+			if err != nil {
+				return
+			}
+			conn.WriteText(msg)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestEcho(t *testing.T) {
+	s := echo(t)
+	c, err := Dial(s.URL, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Protocol != "echo" {
+		t.Errorf("subprotocol %q", c.Protocol)
+	}
+	// lengths of each of the three sizes of frame
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		msg := bytes.Repeat([]byte{'x'}, n)
+		if err := c.WriteText(msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("%d bytes echoed as %d", n, len(got))
+		}
+	}
+	// a ping's answered as it's read, the message then echoed
+	c.mu.Lock()
+	c.writeFrame(opPing, []byte("hi"))
+	c.mu.Unlock()
+	c.WriteText([]byte("after"))
+	if got, err := c.Read(); err != nil || string(got) != "after" {
+		t.Errorf("read %q, %v after a ping", got, err)
+	}
+
+	c.Close(CloseNormal, "bye")
+	if err := c.WriteText([]byte("x")); err == nil {
+		t.Error("wrote to a closed connection")
+	}
+}
+
+func TestFragments(t *testing.T) {
+	s := echo(t)
+	c, err := Dial(s.URL, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(CloseNormal, "")
+	c.mu.Lock()
+	c.conn.Write(masked(0x00|opText, []byte("frag")))
+	c.conn.Write(masked(0x80|opPing, nil)) // control frames may come between
+	c.conn.Write(masked(0x80|opContinuation, []byte("ments")))
+	c.mu.Unlock()
+	if got, err := c.Read(); err != nil || string(got) != "fragments" {
+		t.Errorf("read %q, %v of two fragments", got, err)
+	}
+}
+
+// masked is a short frame as a client sends it
+func masked(b0 byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{b0, 0x80 | byte(len(payload))}, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+func TestProtocolErrors(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		frame []byte
+		code  int
+	}{
+		{"unmasked", []byte{0x80 | opText, 1, 'x'}, CloseProtocol},
+		{"extension bit", masked(0xc0|opText, []byte("x")), CloseProtocol},
+		{"continuation of nothing", masked(0x80|opContinuation, []byte("x")), CloseProtocol},
+		{"fragmented ping", masked(opPing, nil), CloseProtocol},
+		{"unknown opcode", masked(0x80|3, nil), CloseProtocol},
+		{"too big", []byte{0x80 | opText, 0x80 | 127, 0, 0, 0, 0, 0x10, 0, 0, 0}, CloseTooBig},
+	} {
+		s := echo(t)
+		conn, err := Dial(s.URL, "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.conn.Write(c.frame)
+		_, err = conn.Read()
+		var ce *CloseError
+		if !errors.As(err, &ce) || ce.Code != c.code {
+			t.Errorf("%s: read %v, want a close of %d", c.name, err, c.code)
+		}
+		conn.conn.Close()
+	}
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	s := echo(t)
+	if _, err := Dial(s.URL, "other"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("dialed another subprotocol with %v", err)
+	}
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("a plain GET answered %s", res.Status)
+	}
+	if _, err := Dial("wss://localhost", "echo"); err == nil {
+		t.Error("dialed wss://")
+	}
+}